@@ -0,0 +1,155 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// LoginOptions are the optional parameters of StartLogin().
+type LoginOptions struct {
+	Metadata gomagiclink.ChallengeMetadata // Passed to the sender, e.g. for selecting the template
+	ProofKey json.RawMessage               // Client's public key as a JWK, to bind the session to it (see gomagiclink.WithProofOfPossession())
+	// VerifyURL replaces AuthHandlers.VerifyURL in the magic link, e.g. to carry the state
+	// of a larger flow through the login in its query parameters, which are signed.
+	VerifyURL string
+	// Next is substituted for {next} in the controller's verify URL template (see
+	// gomagiclink.WithVerifyURLTemplate()), when the template is used.
+	Next string
+}
+
+// StartLogin is the first half of the login flow, for apps with their own handlers:
+// it generates a challenge for the e-mail address, and sends the signed magic link
+// with the sender. The receipt describes the sent challenge. With SameDevice, pass it
+// to SetSameDeviceCookie().
+func (h *AuthHandlers) StartLogin(ctx context.Context, email string, opts LoginOptions) (receipt *gomagiclink.ChallengeReceipt, err error) {
+	var challenge string
+	if opts.ProofKey != nil {
+		challenge, receipt, err = h.mlc.GenerateChallengeWithProofKey(email, opts.ProofKey, opts.Metadata)
+	} else {
+		challenge, receipt, err = h.mlc.GenerateChallengeWithReceipt(email, opts.Metadata)
+	}
+	if err != nil {
+		return nil, err
+	}
+	verifyURL := h.VerifyURL
+	if opts.VerifyURL != "" {
+		verifyURL = opts.VerifyURL
+	}
+	if err = h.sendLink(ctx, verifyURL, opts.Next, challenge, receipt, opts.Metadata); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// CompleteLogin is the second half of the login flow, for the request of the magic
+// link: it verifies the link's signature, the pre-auth cookie (with SameDevice) and the challenge, calls OnLogin, stores the
+// user record, and issues the session (reusing the one in the session cookie, if it's
+// still valid for the user) and sets the session cookie. If refresh tokens are enabled
+// (see gomagiclink.WithRefreshTokens()), it also sets the refresh cookie. It returns the
+// gomagiclink errors, e.g. ErrExpiredChallenge, for the app to handle.
+func (h *AuthHandlers) CompleteLogin(w http.ResponseWriter, r *http.Request) (user *gomagiclink.AuthUserRecord, sessionId string, err error) {
+	user, sessionId, _, err = h.completeLogin(w, r)
+	return
+}
+
+// completeLogin is CompleteLogin(), also returning the refresh token, if one was issued.
+func (h *AuthHandlers) completeLogin(w http.ResponseWriter, r *http.Request) (user *gomagiclink.AuthUserRecord, sessionId string, refreshToken string, err error) {
+	challenge := h.mlc.ChallengeFromURL(r.URL)
+	if challenge == "" {
+		return nil, "", "", gomagiclink.ErrInvalidChallenge
+	}
+	if err = h.signer.VerifyURL(r.URL); err != nil {
+		return nil, "", "", err
+	}
+	if h.SameDevice {
+		token := ""
+		if cookie, err := r.Cookie(h.SameDeviceCookieName); err == nil {
+			token = cookie.Value
+		}
+		if err = h.mlc.VerifySameDeviceToken(challenge, token); err != nil {
+			return nil, "", "", err
+		}
+	}
+	user, err = h.mlc.VerifyChallenge(challenge)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if h.SameDevice {
+		h.clearSameDeviceCookie(w)
+	}
+	if h.OnLogin != nil {
+		if err = h.OnLogin(user); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if err = h.mlc.StoreUser(user); err != nil {
+		return nil, "", "", err
+	}
+	existingSessionId := ""
+	if cookie, err := r.Cookie(h.CookieName); err == nil {
+		existingSessionId = cookie.Value
+	}
+	sessionId, _, err = h.mlc.ReuseOrGenerateSessionId(user, existingSessionId)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if h.mlc.RefreshTokenLifetime() > 0 && !user.TOTPPending {
+		if refreshToken, err = h.mlc.GenerateRefreshToken(user); err != nil {
+			return nil, "", "", err
+		}
+		h.setRefreshCookie(w, refreshToken)
+	}
+	h.setSessionCookie(w, user, sessionId)
+	return user, sessionId, refreshToken, nil
+}
+
+// setSessionCookie sets the session cookie to the user's new session ID.
+func (h *AuthHandlers) setSessionCookie(w http.ResponseWriter, user *gomagiclink.AuthUserRecord, sessionId string) {
+	maxAge := h.CookieMaxAge
+	if user.SessionLifetime > 0 && (maxAge == 0 || user.SessionLifetime < maxAge) {
+		// Shortened by the session lifetime policy
+		maxAge = user.SessionLifetime
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.CookieName,
+		Value:    sessionId,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   h.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SetSameDeviceCookie sets the pre-auth cookie for the challenge described by the receipt,
+// if SameDevice is set. It lasts until the challenge expires.
+func (h *AuthHandlers) SetSameDeviceCookie(w http.ResponseWriter, receipt *gomagiclink.ChallengeReceipt) {
+	if !h.SameDevice {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.SameDeviceCookieName,
+		Value:    h.mlc.SameDeviceToken(receipt),
+		Path:     "/",
+		MaxAge:   max(int(time.Until(receipt.ExpiresAt).Seconds()), 1),
+		Secure:   h.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSameDeviceCookie deletes the pre-auth cookie after the login.
+func (h *AuthHandlers) clearSameDeviceCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.SameDeviceCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   h.CookieSecure,
+		HttpOnly: true,
+	})
+}
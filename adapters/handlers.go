@@ -0,0 +1,430 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// AuthHandlers implements the magic link login flow as HTTP handlers, which serve both
+// server-rendered pages and single-page apps: requests with "Accept: application/json"
+// get JSON responses (errors have a machine-readable code), while the others get
+// redirects. Fields can be changed after NewAuthHandlers(), before serving requests.
+type AuthHandlers struct {
+	mlc    *gomagiclink.AuthMagicLinkController
+	sender gomagiclink.MagicLinkSender
+	signer *gomagiclink.URLSigner
+
+	VerifyURL    string        // Absolute URL of the Verify() handler, used in the magic links; if empty, the controller's verify URL template is used (see gomagiclink.WithVerifyURLTemplate())
+	CookieName   string        // Name of the session cookie, default "session"
+	CookieMaxAge time.Duration // 0 for a browser-session cookie
+	CookieSecure bool          // Set the Secure flag on the session cookie
+	// Name of the refresh cookie, default "refresh"; it's only set if refresh tokens are
+	// enabled (see gomagiclink.WithRefreshTokens())
+	RefreshCookieName string
+	ChallengeSentURL  string         // Where browsers are redirected after requesting a magic link, default "/"
+	LoggedInURL       string         // Where browsers are redirected after verification, default "/"
+	TOTPURL           string         // Where browsers are redirected after verification if the user needs to enter a TOTP code, default LoggedInURL
+	LoggedOutURL      string         // Where browsers are redirected after logout, default "/"
+	ErrorURL          string         // Where browsers are redirected on errors, with the "error" parameter set to the error code; if empty, a plain text error is returned
+	Realm             string         // Realm in the WWW-Authenticate header of RequireSession()'s 401 responses, optional
+	Messages          MessageCatalog // Messages in JSON and plain text error responses, in the language of the request's Accept-Language header, default DefaultMessageCatalog
+	Logger            *slog.Logger   // Receives unexpected errors
+
+	// If SameDevice is set, magic links only work in the browser which requested them:
+	// Login() and Resend() set a HttpOnly pre-auth cookie (named SameDeviceCookieName,
+	// default "magiclink_device") for the challenge, which Verify() requires (see
+	// gomagiclink.SameDeviceToken()). Users opening the link on another device, e.g. their
+	// phone, get ErrorCodeDeviceMismatch, so offer login codes to them instead. Only the
+	// most recently requested link works in each browser.
+	SameDevice           bool
+	SameDeviceCookieName string
+
+	// OnLogin is called after verification, before the user record is stored, e.g. to
+	// set custom data. An error fails the login.
+	OnLogin func(user *gomagiclink.AuthUserRecord) error
+}
+
+// NewAuthHandlers creates AuthHandlers which send magic links pointing to verifyURL
+// with the sender. The magic links are signed with an URLSigner derived from the
+// controller's secret key.
+func NewAuthHandlers(mlc *gomagiclink.AuthMagicLinkController, sender gomagiclink.MagicLinkSender, verifyURL string) *AuthHandlers {
+	return &AuthHandlers{
+		mlc:                  mlc,
+		sender:               sender,
+		signer:               mlc.NewURLSigner(),
+		VerifyURL:            verifyURL,
+		CookieName:           "session",
+		RefreshCookieName:    "refresh",
+		SameDeviceCookieName: "magiclink_device",
+		ChallengeSentURL:     "/",
+		LoggedInURL:          "/",
+		LoggedOutURL:         "/",
+		Messages:             DefaultMessageCatalog,
+	}
+}
+
+// Error codes in JSON error responses and error redirects.
+const (
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeInvalidLink        = "invalid_link"
+	ErrorCodeInvalidChallenge   = "invalid_challenge"
+	ErrorCodeExpiredChallenge   = "expired_challenge"
+	ErrorCodeUsedChallenge      = "used_challenge"
+	ErrorCodeEmailRequired      = "email_required"
+	ErrorCodeUserDisabled       = "user_disabled"
+	ErrorCodeUserLocked         = "user_locked"
+	ErrorCodeRiskDenied         = "risk_denied"
+	ErrorCodeTooManySessions    = "too_many_sessions"
+	ErrorCodeTOTPRequired       = "totp_required"
+	ErrorCodeEmailUndeliverable = "email_undeliverable"
+	ErrorCodeInvalidTOTPCode    = "invalid_totp_code"
+	ErrorCodeStorageUnavailable = "storage_unavailable"
+	ErrorCodeRateLimited        = "rate_limited"
+	ErrorCodeResendTooSoon      = "resend_too_soon"
+	ErrorCodeDomainNotAllowed   = "domain_not_allowed"
+	ErrorCodeDeviceMismatch     = "device_mismatch"
+	ErrorCodeInsufficientScope  = "insufficient_scope"
+	ErrorCodeSessionRequired    = "session_required"
+	ErrorCodeInvalidSession     = "invalid_session"
+	ErrorCodeInternal           = "internal_error"
+)
+
+// ErrorCode maps the error from the controller to an ErrorCode* code and a HTTP status,
+// e.g. for rendering errors of the login flow with a MessageCatalog.
+func ErrorCode(err error) (code string, status int) {
+	switch err {
+	case gomagiclink.ErrInvalidChallenge, gomagiclink.ErrBrokenChallenge, gomagiclink.ErrWrongAudience:
+		return ErrorCodeInvalidChallenge, http.StatusBadRequest
+	case gomagiclink.ErrExpiredChallenge:
+		return ErrorCodeExpiredChallenge, http.StatusBadRequest
+	case gomagiclink.ErrUsedChallenge:
+		return ErrorCodeUsedChallenge, http.StatusBadRequest
+	case gomagiclink.ErrEmailRequired:
+		return ErrorCodeEmailRequired, http.StatusBadRequest
+	case gomagiclink.ErrInvalidURLSignature, gomagiclink.ErrBrokenURLSignature:
+		return ErrorCodeInvalidLink, http.StatusBadRequest
+	case gomagiclink.ErrUserDisabled:
+		return ErrorCodeUserDisabled, http.StatusForbidden
+	case gomagiclink.ErrUserLocked:
+		return ErrorCodeUserLocked, http.StatusForbidden
+	case gomagiclink.ErrRiskDenied, gomagiclink.ErrRiskChallengeRequired:
+		return ErrorCodeRiskDenied, http.StatusForbidden
+	case gomagiclink.ErrEmailDomainNotAllowed:
+		return ErrorCodeDomainNotAllowed, http.StatusForbidden
+	case gomagiclink.ErrDeviceMismatch:
+		return ErrorCodeDeviceMismatch, http.StatusForbidden
+	case gomagiclink.ErrEmailUndeliverable:
+		return ErrorCodeEmailUndeliverable, http.StatusUnprocessableEntity
+	case gomagiclink.ErrTOTPRequired:
+		return ErrorCodeTOTPRequired, http.StatusUnauthorized
+	case gomagiclink.ErrInvalidTOTPCode:
+		return ErrorCodeInvalidTOTPCode, http.StatusBadRequest
+	case gomagiclink.ErrTooManySessions:
+		return ErrorCodeTooManySessions, http.StatusConflict
+	case gomagiclink.ErrInvalidEmail, gomagiclink.ErrEmptyEmail, gomagiclink.ErrInvalidProofKey, gomagiclink.ErrProofOfPossessionDisabled,
+		gomagiclink.ErrRefreshTokensDisabled:
+		return ErrorCodeBadRequest, http.StatusBadRequest
+	case gomagiclink.ErrInvalidSessionId, gomagiclink.ErrBrokenSessionId, gomagiclink.ErrExpiredSessionId,
+		gomagiclink.ErrSessionNotFound, gomagiclink.ErrProofRequired, gomagiclink.ErrInvalidRefreshToken,
+		gomagiclink.ErrInvalidAPIToken, gomagiclink.ErrAPITokensDisabled:
+		return ErrorCodeInvalidSession, http.StatusUnauthorized
+	case gomagiclink.ErrResendTooSoon:
+		return ErrorCodeResendTooSoon, http.StatusTooManyRequests
+	case gomagiclink.ErrStorageUnavailable, gomagiclink.ErrRevocationListStale:
+		return ErrorCodeStorageUnavailable, http.StatusServiceUnavailable
+	}
+	return ErrorCodeInternal, http.StatusInternalServerError
+}
+
+// WantsJSON returns true if the request prefers a JSON response, according to its Accept header.
+func WantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *AuthHandlers) fail(w http.ResponseWriter, r *http.Request, err error, code string, status int) {
+	if err != nil {
+		code, status = ErrorCode(err)
+		if status == http.StatusInternalServerError && h.Logger != nil {
+			h.Logger.Error("Error in auth handler", "path", r.URL.Path, "error", err)
+		}
+	}
+	if h.ErrorURL != "" && !WantsJSON(r) {
+		http.Redirect(w, r, h.ErrorURL+"?error="+url.QueryEscape(code), http.StatusSeeOther)
+		return
+	}
+	writeError(w, r, h.Messages, code, status)
+}
+
+// writeError writes the error response with the code and its message from the catalog,
+// as JSON if the request prefers it, or as plain text.
+func writeError(w http.ResponseWriter, r *http.Request, messages MessageCatalog, code string, status int) {
+	msg, lang := http.StatusText(status), ""
+	if messages != nil {
+		msg, lang = messages.Localize(r, code)
+	}
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	if WantsJSON(r) {
+		writeJSON(w, status, map[string]any{"error": map[string]string{"code": code, "message": msg}})
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// Login returns the handler which accepts the user's e-mail address (the "email" form
+// field, or a JSON object with an "email" field), and sends them a magic link. JSON
+// requests can also have a "proof_key" field with the client's public key as a JWK, to
+// bind the session to it (see gomagiclink.WithProofOfPossession()). If the challenge is
+// suppressed for a blocked user (see gomagiclink.WithBlockedUserChallenges()), the
+// response is the same as if the magic link was sent.
+func (h *AuthHandlers) Login() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, proofKey, ok := h.readLoginRequest(w, r)
+		if !ok {
+			return
+		}
+		receipt, err := h.StartLogin(r.Context(), email, LoginOptions{ProofKey: proofKey})
+		if err == gomagiclink.ErrChallengeSuppressed {
+			receipt, err = h.mlc.DecoyReceipt(email)
+		}
+		if err != nil {
+			h.fail(w, r, err, "", 0)
+			return
+		}
+		h.SetSameDeviceCookie(w, receipt)
+		h.sent(w, r, "sent", receipt)
+	})
+}
+
+// Resend returns the handler for "Didn't get the e-mail? Resend" buttons. It accepts the
+// same requests as Login(), and sends the most recent unexpired magic link to the address
+// again (see gomagiclink.ResendChallenge()), or a new one if there isn't one. Requests
+// within the controller's resend interval fail with ErrorCodeResendTooSoon. The link
+// always points to VerifyURL (or the verify URL template), without the {next} value.
+func (h *AuthHandlers) Resend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, proofKey, ok := h.readLoginRequest(w, r)
+		if !ok {
+			return
+		}
+		rec, err := h.mlc.ResendChallenge(email)
+		if err == gomagiclink.ErrChallengeNotFound || err == gomagiclink.ErrNoChallengeStore || err == gomagiclink.ErrChallengeSuppressed {
+			receipt, err := h.StartLogin(r.Context(), email, LoginOptions{ProofKey: proofKey})
+			if err == gomagiclink.ErrChallengeSuppressed {
+				receipt, err = h.mlc.DecoyReceipt(email)
+			}
+			if err != nil {
+				h.fail(w, r, err, "", 0)
+				return
+			}
+			h.SetSameDeviceCookie(w, receipt)
+			h.sent(w, r, "sent", receipt)
+			return
+		}
+		if err != nil {
+			h.fail(w, r, err, "", 0)
+			return
+		}
+		receipt := rec.Receipt()
+		if err = h.sendLink(r.Context(), h.VerifyURL, "", rec.Challenge, receipt, rec.Metadata); err != nil {
+			h.fail(w, r, err, "", 0)
+			return
+		}
+		h.SetSameDeviceCookie(w, receipt)
+		h.sent(w, r, "resent", receipt)
+	})
+}
+
+// readLoginRequest reads the e-mail address and the optional proof key from a POST
+// request to Login() or Resend(). It fails the request and returns false if it's invalid.
+func (h *AuthHandlers) readLoginRequest(w http.ResponseWriter, r *http.Request) (email string, proofKey json.RawMessage, ok bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.fail(w, r, nil, ErrorCodeBadRequest, http.StatusMethodNotAllowed)
+		return "", nil, false
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		var body struct {
+			Email    string          `json:"email"`
+			ProofKey json.RawMessage `json:"proof_key"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			h.fail(w, r, nil, ErrorCodeBadRequest, http.StatusBadRequest)
+			return "", nil, false
+		}
+		email, proofKey = body.Email, body.ProofKey
+	} else {
+		email = r.FormValue("email")
+	}
+	if !strings.Contains(email, "@") {
+		h.fail(w, r, nil, ErrorCodeBadRequest, http.StatusBadRequest)
+		return "", nil, false
+	}
+	return email, proofKey, true
+}
+
+// sent responds to a request which sent a magic link: JSON requests get the status,
+// and browsers are redirected to ChallengeSentURL.
+func (h *AuthHandlers) sent(w http.ResponseWriter, r *http.Request, status string, receipt *gomagiclink.ChallengeReceipt) {
+	if WantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]any{"status": status, "expires_at": receipt.ExpiresAt})
+		return
+	}
+	http.Redirect(w, r, h.ChallengeSentURL, http.StatusSeeOther)
+}
+
+// sendLink signs the magic link to verifyURL (or built from the controller's verify URL
+// template if it's empty) for the challenge, and sends it.
+func (h *AuthHandlers) sendLink(ctx context.Context, verifyURL string, next string, challenge string, receipt *gomagiclink.ChallengeReceipt, meta gomagiclink.ChallengeMetadata) error {
+	var link string
+	var err error
+	if verifyURL != "" {
+		link, err = gomagiclink.BuildMagicLink(verifyURL, challenge)
+	} else {
+		link, err = h.mlc.BuildMagicLinkURL(challenge, next)
+	}
+	if err == nil {
+		link, err = h.signer.SignURL(link)
+	}
+	if err != nil {
+		return err
+	}
+	phrase, err := h.mlc.GetAntiPhishingPhrase(receipt.Email)
+	if err != nil {
+		return err
+	}
+	return h.sender.SendMagicLink(ctx, &gomagiclink.MagicLinkMessage{
+		Email:     receipt.Email,
+		Link:      link,
+		Challenge: challenge,
+		ExpiresAt: receipt.ExpiresAt,
+		Metadata:  meta,
+		ReceiptID: receipt.ID,
+
+		AntiPhishingPhrase: phrase,
+	})
+}
+
+// Verify returns the handler for the magic links. It verifies the challenge, stores the
+// user record and sets the session cookie. JSON responses also contain the session ID,
+// for apps which don't use cookies. For users with TOTP enabled, the session is a pending
+// 2FA session, and the app needs to ask for the code (see gomagiclink.VerifyTOTP()).
+// If the controller reissues expired challenges (see gomagiclink.WithExpiredChallengeReissue()),
+// a new magic link is sent for an expired one, and browsers are redirected to ChallengeSentURL
+// with the "reissued" parameter set, while JSON clients get a "reissued" status.
+func (h *AuthHandlers) Verify() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		challenge := h.mlc.ChallengeFromURL(r.URL)
+		if challenge == "" {
+			h.fail(w, r, nil, ErrorCodeBadRequest, http.StatusBadRequest)
+			return
+		}
+		user, sessionId, refreshToken, err := h.completeLogin(w, r)
+		if err == gomagiclink.ErrExpiredChallenge {
+			h.reissue(w, r, challenge)
+			return
+		}
+		if err != nil {
+			h.fail(w, r, err, "", 0)
+			return
+		}
+		if WantsJSON(r) {
+			resp := map[string]any{
+				"session_id":    sessionId,
+				"totp_required": user.TOTPPending,
+				"user":          map[string]any{"id": user.ID, "email": user.Email},
+			}
+			if refreshToken != "" {
+				resp["refresh_token"] = refreshToken
+			}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if user.TOTPPending && h.TOTPURL != "" {
+			http.Redirect(w, r, h.TOTPURL, http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, h.LoggedInURL, http.StatusSeeOther)
+	})
+}
+
+// reissue sends a new magic link for the expired challenge, if the controller allows it,
+// and fails with ErrorCodeExpiredChallenge otherwise.
+func (h *AuthHandlers) reissue(w http.ResponseWriter, r *http.Request, challenge string) {
+	newChallenge, receipt, err := h.mlc.ReissueExpiredChallenge(challenge)
+	if err != nil {
+		h.fail(w, r, gomagiclink.ErrExpiredChallenge, "", 0)
+		return
+	}
+	if err = h.sendLink(r.Context(), h.VerifyURL, "", newChallenge, receipt, gomagiclink.ChallengeMetadata{Campaign: "reissue"}); err != nil {
+		h.fail(w, r, err, "", 0)
+		return
+	}
+	h.SetSameDeviceCookie(w, receipt)
+	if WantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]any{"status": "reissued", "expires_at": receipt.ExpiresAt})
+		return
+	}
+	sep := "?"
+	if strings.Contains(h.ChallengeSentURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, h.ChallengeSentURL+sep+"reissued=1", http.StatusSeeOther)
+}
+
+// Logout returns the handler which deletes the session cookie, and revokes the session
+// (from the cookie, or the bearer token, see Authenticate()) if it's a server-side one
+// (see gomagiclink.WithSessionStore()). It also revokes the refresh token from the
+// refresh cookie, and deletes it.
+func (h *AuthHandlers) Logout() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessionId, _ := h.sessionIdFromRequest(r); sessionId != "" {
+			h.mlc.RevokeSession(sessionId)
+		}
+		if cookie, err := r.Cookie(h.RefreshCookieName); err == nil && h.mlc.RefreshTokenLifetime() > 0 {
+			h.mlc.RevokeRefreshToken(cookie.Value)
+			h.clearRefreshCookie(w)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     h.CookieName,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   h.CookieSecure,
+			HttpOnly: true,
+		})
+		if WantsJSON(r) {
+			writeJSON(w, http.StatusOK, map[string]any{"status": "logged_out"})
+			return
+		}
+		http.Redirect(w, r, h.LoggedOutURL, http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,106 @@
+// Package adapters contains net/http handlers and middleware built on the gomagiclink controller.
+package adapters
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// IntrospectionOptions configures the IntrospectionHandler. The zero value allows
+// any caller to introspect sessions, which is only appropriate on internal networks.
+type IntrospectionOptions struct {
+	// BearerTokens, if not empty, requires the caller to send one of these tokens
+	// in the Authorization: Bearer header.
+	BearerTokens []string
+	// ClientCertNames, if not empty, requires the caller to present a verified TLS client
+	// certificate (mTLS) whose Subject CommonName is one of these names. The http.Server
+	// needs to be configured to request and verify client certificates.
+	ClientCertNames []string
+	// Scopes, if set, is called for active sessions to fill in the "scopes" field.
+	Scopes func(user *gomagiclink.AuthUserRecord) []string
+	// Logger, if set, receives errors and rejected introspection attempts.
+	Logger *slog.Logger
+}
+
+// IntrospectionHandler returns a http.Handler implementing an RFC 7662-style session
+// introspection endpoint for API gateways. The caller POSTs a form with the session ID
+// in the "token" field, and receives a JSON document like:
+//
+//	{"active": true, "sub": "<user id>", "exp": 1700000000, "email": "user@example.com", "scopes": ["read"]}
+//
+// Inactive sessions are reported as {"active": false}.
+func IntrospectionHandler(mlc *gomagiclink.AuthMagicLinkController, opts IntrospectionOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !introspectionCallerAllowed(r, &opts) {
+			if opts.Logger != nil {
+				opts.Logger.Warn("Unauthorized introspection request", "remote_addr", r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		token := r.PostForm.Get("token")
+		if token == "" {
+			http.Error(w, "Missing token", http.StatusBadRequest)
+			return
+		}
+		si, err := mlc.IntrospectSession(token)
+		if err != nil {
+			if opts.Logger != nil {
+				opts.Logger.Error("Error introspecting session", "error", err)
+			}
+			status := http.StatusInternalServerError
+			if err == gomagiclink.ErrStorageUnavailable {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, "Error introspecting session", status)
+			return
+		}
+		if si.Active && opts.Scopes != nil {
+			si.Scopes = opts.Scopes(si.User)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(si)
+	})
+}
+
+func introspectionCallerAllowed(r *http.Request, opts *IntrospectionOptions) bool {
+	if len(opts.ClientCertNames) > 0 {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return false
+		}
+		if !slices.Contains(opts.ClientCertNames, r.TLS.VerifiedChains[0][0].Subject.CommonName) {
+			return false
+		}
+	}
+	if len(opts.BearerTokens) > 0 {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return false
+		}
+		for _, t := range opts.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,24 @@
+package adapters
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ivoras/gomagiclink/keys"
+)
+
+// JWKSHandler returns a http.Handler serving the public keys of the KeySet as a JWK set
+// (usually at "/.well-known/jwks.json"), for verifying public-key session tokens.
+// The keys are read on each request, so rotated keys are published immediately.
+func JWKSHandler(ks *keys.KeySet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(ks.JWKS())
+	})
+}
@@ -0,0 +1,84 @@
+package adapters
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// LinkTracker records when and where magic links are opened, to help debug
+// "I clicked it and nothing happened" support tickets. Magic links are wrapped in
+// signed tracking URLs pointing to the LinkTracker, which records a "link.opened"
+// audit event (with the time, a hash of the client IP address and the user agent)
+// and redirects the browser to the actual verification URL.
+type LinkTracker struct {
+	mlc    *gomagiclink.AuthMagicLinkController
+	signer *gomagiclink.URLSigner
+	// ClientIP returns the client's IP address. By default, the host part of
+	// http.Request.RemoteAddr is used.
+	ClientIP func(r *http.Request) string
+}
+
+// NewLinkTracker creates a LinkTracker which records events in the controller's audit log.
+func NewLinkTracker(mlc *gomagiclink.AuthMagicLinkController) *LinkTracker {
+	return &LinkTracker{
+		mlc:    mlc,
+		signer: mlc.NewURLSigner(),
+	}
+}
+
+// TrackingURL wraps the magic link (targetURL) into a tracking URL served by the
+// LinkTracker at trackerURL (e.g. "https://example.com/track").
+func (lt *LinkTracker) TrackingURL(trackerURL string, email string, targetURL string) (string, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("to", targetURL)
+	q.Set("email", gomagiclink.NormalizeEmail(email))
+	u.RawQuery = q.Encode()
+	return lt.signer.SignURL(u.String())
+}
+
+// ServeHTTP records the link opening and redirects to the magic link.
+func (lt *LinkTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := lt.signer.VerifyURL(r.URL); err != nil {
+		http.Error(w, "Invalid link", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	target := q.Get("to")
+
+	lt.mlc.LogAuditEvent(gomagiclink.AuditEvent{
+		Type:  gomagiclink.AuditLinkOpened,
+		Email: q.Get("email"),
+		Details: map[string]string{
+			"ip_hash":    lt.hashIP(lt.clientIP(r)),
+			"user_agent": r.UserAgent(),
+		},
+	})
+
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (lt *LinkTracker) clientIP(r *http.Request) string {
+	if lt.ClientIP != nil {
+		return lt.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hashIP returns a keyed hash of the IP address, so the audit log can show whether
+// links were opened from the same address without storing the address itself.
+func (lt *LinkTracker) hashIP(ip string) string {
+	return hex.EncodeToString(lt.mlc.SignData("ip-hash", []byte(ip))[:8])
+}
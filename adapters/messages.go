@@ -0,0 +1,229 @@
+package adapters
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MessageCatalog maps language tags (e.g. "en", "de", "pt-BR") to the user-facing
+// messages for the ErrorCode* codes, so apps don't show the codes (or the package's
+// error strings) to their users. Add languages or replace messages by copying
+// DefaultMessageCatalog with Merge().
+type MessageCatalog map[string]map[string]string
+
+// DefaultLanguage is used when none of the languages the client accepts is in the catalog.
+const DefaultLanguage = "en"
+
+// DefaultMessageCatalog has the messages for all the error codes in English, German,
+// French, Spanish and Croatian.
+var DefaultMessageCatalog = MessageCatalog{
+	"en": {
+		ErrorCodeBadRequest:         "Please enter a valid e-mail address.",
+		ErrorCodeInvalidLink:        "This login link is invalid. Please request a new one.",
+		ErrorCodeInvalidChallenge:   "This login link is invalid. Please request a new one.",
+		ErrorCodeExpiredChallenge:   "This login link has expired. Please request a new one.",
+		ErrorCodeUsedChallenge:      "This login link has already been used. Please request a new one.",
+		ErrorCodeEmailRequired:      "Please open the login link in the browser you requested it from.",
+		ErrorCodeUserDisabled:       "This account is disabled.",
+		ErrorCodeUserLocked:         "This account is locked. Please contact support.",
+		ErrorCodeRiskDenied:         "This login attempt was blocked. Please try again later.",
+		ErrorCodeTooManySessions:    "You're logged in on too many devices. Please log out on one of them first.",
+		ErrorCodeTOTPRequired:       "Please enter the code from your authenticator app.",
+		ErrorCodeEmailUndeliverable: "We can't deliver e-mail to this address. Please use another one.",
+		ErrorCodeInvalidTOTPCode:    "This code is invalid. Please try again.",
+		ErrorCodeStorageUnavailable: "The service is temporarily unavailable. Please try again in a few minutes.",
+		ErrorCodeRateLimited:        "Too many attempts. Please wait a minute and try again.",
+		ErrorCodeResendTooSoon:      "We've just sent you a login link. Please wait a minute before asking for it again.",
+		ErrorCodeDomainNotAllowed:   "Logins with e-mail addresses in this domain aren't allowed.",
+		ErrorCodeDeviceMismatch:     "For your security, please open the login link in the same browser you requested it from.",
+		ErrorCodeInsufficientScope:  "This API token doesn't have permission for this request.",
+		ErrorCodeSessionRequired:    "Please log in to continue.",
+		ErrorCodeInvalidSession:     "Your session has expired. Please log in again.",
+		ErrorCodeInternal:           "Something went wrong. Please try again.",
+	},
+	"de": {
+		ErrorCodeBadRequest:         "Bitte geben Sie eine gültige E-Mail-Adresse ein.",
+		ErrorCodeInvalidLink:        "Dieser Anmeldelink ist ungültig. Bitte fordern Sie einen neuen an.",
+		ErrorCodeInvalidChallenge:   "Dieser Anmeldelink ist ungültig. Bitte fordern Sie einen neuen an.",
+		ErrorCodeExpiredChallenge:   "Dieser Anmeldelink ist abgelaufen. Bitte fordern Sie einen neuen an.",
+		ErrorCodeUsedChallenge:      "Dieser Anmeldelink wurde bereits verwendet. Bitte fordern Sie einen neuen an.",
+		ErrorCodeEmailRequired:      "Bitte öffnen Sie den Anmeldelink in dem Browser, in dem Sie ihn angefordert haben.",
+		ErrorCodeUserDisabled:       "Dieses Konto ist deaktiviert.",
+		ErrorCodeUserLocked:         "Dieses Konto ist gesperrt. Bitte wenden Sie sich an den Support.",
+		ErrorCodeRiskDenied:         "Dieser Anmeldeversuch wurde blockiert. Bitte versuchen Sie es später erneut.",
+		ErrorCodeTooManySessions:    "Sie sind auf zu vielen Geräten angemeldet. Bitte melden Sie sich zuerst auf einem davon ab.",
+		ErrorCodeTOTPRequired:       "Bitte geben Sie den Code aus Ihrer Authenticator-App ein.",
+		ErrorCodeEmailUndeliverable: "An diese Adresse können wir keine E-Mails zustellen. Bitte verwenden Sie eine andere.",
+		ErrorCodeInvalidTOTPCode:    "Dieser Code ist ungültig. Bitte versuchen Sie es erneut.",
+		ErrorCodeStorageUnavailable: "Der Dienst ist vorübergehend nicht verfügbar. Bitte versuchen Sie es in einigen Minuten erneut.",
+		ErrorCodeRateLimited:        "Zu viele Versuche. Bitte warten Sie eine Minute und versuchen Sie es erneut.",
+		ErrorCodeResendTooSoon:      "Wir haben Ihnen gerade einen Anmeldelink gesendet. Bitte warten Sie eine Minute, bevor Sie ihn erneut anfordern.",
+		ErrorCodeDomainNotAllowed:   "Anmeldungen mit E-Mail-Adressen dieser Domain sind nicht erlaubt.",
+		ErrorCodeDeviceMismatch:     "Öffnen Sie den Anmeldelink zu Ihrer Sicherheit in dem Browser, in dem Sie ihn angefordert haben.",
+		ErrorCodeInsufficientScope:  "Dieses API-Token hat keine Berechtigung für diese Anfrage.",
+		ErrorCodeSessionRequired:    "Bitte melden Sie sich an, um fortzufahren.",
+		ErrorCodeInvalidSession:     "Ihre Sitzung ist abgelaufen. Bitte melden Sie sich erneut an.",
+		ErrorCodeInternal:           "Etwas ist schiefgelaufen. Bitte versuchen Sie es erneut.",
+	},
+	"fr": {
+		ErrorCodeBadRequest:         "Veuillez saisir une adresse e-mail valide.",
+		ErrorCodeInvalidLink:        "Ce lien de connexion n'est pas valide. Veuillez en demander un nouveau.",
+		ErrorCodeInvalidChallenge:   "Ce lien de connexion n'est pas valide. Veuillez en demander un nouveau.",
+		ErrorCodeExpiredChallenge:   "Ce lien de connexion a expiré. Veuillez en demander un nouveau.",
+		ErrorCodeUsedChallenge:      "Ce lien de connexion a déjà été utilisé. Veuillez en demander un nouveau.",
+		ErrorCodeEmailRequired:      "Veuillez ouvrir le lien de connexion dans le navigateur depuis lequel vous l'avez demandé.",
+		ErrorCodeUserDisabled:       "Ce compte est désactivé.",
+		ErrorCodeUserLocked:         "Ce compte est verrouillé. Veuillez contacter le support.",
+		ErrorCodeRiskDenied:         "Cette tentative de connexion a été bloquée. Veuillez réessayer plus tard.",
+		ErrorCodeTooManySessions:    "Vous êtes connecté sur trop d'appareils. Veuillez d'abord vous déconnecter de l'un d'eux.",
+		ErrorCodeTOTPRequired:       "Veuillez saisir le code de votre application d'authentification.",
+		ErrorCodeEmailUndeliverable: "Nous ne pouvons pas envoyer d'e-mail à cette adresse. Veuillez en utiliser une autre.",
+		ErrorCodeInvalidTOTPCode:    "Ce code n'est pas valide. Veuillez réessayer.",
+		ErrorCodeStorageUnavailable: "Le service est temporairement indisponible. Veuillez réessayer dans quelques minutes.",
+		ErrorCodeRateLimited:        "Trop de tentatives. Veuillez patienter une minute et réessayer.",
+		ErrorCodeResendTooSoon:      "Nous venons de vous envoyer un lien de connexion. Veuillez patienter une minute avant de le redemander.",
+		ErrorCodeDomainNotAllowed:   "Les connexions avec des adresses e-mail de ce domaine ne sont pas autorisées.",
+		ErrorCodeDeviceMismatch:     "Pour votre sécurité, ouvrez le lien de connexion dans le navigateur où vous l'avez demandé.",
+		ErrorCodeInsufficientScope:  "Ce jeton d'API n'a pas l'autorisation pour cette requête.",
+		ErrorCodeSessionRequired:    "Veuillez vous connecter pour continuer.",
+		ErrorCodeInvalidSession:     "Votre session a expiré. Veuillez vous reconnecter.",
+		ErrorCodeInternal:           "Une erreur s'est produite. Veuillez réessayer.",
+	},
+	"es": {
+		ErrorCodeBadRequest:         "Introduce una dirección de correo electrónico válida.",
+		ErrorCodeInvalidLink:        "Este enlace de inicio de sesión no es válido. Solicita uno nuevo.",
+		ErrorCodeInvalidChallenge:   "Este enlace de inicio de sesión no es válido. Solicita uno nuevo.",
+		ErrorCodeExpiredChallenge:   "Este enlace de inicio de sesión ha caducado. Solicita uno nuevo.",
+		ErrorCodeUsedChallenge:      "Este enlace de inicio de sesión ya se ha utilizado. Solicita uno nuevo.",
+		ErrorCodeEmailRequired:      "Abre el enlace de inicio de sesión en el navegador desde el que lo solicitaste.",
+		ErrorCodeUserDisabled:       "Esta cuenta está desactivada.",
+		ErrorCodeUserLocked:         "Esta cuenta está bloqueada. Ponte en contacto con el soporte.",
+		ErrorCodeRiskDenied:         "Se ha bloqueado este intento de inicio de sesión. Inténtalo de nuevo más tarde.",
+		ErrorCodeTooManySessions:    "Has iniciado sesión en demasiados dispositivos. Cierra la sesión en uno de ellos primero.",
+		ErrorCodeTOTPRequired:       "Introduce el código de tu aplicación de autenticación.",
+		ErrorCodeEmailUndeliverable: "No podemos entregar correos a esta dirección. Usa otra.",
+		ErrorCodeInvalidTOTPCode:    "Este código no es válido. Inténtalo de nuevo.",
+		ErrorCodeStorageUnavailable: "El servicio no está disponible temporalmente. Inténtalo de nuevo en unos minutos.",
+		ErrorCodeRateLimited:        "Demasiados intentos. Espera un minuto e inténtalo de nuevo.",
+		ErrorCodeResendTooSoon:      "Acabamos de enviarte un enlace de inicio de sesión. Espera un minuto antes de volver a solicitarlo.",
+		ErrorCodeDomainNotAllowed:   "No se permite iniciar sesión con direcciones de correo de este dominio.",
+		ErrorCodeDeviceMismatch:     "Por tu seguridad, abre el enlace de inicio de sesión en el mismo navegador en el que lo solicitaste.",
+		ErrorCodeInsufficientScope:  "Este token de API no tiene permiso para esta solicitud.",
+		ErrorCodeSessionRequired:    "Inicia sesión para continuar.",
+		ErrorCodeInvalidSession:     "Tu sesión ha caducado. Vuelve a iniciar sesión.",
+		ErrorCodeInternal:           "Algo ha salido mal. Inténtalo de nuevo.",
+	},
+	"hr": {
+		ErrorCodeBadRequest:         "Unesite ispravnu adresu e-pošte.",
+		ErrorCodeInvalidLink:        "Ova poveznica za prijavu nije valjana. Zatražite novu.",
+		ErrorCodeInvalidChallenge:   "Ova poveznica za prijavu nije valjana. Zatražite novu.",
+		ErrorCodeExpiredChallenge:   "Ova poveznica za prijavu je istekla. Zatražite novu.",
+		ErrorCodeUsedChallenge:      "Ova poveznica za prijavu je već iskorištena. Zatražite novu.",
+		ErrorCodeEmailRequired:      "Otvorite poveznicu za prijavu u pregledniku u kojem ste je zatražili.",
+		ErrorCodeUserDisabled:       "Ovaj račun je onemogućen.",
+		ErrorCodeUserLocked:         "Ovaj račun je zaključan. Obratite se podršci.",
+		ErrorCodeRiskDenied:         "Ovaj pokušaj prijave je blokiran. Pokušajte ponovno kasnije.",
+		ErrorCodeTooManySessions:    "Prijavljeni ste na previše uređaja. Najprije se odjavite s jednog od njih.",
+		ErrorCodeTOTPRequired:       "Unesite kôd iz aplikacije za autentifikaciju.",
+		ErrorCodeEmailUndeliverable: "Ne možemo dostaviti e-poštu na ovu adresu. Upotrijebite drugu.",
+		ErrorCodeInvalidTOTPCode:    "Ovaj kôd nije valjan. Pokušajte ponovno.",
+		ErrorCodeStorageUnavailable: "Usluga je privremeno nedostupna. Pokušajte ponovno za nekoliko minuta.",
+		ErrorCodeRateLimited:        "Previše pokušaja. Pričekajte minutu i pokušajte ponovno.",
+		ErrorCodeResendTooSoon:      "Upravo smo vam poslali poveznicu za prijavu. Pričekajte minutu prije ponovnog traženja.",
+		ErrorCodeDomainNotAllowed:   "Prijave s adresama e-pošte u ovoj domeni nisu dopuštene.",
+		ErrorCodeDeviceMismatch:     "Radi vaše sigurnosti otvorite poveznicu za prijavu u pregledniku u kojem ste je zatražili.",
+		ErrorCodeInsufficientScope:  "Ovaj API token nema dopuštenje za ovaj zahtjev.",
+		ErrorCodeSessionRequired:    "Prijavite se za nastavak.",
+		ErrorCodeInvalidSession:     "Vaša sesija je istekla. Prijavite se ponovno.",
+		ErrorCodeInternal:           "Nešto nije u redu. Pokušajte ponovno.",
+	},
+}
+
+// Merge returns a new catalog with the messages of the other catalog added to (or
+// replacing) the ones in this one, e.g.
+// DefaultMessageCatalog.Merge(MessageCatalog{"it": {...}}).
+func (mc MessageCatalog) Merge(other MessageCatalog) MessageCatalog {
+	merged := MessageCatalog{}
+	for _, c := range []MessageCatalog{mc, other} {
+		for lang, messages := range c {
+			if merged[lang] == nil {
+				merged[lang] = map[string]string{}
+			}
+			for code, msg := range messages {
+				merged[lang][code] = msg
+			}
+		}
+	}
+	return merged
+}
+
+// Message returns the message for the error code in the first of the languages which
+// has it, falling back to the language without the region (e.g. "pt" for "pt-BR"), then
+// DefaultLanguage, and the message for ErrorCodeInternal for unknown codes. Languages
+// are matched case-sensitively, except for the fallback, so the catalog's language tags
+// should be lowercase, with the region in uppercase. It also
+// returns the language of the message, which is empty if there's none.
+func (mc MessageCatalog) Message(code string, languages ...string) (msg string, lang string) {
+	for _, c := range []string{code, ErrorCodeInternal} {
+		for _, lang := range slices.Concat(languages, []string{DefaultLanguage}) {
+			if msg, ok := mc[lang][c]; ok {
+				return msg, lang
+			}
+			if base, _, _ := strings.Cut(strings.ToLower(lang), "-"); base != lang {
+				if msg, ok := mc[base][c]; ok {
+					return msg, base
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// Localize returns the message for the error code in the language the request prefers,
+// according to its Accept-Language header.
+func (mc MessageCatalog) Localize(r *http.Request, code string) (msg string, lang string) {
+	return mc.Message(code, AcceptedLanguages(r)...)
+}
+
+// AcceptedLanguages returns the language tags from the request's Accept-Language header,
+// most preferred first.
+func AcceptedLanguages(r *http.Request) []string {
+	type accepted struct {
+		tag string
+		q   float64
+	}
+	var langs []accepted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			langs = append(langs, accepted{tag, q})
+		}
+	}
+	slices.SortStableFunc(langs, func(a, b accepted) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
@@ -0,0 +1,51 @@
+package adapters
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AppleAppSiteAssociationHandler returns a http.Handler serving the
+// "/.well-known/apple-app-site-association" file, which lets the iOS apps (given as
+// "TEAMID.bundle.id") open the magic links matching the path patterns (e.g. "/app/login*")
+// as universal links.
+func AppleAppSiteAssociationHandler(appIDs []string, paths []string) http.Handler {
+	components := []map[string]string{}
+	for _, p := range paths {
+		components = append(components, map[string]string{"/": p})
+	}
+	return wellKnownJSONHandler(map[string]any{
+		"applinks": map[string]any{
+			"details": []map[string]any{
+				{"appIDs": appIDs, "components": components},
+			},
+		},
+	})
+}
+
+// AssetLinksHandler returns a http.Handler serving the "/.well-known/assetlinks.json"
+// file, which lets the Android app (identified by its package name and the SHA-256
+// fingerprints of its signing certificates) open the magic links as verified app links.
+func AssetLinksHandler(packageName string, certFingerprints []string) http.Handler {
+	return wellKnownJSONHandler([]map[string]any{
+		{
+			"relation": []string{"delegate_permission/common.handle_all_urls"},
+			"target": map[string]any{
+				"namespace":                "android_app",
+				"package_name":             packageName,
+				"sha256_cert_fingerprints": certFingerprints,
+			},
+		},
+	})
+}
+
+func wellKnownJSONHandler(doc any) http.Handler {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
@@ -0,0 +1,266 @@
+package adapters
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrInvalidRateLimit = errors.New("rate limit requests must be positive")
+var ErrInvalidTrustedProxy = errors.New("invalid trusted proxy address")
+
+// RateLimitStore keeps the token buckets of a RateLimiter. Implement it on a shared
+// store (e.g. Redis) to enforce the limits across several app instances.
+type RateLimitStore interface {
+	// Take takes a token from the bucket named key, which holds up to burst tokens and
+	// is refilled at rate tokens per second. If the bucket is empty, it returns false and
+	// how long it takes until the next token is available.
+	Take(key string, rate float64, burst int) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitOptions configures a RateLimiter.
+type RateLimitOptions struct {
+	Requests int           // Number of requests allowed per Interval from each client, in the long run
+	Interval time.Duration // Default one minute
+	Burst    int           // Number of requests allowed at once, default Requests
+	// TrustedProxies are the IP addresses or CIDR ranges (e.g. "10.0.0.0/8") of the reverse
+	// proxies in front of the app. For requests coming from them, the client's address is
+	// taken from the X-Forwarded-For header (the rightmost address which isn't a trusted
+	// proxy) or the X-Real-IP header. Those headers are ignored for other requests, as
+	// clients could forge them to get around the limit.
+	TrustedProxies []string
+	// IPv6PrefixLength groups IPv6 clients by the network prefix, as a single client
+	// usually gets a whole /64. Default 64.
+	IPv6PrefixLength int
+	// Name prefixes the bucket keys, so several limiters can share a Store. Default "ratelimit".
+	Name  string
+	Store RateLimitStore // Default a new MemoryRateLimitStore
+	// ErrorURL, if set, is where browsers are redirected when they're over the limit, with
+	// the "error" parameter set to ErrorCodeRateLimited, like AuthHandlers.ErrorURL.
+	ErrorURL string
+	Messages MessageCatalog // Messages in JSON and plain text responses, default DefaultMessageCatalog
+	Logger   *slog.Logger   // Receives Store errors; requests are let through on errors
+}
+
+// DefaultLoginRateLimit is tuned for the endpoint sending magic links (AuthHandlers.Login()),
+// where every request sends an e-mail: 5 requests per minute, in bursts of up to 5.
+var DefaultLoginRateLimit = RateLimitOptions{Requests: 5, Interval: time.Minute, Burst: 5}
+
+// DefaultVerifyRateLimit is tuned for the endpoint verifying magic links (AuthHandlers.Verify()),
+// which legitimate users hit a few times per login, while guessing challenges needs many
+// requests: 20 requests per minute, in bursts of up to 10.
+var DefaultVerifyRateLimit = RateLimitOptions{Requests: 20, Interval: time.Minute, Burst: 10}
+
+// ApplyPolicy returns the options with the non-zero settings of the rate limit from a
+// gomagiclink.Policy, e.g. DefaultLoginRateLimit.ApplyPolicy(policy.RateLimits.Login).
+func (opts RateLimitOptions) ApplyPolicy(rl gomagiclink.PolicyRateLimit) RateLimitOptions {
+	if rl.Requests > 0 {
+		opts.Requests = rl.Requests
+	}
+	if rl.Interval > 0 {
+		opts.Interval = time.Duration(rl.Interval)
+	}
+	if rl.Burst > 0 {
+		opts.Burst = rl.Burst
+	}
+	return opts
+}
+
+// RateLimiter limits the request rate of each client IP address with a token bucket.
+// It's meant for the login endpoints, and is independent of the per-address limits of
+// the controller (see WithMaxOutstandingChallenges()).
+type RateLimiter struct {
+	opts     RateLimitOptions
+	rate     float64 // Tokens per second
+	proxies  []netip.Prefix
+	counters rateLimitCounters
+}
+
+// NewRateLimiter creates a RateLimiter. Use DefaultLoginRateLimit or DefaultVerifyRateLimit
+// as a starting point for the options.
+func NewRateLimiter(opts RateLimitOptions) (rl *RateLimiter, err error) {
+	if opts.Requests <= 0 {
+		return nil, ErrInvalidRateLimit
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = opts.Requests
+	}
+	if opts.IPv6PrefixLength <= 0 || opts.IPv6PrefixLength > 128 {
+		opts.IPv6PrefixLength = 64
+	}
+	if opts.Name == "" {
+		opts.Name = "ratelimit"
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryRateLimitStore()
+	}
+	if opts.Messages == nil {
+		opts.Messages = DefaultMessageCatalog
+	}
+	rl = &RateLimiter{opts: opts, rate: float64(opts.Requests) / opts.Interval.Seconds()}
+	for _, p := range opts.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, ErrInvalidTrustedProxy
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		rl.proxies = append(rl.proxies, prefix.Masked())
+	}
+	return rl, nil
+}
+
+// Middleware returns the handler limiting the requests passed to h. Requests over the
+// limit get a 429 Too Many Requests response with a Retry-After header and a localized
+// message, as JSON (with the ErrorCodeRateLimited code) for requests which accept it, or
+// a redirect to ErrorURL.
+func (rl *RateLimiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := rl.clientKey(r)
+		ok, retryAfter, err := rl.opts.Store.Take(rl.opts.Name+":"+client, rl.rate, rl.opts.Burst)
+		if err != nil {
+			if rl.opts.Logger != nil {
+				rl.opts.Logger.Error("Error in rate limit store", "error", err)
+			}
+			rl.counters.storeErrors.Add(1)
+			ok = true
+		}
+		if ok {
+			rl.counters.allowed.Add(1)
+		} else {
+			rl.counters.reject(client)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			if rl.opts.ErrorURL != "" && !WantsJSON(r) {
+				http.Redirect(w, r, rl.opts.ErrorURL+"?error="+ErrorCodeRateLimited, http.StatusSeeOther)
+				return
+			}
+			writeError(w, r, rl.opts.Messages, ErrorCodeRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the client's IP address, taking the proxy headers into account
+// for requests from the trusted proxies.
+func (rl *RateLimiter) ClientIP(r *http.Request) string {
+	addr, ok := rl.clientAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	return addr.String()
+}
+
+func (rl *RateLimiter) clientAddr(r *http.Request) (addr netip.Addr, ok bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err = netip.ParseAddr(host)
+	if err != nil {
+		return addr, false
+	}
+	addr = addr.Unmap()
+	if !rl.trusted(addr) {
+		return addr, true
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0 && len(forwarded) > 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Garbage from a client; use the last address we can vouch for
+			return addr, true
+		}
+		addr = hop.Unmap()
+		if !rl.trusted(addr) {
+			return addr, true
+		}
+	}
+	if len(forwarded) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap(), true
+		}
+	}
+	return addr, true
+}
+
+func (rl *RateLimiter) trusted(addr netip.Addr) bool {
+	for _, p := range rl.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKey returns the bucket name of the client: its IPv4 address, or its IPv6 network.
+func (rl *RateLimiter) clientKey(r *http.Request) string {
+	addr, ok := rl.clientAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(rl.opts.IPv6PrefixLength)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// MemoryRateLimitStore keeps the token buckets in memory, so it only limits the requests
+// to a single app instance. Buckets which have been refilled are forgotten.
+type MemoryRateLimitStore struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // When the bucket will be full again
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int) (ok bool, retryAfter time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	b := s.buckets[key]
+	if b == nil {
+		if len(s.buckets) >= 10000 {
+			for k, b := range s.buckets {
+				if b.full.Before(now) {
+					delete(s.buckets, k)
+				}
+			}
+		}
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return true, 0, nil
+}
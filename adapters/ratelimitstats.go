@@ -0,0 +1,216 @@
+package adapters
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedRejections is the number of clients whose rejections are counted for the
+// statistics; when it's reached, the client with the fewest rejections is forgotten.
+const maxTrackedRejections = 1000
+
+// RateLimitBucket is the state of a client's token bucket.
+type RateLimitBucket struct {
+	Key    string  // Bucket name, without the limiter's name prefix
+	Tokens float64 // Tokens left; below 1, the client's requests are rejected
+}
+
+// RateLimitBucketLister is implemented by RateLimitStores which can list their buckets
+// for the statistics, like MemoryRateLimitStore.
+type RateLimitBucketLister interface {
+	// Buckets returns the buckets whose names start with prefix, refilled up to now.
+	Buckets(prefix string, rate float64, burst int) ([]RateLimitBucket, error)
+}
+
+// RateLimitClientStats are the rejections of a client, see RateLimitStats.
+type RateLimitClientStats struct {
+	Client       string    `json:"client"` // IP address, or IPv6 network
+	Rejected     uint64    `json:"rejected"`
+	LastRejected time.Time `json:"last_rejected"`
+}
+
+// RateLimitStats describe the requests seen by a RateLimiter, so ops can tell whether
+// rejections come from a few abusive clients or from a limit too low for everyone.
+type RateLimitStats struct {
+	Name        string        `json:"name"`
+	Requests    int           `json:"requests"` // The limit, see RateLimitOptions
+	Interval    time.Duration `json:"interval"`
+	Burst       int           `json:"burst"`
+	Allowed     uint64        `json:"allowed"`      // Requests let through since the RateLimiter was created
+	Rejected    uint64        `json:"rejected"`     // Requests rejected since the RateLimiter was created
+	StoreErrors uint64        `json:"store_errors"` // Requests let through because of Store errors
+	// Clients with the most rejections, in descending order. The rejections are counted
+	// for up to 1000 clients per instance.
+	TopRejected []RateLimitClientStats `json:"top_rejected"`
+	// The current buckets, if the Store implements RateLimitBucketLister (-1 otherwise):
+	// all of them, and those of the clients which are currently being rejected.
+	ActiveBuckets    int `json:"active_buckets"`
+	ThrottledClients int `json:"throttled_clients"`
+}
+
+// rateLimitCounters are the statistics kept by a RateLimiter.
+type rateLimitCounters struct {
+	allowed     atomic.Uint64
+	rejected    atomic.Uint64
+	storeErrors atomic.Uint64
+
+	lock    sync.Mutex
+	clients map[string]*RateLimitClientStats
+}
+
+func (c *rateLimitCounters) reject(client string) {
+	c.rejected.Add(1)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.clients == nil {
+		c.clients = map[string]*RateLimitClientStats{}
+	}
+	cs := c.clients[client]
+	if cs == nil {
+		if len(c.clients) >= maxTrackedRejections {
+			var fewest *RateLimitClientStats
+			for _, s := range c.clients {
+				if fewest == nil || s.Rejected < fewest.Rejected {
+					fewest = s
+				}
+			}
+			delete(c.clients, fewest.Client)
+		}
+		cs = &RateLimitClientStats{Client: client}
+		c.clients[client] = cs
+	}
+	cs.Rejected++
+	cs.LastRejected = time.Now()
+}
+
+// Stats returns the limiter's statistics, with up to top clients in TopRejected.
+func (rl *RateLimiter) Stats(top int) RateLimitStats {
+	stats := RateLimitStats{
+		Name:             rl.opts.Name,
+		Requests:         rl.opts.Requests,
+		Interval:         rl.opts.Interval,
+		Burst:            rl.opts.Burst,
+		Allowed:          rl.counters.allowed.Load(),
+		Rejected:         rl.counters.rejected.Load(),
+		StoreErrors:      rl.counters.storeErrors.Load(),
+		ActiveBuckets:    -1,
+		ThrottledClients: -1,
+	}
+	rl.counters.lock.Lock()
+	for _, cs := range rl.counters.clients {
+		stats.TopRejected = append(stats.TopRejected, *cs)
+	}
+	rl.counters.lock.Unlock()
+	slices.SortFunc(stats.TopRejected, func(a, b RateLimitClientStats) int {
+		return cmp.Or(cmp.Compare(b.Rejected, a.Rejected), strings.Compare(a.Client, b.Client))
+	})
+	if len(stats.TopRejected) > top {
+		stats.TopRejected = stats.TopRejected[:top]
+	}
+	if lister, ok := rl.opts.Store.(RateLimitBucketLister); ok {
+		buckets, err := lister.Buckets(rl.opts.Name+":", rl.rate, rl.opts.Burst)
+		if err == nil {
+			stats.ActiveBuckets, stats.ThrottledClients = len(buckets), 0
+			for _, b := range buckets {
+				if b.Tokens < 1 {
+					stats.ThrottledClients++
+				}
+			}
+		} else if rl.opts.Logger != nil {
+			rl.opts.Logger.Error("Error listing rate limit buckets", "error", err)
+		}
+	}
+	return stats
+}
+
+// Buckets returns the buckets whose names start with prefix, refilled up to now.
+func (s *MemoryRateLimitStore) Buckets(prefix string, rate float64, burst int) ([]RateLimitBucket, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var buckets []RateLimitBucket
+	for key, b := range s.buckets {
+		if name, ok := strings.CutPrefix(key, prefix); ok && b.full.After(now) {
+			tokens := math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+			buckets = append(buckets, RateLimitBucket{Key: name, Tokens: tokens})
+		}
+	}
+	return buckets, nil
+}
+
+// RateLimitStatsHandler returns a diagnostics handler with the statistics of the
+// limiters (see RateLimiter.Stats()), including the top clients by rejections (10 by
+// default, or the "top" query parameter). Requests which accept JSON get an array of
+// RateLimitStats; the others get the Prometheus text exposition format, for scraping.
+// The statistics include client IP addresses, so don't expose the handler publicly.
+func RateLimitStatsHandler(limiters ...*RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top := 10
+		if t := r.URL.Query().Get("top"); t != "" {
+			var err error
+			if top, err = strconv.Atoi(t); err != nil || top < 0 {
+				http.Error(w, "Invalid top parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		stats := make([]RateLimitStats, len(limiters))
+		for i, rl := range limiters {
+			stats[i] = rl.Stats(top)
+		}
+		if WantsJSON(r) {
+			writeJSON(w, http.StatusOK, stats)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		writePrometheusRateLimitStats(w, stats)
+	})
+}
+
+func writePrometheusRateLimitStats(w io.Writer, stats []RateLimitStats) {
+	metric := func(name, typ, help string, value func(s RateLimitStats, emit func(labels string, v float64))) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range stats {
+			value(s, func(labels string, v float64) {
+				fmt.Fprintf(w, "%s{limiter=%q%s} %g\n", name, s.Name, labels, v)
+			})
+		}
+	}
+	metric("gomagiclink_ratelimit_requests_total", "counter", "Requests seen by the rate limiter.", func(s RateLimitStats, emit func(string, float64)) {
+		emit(`,result="allowed"`, float64(s.Allowed))
+		emit(`,result="rejected"`, float64(s.Rejected))
+	})
+	metric("gomagiclink_ratelimit_store_errors_total", "counter", "Requests let through because of rate limit store errors.", func(s RateLimitStats, emit func(string, float64)) {
+		emit("", float64(s.StoreErrors))
+	})
+	metric("gomagiclink_ratelimit_limit_per_second", "gauge", "Configured sustained request rate per client.", func(s RateLimitStats, emit func(string, float64)) {
+		emit("", float64(s.Requests)/s.Interval.Seconds())
+	})
+	metric("gomagiclink_ratelimit_burst", "gauge", "Configured burst size per client.", func(s RateLimitStats, emit func(string, float64)) {
+		emit("", float64(s.Burst))
+	})
+	metric("gomagiclink_ratelimit_active_buckets", "gauge", "Clients with a partly used token bucket.", func(s RateLimitStats, emit func(string, float64)) {
+		if s.ActiveBuckets >= 0 {
+			emit("", float64(s.ActiveBuckets))
+		}
+	})
+	metric("gomagiclink_ratelimit_throttled_clients", "gauge", "Clients currently over the limit.", func(s RateLimitStats, emit func(string, float64)) {
+		if s.ThrottledClients >= 0 {
+			emit("", float64(s.ThrottledClients))
+		}
+	})
+	metric("gomagiclink_ratelimit_client_rejected", "gauge", "Rejected requests of the clients with the most rejections.", func(s RateLimitStats, emit func(string, float64)) {
+		for _, c := range s.TopRejected {
+			emit(fmt.Sprintf(",client=%q", c.Client), float64(c.Rejected))
+		}
+	})
+}
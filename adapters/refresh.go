@@ -0,0 +1,112 @@
+package adapters
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// setRefreshCookie sets the refresh cookie, which lives as long as the refresh token.
+func (h *AuthHandlers) setRefreshCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.RefreshCookieName,
+		Value:    refreshToken,
+		Path:     "/",
+		MaxAge:   int(h.mlc.RefreshTokenLifetime().Seconds()),
+		Secure:   h.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h *AuthHandlers) clearRefreshCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.RefreshCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   h.CookieSecure,
+		HttpOnly: true,
+	})
+}
+
+// refreshFromCookie exchanges the refresh token in the refresh cookie for a new session,
+// and sets both cookies. It returns ErrNoSession if there's no refresh cookie, and clears
+// the cookie if the refresh token isn't valid anymore.
+func (h *AuthHandlers) refreshFromCookie(w http.ResponseWriter, r *http.Request) (user *gomagiclink.AuthUserRecord, sessionId string, err error) {
+	cookie, err := r.Cookie(h.RefreshCookieName)
+	if err != nil || cookie.Value == "" || h.mlc.RefreshTokenLifetime() == 0 {
+		return nil, "", ErrNoSession
+	}
+	user, sessionId, refreshToken, err := h.mlc.ExchangeRefreshToken(cookie.Value)
+	if err != nil {
+		if err != gomagiclink.ErrStorageUnavailable {
+			h.clearRefreshCookie(w)
+		}
+		return nil, "", err
+	}
+	h.setRefreshCookie(w, refreshToken)
+	h.setSessionCookie(w, user, sessionId)
+	return user, sessionId, nil
+}
+
+// Refresh returns the handler which exchanges a refresh token (see
+// gomagiclink.WithRefreshTokens()) for a new session ID, for clients which don't use
+// RequireSession()'s transparent refresh, e.g. mobile apps using bearer tokens. It accepts
+// POST requests with the refresh token in the "refresh_token" field of a JSON body or a
+// form, or else in the refresh cookie. JSON clients get the new session ID and refresh
+// token, and both cookies are set if the refresh token came from the cookie; browsers are
+// redirected to LoggedInURL.
+func (h *AuthHandlers) Refresh() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			h.fail(w, r, nil, ErrorCodeBadRequest, http.StatusMethodNotAllowed)
+			return
+		}
+		var refreshToken string
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+			var body struct {
+				RefreshToken string `json:"refresh_token"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+				h.fail(w, r, nil, ErrorCodeBadRequest, http.StatusBadRequest)
+				return
+			}
+			refreshToken = body.RefreshToken
+		} else {
+			refreshToken = r.FormValue("refresh_token")
+		}
+		var user *gomagiclink.AuthUserRecord
+		var sessionId string
+		var err error
+		if refreshToken != "" {
+			user, sessionId, refreshToken, err = h.mlc.ExchangeRefreshToken(refreshToken)
+		} else {
+			// The new refresh token is only in the cookie
+			user, sessionId, err = h.refreshFromCookie(w, r)
+		}
+		if err == ErrNoSession {
+			h.fail(w, r, nil, ErrorCodeSessionRequired, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			h.fail(w, r, err, "", 0)
+			return
+		}
+		if WantsJSON(r) {
+			resp := map[string]any{
+				"session_id": sessionId,
+				"user":       map[string]any{"id": user.ID, "email": user.Email},
+			}
+			if refreshToken != "" {
+				resp["refresh_token"] = refreshToken
+			}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		http.Redirect(w, r, h.LoggedInURL, http.StatusSeeOther)
+	})
+}
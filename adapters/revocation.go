@@ -0,0 +1,128 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrRevocationFeed = errors.New("unexpected response from the revocation feed")
+
+// RevocationFeedOptions configures the RevocationFeedHandler. Like with the
+// IntrospectionHandler, the zero value allows any caller, which is only appropriate on
+// internal networks.
+type RevocationFeedOptions struct {
+	BearerTokens    []string     // If not empty, the caller must send one of these in the Authorization: Bearer header
+	ClientCertNames []string     // If not empty, the caller must present a verified TLS client certificate with one of these CommonNames
+	Limit           int          // Entries per response, default 1000
+	Logger          *slog.Logger // Receives errors and rejected requests
+}
+
+// revocationFeedResponse is the JSON document served by the RevocationFeedHandler.
+type revocationFeedResponse struct {
+	Entries []gomagiclink.RevocationEntry `json:"entries"`
+	Cursor  uint64                        `json:"cursor,string"`
+}
+
+// RevocationFeedHandler returns the handler serving the region's revocation list to the
+// other regions (see gomagiclink.WithReplicatedRevocation()), which pull it with
+// HTTPRevocationPeer. It answers GET requests with the "after" parameter (the cursor,
+// default 0) with a JSON document like:
+//
+//	{"entries": [{"session_id": "...", "user_id": "...", "revoked_at": "...", "expires_at": "..."}], "cursor": "42"}
+func RevocationFeedHandler(store gomagiclink.ReplicatedRevocationStore, opts RevocationFeedOptions) http.Handler {
+	if opts.Limit <= 0 {
+		opts.Limit = 1000
+	}
+	callers := IntrospectionOptions{BearerTokens: opts.BearerTokens, ClientCertNames: opts.ClientCertNames}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !introspectionCallerAllowed(r, &callers) {
+			if opts.Logger != nil {
+				opts.Logger.Warn("Unauthorized revocation feed request", "remote_addr", r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var after uint64
+		if v := r.URL.Query().Get("after"); v != "" {
+			var err error
+			if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, cursor, err := store.RevocationChanges(after, opts.Limit)
+		if err != nil {
+			if opts.Logger != nil {
+				opts.Logger.Error("Error reading revocations", "error", err)
+			}
+			http.Error(w, "Error reading revocations", http.StatusServiceUnavailable)
+			return
+		}
+		if entries == nil {
+			entries = []gomagiclink.RevocationEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(revocationFeedResponse{Entries: entries, Cursor: cursor})
+	})
+}
+
+// HTTPRevocationPeer is a gomagiclink.RevocationPeer pulling another region's revocation
+// list from its RevocationFeedHandler.
+type HTTPRevocationPeer struct {
+	PeerName    string       // Name of the region, e.g. "eu-west"
+	URL         string       // URL of the region's RevocationFeedHandler
+	BearerToken string       // Sent in the Authorization header, if set
+	Client      *http.Client // Default http.DefaultClient
+}
+
+func (hp *HTTPRevocationPeer) Name() string {
+	return hp.PeerName
+}
+
+func (hp *HTTPRevocationPeer) PullRevocations(ctx context.Context, after uint64) (entries []gomagiclink.RevocationEntry, cursor uint64, err error) {
+	u, err := url.Parse(hp.URL)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	q.Set("after", strconv.FormatUint(after, 10))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	if hp.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+hp.BearerToken)
+	}
+	client := hp.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, ErrRevocationFeed
+	}
+	var feed revocationFeedResponse
+	if err = json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return nil, 0, ErrRevocationFeed
+	}
+	return feed.Entries, feed.Cursor, nil
+}
@@ -0,0 +1,129 @@
+package adapters
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityHeadersOptions configures the SecurityHeaders middleware. The zero value
+// sets the recommended headers, without HSTS.
+type SecurityHeadersOptions struct {
+	// ContentSecurityPolicy for the pages; default allows only same-origin resources,
+	// no framing, and forms posting only to the same origin.
+	ContentSecurityPolicy string
+	// HSTSMaxAge, if not 0, sets the Strict-Transport-Security header. Only enable it
+	// for sites which are served only over HTTPS.
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains adds includeSubDomains to the Strict-Transport-Security header.
+	HSTSIncludeSubdomains bool
+}
+
+// DefaultContentSecurityPolicy is the CSP set by SecurityHeaders() by default.
+const DefaultContentSecurityPolicy = "default-src 'self'; frame-ancestors 'none'; form-action 'self'; base-uri 'none'"
+
+// SecurityHeaders returns middleware setting the security headers recommended for login
+// pages and magic link endpoints:
+//
+//   - Referrer-Policy: no-referrer, so challenges in the verification URL don't leak to
+//     other sites through the Referer header
+//   - Content-Security-Policy (see SecurityHeadersOptions)
+//   - X-Content-Type-Options: nosniff and X-Frame-Options: DENY
+//   - Strict-Transport-Security, if enabled
+//
+// Headers set by outer middleware aren't overwritten, and the handler can override them.
+func SecurityHeaders(opts SecurityHeadersOptions, h http.Handler) http.Handler {
+	csp := opts.ContentSecurityPolicy
+	if csp == "" {
+		csp = DefaultContentSecurityPolicy
+	}
+	var hsts string
+	if opts.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(opts.HSTSMaxAge.Seconds()))
+		if opts.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setDefault := func(name, value string) {
+			if w.Header().Get(name) == "" {
+				w.Header().Set(name, value)
+			}
+		}
+		setDefault("Referrer-Policy", "no-referrer")
+		setDefault("Content-Security-Policy", csp)
+		setDefault("X-Content-Type-Options", "nosniff")
+		setDefault("X-Frame-Options", "DENY")
+		if hsts != "" {
+			setDefault("Strict-Transport-Security", hsts)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins are the origins (e.g. "https://app.example.com") which can call the
+	// endpoints. "*" allows any origin, but then cookies aren't allowed.
+	AllowedOrigins []string
+	// AllowedMethods; default is GET, POST.
+	AllowedMethods []string
+	// AllowedHeaders; default is Content-Type, Accept, Authorization.
+	AllowedHeaders []string
+	// MaxAge is how long browsers can cache preflight responses; default 10 minutes.
+	MaxAge time.Duration
+}
+
+// CORS returns middleware allowing cross-origin requests from the configured origins,
+// e.g. for the JSON mode of AuthHandlers used by a single-page app on another domain.
+// Requests from explicitly listed origins can include cookies (credentials). Preflight
+// requests are answered by the middleware. Without allowed origins, it doesn't change
+// the responses.
+func CORS(opts CORSOptions, h http.Handler) http.Handler {
+	if len(opts.AllowedOrigins) == 0 {
+		return h
+	}
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost}
+	}
+	headers := opts.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Content-Type", "Accept", "Authorization"}
+	}
+	maxAge := opts.MaxAge
+	if maxAge == 0 {
+		maxAge = 10 * time.Minute
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	allowAny := slices.Contains(opts.AllowedOrigins, "*")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		allowed := false
+		if origin != "" {
+			if slices.Contains(opts.AllowedOrigins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				allowed = true
+			} else if allowAny {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				allowed = true
+			}
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
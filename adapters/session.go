@@ -0,0 +1,173 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrNoSession = errors.New("no session in the request")
+
+type sessionContextKey struct{}
+
+// sessionContext is what RequireSession() stores in the request's context.
+type sessionContext struct {
+	user      *gomagiclink.AuthUserRecord
+	sessionId string
+}
+
+// UserFromContext returns the user authenticated by RequireSession(), or nil.
+func UserFromContext(ctx context.Context) *gomagiclink.AuthUserRecord {
+	if sc, ok := ctx.Value(sessionContextKey{}).(*sessionContext); ok {
+		return sc.user
+	}
+	return nil
+}
+
+// SessionIdFromContext returns the session ID authenticated by RequireSession(), or
+// an empty string.
+func SessionIdFromContext(ctx context.Context) string {
+	if sc, ok := ctx.Value(sessionContextKey{}).(*sessionContext); ok {
+		return sc.sessionId
+	}
+	return ""
+}
+
+// BearerToken returns the token from the request's "Authorization: Bearer" header, or
+// an empty string if there isn't one.
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// sessionIdFromRequest returns the session ID from the Authorization header, or else
+// from the session cookie.
+func (h *AuthHandlers) sessionIdFromRequest(r *http.Request) (sessionId string, bearer bool) {
+	if token := BearerToken(r); token != "" {
+		return token, true
+	}
+	if cookie, err := r.Cookie(h.CookieName); err == nil {
+		return cookie.Value, false
+	}
+	return "", false
+}
+
+// Authenticate verifies the session ID sent with the request, either as a bearer token
+// ("Authorization: Bearer <session ID>", for single-page apps and mobile clients which
+// don't use cookies) or in the session cookie. The bearer token takes precedence. It
+// returns ErrNoSession if the request has neither. Bearer tokens starting with
+// gomagiclink.APITokenPrefix are verified as API tokens (see gomagiclink.WithAPITokens()),
+// with an empty session ID returned, and the APIToken field of the user record set, which
+// callers have to check, as API tokens may be limited to some scopes.
+func (h *AuthHandlers) Authenticate(r *http.Request) (user *gomagiclink.AuthUserRecord, sessionId string, err error) {
+	sessionId, bearer := h.sessionIdFromRequest(r)
+	if sessionId == "" {
+		return nil, "", ErrNoSession
+	}
+	if bearer && strings.HasPrefix(sessionId, gomagiclink.APITokenPrefix) {
+		user, err = h.mlc.VerifyAPIToken(sessionId)
+		if err != nil {
+			return nil, "", err
+		}
+		return user, "", nil
+	}
+	user, err = h.mlc.VerifySessionId(sessionId)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, sessionId, nil
+}
+
+// RequireSession is a middleware which lets through only the requests with a valid
+// session (see Authenticate()), and makes the user and the session ID available to the
+// handler with UserFromContext() and SessionIdFromContext(). Sessions in the grace
+// window (see gomagiclink.WithSessionGrace()) are let through with StaleSession set,
+// so the handler can refresh them. If refresh tokens are enabled (see
+// gomagiclink.WithRefreshTokens()), requests without a valid session cookie but with a
+// refresh cookie get a new session transparently, with both cookies replaced. Other
+// requests get a 401 Unauthorized error response with the RFC 6750 WWW-Authenticate header.
+// API tokens aren't accepted, as they can be limited to some scopes: requests with them
+// get a 403 Forbidden error response with insufficient_scope. Use RequireScope() for the
+// routes which accept them.
+func (h *AuthHandlers) RequireSession(next http.Handler) http.Handler {
+	return h.requireSession("", next)
+}
+
+// RequireScope is RequireSession(), which also accepts API tokens with the scope (see
+// gomagiclink.APITokenRecord.HasScope()), responding to those without it with a 403
+// Forbidden error. Requests authenticated by a session are let through, as they act with
+// all of the user's permissions.
+func (h *AuthHandlers) RequireScope(scope string, next http.Handler) http.Handler {
+	return h.requireSession(scope, next)
+}
+
+// requireSession implements RequireSession() and RequireScope(). API tokens are
+// accepted only if the scope isn't empty, and they have it.
+func (h *AuthHandlers) requireSession(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, sessionId, err := h.Authenticate(r)
+		if err != nil && BearerToken(r) == "" && (err == ErrNoSession || err == gomagiclink.ErrExpiredSessionId || err == gomagiclink.ErrInvalidSessionId) {
+			if u, s, rerr := h.refreshFromCookie(w, r); rerr != ErrNoSession {
+				user, sessionId, err = u, s, rerr
+			}
+		}
+		if err != nil {
+			h.unauthorized(w, r, err)
+			return
+		}
+		if user.APIToken != nil && (scope == "" || !user.APIToken.HasScope(scope)) {
+			h.insufficientScope(w, r, scope)
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, &sessionContext{user: user, sessionId: sessionId})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// insufficientScope responds to a request with an API token which doesn't have the scope,
+// or to a route which doesn't accept API tokens if the scope is empty.
+func (h *AuthHandlers) insufficientScope(w http.ResponseWriter, r *http.Request, scope string) {
+	challenge := "Bearer"
+	if h.Realm != "" {
+		challenge += ` realm="` + strings.ReplaceAll(h.Realm, `"`, "'") + `",`
+	}
+	challenge += ` error="insufficient_scope"`
+	if scope != "" {
+		challenge += `, scope="` + strings.ReplaceAll(scope, `"`, "'") + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	h.fail(w, r, nil, ErrorCodeInsufficientScope, http.StatusForbidden)
+}
+
+// unauthorized responds to a request which failed authentication.
+func (h *AuthHandlers) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	challenge := "Bearer"
+	if h.Realm != "" {
+		challenge += ` realm="` + strings.ReplaceAll(h.Realm, `"`, "'") + `"`
+	}
+	code, status := ErrorCodeSessionRequired, http.StatusUnauthorized
+	if err != ErrNoSession {
+		code, status = ErrorCode(err)
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			// RFC 6750 uses 401 for all the invalid tokens, including those of blocked users
+			if h.Realm != "" {
+				challenge += ","
+			}
+			challenge += ` error="invalid_token", error_description="` + code + `"`
+			status = http.StatusUnauthorized
+		}
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	h.fail(w, r, nil, code, status)
+	if status == http.StatusInternalServerError && h.Logger != nil {
+		h.Logger.Error("Error verifying the session", "path", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,108 @@
+package adapters_test
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/adapters"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+func TestAPITokenScopes(t *testing.T) {
+	db, err := storage.NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey := make([]byte, 32)
+	if _, err = rand.Read(secretKey); err != nil {
+		t.Fatal(err)
+	}
+	mlc, err := gomagiclink.NewAuthMagicLinkController(secretKey, time.Hour, time.Hour, db, gomagiclink.WithAPITokens(gomagiclink.NewMemoryAPITokenStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mlc.Close()
+	user, err := gomagiclink.NewAuthUserRecord("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	sessionId, err := mlc.GenerateSessionId(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readToken, _, err := mlc.GenerateAPIToken(user, "reader", []string{"read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedToken, revoked, err := mlc.GenerateAPIToken(user, "revoked", []string{"read", "write"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.RevokeAPIToken(user.ID, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	h := adapters.NewAuthHandlers(mlc, nil, "https://example.com/verify")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := adapters.UserFromContext(r.Context())
+		if u == nil || u.ID != user.ID {
+			t.Errorf("UserFromContext() = %v, want the user", u)
+		}
+		if u != nil && (u.APIToken != nil) == (adapters.SessionIdFromContext(r.Context()) != "") {
+			t.Error("a request should have either an API token or a session ID")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	routes := map[string]http.Handler{
+		"session": h.RequireSession(ok),
+		"read":    h.RequireScope("read", ok),
+		"write":   h.RequireScope("write", ok),
+	}
+	tests := []struct {
+		name      string
+		route     string
+		bearer    string
+		cookie    string
+		status    int
+		challenge string // Part of the WWW-Authenticate header
+	}{
+		{"session on a session route", "session", sessionId, "", http.StatusNoContent, ""},
+		{"session cookie on a session route", "session", "", sessionId, http.StatusNoContent, ""},
+		{"session on a scoped route", "write", sessionId, "", http.StatusNoContent, ""},
+		{"API token on a session route", "session", readToken, "", http.StatusForbidden, `error="insufficient_scope"`},
+		{"API token with the scope", "read", readToken, "", http.StatusNoContent, ""},
+		{"API token without the scope", "write", readToken, "", http.StatusForbidden, `scope="write"`},
+		{"revoked API token", "read", revokedToken, "", http.StatusUnauthorized, `error="invalid_token"`},
+		{"unknown API token", "read", gomagiclink.APITokenPrefix + "unknown", "", http.StatusUnauthorized, `error="invalid_token"`},
+		{"API token in the cookie", "read", "", readToken, http.StatusUnauthorized, ""},
+		{"no credentials", "read", "", "", http.StatusUnauthorized, "Bearer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+			r.Header.Set("Accept", "application/json")
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: h.CookieName, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			routes[tt.route].ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, tt.challenge) {
+				t.Errorf("WWW-Authenticate: %q, want it to contain %q", challenge, tt.challenge)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+// Package admin is an optional, embeddable web UI for administering gomagiclink users:
+// looking up users, disabling and locking accounts, revoking sessions and viewing the audit log.
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+const auditPageSize = 50
+const usersPageSize = 50
+
+var ErrNoMinAccessLevel = errors.New("MinAccessLevel must be greater than 0")
+
+// Options configures the admin UI.
+type Options struct {
+	BasePath       string       // Path the handler is mounted on, e.g. "/admin"
+	CookieName     string       // Name of the session cookie, default "session"
+	MinAccessLevel int          // Users need at least this AccessLevel to use the admin UI; must be greater than 0
+	LoginURL       string       // Where unauthenticated browsers are redirected; if empty, they get a 403 page
+	CSRFKey        []byte       // Key for the CSRF tokens; must be shared by all instances behind a load balancer. Default is random.
+	Logger         *slog.Logger // Receives unexpected errors
+}
+
+// Handler serves the admin UI. Only users with a valid session (verified with the
+// controller's VerifySessionId()) and an AccessLevel of at least Options.MinAccessLevel
+// can use it; impersonation sessions are rejected. Admins can only change the accounts
+// of users with a lower AccessLevel than theirs. Actions done through it are recorded
+// in the audit log by the controller.
+type Handler struct {
+	mlc   *gomagiclink.AuthMagicLinkController
+	opts  Options
+	mux   *http.ServeMux
+	pages map[string]*template.Template
+}
+
+type pageData struct {
+	Base    string
+	Admin   *gomagiclink.AuthUserRecord
+	CSRF    string
+	Message string
+	Error   string
+	Data    any
+}
+
+type userPageData struct {
+	User         *gomagiclink.AuthUserRecord
+	Sessions     []*gomagiclink.SessionRecord
+	Events       []gomagiclink.AuditEvent
+	AuditEnabled bool
+	Bounces      []*gomagiclink.BounceRecord
+	Suppressed   bool
+	BounceStore  bool
+}
+
+type usersPageData struct {
+	Users      []*gomagiclink.AuthUserRecord
+	Domain     string
+	Enabled    string
+	PrevOffset int
+	NextOffset int
+}
+
+type auditPageData struct {
+	Events     []gomagiclink.AuditEvent
+	UserID     string
+	Type       string
+	PrevOffset int
+	NextOffset int
+}
+
+// NewHandler creates the admin UI handler. Mount it on Options.BasePath, e.g.
+// mux.Handle("/admin/", h).
+func NewHandler(mlc *gomagiclink.AuthMagicLinkController, opts Options) (h *Handler, err error) {
+	if opts.MinAccessLevel <= 0 {
+		return nil, ErrNoMinAccessLevel
+	}
+	opts.BasePath = strings.TrimSuffix(opts.BasePath, "/")
+	if opts.CookieName == "" {
+		opts.CookieName = "session"
+	}
+	if opts.CSRFKey == nil {
+		opts.CSRFKey = make([]byte, 32)
+		if _, err = rand.Read(opts.CSRFKey); err != nil {
+			return
+		}
+	}
+	h = &Handler{mlc: mlc, opts: opts, pages: map[string]*template.Template{}}
+	funcs := template.FuncMap{
+		"base": func() string { return opts.BasePath },
+		"fmtTime": func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.UTC().Format("2006-01-02 15:04:05")
+		},
+		"uuidOrEmpty": func(id uuid.UUID) string {
+			if id == uuid.Nil {
+				return ""
+			}
+			return id.String()
+		},
+	}
+	for _, page := range []string{"index.html", "users.html", "user.html", "audit.html", "error.html"} {
+		h.pages[page], err = template.New("layout.html").Funcs(funcs).ParseFS(templateFS, "templates/layout.html", "templates/"+page)
+		if err != nil {
+			return nil, err
+		}
+	}
+	static, _ := fs.Sub(staticFS, "static")
+
+	h.mux = http.NewServeMux()
+	h.mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static)))
+	h.mux.HandleFunc("GET /{$}", h.index)
+	h.mux.HandleFunc("GET /users", h.users)
+	h.mux.HandleFunc("GET /users/{id}", h.user)
+	h.mux.HandleFunc("GET /audit", h.audit)
+	h.mux.HandleFunc("POST /users/{id}/{action}", h.userAction)
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	http.StripPrefix(h.opts.BasePath, h.mux).ServeHTTP(w, r)
+}
+
+// authenticate returns the admin user and the session ID, or writes an error response.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*gomagiclink.AuthUserRecord, string) {
+	cookie, err := r.Cookie(h.opts.CookieName)
+	if err == nil {
+		user, err := h.mlc.VerifySessionId(cookie.Value)
+		if err == nil && user.ImpersonatedBy == uuid.Nil && user.AccessLevel >= h.opts.MinAccessLevel {
+			return user, cookie.Value
+		}
+		if err == gomagiclink.ErrStorageUnavailable {
+			h.render(w, http.StatusServiceUnavailable, "error.html", pageData{Error: "Storage is unavailable"})
+			return nil, ""
+		}
+	}
+	if h.opts.LoginURL != "" && r.Method == http.MethodGet {
+		http.Redirect(w, r, h.opts.LoginURL, http.StatusSeeOther)
+		return nil, ""
+	}
+	h.render(w, http.StatusForbidden, "error.html", pageData{Error: "Access denied"})
+	return nil, ""
+}
+
+func (h *Handler) csrfToken(sessionId string) string {
+	mac := hmac.New(sha256.New, h.opts.CSRFKey)
+	mac.Write([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Handler) render(w http.ResponseWriter, status int, page string, data pageData) {
+	data.Base = h.opts.BasePath
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := h.pages[page].Execute(w, data); err != nil && h.opts.Logger != nil {
+		h.opts.Logger.Error("Error rendering admin page", "page", page, "error", err)
+	}
+}
+
+func (h *Handler) internalError(w http.ResponseWriter, r *http.Request, admin *gomagiclink.AuthUserRecord, err error) {
+	if h.opts.Logger != nil {
+		h.opts.Logger.Error("Error in admin UI", "path", r.URL.Path, "error", err)
+	}
+	status := http.StatusInternalServerError
+	if err == gomagiclink.ErrStorageUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	h.render(w, status, "error.html", pageData{Admin: admin, Error: http.StatusText(status)})
+}
+
+// index shows the user search form and the most recent audit events. Searching
+// by e-mail address or user ID redirects to the user's page.
+func (h *Handler) index(w http.ResponseWriter, r *http.Request) {
+	admin, sessionId := h.authenticate(w, r)
+	if admin == nil {
+		return
+	}
+	data := pageData{Admin: admin, CSRF: h.csrfToken(sessionId)}
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		var user *gomagiclink.AuthUserRecord
+		var err error
+		if id, uuidErr := uuid.Parse(q); uuidErr == nil {
+			user, err = h.mlc.GetUserById(id)
+		} else {
+			user, err = h.mlc.GetUserByEmail(gomagiclink.NormalizeEmail(q))
+		}
+		if err == nil {
+			http.Redirect(w, r, h.opts.BasePath+"/users/"+user.ID.String(), http.StatusSeeOther)
+			return
+		}
+		if err != gomagiclink.ErrUserNotFound {
+			h.internalError(w, r, admin, err)
+			return
+		}
+		data.Error = "User not found"
+	}
+	events, err := h.mlc.GetAuditEvents(gomagiclink.AuditFilter{Since: time.Now().Add(-24 * time.Hour)})
+	if err != nil && err != gomagiclink.ErrNoAuditStore {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	data.Data = newestFirst(events, auditPageSize)
+	h.render(w, http.StatusOK, "index.html", data)
+}
+
+// users lists the users, optionally filtered by e-mail domain and enabled state.
+func (h *Handler) users(w http.ResponseWriter, r *http.Request) {
+	admin, _ := h.authenticate(w, r)
+	if admin == nil {
+		return
+	}
+	query := r.URL.Query()
+	data := usersPageData{Domain: strings.TrimSpace(query.Get("domain")), Enabled: query.Get("enabled")}
+	var filter gomagiclink.UserFilter
+	if data.Domain != "" {
+		filter = filter.WhereEmailDomain(data.Domain)
+	}
+	switch data.Enabled {
+	case "yes":
+		filter = filter.WhereEnabled(true)
+	case "no":
+		filter = filter.WhereEnabled(false)
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	offset = max(offset, 0)
+	page, err := h.mlc.ListUsersByFilter(filter.Page(offset, usersPageSize))
+	if err == gomagiclink.ErrUserListingNotSupported {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "The storage can't list users; search by e-mail address or ID"})
+		return
+	}
+	if err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	data.Users = page.Users
+	data.PrevOffset = -1
+	if offset > 0 {
+		data.PrevOffset = max(offset-usersPageSize, 0)
+	}
+	data.NextOffset = page.NextOffset
+	h.render(w, http.StatusOK, "users.html", pageData{Admin: admin, Data: data})
+}
+
+// user shows the user's record, sessions, audit events and bounces, with the action forms.
+func (h *Handler) user(w http.ResponseWriter, r *http.Request) {
+	admin, sessionId := h.authenticate(w, r)
+	if admin == nil {
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "User not found"})
+		return
+	}
+	user, err := h.mlc.GetUserById(id)
+	if err == gomagiclink.ErrUserNotFound {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "User not found"})
+		return
+	}
+	if err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	sessions, err := h.mlc.GetUserSessions(id)
+	if err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	events, err := h.mlc.GetAuditEvents(gomagiclink.AuditFilter{UserID: id})
+	if err != nil && err != gomagiclink.ErrNoAuditStore {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	data := userPageData{
+		User:         user,
+		Sessions:     sessions,
+		Events:       newestFirst(events, auditPageSize),
+		AuditEnabled: err == nil,
+	}
+	data.Bounces, err = h.mlc.GetBounceHistory(user.Email)
+	if err != nil && err != gomagiclink.ErrNoBounceStore {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	data.BounceStore = err == nil
+	if data.Suppressed, err = h.mlc.IsEmailSuppressed(user.Email); err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	h.render(w, http.StatusOK, "user.html", pageData{
+		Admin:   admin,
+		CSRF:    h.csrfToken(sessionId),
+		Message: r.URL.Query().Get("done"),
+		Data:    data,
+	})
+}
+
+// audit shows the audit log, newest first, optionally filtered by user ID and event type.
+func (h *Handler) audit(w http.ResponseWriter, r *http.Request) {
+	admin, _ := h.authenticate(w, r)
+	if admin == nil {
+		return
+	}
+	query := r.URL.Query()
+	data := auditPageData{UserID: query.Get("user"), Type: query.Get("type")}
+	var filter gomagiclink.AuditFilter
+	if data.UserID != "" {
+		id, err := uuid.Parse(data.UserID)
+		if err != nil {
+			h.render(w, http.StatusBadRequest, "error.html", pageData{Admin: admin, Error: "Invalid user ID"})
+			return
+		}
+		filter.UserID = id
+	}
+	if data.Type != "" {
+		filter.Types = []string{data.Type}
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	offset = max(offset, 0)
+	events, err := h.mlc.GetAuditEvents(filter)
+	if err == gomagiclink.ErrNoAuditStore {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "The audit log isn't queryable; configure an AuditStore"})
+		return
+	}
+	if err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	events = newestFirst(events, 0)
+	if offset < len(events) {
+		data.Events = events[offset:min(offset+auditPageSize, len(events))]
+	}
+	data.PrevOffset = -1
+	if offset > 0 {
+		data.PrevOffset = max(offset-auditPageSize, 0)
+	}
+	data.NextOffset = -1
+	if offset+auditPageSize < len(events) {
+		data.NextOffset = offset + auditPageSize
+	}
+	h.render(w, http.StatusOK, "audit.html", pageData{Admin: admin, Data: data})
+}
+
+// userAction handles the forms on the user page.
+func (h *Handler) userAction(w http.ResponseWriter, r *http.Request) {
+	admin, sessionId := h.authenticate(w, r)
+	if admin == nil {
+		return
+	}
+	if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(h.csrfToken(sessionId))) {
+		h.render(w, http.StatusForbidden, "error.html", pageData{Admin: admin, Error: "Invalid CSRF token, reload the page"})
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "User not found"})
+		return
+	}
+	if id == admin.ID {
+		h.render(w, http.StatusBadRequest, "error.html", pageData{Admin: admin, Error: "Admins can't change their own account here"})
+		return
+	}
+	target, err := h.mlc.GetUserById(id)
+	if err == gomagiclink.ErrUserNotFound {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "User not found"})
+		return
+	}
+	if err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	if target.AccessLevel >= admin.AccessLevel {
+		h.render(w, http.StatusForbidden, "error.html", pageData{Admin: admin, Error: "Admins can only change accounts with a lower access level"})
+		return
+	}
+	var done string
+	switch r.PathValue("action") {
+	case "disable":
+		err, done = h.mlc.DisableUser(id), "User disabled"
+	case "enable":
+		err, done = h.mlc.EnableUser(id), "User enabled"
+	case "lock":
+		var until time.Time
+		if hours, _ := strconv.Atoi(r.PostFormValue("hours")); hours > 0 {
+			until = time.Now().Add(time.Duration(hours) * time.Hour)
+		}
+		err, done = h.mlc.LockUser(id, r.PostFormValue("reason"), until), "User locked"
+	case "unlock":
+		err, done = h.mlc.UnlockUser(id), "User unlocked"
+	case "revoke-sessions":
+		err, done = h.mlc.RevokeUserSessions(id), "Sessions revoked"
+	case "unsuppress":
+		err, done = h.mlc.UnsuppressEmail(target.Email), "E-mail address unsuppressed"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == gomagiclink.ErrUserNotFound {
+		h.render(w, http.StatusNotFound, "error.html", pageData{Admin: admin, Error: "User not found"})
+		return
+	}
+	if err != nil {
+		h.internalError(w, r, admin, err)
+		return
+	}
+	if h.opts.Logger != nil {
+		h.opts.Logger.Info("Admin action", "admin", admin.ID, "action", r.PathValue("action"), "user", id)
+	}
+	http.Redirect(w, r, h.opts.BasePath+"/users/"+id.String()+"?done="+url.QueryEscape(done), http.StatusSeeOther)
+}
+
+// newestFirst reverses the events (which are returned oldest first), keeping at most
+// limit of them if limit isn't 0.
+func newestFirst(events []gomagiclink.AuditEvent, limit int) []gomagiclink.AuditEvent {
+	result := make([]gomagiclink.AuditEvent, 0, len(events))
+	for i := len(events) - 1; i >= 0 && (limit == 0 || len(result) < limit); i-- {
+		result = append(result, events[i])
+	}
+	return result
+}
@@ -0,0 +1,52 @@
+package gomagiclink
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// MaxAntiPhishingPhraseLength is the maximum length of an anti-phishing phrase, in characters.
+const MaxAntiPhishingPhraseLength = 64
+
+var ErrInvalidAntiPhishingPhrase = errors.New("invalid anti-phishing phrase")
+
+// SetAntiPhishingPhrase sets the user's anti-phishing phrase: a phrase the user chooses,
+// which is included in the magic link messages sent to them, so they can tell genuine
+// messages from phishing ones, which can't know it. An empty phrase removes it. The phrase
+// is trimmed, and must not be longer than MaxAntiPhishingPhraseLength characters or
+// contain control characters. The change is recorded in the audit log (without the phrase).
+func (mlc *AuthMagicLinkController) SetAntiPhishingPhrase(id uuid.UUID, phrase string) (err error) {
+	phrase = strings.TrimSpace(phrase)
+	if utf8.RuneCountInString(phrase) > MaxAntiPhishingPhraseLength || strings.ContainsFunc(phrase, unicode.IsControl) {
+		return ErrInvalidAntiPhishingPhrase
+	}
+	user, err := mlc.loadUserById(id)
+	if err != nil {
+		return
+	}
+	user.AntiPhishingPhrase = phrase
+	if err = mlc.UpdateUser(user); err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditPhraseChanged, UserID: user.ID, Email: user.Email})
+	return nil
+}
+
+// GetAntiPhishingPhrase returns the anti-phishing phrase of the user with the e-mail
+// address, for MagicLinkMessage.AntiPhishingPhrase. It returns an empty string if the
+// user doesn't exist or hasn't set a phrase. The phrase must only be sent to the user's
+// own address, never shown to whoever requested the magic link.
+func (mlc *AuthMagicLinkController) GetAntiPhishingPhrase(email string) (phrase string, err error) {
+	user, err := mlc.loadUserByEmail(NormalizeEmail(email))
+	if err == ErrUserNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.AntiPhishingPhrase, nil
+}
@@ -0,0 +1,254 @@
+package gomagiclink
+
+import (
+	"crypto/rand"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APITokenPrefix starts all the API tokens, so they can't be confused with session IDs,
+// and secret scanners can find them in leaked code and logs.
+const APITokenPrefix = "mlpat_"
+
+// apiTokenLastUsedInterval limits how often the LastUsedAt time is written to the store.
+const apiTokenLastUsedInterval = time.Minute
+
+var ErrAPITokensDisabled = errors.New("API tokens not enabled")
+var ErrInvalidAPIToken = errors.New("invalid API token")
+var ErrAPITokenNotFound = errors.New("API token not found")
+
+// APITokenRecord is an API token (personal access token), as kept in an APITokenStore.
+type APITokenRecord struct {
+	ID         string    `json:"id"` // SHA-256 hash of the API token, so a leaked store doesn't leak tokens
+	UserID     uuid.UUID `json:"user_id"`
+	Name       string    `json:"name"` // Chosen by the user, to tell the tokens apart
+	Scopes     []string  `json:"scopes,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`   // Zero if the token doesn't expire
+	LastUsedAt time.Time `json:"last_used_at"` // Zero if it hasn't been used; updated at most once a minute
+}
+
+// HasScope returns true if the token was issued with the scope.
+func (rec *APITokenRecord) HasScope(scope string) bool {
+	return slices.Contains(rec.Scopes, scope)
+}
+
+// APITokenStore keeps the API tokens, see WithAPITokens().
+type APITokenStore interface {
+	AddAPIToken(rec *APITokenRecord) error
+	GetAPIToken(id string) (*APITokenRecord, error)               // Returns ErrAPITokenNotFound if it's not in the store
+	GetUserAPITokens(userID uuid.UUID) ([]*APITokenRecord, error) // Including the expired ones
+	SetAPITokenLastUsed(id string, lastUsed time.Time) error
+	RemoveAPIToken(id string) error
+	RemoveUserAPITokens(userID uuid.UUID) error
+}
+
+// WithAPITokens enables long-lived API tokens (personal access tokens), which users
+// create with GenerateAPIToken() for scripts and integrations, and which are verified
+// with VerifyAPIToken() (adapters.AuthHandlers.RequireScope() accepts them as bearer
+// tokens). Only their hashes are kept in the APITokenStore.
+func WithAPITokens(store APITokenStore) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.apiTokenStore = store
+	}
+}
+
+// GenerateAPIToken creates an API token for the user, with a name to identify it in
+// ListAPITokens(), and the scopes which the app checks with APITokenRecord.HasScope().
+// If expiry is 0, the token doesn't expire. The token starts with APITokenPrefix, and is
+// returned only here, so show it to the user once. API tokens aren't generated for users
+// who still need to enter a TOTP code (ErrTOTPRequired), nor for impersonation sessions
+// (ErrImpersonationNotAllowed). It's recorded in the audit log.
+func (mlc *AuthMagicLinkController) GenerateAPIToken(user *AuthUserRecord, name string, scopes []string, expiry time.Duration) (token string, rec *APITokenRecord, err error) {
+	if mlc.apiTokenStore == nil {
+		return "", nil, ErrAPITokensDisabled
+	}
+	if user.TOTPPending {
+		return "", nil, ErrTOTPRequired
+	}
+	if user.ImpersonatedBy != uuid.Nil {
+		return "", nil, ErrImpersonationNotAllowed
+	}
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	token = APITokenPrefix + encodeToString(random)
+	now := time.Now()
+	rec = &APITokenRecord{
+		ID:        storedSessionHash(token),
+		UserID:    user.ID,
+		Name:      name,
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: now,
+	}
+	if expiry > 0 {
+		rec.ExpiresAt = now.Add(expiry)
+	}
+	if err = mlc.apiTokenStore.AddAPIToken(rec); err != nil {
+		return "", nil, err
+	}
+	mlc.audit(AuditEvent{Type: AuditAPITokenCreated, UserID: user.ID, Email: user.Email, Details: map[string]string{"token_id": rec.ID, "name": name}})
+	return token, rec, nil
+}
+
+// VerifyAPIToken verifies the API token generated by GenerateAPIToken(), and returns the
+// user's record, with the APIToken field set to the token's record. Invalid, expired and
+// revoked tokens are rejected with ErrInvalidAPIToken, and those of disabled and locked
+// users with ErrUserDisabled and ErrUserLocked.
+func (mlc *AuthMagicLinkController) VerifyAPIToken(token string) (user *AuthUserRecord, err error) {
+	if mlc.apiTokenStore == nil {
+		return nil, ErrAPITokensDisabled
+	}
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, ErrInvalidAPIToken
+	}
+	rec, err := mlc.apiTokenStore.GetAPIToken(storedSessionHash(token))
+	if err == ErrAPITokenNotFound {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !rec.ExpiresAt.IsZero() && !rec.ExpiresAt.After(now) {
+		return nil, ErrInvalidAPIToken
+	}
+	user, err = mlc.getUserById(rec.UserID)
+	if err == ErrUserNotFound {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.Enabled {
+		return nil, ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, ErrUserLocked
+	}
+	if now.Sub(rec.LastUsedAt) >= apiTokenLastUsedInterval {
+		if err = mlc.apiTokenStore.SetAPITokenLastUsed(rec.ID, now); err != nil {
+			// Not worth failing the request for
+			mlc.logger.Error("Error updating API token's last use", "error", err)
+		}
+		rec.LastUsedAt = now
+	}
+	user.APIToken = rec
+	return user, nil
+}
+
+// ListAPITokens returns the user's API tokens, including the expired ones, oldest first.
+func (mlc *AuthMagicLinkController) ListAPITokens(userId uuid.UUID) ([]*APITokenRecord, error) {
+	if mlc.apiTokenStore == nil {
+		return nil, ErrAPITokensDisabled
+	}
+	recs, err := mlc.apiTokenStore.GetUserAPITokens(userId)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(recs, func(a, b *APITokenRecord) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return recs, nil
+}
+
+// RevokeAPIToken removes the user's API token with the ID (APITokenRecord.ID), returning
+// ErrAPITokenNotFound if the user doesn't have it. It's recorded in the audit log.
+func (mlc *AuthMagicLinkController) RevokeAPIToken(userId uuid.UUID, id string) (err error) {
+	if mlc.apiTokenStore == nil {
+		return ErrAPITokensDisabled
+	}
+	rec, err := mlc.apiTokenStore.GetAPIToken(id)
+	if err != nil {
+		return
+	}
+	if rec.UserID != userId {
+		return ErrAPITokenNotFound
+	}
+	if err = mlc.apiTokenStore.RemoveAPIToken(id); err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditAPITokenRevoked, UserID: userId, Details: map[string]string{"token_id": rec.ID, "name": rec.Name}})
+	return nil
+}
+
+// MemoryAPITokenStore is an in-memory APITokenStore, for development and tests: the
+// tokens are lost when the app restarts.
+type MemoryAPITokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]*APITokenRecord
+}
+
+func NewMemoryAPITokenStore() *MemoryAPITokenStore {
+	return &MemoryAPITokenStore{tokens: map[string]*APITokenRecord{}}
+}
+
+func (ms *MemoryAPITokenStore) AddAPIToken(rec *APITokenRecord) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	recCopy := *rec
+	ms.tokens[rec.ID] = &recCopy
+	return nil
+}
+
+func (ms *MemoryAPITokenStore) GetAPIToken(id string) (*APITokenRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rec, ok := ms.tokens[id]
+	if !ok {
+		return nil, ErrAPITokenNotFound
+	}
+	recCopy := *rec
+	return &recCopy, nil
+}
+
+func (ms *MemoryAPITokenStore) GetUserAPITokens(userID uuid.UUID) ([]*APITokenRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var recs []*APITokenRecord
+	for _, rec := range ms.tokens {
+		if rec.UserID == userID {
+			recCopy := *rec
+			recs = append(recs, &recCopy)
+		}
+	}
+	return recs, nil
+}
+
+func (ms *MemoryAPITokenStore) SetAPITokenLastUsed(id string, lastUsed time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rec, ok := ms.tokens[id]
+	if !ok {
+		return ErrAPITokenNotFound
+	}
+	rec.LastUsedAt = lastUsed
+	return nil
+}
+
+func (ms *MemoryAPITokenStore) RemoveAPIToken(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.tokens[id]; !ok {
+		return ErrAPITokenNotFound
+	}
+	delete(ms.tokens, id)
+	return nil
+}
+
+func (ms *MemoryAPITokenStore) RemoveUserAPITokens(userID uuid.UUID) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, rec := range ms.tokens {
+		if rec.UserID == userID {
+			delete(ms.tokens, id)
+		}
+	}
+	return nil
+}
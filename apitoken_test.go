@@ -0,0 +1,62 @@
+package gomagiclink_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+func TestAPITokens(t *testing.T) {
+	mlc, _, user := newTestController(t, gomagiclink.WithAPITokens(gomagiclink.NewMemoryAPITokenStore()))
+	scopes := []string{"read", "orders:write"}
+	token, rec, err := mlc.GenerateAPIToken(user, "ci", scopes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes[0] = "admin"
+	verified, err := mlc.VerifyAPIToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.ID != user.ID || verified.APIToken == nil || verified.APIToken.ID != rec.ID {
+		t.Fatalf("VerifyAPIToken() = user %v with token %+v, want %v with %q", verified.ID, verified.APIToken, user.ID, rec.ID)
+	}
+	for scope, want := range map[string]bool{"read": true, "orders:write": true, "admin": false, "orders": false, "": false} {
+		if got := verified.APIToken.HasScope(scope); got != want {
+			t.Errorf("HasScope(%q) = %v, want %v", scope, got, want)
+		}
+	}
+	if _, err = mlc.VerifyAPIToken(gomagiclink.APITokenPrefix + "unknown"); err != gomagiclink.ErrInvalidAPIToken {
+		t.Errorf("unknown API token = %v, want ErrInvalidAPIToken", err)
+	}
+	if _, err = mlc.VerifySessionId(token); err == nil {
+		t.Error("API token accepted as a session ID")
+	}
+
+	expiring, _, err := mlc.GenerateAPIToken(user, "short", []string{"read"}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err = mlc.VerifyAPIToken(expiring); err != gomagiclink.ErrInvalidAPIToken {
+		t.Errorf("expired API token = %v, want ErrInvalidAPIToken", err)
+	}
+
+	if err = mlc.RevokeAPIToken(user.ID, rec.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mlc.VerifyAPIToken(token); err != gomagiclink.ErrInvalidAPIToken {
+		t.Errorf("revoked API token = %v, want ErrInvalidAPIToken", err)
+	}
+	other, _, err := mlc.GenerateAPIToken(user, "other", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.InvalidateUserTokens(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mlc.VerifyAPIToken(other); err != gomagiclink.ErrInvalidAPIToken {
+		t.Errorf("API token after InvalidateUserTokens() = %v, want ErrInvalidAPIToken", err)
+	}
+}
@@ -0,0 +1,59 @@
+package gomagiclink_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+func TestWrongAudience(t *testing.T) {
+	db, err := storage.NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey := newTestSecretKey(t)
+	user, err := gomagiclink.NewAuthUserRecord("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		opts []gomagiclink.ControllerOption
+	}{
+		{"session", nil},
+		{"encrypted session", []gomagiclink.ControllerOption{gomagiclink.WithEncryptedSessions(time.Minute)}},
+		{"claims session", []gomagiclink.ControllerOption{gomagiclink.WithClaimsProvider(testClaimsProvider{})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newController := func(audience string) *gomagiclink.AuthMagicLinkController {
+				t.Helper()
+				opts := append([]gomagiclink.ControllerOption{gomagiclink.WithAudience(audience)}, tc.opts...)
+				mlc, err := gomagiclink.NewAuthMagicLinkController(secretKey, time.Hour, time.Hour, db, opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { mlc.Close() })
+				return mlc
+			}
+			staging, production := newController("staging"), newController("production")
+			if err := staging.StoreUser(user); err != nil {
+				t.Fatal(err)
+			}
+			sessionId, err := staging.GenerateSessionId(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = staging.VerifySessionId(sessionId); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = production.VerifySessionId(sessionId); err != gomagiclink.ErrWrongAudience {
+				t.Errorf("session from another audience = %v, want ErrWrongAudience", err)
+			}
+			if _, err = newController("").VerifySessionId(sessionId); err != gomagiclink.ErrWrongAudience {
+				t.Errorf("session from an audience verified without one = %v, want ErrWrongAudience", err)
+			}
+		})
+	}
+}
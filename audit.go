@@ -0,0 +1,111 @@
+package gomagiclink
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audit event types
+const (
+	AuditImpersonationIssued = "impersonation.issued"
+	AuditImpersonationUsed   = "impersonation.used"
+	AuditLinkOpened          = "link.opened"
+	AuditChallengeIssued     = "challenge.issued"
+	AuditSessionRevoked      = "session.revoked"
+	AuditSessionRefreshed    = "session.refreshed"
+	AuditUserCreated         = "user.created"
+	AuditLoginSucceeded      = "login.succeeded"
+	AuditLoginFailed         = "login.failed"
+	AuditUserLocked          = "user.locked"
+	AuditUserUnlocked        = "user.unlocked"
+	AuditUserDisabled        = "user.disabled"
+	AuditUserEnabled         = "user.enabled"
+	AuditPhraseChanged       = "user.phrase_changed"
+	AuditUsersMerged         = "user.merged"
+	AuditAPITokenCreated     = "api_token.created"
+	AuditAPITokenRevoked     = "api_token.revoked"
+	AuditMessageDelivered    = "message.delivered" // Recorded by senders, e.g. mailer.FailoverSender
+)
+
+// AuditEvent is a security-relevant event recorded by the controller.
+type AuditEvent struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	UserID  uuid.UUID         `json:"user_id,omitempty"`  // The user the event is about
+	ActorID uuid.UUID         `json:"actor_id,omitempty"` // The user who caused the event, if different
+	Email   string            `json:"email,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// AuditLogger receives audit events from the controller. Set it with the
+// WithAuditLogger() option. LogAuditEvent() is called synchronously, so it should be fast.
+type AuditLogger interface {
+	LogAuditEvent(ev AuditEvent)
+}
+
+// WithAuditLogger installs an AuditLogger into the controller.
+func WithAuditLogger(al AuditLogger) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.auditLogger = al
+	}
+}
+
+// SlogAuditLogger is an AuditLogger which writes events to a slog.Logger.
+type SlogAuditLogger struct {
+	Logger *slog.Logger
+	Level  slog.Level
+}
+
+func NewSlogAuditLogger(logger *slog.Logger) *SlogAuditLogger {
+	return &SlogAuditLogger{Logger: logger, Level: slog.LevelInfo}
+}
+
+func (sal *SlogAuditLogger) LogAuditEvent(ev AuditEvent) {
+	attrs := []slog.Attr{
+		slog.String("type", ev.Type),
+		slog.Time("time", ev.Time),
+	}
+	if ev.UserID != uuid.Nil {
+		attrs = append(attrs, slog.String("user_id", ev.UserID.String()))
+	}
+	if ev.ActorID != uuid.Nil {
+		attrs = append(attrs, slog.String("actor_id", ev.ActorID.String()))
+	}
+	if ev.Email != "" {
+		attrs = append(attrs, slog.String("email", ev.Email))
+	}
+	for k, v := range ev.Details {
+		attrs = append(attrs, slog.String(k, v))
+	}
+	sal.Logger.LogAttrs(context.Background(), sal.Level, "audit", attrs...)
+}
+
+// LogAuditEvent records an event in the audit log, if an AuditLogger is configured.
+// Sub-packages such as `adapters` use it to record their own events.
+func (mlc *AuthMagicLinkController) LogAuditEvent(ev AuditEvent) {
+	mlc.audit(ev)
+}
+
+// audit sends the event to the AuditLogger, if one is configured.
+func (mlc *AuthMagicLinkController) audit(ev AuditEvent) {
+	if mlc.auditLogger == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	mlc.auditLogger.LogAuditEvent(ev)
+}
+
+// MultiAuditLogger sends audit events to all of the AuditLoggers, e.g. to a log and
+// to a webhook dispatcher.
+type MultiAuditLogger []AuditLogger
+
+func (mal MultiAuditLogger) LogAuditEvent(ev AuditEvent) {
+	for _, al := range mal {
+		al.LogAuditEvent(ev)
+	}
+}
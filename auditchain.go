@@ -0,0 +1,223 @@
+package gomagiclink
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoAuditChainKey = errors.New("audit chain key is empty")
+
+// The Details keys added by ChainedAuditLogger
+const (
+	AuditChainID   = "chain_id"
+	AuditChainSeq  = "chain_seq"
+	AuditChainPrev = "chain_prev" // Hash of the previous event of the chain, empty for the first one
+	AuditChainHash = "chain_hash"
+)
+
+// AuditChainHead is the last event of an audit chain, see ChainedAuditLogger.
+type AuditChainHead struct {
+	ChainID string `json:"chain_id"`
+	Seq     uint64 `json:"seq"`
+	Hash    string `json:"hash"`
+}
+
+// ChainedAuditLogger makes the audit log tamper-evident, for regulated environments. It
+// adds the position of each event in a chain, and an HMAC of the event including the hash
+// of the previous one, to the event's Details, and passes it to the next AuditLogger
+// (e.g. a storage.SQLAuditStore). Modified, inserted and deleted events are then detected
+// by VerifyAuditChain().
+//
+// Each ChainedAuditLogger has its own chain, so each app instance writes a separate chain
+// into a shared log. Deleting the most recent events can only be detected by comparing the
+// chain with its Head(), so record it somewhere the log's writers can't change it (e.g.
+// log it to a separate system periodically), and pass it to NewChainedAuditLogger() to
+// continue the chain after a restart.
+type ChainedAuditLogger struct {
+	next AuditLogger
+	key  []byte
+	lock sync.Mutex
+	head AuditChainHead
+}
+
+// NewChainedAuditLogger creates a ChainedAuditLogger passing the events to next. The
+// key is used for the HMACs, and is needed to verify the chain; keep it apart from the
+// log. If head is empty, a new chain with a random ID is started.
+func NewChainedAuditLogger(next AuditLogger, key []byte, head AuditChainHead) (cal *ChainedAuditLogger, err error) {
+	if len(key) == 0 {
+		return nil, ErrNoAuditChainKey
+	}
+	if head.ChainID == "" {
+		head = AuditChainHead{ChainID: uuid.NewString()}
+	}
+	return &ChainedAuditLogger{next: next, key: slices.Clone(key), head: head}, nil
+}
+
+func (cal *ChainedAuditLogger) LogAuditEvent(ev AuditEvent) {
+	cal.lock.Lock()
+	defer cal.lock.Unlock()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	// SQL stores keep microseconds
+	ev.Time = ev.Time.Truncate(time.Microsecond)
+	ev.Details = maps.Clone(ev.Details)
+	if ev.Details == nil {
+		ev.Details = map[string]string{}
+	}
+	ev.Details[AuditChainID] = cal.head.ChainID
+	ev.Details[AuditChainSeq] = strconv.FormatUint(cal.head.Seq+1, 10)
+	ev.Details[AuditChainPrev] = cal.head.Hash
+	delete(ev.Details, AuditChainHash)
+	hash := auditChainHash(cal.key, &ev)
+	ev.Details[AuditChainHash] = hash
+	cal.head.Seq++
+	cal.head.Hash = hash
+	cal.next.LogAuditEvent(ev)
+}
+
+// Head returns the chain's last event.
+func (cal *ChainedAuditLogger) Head() AuditChainHead {
+	cal.lock.Lock()
+	defer cal.lock.Unlock()
+	return cal.head
+}
+
+// GetAuditEvents queries the next AuditLogger, if it's an AuditStore, so the controller's
+// GetAuditEvents() still works.
+func (cal *ChainedAuditLogger) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	if store, ok := cal.next.(AuditStore); ok {
+		return store.GetAuditEvents(filter)
+	}
+	return nil, ErrNoAuditStore
+}
+
+// auditChainHash returns the HMAC of the event, with all the Details except AuditChainHash.
+func auditChainHash(key []byte, ev *AuditEvent) string {
+	details := maps.Clone(ev.Details)
+	delete(details, AuditChainHash)
+	// Map keys are marshalled in order, so the encoding is canonical
+	data, _ := json.Marshal(struct {
+		Time    string            `json:"time"`
+		Type    string            `json:"type"`
+		UserID  string            `json:"user_id"`
+		ActorID string            `json:"actor_id"`
+		Email   string            `json:"email"`
+		Details map[string]string `json:"details"`
+	}{
+		Time:    ev.Time.UTC().Format(time.RFC3339Nano),
+		Type:    ev.Type,
+		UserID:  uuidOrEmpty(ev.UserID),
+		ActorID: uuidOrEmpty(ev.ActorID),
+		Email:   ev.Email,
+		Details: details,
+	})
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditChainProblem is a sign of tampering found by VerifyAuditChain().
+type AuditChainProblem struct {
+	Index   int    // Of the event in the verified slice, -1 for missing events
+	ChainID string // Empty for events which aren't chained
+	Seq     uint64
+	Problem string // E.g. "modified"
+}
+
+// AuditChainSummary describes a chain verified by VerifyAuditChain().
+type AuditChainSummary struct {
+	Head     AuditChainHead // The chain's last event
+	FirstSeq uint64         // Sequence number of the chain's first event, 1 unless events have been purged
+	Events   int
+}
+
+// AuditChainReport is the result of VerifyAuditChain().
+type AuditChainReport struct {
+	Chains   []AuditChainSummary // Ordered by chain ID
+	Problems []AuditChainProblem
+}
+
+// OK returns true if no problems were found.
+func (acr *AuditChainReport) OK() bool {
+	return len(acr.Problems) == 0
+}
+
+// VerifyAuditChain checks the chains written by ChainedAuditLogger into the events, e.g.
+// as returned by GetAuditEvents(), and reports:
+//
+//   - "unchained": events without a chain, i.e. inserted into the log by other means
+//   - "modified": events whose hash doesn't match their contents
+//   - "broken": events whose previous hash doesn't match the previous event's hash, i.e.
+//     the chain was rewritten
+//   - "duplicate": repeated sequence numbers
+//   - "missing": gaps in the sequence numbers, i.e. deleted events
+//
+// The events can be in any order. If the oldest events have been purged, the chain is
+// verified from the first remaining event; compare the returned chains' FirstSeq and Head
+// with the retention policy and the recorded heads, to detect deletions at either end.
+func VerifyAuditChain(events []AuditEvent, key []byte) (report AuditChainReport) {
+	type link struct {
+		index    int
+		seq      uint64
+		modified bool
+	}
+	chains := map[string][]link{}
+	for i := range events {
+		ev := &events[i]
+		id := ev.Details[AuditChainID]
+		seq, err := strconv.ParseUint(ev.Details[AuditChainSeq], 10, 64)
+		if id == "" || err != nil || seq == 0 {
+			report.Problems = append(report.Problems, AuditChainProblem{Index: i, Problem: "unchained"})
+			continue
+		}
+		modified := !hmac.Equal([]byte(ev.Details[AuditChainHash]), []byte(auditChainHash(key, ev)))
+		if modified {
+			report.Problems = append(report.Problems, AuditChainProblem{Index: i, ChainID: id, Seq: seq, Problem: "modified"})
+		}
+		chains[id] = append(chains[id], link{index: i, seq: seq, modified: modified})
+	}
+	ids := make([]string, 0, len(chains))
+	for id := range chains {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		links := chains[id]
+		slices.SortStableFunc(links, func(a, b link) int { return cmp.Compare(a.seq, b.seq) })
+		for n, l := range links[1:] {
+			prev := links[n]
+			switch {
+			case l.seq == prev.seq:
+				report.Problems = append(report.Problems, AuditChainProblem{Index: l.index, ChainID: id, Seq: l.seq, Problem: "duplicate"})
+			case l.seq > prev.seq+1:
+				for seq := prev.seq + 1; seq < l.seq; seq++ {
+					report.Problems = append(report.Problems, AuditChainProblem{Index: -1, ChainID: id, Seq: seq, Problem: "missing"})
+				}
+			case !l.modified && !prev.modified && events[l.index].Details[AuditChainPrev] != events[prev.index].Details[AuditChainHash]:
+				report.Problems = append(report.Problems, AuditChainProblem{Index: l.index, ChainID: id, Seq: l.seq, Problem: "broken"})
+			}
+		}
+		first, last := links[0], links[len(links)-1]
+		if first.seq == 1 && events[first.index].Details[AuditChainPrev] != "" {
+			report.Problems = append(report.Problems, AuditChainProblem{Index: first.index, ChainID: id, Seq: 1, Problem: "broken"})
+		}
+		report.Chains = append(report.Chains, AuditChainSummary{
+			Head:     AuditChainHead{ChainID: id, Seq: last.seq, Hash: events[last.index].Details[AuditChainHash]},
+			FirstSeq: first.seq,
+			Events:   len(links),
+		})
+	}
+	return
+}
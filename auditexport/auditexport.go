@@ -0,0 +1,330 @@
+// Package auditexport exports gomagiclink audit events to object storage (such as S3 or
+// GCS) as CloudEvents, for SIEMs and data lakes which ingest them from there.
+//
+// The events are appended to a batch file in a local spool directory as they're logged,
+// and each batch is uploaded as a JSON Lines file (one structured-mode CloudEvent per
+// line) when its period (by default an hour) ends. A batch file is removed only after it
+// was uploaded, so the events survive upload failures and restarts, and are delivered at
+// least once: a batch uploaded again after a crash overwrites the same object, and the
+// events can be deduplicated by their IDs.
+package auditexport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrNoSpoolDir = errors.New("audit export spool directory not set")
+var ErrSinkClosed = errors.New("audit export sink closed")
+
+const (
+	spoolSuffix   = ".part"   // The batch being written
+	batchSuffix   = ".ndjson" // Batches waiting to be uploaded
+	batchTimeFmt  = "20060102T150405Z"
+	keyTimeFormat = "2006/01/02/15"
+)
+
+// CloudEvent is an audit event in the CloudEvents 1.0 JSON format.
+type CloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Subject         string                 `json:"subject,omitempty"` // The user's ID, if the event is about a user
+	Time            time.Time              `json:"time"`
+	DataContentType string                 `json:"datacontenttype"`
+	Data            gomagiclink.AuditEvent `json:"data"`
+}
+
+// NewCloudEvent returns the audit event as a CloudEvent with a new ID, with the source
+// and the type prefix (see Options).
+func NewCloudEvent(ev gomagiclink.AuditEvent, source string, typePrefix string) *CloudEvent {
+	ce := &CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.NewString(),
+		Source:          source,
+		Type:            typePrefix + ev.Type,
+		Time:            ev.Time,
+		DataContentType: "application/json",
+		Data:            ev,
+	}
+	if ev.UserID != uuid.Nil {
+		ce.Subject = ev.UserID.String()
+	}
+	return ce
+}
+
+// Uploader stores a batch file in object storage under the key. Uploading the same key
+// again must overwrite the object. See S3Uploader.
+type Uploader interface {
+	Upload(ctx context.Context, key string, body []byte) error
+}
+
+// Options configures the Sink. Zero values are replaced by defaults.
+type Options struct {
+	SpoolDir      string        // Directory for the batches waiting to be uploaded, required; created if it doesn't exist
+	Interval      time.Duration // Period of each batch, default an hour; batches start at multiples of it
+	RetryInterval time.Duration // Delay before retrying failed uploads, default a minute
+	Source        string        // CloudEvents source, default "/gomagiclink"; e.g. the app's URL
+	TypePrefix    string        // Prepended to the audit event types, default "com.github.ivoras.gomagiclink."
+	KeyPrefix     string        // Prepended to the object keys, e.g. "audit/"
+	Logger        *slog.Logger  // Receives spooling and upload errors; default doesn't log
+}
+
+// Sink is a gomagiclink.AuditLogger which exports the events to object storage through
+// the Uploader. The object keys are KeyPrefix followed by "YYYY/MM/DD/HH/" of the batch's
+// start time in UTC, and the batch file name, e.g.
+// "audit/2024/05/01/13/20240501T130000Z-1f0c9a3e5b7d2468.ndjson". Install it with
+// gomagiclink.WithAuditLogger(), combined with other AuditLoggers using
+// gomagiclink.MultiAuditLogger if needed. Call Shutdown() before the process exits, to
+// upload the last batch.
+//
+// Each event is written to the spool file before LogAuditEvent() returns, but without
+// syncing it to the disk, so events can be lost if the machine (not just the process)
+// crashes. Several processes can't share a spool directory.
+type Sink struct {
+	uploader Uploader
+	opts     Options
+	lock     sync.Mutex // Protects the fields below
+	file     *os.File   // The current batch, nil if there's no event in it yet
+	period   time.Time  // Start of the current batch's period
+	closed   bool
+	upload   sync.Mutex // Serializes the uploads
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSink creates a Sink, and starts uploading the batches in the spool directory,
+// including those left by a previous process.
+func NewSink(uploader Uploader, opts Options) (*Sink, error) {
+	if opts.SpoolDir == "" {
+		return nil, ErrNoSpoolDir
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Minute
+	}
+	if opts.Source == "" {
+		opts.Source = "/gomagiclink"
+	}
+	if opts.TypePrefix == "" {
+		opts.TypePrefix = "com.github.ivoras.gomagiclink."
+	}
+	if err := os.MkdirAll(opts.SpoolDir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Sink{
+		uploader: uploader,
+		opts:     opts,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// recover readies the batches which a previous process was writing when it stopped,
+// dropping the last line if it was cut off.
+func (s *Sink) recover() error {
+	names, err := filepath.Glob(filepath.Join(s.opts.SpoolDir, "*"+batchSuffix+spoolSuffix))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if n := strings.LastIndexByte(string(data), '\n') + 1; n < len(data) {
+			if err = os.Truncate(name, int64(n)); err != nil {
+				return err
+			}
+		}
+		if err = os.Rename(name, strings.TrimSuffix(name, spoolSuffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogAuditEvent appends the event to the current batch.
+func (s *Sink) LogAuditEvent(ev gomagiclink.AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ce := NewCloudEvent(ev, s.opts.Source, s.opts.TypePrefix)
+	line, err := json.Marshal(ce)
+	if err != nil {
+		s.logError("Error encoding audit event", err, "event_id", ce.ID)
+		return
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	now := time.Now()
+	if s.file != nil && !s.period.Equal(s.periodOf(now)) {
+		s.rotate()
+	}
+	if s.file == nil {
+		if err = s.open(now); err != nil {
+			s.logError("Error creating audit export batch", err, "event_id", ce.ID)
+			return
+		}
+	}
+	// A single write, so the recovery only needs to drop a cut-off last line
+	if _, err = s.file.Write(line); err != nil {
+		s.logError("Error spooling audit event", err, "event_id", ce.ID)
+	}
+}
+
+func (s *Sink) periodOf(t time.Time) time.Time {
+	return t.UTC().Truncate(s.opts.Interval)
+}
+
+// open starts a new batch. Called with the lock held.
+func (s *Sink) open(now time.Time) error {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	period := s.periodOf(now)
+	name := period.Format(batchTimeFmt) + "-" + hex.EncodeToString(random) + batchSuffix + spoolSuffix
+	f, err := os.OpenFile(filepath.Join(s.opts.SpoolDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.file, s.period = f, period
+	return nil
+}
+
+// rotate closes the current batch and readies it for the upload. Called with the lock held.
+func (s *Sink) rotate() {
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		s.logError("Error closing audit export batch", err, "file", name)
+	}
+	s.file = nil
+	if err := os.Rename(name, strings.TrimSuffix(name, spoolSuffix)); err != nil {
+		s.logError("Error readying audit export batch", err, "file", name)
+	}
+}
+
+// rotateDue rotates the current batch if its period has ended, or if force is set.
+func (s *Sink) rotateDue(force bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil && (force || !s.period.Equal(s.periodOf(time.Now()))) {
+		s.rotate()
+	}
+}
+
+// run rotates the batches when their periods end, and uploads them, retrying the
+// failed uploads after RetryInterval.
+func (s *Sink) run() {
+	defer close(s.done)
+	for {
+		err := s.uploadReady(context.Background())
+		if err != nil {
+			s.logError("Error uploading audit events", err)
+		}
+		now := time.Now()
+		wait := s.periodOf(now).Add(s.opts.Interval).Sub(now)
+		if err != nil && wait > s.opts.RetryInterval {
+			wait = s.opts.RetryInterval
+		}
+		select {
+		case <-time.After(wait):
+			s.rotateDue(false)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// uploadReady uploads the ready batches, oldest first, removing the uploaded ones. It
+// stops at the first error, leaving the rest for the next attempt.
+func (s *Sink) uploadReady(ctx context.Context) error {
+	s.upload.Lock()
+	defer s.upload.Unlock()
+	names, err := filepath.Glob(filepath.Join(s.opts.SpoolDir, "*"+batchSuffix))
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(name)
+		key := s.opts.KeyPrefix + base
+		if t, err := time.Parse(batchTimeFmt, strings.SplitN(base, "-", 2)[0]); err == nil {
+			key = s.opts.KeyPrefix + t.Format(keyTimeFormat) + "/" + base
+		}
+		if err = s.uploader.Upload(ctx, key, body); err != nil {
+			return err
+		}
+		if err = os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush ends the current batch early, and uploads all the ready batches.
+func (s *Sink) Flush(ctx context.Context) error {
+	s.rotateDue(true)
+	return s.uploadReady(ctx)
+}
+
+// Shutdown stops accepting events, and uploads the current batch and the ones waiting
+// for a retry. Those which couldn't be uploaded before the context is done stay in the
+// spool directory, and are uploaded by the next Sink using it.
+func (s *Sink) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrSinkClosed
+	}
+	s.closed = true
+	if s.file != nil {
+		s.rotate()
+	}
+	s.lock.Unlock()
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.uploadReady(ctx)
+}
+
+func (s *Sink) logError(msg string, err error, attrs ...any) {
+	if s.opts.Logger == nil {
+		return
+	}
+	s.opts.Logger.Error(msg, append(attrs, "error", err)...)
+}
@@ -0,0 +1,135 @@
+package auditexport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidS3Options = errors.New("invalid S3 uploader options")
+
+// S3Uploader is an Uploader which PUTs the batches into a bucket through the S3 API,
+// authenticated with AWS Signature Version 4. Besides AWS S3, it works with Google Cloud
+// Storage (with HMAC keys, Endpoint "https://storage.googleapis.com" and Region "auto")
+// and other S3-compatible stores such as MinIO and Cloudflare R2. The bucket is addressed
+// in the path, not in the host name.
+type S3Uploader struct {
+	Endpoint        string // Default "https://s3.<Region>.amazonaws.com"
+	Region          string // E.g. "eu-central-1"
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string       // For temporary credentials, optional
+	Client          *http.Client // Default a client with a 60s timeout
+}
+
+func (su *S3Uploader) Upload(ctx context.Context, key string, body []byte) error {
+	if su.Region == "" || su.Bucket == "" || su.AccessKeyID == "" || su.SecretAccessKey == "" {
+		return ErrInvalidS3Options
+	}
+	endpoint := su.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + su.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return err
+	}
+	u.Path += "/" + su.Bucket + "/" + key
+	u.RawPath = u.Path[:len(u.Path)-len(key)] + s3Escape(key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if su.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", su.SessionToken)
+	}
+	signV4(req, hex.EncodeToString(payloadHash[:]), su.Region, "s3", su.AccessKeyID, su.SecretAccessKey, time.Now())
+
+	client := su.Client
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("uploading %s: %s: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// s3Escape escapes the key as the S3 API expects it, leaving the slashes.
+func s3Escape(key string) string {
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signV4 sets the X-Amz-Date and Authorization headers of the request without a query
+// string, signing the Host and all the X-Amz-* headers.
+func signV4(req *http.Request, payloadHash string, region string, service string, accessKeyID string, secretAccessKey string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical.String()))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
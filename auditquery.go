@@ -0,0 +1,125 @@
+package gomagiclink
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoAuditStore = errors.New("audit logger doesn't support queries")
+
+// AuditFilter selects audit events in GetAuditEvents(). Zero-valued fields don't filter.
+type AuditFilter struct {
+	Since  time.Time // Events at or after this time
+	Until  time.Time // Events before this time
+	UserID uuid.UUID // Events about this user, or caused by them
+	Types  []string  // Event types, e.g. AuditUserLocked
+	Offset int       // Number of matching events to skip, for pagination
+	Limit  int       // Maximum number of events to return, 0 for no limit
+}
+
+// Matches returns true if the event passes the filter (ignoring Offset and Limit).
+func (af *AuditFilter) Matches(ev *AuditEvent) bool {
+	if !af.Since.IsZero() && ev.Time.Before(af.Since) {
+		return false
+	}
+	if !af.Until.IsZero() && !ev.Time.Before(af.Until) {
+		return false
+	}
+	if af.UserID != uuid.Nil && ev.UserID != af.UserID && ev.ActorID != af.UserID {
+		return false
+	}
+	if len(af.Types) > 0 && !slices.Contains(af.Types, ev.Type) {
+		return false
+	}
+	return true
+}
+
+// AuditStore is an AuditLogger which also stores the events and can query them.
+// The `storage` package has a SQL implementation.
+type AuditStore interface {
+	AuditLogger
+	// GetAuditEvents returns the events matching the filter, oldest first.
+	GetAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+}
+
+// GetAuditEvents queries the audit log, if the configured AuditLogger is an AuditStore,
+// or a MultiAuditLogger containing one.
+func (mlc *AuthMagicLinkController) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	if store, ok := mlc.auditLogger.(AuditStore); ok {
+		return store.GetAuditEvents(filter)
+	}
+	if multi, ok := mlc.auditLogger.(MultiAuditLogger); ok {
+		for _, al := range multi {
+			if store, ok := al.(AuditStore); ok {
+				return store.GetAuditEvents(filter)
+			}
+		}
+	}
+	return nil, ErrNoAuditStore
+}
+
+// ExportAuditEventsCSV writes the events as CSV, with a header row. The details are
+// written as a JSON object in the last column.
+func ExportAuditEventsCSV(w io.Writer, events []AuditEvent) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"time", "type", "user_id", "actor_id", "email", "details"})
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		details := ""
+		if len(ev.Details) > 0 {
+			data, err := json.Marshal(ev.Details)
+			if err != nil {
+				return err
+			}
+			details = string(data)
+		}
+		err = cw.Write([]string{
+			ev.Time.UTC().Format(time.RFC3339Nano),
+			ev.Type,
+			uuidOrEmpty(ev.UserID),
+			uuidOrEmpty(ev.ActorID),
+			csvSafe(ev.Email),
+			details,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportAuditEventsJSONL writes the events as JSON Lines, one event per line.
+func ExportAuditEventsJSONL(w io.Writer, events []AuditEvent) error {
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uuidOrEmpty(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return ""
+	}
+	return id.String()
+}
+
+// csvSafe prevents the value from being interpreted as a formula by spreadsheet apps.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+package gomagiclink
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// WithBatchVerifyWorkers sets the number of goroutines VerifySessionIdBatch() uses for
+// verifying the session IDs and loading the users, which bounds the load a batch puts
+// on the CPU and the storage. The default is runtime.GOMAXPROCS(0).
+func WithBatchVerifyWorkers(workers int) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.batchVerifyWorkers = workers
+	}
+}
+
+// SessionVerification is the result of verifying one session ID of a batch, see
+// VerifySessionIdBatch().
+type SessionVerification struct {
+	User *AuthUserRecord // As returned by VerifySessionId(), nil on errors
+	Err  error
+}
+
+// VerifySessionIdBatch verifies many session IDs at once, e.g. in a gateway, and returns
+// a result for each, in the same order, as VerifySessionId() would. The session IDs are
+// verified in parallel (see WithBatchVerifyWorkers()), repeated session IDs are verified
+// only once, and each user is loaded only once, however many of their sessions are in
+// the batch. As with VerifySessionId(), encrypted sessions with a fresh user snapshot
+// don't load the user. Each result has its own copy of the user record.
+func (mlc *AuthMagicLinkController) VerifySessionIdBatch(sessionIds []string) []SessionVerification {
+	results := make([]SessionVerification, len(sessionIds))
+	if len(sessionIds) == 0 {
+		return results
+	}
+	// Verify each distinct session ID once
+	index := make([]int, len(sessionIds)) // Index of each session ID in unique
+	positions := map[string]int{}
+	var unique []string
+	for i, sessionId := range sessionIds {
+		pos, ok := positions[sessionId]
+		if !ok {
+			pos = len(unique)
+			positions[sessionId] = pos
+			unique = append(unique, sessionId)
+		}
+		index[i] = pos
+	}
+	claims := make([]sessionClaims, len(unique))
+	errs := make([]error, len(unique))
+	snapshots := make([]*AuthUserRecord, len(unique))
+	mlc.parallel(len(unique), func(i int) {
+		claims[i], errs[i] = mlc.parseSessionId(unique[i])
+		if errs[i] == nil && claims[i].ProofKey != nil {
+			errs[i] = ErrProofRequired
+		}
+		if errs[i] == nil {
+			snapshots[i] = mlc.snapshotUser(claims[i])
+		}
+	})
+
+	// Load each user once
+	userIndex := map[uuid.UUID]int{}
+	var userIds []uuid.UUID
+	for i := range unique {
+		if errs[i] != nil || snapshots[i] != nil {
+			continue
+		}
+		if _, ok := userIndex[claims[i].UserID]; !ok {
+			userIndex[claims[i].UserID] = len(userIds)
+			userIds = append(userIds, claims[i].UserID)
+		}
+	}
+	users := make([]*AuthUserRecord, len(userIds))
+	userErrs := make([]error, len(userIds))
+	mlc.parallel(len(userIds), func(i int) {
+		users[i], userErrs[i] = mlc.getUserById(userIds[i])
+	})
+
+	verified := make([]SessionVerification, len(unique))
+	for i := range unique {
+		if errs[i] != nil {
+			verified[i].Err = errs[i]
+			continue
+		}
+		if snapshots[i] != nil {
+			verified[i].User, verified[i].Err = mlc.checkSessionUser(claims[i], snapshots[i])
+			continue
+		}
+		u := userIndex[claims[i].UserID]
+		if userErrs[u] != nil {
+			verified[i].Err = userErrs[u]
+			continue
+		}
+		verified[i].User, verified[i].Err = mlc.checkSessionUser(claims[i], users[u].clone())
+	}
+	used := make([]bool, len(unique))
+	for i := range results {
+		results[i] = verified[index[i]]
+		if used[index[i]] && results[i].User != nil {
+			// A repeated session ID gets its own copy too
+			results[i].User = results[i].User.clone()
+		}
+		used[index[i]] = true
+	}
+	return results
+}
+
+// parallel calls fn for 0..n-1 with at most the batch verification worker count of
+// goroutines, and waits for them.
+func (mlc *AuthMagicLinkController) parallel(n int, fn func(i int)) {
+	workers := mlc.batchVerifyWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
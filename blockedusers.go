@@ -0,0 +1,70 @@
+package gomagiclink
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrChallengeSuppressed = errors.New("challenge suppressed")
+
+// BlockedUserChallenges is the policy for generating challenges for disabled and locked
+// users, see WithBlockedUserChallenges().
+type BlockedUserChallenges int
+
+const (
+	// Challenges are generated, and rejected when they're verified (the default)
+	BlockedUserChallengesAllowed BlockedUserChallenges = iota
+	// Generating a challenge fails with ErrUserDisabled or ErrUserLocked
+	BlockedUserChallengesRefused
+	// Generating a challenge fails with ErrChallengeSuppressed, which the app should
+	// handle as if the magic link was sent, so the response doesn't reveal that the
+	// account exists and is blocked
+	BlockedUserChallengesSuppressed
+)
+
+// WithBlockedUserChallenges sets whether challenges are generated for disabled and
+// locked users. By default they are, so the users receive magic links which fail only
+// when they're opened; with BlockedUserChallengesRefused or BlockedUserChallengesSuppressed,
+// no challenge is generated and nothing should be sent.
+func WithBlockedUserChallenges(policy BlockedUserChallenges) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.blockedUserChallenges = policy
+	}
+}
+
+// checkBlockedUser applies the blocked user policy to the user with the e-mail address,
+// if there is one.
+func (mlc *AuthMagicLinkController) checkBlockedUser(email string) error {
+	if mlc.blockedUserChallenges == BlockedUserChallengesAllowed {
+		return nil
+	}
+	user, err := mlc.loadUserByEmail(email)
+	if err == ErrUserNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var reason error
+	if !user.Enabled {
+		reason = ErrUserDisabled
+	} else if user.IsLocked() {
+		reason = ErrUserLocked
+	} else {
+		return nil
+	}
+	mlc.logger.Info("Challenge refused for a blocked user", "user_id", user.ID, "reason", reason)
+	if mlc.blockedUserChallenges == BlockedUserChallengesSuppressed {
+		return ErrChallengeSuppressed
+	}
+	return reason
+}
+
+// DecoyReceipt returns a receipt for a challenge which wasn't generated, for responding
+// to ErrChallengeSuppressed the same way as to a sent magic link.
+func (mlc *AuthMagicLinkController) DecoyReceipt(email string) (*ChallengeReceipt, error) {
+	salt, err := mlc.newSalt()
+	if err != nil {
+		return nil, err
+	}
+	return newChallengeReceipt(NormalizeEmail(email), encodeToString(salt), time.Now().Add(mlc.challengeExpDuration))
+}
@@ -0,0 +1,161 @@
+package gomagiclink
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrEmailUndeliverable = errors.New("e-mail address is undeliverable")
+var ErrNoBounceStore = errors.New("no bounce store configured")
+
+// Bounce types
+const (
+	BounceHard      = "hard"      // Permanent delivery failure, e.g. the mailbox doesn't exist
+	BounceSoft      = "soft"      // Temporary delivery failure, e.g. a full mailbox
+	BounceComplaint = "complaint" // The recipient marked the message as spam
+)
+
+// Audit event types for bounces
+const (
+	AuditEmailBounced      = "email.bounced"
+	AuditEmailUnsuppressed = "email.unsuppressed"
+)
+
+// BounceRecord is a bounce or complaint notification from the e-mail provider.
+type BounceRecord struct {
+	Email     string    `json:"email"`
+	Type      string    `json:"type"`     // BounceHard, BounceSoft or BounceComplaint
+	Provider  string    `json:"provider"` // E.g. "ses" or "sendgrid"
+	Reason    string    `json:"reason,omitempty"`
+	MessageID string    `json:"message_id,omitempty"` // The provider's ID of the bounced message
+	Time      time.Time `json:"time"`
+}
+
+// Suppresses returns true if the bounce makes the address undeliverable. Soft
+// bounces don't.
+func (br *BounceRecord) Suppresses() bool {
+	return br.Type == BounceHard || br.Type == BounceComplaint
+}
+
+// BounceStore keeps the bounce history and the list of suppressed (undeliverable)
+// e-mail addresses.
+type BounceStore interface {
+	AddBounce(rec *BounceRecord) error                // Suppresses the address if rec.Suppresses()
+	GetBounces(email string) ([]*BounceRecord, error) // Oldest first
+	IsSuppressed(email string) (bool, error)
+	Unsuppress(email string) error // Keeps the history
+}
+
+// WithBounceStore makes GenerateChallenge() refuse suppressed e-mail addresses with
+// ErrEmailUndeliverable, so the app doesn't keep sending to addresses which bounced or
+// complained, damaging its sender reputation. Feed it with RecordBounce(), e.g. from the
+// provider webhook handlers in the `mailer` package.
+func WithBounceStore(bs BounceStore) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.bounceStore = bs
+	}
+}
+
+// RecordBounce records a bounce or complaint in the BounceStore and the audit log.
+func (mlc *AuthMagicLinkController) RecordBounce(rec BounceRecord) error {
+	if mlc.bounceStore == nil {
+		return ErrNoBounceStore
+	}
+	rec.Email = NormalizeEmail(rec.Email)
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if err := mlc.bounceStore.AddBounce(&rec); err != nil {
+		return err
+	}
+	details := map[string]string{"bounce_type": rec.Type, "provider": rec.Provider}
+	if rec.Reason != "" {
+		details["reason"] = rec.Reason
+	}
+	mlc.audit(AuditEvent{Type: AuditEmailBounced, Email: rec.Email, Details: details})
+	return nil
+}
+
+// GetBounceHistory returns the bounces and complaints recorded for the e-mail address, oldest first.
+func (mlc *AuthMagicLinkController) GetBounceHistory(email string) ([]*BounceRecord, error) {
+	if mlc.bounceStore == nil {
+		return nil, ErrNoBounceStore
+	}
+	return mlc.bounceStore.GetBounces(NormalizeEmail(email))
+}
+
+// IsEmailSuppressed returns true if the e-mail address is undeliverable.
+func (mlc *AuthMagicLinkController) IsEmailSuppressed(email string) (bool, error) {
+	if mlc.bounceStore == nil {
+		return false, nil
+	}
+	return mlc.bounceStore.IsSuppressed(NormalizeEmail(email))
+}
+
+// UnsuppressEmail makes the e-mail address deliverable again, e.g. after the user
+// has fixed their mailbox. It's recorded in the audit log.
+func (mlc *AuthMagicLinkController) UnsuppressEmail(email string) error {
+	if mlc.bounceStore == nil {
+		return ErrNoBounceStore
+	}
+	email = NormalizeEmail(email)
+	if err := mlc.bounceStore.Unsuppress(email); err != nil {
+		return err
+	}
+	mlc.audit(AuditEvent{Type: AuditEmailUnsuppressed, Email: email})
+	return nil
+}
+
+// MemoryBounceStore is an in-memory BounceStore, suitable for single-instance apps
+// and development.
+type MemoryBounceStore struct {
+	lock       sync.Mutex
+	bounces    map[string][]*BounceRecord
+	suppressed map[string]bool
+}
+
+func NewMemoryBounceStore() *MemoryBounceStore {
+	return &MemoryBounceStore{
+		bounces:    map[string][]*BounceRecord{},
+		suppressed: map[string]bool{},
+	}
+}
+
+func (mbs *MemoryBounceStore) AddBounce(rec *BounceRecord) error {
+	mbs.lock.Lock()
+	defer mbs.lock.Unlock()
+	recCopy := *rec
+	mbs.bounces[rec.Email] = append(mbs.bounces[rec.Email], &recCopy)
+	slices.SortStableFunc(mbs.bounces[rec.Email], func(a, b *BounceRecord) int {
+		return a.Time.Compare(b.Time)
+	})
+	if rec.Suppresses() {
+		mbs.suppressed[rec.Email] = true
+	}
+	return nil
+}
+
+func (mbs *MemoryBounceStore) GetBounces(email string) (recs []*BounceRecord, err error) {
+	mbs.lock.Lock()
+	defer mbs.lock.Unlock()
+	for _, rec := range mbs.bounces[email] {
+		recCopy := *rec
+		recs = append(recs, &recCopy)
+	}
+	return recs, nil
+}
+
+func (mbs *MemoryBounceStore) IsSuppressed(email string) (bool, error) {
+	mbs.lock.Lock()
+	defer mbs.lock.Unlock()
+	return mbs.suppressed[email], nil
+}
+
+func (mbs *MemoryBounceStore) Unsuppress(email string) error {
+	mbs.lock.Lock()
+	defer mbs.lock.Unlock()
+	delete(mbs.suppressed, email)
+	return nil
+}
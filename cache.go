@@ -0,0 +1,117 @@
+package gomagiclink
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
+)
+
+type userCacheEntry struct {
+	user    *AuthUserRecord
+	expires time.Time
+}
+
+// userCacheInvalidation records when a user's cached record was last invalidated.
+type userCacheInvalidation struct {
+	gen  uint64
+	time time.Time
+}
+
+// userCache is a TTL cache of user records with singleflight lookup deduplication.
+type userCache struct {
+	ttl       time.Duration
+	lock      sync.RWMutex
+	entries   map[uuid.UUID]userCacheEntry
+	gens      map[uuid.UUID]userCacheInvalidation // Recent invalidations, kept for ttl
+	gen       uint64                              // Incremented on each invalidation
+	lastSweep time.Time
+	group     singleflight.Group
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{
+		ttl:       ttl,
+		entries:   map[uuid.UUID]userCacheEntry{},
+		gens:      map[uuid.UUID]userCacheInvalidation{},
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns a copy of the cached user record, calling load on a cache miss.
+// Concurrent misses for the same ID share a single call to load.
+func (uc *userCache) get(id uuid.UUID, load func(id uuid.UUID) (*AuthUserRecord, error)) (*AuthUserRecord, error) {
+	uc.lock.RLock()
+	entry, ok := uc.entries[id]
+	uc.lock.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.user.clone(), nil
+	}
+
+	v, err, _ := uc.group.Do(id.String(), func() (interface{}, error) {
+		start := time.Now()
+		uc.lock.RLock()
+		startGen := uc.gens[id].gen
+		uc.lock.RUnlock()
+		user, err := load(id)
+		if err != nil {
+			return nil, err
+		}
+		uc.lock.Lock()
+		defer uc.lock.Unlock()
+		// A record loaded before the last invalidation may be stale, so it isn't cached
+		if uc.gens[id].gen == startGen {
+			uc.entries[id] = userCacheEntry{user: user, expires: start.Add(uc.ttl)}
+			if now := time.Now(); now.Sub(uc.lastSweep) >= uc.ttl {
+				uc.sweep(now)
+			}
+		}
+		return user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*AuthUserRecord).clone(), nil
+}
+
+func (uc *userCache) invalidate(id uuid.UUID) {
+	uc.lock.Lock()
+	delete(uc.entries, id)
+	uc.gen++
+	uc.gens[id] = userCacheInvalidation{gen: uc.gen, time: time.Now()}
+	uc.lock.Unlock()
+	uc.group.Forget(id.String())
+}
+
+// sweep removes the expired entries, and the invalidations older than the TTL, as a
+// record loaded before them would have expired by now (entries expire ttl after their
+// load started). Called with the lock held.
+func (uc *userCache) sweep(now time.Time) {
+	for id, entry := range uc.entries {
+		if !now.Before(entry.expires) {
+			delete(uc.entries, id)
+		}
+	}
+	for id, inv := range uc.gens {
+		if now.Sub(inv.time) >= uc.ttl {
+			delete(uc.gens, id)
+		}
+	}
+	uc.lastSweep = now
+}
+
+// clone returns a copy of the record which can be modified without affecting the original.
+func (aur *AuthUserRecord) clone() *AuthUserRecord {
+	c := *aur
+	if aur.CustomData != nil {
+		c.CustomData = maps.Clone(aur.CustomData)
+	}
+	c.Memberships = slices.Clone(aur.Memberships)
+	c.TOTPSecret = slices.Clone(aur.TOTPSecret)
+	c.TOTPPendingSecret = slices.Clone(aur.TOTPPendingSecret)
+	c.SessionClaims = slices.Clone(aur.SessionClaims)
+	return &c
+}
@@ -0,0 +1,57 @@
+package gomagiclink
+
+import "time"
+
+// ChallengeInfo describes a challenge, see GetChallengeInfo().
+type ChallengeInfo struct {
+	Email     string    `json:"email"`
+	IssuedAt  time.Time `json:"issued_at"` // From the ChallengeStore, or estimated from the expiration time and the challenge duration
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"expired"`
+	Used      bool      `json:"used"`      // Already used or invalidated; known only with a ChallengeStore
+	ProofKey  bool      `json:"proof_key"` // Bound to a proof key, see WithProofOfPossession()
+}
+
+// ExpiresIn returns how long the challenge is valid for, or 0 if it has expired.
+func (ci *ChallengeInfo) ExpiresIn() time.Duration {
+	return max(time.Until(ci.ExpiresAt), 0)
+}
+
+// Valid returns true if the challenge can still be verified.
+func (ci *ChallengeInfo) Valid() bool {
+	return !ci.Expired && !ci.Used
+}
+
+// GetChallengeInfo verifies the challenge's signature and describes it without consuming
+// it, so the verification page can show e.g. "this link expires in 12 minutes", or check
+// the link before showing the button which verifies it. Expired and used challenges are
+// described (see ChallengeInfo.Valid()); an error is returned for invalid ones
+// (ErrInvalidChallenge, ErrBrokenChallenge). Challenges with hashed e-mail addresses
+// need a ChallengeStore, and return ErrEmailRequired without one, or ErrUsedChallenge
+// if they're no longer in it.
+func (mlc *AuthMagicLinkController) GetChallengeInfo(challenge string) (ci *ChallengeInfo, err error) {
+	pc, err := mlc.parseChallenge(challenge, "", true)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Unix(int64(pc.ExpTime), 0)
+	ci = &ChallengeInfo{
+		Email:     pc.Email,
+		IssuedAt:  expiresAt.Add(-mlc.challengeExpDuration),
+		ExpiresAt: expiresAt,
+		Expired:   mlc.isExpired(pc.ExpTime),
+		ProofKey:  pc.ProofKey != nil,
+	}
+	if mlc.challengeStore != nil {
+		rec, err := mlc.challengeStore.GetChallenge(ChallengeID(challenge))
+		switch err {
+		case nil:
+			ci.IssuedAt = rec.IssuedAt
+		case ErrChallengeNotFound:
+			ci.Used = true
+		default:
+			return nil, err
+		}
+	}
+	return ci, nil
+}
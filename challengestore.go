@@ -0,0 +1,242 @@
+package gomagiclink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrChallengeNotFound = errors.New("challenge not found")
+var ErrUsedChallenge = errors.New("challenge already used or invalidated")
+
+// ChallengeReceipt describes an issued challenge, without containing the challenge
+// itself. It's returned by GenerateChallengeWithReceipt() and recorded in the
+// ChallengeStore and the audit log.
+type ChallengeReceipt struct {
+	ID          uuid.UUID `json:"id"` // Unique ID of the receipt, time-ordered
+	Email       string    `json:"email"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Fingerprint string    `json:"fingerprint"` // ChallengeID() of the challenge
+}
+
+func newChallengeReceipt(email string, challenge string, expTime time.Time) (*ChallengeReceipt, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return nil, err
+	}
+	return &ChallengeReceipt{
+		ID:          id,
+		Email:       email,
+		IssuedAt:    time.Now(),
+		ExpiresAt:   expTime,
+		Fingerprint: ChallengeID(challenge),
+	}, nil
+}
+
+// ChallengeRecord describes an issued challenge, as kept in a ChallengeStore.
+type ChallengeRecord struct {
+	ID        string            `json:"id"` // Fingerprint of the challenge, see ChallengeID()
+	ReceiptID uuid.UUID         `json:"receipt_id"`
+	Email     string            `json:"email"`
+	Challenge string            `json:"challenge"` // The challenge itself; it's a credential, so keep the store safe
+	IssuedAt  time.Time         `json:"issued_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	Metadata  ChallengeMetadata `json:"metadata"`
+}
+
+// ChallengeStore keeps track of the issued challenges, for features which need
+// server-side state, such as limiting the number of outstanding challenges per
+// e-mail address. When a ChallengeStore is configured with WithChallengeStore(),
+// each challenge can be verified only once, and only while it's in the store.
+type ChallengeStore interface {
+	AddChallenge(rec *ChallengeRecord) error
+	GetChallenge(id string) (*ChallengeRecord, error)              // Returns ErrChallengeNotFound if it's not in the store
+	GetChallengesByEmail(email string) ([]*ChallengeRecord, error) // Unexpired challenges, oldest first
+	RemoveChallenge(id string) error
+}
+
+// ChallengeID returns the fingerprint of the challenge (in its CanonicalToken() form), used
+// as its ID in a ChallengeStore.
+func ChallengeID(challenge string) string {
+	h := sha256.Sum256([]byte(CanonicalToken(challenge)))
+	return hex.EncodeToString(h[:16])
+}
+
+// WithChallengeStore sets the ChallengeStore in which the controller records issued
+// challenges. Challenges are removed from the store when they're verified, so each
+// can be used only once.
+func WithChallengeStore(cs ChallengeStore) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.challengeStore = cs
+	}
+}
+
+// WithMaxOutstandingChallenges limits the number of unexpired challenges per e-mail
+// address, so a spammed inbox doesn't contain dozens of valid magic links. When the
+// limit is exceeded, the oldest challenges are invalidated. It requires a ChallengeStore.
+func WithMaxOutstandingChallenges(n int) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.maxOutstandingChallenges = n
+	}
+}
+
+// recordChallenge adds the new challenge to the ChallengeStore, if one is configured,
+// and invalidates the oldest challenges over the limit.
+func (mlc *AuthMagicLinkController) recordChallenge(challenge string, receipt *ChallengeReceipt, meta ChallengeMetadata) error {
+	if mlc.challengeStore == nil {
+		return nil
+	}
+	err := mlc.challengeStore.AddChallenge(&ChallengeRecord{
+		ID:        receipt.Fingerprint,
+		ReceiptID: receipt.ID,
+		Email:     receipt.Email,
+		Challenge: challenge,
+		IssuedAt:  receipt.IssuedAt,
+		ExpiresAt: receipt.ExpiresAt,
+		Metadata:  meta,
+	})
+	if err != nil {
+		return err
+	}
+	if mlc.maxOutstandingChallenges <= 0 {
+		return nil
+	}
+	recs, err := mlc.challengeStore.GetChallengesByEmail(receipt.Email)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(recs)-mlc.maxOutstandingChallenges; i++ {
+		err = mlc.challengeStore.RemoveChallenge(recs[i].ID)
+		if err != nil && err != ErrChallengeNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumeChallenge removes the challenge from the ChallengeStore, if one is configured,
+// returning ErrUsedChallenge if it's not there.
+func (mlc *AuthMagicLinkController) consumeChallenge(challenge string) error {
+	if mlc.challengeStore == nil {
+		return nil
+	}
+	err := mlc.challengeStore.RemoveChallenge(ChallengeID(challenge))
+	if err == ErrChallengeNotFound {
+		return ErrUsedChallenge
+	}
+	return err
+}
+
+// memoryChallengePurgeInterval is how often MemoryChallengeStore removes the expired
+// challenges of all the e-mail addresses.
+const memoryChallengePurgeInterval = time.Minute
+
+// MemoryChallengeStore is an in-memory ChallengeStore, suitable for single-instance apps.
+// Expired challenges are removed periodically, as new ones are added.
+type MemoryChallengeStore struct {
+	lock       sync.Mutex
+	challenges map[string]*ChallengeRecord
+	byEmail    map[string][]string
+	lastPurge  time.Time
+}
+
+func NewMemoryChallengeStore() *MemoryChallengeStore {
+	return &MemoryChallengeStore{
+		challenges: map[string]*ChallengeRecord{},
+		byEmail:    map[string][]string{},
+	}
+}
+
+func (mcs *MemoryChallengeStore) AddChallenge(rec *ChallengeRecord) error {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	if now := time.Now(); now.Sub(mcs.lastPurge) >= memoryChallengePurgeInterval {
+		mcs.purge(now)
+		mcs.lastPurge = now
+	}
+	stored := *rec
+	mcs.challenges[rec.ID] = &stored
+	mcs.byEmail[rec.Email] = append(mcs.byEmail[rec.Email], rec.ID)
+	return nil
+}
+
+// purge removes the expired challenges. Called with the lock held.
+func (mcs *MemoryChallengeStore) purge(now time.Time) {
+	for email, ids := range mcs.byEmail {
+		live := slices.DeleteFunc(ids, func(id string) bool {
+			rec, ok := mcs.challenges[id]
+			if ok && rec.ExpiresAt.Before(now) {
+				delete(mcs.challenges, id)
+				return true
+			}
+			return !ok
+		})
+		if len(live) == 0 {
+			delete(mcs.byEmail, email)
+		} else {
+			mcs.byEmail[email] = live
+		}
+	}
+}
+
+func (mcs *MemoryChallengeStore) GetChallenge(id string) (*ChallengeRecord, error) {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	rec, ok := mcs.challenges[id]
+	if !ok || rec.ExpiresAt.Before(time.Now()) {
+		return nil, ErrChallengeNotFound
+	}
+	found := *rec
+	return &found, nil
+}
+
+func (mcs *MemoryChallengeStore) GetChallengesByEmail(email string) (recs []*ChallengeRecord, err error) {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	now := time.Now()
+	ids := mcs.byEmail[email]
+	live := ids[:0]
+	for _, id := range ids {
+		rec, ok := mcs.challenges[id]
+		if !ok {
+			continue
+		}
+		if rec.ExpiresAt.Before(now) {
+			delete(mcs.challenges, id)
+			continue
+		}
+		live = append(live, id)
+		found := *rec
+		recs = append(recs, &found)
+	}
+	if len(live) == 0 {
+		delete(mcs.byEmail, email)
+	} else {
+		mcs.byEmail[email] = live
+	}
+	slices.SortStableFunc(recs, func(a, b *ChallengeRecord) int {
+		return a.IssuedAt.Compare(b.IssuedAt)
+	})
+	return recs, nil
+}
+
+func (mcs *MemoryChallengeStore) RemoveChallenge(id string) error {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	rec, ok := mcs.challenges[id]
+	if !ok {
+		return ErrChallengeNotFound
+	}
+	delete(mcs.challenges, id)
+	mcs.byEmail[rec.Email] = slices.DeleteFunc(mcs.byEmail[rec.Email], func(i string) bool { return i == id })
+	if len(mcs.byEmail[rec.Email]) == 0 {
+		delete(mcs.byEmail, rec.Email)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Package chat has MagicLinkSenders which deliver magic links as direct messages on chat
+// platforms (Slack and Microsoft Teams), to the account of the user's workspace with the
+// same e-mail address. They're meant for internal tools, whose users are more likely to
+// be looking at the chat than at their mailbox.
+//
+// The links are sent so that the platforms don't generate link previews, which would
+// open the links (and use up single-use challenges) before the user does.
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrRecipientNotFound = errors.New("no chat account with the e-mail address")
+
+// Lookup maps the user's e-mail address to their account ID on the chat platform,
+// returning ErrRecipientNotFound if there isn't one. It replaces the built-in lookup
+// through the platform's API, e.g. for apps which keep the mapping themselves.
+type Lookup func(ctx context.Context, email string) (accountID string, err error)
+
+// MessageText returns the default text of the message for a magic link.
+func MessageText(msg *gomagiclink.MagicLinkMessage) string {
+	var sb strings.Builder
+	if msg.AntiPhishingPhrase != "" {
+		fmt.Fprintf(&sb, "Your anti-phishing phrase: %s\n", msg.AntiPhishingPhrase)
+	}
+	sb.WriteString("Use the link below to log in.")
+	if !msg.ExpiresAt.IsZero() {
+		fmt.Fprintf(&sb, " It expires at %s.", msg.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	sb.WriteString(" If you didn't request it, you can ignore this message.")
+	return sb.String()
+}
+
+// postJSON POSTs the request body as JSON, and decodes the JSON response into result.
+func postJSON(ctx context.Context, client *http.Client, url string, token string, body any, result any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return doJSON(client, req, token, result)
+}
+
+// doJSON sends the request with the bearer token, and decodes the JSON response into result.
+func doJSON(client *http.Client, req *http.Request, token string, result any) error {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+const defaultSlackAPIURL = "https://slack.com/api"
+
+// SlackSender is a MagicLinkSender which sends magic links as direct messages from a
+// Slack app. The app's bot token needs the chat:write and users:read.email scopes.
+type SlackSender struct {
+	Token  string                                         // Bot token, "xoxb-..."
+	Text   func(msg *gomagiclink.MagicLinkMessage) string // Message text; default MessageText()
+	Lookup Lookup                                         // Default users.lookupByEmail
+	Client *http.Client                                   // Default http.DefaultClient
+	APIURL string                                         // Default "https://slack.com/api"
+}
+
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	User  struct {
+		ID string `json:"id"`
+	} `json:"user"`
+}
+
+func (r *slackResponse) err() error {
+	if r.OK {
+		return nil
+	}
+	if r.Error == "users_not_found" {
+		return ErrRecipientNotFound
+	}
+	return fmt.Errorf("slack: %s", r.Error)
+}
+
+func (ss *SlackSender) apiURL(method string) string {
+	base := ss.APIURL
+	if base == "" {
+		base = defaultSlackAPIURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + method
+}
+
+// SendMagicLink looks up the user by their e-mail address, and sends them the message.
+func (ss *SlackSender) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	lookup := ss.Lookup
+	if lookup == nil {
+		lookup = ss.lookupByEmail
+	}
+	userID, err := lookup(ctx, msg.Email)
+	if err != nil {
+		return err
+	}
+	text := MessageText
+	if ss.Text != nil {
+		text = ss.Text
+	}
+	var resp slackResponse
+	err = postJSON(ctx, ss.Client, ss.apiURL("chat.postMessage"), ss.Token, map[string]any{
+		// Posting to the user ID sends a direct message from the app
+		"channel":      userID,
+		"text":         slackEscape(text(msg)) + "\n<" + slackEscape(msg.Link) + "|Log in>",
+		"unfurl_links": false,
+		"unfurl_media": false,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	return resp.err()
+}
+
+func (ss *SlackSender) lookupByEmail(ctx context.Context, email string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ss.apiURL("users.lookupByEmail")+"?email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return "", err
+	}
+	var resp slackResponse
+	if err = doJSON(ss.Client, req, ss.Token, &resp); err != nil {
+		return "", err
+	}
+	if err = resp.err(); err != nil {
+		return "", err
+	}
+	return resp.User.ID, nil
+}
+
+// slackEscape escapes the characters which Slack's message formatting uses for markup.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+const defaultTeamsServiceURL = "https://smba.trafficmanager.net/teams/"
+const defaultGraphURL = "https://graph.microsoft.com/v1.0"
+const defaultMicrosoftLoginURL = "https://login.microsoftonline.com"
+
+// TeamsSender is a MagicLinkSender which sends magic links as direct messages from a
+// Microsoft Teams bot. The bot's app registration needs the User.Read.All application
+// permission in Microsoft Graph (to find the users by their e-mail addresses), and the
+// bot needs to be installed for the users, as bots can't message users who haven't
+// installed them. The link is sent as a card button, so Teams doesn't generate a
+// preview for it.
+type TeamsSender struct {
+	TenantID    string                                         // Azure AD (Entra ID) tenant of the bot and the users
+	AppID       string                                         // Bot's app (client) ID
+	AppPassword string                                         // Bot's client secret
+	Text        func(msg *gomagiclink.MagicLinkMessage) string // Message text; default MessageText()
+	Lookup      Lookup                                         // Default Microsoft Graph user lookup, returning the user's object ID
+	Client      *http.Client                                   // Default http.DefaultClient
+	ServiceURL  string                                         // Bot Framework service URL, default "https://smba.trafficmanager.net/teams/"
+	GraphURL    string                                         // Default "https://graph.microsoft.com/v1.0"
+	LoginURL    string                                         // Default "https://login.microsoftonline.com"
+
+	lock   sync.Mutex
+	tokens map[string]*teamsToken // By scope
+}
+
+type teamsToken struct {
+	token   string
+	expires time.Time
+}
+
+// SendMagicLink looks up the user by their e-mail address, and sends them the message.
+func (ts *TeamsSender) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	lookup := ts.Lookup
+	if lookup == nil {
+		lookup = ts.lookupByEmail
+	}
+	userID, err := lookup(ctx, msg.Email)
+	if err != nil {
+		return err
+	}
+	token, err := ts.token(ctx, "https://api.botframework.com/.default")
+	if err != nil {
+		return err
+	}
+	serviceURL := ts.ServiceURL
+	if serviceURL == "" {
+		serviceURL = defaultTeamsServiceURL
+	}
+	serviceURL = strings.TrimSuffix(serviceURL, "/")
+
+	var conversation struct {
+		ID string `json:"id"`
+	}
+	err = postJSON(ctx, ts.Client, serviceURL+"/v3/conversations", token, map[string]any{
+		"bot":         map[string]string{"id": "28:" + ts.AppID},
+		"members":     []map[string]string{{"id": userID}},
+		"tenantId":    ts.TenantID,
+		"channelData": map[string]any{"tenant": map[string]string{"id": ts.TenantID}},
+		"isGroup":     false,
+	}, &conversation)
+	if err != nil {
+		return err
+	}
+	text := MessageText
+	if ts.Text != nil {
+		text = ts.Text
+	}
+	return postJSON(ctx, ts.Client, serviceURL+"/v3/conversations/"+url.PathEscape(conversation.ID)+"/activities", token, map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.hero",
+			"content": map[string]any{
+				"text":    text(msg),
+				"buttons": []map[string]string{{"type": "openUrl", "title": "Log in", "value": msg.Link}},
+			},
+		}},
+	}, nil)
+}
+
+// lookupByEmail finds the user's object ID in Microsoft Graph, by their e-mail address or UPN.
+func (ts *TeamsSender) lookupByEmail(ctx context.Context, email string) (string, error) {
+	token, err := ts.token(ctx, "https://graph.microsoft.com/.default")
+	if err != nil {
+		return "", err
+	}
+	graphURL := ts.GraphURL
+	if graphURL == "" {
+		graphURL = defaultGraphURL
+	}
+	quoted := "'" + strings.ReplaceAll(email, "'", "''") + "'"
+	query := url.Values{
+		"$filter": {"mail eq " + quoted + " or userPrincipalName eq " + quoted},
+		"$select": {"id"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(graphURL, "/")+"/users?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Value []struct {
+			ID string `json:"id"`
+		} `json:"value"`
+	}
+	if err = doJSON(ts.Client, req, token, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Value) == 0 {
+		return "", ErrRecipientNotFound
+	}
+	return resp.Value[0].ID, nil
+}
+
+// token returns an app-only access token for the scope, fetching a new one when the
+// cached one is about to expire.
+func (ts *TeamsSender) token(ctx context.Context, scope string) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if t := ts.tokens[scope]; t != nil && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+	loginURL := ts.LoginURL
+	if loginURL == "" {
+		loginURL = defaultMicrosoftLoginURL
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {ts.AppID},
+		"client_secret": {ts.AppPassword},
+		"scope":         {scope},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(loginURL, "/")+"/"+url.PathEscape(ts.TenantID)+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = doJSON(ts.Client, req, "", &resp); err != nil {
+		return "", err
+	}
+	if ts.tokens == nil {
+		ts.tokens = map[string]*teamsToken{}
+	}
+	// Refresh the token a minute before it expires
+	ts.tokens[scope] = &teamsToken{token: resp.AccessToken, expires: time.Now().Add(time.Duration(resp.ExpiresIn-60) * time.Second)}
+	return resp.AccessToken, nil
+}
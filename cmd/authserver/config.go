@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink/internal/toml"
+	"github.com/ivoras/gomagiclink/internal/yaml"
+)
+
+// duration is a time.Duration which is written as a string like "1h30m" in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// secret is a string which is redacted when the config is printed.
+type secret string
+
+func (s secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal("<redacted>")
+}
+
+// Config is the auth server configuration. It's read from a JSON, YAML or TOML file (by
+// the extension), and the values can be overridden with MAGICLINK_* environment
+// variables (see applyEnv()), and then with the command line flags.
+type Config struct {
+	Listen          string   `json:"listen"`
+	PublicURL       string   `json:"public_url"` // Base URL of the server, used in the magic links; required for logins
+	ChallengeExpiry duration `json:"challenge_expiry"`
+	SessionExpiry   duration `json:"session_expiry"`
+	UserCacheTTL    duration `json:"user_cache_ttl"`
+	DrainTimeout    duration `json:"drain_timeout"`
+
+	Storage struct {
+		// DSN sets the other fields at once, see applyStorageDSN()
+		DSN   string `json:"dsn"`
+		Type  string `json:"type"` // "sqlite" or "filesystem"
+		Path  string `json:"path"` // SQLite database file or directory
+		Table string `json:"table"`
+	} `json:"storage"`
+
+	// The secret key is read from SecretKeyFile if it's set, otherwise from the
+	// MAGICLINK_SECRET_KEY environment variable. It's never read from the config file.
+	SecretKeyFile string `json:"secret_key_file"`
+	secretKey     []byte
+
+	TLS struct {
+		Cert        string   `json:"cert"`
+		Key         string   `json:"key"`
+		ClientCA    string   `json:"client_ca"`
+		ClientNames []string `json:"client_names"`
+	} `json:"tls"`
+
+	IntrospectionTokens []secret `json:"-"` // From MAGICLINK_INTROSPECTION_TOKENS
+
+	SMTP struct {
+		Host     string `json:"host"`
+		Port     int    `json:"port"`
+		Username string `json:"username"`
+		Password secret `json:"-"` // From MAGICLINK_SMTP_PASSWORD
+		From     string `json:"from"`
+		// DKIM signing of the messages; the private key file is PEM-encoded
+		DKIM struct {
+			Domain   string `json:"domain"`
+			Selector string `json:"selector"`
+			KeyFile  string `json:"key_file"`
+		} `json:"dkim"`
+	} `json:"smtp"`
+
+	CORS struct {
+		AllowedOrigins []string `json:"allowed_origins"`
+	} `json:"cors"`
+
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies, whose
+	// X-Forwarded-For headers are used to find the client addresses for rate limiting.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	Log struct {
+		Level  string `json:"level"`
+		Levels string `json:"levels"` // Per-subsystem, e.g. "storage=debug,adapters=warn"
+	} `json:"log"`
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{
+		Listen:          "localhost:8004",
+		ChallengeExpiry: duration(time.Hour),
+		SessionExpiry:   duration(24 * time.Hour),
+		UserCacheTTL:    duration(time.Minute),
+		DrainTimeout:    duration(30 * time.Second),
+	}
+	cfg.Storage.Type = "sqlite"
+	cfg.Storage.Path = "./magiclink.db"
+	cfg.Storage.Table = "magiclink"
+	cfg.SMTP.Port = 587
+	cfg.Log.Level = "info"
+	return cfg
+}
+
+// loadConfig reads the config file, if path isn't empty, over the defaults, and applies
+// the environment variables.
+func loadConfig(path string) (cfg *Config, err error) {
+	cfg = defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			data, err = yaml.ToJSON(data)
+		case ".toml":
+			data, err = toml.ToJSON(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err = cfg.applyStorageDSN(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err = cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyStorageDSN sets the storage settings from the storage DSN, if it's set:
+//
+//	sqlite:PATH[?table=TABLE]	SQLite database file, e.g. "sqlite:///data/magiclink.db"
+//	filesystem:DIR			directory for the filesystem storage, e.g. "filesystem:/data/users"
+//
+// Other storages (such as PostgreSQL) need a database driver, and aren't built into the
+// server.
+func (cfg *Config) applyStorageDSN() error {
+	if cfg.Storage.DSN == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Storage.DSN)
+	if err != nil {
+		return fmt.Errorf("storage.dsn: %w", err)
+	}
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	switch u.Scheme {
+	case "sqlite":
+		cfg.Storage.Type = "sqlite"
+		if table := u.Query().Get("table"); table != "" {
+			cfg.Storage.Table = table
+		}
+	case "filesystem":
+		cfg.Storage.Type = "filesystem"
+	default:
+		return fmt.Errorf("storage.dsn: unsupported scheme %q, expecting \"sqlite\" or \"filesystem\"", u.Scheme)
+	}
+	if path == "" {
+		return errors.New("storage.dsn: no path")
+	}
+	cfg.Storage.Path = path
+	return nil
+}
+
+// applyEnv overrides the settings with the MAGICLINK_* environment variables which are set.
+// MAGICLINK_STORAGE_DSN is applied first, so the other storage variables override it.
+func (cfg *Config) applyEnv() error {
+	if v, ok := os.LookupEnv("MAGICLINK_STORAGE_DSN"); ok {
+		cfg.Storage.DSN = v
+		if err := cfg.applyStorageDSN(); err != nil {
+			return fmt.Errorf("MAGICLINK_STORAGE_DSN: %w", err)
+		}
+	}
+	strs := map[string]*string{
+		"MAGICLINK_LISTEN":             &cfg.Listen,
+		"MAGICLINK_PUBLIC_URL":         &cfg.PublicURL,
+		"MAGICLINK_STORAGE_TYPE":       &cfg.Storage.Type,
+		"MAGICLINK_STORAGE_PATH":       &cfg.Storage.Path,
+		"MAGICLINK_STORAGE_TABLE":      &cfg.Storage.Table,
+		"MAGICLINK_SECRET_KEY_FILE":    &cfg.SecretKeyFile,
+		"MAGICLINK_TLS_CERT":           &cfg.TLS.Cert,
+		"MAGICLINK_TLS_KEY":            &cfg.TLS.Key,
+		"MAGICLINK_TLS_CLIENT_CA":      &cfg.TLS.ClientCA,
+		"MAGICLINK_SMTP_HOST":          &cfg.SMTP.Host,
+		"MAGICLINK_SMTP_USERNAME":      &cfg.SMTP.Username,
+		"MAGICLINK_SMTP_FROM":          &cfg.SMTP.From,
+		"MAGICLINK_SMTP_DKIM_DOMAIN":   &cfg.SMTP.DKIM.Domain,
+		"MAGICLINK_SMTP_DKIM_SELECTOR": &cfg.SMTP.DKIM.Selector,
+		"MAGICLINK_SMTP_DKIM_KEY_FILE": &cfg.SMTP.DKIM.KeyFile,
+		"MAGICLINK_LOG_LEVEL":          &cfg.Log.Level,
+		"MAGICLINK_LOG_LEVELS":         &cfg.Log.Levels,
+	}
+	for name, p := range strs {
+		if v, ok := os.LookupEnv(name); ok {
+			*p = v
+		}
+	}
+	durations := map[string]*duration{
+		"MAGICLINK_CHALLENGE_EXPIRY": &cfg.ChallengeExpiry,
+		"MAGICLINK_SESSION_EXPIRY":   &cfg.SessionExpiry,
+		"MAGICLINK_USER_CACHE_TTL":   &cfg.UserCacheTTL,
+		"MAGICLINK_DRAIN_TIMEOUT":    &cfg.DrainTimeout,
+	}
+	for name, p := range durations {
+		if v, ok := os.LookupEnv(name); ok {
+			if err := p.Set(v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	lists := map[string]*[]string{
+		"MAGICLINK_TLS_CLIENT_NAMES":     &cfg.TLS.ClientNames,
+		"MAGICLINK_CORS_ALLOWED_ORIGINS": &cfg.CORS.AllowedOrigins,
+		"MAGICLINK_TRUSTED_PROXIES":      &cfg.TrustedProxies,
+	}
+	for name, p := range lists {
+		if v, ok := os.LookupEnv(name); ok {
+			*p = splitList(v)
+		}
+	}
+	if v, ok := os.LookupEnv("MAGICLINK_SMTP_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MAGICLINK_SMTP_PORT: %w", err)
+		}
+		cfg.SMTP.Port = port
+	}
+	// Secrets are only read from the environment (or files), to keep them out of the
+	// config file and the process list.
+	cfg.SMTP.Password = secret(os.Getenv("MAGICLINK_SMTP_PASSWORD"))
+	for _, token := range splitList(os.Getenv("MAGICLINK_INTROSPECTION_TOKENS")) {
+		cfg.IntrospectionTokens = append(cfg.IntrospectionTokens, secret(token))
+	}
+	return nil
+}
+
+// loadSecretKey reads the secret key from the file or the environment.
+func (cfg *Config) loadSecretKey() error {
+	if cfg.SecretKeyFile != "" {
+		data, err := os.ReadFile(cfg.SecretKeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.secretKey = bytes.TrimSpace(data)
+	} else {
+		cfg.secretKey = []byte(os.Getenv("MAGICLINK_SECRET_KEY"))
+	}
+	if len(cfg.secretKey) == 0 {
+		return errors.New("no secret key: set secret_key_file or MAGICLINK_SECRET_KEY")
+	}
+	return nil
+}
+
+// validate checks the config for errors, so they're reported at startup.
+func (cfg *Config) validate() error {
+	var errs []error
+	if cfg.Listen == "" {
+		errs = append(errs, errors.New("listen is empty"))
+	}
+	if cfg.ChallengeExpiry <= 0 || cfg.SessionExpiry <= 0 {
+		errs = append(errs, errors.New("challenge_expiry and session_expiry must be positive"))
+	}
+	if cfg.UserCacheTTL < 0 || cfg.DrainTimeout < 0 {
+		errs = append(errs, errors.New("user_cache_ttl and drain_timeout can't be negative"))
+	}
+	switch cfg.Storage.Type {
+	case "sqlite", "filesystem":
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage type %q, expecting \"sqlite\" or \"filesystem\"", cfg.Storage.Type))
+	}
+	if cfg.Storage.Path == "" {
+		errs = append(errs, errors.New("storage.path is empty"))
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		errs = append(errs, errors.New("tls.cert and tls.key must be set together"))
+	}
+	if cfg.SMTP.Host != "" {
+		if cfg.SMTP.From == "" {
+			errs = append(errs, errors.New("smtp.from is required with smtp.host"))
+		}
+		if !strings.HasPrefix(cfg.PublicURL, "https://") && !strings.HasPrefix(cfg.PublicURL, "http://") {
+			errs = append(errs, errors.New("public_url (http:// or https://) is required with smtp.host"))
+		}
+	}
+	if dkim := cfg.SMTP.DKIM; (dkim.Domain == "") != (dkim.KeyFile == "") || (dkim.Domain == "") != (dkim.Selector == "") {
+		errs = append(errs, errors.New("smtp.dkim.domain, smtp.dkim.selector and smtp.dkim.key_file must be set together"))
+	}
+	for _, origin := range cfg.CORS.AllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "https://") && !strings.HasPrefix(origin, "http://") {
+			errs = append(errs, fmt.Errorf("invalid CORS origin %q", origin))
+		}
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err = netip.ParseAddr(proxy); err != nil {
+				errs = append(errs, fmt.Errorf("invalid trusted proxy %q", proxy))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String returns the effective config as JSON, with the secrets redacted.
+func (cfg *Config) String() string {
+	printable := struct {
+		*Config
+		IntrospectionTokens []secret `json:"introspection_tokens"`
+		SMTPPassword        secret   `json:"smtp_password"`
+	}{cfg, cfg.IntrospectionTokens, cfg.SMTP.Password}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(printable); err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func splitList(s string) (result []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,279 @@
+package main
+
+// This is a standalone server for the gomagiclink module, which lets other services
+// (e.g. API gateways) verify session IDs issued by a magic link app sharing the
+// same secret key and user database. With an SMTP server configured, it also
+// handles the logins itself. See README.md for the configuration.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/adapters"
+	"github.com/ivoras/gomagiclink/loginui"
+	"github.com/ivoras/gomagiclink/mailer"
+	"github.com/ivoras/gomagiclink/storage"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	configFile := flag.String("config", os.Getenv("MAGICLINK_CONFIG"), "Config file, JSON, YAML (.yaml, .yml) or TOML (.toml)")
+	printConfig := flag.Bool("print-config", false, "Print the effective config and exit")
+	flag.String("listen", "", "Address to listen on")
+	flag.String("db", "", "SQLite database file, or directory for the filesystem storage")
+	flag.String("table", "", "Table name in the SQLite database")
+	flag.String("tls-cert", "", "TLS certificate file")
+	flag.String("tls-key", "", "TLS key file")
+	flag.String("client-ca", "", "CA certificate file for verifying introspection clients (mTLS)")
+	flag.String("client-names", "", "Comma-separated list of allowed client certificate common names")
+	flag.String("log-level", "", "Default log level (debug, info, warn, error)")
+	flag.String("log-levels", "", "Per-subsystem log levels, e.g. storage=debug,adapters=warn")
+	flag.String("drain-timeout", "", "How long to wait for in-flight requests on shutdown, e.g. 30s")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Flags given on the command line override the config file and the environment.
+	flag.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "listen":
+			cfg.Listen = v
+		case "db":
+			cfg.Storage.DSN, cfg.Storage.Path = "", v
+		case "table":
+			cfg.Storage.Table = v
+		case "tls-cert":
+			cfg.TLS.Cert = v
+		case "tls-key":
+			cfg.TLS.Key = v
+		case "client-ca":
+			cfg.TLS.ClientCA = v
+		case "client-names":
+			cfg.TLS.ClientNames = splitList(v)
+		case "log-level":
+			cfg.Log.Level = v
+		case "log-levels":
+			cfg.Log.Levels = v
+		case "drain-timeout":
+			if err := cfg.DrainTimeout.Set(v); err != nil {
+				log.Fatal("Invalid -drain-timeout: ", err)
+			}
+		}
+	})
+	if err = cfg.validate(); err != nil {
+		log.Fatal("Invalid config:\n", err)
+	}
+	if *printConfig {
+		fmt.Println(cfg)
+		return
+	}
+	if err = cfg.loadSecretKey(); err != nil {
+		log.Fatal(err)
+	}
+
+	loggers, err := newLoggers(cfg.Log.Level, cfg.Log.Levels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Effective config:", cfg)
+
+	var mlStorage interface {
+		gomagiclink.UserAuthDatabase
+		SetLogger(*slog.Logger)
+	}
+	var sqliteStorage *storage.SQLiteStorage
+	switch cfg.Storage.Type {
+	case "sqlite":
+		sqliteStorage, err = storage.NewSQLiteStorageWithOptions(storage.SQLiteOptions{
+			Path:         cfg.Storage.Path,
+			TableName:    cfg.Storage.Table,
+			CreateSchema: true,
+		})
+		mlStorage = sqliteStorage
+	case "filesystem":
+		mlStorage, err = storage.NewFileSystemStorage(cfg.Storage.Path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	mlStorage.SetLogger(loggers.Logger(gomagiclink.SubsystemStorage))
+	opts := []gomagiclink.ControllerOption{
+		gomagiclink.WithLogger(loggers.Logger(gomagiclink.SubsystemController)),
+	}
+	if cfg.UserCacheTTL > 0 {
+		opts = append(opts, gomagiclink.WithUserCache(time.Duration(cfg.UserCacheTTL)))
+	}
+	mlink, err := gomagiclink.NewAuthMagicLinkController(
+		cfg.secretKey,
+		time.Duration(cfg.ChallengeExpiry),
+		time.Duration(cfg.SessionExpiry),
+		mlStorage,
+		opts...,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check the configuration and warm up the storage before accepting requests.
+	selfTestCtx, cancelSelfTest := context.WithTimeout(context.Background(), 30*time.Second)
+	report, err := mlink.SelfTest(selfTestCtx)
+	cancelSelfTest()
+	if err != nil {
+		log.Fatal("Self-test failed: ", err)
+	}
+	for _, step := range report.Steps {
+		log.Printf("Self-test step %s took %s", step.Name, step.Duration)
+	}
+
+	introspectionOpts := adapters.IntrospectionOptions{
+		ClientCertNames: cfg.TLS.ClientNames,
+		Logger:          loggers.Logger(gomagiclink.SubsystemAdapters),
+	}
+	for _, token := range cfg.IntrospectionTokens {
+		introspectionOpts.BearerTokens = append(introspectionOpts.BearerTokens, string(token))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/introspect", adapters.IntrospectionHandler(mlink, introspectionOpts))
+	if cfg.SMTP.Host != "" {
+		// With an SMTP server, the auth server also handles the logins.
+		sender := &mailer.SMTPSender{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: string(cfg.SMTP.Password),
+			From:     cfg.SMTP.From,
+		}
+		if cfg.SMTP.DKIM.KeyFile != "" {
+			key, err := mailer.LoadDKIMKey(cfg.SMTP.DKIM.KeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sender.DKIM = &mailer.DKIMSigner{Domain: cfg.SMTP.DKIM.Domain, Selector: cfg.SMTP.DKIM.Selector, Key: key}
+		}
+		baseURL := strings.TrimSuffix(cfg.PublicURL, "/")
+		handlers := adapters.NewAuthHandlers(mlink, sender, baseURL+"/verify")
+		handlers.CookieSecure = strings.HasPrefix(baseURL, "https://")
+		handlers.CookieMaxAge = time.Duration(cfg.SessionExpiry)
+		handlers.Logger = loggers.Logger(gomagiclink.SubsystemAdapters)
+		corsOpts := adapters.CORSOptions{AllowedOrigins: cfg.CORS.AllowedOrigins}
+		securityOpts := adapters.SecurityHeadersOptions{}
+		if handlers.CookieSecure {
+			securityOpts.HSTSMaxAge = 365 * 24 * time.Hour
+		}
+		pages, err := loginui.NewHandler(loginui.Options{BasePath: "/auth", LoginURL: "/login", Logger: handlers.Logger})
+		if err != nil {
+			log.Fatal(err)
+		}
+		pages.ConfigureAuthHandlers(handlers)
+		loginLimitOpts, verifyLimitOpts := adapters.DefaultLoginRateLimit, adapters.DefaultVerifyRateLimit
+		for _, opts := range []*adapters.RateLimitOptions{&loginLimitOpts, &verifyLimitOpts} {
+			opts.TrustedProxies = cfg.TrustedProxies
+			opts.ErrorURL = handlers.ErrorURL
+			opts.Logger = handlers.Logger
+		}
+		loginLimit, err := adapters.NewRateLimiter(loginLimitOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifyLimit, err := adapters.NewRateLimiter(verifyLimitOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux.Handle("/login", adapters.SecurityHeaders(securityOpts, adapters.CORS(corsOpts, loginLimit.Middleware(handlers.Login()))))
+		mux.Handle("/resend", adapters.SecurityHeaders(securityOpts, adapters.CORS(corsOpts, loginLimit.Middleware(handlers.Resend()))))
+		mux.Handle("/verify", adapters.SecurityHeaders(securityOpts, verifyLimit.Middleware(handlers.Verify())))
+		mux.Handle("/logout", adapters.SecurityHeaders(securityOpts, adapters.CORS(corsOpts, handlers.Logout())))
+		mux.Handle("/auth/", adapters.SecurityHeaders(securityOpts, pages))
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: mux,
+	}
+	if cfg.TLS.ClientCA != "" {
+		caPEM, err := os.ReadFile(cfg.TLS.ClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			log.Fatal("Cannot parse client CA certificates")
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
+	// On SIGINT or SIGTERM, stop accepting connections and let the in-flight
+	// requests complete, for at most DrainTimeout.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 1)
+	go func() {
+		log.Println("Listening on", cfg.Listen)
+		if cfg.TLS.Cert != "" {
+			errCh <- srv.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-errCh:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down:", err)
+	}
+	if sqliteStorage != nil {
+		if err = sqliteStorage.Close(); err != nil {
+			log.Println("Error closing the database:", err)
+		}
+	}
+}
+
+// newLoggers parses the log level flags.
+func newLoggers(defaultLevel string, subsystemLevels string) (*gomagiclink.Loggers, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(defaultLevel))
+	if err != nil {
+		return nil, err
+	}
+	loggers := gomagiclink.NewLoggers(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}), level)
+	if subsystemLevels == "" {
+		return loggers, nil
+	}
+	for _, sl := range strings.Split(subsystemLevels, ",") {
+		subsystem, levelName, ok := strings.Cut(sl, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid subsystem log level: %s", sl)
+		}
+		err = level.UnmarshalText([]byte(levelName))
+		if err != nil {
+			return nil, err
+		}
+		loggers.SetLevel(subsystem, level)
+	}
+	return loggers, nil
+}
@@ -24,13 +24,19 @@ func readLine(prompt string) (s string) {
 func main() {
 	consoleReader = bufio.NewReader(os.Stdin)
 
+	// Challenges are verified in the same run, so a random secret key will do.
+	secretKey, _, err := gomagiclink.GenerateSecretKey()
+	if err != nil {
+		panic(err)
+	}
+
 	fsStorage, err := storage.NewFileSystemStorage(".")
 	if err != nil {
 		panic(err)
 	}
 
 	magicLinkController, err := gomagiclink.NewAuthMagicLinkController(
-		[]byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit."), // Our secret key
+		secretKey,    // Our secret key
 		time.Hour,    // User change (i.e. magic link) expiration
 		time.Hour*24, // Session ID (i.e. cookied) expiration
 		fsStorage,    // Storage engine for user data
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+func verifyAuditChain(args []string) error {
+	fs := flag.NewFlagSet("verify-audit-chain", flag.ExitOnError)
+	file := fs.String("file", "", "JSON Lines file with the audit events, e.g. from ExportAuditEventsJSONL(), or - for stdin")
+	audit := fs.String("audit", "", "DSN of the SQL audit store, instead of --file")
+	keyEnv := fs.String("key-env", "MAGICLINK_AUDIT_CHAIN_KEY", "Environment variable with the chain's HMAC key")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: magiclinkctl verify-audit-chain (--file=FILE | --audit=DSN) [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*file == "") == (*audit == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	key := os.Getenv(*keyEnv)
+	if key == "" {
+		return fmt.Errorf("the HMAC key must be in the %s environment variable", *keyEnv)
+	}
+
+	var events []gomagiclink.AuditEvent
+	var err error
+	if *file != "" {
+		events, err = readAuditEventsFile(*file)
+	} else {
+		events, err = readAuditEventsStore(*audit)
+	}
+	if err != nil {
+		return err
+	}
+
+	report := gomagiclink.VerifyAuditChain(events, []byte(key))
+	fmt.Printf("%d events, %d chains\n", len(events), len(report.Chains))
+	for _, c := range report.Chains {
+		fmt.Printf("chain %s: %d events, seq %d-%d, head %s\n", c.Head.ChainID, c.Events, c.FirstSeq, c.Head.Seq, c.Head.Hash)
+	}
+	for _, p := range report.Problems {
+		switch {
+		case p.Index < 0:
+			fmt.Printf("%s: chain %s seq %d\n", p.Problem, p.ChainID, p.Seq)
+		case p.ChainID == "":
+			ev := events[p.Index]
+			fmt.Printf("%s: event %d (%s %s)\n", p.Problem, p.Index+1, ev.Time.UTC().Format("2006-01-02T15:04:05.999999Z"), ev.Type)
+		default:
+			fmt.Printf("%s: event %d, chain %s seq %d\n", p.Problem, p.Index+1, p.ChainID, p.Seq)
+		}
+	}
+	if !report.OK() {
+		return fmt.Errorf("the audit log has been tampered with (%d problems)", len(report.Problems))
+	}
+	return nil
+}
+
+func readAuditEventsFile(name string) (events []gomagiclink.AuditEvent, err error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var ev gomagiclink.AuditEvent
+		if err = json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// readAuditEventsStore reads all the events from a storage.SQLAuditStore, with the
+// sqlite:FILE?table=TABLE or postgres://...?table=TABLE DSN.
+func readAuditEventsStore(dsn string) (events []gomagiclink.AuditEvent, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit store DSN: %w", err)
+	}
+	table := u.Query().Get("table")
+	var db *sql.DB
+	var store *storage.SQLAuditStore
+	switch u.Scheme {
+	case "sqlite":
+		path, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(dsn, "sqlite:"), "//"), "?")
+		if db, err = sql.Open("sqlite3", path); err != nil {
+			return nil, err
+		}
+		store, err = storage.NewSQLiteAuditStore(db, table)
+	case "postgres", "postgresql":
+		q := u.Query()
+		q.Del("table")
+		u.RawQuery = q.Encode()
+		if db, err = sql.Open("postgres", u.String()); err != nil {
+			return nil, fmt.Errorf("opening PostgreSQL (is a driver compiled in?): %w", err)
+		}
+		store, err = storage.NewPgSQLAuditStore(db, table)
+	default:
+		return nil, fmt.Errorf("unsupported audit store scheme %q", u.Scheme)
+	}
+	defer db.Close()
+	if err != nil {
+		return nil, err
+	}
+	return store.GetAuditEvents(gomagiclink.AuditFilter{})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+// openedStorage is a user storage opened from a DSN, with the function releasing it.
+type openedStorage struct {
+	db    gomagiclink.UserAuthDatabase
+	close func() error
+}
+
+// openStorage opens the user storage described by the DSN, see README.md for the
+// formats. The target storage's SQL table is created if it doesn't exist.
+func openStorage(dsn string, target bool) (st openedStorage, err error) {
+	scheme, rest, ok := strings.Cut(dsn, ":")
+	if !ok {
+		return st, fmt.Errorf("invalid storage DSN %q, expected scheme:...", dsn)
+	}
+	st.close = func() error { return nil }
+	switch scheme {
+	case "filesystem", "fs":
+		dir := strings.TrimPrefix(rest, "//")
+		if dir == "" {
+			return st, fmt.Errorf("missing directory in %q", dsn)
+		}
+		st.db, err = storage.NewFileSystemStorage(dir)
+	case "sqlite":
+		path, query, _ := strings.Cut(strings.TrimPrefix(rest, "//"), "?")
+		params, qerr := url.ParseQuery(query)
+		if qerr != nil {
+			return st, fmt.Errorf("invalid parameters in %q: %w", dsn, qerr)
+		}
+		var sqlite *storage.SQLiteStorage
+		sqlite, err = storage.NewSQLiteStorageWithOptions(storage.SQLiteOptions{
+			Path:         path,
+			TableName:    params.Get("table"),
+			CreateSchema: target,
+		})
+		if err == nil {
+			st.db, st.close = sqlite, sqlite.Close
+		}
+	case "postgres", "postgresql":
+		u, perr := url.Parse(dsn)
+		if perr != nil {
+			return st, fmt.Errorf("invalid storage DSN: %w", perr)
+		}
+		table := u.Query().Get("table")
+		q := u.Query()
+		q.Del("table")
+		u.RawQuery = q.Encode()
+		db, perr := sql.Open("postgres", u.String())
+		if perr != nil {
+			return st, fmt.Errorf("opening PostgreSQL (is a driver compiled in?): %w", perr)
+		}
+		var pg *storage.PgSQLStorage
+		pg, err = storage.NewPgSQLStorage(db, table)
+		if err != nil {
+			db.Close()
+		} else {
+			st.db, st.close = pg, db.Close
+		}
+	case "rest+http", "rest+https":
+		u, perr := url.Parse(dsn)
+		if perr != nil {
+			return st, fmt.Errorf("invalid storage DSN: %w", perr)
+		}
+		header := http.Header{}
+		for _, h := range u.Query()["header"] {
+			name, value, ok := strings.Cut(h, ":")
+			if !ok {
+				return st, fmt.Errorf("invalid header %q in %q, expected Name:Value", h, dsn)
+			}
+			header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		u.Scheme = strings.TrimPrefix(u.Scheme, "rest+")
+		u.RawQuery = ""
+		st.db, err = storage.NewRESTStorage(storage.RESTOptions{BaseURL: u.String(), Header: header})
+	case "cloudflare-kv":
+		account, namespace, ok := strings.Cut(strings.TrimPrefix(rest, "//"), "/")
+		if !ok || account == "" || namespace == "" {
+			return st, fmt.Errorf("invalid Cloudflare KV DSN %q, expected cloudflare-kv://ACCOUNT/NAMESPACE", dsn)
+		}
+		st.db, err = storage.NewCloudflareKVStorage(account, namespace, os.Getenv("CLOUDFLARE_API_TOKEN"))
+	case "azure":
+		account, table, ok := strings.Cut(strings.TrimPrefix(rest, "//"), "/")
+		if !ok || account == "" || table == "" {
+			return st, fmt.Errorf("invalid Azure DSN %q, expected azure://ACCOUNT/TABLE", dsn)
+		}
+		st.db, err = storage.NewAzureTableStorage(account, os.Getenv("AZURE_STORAGE_KEY"), table)
+	case "redis":
+		return st, fmt.Errorf("there's no Redis user storage (yet)")
+	default:
+		return st, fmt.Errorf("unsupported storage scheme %q", scheme)
+	}
+	if err != nil {
+		return st, fmt.Errorf("opening %s storage: %w", scheme, err)
+	}
+	return st, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+// This is the command-line tool for administering gomagiclink deployments. See
+// README.md for the commands.
+
+import (
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const usage = `Usage: magiclinkctl <command> [flags]
+
+Commands:
+  migrate-storage      Copy all the users from one storage to another
+  verify-audit-chain   Check the audit log written through a ChainedAuditLogger for tampering
+
+Run "magiclinkctl <command> -h" for the command's flags.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "migrate-storage":
+		err = migrateStorage(os.Args[2:])
+	case "verify-audit-chain":
+		err = verifyAuditChain(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
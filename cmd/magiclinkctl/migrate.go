@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// migration copies the users from one storage to another.
+type migration struct {
+	src       gomagiclink.UserAuthDatabase
+	dst       gomagiclink.UserAuthDatabase
+	batch     int
+	dryRun    bool
+	overwrite bool
+	logger    *log.Logger
+
+	emptyTarget bool // Dry run into a target which isn't set up yet
+
+	total                                   int // Users in the source, for the progress
+	seen, copied, skipped, conflicts, fails int
+	lastProgress                            time.Time
+}
+
+func migrateStorage(args []string) error {
+	fs := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	from := fs.String("from", "", "DSN of the storage to copy the users from")
+	to := fs.String("to", "", "DSN of the storage to copy the users to")
+	batch := fs.Int("batch", 100, "Number of users read from the source at once")
+	dryRun := fs.Bool("dry-run", false, "Read the users and check for conflicts, without writing anything")
+	overwrite := fs.Bool("overwrite", false, "Overwrite the users which already exist in the target with the same ID")
+	verify := fs.Bool("verify", false, "Compare all the users in the target with the source after copying them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: magiclinkctl migrate-storage --from=DSN --to=DSN [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *batch < 1 {
+		return fmt.Errorf("invalid batch size %d", *batch)
+	}
+
+	src, err := openStorage(*from, false)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	dst, err := openStorage(*to, !*dryRun)
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+
+	m := &migration{
+		src:       src.db,
+		dst:       dst.db,
+		batch:     *batch,
+		dryRun:    *dryRun,
+		overwrite: *overwrite,
+		logger:    log.New(os.Stderr, "", log.LstdFlags),
+	}
+	if err = m.copyUsers(); err != nil {
+		return err
+	}
+	if *verify && !*dryRun {
+		if err = m.verifyUsers(); err != nil {
+			return err
+		}
+	}
+	if m.fails > 0 || m.conflicts > 0 {
+		return fmt.Errorf("%d users failed to migrate, %d conflicted", m.fails, m.conflicts)
+	}
+	return nil
+}
+
+// eachUser calls fn for all the users in the source, a batch at a time.
+func (m *migration) eachUser(fn func(user *gomagiclink.AuthUserRecord)) error {
+	lister, ok := m.src.(gomagiclink.UserLister)
+	if !ok {
+		return gomagiclink.ErrUserListingNotSupported
+	}
+	filter := gomagiclink.UserFilter{Limit: m.batch}
+	for {
+		page, err := lister.ListUsers(filter)
+		if err != nil {
+			return fmt.Errorf("listing the users at offset %d: %w", filter.Offset, err)
+		}
+		for _, user := range page.Users {
+			fn(user)
+		}
+		if page.NextOffset < 0 {
+			return nil
+		}
+		filter.Offset = page.NextOffset
+	}
+}
+
+// copyUsers copies the users, logging and counting the failures instead of stopping
+// at the first one.
+func (m *migration) copyUsers() (err error) {
+	if m.total, err = m.src.GetUserCount(); err != nil {
+		return fmt.Errorf("counting the users: %w", err)
+	}
+	if m.dryRun {
+		if _, err := m.dst.UsersExist(); err != nil {
+			m.logger.Printf("Can't read the target, assuming it's empty: %v", err)
+			m.emptyTarget = true
+		}
+	}
+	m.logger.Printf("Migrating %d users (dry run: %v)", m.total, m.dryRun)
+	err = m.eachUser(func(user *gomagiclink.AuthUserRecord) {
+		m.seen++
+		m.copyUser(user)
+		m.progress(false)
+	})
+	m.progress(true)
+	return err
+}
+
+func (m *migration) copyUser(user *gomagiclink.AuthUserRecord) {
+	if m.emptyTarget {
+		m.copied++
+		return
+	}
+	existing, err := m.dst.GetUserById(user.ID)
+	switch {
+	case err == nil && !m.overwrite:
+		m.skipped++
+		return
+	case err == nil && existing.Email != user.Email && m.dst.UserExistsByEmail(user.Email):
+		m.logger.Printf("User %s: the e-mail address belongs to another user in the target", user.ID)
+		m.conflicts++
+		return
+	case err == nil:
+		if !m.dryRun {
+			err = gomagiclink.UpdateStoredUser(m.dst, user)
+		}
+	case errors.Is(err, gomagiclink.ErrUserNotFound):
+		if m.dst.UserExistsByEmail(user.Email) {
+			m.logger.Printf("User %s: the e-mail address belongs to another user in the target", user.ID)
+			m.conflicts++
+			return
+		}
+		err = nil
+		if !m.dryRun {
+			err = gomagiclink.CreateStoredUser(m.dst, user)
+		}
+	}
+	if err != nil {
+		m.logger.Printf("User %s: %v", user.ID, err)
+		m.fails++
+		return
+	}
+	m.copied++
+}
+
+// progress logs the progress at most once a second, or always if final.
+func (m *migration) progress(final bool) {
+	if !final && time.Since(m.lastProgress) < time.Second {
+		return
+	}
+	m.lastProgress = time.Now()
+	m.logger.Printf("%d/%d users: %d copied, %d skipped (already exist), %d conflicts, %d failed",
+		m.seen, m.total, m.copied, m.skipped, m.conflicts, m.fails)
+}
+
+// verifyUsers reads all the users in the source again, and compares them with the
+// users in the target. UpdatedAt is ignored, since the target storage sets it.
+func (m *migration) verifyUsers() error {
+	m.logger.Printf("Verifying the users")
+	var checked, mismatched int
+	err := m.eachUser(func(user *gomagiclink.AuthUserRecord) {
+		checked++
+		copied, err := m.dst.GetUserById(user.ID)
+		if err != nil {
+			m.logger.Printf("User %s: %v", user.ID, err)
+			mismatched++
+			return
+		}
+		if !sameUser(user, copied) {
+			m.logger.Printf("User %s differs in the target", user.ID)
+			mismatched++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	m.logger.Printf("Verified %d users, %d mismatched", checked, mismatched)
+	if mismatched > 0 {
+		return fmt.Errorf("%d users don't match", mismatched)
+	}
+	return nil
+}
+
+// sameUser compares the stored fields of the records, except UpdatedAt. Times are
+// compared as instants, since storages can return them in another time zone.
+func sameUser(a, b *gomagiclink.AuthUserRecord) bool {
+	return reflect.DeepEqual(comparableUser(a), comparableUser(b))
+}
+
+func comparableUser(user *gomagiclink.AuthUserRecord) any {
+	u := *user
+	u.UpdatedAt = time.Time{}
+	buf, err := json.Marshal(&u)
+	if err != nil {
+		return nil
+	}
+	var v any
+	if err = json.Unmarshal(buf, &v); err != nil {
+		return nil
+	}
+	return normalizeTimes(v)
+}
+
+// normalizeTimes converts the RFC 3339 times in the decoded JSON to UTC.
+func normalizeTimes(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeTimes(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeTimes(e)
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return v
+}
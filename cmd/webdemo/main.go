@@ -3,17 +3,21 @@ package main
 // This is an example web app for the gomagiclink module, implementing the magic link login workflow.
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/adapters"
+	"github.com/ivoras/gomagiclink/mailer"
 	"github.com/ivoras/gomagiclink/storage"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,10 +25,27 @@ import (
 const cookieName = "MLCOOKIE"
 const cookieDurationSeconds = 3600
 const wwwListen = "localhost:8003"
+const challengeDuration = time.Hour
 
 var mlink *gomagiclink.AuthMagicLinkController
+var auth *adapters.AuthHandlers
+var devMailbox = mailer.NewDevMailbox(50)
+var consoleSender = mailer.NewConsoleSender(os.Stdout)
 
 func main() {
+	// The secret key should come from the configuration. If it's not set, generate a
+	// random one, but then the sessions won't survive a restart.
+	secretKey := []byte(os.Getenv("MAGICLINK_SECRET_KEY"))
+	if len(secretKey) == 0 {
+		var keyBase64 string
+		var err error
+		secretKey, keyBase64, err = gomagiclink.GenerateSecretKey()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("MAGICLINK_SECRET_KEY not set, using a random key:", keyBase64)
+	}
+
 	db, err := sql.Open("sqlite3", "./magiclink.db")
 	if err != nil {
 		panic(err)
@@ -34,23 +55,50 @@ func main() {
 		panic(err)
 	}
 	mlink, err = gomagiclink.NewAuthMagicLinkController(
-		[]byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit."), // Our secret key
-		time.Hour,    // User challenge (i.e. magic link) expiration
-		time.Hour*24, // Session ID (i.e. cookied) expiration
-		mlStorage,    // Storage engine for user data
+		secretKey,                               // Our secret key
+		challengeDuration,                       // User challenge (i.e. magic link) expiration
+		time.Hour*24,                            // Session ID (i.e. cookied) expiration
+		mlStorage,                               // Storage engine for user data
+		gomagiclink.WithSessionGrace(time.Hour), // Re-issue recently expired sessions
+		gomagiclink.WithWriteBehind(5*time.Second), // The counter is stored on every page view, so buffer the writes
 	)
 	if err != nil {
 		panic(err)
 	}
+	auth = adapters.NewAuthHandlers(mlink, devMailbox, fmt.Sprintf("http://%s/verify", wwwListen))
+	auth.CookieName = cookieName
+	auth.CookieMaxAge = cookieDurationSeconds * time.Second
+	auth.OnLogin = func(user *gomagiclink.AuthUserRecord) error {
+		if user.CustomData == nil {
+			user.CustomData = map[string]string{"n": "1"} // CustomData goes through JSON, so all numbers are float64
+		}
+		if count, err := mlink.GetUserCount(); err == nil && count == 0 { // 1st user, make it an admin
+			user.AccessLevel = 1000
+		}
+		return nil
+	}
 
 	http.HandleFunc("/", wwwRoot)
 	http.HandleFunc("/login", wwwLogin)
 	http.HandleFunc("/challenge", wwwChallenge)
 	http.HandleFunc("/verify", wwwVerifyChallenge)
 	http.HandleFunc("/logout", wwwLogout)
+	http.Handle("/dev/mail", devMailbox) // Shows the "sent" magic links
+
+	// On Ctrl-C, stop the server and write the buffered user records
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	srv := &http.Server{Addr: wwwListen, Handler: Logger(os.Stderr, http.DefaultServeMux)}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
 
 	log.Println("Listening on", wwwListen)
-	log.Println(http.ListenAndServe(wwwListen, Logger(os.Stderr, http.DefaultServeMux)))
+	log.Println(srv.ListenAndServe())
+	if err = mlink.Close(); err != nil {
+		log.Println("Can't write user records:", err)
+	}
 }
 
 type Page struct {
@@ -107,6 +155,22 @@ func wwwRoot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.StaleSession {
+		// The session has expired recently, so silently issue a new one
+		sessionId, err := mlink.GenerateSessionId(user)
+		if err != nil {
+			wwwError(w, http.StatusInternalServerError, "Error generating session id")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    sessionId,
+			Path:     "/",
+			MaxAge:   cookieDurationSeconds,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
 	// This is the actual web app. We're just incrementing the counter here and making
 	// use of the CustomData feature.
 	n, _ := strconv.Atoi(user.CustomData["n"])
@@ -161,29 +225,35 @@ func wwwChallenge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	challenge, err := mlink.GenerateChallenge(email)
+	locale, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	meta := gomagiclink.ChallengeMetadata{Locale: locale, Channel: "email"}
+	receipt, err := auth.StartLogin(r.Context(), email, adapters.LoginOptions{Metadata: meta})
 	if err != nil {
-		wwwError(w, http.StatusInternalServerError, "Error generating challenge")
+		wwwError(w, http.StatusInternalServerError, "Error sending the magic link")
 		return
 	}
-
-	url := fmt.Sprintf("http://%s/verify?challenge=%s", wwwListen, url.QueryEscape(challenge))
-	fmt.Println("Open this URL in the browser to start verification:", url)
+	// The DevMailbox captured the message; find it, to show the link
+	var url string
+	for _, msg := range devMailbox.Messages() {
+		if msg.ReceiptID == receipt.ID {
+			url = msg.Link
+			consoleSender.SendMagicLink(r.Context(), &msg.MagicLinkMessage)
+			break
+		}
+	}
 
 	p, err := loadPage("challenge.html", "Challenge issued")
 	if err != nil {
 		wwwError(w, http.StatusInternalServerError, "Can't load challenge template")
 	}
 	p.tpl.Execute(w, struct {
-		Title     string
-		Email     string
-		Challenge string
-		Url       string
+		Title string
+		Email string
+		Url   string
 	}{
-		Title:     p.Title,
-		Email:     email,
-		Challenge: challenge,
-		Url:       url,
+		Title: p.Title,
+		Email: receipt.Email,
+		Url:   url,
 	})
 }
 
@@ -193,15 +263,15 @@ func wwwChallenge(w http.ResponseWriter, r *http.Request) {
 //   - Generates the session id
 //   - Creates a HTTP cookie and adds the session ID to it
 func wwwVerifyChallenge(w http.ResponseWriter, r *http.Request) {
-	challenge := r.URL.Query().Get("challenge")
-	if challenge == "" {
+	if r.URL.Query().Get("challenge") == "" {
 		log.Println("Empty challenge")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
-	user, err := mlink.VerifyChallenge(challenge)
-	if err != nil {
+	if _, _, err := auth.CompleteLogin(w, r); err != nil {
 		switch err {
+		case gomagiclink.ErrInvalidURLSignature, gomagiclink.ErrBrokenURLSignature:
+			wwwError(w, http.StatusBadRequest, "Magic link was modified")
 		case gomagiclink.ErrBrokenChallenge:
 			wwwError(w, http.StatusBadRequest, "Broken challenge")
 		case gomagiclink.ErrInvalidChallenge:
@@ -213,30 +283,6 @@ func wwwVerifyChallenge(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if user.CustomData == nil {
-		user.CustomData = map[string]string{"n": "1"} // CustomData goes through JSON, so all numbers are float64
-	}
-	if count, err := mlink.GetUserCount(); err == nil && count == 0 { // 1st user, make it an admin
-		user.AccessLevel = 1000
-	}
-	err = mlink.StoreUser(user)
-	if err != nil {
-		wwwError(w, http.StatusInternalServerError, "Error storing user")
-		return
-	}
-	sessionId, err := mlink.GenerateSessionId(user)
-	if err != nil {
-		wwwError(w, http.StatusInternalServerError, "Error generating session id")
-		return
-	}
-	cookie := http.Cookie{
-		Name:     cookieName,
-		Value:    sessionId,
-		Path:     "/",
-		MaxAge:   cookieDurationSeconds,
-		SameSite: http.SameSiteLaxMode,
-	}
-	http.SetCookie(w, &cookie)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
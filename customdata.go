@@ -0,0 +1,132 @@
+package gomagiclink
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+var ErrCustomDataNotFound = errors.New("custom data not found")
+var ErrCustomDataVersion = errors.New("unsupported custom data version")
+
+// CustomDataCodec encodes the app's values into the strings stored in the CustomData
+// of user records.
+type CustomDataCodec interface {
+	Marshal(v any) (string, error)
+	Unmarshal(data string, v any) error
+}
+
+// JSONCustomDataCodec encodes values as JSON.
+type JSONCustomDataCodec struct{}
+
+func (JSONCustomDataCodec) Marshal(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (JSONCustomDataCodec) Unmarshal(data string, v any) error {
+	return json.Unmarshal([]byte(data), v)
+}
+
+// DefaultCustomDataCodec is used by VersionedCustomData without a Codec.
+var DefaultCustomDataCodec CustomDataCodec = JSONCustomDataCodec{}
+
+// CustomDataMigration upgrades a value from one version to the next. The value is
+// decoded generically by the codec, e.g. JSON objects as map[string]any, and numbers
+// as float64.
+type CustomDataMigration func(old any) (any, error)
+
+// VersionedCustomData stores a value of the app's type T in the CustomData of user
+// records, under Key, together with the version of its schema (under Key + ".version").
+// When T changes shape, increase Version and add a migration from the previous version:
+// values stored with older versions are upgraded when they're loaded, so the records
+// don't need to be converted all at once. Values stored before versioning was used are
+// version 0.
+type VersionedCustomData[T any] struct {
+	Key        string
+	Version    int
+	Codec      CustomDataCodec             // DefaultCustomDataCodec if nil
+	Migrations map[int]CustomDataMigration // Keyed by the version they upgrade from
+}
+
+func (vcd *VersionedCustomData[T]) codec() CustomDataCodec {
+	if vcd.Codec != nil {
+		return vcd.Codec
+	}
+	return DefaultCustomDataCodec
+}
+
+func (vcd *VersionedCustomData[T]) versionKey() string {
+	return vcd.Key + ".version"
+}
+
+// Load decodes the value from the user record, upgrading it to the current version
+// if it was stored with an older one. In that case, the upgraded value is also put
+// back into the record and migrated is true; store the record to persist the upgrade.
+// It returns ErrCustomDataNotFound if the record doesn't have the value, and
+// ErrCustomDataVersion if it's from a newer version or a migration is missing.
+func (vcd *VersionedCustomData[T]) Load(user *AuthUserRecord) (v T, migrated bool, err error) {
+	data, ok := user.CustomData[vcd.Key]
+	if !ok {
+		return v, false, ErrCustomDataNotFound
+	}
+	version := 0
+	if s, ok := user.CustomData[vcd.versionKey()]; ok {
+		if version, err = strconv.Atoi(s); err != nil {
+			return v, false, ErrCustomDataVersion
+		}
+	}
+	if version > vcd.Version {
+		return v, false, ErrCustomDataVersion
+	}
+	codec := vcd.codec()
+	if version < vcd.Version {
+		var generic any
+		if err = codec.Unmarshal(data, &generic); err != nil {
+			return v, false, err
+		}
+		for ; version < vcd.Version; version++ {
+			migrate := vcd.Migrations[version]
+			if migrate == nil {
+				return v, false, ErrCustomDataVersion
+			}
+			if generic, err = migrate(generic); err != nil {
+				return v, false, err
+			}
+		}
+		if data, err = codec.Marshal(generic); err != nil {
+			return v, false, err
+		}
+		migrated = true
+	}
+	if err = codec.Unmarshal(data, &v); err != nil {
+		return v, false, err
+	}
+	if migrated {
+		// Re-encode the typed value, so the record holds exactly what Store() would write
+		if err = vcd.Store(user, v); err != nil {
+			return v, false, err
+		}
+	}
+	return v, migrated, nil
+}
+
+// Store encodes the value into the user record, with the current version.
+func (vcd *VersionedCustomData[T]) Store(user *AuthUserRecord, v T) error {
+	data, err := vcd.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+	if user.CustomData == nil {
+		user.CustomData = map[string]string{}
+	}
+	user.CustomData[vcd.Key] = data
+	user.CustomData[vcd.versionKey()] = strconv.Itoa(vcd.Version)
+	return nil
+}
+
+// Delete removes the value from the user record.
+func (vcd *VersionedCustomData[T]) Delete(user *AuthUserRecord) {
+	delete(user.CustomData, vcd.Key)
+	delete(user.CustomData, vcd.versionKey())
+}
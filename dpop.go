@@ -0,0 +1,285 @@
+package gomagiclink
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const boundChallengeSignature = "P"
+const boundSessionIdSignature = "B"
+const proofKeyThumbprintLength = sha256.Size
+
+// DefaultProofMaxAge is how old the proofs passed to VerifySessionIdWithProof() can be,
+// if WithProofOfPossession() is given 0.
+const DefaultProofMaxAge = time.Minute
+
+var ErrProofOfPossessionDisabled = errors.New("proof of possession not enabled")
+var ErrInvalidProofKey = errors.New("invalid proof key")
+var ErrProofRequired = errors.New("proof of possession required")
+var ErrInvalidProof = errors.New("invalid proof of possession")
+var ErrReplayedProof = errors.New("replayed proof of possession")
+
+// WithProofOfPossession enables the DPoP-style (RFC 9449) proof of possession mode: the
+// client generates a key pair and sends the public key (as a JWK) when it requests the
+// magic link, and the app passes it to GenerateChallengeWithProofKey(). The session ID
+// generated after verifying such a challenge is bound to the key, and it's only accepted
+// by VerifySessionIdWithProof(), with a proof signed by the private key for each request,
+// so a stolen session ID is useless without the key. Proofs older than maxAge (default
+// DefaultProofMaxAge) are rejected, and the newer ones can only be used once; the used
+// proofs are remembered in memory, so each app instance detects replays on its own.
+func WithProofOfPossession(maxAge time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		if maxAge <= 0 {
+			maxAge = DefaultProofMaxAge
+		}
+		mlc.proofMaxAge = maxAge
+		mlc.proofReplays = newSeenCache()
+	}
+}
+
+// proofJWK is a public key in the JWK format. Only EC P-256 and Ed25519 keys are supported.
+type proofJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	D   string `json:"d,omitempty"`
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key.
+func (k *proofJWK) thumbprint() []byte {
+	var canonical string
+	if k.Kty == "EC" {
+		canonical = `{"crv":"` + k.Crv + `","kty":"EC","x":"` + k.X + `","y":"` + k.Y + `"}`
+	} else {
+		canonical = `{"crv":"` + k.Crv + `","kty":"OKP","x":"` + k.X + `"}`
+	}
+	h := sha256.Sum256([]byte(canonical))
+	return h[:]
+}
+
+// verifier returns the function verifying signatures made by the key with the JWS algorithm.
+func (k *proofJWK) verifier(alg string) (func(signed, sig []byte) bool, error) {
+	if k.D != "" {
+		return nil, ErrInvalidProofKey
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, ErrInvalidProofKey
+	}
+	switch {
+	case k.Kty == "EC" && k.Crv == "P-256" && (alg == "" || alg == "ES256"):
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil || len(x) != 32 || len(y) != 32 {
+			return nil, ErrInvalidProofKey
+		}
+		if _, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, ErrInvalidProofKey
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return func(signed, sig []byte) bool {
+			if len(sig) != 64 {
+				return false
+			}
+			h := sha256.Sum256(signed)
+			return ecdsa.Verify(pub, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+		}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519" && (alg == "" || alg == "EdDSA"):
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidProofKey
+		}
+		return func(signed, sig []byte) bool {
+			return ed25519.Verify(ed25519.PublicKey(x), signed, sig)
+		}, nil
+	}
+	return nil, ErrInvalidProofKey
+}
+
+func parseProofJWK(jwk []byte) (k *proofJWK, err error) {
+	k = &proofJWK{}
+	if err = json.Unmarshal(jwk, k); err != nil {
+		return nil, ErrInvalidProofKey
+	}
+	if _, err = k.verifier(""); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ProofKeyThumbprint returns the RFC 7638 thumbprint of the public key in the JWK format,
+// base64url-encoded, as used in the "jkt" confirmation claim. Only EC P-256 and Ed25519
+// keys are supported.
+func ProofKeyThumbprint(jwk []byte) (string, error) {
+	k, err := parseProofJWK(jwk)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(k.thumbprint()), nil
+}
+
+// GenerateChallengeWithProofKey is like GenerateChallengeWithReceipt(), but binds the
+// challenge to the client's public key (a JWK), see WithProofOfPossession(). VerifyChallenge()
+// sets the ProofKeyThumbprint field of the user record it returns for such challenges, and
+// GenerateSessionId() then generates a session ID bound to the key.
+func (mlc *AuthMagicLinkController) GenerateChallengeWithProofKey(email string, jwk []byte, meta ChallengeMetadata) (challenge string, receipt *ChallengeReceipt, err error) {
+	if mlc.proofReplays == nil {
+		return "", nil, ErrProofOfPossessionDisabled
+	}
+	k, err := parseProofJWK(jwk)
+	if err != nil {
+		return "", nil, err
+	}
+	return mlc.generateChallenge(email, RiskInfo{}, meta, k.thumbprint())
+}
+
+// proofKeyFromThumbprint decodes the ProofKeyThumbprint field of a user record.
+func proofKeyFromThumbprint(jkt string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(jkt)
+	if err != nil || len(key) != proofKeyThumbprintLength {
+		return nil, ErrInvalidProofKey
+	}
+	return key, nil
+}
+
+// proofHeader and proofClaims are the parts of a DPoP proof JWT.
+type proofHeader struct {
+	Typ string          `json:"typ"`
+	Alg string          `json:"alg"`
+	JWK json.RawMessage `json:"jwk"`
+}
+
+type proofClaims struct {
+	ID          string `json:"jti"`
+	Method      string `json:"htm"`
+	URL         string `json:"htu"`
+	IssuedAt    int64  `json:"iat"`
+	AccessToken string `json:"ath"`
+}
+
+// VerifySessionIdWithProof is like VerifySessionId(), but also accepts session IDs bound
+// to a proof key (see WithProofOfPossession()). The proof is the value of the request's
+// "DPoP" header: a JWT signed with the bound key, with the "htm" and "htu" claims set to
+// the request's method and URL, and the "ath" claim set to the hash of the session ID, as
+// in RFC 9449. Session IDs which aren't bound are verified without the proof.
+func (mlc *AuthMagicLinkController) VerifySessionIdWithProof(sessionId string, proof string, method string, requestURL string) (user *AuthUserRecord, err error) {
+	claims, err := mlc.parseSessionId(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ProofKey != nil {
+		if err = mlc.verifyProof(proof, claims.ProofKey, sessionId, method, requestURL); err != nil {
+			return nil, err
+		}
+	}
+	return mlc.sessionUser(claims)
+}
+
+// verifyProof verifies that the DPoP proof JWT is signed by the key with the thumbprint,
+// for the request and the session ID, and that it hasn't been used before.
+func (mlc *AuthMagicLinkController) verifyProof(proof string, thumbprint []byte, sessionId string, method string, requestURL string) error {
+	if proof == "" {
+		return ErrProofRequired
+	}
+	if mlc.proofReplays == nil {
+		return ErrProofOfPossessionDisabled
+	}
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return ErrInvalidProof
+	}
+	var header proofHeader
+	var claims proofClaims
+	if decodeProofPart(parts[0], &header) != nil || decodeProofPart(parts[1], &claims) != nil || header.Typ != "dpop+jwt" {
+		return ErrInvalidProof
+	}
+	var k proofJWK
+	if err := json.Unmarshal(header.JWK, &k); err != nil {
+		return ErrInvalidProof
+	}
+	verify, err := k.verifier(header.Alg)
+	if err != nil || header.Alg == "" {
+		return ErrInvalidProof
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return ErrInvalidProof
+	}
+	if string(k.thumbprint()) != string(thumbprint) {
+		return ErrInvalidProof
+	}
+	ath := sha256.Sum256([]byte(sessionId))
+	if claims.ID == "" || claims.Method != method || !sameProofURL(claims.URL, requestURL) ||
+		claims.AccessToken != base64.RawURLEncoding.EncodeToString(ath[:]) {
+		return ErrInvalidProof
+	}
+	window := mlc.proofMaxAge + mlc.clockSkew
+	issued := time.Unix(claims.IssuedAt, 0)
+	if time.Since(issued) > window || time.Until(issued) > window {
+		return ErrInvalidProof
+	}
+	if !mlc.proofReplays.add(string(thumbprint)+claims.ID, issued.Add(window)) {
+		return ErrReplayedProof
+	}
+	return nil
+}
+
+func decodeProofPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// sameProofURL compares the "htu" claim with the request URL, ignoring the query and fragment.
+func sameProofURL(htu string, requestURL string) bool {
+	u1, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	u2, err := url.Parse(requestURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u1.Scheme, u2.Scheme) && strings.EqualFold(u1.Host, u2.Host) && u1.EscapedPath() == u2.EscapedPath()
+}
+
+// seenCache remembers the IDs of the recently used one-time items, like proofs.
+type seenCache struct {
+	lock sync.Mutex
+	seen map[string]time.Time // IDs, with the time until which they're remembered
+}
+
+func newSeenCache() *seenCache {
+	return &seenCache{seen: map[string]time.Time{}}
+}
+
+// add records the ID, returning false if it has already been used.
+func (rc *seenCache) add(id string, until time.Time) bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	now := time.Now()
+	if t, ok := rc.seen[id]; ok && now.Before(t) {
+		return false
+	}
+	if len(rc.seen) >= 10000 {
+		for key, t := range rc.seen {
+			if t.Before(now) {
+				delete(rc.seen, key)
+			}
+		}
+	}
+	rc.seen[id] = until
+	return true
+}
@@ -0,0 +1,165 @@
+package gomagiclink_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// testProofKey is a client's proof key.
+type testProofKey struct {
+	key *ecdsa.PrivateKey
+	jwk []byte
+}
+
+func newTestProofKey(t *testing.T) *testProofKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32)))
+	y := base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32)))
+	return &testProofKey{key: key, jwk: []byte(`{"kty":"EC","crv":"P-256","x":"` + x + `","y":"` + y + `"}`)}
+}
+
+// proof returns a DPoP proof JWT for the request, with the JWK in the header, and signed
+// with the signer's key.
+func (k *testProofKey) proof(t *testing.T, signer *testProofKey, jti string, method string, url string, sessionId string, iat time.Time) string {
+	t.Helper()
+	ath := sha256.Sum256([]byte(sessionId))
+	header, err := json.Marshal(map[string]any{"typ": "dpop+jwt", "alg": "ES256", "jwk": json.RawMessage(k.jwk)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := json.Marshal(map[string]any{
+		"jti": jti,
+		"htm": method,
+		"htu": url,
+		"iat": iat.Unix(),
+		"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, signer.key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestProofOfPossession(t *testing.T) {
+	mlc, _, user := newTestController(t, gomagiclink.WithProofOfPossession(time.Minute))
+	key, otherKey := newTestProofKey(t), newTestProofKey(t)
+	challenge, _, err := mlc.GenerateChallengeWithProofKey(user.Email, key.jwk, gomagiclink.ChallengeMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := mlc.VerifyChallenge(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbprint, _ := gomagiclink.ProofKeyThumbprint(key.jwk); bound.ProofKeyThumbprint != thumbprint {
+		t.Fatalf("ProofKeyThumbprint = %q, want %q", bound.ProofKeyThumbprint, thumbprint)
+	}
+	sessionId, err := mlc.GenerateSessionId(bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSessionId, err := mlc.GenerateSessionId(bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const method, url = "POST", "https://example.com/api/orders"
+	now := time.Now()
+
+	if _, err = mlc.VerifySessionId(sessionId); err != gomagiclink.ErrProofRequired {
+		t.Errorf("VerifySessionId() of a bound session = %v, want ErrProofRequired", err)
+	}
+	if _, err = mlc.VerifySessionIdWithProof(sessionId, "", method, url); err != gomagiclink.ErrProofRequired {
+		t.Errorf("bound session without a proof = %v, want ErrProofRequired", err)
+	}
+
+	proof := key.proof(t, key, "jti-1", method, url, sessionId, now)
+	verified, err := mlc.VerifySessionIdWithProof(sessionId, proof, method, url+"?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.ID != user.ID {
+		t.Errorf("verified user %v, want %v", verified.ID, user.ID)
+	}
+	if _, err = mlc.VerifySessionIdWithProof(sessionId, proof, method, url); err != gomagiclink.ErrReplayedProof {
+		t.Errorf("replayed proof = %v, want ErrReplayedProof", err)
+	}
+	if _, err = mlc.VerifySessionIdWithProof(sessionId, key.proof(t, key, "jti-2", method, url, sessionId, now), method, url); err != nil {
+		t.Errorf("a new proof: %v", err)
+	}
+
+	invalid := []struct {
+		name  string
+		proof string
+	}{
+		{"another key", otherKey.proof(t, otherKey, "jti-3", method, url, sessionId, now)},
+		{"the bound key's JWK signed with another key", key.proof(t, otherKey, "jti-4", method, url, sessionId, now)},
+		{"another method", key.proof(t, key, "jti-5", "GET", url, sessionId, now)},
+		{"another URL", key.proof(t, key, "jti-6", method, "https://example.com/api/users", sessionId, now)},
+		{"another host", key.proof(t, key, "jti-7", method, "https://evil.example.com/api/orders", sessionId, now)},
+		{"another session", key.proof(t, key, "jti-8", method, url, otherSessionId, now)},
+		{"too old", key.proof(t, key, "jti-9", method, url, sessionId, now.Add(-2*time.Minute))},
+		{"from the future", key.proof(t, key, "jti-10", method, url, sessionId, now.Add(2*time.Minute))},
+		{"without a jti", key.proof(t, key, "", method, url, sessionId, now)},
+		{"malformed", "not.a.proof"},
+	}
+	for _, tt := range invalid {
+		if _, err = mlc.VerifySessionIdWithProof(sessionId, tt.proof, method, url); err != gomagiclink.ErrInvalidProof {
+			t.Errorf("proof with %s = %v, want ErrInvalidProof", tt.name, err)
+		}
+	}
+
+	// The rejected proofs aren't recorded as used
+	if _, err = mlc.VerifySessionIdWithProof(sessionId, key.proof(t, key, "jti-3", method, url, sessionId, now), method, url); err != nil {
+		t.Errorf("a valid proof with the ID of a rejected one: %v", err)
+	}
+	// Sessions which aren't bound are verified without the proof
+	plain, err := mlc.GenerateSessionId(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mlc.VerifySessionIdWithProof(plain, "", method, url); err != nil {
+		t.Errorf("session which isn't bound, without a proof: %v", err)
+	}
+}
+
+func TestProofKeyThumbprint(t *testing.T) {
+	// RFC 7638, section 3.1, is an RSA key, so the thumbprint is checked with the RFC 8037
+	// Ed25519 example (Appendix A.3)
+	jwk := []byte(`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`)
+	thumbprint, err := gomagiclink.ProofKeyThumbprint(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; thumbprint != want {
+		t.Errorf("ProofKeyThumbprint() = %q, want %q", thumbprint, want)
+	}
+	for _, jwk := range []string{
+		`{"kty":"RSA","n":"0vx7agoebGcQSuuPiLJXZpt","e":"AQAB"}`,
+		`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A"}`,
+		`{"kty":"EC","crv":"P-256","x":"AAAA","y":"AAAA"}`,
+		`not JSON`,
+	} {
+		if _, err = gomagiclink.ProofKeyThumbprint([]byte(jwk)); err != gomagiclink.ErrInvalidProofKey {
+			t.Errorf("ProofKeyThumbprint(%s) = %v, want ErrInvalidProofKey", jwk, err)
+		}
+	}
+}
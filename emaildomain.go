@@ -0,0 +1,112 @@
+package gomagiclink
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var ErrEmailDomainNotAllowed = errors.New("e-mail domain not allowed")
+var ErrInvalidDomainPattern = errors.New("invalid e-mail domain pattern")
+
+// EmailDomainPolicy limits the e-mail domains which can log in, see WithEmailDomainPolicy().
+// The patterns are either exact domains ("example.com"), wildcards matching the
+// subdomains ("*.example.com", which doesn't match "example.com" itself), or regular
+// expressions matching the whole domain, prefixed with "re:" ("re:dev[0-9]+\.example\.com").
+// Domains are compared in lower case.
+type EmailDomainPolicy struct {
+	Allow []string // If not empty, only the domains matching one of these patterns can log in
+	Deny  []string // The domains matching one of these patterns can't log in, even if they're allowed
+}
+
+// domainMatcher is a compiled EmailDomainPolicy pattern.
+type domainMatcher struct {
+	exact  string
+	suffix string // For wildcards, "." + the parent domain
+	re     *regexp.Regexp
+}
+
+func compileDomainPatterns(patterns []string) (matchers []domainMatcher, err error) {
+	for _, pattern := range patterns {
+		var m domainMatcher
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			if m.re, err = regexp.Compile("^(?:" + expr + ")$"); err != nil {
+				return nil, ErrInvalidDomainPattern
+			}
+		} else if parent, ok := strings.CutPrefix(pattern, "*."); ok && parent != "" && !strings.Contains(parent, "*") {
+			m.suffix = "." + strings.ToLower(parent)
+		} else if pattern != "" && !strings.ContainsAny(pattern, "*@") {
+			m.exact = strings.ToLower(pattern)
+		} else {
+			return nil, ErrInvalidDomainPattern
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func (m *domainMatcher) match(domain string) bool {
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(domain)
+	case m.suffix != "":
+		return strings.HasSuffix(domain, m.suffix)
+	}
+	return domain == m.exact
+}
+
+// emailDomainRules is the compiled EmailDomainPolicy.
+type emailDomainRules struct {
+	policy EmailDomainPolicy
+	allow  []domainMatcher
+	deny   []domainMatcher
+}
+
+// WithEmailDomainPolicy limits the e-mail domains which can log in, e.g. to the company's
+// domain for internal tools. It's enforced by GenerateChallenge(), and checked again by
+// VerifyChallenge(), so changing the policy also applies to the links already sent.
+// Other addresses are rejected with ErrEmailDomainNotAllowed. Invalid patterns make
+// NewAuthMagicLinkController() fail with ErrInvalidDomainPattern.
+func WithEmailDomainPolicy(policy EmailDomainPolicy) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.emailDomains = &emailDomainRules{policy: policy}
+	}
+}
+
+// compile compiles the policy's patterns.
+func (edr *emailDomainRules) compile() (err error) {
+	if edr.allow, err = compileDomainPatterns(edr.policy.Allow); err != nil {
+		return
+	}
+	edr.deny, err = compileDomainPatterns(edr.policy.Deny)
+	return
+}
+
+// CheckEmailDomain returns ErrEmailDomainNotAllowed if the e-mail address' domain can't
+// log in according to the policy set with WithEmailDomainPolicy(), e.g. to validate the
+// address in the login form before generating a challenge.
+func (mlc *AuthMagicLinkController) CheckEmailDomain(email string) error {
+	if mlc.emailDomains == nil {
+		return nil
+	}
+	email = NormalizeEmail(email)
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return ErrEmailDomainNotAllowed
+	}
+	domain := email[at+1:]
+	for i := range mlc.emailDomains.deny {
+		if mlc.emailDomains.deny[i].match(domain) {
+			return ErrEmailDomainNotAllowed
+		}
+	}
+	if len(mlc.emailDomains.allow) == 0 {
+		return nil
+	}
+	for i := range mlc.emailDomains.allow {
+		if mlc.emailDomains.allow[i].match(domain) {
+			return nil
+		}
+	}
+	return ErrEmailDomainNotAllowed
+}
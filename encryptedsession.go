@@ -0,0 +1,177 @@
+package gomagiclink
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const encryptedSessionIdSignature = "X"
+
+// maxSessionSnapshotLength limits the JSON-encoded snapshot, so the encrypted session ID
+// still fits in a cookie.
+const maxSessionSnapshotLength = 2048
+
+var ErrSessionSnapshotTooLarge = errors.New("session snapshot too large")
+var ErrUserSnapshot = errors.New("user record from an encrypted session can't be stored")
+
+// WithEncryptedSessions makes GenerateSessionId() encrypt a snapshot of the user (the ID,
+// e-mail address, AccessLevel, organization memberships and the ClaimsProvider's claims)
+// into the session ID, so read-only requests can be served without accessing the
+// storage. For freshness after the session was issued, VerifySessionId() returns the
+// user record built from the snapshot, with the SessionSnapshot field set; after that,
+// it loads the record from the storage as usual. This means that changes to the user,
+// including disabling or locking them, take effect on their sessions only after the
+// freshness period. ReuseOrGenerateSessionId() issues a new session ID once the
+// snapshot is no longer fresh, or differs from the user record.
+//
+// The snapshot is encrypted with a key derived from the secret key, so its contents
+// aren't readable by the client, and its JSON encoding is limited to 2048 bytes
+// (ErrSessionSnapshotTooLarge). Sessions bound to a proof key, server-side sessions
+// (see WithSessionStore()) and impersonation sessions aren't encrypted. Encrypted session
+// IDs are still accepted when the option is removed, but the user is always loaded.
+func WithEncryptedSessions(freshness time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.encryptedSessions = true
+		mlc.sessionSnapshotFreshness = freshness
+	}
+}
+
+// sessionSnapshot is the part of the user record encrypted into the session ID.
+type sessionSnapshot struct {
+	ID          uuid.UUID       `json:"id"`
+	Email       string          `json:"email"`
+	AccessLevel int             `json:"lvl,omitempty"`
+	Memberships []OrgMembership `json:"orgs,omitempty"`
+	Claims      json.RawMessage `json:"claims,omitempty"`
+	Epoch       int             `json:"epoch,omitempty"` // The user's TokenEpoch
+	IssuedAt    int64           `json:"iat"`
+	ExpTime     int             `json:"exp,omitempty"` // Unix timestamp, 0 if the session doesn't expire
+}
+
+// matches returns true if the snapshot was taken from the user record as it is now.
+func (ss *sessionSnapshot) matches(user *AuthUserRecord, claims []byte) bool {
+	return ss.ID == user.ID && ss.Email == user.Email && ss.AccessLevel == user.AccessLevel && ss.Epoch == user.TokenEpoch &&
+		slices.EqualFunc(ss.Memberships, user.Memberships, func(a, b OrgMembership) bool {
+			return a.OrgID == b.OrgID && a.Role == b.Role && a.JoinedAt.Equal(b.JoinedAt)
+		}) &&
+		string(ss.Claims) == string(claims)
+}
+
+// user returns the partial user record held by the snapshot.
+func (ss *sessionSnapshot) user() *AuthUserRecord {
+	return &AuthUserRecord{
+		ID:              ss.ID,
+		Enabled:         true,
+		Email:           ss.Email,
+		AccessLevel:     ss.AccessLevel,
+		Memberships:     ss.Memberships,
+		TokenEpoch:      ss.Epoch,
+		SessionSnapshot: true,
+	}
+}
+
+// snapshotFresh returns true if the snapshot can be used instead of the user record.
+func (mlc *AuthMagicLinkController) snapshotFresh(ss *sessionSnapshot) bool {
+	return mlc.encryptedSessions && time.Since(time.Unix(ss.IssuedAt, 0)) < mlc.sessionSnapshotFreshness
+}
+
+// generateEncryptedSessionId creates a session ID with the encrypted snapshot of the user.
+func (mlc *AuthMagicLinkController) generateEncryptedSessionId(user *AuthUserRecord) (sessionId string, err error) {
+	// Session ID is in the format:
+	// XSALT-ENCRYPTED_SNAPSHOT-HMAC("X" || SALT || ENCRYPTED_SNAPSHOT, sessionKey)
+	// where the salt ends with the audience tag, as in the other session IDs
+	if user.SessionSnapshot {
+		// Refresh the snapshot from the storage, not from an earlier snapshot
+		if user, err = mlc.getUserById(user.ID); err != nil {
+			return
+		}
+	}
+	claims, err := mlc.sessionClaimsJSON(user)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	ss := sessionSnapshot{
+		ID:          user.ID,
+		Email:       user.Email,
+		AccessLevel: user.AccessLevel,
+		Memberships: user.Memberships,
+		Claims:      claims,
+		Epoch:       user.TokenEpoch,
+		IssuedAt:    now.Unix(),
+	}
+	if d := mlc.sessionDuration(user); d > 0 {
+		ss.ExpTime = int(now.Add(d).Unix())
+	}
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return
+	}
+	if len(data) > maxSessionSnapshotLength {
+		return "", ErrSessionSnapshotTooLarge
+	}
+	salt, err := mlc.newSalt()
+	if err != nil {
+		return
+	}
+	ciphertext, err := sealAESGCM(mlc.keys.sessionEncryption, data, []byte(encryptedSessionIdSignature))
+	if err != nil {
+		return
+	}
+	hmac := mlc.makeTokenHMAC(mlc.keys.session, slices.Concat([]byte(encryptedSessionIdSignature), salt, []byte{0}, ciphertext))
+	return mlc.sealToken(encryptedSessionIdSignature + strings.Join([]string{encodeToString(salt), encodeToString(ciphertext), encodeToString(hmac)}, sesionIdSplitChar)), nil
+}
+
+// parseEncryptedSessionId verifies and decrypts the body of an encrypted session ID.
+func (mlc *AuthMagicLinkController) parseEncryptedSessionId(fullSessionId string, sessionId string) (claims sessionClaims, err error) {
+	parts := strings.Split(sessionId[len(encryptedSessionIdSignature):], sesionIdSplitChar)
+	if len(parts) != 3 {
+		return claims, ErrInvalidSessionId
+	}
+	salt, err := decodeFromString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidSessionId
+	}
+	if err = mlc.checkAudience(salt); err != nil {
+		return claims, err
+	}
+	ciphertext, err := decodeFromString(parts[1])
+	if err != nil {
+		return claims, ErrInvalidSessionId
+	}
+	hmac1, err := decodeFromString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidSessionId
+	}
+	if !mlc.verifyTokenHMAC(mlc.keys.session, slices.Concat([]byte(encryptedSessionIdSignature), salt, []byte{0}, ciphertext), hmac1) {
+		return claims, ErrBrokenSessionId
+	}
+	data, err := openAESGCM(mlc.keys.sessionEncryption, ciphertext, []byte(encryptedSessionIdSignature))
+	if err != nil {
+		return claims, ErrBrokenSessionId
+	}
+	ss := &sessionSnapshot{}
+	if err = json.Unmarshal(data, ss); err != nil {
+		return claims, ErrInvalidSessionId
+	}
+	stale := false
+	if ss.ExpTime != 0 && mlc.isExpired(ss.ExpTime) {
+		if mlc.sessionGrace <= 0 || mlc.isExpired(ss.ExpTime+int(mlc.sessionGrace.Seconds())) {
+			ev := SessionExpiredEvent{SessionID: storedSessionHash(fullSessionId), UserID: ss.ID, CreatedAt: time.Unix(ss.IssuedAt, 0), ExpiredAt: time.Unix(int64(ss.ExpTime), 0), DetectedBy: SessionExpiryDetectedOnVerify}
+			mlc.sessionExpired(ev)
+			return claims, ErrExpiredSessionId
+		}
+		stale = true
+	}
+	if mlc.revocations != nil {
+		if err = mlc.checkRevocation(fullSessionId, ss.ID, ss.ExpTime); err != nil {
+			return claims, err
+		}
+	}
+	return sessionClaims{UserID: ss.ID, ExpTime: ss.ExpTime, Epoch: ss.Epoch, Stale: stale, IssuedAt: time.Unix(ss.IssuedAt, 0), Claims: ss.Claims, Snapshot: ss}, nil
+}
@@ -0,0 +1,198 @@
+package gomagiclink
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+const encryptedRecordVersion = "v1"
+const encryptionKeyLength = 32
+
+var ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+var ErrInvalidEncryptionKey = errors.New("invalid encryption key (must be 32 bytes)")
+var ErrBrokenEncryptedRecord = errors.New("broken encrypted record")
+var ErrNoRecordEncryptor = errors.New("record encryptor not set")
+
+// KeyProvider wraps and unwraps per-record data keys with a key encryption key (KEK).
+// Implement it to keep the KEK in a KMS; LocalKeyProvider keeps it in memory.
+type KeyProvider interface {
+	CurrentKeyID() string // ID of the KEK used to wrap new data keys
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// LocalKeyProvider is a KeyProvider holding the KEKs in memory. Old keys can be added
+// with AddKey() so that records encrypted with them can still be read during key rotation.
+type LocalKeyProvider struct {
+	currentKeyID string
+	keys         map[string][]byte
+}
+
+// NewLocalKeyProvider creates a LocalKeyProvider with the given 32-byte key as the current KEK.
+func NewLocalKeyProvider(keyID string, key []byte) (*LocalKeyProvider, error) {
+	lkp := &LocalKeyProvider{
+		currentKeyID: keyID,
+		keys:         map[string][]byte{},
+	}
+	return lkp, lkp.AddKey(keyID, key)
+}
+
+// NewLocalKeyProvider creates a LocalKeyProvider with a KEK derived from the controller's
+// secret key. The key ID is derived from the key, so changing the secret key changes the key ID.
+// Unless legacy keys are disabled (see WithoutLegacyKeys()), the KEK used before the key
+// schedule is added as an old key, so ReencryptRecords() can move the records to the new one.
+func (mlc *AuthMagicLinkController) NewLocalKeyProvider() *LocalKeyProvider {
+	lkp, _ := NewLocalKeyProvider(localKeyID(mlc.keys.recordKEK), mlc.keys.recordKEK)
+	if legacy := mlc.keys.legacyKey("record-encryption"); legacy != nil {
+		lkp.AddKey(localKeyID(legacy), legacy)
+	}
+	return lkp
+}
+
+func localKeyID(key []byte) string {
+	keyIDHash := sha256.Sum256(key)
+	return hex.EncodeToString(keyIDHash[:4])
+}
+
+// AddKey adds an additional KEK, which is used only for unwrapping data keys.
+func (lkp *LocalKeyProvider) AddKey(keyID string, key []byte) error {
+	if len(key) != encryptionKeyLength {
+		return ErrInvalidEncryptionKey
+	}
+	lkp.keys[keyID] = key
+	return nil
+}
+
+func (lkp *LocalKeyProvider) CurrentKeyID() string {
+	return lkp.currentKeyID
+}
+
+func (lkp *LocalKeyProvider) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	key, ok := lkp.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	return sealAESGCM(key, dataKey, []byte(keyID))
+}
+
+func (lkp *LocalKeyProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	key, ok := lkp.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	return openAESGCM(key, wrappedKey, []byte(keyID))
+}
+
+// RecordEncryptor implements envelope encryption of user records: each record is
+// encrypted with AES-GCM using a random data key, which is itself encrypted by the
+// KeyProvider. The encrypted record is a JSON document, so it can be stored in the
+// same places as the plain record, including JSONB columns.
+type RecordEncryptor struct {
+	kp KeyProvider
+}
+
+// encryptedRecord is the envelope stored instead of the plain JSON user record.
+type encryptedRecord struct {
+	Enc   string `json:"enc"` // Envelope version
+	KeyID string `json:"kid"` // ID of the KEK which wrapped the data key
+	Key   []byte `json:"key"` // Wrapped data key
+	Data  []byte `json:"data"`
+}
+
+func NewRecordEncryptor(kp KeyProvider) *RecordEncryptor {
+	return &RecordEncryptor{kp: kp}
+}
+
+// Encrypt encrypts the plain record.
+func (re *RecordEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, encryptionKeyLength)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keyID := re.kp.CurrentKeyID()
+	wrappedKey, err := re.kp.WrapKey(keyID, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := sealAESGCM(dataKey, plaintext, []byte(encryptedRecordVersion))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encryptedRecord{
+		Enc:   encryptedRecordVersion,
+		KeyID: keyID,
+		Key:   wrappedKey,
+		Data:  data,
+	})
+}
+
+// Decrypt decrypts a record encrypted by Encrypt(). Records which aren't encrypted
+// are returned as they are, so encryption can be enabled on existing storages.
+func (re *RecordEncryptor) Decrypt(data []byte) ([]byte, error) {
+	env, ok := parseEncryptedRecord(data)
+	if !ok {
+		return data, nil
+	}
+	dataKey, err := re.kp.UnwrapKey(env.KeyID, env.Key)
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(dataKey, env.Data, []byte(env.Enc))
+}
+
+// NeedsReencryption returns true if the record isn't encrypted, or isn't encrypted
+// with the current KEK. It's used by the storages' key rotation tooling.
+func (re *RecordEncryptor) NeedsReencryption(data []byte) bool {
+	env, ok := parseEncryptedRecord(data)
+	return !ok || env.KeyID != re.kp.CurrentKeyID()
+}
+
+func parseEncryptedRecord(data []byte) (env encryptedRecord, ok bool) {
+	if json.Unmarshal(data, &env) != nil || env.Enc != encryptedRecordVersion {
+		return env, false
+	}
+	return env, true
+}
+
+// sealAESGCM encrypts the plaintext, returning the nonce followed by the ciphertext.
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAESGCM(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrBrokenEncryptedRecord
+	}
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrBrokenEncryptedRecord
+	}
+	return plaintext, nil
+}
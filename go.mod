@@ -5,4 +5,5 @@ go 1.22.0
 require (
 	github.com/google/uuid v1.6.0
 	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/sync v0.10.0
 )
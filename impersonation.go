@@ -0,0 +1,109 @@
+package gomagiclink
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const impersonationSessionIdSignature = "I"
+
+var ErrImpersonationNotAllowed = errors.New("impersonation not allowed")
+
+// MaxImpersonationTTL is the longest validity of an impersonation session.
+const MaxImpersonationTTL = time.Hour
+
+// impersonatorPart returns the admin part of an impersonation session ID, with the
+// admin's TokenEpoch appended if it's not 0.
+func impersonatorPart(adminId uuid.UUID, epoch int) string {
+	if epoch == 0 {
+		return adminId.String()
+	}
+	return adminId.String() + sessionEpochSeparator + strconv.Itoa(epoch)
+}
+
+// parseImpersonatorPart parses the admin part of an impersonation session ID.
+func parseImpersonatorPart(s string) (adminId uuid.UUID, epoch int, err error) {
+	idStr, epochStr, found := strings.Cut(s, sessionEpochSeparator)
+	if adminId, err = parseTokenUUID(idStr); err != nil {
+		return
+	}
+	if found {
+		if epoch, err = strconv.Atoi(epochStr); err == nil && epoch <= 0 {
+			err = ErrInvalidSessionId
+		}
+	}
+	return
+}
+
+// impersonatorPayload returns the signed admin part of an impersonation session ID.
+func impersonatorPayload(adminId uuid.UUID, epoch int) []byte {
+	if epoch == 0 {
+		return adminId[:]
+	}
+	return slices.Concat(adminId[:], []byte(sessionEpochSeparator+strconv.Itoa(epoch)))
+}
+
+// GenerateImpersonationSession generates a session ID which lets adminUser act as
+// targetUser, e.g. for support staff to "view as user". The admin's ID is embedded
+// in the session ID and signed, and VerifySessionId() reports it in the ImpersonatedBy
+// field of the returned record. The admin needs to have a higher AccessLevel than the
+// target user, and the session expires after ttl, which can be at most
+// MaxImpersonationTTL. The admin is checked again whenever the session is verified, so
+// disabling, locking, deleting or demoting them ends the impersonation, as does
+// InvalidateUserTokens() on the admin, whose TokenEpoch is embedded too. Issuing and
+// using impersonation sessions is recorded in the audit log.
+func (mlc *AuthMagicLinkController) GenerateImpersonationSession(adminUser *AuthUserRecord, targetUser *AuthUserRecord, ttl time.Duration) (sessionId string, err error) {
+	// Impersonation session ID is in the format:
+	// SALT-USER_ID-EXPTIME-ADMIN-HMAC("I" || SALT || USER_ID || EXPTIME || ADMIN, sessionKey),
+	// where ADMIN is the admin's ID, and their TokenEpoch if it's not 0, as in EXPTIME
+	if !adminUser.Enabled || adminUser.IsLocked() || adminUser.ImpersonatedBy != uuid.Nil || adminUser.ID == targetUser.ID ||
+		adminUser.AccessLevel <= targetUser.AccessLevel || ttl <= 0 || ttl > MaxImpersonationTTL {
+		return "", ErrImpersonationNotAllowed
+	}
+	salt, err := mlc.newSalt()
+	if err != nil {
+		return
+	}
+	expTime := int(time.Now().Add(ttl).Unix())
+	expTimeStr := sessionExpTimePart(expTime, targetUser.TokenEpoch)
+
+	hmac := mlc.makeTokenHMAC(mlc.keys.session, slices.Concat([]byte(impersonationSessionIdSignature), salt, []byte{0}, targetUser.ID[:], []byte{0}, []byte(expTimeStr), []byte{0}, impersonatorPayload(adminUser.ID, adminUser.TokenEpoch)))
+
+	mlc.audit(AuditEvent{
+		Type:    AuditImpersonationIssued,
+		UserID:  targetUser.ID,
+		ActorID: adminUser.ID,
+		Email:   targetUser.Email,
+		Details: map[string]string{"admin_email": adminUser.Email, "expires": strconv.Itoa(expTime)},
+	})
+
+	return mlc.sealToken(strings.Join([]string{
+		impersonationSessionIdSignature + encodeToString(salt),
+		targetUser.ID.String(),
+		expTimeStr,
+		impersonatorPart(adminUser.ID, adminUser.TokenEpoch),
+		encodeToString(hmac),
+	}, sesionIdSplitChar)), nil
+}
+
+// checkImpersonator checks that the admin who issued the impersonation session can still
+// impersonate the user, and that their tokens weren't invalidated since, returning
+// ErrInvalidSessionId if they can't.
+func (mlc *AuthMagicLinkController) checkImpersonator(adminId uuid.UUID, adminEpoch int, user *AuthUserRecord) error {
+	admin, err := mlc.getUserById(adminId)
+	if err == ErrUserNotFound {
+		return ErrInvalidSessionId
+	}
+	if err != nil {
+		return err
+	}
+	if !admin.Enabled || admin.IsLocked() || admin.AccessLevel <= user.AccessLevel || admin.TokenEpoch != adminEpoch {
+		return ErrInvalidSessionId
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Package b32 is the base32 codec used in all gomagiclink tokens (challenges, session IDs,
+// invitations, URL signatures): the standard alphabet, without padding, so the encoded
+// strings only contain upper-case letters and digits, which never need escaping in URLs.
+package b32
+
+import (
+	"encoding/base32"
+	"strings"
+)
+
+// alphabet is the characters of the encoded strings.
+const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+var encoding = base32.NewEncoding(alphabet).WithPadding(base32.NoPadding)
+
+// EncodeToString encodes the bytes, without padding.
+func EncodeToString(b []byte) string {
+	return encoding.EncodeToString(b)
+}
+
+// AppendEncode appends the encoded bytes to dst, so tokens can be built in a single buffer.
+func AppendEncode(dst, b []byte) []byte {
+	return encoding.AppendEncode(dst, b)
+}
+
+// EncodedLen returns the length of the encoding of n bytes.
+func EncodedLen(n int) int {
+	return encoding.EncodedLen(n)
+}
+
+// unusedBits is the number of unused bits in the last character of an encoded string,
+// by its length modulo 8, or -1 if the length is invalid.
+var unusedBits = [8]int{0, -1, 2, -1, 4, 1, -1, 3}
+
+// check rejects strings which EncodeToString() couldn't have produced: with characters
+// outside the alphabet (including the line breaks the base32 package skips), invalid
+// lengths, or non-zero unused bits, so each token has a single encoding.
+func check(s string) error {
+	bits := unusedBits[len(s)%8]
+	if bits < 0 {
+		return base32.CorruptInputError(len(s))
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(alphabet, s[i]) < 0 {
+			return base32.CorruptInputError(i)
+		}
+	}
+	if bits > 0 && strings.IndexByte(alphabet, s[len(s)-1])&(1<<bits-1) != 0 {
+		return base32.CorruptInputError(len(s) - 1)
+	}
+	return nil
+}
+
+// DecodeString decodes a string produced by EncodeToString(). For compatibility with
+// tokens padded by other encoders, trailing "=" padding is ignored.
+func DecodeString(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if err := check(s); err != nil {
+		return nil, err
+	}
+	return encoding.DecodeString(s)
+}
+
+// AppendDecode appends the decoded string to dst, ignoring the padding like DecodeString().
+func AppendDecode(dst []byte, s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if err := check(s); err != nil {
+		return dst, err
+	}
+	return encoding.AppendDecode(dst, []byte(s))
+}
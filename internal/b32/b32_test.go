@@ -0,0 +1,61 @@
+package b32
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func FuzzEncodeDecode(f *testing.F) {
+	for _, seed := range []string{"", "f", "fo", "foo", "foob", "fooba", "foobar", "\x00\xff\x10"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s := EncodeToString(b)
+		if len(s) != EncodedLen(len(b)) {
+			t.Fatalf("EncodedLen(%d) = %d, encoded to %d characters", len(b), EncodedLen(len(b)), len(s))
+		}
+		if strings.Trim(s, alphabet) != "" {
+			t.Fatalf("%q encoded to %q, outside the alphabet", b, s)
+		}
+		decoded, err := DecodeString(s)
+		if err != nil {
+			t.Fatalf("DecodeString(%q): %v", s, err)
+		}
+		if !bytes.Equal(decoded, b) {
+			t.Fatalf("DecodeString(EncodeToString(%q)) = %q", b, decoded)
+		}
+		buf := AppendEncode([]byte("prefix"), b)
+		if string(buf) != "prefix"+s {
+			t.Fatalf("AppendEncode = %q, want %q", buf, "prefix"+s)
+		}
+		decoded, err = AppendDecode([]byte("prefix"), s+"=")
+		if err != nil {
+			t.Fatalf("AppendDecode(%q): %v", s+"=", err)
+		}
+		if !bytes.Equal(decoded, append([]byte("prefix"), b...)) {
+			t.Fatalf("AppendDecode = %q, want the prefix and %q", decoded, b)
+		}
+	})
+}
+
+// FuzzDecodeGarbage checks that only strings in the alphabet decode, and that what
+// decodes is encoded back to the same string, so no token has two encodings.
+func FuzzDecodeGarbage(f *testing.F) {
+	for _, seed := range []string{"", "MZXW6", "MZXW6===", "mzxw6", "MZXW6!", "MZ XW6", "MZX\nW6", "M", "MZX", "18", "MZXW6YQ=", "MZXW7", "MZXW6YR"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		decoded, err := DecodeString(s)
+		if err != nil {
+			return
+		}
+		trimmed := strings.TrimRight(s, "=")
+		if strings.Trim(trimmed, alphabet) != "" {
+			t.Fatalf("DecodeString(%q) accepted characters outside the alphabet", s)
+		}
+		if EncodeToString(decoded) != trimmed {
+			t.Fatalf("DecodeString(%q) = %q, which encodes differently", s, decoded)
+		}
+	})
+}
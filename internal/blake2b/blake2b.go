@@ -0,0 +1,158 @@
+// Package blake2b implements the BLAKE2b hash function (RFC 7693), including its keyed
+// mode, which is used as a MAC for gomagiclink tokens (see WithMACAlgorithm()). It's
+// a small, unoptimized implementation, so the module doesn't need golang.org/x/crypto.
+package blake2b
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/bits"
+)
+
+const (
+	BlockSize = 128
+	Size      = 64 // Maximum digest size
+	Size256   = 32
+	maxKeyLen = 64
+)
+
+var ErrInvalidKeySize = errors.New("blake2b: key longer than 64 bytes")
+var ErrInvalidSize = errors.New("blake2b: invalid digest size")
+
+var iv = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var sigma = [10][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+type digest struct {
+	h    [8]uint64
+	t    [2]uint64 // Byte counter
+	buf  [BlockSize]byte
+	nbuf int
+	size int
+	key  []byte
+}
+
+// New returns a BLAKE2b hash with the given digest size (1 to 64 bytes), keyed with
+// the key if it isn't empty.
+func New(size int, key []byte) (hash.Hash, error) {
+	if size < 1 || size > Size {
+		return nil, ErrInvalidSize
+	}
+	if len(key) > maxKeyLen {
+		return nil, ErrInvalidKeySize
+	}
+	d := &digest{size: size, key: append([]byte(nil), key...)}
+	d.Reset()
+	return d, nil
+}
+
+// New256 returns a BLAKE2b-256 hash, keyed with the key if it isn't empty.
+func New256(key []byte) (hash.Hash, error) {
+	return New(Size256, key)
+}
+
+func (d *digest) Reset() {
+	d.h = iv
+	d.h[0] ^= 0x01010000 ^ uint64(len(d.key))<<8 ^ uint64(d.size)
+	d.t = [2]uint64{}
+	d.buf = [BlockSize]byte{}
+	d.nbuf = 0
+	if len(d.key) > 0 {
+		// The key is padded to a full block, which is processed first
+		copy(d.buf[:], d.key)
+		d.nbuf = BlockSize
+	}
+}
+
+func (d *digest) Size() int      { return d.size }
+func (d *digest) BlockSize() int { return BlockSize }
+
+func (d *digest) Write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		// A full buffer is only compressed when more data follows, as the last block
+		// is compressed differently.
+		if d.nbuf == BlockSize {
+			d.addCounter(BlockSize)
+			compress(&d.h, &d.buf, d.t, false)
+			d.nbuf = 0
+		}
+		c := copy(d.buf[d.nbuf:], p)
+		d.nbuf += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	dd := *d
+	dd.addCounter(uint64(dd.nbuf))
+	clear(dd.buf[dd.nbuf:])
+	compress(&dd.h, &dd.buf, dd.t, true)
+	var out [Size]byte
+	for i, v := range dd.h {
+		binary.LittleEndian.PutUint64(out[i*8:], v)
+	}
+	return append(b, out[:d.size]...)
+}
+
+func (d *digest) addCounter(n uint64) {
+	var carry uint64
+	d.t[0], carry = bits.Add64(d.t[0], n, 0)
+	d.t[1] += carry
+}
+
+func compress(h *[8]uint64, block *[BlockSize]byte, t [2]uint64, last bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[i*8:])
+	}
+	var v [16]uint64
+	copy(v[:8], h[:])
+	copy(v[8:], iv[:])
+	v[12] ^= t[0]
+	v[13] ^= t[1]
+	if last {
+		v[14] = ^v[14]
+	}
+	for r := 0; r < 12; r++ {
+		s := &sigma[r%10]
+		g(&v, 0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(&v, 1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(&v, 2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(&v, 3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(&v, 0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(&v, 1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(&v, 2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(&v, 3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
+
+func g(v *[16]uint64, a, b, c, d int, x, y uint64) {
+	v[a] += v[b] + x
+	v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+	v[c] += v[d]
+	v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+	v[a] += v[b] + y
+	v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+	v[c] += v[d]
+	v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+}
@@ -0,0 +1,117 @@
+package blake2b
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func sum(t *testing.T, size int, key []byte, data []byte) []byte {
+	t.Helper()
+	h, err := New(size, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func TestKnownAnswers(t *testing.T) {
+	key := make([]byte, 64)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		name string
+		size int
+		key  []byte
+		data []byte
+		sum  string
+	}{
+		// RFC 7693, Appendix A
+		{"abc", 64, nil, []byte("abc"), "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"empty", 64, nil, nil, "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{"empty 256", 32, nil, nil, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		// The keyed test vectors of the reference implementation (blake2b-kat.txt)
+		{"keyed empty", 64, key, nil, "10ebb67700b1868efb4417987acf4690ae9d972fb7a590c2f02871799aaa4786b5e996e8f0f4eb981fc214b005f42d2ff4233499391653df7aefcbc13fc51568"},
+		{"keyed 1 byte", 64, key, []byte{0}, "961f6dd1e4dd30f63901690c512e78e4b45e4742ed197c3c5e45c549fd25f2e4187b0bc9fe30492b16b0d0bc4ef9b0f34c7003fac09a5ef1532e69430234cebd"},
+	} {
+		if got := sum(t, tc.size, tc.key, tc.data); !bytes.Equal(got, mustDecodeHex(t, tc.sum)) {
+			t.Errorf("%s: got %x, want %s", tc.name, got, tc.sum)
+		}
+	}
+}
+
+// selftestSeq is the deterministic input generator of the RFC 7693 self-test.
+func selftestSeq(n int, seed uint32) []byte {
+	out := make([]byte, n)
+	a, b := 0xDEAD4BAD*seed, uint32(1)
+	for i := range out {
+		t := a + b
+		a, b = b, t
+		out[i] = byte(t >> 24)
+	}
+	return out
+}
+
+// TestSelfTest runs the self-test of RFC 7693, Appendix E, which hashes inputs of various
+// lengths, with and without keys, into digests of various sizes.
+func TestSelfTest(t *testing.T) {
+	want := mustDecodeHex(t, "c23a7800d98123bd10f506c61e29da5603d763b8bbad2e737f5e765a7bccd475")
+	all, err := New(32, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, outLen := range []int{20, 32, 48, 64} {
+		for _, inLen := range []int{0, 3, 128, 129, 255, 1024} {
+			in := selftestSeq(inLen, uint32(inLen))
+			all.Write(sum(t, outLen, nil, in))
+			all.Write(sum(t, outLen, selftestSeq(outLen, uint32(outLen)), in))
+		}
+	}
+	if got := all.Sum(nil); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+// TestIncremental checks that writing the data in pieces, across block boundaries, gives
+// the same sum as writing it at once, and that Reset() starts over with the key.
+func TestIncremental(t *testing.T) {
+	data := selftestSeq(1000, 1)
+	key := []byte("key")
+	want := sum(t, 32, key, data)
+	h, err := New256(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 127, 128, 129, 255} {
+		h.Reset()
+		for i := 0; i < len(data); i += n {
+			h.Write(data[i:min(i+n, len(data))])
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			t.Errorf("written in pieces of %d: got %x, want %x", n, got, want)
+		}
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	if _, err := New(0, nil); err != ErrInvalidSize {
+		t.Errorf("New(0) = %v, want ErrInvalidSize", err)
+	}
+	if _, err := New(65, nil); err != ErrInvalidSize {
+		t.Errorf("New(65) = %v, want ErrInvalidSize", err)
+	}
+	if _, err := New(32, make([]byte, 65)); err != ErrInvalidKeySize {
+		t.Errorf("New() with a 65-byte key = %v, want ErrInvalidKeySize", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Package hkdf implements the HMAC-based key derivation function (RFC 5869) with
+// SHA-256, which gomagiclink uses to derive its purpose-bound keys from the secret key.
+// It's a small implementation, so the module doesn't need golang.org/x/crypto.
+package hkdf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// MaxLength is the maximum length of the output keying material.
+const MaxLength = 255 * sha256.Size
+
+var ErrInvalidLength = errors.New("hkdf: invalid output length")
+
+// Extract computes the pseudorandom key from the input keying material and the salt.
+func Extract(secret []byte, salt []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// Expand derives length bytes of output keying material from the pseudorandom key,
+// bound to the info string.
+func Expand(prk []byte, info []byte, length int) ([]byte, error) {
+	if length <= 0 || length > MaxLength {
+		return nil, ErrInvalidLength
+	}
+	mac := hmac.New(sha256.New, prk)
+	out := make([]byte, 0, length+sha256.Size)
+	var block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length], nil
+}
+
+// Key is Extract() followed by Expand().
+func Key(secret []byte, salt []byte, info []byte, length int) ([]byte, error) {
+	return Expand(Extract(secret, salt), info, length)
+}
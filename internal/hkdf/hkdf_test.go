@@ -0,0 +1,112 @@
+package hkdf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func seq(from, to int) []byte {
+	b := make([]byte, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The SHA-256 test cases from RFC 5869, Appendix A.
+func TestRFC5869(t *testing.T) {
+	tests := []struct {
+		name   string
+		ikm    []byte
+		salt   []byte
+		info   []byte
+		length int
+		prk    string
+		okm    string
+	}{
+		{
+			"A.1 basic",
+			bytes.Repeat([]byte{0x0b}, 22), seq(0x00, 0x0c), seq(0xf0, 0xf9), 42,
+			"077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5",
+			"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			"A.2 longer inputs and outputs",
+			seq(0x00, 0x4f), seq(0x60, 0xaf), seq(0xb0, 0xff), 82,
+			"06a6b88c5853361a06104c9ceb35b45cef760014904671014a193f40c15fc244",
+			"b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c19afa97c" +
+				"59045a99cac7827271cb41c65e590e09da3275600c2f09b8367793a9aca3db71" +
+				"cc30c58179ec3e87c14c01d5c1f3434f1d87",
+		},
+		{
+			"A.3 zero-length salt and info",
+			bytes.Repeat([]byte{0x0b}, 22), []byte{}, []byte{}, 42,
+			"19ef24a32c717b167f33a91d6f648bdf96596776afdb6377ac434c1c293ccb04",
+			"8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prk := Extract(tt.ikm, tt.salt)
+			if !bytes.Equal(prk, unhex(t, tt.prk)) {
+				t.Errorf("Extract() = %x, want %s", prk, tt.prk)
+			}
+			okm, err := Expand(prk, tt.info, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(okm, unhex(t, tt.okm)) {
+				t.Errorf("Expand() = %x, want %s", okm, tt.okm)
+			}
+			key, err := Key(tt.ikm, tt.salt, tt.info, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key, okm) {
+				t.Errorf("Key() = %x, want %x", key, okm)
+			}
+		})
+	}
+
+	// A missing salt is the same as a zero-length one, a string of HashLen zeros
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	if prk := Extract(ikm, nil); !bytes.Equal(prk, Extract(ikm, []byte{})) {
+		t.Errorf("Extract() without a salt = %x, want %x", prk, Extract(ikm, []byte{}))
+	}
+}
+
+func TestExpandLength(t *testing.T) {
+	prk := Extract([]byte("secret"), []byte("salt"))
+	for _, length := range []int{-1, 0, MaxLength + 1} {
+		if _, err := Expand(prk, nil, length); err != ErrInvalidLength {
+			t.Errorf("Expand() of %d bytes = %v, want ErrInvalidLength", length, err)
+		}
+	}
+	long, err := Expand(prk, []byte("info"), MaxLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(long) != MaxLength {
+		t.Fatalf("Expand() of MaxLength returned %d bytes", len(long))
+	}
+	// Shorter outputs are prefixes of the longer ones
+	for _, length := range []int{1, 31, 32, 33, 64, 100} {
+		okm, err := Expand(prk, []byte("info"), length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(okm, long[:length]) {
+			t.Errorf("Expand() of %d bytes isn't a prefix of the longer output", length)
+		}
+	}
+}
@@ -0,0 +1,631 @@
+// Package msgpack implements the subset of MessagePack needed for gomagiclink's user
+// records: structs are encoded as maps keyed by their JSON field names (honouring the
+// "-" and "omitempty" options), so the encoding follows the JSON one, and time.Time is
+// encoded with the timestamp extension type. It's a small implementation, so the module
+// doesn't need an external MessagePack library.
+package msgpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTruncated = errors.New("msgpack: truncated data")
+
+const timestampExt int8 = -1
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Marshal returns the MessagePack encoding of v.
+func Marshal(v any) ([]byte, error) {
+	e := encoder{buf: make([]byte, 0, 256)}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Unmarshal decodes the MessagePack data into the value pointed to by v. Map keys
+// which don't match a struct field are skipped.
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+	d := decoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: trailing data")
+	}
+	return nil
+}
+
+// field is a struct field, as encoded.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []field
+
+// structFields returns the encoded fields of the struct type, following the JSON tags.
+func structFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.encodeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.encodeBytes(b)
+			return nil
+		}
+		e.encodeHeader(v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		e.encodeHeader(v.Len(), 0x80, 0xde, 0xdf)
+		iter := v.MapRange()
+		for iter.Next() {
+			e.encodeString(iter.Key().String())
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		n := 0
+		for _, f := range fields {
+			if !f.omitEmpty || !v.Field(f.index).IsZero() {
+				n++
+			}
+		}
+		e.encodeHeader(n, 0x80, 0xde, 0xdf)
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			e.encodeString(f.name)
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *encoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(i))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(i))
+	}
+}
+
+func (e *encoder) encodeUint(u uint64) {
+	switch {
+	case u < 128:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(u))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), u)
+	}
+}
+
+// encodeHeader writes the header of a string, array or map: the fixed form if the
+// length fits into its low bits, or the 16- or 32-bit form.
+func (e *encoder) encodeHeader(n int, fix byte, code16 byte, code32 byte) {
+	fixMax := 15
+	if fix == 0xa0 {
+		fixMax = 31
+	}
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, code16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, code32), uint32(n))
+	}
+}
+
+func (e *encoder) encodeString(s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		e.buf = append(e.buf, 0xd9, byte(len(s)))
+	} else {
+		e.encodeHeader(len(s), 0xa0, 0xda, 0xdb)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) encodeBytes(b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xc5), uint16(len(b)))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xc6), uint32(len(b)))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+// encodeTime writes the timestamp 96 extension (nanoseconds and signed seconds), which
+// covers the zero time.Time.
+func (e *encoder) encodeTime(t time.Time) {
+	e.buf = append(e.buf, 0xc7, 12, 0xff) // ext 8, 12 bytes, type -1
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Nanosecond()))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(t.Unix()))
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, ErrTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLength reads a big-endian length of the given size in bytes.
+func (d *decoder) readLength(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// lengthSizes are the sizes of the length fields of the variable-length types.
+var lengthSizes = map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4, 0xdc: 2, 0xdd: 4, 0xde: 2, 0xdf: 4, 0xc7: 1, 0xc8: 2, 0xc9: 4}
+
+// value is a decoded scalar or a container header.
+type value struct {
+	kind   byte // 'n'il, 'b'ool, 'i'nt, 'u'int, 'f'loat, 's'tring, 'y' bytes, 'a'rray, 'm'ap, 'e'xt
+	b      bool
+	i      int64
+	u      uint64
+	f      float64
+	bytes  []byte // For strings, bytes and extensions
+	n      int    // Number of array elements or map pairs
+	extTyp int8
+}
+
+// read reads the next value; for arrays and maps, only the header. Arrays and maps with
+// more elements than the remaining bytes are rejected as truncated before the elements
+// are allocated, as each element takes at least a byte.
+func (d *decoder) read() (v value, err error) {
+	if v, err = d.readValue(); err != nil {
+		return v, err
+	}
+	n := v.n
+	if v.kind == 'm' {
+		n *= 2
+	}
+	if n > len(d.data)-d.pos {
+		return v, ErrTruncated
+	}
+	return v, nil
+}
+
+func (d *decoder) readValue() (v value, err error) {
+	c, err := d.readByte()
+	if err != nil {
+		return v, err
+	}
+	switch {
+	case c <= 0x7f:
+		return value{kind: 'u', u: uint64(c)}, nil
+	case c >= 0xe0:
+		return value{kind: 'i', i: int64(int8(c))}, nil
+	case c&0xf0 == 0x80:
+		return value{kind: 'm', n: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x90:
+		return value{kind: 'a', n: int(c & 0x0f)}, nil
+	case c&0xe0 == 0xa0:
+		v.kind = 's'
+		v.bytes, err = d.next(int(c & 0x1f))
+		return v, err
+	}
+	switch c {
+	case 0xc0:
+		v.kind = 'n'
+	case 0xc2, 0xc3:
+		v.kind, v.b = 'b', c == 0xc3
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		n, err := d.readLength(lengthSizes[c])
+		if err != nil {
+			return v, err
+		}
+		v.kind = 'y'
+		if c >= 0xd9 {
+			v.kind = 's'
+		}
+		v.bytes, err = d.next(n)
+		return v, err
+	case 0xdc, 0xdd:
+		v.kind = 'a'
+		v.n, err = d.readLength(lengthSizes[c])
+	case 0xde, 0xdf:
+		v.kind = 'm'
+		v.n, err = d.readLength(lengthSizes[c])
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return v, err
+		}
+		v.kind, v.u = 'u', beUint(b)
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		b, err := d.next(1 << (c - 0xd0))
+		if err != nil {
+			return v, err
+		}
+		u := beUint(b)
+		shift := 64 - 8*len(b)
+		v.kind, v.i = 'i', int64(u<<shift)>>shift
+	case 0xca:
+		b, err := d.next(4)
+		if err != nil {
+			return v, err
+		}
+		v.kind, v.f = 'f', float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 0xcb:
+		b, err := d.next(8)
+		if err != nil {
+			return v, err
+		}
+		v.kind, v.f = 'f', math.Float64frombits(binary.BigEndian.Uint64(b))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+		n := 1 << (c - 0xd4)
+		if c >= 0xc7 && c <= 0xc9 {
+			if n, err = d.readLength(lengthSizes[c]); err != nil {
+				return v, err
+			}
+		}
+		t, err := d.readByte()
+		if err != nil {
+			return v, err
+		}
+		v.kind, v.extTyp = 'e', int8(t)
+		v.bytes, err = d.next(n)
+		return v, err
+	default:
+		return v, fmt.Errorf("msgpack: unknown type code 0x%02x", c)
+	}
+	return v, err
+}
+
+func beUint(b []byte) (u uint64) {
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u
+}
+
+// skip skips the rest of the value, for containers.
+func (d *decoder) skip(v value) error {
+	n := v.n
+	if v.kind == 'm' {
+		n *= 2
+	} else if v.kind != 'a' {
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		child, err := d.read()
+		if err != nil {
+			return err
+		}
+		if err = d.skip(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) decode(rv reflect.Value) error {
+	v, err := d.read()
+	if err != nil {
+		return err
+	}
+	return d.decodeValue(v, rv)
+}
+
+func (d *decoder) decodeValue(v value, rv reflect.Value) error {
+	if v.kind == 'n' {
+		rv.SetZero()
+		return nil
+	}
+	if rv.Type() == timeType {
+		if v.kind != 'e' || v.extTyp != timestampExt {
+			return d.mismatch(v, rv)
+		}
+		t, err := decodeTime(v.bytes)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		if v.kind != 'b' {
+			return d.mismatch(v, rv)
+		}
+		rv.SetBool(v.b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := v.i
+		switch v.kind {
+		case 'i':
+		case 'u':
+			if v.u > math.MaxInt64 {
+				return d.mismatch(v, rv)
+			}
+			i = int64(v.u)
+		default:
+			return d.mismatch(v, rv)
+		}
+		if rv.OverflowInt(i) {
+			return d.mismatch(v, rv)
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.kind != 'u' || rv.OverflowUint(v.u) {
+			return d.mismatch(v, rv)
+		}
+		rv.SetUint(v.u)
+	case reflect.Float32, reflect.Float64:
+		switch v.kind {
+		case 'f':
+			rv.SetFloat(v.f)
+		case 'i':
+			rv.SetFloat(float64(v.i))
+		case 'u':
+			rv.SetFloat(float64(v.u))
+		default:
+			return d.mismatch(v, rv)
+		}
+	case reflect.String:
+		if v.kind != 's' {
+			return d.mismatch(v, rv)
+		}
+		rv.SetString(string(v.bytes))
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.decodeValue(v, rv.Elem())
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			if v.kind != 'y' && v.kind != 's' {
+				return d.mismatch(v, rv)
+			}
+			rv.SetBytes(append([]byte{}, v.bytes...))
+			return nil
+		}
+		if v.kind != 'a' {
+			return d.mismatch(v, rv)
+		}
+		s := reflect.MakeSlice(rv.Type(), v.n, v.n)
+		for i := 0; i < v.n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(s)
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			if v.kind != 'y' || len(v.bytes) != rv.Len() {
+				return d.mismatch(v, rv)
+			}
+			reflect.Copy(rv, reflect.ValueOf(v.bytes))
+			return nil
+		}
+		if v.kind != 'a' || v.n != rv.Len() {
+			return d.mismatch(v, rv)
+		}
+		for i := 0; i < v.n; i++ {
+			if err := d.decode(rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.kind != 'm' || rv.Type().Key().Kind() != reflect.String {
+			return d.mismatch(v, rv)
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), v.n)
+		for i := 0; i < v.n; i++ {
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err = d.decode(elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), elem)
+		}
+		rv.Set(m)
+	case reflect.Struct:
+		if v.kind != 'm' {
+			return d.mismatch(v, rv)
+		}
+		fields := structFields(rv.Type())
+		for i := 0; i < v.n; i++ {
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			idx := -1
+			for _, f := range fields {
+				if f.name == key {
+					idx = f.index
+					break
+				}
+			}
+			if idx < 0 {
+				child, err := d.read()
+				if err != nil {
+					return err
+				}
+				if err = d.skip(child); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = d.decode(rv.Field(idx)); err != nil {
+				return err
+			}
+		}
+	default:
+		return d.mismatch(v, rv)
+	}
+	return nil
+}
+
+func (d *decoder) readString() (string, error) {
+	v, err := d.read()
+	if err != nil {
+		return "", err
+	}
+	if v.kind != 's' {
+		return "", errors.New("msgpack: map key isn't a string")
+	}
+	return string(v.bytes), nil
+}
+
+func (d *decoder) mismatch(v value, rv reflect.Value) error {
+	return fmt.Errorf("msgpack: can't decode %q value into %s", v.kind, rv.Type())
+}
+
+// decodeTime decodes the timestamp extension, in any of its 32-, 64- and 96-bit forms.
+func decodeTime(b []byte) (time.Time, error) {
+	switch len(b) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0).UTC(), nil
+	case 8:
+		u := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(u&0x3ffffffff), int64(u>>34)).UTC(), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(binary.BigEndian.Uint32(b))).UTC(), nil
+	}
+	return time.Time{}, errors.New("msgpack: invalid timestamp")
+}
@@ -0,0 +1,224 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testInner struct {
+	Name  string `json:"name"`
+	Value int    `json:"value,omitempty"`
+}
+
+type testRecord struct {
+	ID       [4]byte           `json:"id"`
+	Enabled  bool              `json:"enabled"`
+	Level    int               `json:"level"`
+	Small    int8              `json:"small"`
+	Count    uint32            `json:"count"`
+	Big      uint64            `json:"big"`
+	Ratio    float64           `json:"ratio"`
+	Email    string            `json:"email"`
+	Secret   []byte            `json:"secret,omitempty"`
+	Tags     []string          `json:"tags"`
+	Data     map[string]string `json:"data"`
+	Inner    testInner         `json:"inner"`
+	Items    []testInner       `json:"items,omitempty"`
+	Ptr      *testInner        `json:"ptr"`
+	Created  time.Time         `json:"created"`
+	Zero     time.Time         `json:"zero"`
+	Skipped  string            `json:"-"`
+	Untagged string
+	private  string
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, rec := range []testRecord{
+		{},
+		{
+			ID:       [4]byte{1, 2, 3, 4},
+			Enabled:  true,
+			Level:    -100000,
+			Small:    -5,
+			Count:    70000,
+			Big:      math.MaxUint64,
+			Ratio:    -1.5,
+			Email:    strings.Repeat("x", 40) + "@example.com",
+			Secret:   bytes.Repeat([]byte{0xab}, 300),
+			Tags:     []string{"a", "", strings.Repeat("long", 20000)},
+			Data:     map[string]string{"k": "v", "": "empty key"},
+			Inner:    testInner{Name: "inner", Value: 7},
+			Items:    make([]testInner, 20),
+			Ptr:      &testInner{Name: "ptr"},
+			Created:  time.Date(2026, 10, 18, 12, 30, 15, 123456789, time.UTC),
+			Untagged: "untagged",
+		},
+		{Level: math.MinInt64, Small: math.MinInt8, Count: math.MaxUint32, Ratio: math.Inf(1), Created: time.Unix(-1e10, 1).UTC()},
+	} {
+		data, err := Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got testRecord
+		if err = Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(Marshal(%+v)): %v", rec, err)
+		}
+		if !reflect.DeepEqual(got, rec) {
+			t.Errorf("Unmarshal(Marshal()) = %+v, want %+v", got, rec)
+		}
+	}
+}
+
+func TestIgnoredFields(t *testing.T) {
+	data, err := Marshal(testRecord{Skipped: "skipped", private: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("skipped")) || bytes.Contains(data, []byte("private")) {
+		t.Errorf("ignored fields encoded: %x", data)
+	}
+	if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("items")) {
+		t.Errorf("empty omitempty fields encoded: %x", data)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		v    any
+		want string
+	}{
+		{nil, "c0"},
+		{false, "c2"},
+		{true, "c3"},
+		{0, "00"},
+		{127, "7f"},
+		{128, "cc80"},
+		{256, "cd0100"},
+		{65536, "ce00010000"},
+		{int64(1) << 32, "cf0000000100000000"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0df"},
+		{-129, "d1ff7f"},
+		{-32769, "d2ffff7fff"},
+		{int64(math.MinInt64), "d38000000000000000"},
+		{1.5, "cb3ff8000000000000"},
+		{"", "a0"},
+		{"abc", "a3616263"},
+		{strings.Repeat("a", 32), "d920" + strings.Repeat("61", 32)},
+		{[]byte{1, 2}, "c4020102"},
+		{[]int{1, 2}, "920102"},
+		{map[string]int{"a": 1}, "81a16101"},
+		{testInner{Name: "n"}, "81a46e616d65a16e"},
+		{time.Unix(1, 2).UTC(), "c70cff000000020000000000000001"},
+	} {
+		data, err := Marshal(tc.v)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", tc.v, err)
+		}
+		if got := hex.EncodeToString(data); got != tc.want {
+			t.Errorf("Marshal(%#v) = %s, want %s", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeOtherEncodings(t *testing.T) {
+	mustDecodeHex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var i int
+	if err := Unmarshal(mustDecodeHex("d10005"), &i); err != nil || i != 5 {
+		t.Errorf("int16 5 = %d, %v", i, err)
+	}
+	var f float64
+	if err := Unmarshal(mustDecodeHex("ca3fc00000"), &f); err != nil || f != 1.5 {
+		t.Errorf("float32 1.5 = %v, %v", f, err)
+	}
+	var s string
+	if err := Unmarshal(mustDecodeHex("da0003616263"), &s); err != nil || s != "abc" {
+		t.Errorf("str16 = %q, %v", s, err)
+	}
+	var tm time.Time
+	if err := Unmarshal(mustDecodeHex("d6ff00000001"), &tm); err != nil || !tm.Equal(time.Unix(1, 0)) {
+		t.Errorf("timestamp 32 = %v, %v", tm, err)
+	}
+	if err := Unmarshal(mustDecodeHex("d7ff0000000800000001"), &tm); err != nil || !tm.Equal(time.Unix(1, 2)) {
+		t.Errorf("timestamp 64 = %v, %v", tm, err)
+	}
+	// Unknown keys are skipped, including containers
+	var inner testInner
+	if err := Unmarshal(mustDecodeHex("82a178920181a17801a46e616d65a16e"), &inner); err != nil || inner.Name != "n" {
+		t.Errorf("record with an unknown key = %+v, %v", inner, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var rec testRecord
+	if err := Unmarshal([]byte{0xc0}, rec); err == nil {
+		t.Error("Unmarshal() into a non-pointer succeeded")
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		v    any
+	}{
+		{"empty", nil, new(int)},
+		{"trailing data", []byte{0x01, 0x02}, new(int)},
+		{"unknown type code", []byte{0xc1}, new(int)},
+		{"type mismatch", []byte{0xa1, 'x'}, new(int)},
+		{"overflow", []byte{0xcd, 0x01, 0x00}, new(int8)},
+		{"negative into unsigned", []byte{0xff}, new(uint)},
+		{"map key isn't a string", []byte{0x81, 0x01, 0x01}, new(map[string]int)},
+		{"invalid timestamp", []byte{0xd5, 0xff, 0x00, 0x00}, new(time.Time)},
+		{"byte array length", []byte{0xc4, 0x01, 0x00}, new([4]byte)},
+		{"huge array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, new([]int)},
+		{"huge map", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}, new(map[string]int)},
+		{"huge string", []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, new(string)},
+	} {
+		if err := Unmarshal(tc.data, tc.v); err == nil {
+			t.Errorf("%s: Unmarshal(%x) succeeded", tc.name, tc.data)
+		}
+	}
+}
+
+// TestTruncated checks that every truncation of an encoded record, and every corrupted
+// byte, is rejected with an error and never panics.
+func TestTruncated(t *testing.T) {
+	data, err := Marshal(testRecord{
+		ID: [4]byte{1, 2, 3, 4}, Level: 1000, Email: "user@example.com", Secret: []byte("secret"),
+		Tags: []string{"a", "b"}, Data: map[string]string{"k": "v"}, Items: []testInner{{Name: "x"}},
+		Ptr: &testInner{Name: "p"}, Created: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		var rec testRecord
+		err := Unmarshal(data[:n], &rec)
+		if err == nil {
+			t.Fatalf("Unmarshal() of the first %d of %d bytes succeeded", n, len(data))
+		}
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("Unmarshal() of the first %d of %d bytes: %v, want ErrTruncated", n, len(data), err)
+		}
+	}
+	corrupted := make([]byte, len(data))
+	for i := range data {
+		for _, c := range []byte{0x00, 0x7f, 0x80, 0x9f, 0xc1, 0xc7, 0xd9, 0xdc, 0xdd, 0xde, 0xdf, 0xff} {
+			copy(corrupted, data)
+			corrupted[i] = c
+			var rec testRecord
+			Unmarshal(corrupted, &rec) // Mustn't panic
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The format information strings of ISO/IEC 18004, Table C.1, by level and mask.
+var testFormatStrings = map[Level][8]string{
+	LevelL: {"111011111000100", "111001011110011", "111110110101010", "111100010011101", "110011000101111", "110001100011000", "110110001000001", "110100101110110"},
+	LevelM: {"101010000010010", "101000100100101", "101111001111100", "101101101001011", "100010111111001", "100000011001110", "100111110010111", "100101010100000"},
+}
+
+// TestReedSolomon checks the error correction of the "HELLO WORLD" 1-M example.
+func TestReedSolomon(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsGenerator(10)); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder() = %v, want %v", got, want)
+	}
+	if got := addErrorCorrection(data, 1, LevelM); !bytes.Equal(got, append(data, want...)) {
+		t.Errorf("addErrorCorrection() = %v, want the data and %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	for level, strs := range testFormatStrings {
+		for mask, want := range strs {
+			c := &Code{Size: 21, modules: make([]bool, 21*21), function: make([]bool, 21*21)}
+			c.drawFormatBits(level, mask)
+			first, second := readFormat(c)
+			if first != want || second != want {
+				t.Errorf("level %d, mask %d: format %s and %s, want %s", level, mask, first, second, want)
+			}
+		}
+	}
+}
+
+// readFormat reads both copies of the format information, most significant bit first.
+func readFormat(c *Code) (first string, second string) {
+	var a, b [15]byte
+	for i := 0; i < 15; i++ {
+		var x, y int
+		switch {
+		case i <= 5:
+			x, y = 8, i
+		case i == 6:
+			x, y = 8, 7
+		case i == 7:
+			x, y = 8, 8
+		case i == 8:
+			x, y = 7, 8
+		default:
+			x, y = 14-i, 8
+		}
+		a[14-i] = bit(c.Dark(x, y))
+		if i < 8 {
+			x, y = c.Size-1-i, 8
+		} else {
+			x, y = 8, c.Size-15+i
+		}
+		b[14-i] = bit(c.Dark(x, y))
+	}
+	return string(a[:]), string(b[:])
+}
+
+func bit(dark bool) byte {
+	if dark {
+		return '1'
+	}
+	return '0'
+}
+
+func TestVersionInformation(t *testing.T) {
+	// ISO/IEC 18004, Table D.1
+	for version, want := range map[int]string{7: "000111110010010100", 21: "010101011010000011", 40: "101000110001101001"} {
+		size := version*4 + 17
+		c := &Code{Size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+		c.drawFunctionPatterns(version)
+		var got [18]byte
+		for i := 0; i < 18; i++ {
+			a, b := size-11+i%3, i/3
+			if c.Dark(a, b) != c.Dark(b, a) {
+				t.Errorf("version %d: the two copies of the version information differ at bit %d", version, i)
+			}
+			got[17-i] = bit(c.Dark(a, b))
+		}
+		if string(got[:]) != want {
+			t.Errorf("version %d: version information %s, want %s", version, got, want)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	for _, tc := range []struct {
+		level   Level
+		n       int
+		version int // 0 if too long
+	}{
+		{LevelL, 0, 1},
+		{LevelL, 17, 1},
+		{LevelL, 18, 2},
+		{LevelM, 14, 1},
+		{LevelM, 15, 2},
+		{LevelL, 230, 9},
+		{LevelL, 231, 10}, // The length needs 16 bits from version 10
+		{LevelL, 271, 10},
+		{LevelL, 272, 11},
+		{LevelL, 2953, 40},
+		{LevelL, 2954, 0},
+		{LevelM, 2331, 40},
+		{LevelM, 2332, 0},
+	} {
+		c, err := Encode(bytes.Repeat([]byte{'a'}, tc.n), tc.level)
+		if tc.version == 0 {
+			if err != ErrDataTooLong {
+				t.Errorf("level %d, %d bytes: %v, want ErrDataTooLong", tc.level, tc.n, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("level %d, %d bytes: %v", tc.level, tc.n, err)
+		}
+		if want := tc.version*4 + 17; c.Size != want {
+			t.Errorf("level %d, %d bytes: size %d, want %d (version %d)", tc.level, tc.n, c.Size, want, tc.version)
+		}
+	}
+}
+
+// TestStructure checks the function patterns of encoded codes, and that the format
+// information names a valid level and mask.
+func TestStructure(t *testing.T) {
+	for _, n := range []int{1, 20, 100, 500} {
+		for _, level := range []Level{LevelL, LevelM} {
+			c, err := Encode(bytes.Repeat([]byte{'x'}, n), level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := fmt.Sprintf("%d bytes, level %d", n, level)
+			for _, corner := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+				for dy := -1; dy <= 7; dy++ {
+					for dx := -1; dx <= 7; dx++ {
+						x, y := corner[0]+dx, corner[1]+dy
+						if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+							continue
+						}
+						dist := max(abs(dx-3), abs(dy-3))
+						if want := dist != 2 && dist <= 3; c.Dark(x, y) != want {
+							t.Fatalf("%s: finder pattern module (%d, %d) dark %v, want %v", name, x, y, !want, want)
+						}
+					}
+				}
+			}
+			for i := 8; i < c.Size-8; i++ {
+				if c.Dark(i, 6) != (i%2 == 0) || c.Dark(6, i) != (i%2 == 0) {
+					t.Fatalf("%s: timing pattern module %d", name, i)
+				}
+			}
+			if !c.Dark(8, c.Size-8) {
+				t.Errorf("%s: the dark module is light", name)
+			}
+			first, second := readFormat(c)
+			if first != second {
+				t.Errorf("%s: format information copies %s and %s differ", name, first, second)
+			}
+			if formats := testFormatStrings[level]; !strings.Contains(strings.Join(formats[:], " "), first) {
+				t.Errorf("%s: format information %s isn't one of level %d", name, first, level)
+			}
+		}
+	}
+}
+
+// TestDecode reads the data back from codes with a single error correction block.
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		level Level
+	}{
+		{"HELLO WORLD", LevelM},
+		{"https://example.com/verify?c=ABC", LevelL},
+		{"", LevelL},
+		{"\x00\xff binary", LevelM},
+	} {
+		c, err := Encode([]byte(tc.data), tc.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version := (c.Size - 17) / 4
+		if eccBlocks[tc.level][version] != 1 {
+			t.Fatalf("%q: %d blocks", tc.data, eccBlocks[tc.level][version])
+		}
+		format, _ := readFormat(c)
+		mask := -1
+		for m, s := range testFormatStrings[tc.level] {
+			if s == format {
+				mask = m
+			}
+		}
+		if mask < 0 {
+			t.Fatalf("%q: unknown format %s", tc.data, format)
+		}
+
+		unmasked := &Code{Size: c.Size, modules: append([]bool(nil), c.modules...), function: c.function}
+		unmasked.applyMask(mask)
+		codewords := unmasked.readCodewords(rawDataModules(version) / 8)
+		numData := dataCodewords(version, tc.level)
+		data, ecc := codewords[:numData], codewords[numData:]
+		if want := rsRemainder(data, rsGenerator(len(ecc))); !bytes.Equal(ecc, want) {
+			t.Errorf("%q: error correction codewords %v, want %v", tc.data, ecc, want)
+		}
+
+		var bb bitReader
+		bb.bytes = data
+		if mode := bb.read(4); mode != 0b0100 {
+			t.Fatalf("%q: mode %04b, want byte mode", tc.data, mode)
+		}
+		n := bb.read(8)
+		got := make([]byte, n)
+		for i := range got {
+			got[i] = byte(bb.read(8))
+		}
+		if string(got) != tc.data {
+			t.Errorf("decoded %q, want %q", got, tc.data)
+		}
+		if terminator := bb.read(4); terminator != 0 {
+			t.Errorf("%q: terminator %04b", tc.data, terminator)
+		}
+		pad := data[(bb.n+7)/8:]
+		for i, b := range pad {
+			if want := []byte{0xec, 0x11}[i%2]; b != want {
+				t.Errorf("%q: padding %x, want alternating ec, 11", tc.data, pad)
+				break
+			}
+		}
+	}
+}
+
+// readCodewords reads the codewords in the order drawCodewords() places them.
+func (c *Code) readCodewords(n int) []byte {
+	data := make([]byte, n)
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.function[y*c.Size+x] && i < n*8 {
+					if c.modules[y*c.Size+x] {
+						data[i/8] |= 0x80 >> (i % 8)
+					}
+					i++
+				}
+			}
+		}
+	}
+	return data
+}
+
+type bitReader struct {
+	bytes []byte
+	n     int
+}
+
+func (br *bitReader) read(bits int) (v int) {
+	for i := 0; i < bits; i++ {
+		v = v<<1 | int(br.bytes[br.n/8]>>(7-br.n%8)&1)
+		br.n++
+	}
+	return v
+}
@@ -0,0 +1,320 @@
+// Package toml implements the subset of TOML needed for gomagiclink's config files:
+// tables ("[a.b]"), bare, quoted and dotted keys, basic and literal strings, integers,
+// floats, booleans, arrays of those (which can span lines), and comments. Arrays of
+// tables, inline tables, multi-line strings and dates aren't supported, and are reported
+// as errors. Like the yaml package, the document is converted to JSON, so it can be
+// decoded into the same structs as JSON files, without an external TOML library.
+package toml
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("unsupported TOML syntax")
+
+type parser struct {
+	root  map[string]any
+	table map[string]any // The table the key/value pairs go into
+	// tables are the tables defined with headers, which can't be defined again
+	tables map[string]bool
+}
+
+// ToJSON converts the TOML document to a JSON object. Integers and floats are converted
+// to JSON numbers.
+func ToJSON(data []byte) ([]byte, error) {
+	v, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the TOML document into map[string]any, []any, string, bool, int64
+// and float64 values.
+func Unmarshal(data []byte) (map[string]any, error) {
+	p := &parser{root: map[string]any{}, tables: map[string]bool{}}
+	p.table = p.root
+	lines := strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n")
+	for i := 0; i < len(lines); i++ {
+		num := i + 1
+		text, err := stripComment(strings.TrimRight(lines[i], "\r"))
+		if err != nil {
+			return nil, errorf(num, "%v", err)
+		}
+		text = strings.TrimSpace(text)
+		// Arrays can continue on the following lines, until the brackets are closed
+		for text != "" && !strings.HasPrefix(text, "[") && unclosedBrackets(text) > 0 && i+1 < len(lines) {
+			i++
+			more, err := stripComment(strings.TrimRight(lines[i], "\r"))
+			if err != nil {
+				return nil, errorf(i+1, "%v", err)
+			}
+			text += " " + strings.TrimSpace(more)
+		}
+		if text == "" {
+			continue
+		}
+		if err = p.line(text); err != nil {
+			return nil, errorf(num, "%v", err)
+		}
+	}
+	return p.root, nil
+}
+
+func errorf(num int, format string, args ...any) error {
+	return fmt.Errorf("toml: line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+// line parses a table header or a key/value pair.
+func (p *parser) line(text string) error {
+	if strings.HasPrefix(text, "[[") {
+		return fmt.Errorf("%w: arrays of tables", ErrUnsupported)
+	}
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return errors.New("unterminated table header")
+		}
+		keys, rest, err := parseKey(text[1 : len(text)-1])
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return errors.New("unexpected text in the table header")
+		}
+		name := strings.Join(keys, "\x00")
+		if p.tables[name] {
+			return fmt.Errorf("table %q defined twice", strings.Join(keys, "."))
+		}
+		p.tables[name] = true
+		p.table, err = subtable(p.root, keys)
+		return err
+	}
+	keys, rest, err := parseKey(text)
+	if err != nil {
+		return err
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "=") {
+		return errors.New("expected \"=\" after the key")
+	}
+	v, err := value(strings.TrimSpace(rest[1:]))
+	if err != nil {
+		return err
+	}
+	table, err := subtable(p.table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	if _, ok := table[key]; ok {
+		return fmt.Errorf("key %q defined twice", strings.Join(keys, "."))
+	}
+	table[key] = v
+	return nil
+}
+
+// subtable returns the table at the path of keys under the table, creating the missing
+// ones.
+func subtable(table map[string]any, keys []string) (map[string]any, error) {
+	for _, key := range keys {
+		switch v := table[key].(type) {
+		case nil:
+			sub := map[string]any{}
+			table[key] = sub
+			table = sub
+		case map[string]any:
+			table = v
+		default:
+			return nil, fmt.Errorf("key %q is already a value, not a table", key)
+		}
+	}
+	return table, nil
+}
+
+var bareKeyRe = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+
+// parseKey parses a (possibly dotted) key at the start of s, returning its parts and the
+// rest of s.
+func parseKey(s string) (keys []string, rest string, err error) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		var key string
+		switch {
+		case s == "":
+			return nil, "", errors.New("missing key")
+		case s[0] == '"' || s[0] == '\'':
+			end := quotedEnd(s)
+			if end < 0 {
+				return nil, "", errors.New("unterminated quoted key")
+			}
+			v, err := value(s[:end])
+			if err != nil {
+				return nil, "", err
+			}
+			key, s = v.(string), s[end:]
+		default:
+			key = bareKeyRe.FindString(s)
+			if key == "" {
+				return nil, "", fmt.Errorf("invalid key at %q", s)
+			}
+			s = s[len(key):]
+		}
+		keys = append(keys, key)
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ".") {
+			return keys, s, nil
+		}
+		s = s[1:]
+	}
+}
+
+// stripComment removes the comment from the line, i.e. everything from a "#" outside of
+// strings.
+func stripComment(s string) (string, error) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			if strings.HasPrefix(s[i:], `"""`) || strings.HasPrefix(s[i:], "'''") {
+				return "", fmt.Errorf("%w: multi-line strings", ErrUnsupported)
+			}
+			quote = c
+		case c == '#':
+			return s[:i], nil
+		}
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated string")
+	}
+	return s, nil
+}
+
+// unclosedBrackets returns the number of "[" in s, outside of strings, which aren't
+// closed.
+func unclosedBrackets(s string) (n int) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			n++
+		case c == ']':
+			n--
+		}
+	}
+	return n
+}
+
+// quotedEnd returns the index after the string starting at s[0], or -1 if it's not
+// terminated.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[0] == '"' && s[i] == '\\':
+			i++
+		case s[i] == s[0]:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+var (
+	intRe   = regexp.MustCompile(`^[-+]?[0-9](?:_?[0-9])*$`)
+	floatRe = regexp.MustCompile(`^[-+]?[0-9](?:_?[0-9])*(?:\.[0-9](?:_?[0-9])*)?(?:[eE][-+]?[0-9](?:_?[0-9])*)?$`)
+)
+
+// value parses a value: a string, a number, a boolean or an array.
+func value(s string) (any, error) {
+	if s == "" {
+		return nil, errors.New("missing value")
+	}
+	switch s[0] {
+	case '"':
+		if quotedEnd(s) != len(s) {
+			return nil, errors.New("unexpected text after the string")
+		}
+		// TOML's basic string escapes are JSON's, plus \e and \UXXXXXXXX, which are rare
+		var v string
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, fmt.Errorf("invalid string: %w", err)
+		}
+		return v, nil
+	case '\'':
+		if quotedEnd(s) != len(s) {
+			return nil, errors.New("unexpected text after the string")
+		}
+		return s[1 : len(s)-1], nil
+	case '[':
+		return array(s)
+	case '{':
+		return nil, fmt.Errorf("%w: inline tables", ErrUnsupported)
+	}
+	switch {
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case intRe.MatchString(s):
+		return strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 10, 64)
+	case floatRe.MatchString(s):
+		return strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+	}
+	return nil, fmt.Errorf("%w: value %q", ErrUnsupported, s)
+}
+
+// array parses an array of values, like `["a", 'b', 3,]`.
+func array(s string) (any, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, errors.New("unterminated array")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	arr := []any{}
+	for s != "" {
+		var item string
+		switch s[0] {
+		case '"', '\'':
+			end := quotedEnd(s)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			item, s = s[:end], strings.TrimSpace(s[end:])
+		case '[':
+			return nil, fmt.Errorf("%w: nested arrays", ErrUnsupported)
+		default:
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			item, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		if s != "" && s[0] != ',' {
+			return nil, errors.New("expected \",\" in the array")
+		}
+		v, err := value(item)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+	return arr, nil
+}
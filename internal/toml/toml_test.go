@@ -0,0 +1,111 @@
+package toml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", `{}`},
+		{"comments", "# comment\n\n   # indented\n", `{}`},
+		{"byte order mark and CRLF", "\ufeffa = 1\r\nb = 2\r\n", `{"a":1,"b":2}`},
+		{"scalars", "s = \"text\"\nl = 'C:\\path'\ni = -42\nu = 1_000\nf = 3.25\ne = 1e3\nt = true\nn = false", `{"e":1000,"f":3.25,"i":-42,"l":"C:\\path","n":false,"s":"text","t":true,"u":1000}`},
+		{"escapes", `s = "tab\there \"quoted\" \u00e9"`, `{"s":"tab\there \"quoted\" é"}`},
+		{"comments after values", "a = \"x # y\" # comment\nb = 'z#' #\nc = 1#", `{"a":"x # y","b":"z#","c":1}`},
+		{"keys", "bare_key-1 = 1\n\"quoted key\" = 2\n'literal.key' = 3\n123 = 4", `{"123":4,"bare_key-1":1,"literal.key":3,"quoted key":2}`},
+		{"dotted keys", "a.b = 1\na.c = 2\n\"x.y\".z = 3\n a . d = 4", `{"a":{"b":1,"c":2,"d":4},"x.y":{"z":3}}`},
+		{"tables", "top = 1\n[server]\nhost = \"h\"\n[server.tls]\ncert = \"c\"\n[other]\nx = 1", `{"other":{"x":1},"server":{"host":"h","tls":{"cert":"c"}},"top":1}`},
+		{"table headers", "[ a . \"b c\" ] # comment\nx = 1\n[a]\ny = 2", `{"a":{"b c":{"x":1},"y":2}}`},
+		{"dotted keys in a table", "[a]\nb.c = 1", `{"a":{"b":{"c":1}}}`},
+		{"arrays", "a = [1, 2, 3]\nb = [\"x\", 'y', \"a, b\", \"[c]\"]\nc = []\nd = [ true , false, ]\ne = [1.5, -2]", `{"a":[1,2,3],"b":["x","y","a, b","[c]"],"c":[],"d":[true,false],"e":[1.5,-2]}`},
+		{"multi-line array", "a = [\n  \"x\", # first\n  \"y\",\n\n  \"z\"\n]\nb = 1", `{"a":["x","y","z"],"b":1}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToJSON([]byte(tc.in))
+			if err != nil {
+				t.Fatalf("ToJSON(%q): %v", tc.in, err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("ToJSON(%q) = %s, want %s", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		in          string
+		want        string // In the error message
+		unsupported bool
+	}{
+		{"missing value", "a =", "line 1: missing value", false},
+		{"missing equals", "a 1", "expected \"=\"", false},
+		{"missing key", "= 1", "invalid key", false},
+		{"invalid key", "a/b = 1", "expected \"=\"", false},
+		{"empty dotted key part", "a. = 1", "invalid key", false},
+		{"duplicate key", "a = 1\nb = 2\na = 3", "line 3: key \"a\" defined twice", false},
+		{"duplicate dotted key", "a.b = 1\na.b = 2", "key \"a.b\" defined twice", false},
+		{"duplicate table", "[a]\nx = 1\n[b]\n[a]", "line 4: table \"a\" defined twice", false},
+		{"value used as a table", "a = 1\n[a.b]", "line 2: key \"a\" is already a value", false},
+		{"value used as a dotted table", "a = 1\na.b = 2", "already a value", false},
+		{"unterminated table header", "[a", "unterminated table header", false},
+		{"text in table header", "[a b]", "unexpected text in the table header", false},
+		{"empty table header", "[]", "missing key", false},
+		{"unterminated string", "a = \"x", "line 1: unterminated string", false},
+		{"unterminated quoted key", "\"a = 1", "unterminated", false},
+		{"text after string", "a = \"x\" y", "unexpected text after the string", false},
+		{"invalid escape", `a = "\q"`, "invalid string", false},
+		{"unterminated array", "a = [1, 2\nb = 3", "unterminated array", false},
+		{"array without commas", "a = [\"x\" \"y\"]", "expected \",\"", false},
+		{"invalid array item", "a = [1, x]", "value \"x\"", true},
+		{"bare string", "a = text", "value \"text\"", true},
+		{"leading underscore", "a = _1", "value \"_1\"", true},
+		{"double underscore", "a = 1__0", "value \"1__0\"", true},
+		{"array of tables", "[[a]]", "arrays of tables", true},
+		{"inline table", "a = {b = 1}", "inline tables", true},
+		{"multi-line basic string", "a = \"\"\"x\"\"\"", "multi-line strings", true},
+		{"multi-line literal string", "a = '''x'''", "multi-line strings", true},
+		{"nested array", "a = [[1], [2]]", "nested arrays", true},
+		{"date", "a = 2026-10-18", "value \"2026-10-18\"", true},
+		{"hex", "a = 0x10", "value \"0x10\"", true},
+		{"integer overflow", "a = 9223372036854775808", "out of range", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToJSON([]byte(tc.in))
+			if err == nil {
+				t.Fatalf("ToJSON(%q) = %s, want an error", tc.in, got)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("ToJSON(%q): %v, want %q in the error", tc.in, err, tc.want)
+			}
+			if strings.Contains(err.Error(), ErrUnsupported.Error()) != tc.unsupported {
+				t.Errorf("ToJSON(%q): %v, unsupported syntax: %v", tc.in, err, tc.unsupported)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTypes(t *testing.T) {
+	m, err := Unmarshal([]byte("i = 1\nf = 2.5\na = [1]\n[t]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["i"].(int64); !ok {
+		t.Errorf("integer = %T, want int64", m["i"])
+	}
+	if _, ok := m["f"].(float64); !ok {
+		t.Errorf("float = %T, want float64", m["f"])
+	}
+	if _, ok := m["a"].([]any); !ok {
+		t.Errorf("array = %T, want []any", m["a"])
+	}
+	if _, ok := m["t"].(map[string]any); !ok {
+		t.Errorf("table = %T, want map[string]any", m["t"])
+	}
+}
@@ -0,0 +1,395 @@
+// Package yaml implements the subset of YAML needed for gomagiclink's policy files:
+// block mappings and sequences, flow sequences of scalars ("[a, b]"), plain, single- and
+// double-quoted scalars, and comments. Anchors, tags, flow mappings, multi-line scalars
+// and multiple documents aren't supported, and are reported as errors. The document is
+// converted to JSON, so it can be decoded into the same structs as JSON files. It's a
+// small implementation, so the module doesn't need an external YAML library.
+package yaml
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("unsupported YAML syntax")
+
+type line struct {
+	num    int // 1-based, for error messages
+	indent int
+	text   string // Without the indentation and the comment
+}
+
+type parser struct {
+	lines []line
+	pos   int
+}
+
+// ToJSON converts the YAML document to JSON. Plain scalars which look like numbers,
+// booleans or null are converted to them, and all the others to strings.
+func ToJSON(data []byte) ([]byte, error) {
+	v, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the YAML document into map[string]any, []any, string, bool, int64,
+// float64 and nil values. An empty document is nil.
+func Unmarshal(data []byte) (any, error) {
+	p := &parser{}
+	if err := p.split(string(data)); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	if p.lines[0].indent != 0 {
+		return nil, p.errorf(p.lines[0], "unexpected indentation")
+	}
+	v, err := p.block(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf(p.lines[p.pos], "unexpected indentation")
+	}
+	return v, nil
+}
+
+func (p *parser) errorf(l line, format string, args ...any) error {
+	return fmt.Errorf("yaml: line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+// split breaks the document into lines, dropping the blank lines, the comments and the
+// document markers.
+func (p *parser) split(doc string) error {
+	doc = strings.TrimPrefix(doc, "\ufeff")
+	for i, text := range strings.Split(doc, "\n") {
+		l := line{num: i + 1}
+		text = strings.TrimRight(text, "\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return p.errorf(l, "tabs can't be used for indentation")
+		}
+		l.indent = len(text) - len(trimmed)
+		trimmed, err := stripComment(trimmed)
+		if err != nil {
+			return p.errorf(l, "%v", err)
+		}
+		l.text = strings.TrimRight(trimmed, " \t")
+		switch {
+		case l.text == "":
+			continue
+		case l.indent == 0 && l.text == "---":
+			if len(p.lines) > 0 {
+				return p.errorf(l, "%v: multiple documents", ErrUnsupported)
+			}
+			continue
+		case l.indent == 0 && l.text == "...":
+			return nil
+		case l.indent == 0 && strings.HasPrefix(l.text, "%"):
+			return p.errorf(l, "%v: directives", ErrUnsupported)
+		}
+		p.lines = append(p.lines, l)
+	}
+	return nil
+}
+
+// stripComment removes the comment from the line, i.e. everything from a "#" at the
+// start or after a space, outside of quotes.
+func stripComment(s string) (string, error) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			if quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				i++
+			} else {
+				quote = 0
+			}
+		case quote != 0:
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [,:-", s[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i], nil
+		}
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated quoted string")
+	}
+	return s, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block parses the mapping or sequence starting at the current line, which is indented
+// by indent.
+func (p *parser) block(indent int) (any, error) {
+	if isSequenceItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *parser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if isSequenceItem(l.text) {
+			return nil, p.errorf(l, "expected a mapping key, not a sequence item")
+		}
+		key, value, err := splitKey(l.text)
+		if err != nil {
+			return nil, p.errorf(l, "%v", err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(l, "duplicate key %q", key)
+		}
+		p.pos++
+		if value != "" {
+			if m[key], err = scalarOrFlow(value); err != nil {
+				return nil, p.errorf(l, "%v", err)
+			}
+			continue
+		}
+		switch {
+		case p.pos >= len(p.lines):
+			m[key] = nil
+		case p.lines[p.pos].indent > indent:
+			if m[key], err = p.block(p.lines[p.pos].indent); err != nil {
+				return nil, err
+			}
+		case p.lines[p.pos].indent == indent && isSequenceItem(p.lines[p.pos].text):
+			// Sequences may be at the same indentation as their key
+			if m[key], err = p.sequence(indent); err != nil {
+				return nil, err
+			}
+		default:
+			m[key] = nil
+		}
+	}
+	return m, nil
+}
+
+func (p *parser) sequence(indent int) (any, error) {
+	seq := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !isSequenceItem(l.text) {
+			if l.indent > indent {
+				return nil, p.errorf(l, "unexpected indentation")
+			}
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				item, err := p.block(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, item)
+			} else {
+				seq = append(seq, nil)
+			}
+			continue
+		}
+		if _, _, err := splitKey(rest); err == nil || isSequenceItem(rest) {
+			// A mapping or sequence starting on the item's line: parse it as if it was
+			// on its own line, indented to where it starts
+			itemIndent := l.indent + len(l.text) - len(rest)
+			p.lines[p.pos] = line{num: l.num, indent: itemIndent, text: rest}
+			item, err := p.block(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+			continue
+		}
+		item, err := scalarOrFlow(rest)
+		if err != nil {
+			return nil, p.errorf(l, "%v", err)
+		}
+		seq = append(seq, item)
+		p.pos++
+	}
+	return seq, nil
+}
+
+// splitKey splits a "key: value" line.
+func splitKey(text string) (key string, value string, err error) {
+	var rawKey string
+	if text[0] == '"' || text[0] == '\'' {
+		end := quotedEnd(text)
+		if end < 0 {
+			return "", "", errors.New("unterminated quoted string")
+		}
+		rawKey, text = text[:end], text[end:]
+		if !strings.HasPrefix(text, ":") {
+			return "", "", errors.New("expected \":\" after the key")
+		}
+		text = text[1:]
+	} else {
+		i := strings.Index(text, ": ")
+		if i < 0 {
+			if !strings.HasSuffix(text, ":") {
+				return "", "", errors.New("expected \"key: value\"")
+			}
+			i = len(text) - 1
+		}
+		rawKey, text = text[:i], text[i+1:]
+	}
+	if text != "" && text[0] != ' ' {
+		return "", "", errors.New("expected a space after \":\"")
+	}
+	k, err := scalar(strings.TrimRight(rawKey, " "))
+	if err != nil {
+		return "", "", err
+	}
+	switch k := k.(type) {
+	case string:
+		key = k
+	case nil:
+		return "", "", errors.New("empty key")
+	default:
+		key = strings.TrimRight(rawKey, " ")
+	}
+	return key, strings.TrimSpace(text), nil
+}
+
+// quotedEnd returns the index after the closing quote of the quoted string at the start
+// of s, or -1 if it isn't closed.
+func quotedEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			if quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func scalarOrFlow(s string) (any, error) {
+	switch s[0] {
+	case '[':
+		return flowSequence(s)
+	case '{':
+		return nil, fmt.Errorf("%w: flow mappings", ErrUnsupported)
+	case '|', '>':
+		return nil, fmt.Errorf("%w: block scalars", ErrUnsupported)
+	}
+	return scalar(s)
+}
+
+// flowSequence parses a single-line flow sequence of scalars, like "[a, 'b, c', 3]".
+func flowSequence(s string) (any, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, errors.New("unterminated flow sequence")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	seq := []any{}
+	for s != "" {
+		var item string
+		if s[0] == '"' || s[0] == '\'' {
+			end := quotedEnd(s)
+			if end < 0 {
+				return nil, errors.New("unterminated quoted string")
+			}
+			item, s = s[:end], strings.TrimLeft(s[end:], " ")
+			if s != "" && s[0] != ',' {
+				return nil, errors.New("expected \",\" in the flow sequence")
+			}
+		} else {
+			if strings.ContainsAny(s[:1], "[{") {
+				return nil, fmt.Errorf("%w: nested flow collections", ErrUnsupported)
+			}
+			item, s, _ = strings.Cut(s, ",")
+			item = strings.TrimSpace(item)
+			if s != "" {
+				s = "," + s
+			}
+		}
+		if item == "" {
+			return nil, errors.New("empty item in the flow sequence")
+		}
+		v, err := scalar(item)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+	return seq, nil
+}
+
+var numberRe = regexp.MustCompile(`^[-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?$`)
+
+// scalar resolves a plain or quoted scalar.
+func scalar(s string) (any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	switch s[0] {
+	case '"':
+		if quotedEnd(s) != len(s) {
+			return nil, errors.New("unexpected text after the quoted string")
+		}
+		// YAML's double-quoted escapes are a superset of JSON's, and the common ones
+		// are the same
+		var v string
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, fmt.Errorf("invalid double-quoted string: %w", err)
+		}
+		return v, nil
+	case '\'':
+		if quotedEnd(s) != len(s) {
+			return nil, errors.New("unexpected text after the quoted string")
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '&', '*', '!':
+		return nil, fmt.Errorf("%w: anchors, aliases and tags", ErrUnsupported)
+	case '@', '`':
+		return nil, fmt.Errorf("plain scalars can't start with %q", s[0])
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if numberRe.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,124 @@
+package yaml
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", "null"},
+		{"comments only", "# comment\n\n  # indented comment\n", "null"},
+		{"document markers", "---\na: 1\n...\nignored: [", `{"a":1}`},
+		{"byte order mark", "\ufeffa: 1", `{"a":1}`},
+		{"CRLF", "a: 1\r\nb:\r\n  - x\r\n", `{"a":1,"b":["x"]}`},
+		{"scalars", "s: text\ni: -12\nf: 1.5\ne: 1e3\nt: true\nF: False\nn: null\ntilde: ~\nempty:", `{"F":false,"e":1000,"empty":null,"f":1.5,"i":-12,"n":null,"s":"text","t":true,"tilde":null}`},
+		{"not numbers", "a: 1.2.3\nb: 0x10\nc: 12:30\nd: -", `{"a":"1.2.3","b":"0x10","c":"12:30","d":"-"}`},
+		{"big integer", "a: 123456789012345678901234567890", `{"a":1.2345678901234568e+29}`},
+		{"quoted", `a: "x: #y"` + "\nb: 'it''s'\nc: \"tab\\tnew\\nline \\u00e9\"\nd: '1'\ne: \"true\"", `{"a":"x: #y","b":"it's","c":"tab\tnew\nline é","d":"1","e":"true"}`},
+		{"comments", "a: x # comment\nb: x#not a comment\nc: 'x # y' # comment", `{"a":"x","b":"x#not a comment","c":"x # y"}`},
+		{"quoted keys", "\"a b\": 1\n'c: d': 2\n1: one", `{"1":"one","a b":1,"c: d":2}`},
+		{"colon in value", "url: http://example.com/a", `{"url":"http://example.com/a"}`},
+		{"nested mappings", "a:\n  b:\n    c: 1\n  d: 2\ne: 3", `{"a":{"b":{"c":1},"d":2},"e":3}`},
+		{"indentation by 4", "a:\n    b: 1\n    c:\n        d: 2", `{"a":{"b":1,"c":{"d":2}}}`},
+		{"key without value before dedent", "a:\n  b:\nc: 1", `{"a":{"b":null},"c":1}`},
+		{"sequence", "- a\n- 2\n- \n-\n- 'x'", `["a",2,null,null,"x"]`},
+		{"indented sequence", "a:\n  - x\n  - y\nb: 1", `{"a":["x","y"],"b":1}`},
+		{"sequence at the key's indentation", "a:\n- x\n- y\nb: 1", `{"a":["x","y"],"b":1}`},
+		{"sequence of mappings", "- a: 1\n  b: 2\n- a: 3", `[{"a":1,"b":2},{"a":3}]`},
+		{"sequence of mappings on their own lines", "-\n  a: 1\n-\n  a: 2", `[{"a":1},{"a":2}]`},
+		{"nested sequences", "- - a\n  - b\n- - c", `[["a","b"],["c"]]`},
+		{"mapping in a sequence with a nested sequence", "rules:\n  - name: x\n    domains:\n      - a.com\n      - b.com\n  - name: y", `{"rules":[{"domains":["a.com","b.com"],"name":"x"},{"name":"y"}]}`},
+		{"flow sequences", "a: [x, 'y, z', \"w\", 1, true]\nb: []\nc: [ a ,b ]", `{"a":["x","y, z","w",1,true],"b":[],"c":["a","b"]}`},
+		{"flow sequence in a sequence", "- [a, b]\n- []", `[["a","b"],[]]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToJSON([]byte(tc.in))
+			if err != nil {
+				t.Fatalf("ToJSON(%q): %v", tc.in, err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("ToJSON(%q) = %s, want %s", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		in          string
+		want        string // In the error message
+		unsupported bool
+	}{
+		{"tab indentation", "a:\n\tb: 1", "line 2: tabs", false},
+		{"indented first line", "  a: 1\nb: 2", "line 1: unexpected indentation", false},
+		{"over-indented key", "a: 1\n  b: 2", "line 2: unexpected indentation", false},
+		{"over-indented after a nested mapping", "a:\n  b: 1\n    c: 2", "line 3: unexpected indentation", false},
+		{"dedent to an unknown level", "a:\n    b: 1\n  c: 2", "line 3: unexpected indentation", false},
+		{"over-indented sequence item", "- a\n  - b", "line 2: unexpected indentation", false},
+		{"sequence item in a mapping", "a: 1\n- b", "line 2: expected a mapping key", false},
+		{"mapping after a sequence", "- a\nb: 1", "line 2: unexpected indentation", false},
+		{"no colon", "a: 1\nb", "line 2: expected \"key: value\"", false},
+		{"no space after colon", "'a':b", "expected a space", false},
+		{"duplicate key", "a: 1\nb: 2\na: 3", "line 3: duplicate key \"a\"", false},
+		{"empty key", "~: 1", "empty key", false},
+		{"unterminated quote", "a: 'x", "line 1: unterminated quoted string", false},
+		{"unterminated quoted key", "\"a: 1", "unterminated quoted string", false},
+		{"text after a quoted string", "a: 'x' y", "unexpected text after the quoted string", false},
+		{"invalid escape", `a: "\q"`, "invalid double-quoted string", false},
+		{"unterminated flow sequence", "a: [x, y", "unterminated flow sequence", false},
+		{"empty flow item", "a: [x, , y]", "empty item", false},
+		{"reserved indicator", "a: @x", "can't start with", false},
+		{"multiple documents", "a: 1\n---\nb: 2", "line 2: unsupported YAML syntax: multiple documents", true},
+		{"directive", "%YAML 1.2\na: 1", "directives", true},
+		{"flow mapping", "a: {b: 1}", "flow mappings", true},
+		{"literal block scalar", "a: |\n  text", "block scalars", true},
+		{"folded block scalar", "a: >\n  text", "block scalars", true},
+		{"anchor", "a: &x 1", "anchors", true},
+		{"alias", "a: *x", "anchors", true},
+		{"tag", "a: !!str 1", "tags", true},
+		{"nested flow sequence", "a: [[x]]", "nested flow collections", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ToJSON([]byte(tc.in))
+			if err == nil {
+				t.Fatalf("ToJSON(%q) = %s, want an error", tc.in, got)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("ToJSON(%q): %v, want %q in the error", tc.in, err, tc.want)
+			}
+			if strings.Contains(err.Error(), ErrUnsupported.Error()) != tc.unsupported {
+				t.Errorf("ToJSON(%q): %v, unsupported syntax: %v", tc.in, err, tc.unsupported)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTypes(t *testing.T) {
+	v, err := Unmarshal([]byte("i: 1\nf: 2.5\nl: [a]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		t.Fatalf("Unmarshal() = %T, want map[string]any", v)
+	}
+	if _, ok := m["i"].(int64); !ok {
+		t.Errorf("integer = %T, want int64", m["i"])
+	}
+	if _, ok := m["f"].(float64); !ok {
+		t.Errorf("float = %T, want float64", m["f"])
+	}
+	if _, ok := m["l"].([]any); !ok {
+		t.Errorf("sequence = %T, want []any", m["l"])
+	}
+	if _, err = scalarOrFlow("{a: 1}"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("flow mapping: %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,68 @@
+package gomagiclink
+
+import (
+	"encoding/base64"
+
+	"github.com/google/uuid"
+)
+
+// SessionIntrospection describes a session ID, in the style of an RFC 7662 token
+// introspection response.
+type SessionIntrospection struct {
+	Active      bool     `json:"active"`
+	Subject     string   `json:"sub,omitempty"`   // User ID
+	Expires     int64    `json:"exp,omitempty"`   // Unix timestamp, omitted if the session doesn't expire
+	Email       string   `json:"email,omitempty"` // User's e-mail address
+	AccessLevel int      `json:"access_level,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+	// Confirmation names the proof key the session is bound to, as in RFC 9449, so the
+	// resource server can check the request's proof itself
+	Confirmation *SessionConfirmation `json:"cnf,omitempty"`
+
+	User *AuthUserRecord `json:"-"` // The user record of an active session
+}
+
+// SessionConfirmation is the "cnf" member of a SessionIntrospection.
+type SessionConfirmation struct {
+	KeyThumbprint string `json:"jkt"` // RFC 7638 thumbprint of the proof key, base64url-encoded
+}
+
+// IntrospectSession verifies the session ID and describes it. Invalid or expired
+// (including stale) sessions, and sessions of disabled users are reported as inactive, without an error.
+// An error is returned only if the storage lookup fails.
+func (mlc *AuthMagicLinkController) IntrospectSession(sessionId string) (*SessionIntrospection, error) {
+	claims, err := mlc.parseSessionId(sessionId)
+	if err != nil || claims.Stale {
+		return &SessionIntrospection{Active: false}, nil
+	}
+	user, err := mlc.getUserById(claims.UserID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return &SessionIntrospection{Active: false}, nil
+		}
+		return nil, err
+	}
+	if !user.Enabled || user.IsLocked() || !claims.epochValid(user) {
+		return &SessionIntrospection{Active: false}, nil
+	}
+	if claims.ImpersonatorID != uuid.Nil {
+		if err = mlc.checkImpersonator(claims.ImpersonatorID, claims.ImpersonatorEpoch, user); err == ErrInvalidSessionId {
+			return &SessionIntrospection{Active: false}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	si := &SessionIntrospection{
+		Active:      true,
+		Subject:     user.ID.String(),
+		Expires:     int64(claims.ExpTime),
+		Email:       user.Email,
+		AccessLevel: user.AccessLevel,
+		User:        user,
+	}
+	if claims.ProofKey != nil {
+		si.Confirmation = &SessionConfirmation{KeyThumbprint: base64.RawURLEncoding.EncodeToString(claims.ProofKey)}
+	}
+	return si, nil
+}
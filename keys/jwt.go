@@ -0,0 +1,102 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrBrokenToken = errors.New("broken token signature")
+var ErrExpiredToken = errors.New("expired token")
+var ErrWrongAudience = errors.New("token issued for a different audience")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// SessionClaims are the claims of a public-key session token.
+type SessionClaims struct {
+	Subject  string `json:"sub"` // User ID
+	Email    string `json:"email"`
+	Audience string `json:"aud,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp,omitempty"` // 0 if the token doesn't expire
+}
+
+// Sign creates a JWT with the claims, signed with the current key (EdDSA).
+func (ks *KeySet) Sign(claims any) (token string, err error) {
+	key := ks.Current()
+	if key == nil || key.Private == nil {
+		return "", ErrNoSigningKey
+	}
+	header, err := json.Marshal(jwtHeader{Alg: "EdDSA", Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(key.Private, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the JWT's signature with the key named by its "kid" header, and
+// decodes its claims. It doesn't check the expiry; see VerifySessionToken().
+func (ks *KeySet) Verify(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var header jwtHeader
+	if err = json.Unmarshal(headerJson, &header); err != nil || header.Alg != "EdDSA" {
+		return ErrInvalidToken
+	}
+	key, err := ks.Key(header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if !ed25519.Verify(key.Public, []byte(parts[0]+"."+parts[1]), sig) {
+		return ErrBrokenToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// VerifySessionToken verifies a public-key session token and checks its expiry and
+// audience (if audience isn't empty). Resource servers can use it with a KeySet from
+// ParseJWKS() to verify session tokens without contacting the auth server.
+func (ks *KeySet) VerifySessionToken(token string, audience string) (claims *SessionClaims, err error) {
+	claims = &SessionClaims{}
+	if err = ks.Verify(token, claims); err != nil {
+		return nil, err
+	}
+	if claims.Expires != 0 && claims.Expires < time.Now().Unix() {
+		return nil, ErrExpiredToken
+	}
+	if audience != "" && claims.Audience != audience {
+		return nil, ErrWrongAudience
+	}
+	return claims, nil
+}
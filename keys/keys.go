@@ -0,0 +1,156 @@
+// Package keys manages the Ed25519 keys used for signing public-key session tokens,
+// and publishes them as a JWK set, so resource servers can verify the tokens locally.
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("unknown key id")
+var ErrNoSigningKey = errors.New("no signing key")
+var ErrInvalidJWK = errors.New("invalid JWK")
+
+// Key is an Ed25519 key pair identified by a key ID ("kid"). Keys loaded from a
+// JWK set have only the public key.
+type Key struct {
+	ID        string
+	Private   ed25519.PrivateKey
+	Public    ed25519.PublicKey
+	CreatedAt time.Time
+}
+
+// KeySet holds the keys for signing and verifying tokens. New tokens are signed with
+// the current key, while tokens signed with the other keys in the set can still be
+// verified. To rotate keys, call GenerateKey() to add a new current key, and remove
+// the old key with RemoveKey() after the tokens signed with it have expired.
+type KeySet struct {
+	lock    sync.RWMutex
+	keys    []*Key
+	current *Key
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{}
+}
+
+// GenerateKey generates a new key and makes it the current signing key.
+func (ks *KeySet) GenerateKey() (key *Key, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	kid := make([]byte, 12)
+	if _, err = rand.Read(kid); err != nil {
+		return
+	}
+	key = &Key{
+		ID:        base64.RawURLEncoding.EncodeToString(kid),
+		Private:   priv,
+		Public:    pub,
+		CreatedAt: time.Now(),
+	}
+	ks.AddKey(key, true)
+	return key, nil
+}
+
+// AddKey adds the key to the set, e.g. one loaded from secure storage, replacing a key
+// with the same ID. If current is true, it becomes the signing key.
+func (ks *KeySet) AddKey(key *Key, current bool) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys = slices.DeleteFunc(ks.keys, func(k *Key) bool { return k.ID == key.ID })
+	ks.keys = append(ks.keys, key)
+	if current {
+		ks.current = key
+	}
+}
+
+// RemoveKey removes the key from the set. Tokens signed with it can't be verified afterwards.
+func (ks *KeySet) RemoveKey(kid string) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys = slices.DeleteFunc(ks.keys, func(k *Key) bool { return k.ID == kid })
+	if ks.current != nil && ks.current.ID == kid {
+		ks.current = nil
+	}
+}
+
+// Current returns the signing key, or nil if there isn't one.
+func (ks *KeySet) Current() *Key {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	return ks.current
+}
+
+// Key returns the key with the ID.
+func (ks *KeySet) Key(kid string) (*Key, error) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	for _, k := range ks.keys {
+		if k.ID == kid {
+			return k, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 8037 for Ed25519).
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	X   string `json:"x"`
+}
+
+// JWKSet is a JSON Web Key set, as served by a JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys in the set as a JWK set.
+func (ks *KeySet) JWKS() JWKSet {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range ks.keys {
+		set.Keys = append(set.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: "EdDSA",
+			X:   base64.RawURLEncoding.EncodeToString(k.Public),
+		})
+	}
+	return set
+}
+
+// ParseJWKS creates a KeySet with the public keys from a JWK set, e.g. one fetched from
+// the JWKS endpoint, for verifying tokens. Keys other than Ed25519 are skipped.
+func ParseJWKS(data []byte) (ks *KeySet, err error) {
+	var set JWKSet
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	ks = NewKeySet()
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" {
+			continue
+		}
+		pub, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(pub) != ed25519.PublicKeySize || jwk.Kid == "" {
+			return nil, ErrInvalidJWK
+		}
+		ks.AddKey(&Key{ID: jwk.Kid, Public: ed25519.PublicKey(pub)}, false)
+	}
+	return ks, nil
+}
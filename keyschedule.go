@@ -0,0 +1,95 @@
+package gomagiclink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/ivoras/gomagiclink/internal/b32"
+	"github.com/ivoras/gomagiclink/internal/hkdf"
+)
+
+// The secret key is stretched with HKDF-SHA-256 into separate keys for each purpose,
+// so a weakness in one use (or a key leaked from it) doesn't affect the others. The
+// labels are the HKDF info strings, and must never change.
+const (
+	keyScheduleSalt         = "gomagiclink key schedule"
+	keyLabelChallenge       = "gomagiclink/v1/challenge"          // Challenge MACs, login codes and hashed e-mail addresses
+	keyLabelSession         = "gomagiclink/v1/session"            // Session ID MACs, including impersonation and stateless sessions
+	keyLabelSessionEncrypt  = "gomagiclink/v1/session-encryption" // User snapshots in encrypted session IDs
+	keyLabelSigning         = "gomagiclink/v1/signing"            // SignData(), for the sub-packages' tokens
+	keyLabelRecordEncrypt   = "gomagiclink/v1/record-encryption"  // The KEK of NewLocalKeyProvider()
+	keyLabelTOTPEncrypt     = "gomagiclink/v1/totp-encryption"    // TOTP secrets on the user records
+	keyLabelURLSigning      = "gomagiclink/v1/url-signing"        // NewURLSigner()
+	keyLabelKeyID           = "gomagiclink/v1/key-id"             // The key ID in the token headers
+	keyLabelApplicationBase = "gomagiclink/v1/app/"               // DeriveKey()
+)
+
+// keySchedule holds the keys derived from the secret key.
+type keySchedule struct {
+	prk       []byte // HKDF pseudorandom key, for DeriveKey()
+	id        string // Key ID in the token headers
+	challenge []byte
+	session   []byte
+	signing   []byte
+	// sessionEncryption encrypts the user snapshots, see WithEncryptedSessions()
+	sessionEncryption []byte
+	recordKEK         []byte
+	totp              []byte
+	urlSigning        []byte
+
+	// SHA-256 of the secret key, which was used for everything before the key schedule.
+	// Nil if legacy keys are disabled with WithoutLegacyKeys().
+	legacy []byte
+}
+
+func newKeySchedule(secretKey []byte) *keySchedule {
+	ks := &keySchedule{prk: hkdf.Extract(secretKey, []byte(keyScheduleSalt))}
+	ks.challenge = ks.derive(keyLabelChallenge)
+	ks.session = ks.derive(keyLabelSession)
+	ks.sessionEncryption = ks.derive(keyLabelSessionEncrypt)
+	ks.signing = ks.derive(keyLabelSigning)
+	ks.recordKEK = ks.derive(keyLabelRecordEncrypt)
+	ks.totp = ks.derive(keyLabelTOTPEncrypt)
+	ks.urlSigning = ks.derive(keyLabelURLSigning)
+	ks.id = b32.EncodeToString(ks.derive(keyLabelKeyID)[:5])
+	legacy := sha256.Sum256(secretKey)
+	ks.legacy = legacy[:]
+	return ks
+}
+
+func (ks *keySchedule) derive(label string) []byte {
+	// 32 bytes can't exceed the maximum length
+	key, _ := hkdf.Expand(ks.prk, []byte(label), 32)
+	return key
+}
+
+// legacyKey returns the key derived from the SHA-256 of the secret key with the label,
+// as it was done before the key schedule, or nil if legacy keys are disabled.
+func (ks *keySchedule) legacyKey(label string) []byte {
+	if ks.legacy == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, ks.legacy)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// WithoutLegacyKeys stops accepting tokens and reading data protected with the keys used
+// before the key schedule, which were all derived from a single SHA-256 hash of the
+// secret key. By default, they're accepted, so upgrading doesn't log out the users, and
+// data is moved to the new keys as it's written: tokens as they're reissued, TOTP
+// secrets when they're used, and encrypted records when they're stored again or by
+// ReencryptRecords(). Enable it once the old sessions have expired and the records have
+// been re-encrypted.
+func WithoutLegacyKeys() ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.disableLegacyKeys = true
+	}
+}
+
+// DeriveKey returns a 32-byte key derived from the secret key for the application's own
+// purpose, e.g. the secret of a webhook endpoint. Keys with different labels are
+// independent, and distinct from the controller's own keys.
+func (mlc *AuthMagicLinkController) DeriveKey(label string) []byte {
+	return mlc.keys.derive(keyLabelApplicationBase + label)
+}
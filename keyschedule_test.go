@@ -0,0 +1,42 @@
+package gomagiclink
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ivoras/gomagiclink/internal/hkdf"
+)
+
+func TestKeySchedule(t *testing.T) {
+	secretKey := []byte("0123456789abcdef0123456789abcdef")
+	ks := newKeySchedule(secretKey)
+	keys := map[string][]byte{
+		keyLabelChallenge:      ks.challenge,
+		keyLabelSession:        ks.session,
+		keyLabelSessionEncrypt: ks.sessionEncryption,
+		keyLabelSigning:        ks.signing,
+		keyLabelRecordEncrypt:  ks.recordKEK,
+		keyLabelTOTPEncrypt:    ks.totp,
+		keyLabelURLSigning:     ks.urlSigning,
+	}
+	seen := map[string]string{}
+	for label, key := range keys {
+		want, err := hkdf.Key(secretKey, []byte(keyScheduleSalt), []byte(label), 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, want) {
+			t.Errorf("key %q = %x, want %x", label, key, want)
+		}
+		if other, ok := seen[string(key)]; ok {
+			t.Errorf("keys %q and %q are the same", label, other)
+		}
+		seen[string(key)] = label
+	}
+	if bytes.Equal(ks.derive(keyLabelApplicationBase+"a"), ks.derive(keyLabelApplicationBase+"b")) {
+		t.Error("application keys with different labels are the same")
+	}
+	if other := newKeySchedule([]byte("fedcba9876543210fedcba9876543210")); bytes.Equal(other.session, ks.session) || other.id == ks.id {
+		t.Error("another secret key derived the same keys")
+	}
+}
@@ -0,0 +1,69 @@
+package gomagiclink
+
+import "time"
+
+// SessionLifetimePolicy decides how long the sessions generated after verifying a
+// challenge are valid, from the age of the magic link (how long ago the challenge was
+// generated). It returns the session duration, or 0 for the controller's default. The
+// policy can only shorten the sessions, not make them longer than the default.
+type SessionLifetimePolicy func(user *AuthUserRecord, linkAge time.Duration) time.Duration
+
+// WithSessionLifetimePolicy sets the policy applied by VerifyChallenge() (and the other
+// ways of verifying challenges), so the magic links can stay clickable for a long time
+// (the challenge duration passed to NewAuthMagicLinkController()), while the sessions
+// they create shrink as the links get older, e.g. links valid for 24 hours, but sessions
+// from links opened after the first hour valid for only an hour. The result is set in
+// the record's SessionLifetime field, which GenerateSessionId() and
+// GenerateSessionToken() honour. It isn't carried across the 2FA step, so sessions
+// generated after VerifyPendingTOTPSession() have the default duration.
+func WithSessionLifetimePolicy(policy SessionLifetimePolicy) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.sessionLifetimePolicy = policy
+	}
+}
+
+// LinkAgeSessionLimit returns a SessionLifetimePolicy which limits the sessions to
+// limit for links opened more than after since they were generated.
+func LinkAgeSessionLimit(after time.Duration, limit time.Duration) SessionLifetimePolicy {
+	return func(user *AuthUserRecord, linkAge time.Duration) time.Duration {
+		if linkAge > after {
+			return limit
+		}
+		return 0
+	}
+}
+
+// ProportionalSessionLifetime returns a SessionLifetimePolicy which shrinks the sessions
+// in proportion to the link's remaining lifetime, from the full session duration for
+// links opened right away, down to minimum for links opened just before they expire.
+// The controller needs a session duration.
+func (mlc *AuthMagicLinkController) ProportionalSessionLifetime(minimum time.Duration) SessionLifetimePolicy {
+	return func(user *AuthUserRecord, linkAge time.Duration) time.Duration {
+		if mlc.sessionExpDuration <= 0 || mlc.challengeExpDuration <= 0 {
+			return 0
+		}
+		remaining := max(mlc.challengeExpDuration-linkAge, 0)
+		d := time.Duration(float64(mlc.sessionExpDuration) * float64(remaining) / float64(mlc.challengeExpDuration))
+		return max(d, minimum)
+	}
+}
+
+// applySessionLifetimePolicy sets the user's SessionLifetime for the verified challenge
+// which was issued at issuedAt.
+func (mlc *AuthMagicLinkController) applySessionLifetimePolicy(user *AuthUserRecord, issuedAt time.Time) {
+	if mlc.sessionLifetimePolicy == nil {
+		return
+	}
+	user.SessionLifetime = max(mlc.sessionLifetimePolicy(user, max(time.Since(issuedAt), 0)), 0)
+}
+
+// sessionDuration returns the duration of the sessions generated for the user: the
+// controller's default, shortened by the user's SessionLifetime. Zero means the sessions
+// don't expire.
+func (mlc *AuthMagicLinkController) sessionDuration(user *AuthUserRecord) time.Duration {
+	d := mlc.sessionExpDuration
+	if user.SessionLifetime > 0 && (d <= 0 || user.SessionLifetime < d) {
+		d = user.SessionLifetime
+	}
+	return d
+}
@@ -0,0 +1,158 @@
+package gomagiclink
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidVerifyURLTemplate = errors.New("invalid verify URL template")
+var ErrNoVerifyURLTemplate = errors.New("no verify URL template")
+
+// Placeholders in verify URL templates, see WithVerifyURLTemplate().
+const (
+	VerifyURLChallenge = "{challenge}"
+	VerifyURLNext      = "{next}"
+)
+
+var verifyURLPlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// verifyURLTemplate is a parsed verify URL template. The challenge is either a path
+// segment, or the value of a query or fragment parameter.
+type verifyURLTemplate struct {
+	raw      string
+	part     string // "path", "query" or "fragment"
+	param    string // For "query" and "fragment"
+	segment  int    // For "path", the index of the segment in the URL's path split by "/"
+	segments int    // For "path", the number of the segments
+}
+
+// WithVerifyURLTemplate sets the template of the magic links built by BuildMagicLinkURL(),
+// so each app (or each controller of a multi-app deployment) can have its own URL shape
+// without building the links in handler code, e.g.
+//
+//	"https://app.example.com/auth/callback?token={challenge}&next={next}"
+//	"myapp://login/{challenge}"
+//
+// The {challenge} placeholder is required, and must be a whole path segment, or the
+// whole value of a query or fragment parameter. The {next} placeholder is optional; a
+// parameter with an empty {next} is left out. The adapters' handlers use the template
+// when their VerifyURL is empty.
+func WithVerifyURLTemplate(template string) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.verifyURLTemplate = &verifyURLTemplate{raw: template}
+	}
+}
+
+// parse checks the template and finds where the challenge is in it.
+func (vt *verifyURLTemplate) parse() error {
+	for _, p := range verifyURLPlaceholderRe.FindAllString(vt.raw, -1) {
+		if p != VerifyURLChallenge && p != VerifyURLNext {
+			return ErrInvalidVerifyURLTemplate
+		}
+	}
+	if strings.Count(vt.raw, VerifyURLChallenge) != 1 {
+		return ErrInvalidVerifyURLTemplate
+	}
+	u, err := url.Parse(vt.expand("x", "x"))
+	if err != nil || u.Scheme == "" {
+		return ErrInvalidVerifyURLTemplate
+	}
+	rest, fragment, _ := strings.Cut(vt.raw, "#")
+	path, query, _ := strings.Cut(rest, "?")
+	if i := indexOf(strings.Split(path, "/"), VerifyURLChallenge); i >= 0 {
+		// The raw path includes the scheme and the host for absolute URLs
+		segments := strings.Split(u.EscapedPath(), "/")
+		vt.part, vt.segments = "path", len(segments)
+		vt.segment = i - (len(strings.Split(path, "/")) - len(segments))
+		if vt.segment < 0 || segments[vt.segment] != "x" {
+			return ErrInvalidVerifyURLTemplate
+		}
+		return nil
+	}
+	for part, params := range map[string]string{"query": query, "fragment": fragment} {
+		for _, pair := range strings.Split(params, "&") {
+			if name, value, _ := strings.Cut(pair, "="); value == VerifyURLChallenge {
+				vt.part, vt.param = part, name
+				return nil
+			}
+		}
+	}
+	return ErrInvalidVerifyURLTemplate
+}
+
+// expand replaces the placeholders with the escaped values.
+func (vt *verifyURLTemplate) expand(challenge string, next string) string {
+	values := map[string]string{VerifyURLChallenge: challenge, VerifyURLNext: next}
+	rest, fragment, hasFragment := strings.Cut(vt.raw, "#")
+	path, query, hasQuery := strings.Cut(rest, "?")
+	link := verifyURLPlaceholderRe.ReplaceAllStringFunc(path, func(p string) string {
+		return url.PathEscape(values[p])
+	})
+	expandParams := func(params string) string {
+		var pairs []string
+		for _, pair := range strings.Split(params, "&") {
+			if _, value, _ := strings.Cut(pair, "="); values[value] == "" && value == VerifyURLNext {
+				continue
+			}
+			pairs = append(pairs, verifyURLPlaceholderRe.ReplaceAllStringFunc(pair, func(p string) string {
+				return url.QueryEscape(values[p])
+			}))
+		}
+		return strings.Join(pairs, "&")
+	}
+	if hasQuery {
+		if q := expandParams(query); q != "" {
+			link += "?" + q
+		}
+	}
+	if hasFragment {
+		link += "#" + expandParams(fragment)
+	}
+	return link
+}
+
+func indexOf(items []string, item string) int {
+	for i := range items {
+		if items[i] == item {
+			return i
+		}
+	}
+	return -1
+}
+
+// BuildMagicLinkURL builds the magic link for the challenge from the template set with
+// WithVerifyURLTemplate(). next is substituted for {next}, e.g. the page to return to
+// after the login; since it ends up in a redirect, the app must check it when the link
+// is opened. It returns ErrNoVerifyURLTemplate if there's no template; use
+// BuildMagicLink() with a base URL instead.
+func (mlc *AuthMagicLinkController) BuildMagicLinkURL(challenge string, next string) (string, error) {
+	if mlc.verifyURLTemplate == nil {
+		return "", ErrNoVerifyURLTemplate
+	}
+	return mlc.verifyURLTemplate.expand(challenge, next), nil
+}
+
+// ChallengeFromURL returns the challenge from an opened magic link, wherever the verify
+// URL template puts it, or from the "challenge" query parameter, as added by
+// BuildMagicLink(). It returns an empty string if there's no challenge.
+func (mlc *AuthMagicLinkController) ChallengeFromURL(u *url.URL) string {
+	if challenge := u.Query().Get("challenge"); challenge != "" || mlc.verifyURLTemplate == nil {
+		return challenge
+	}
+	vt := mlc.verifyURLTemplate
+	switch vt.part {
+	case "query":
+		return u.Query().Get(vt.param)
+	case "fragment":
+		params, _ := url.ParseQuery(u.EscapedFragment())
+		return params.Get(vt.param)
+	case "path":
+		if segments := strings.Split(u.EscapedPath(), "/"); len(segments) == vt.segments {
+			challenge, _ := url.PathUnescape(segments[vt.segment])
+			return challenge
+		}
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package gomagiclink
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Subsystem names, used as the "subsystem" attribute of log records and for
+// per-subsystem level control in Loggers.
+const (
+	SubsystemController = "controller"
+	SubsystemStorage    = "storage"
+	SubsystemAdapters   = "adapters"
+	SubsystemMailer     = "mailer"
+)
+
+// Attribute keys whose values are redacted by loggers created by this package.
+var redactedLogKeys = []string{"challenge", "session_id", "sessionid", "token", "cookie", "secret"}
+
+// WithLogger sets the logger used by the controller. By default, the controller logs
+// to slog.Default(). Either way, challenges and session IDs are redacted.
+func WithLogger(logger *slog.Logger) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		if _, ok := logger.Handler().(*redactingHandler); !ok {
+			logger = slog.New(newRedactingHandler(logger.Handler()))
+		}
+		mlc.logger = logger
+	}
+}
+
+// RedactToken returns a shortened version of a challenge, session ID or other token,
+// which identifies it well enough for debugging, but can't be used.
+func RedactToken(token string) string {
+	if len(token) <= 8 {
+		return "[redacted]"
+	}
+	return token[:4] + "...[redacted]"
+}
+
+// tokenFingerprint identifies a token in the logs without revealing any part of it.
+func tokenFingerprint(token string) string {
+	return ChallengeID(token)
+}
+
+// Secret is a string which is redacted when logged with slog.
+type Secret string
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(RedactToken(string(s)))
+}
+
+// Loggers creates per-subsystem loggers sharing a single slog.Handler, with levels
+// which can be set (and changed at run time) independently for each subsystem.
+// Attributes which hold tokens (such as "challenge", "session_id" and "token") are redacted.
+type Loggers struct {
+	handler      slog.Handler
+	defaultLevel *slog.LevelVar
+	lock         sync.Mutex
+	levels       map[string]*slog.LevelVar
+}
+
+// NewLoggers creates Loggers writing to the handler, with the default level for all subsystems.
+func NewLoggers(handler slog.Handler, defaultLevel slog.Level) *Loggers {
+	l := &Loggers{
+		handler:      handler,
+		defaultLevel: &slog.LevelVar{},
+		levels:       map[string]*slog.LevelVar{},
+	}
+	l.defaultLevel.Set(defaultLevel)
+	return l
+}
+
+// SetLevel sets the level of the subsystem's logger, including the loggers already created.
+func (l *Loggers) SetLevel(subsystem string, level slog.Level) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lv, ok := l.levels[subsystem]
+	if !ok {
+		lv = &slog.LevelVar{}
+		l.levels[subsystem] = lv
+	}
+	lv.Set(level)
+}
+
+// SetDefaultLevel sets the level of subsystems which don't have their own level set.
+func (l *Loggers) SetDefaultLevel(level slog.Level) {
+	l.defaultLevel.Set(level)
+}
+
+// Logger returns the logger for the subsystem.
+func (l *Loggers) Logger(subsystem string) *slog.Logger {
+	return slog.New(&redactingHandler{
+		inner: l.handler,
+		level: subsystemLeveler{loggers: l, subsystem: subsystem},
+	}).With("subsystem", subsystem)
+}
+
+type subsystemLeveler struct {
+	loggers   *Loggers
+	subsystem string
+}
+
+func (sl subsystemLeveler) Level() slog.Level {
+	sl.loggers.lock.Lock()
+	lv, ok := sl.loggers.levels[sl.subsystem]
+	sl.loggers.lock.Unlock()
+	if ok {
+		return lv.Level()
+	}
+	return sl.loggers.defaultLevel.Level()
+}
+
+// redactingHandler filters records by level, and redacts the values of token attributes.
+type redactingHandler struct {
+	inner slog.Handler
+	level slog.Leveler // nil to use only the inner handler's level
+}
+
+func newRedactingHandler(inner slog.Handler) *redactingHandler {
+	return &redactingHandler{inner: inner}
+}
+
+func (rh *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if rh.level != nil && level < rh.level.Level() {
+		return false
+	}
+	return rh.inner.Enabled(ctx, level)
+}
+
+func (rh *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(redactAttr(a))
+		return true
+	})
+	return rh.inner.Handle(ctx, nr)
+}
+
+func (rh *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{inner: rh.inner.WithAttrs(redacted), level: rh.level}
+}
+
+func (rh *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{inner: rh.inner.WithGroup(name), level: rh.level}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+	if slices.Contains(redactedLogKeys, strings.ToLower(a.Key)) {
+		return slog.String(a.Key, RedactToken(a.Value.Resolve().String()))
+	}
+	return a
+}
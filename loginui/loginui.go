@@ -0,0 +1,202 @@
+// Package loginui has embeddable, themable HTML pages for the magic link login flow:
+// the login form, the "check your e-mail" page, the error page and the logged out page.
+// They're meant to be used with adapters.AuthHandlers, so small apps get a complete
+// login flow without any frontend work.
+package loginui
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ivoras/gomagiclink/adapters"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+var ErrInvalidTheme = errors.New("theme values can't contain ;, {, }, < or >")
+
+// Theme customizes the look of the pages. Empty fields have defaults.
+type Theme struct {
+	AppName         string // Shown in the page titles and headings, default "Log in"
+	LogoURL         string // Image shown above the headings
+	PrimaryColor    string // CSS colour of the buttons and links, default "#2563eb"
+	BackgroundColor string // CSS colour of the page background, default "#f3f4f6"
+	TextColor       string // CSS colour of the text, default "#111827"
+	FontFamily      string // CSS font-family, default the system UI font
+	CustomCSS       string // Appended to the stylesheet
+}
+
+// Options configures the login pages.
+type Options struct {
+	BasePath string // Path the handler is mounted on, e.g. "/auth"
+	LoginURL string // URL of the AuthHandlers.Login() handler, to which the login form posts, default "/login"
+	Theme    Theme
+	// Templates can replace the built-in templates: files in it named like them
+	// (layout.html, login.html, sent.html, error.html, loggedout.html) are used instead.
+	Templates fs.FS
+	// Catalog has the messages shown for the adapters.ErrorCode* codes, in the language
+	// of the request's Accept-Language header. Default adapters.DefaultMessageCatalog.
+	Catalog adapters.MessageCatalog
+	// Messages replace the messages from the Catalog in all languages.
+	Messages map[string]string
+	Logger   *slog.Logger // Receives template errors
+}
+
+// DefaultMessages are the English messages shown on the error page for the error codes.
+var DefaultMessages = adapters.DefaultMessageCatalog[adapters.DefaultLanguage]
+
+var pageNames = []string{"login.html", "sent.html", "error.html", "loggedout.html"}
+
+// Handler serves the login pages.
+type Handler struct {
+	opts     Options
+	mux      *http.ServeMux
+	pages    map[string]*template.Template
+	themeCSS []byte
+}
+
+type pageData struct {
+	Base     string
+	LoginURL string
+	Theme    Theme
+	Error    string
+	Reissued bool // The link had expired, and a new one was sent (see adapters.AuthHandlers.Verify())
+}
+
+// NewHandler creates the login pages handler. Mount it on Options.BasePath, e.g.
+// mux.Handle("/auth/", h), and point the AuthHandlers to it with ConfigureAuthHandlers().
+func NewHandler(opts Options) (h *Handler, err error) {
+	opts.BasePath = strings.TrimSuffix(opts.BasePath, "/")
+	if opts.LoginURL == "" {
+		opts.LoginURL = "/login"
+	}
+	if opts.Theme.AppName == "" {
+		opts.Theme.AppName = "Log in"
+	}
+	if opts.Catalog == nil {
+		opts.Catalog = adapters.DefaultMessageCatalog
+	}
+	h = &Handler{opts: opts, pages: map[string]*template.Template{}}
+	if h.themeCSS, err = themeCSS(opts.Theme); err != nil {
+		return nil, err
+	}
+	for _, page := range pageNames {
+		if h.pages[page], err = parsePage(page, opts.Templates); err != nil {
+			return nil, err
+		}
+	}
+	static, _ := fs.Sub(staticFS, "static")
+
+	h.mux = http.NewServeMux()
+	h.mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static)))
+	h.mux.HandleFunc("GET /theme.css", h.serveThemeCSS)
+	h.mux.HandleFunc("GET /{$}", h.page("login.html", http.StatusOK))
+	h.mux.HandleFunc("GET /sent", h.page("sent.html", http.StatusOK))
+	h.mux.HandleFunc("GET /error", h.page("error.html", http.StatusBadRequest))
+	h.mux.HandleFunc("GET /logged-out", h.page("loggedout.html", http.StatusOK))
+	return h, nil
+}
+
+// parsePage parses the layout and the page template, using the overrides where they exist.
+func parsePage(page string, overrides fs.FS) (t *template.Template, err error) {
+	t = template.New("layout.html")
+	for _, name := range []string{"layout.html", page} {
+		src := fs.FS(templateFS)
+		path := "templates/" + name
+		if overrides != nil {
+			if _, err := fs.Stat(overrides, name); err == nil {
+				src, path = overrides, name
+			}
+		}
+		if t, err = t.ParseFS(src, path); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// themeCSS renders the theme as CSS variables used by the built-in stylesheet.
+func themeCSS(theme Theme) ([]byte, error) {
+	vars := []struct{ name, value, def string }{
+		{"--primary", theme.PrimaryColor, "#2563eb"},
+		{"--background", theme.BackgroundColor, "#f3f4f6"},
+		{"--text", theme.TextColor, "#111827"},
+		{"--font", theme.FontFamily, "system-ui, -apple-system, 'Segoe UI', Roboto, sans-serif"},
+	}
+	var buf bytes.Buffer
+	buf.WriteString(":root {\n")
+	for _, v := range vars {
+		if strings.ContainsAny(v.value, ";{}<>") {
+			return nil, ErrInvalidTheme
+		}
+		if v.value == "" {
+			v.value = v.def
+		}
+		fmt.Fprintf(&buf, "  %s: %s;\n", v.name, v.value)
+	}
+	buf.WriteString("}\n")
+	buf.WriteString(theme.CustomCSS)
+	return buf.Bytes(), nil
+}
+
+// ConfigureAuthHandlers points the AuthHandlers' redirects to the pages, and makes them
+// use the same message catalog.
+func (h *Handler) ConfigureAuthHandlers(ah *adapters.AuthHandlers) {
+	ah.Messages = h.opts.Catalog
+	ah.ChallengeSentURL = h.opts.BasePath + "/sent"
+	ah.ErrorURL = h.opts.BasePath + "/error"
+	ah.LoggedOutURL = h.opts.BasePath + "/logged-out"
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.StripPrefix(h.opts.BasePath, h.mux).ServeHTTP(w, r)
+}
+
+func (h *Handler) serveThemeCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Write(h.themeCSS)
+}
+
+// page returns the handler rendering the page. The "error" query parameter (an
+// adapters.ErrorCode* code) is shown as a message.
+func (h *Handler) page(page string, status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := pageData{Base: h.opts.BasePath, LoginURL: h.opts.LoginURL, Theme: h.opts.Theme}
+		if code := r.URL.Query().Get("error"); code != "" || page == "error.html" {
+			data.Error = h.message(r, code)
+		}
+		data.Reissued = r.URL.Query().Get("reissued") != ""
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := h.pages[page].Execute(w, data); err != nil && h.opts.Logger != nil {
+			h.opts.Logger.Error("Error rendering login page", "page", page, "error", err)
+		}
+	}
+}
+
+// message returns the message for the error code in the request's language, falling
+// back to the internal error message.
+func (h *Handler) message(r *http.Request, code string) string {
+	if msg, ok := h.opts.Messages[code]; ok {
+		return msg
+	}
+	if _, ok := h.opts.Catalog[adapters.DefaultLanguage][code]; !ok {
+		if msg, ok := h.opts.Messages[adapters.ErrorCodeInternal]; ok {
+			return msg
+		}
+	}
+	msg, _ := h.opts.Catalog.Localize(r, code)
+	return msg
+}
@@ -0,0 +1,127 @@
+package gomagiclink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"slices"
+
+	"github.com/ivoras/gomagiclink/internal/blake2b"
+)
+
+// MACAlgorithm selects how the token MACs (in challenges, session IDs and everything
+// signed with SignData()) are computed.
+type MACAlgorithm byte
+
+const (
+	MACHMACSHA256     MACAlgorithm = 0 // HMAC-SHA-256, the default
+	MACHMACSHA512_256 MACAlgorithm = 1 // HMAC-SHA-512/256
+	MACBLAKE2b256     MACAlgorithm = 2 // Keyed BLAKE2b-256
+)
+
+var ErrUnknownMACAlgorithm = errors.New("unknown MAC algorithm")
+
+// String returns the algorithm's name.
+func (alg MACAlgorithm) String() string {
+	switch alg {
+	case MACHMACSHA256:
+		return "HMAC-SHA-256"
+	case MACHMACSHA512_256:
+		return "HMAC-SHA-512/256"
+	case MACBLAKE2b256:
+		return "BLAKE2b-256"
+	}
+	return "unknown"
+}
+
+func (alg MACAlgorithm) valid() bool {
+	return alg <= MACBLAKE2b256
+}
+
+// WithMACAlgorithm selects the MAC algorithm for the tokens, for organizations with
+// specific cryptographic standards. Only tokens made with this algorithm are accepted,
+// unless the previous one is passed to WithLegacyMACAlgorithms() (the algorithm is
+// recorded in a version byte in front of the MAC, for all but the default HMAC-SHA-256),
+// so the algorithm can be changed without logging out the users. The keys derived from
+// the secret key, e.g. for encrypting records, aren't affected.
+func WithMACAlgorithm(alg MACAlgorithm) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.macAlgorithm = alg
+	}
+}
+
+// WithLegacyMACAlgorithms accepts tokens made with the algorithms as well as with the one
+// selected by WithMACAlgorithm(), e.g. while switching to a new one. New tokens are always
+// made with the selected algorithm.
+func WithLegacyMACAlgorithms(algs ...MACAlgorithm) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.legacyMACAlgorithms = append(mlc.legacyMACAlgorithms, algs...)
+	}
+}
+
+// macAlgorithmAccepted returns true for the algorithms tokens are accepted with.
+func (mlc *AuthMagicLinkController) macAlgorithmAccepted(alg MACAlgorithm) bool {
+	return alg == mlc.macAlgorithm || slices.Contains(mlc.legacyMACAlgorithms, alg)
+}
+
+// macWith computes the raw token MAC with the algorithm and the key, mixing in the
+// audience and the namespace.
+func (mlc *AuthMagicLinkController) macWith(alg MACAlgorithm, key []byte, payload []byte) []byte {
+	if mlc.audience != "" {
+		payload = slices.Concat(payload, []byte{0}, []byte("audience"), []byte{0}, []byte(mlc.audience))
+	}
+	if mlc.namespace != "" {
+		payload = slices.Concat(payload, []byte{0}, []byte("namespace"), []byte{0}, []byte(mlc.namespace))
+	}
+	var mac hash.Hash
+	switch alg {
+	case MACHMACSHA512_256:
+		mac = hmac.New(sha512.New512_256, key)
+	case MACBLAKE2b256:
+		// The keys are 32 bytes long, so this can't fail
+		mac, _ = blake2b.New256(key)
+	default:
+		mac = hmac.New(sha256.New, key)
+	}
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// makeTokenHMAC computes the MAC for a token with the configured algorithm and the key
+// from the key schedule. MACs made with algorithms other than the default are prefixed
+// with the algorithm's version byte.
+func (mlc *AuthMagicLinkController) makeTokenHMAC(key []byte, payload []byte) []byte {
+	mac := mlc.macWith(mlc.macAlgorithm, key, payload)
+	if mlc.macAlgorithm == MACHMACSHA256 {
+		return mac
+	}
+	return append([]byte{byte(mlc.macAlgorithm)}, mac...)
+}
+
+// tokenMACAlgorithm returns the algorithm a MAC made by makeTokenHMAC() was computed with.
+func tokenMACAlgorithm(mac []byte) (alg MACAlgorithm, ok bool) {
+	switch len(mac) {
+	case sha256.Size:
+		return MACHMACSHA256, true
+	case sha256.Size + 1:
+		alg = MACAlgorithm(mac[0])
+		return alg, alg != MACHMACSHA256 && alg.valid()
+	}
+	return 0, false
+}
+
+// verifyTokenHMAC verifies a MAC made by makeTokenHMAC(), with the algorithm it was made
+// with, if it's accepted (see WithLegacyMACAlgorithms()). MACs made with the legacy key
+// are accepted unless it's disabled (see WithoutLegacyKeys()).
+func (mlc *AuthMagicLinkController) verifyTokenHMAC(key []byte, payload []byte, mac []byte) bool {
+	alg, ok := tokenMACAlgorithm(mac)
+	if !ok || !mlc.macAlgorithmAccepted(alg) {
+		return false
+	}
+	if hmac.Equal(mac[len(mac)-sha256.Size:], mlc.macWith(alg, key, payload)) {
+		return true
+	}
+	return mlc.keys.legacy != nil && hmac.Equal(mac[len(mac)-sha256.Size:], mlc.macWith(alg, mlc.keys.legacy, payload))
+}
@@ -0,0 +1,59 @@
+package gomagiclink_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+func TestAcceptedMACAlgorithms(t *testing.T) {
+	db, err := storage.NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey := newTestSecretKey(t)
+	newController := func(opts ...gomagiclink.ControllerOption) *gomagiclink.AuthMagicLinkController {
+		t.Helper()
+		mlc, err := gomagiclink.NewAuthMagicLinkController(secretKey, time.Hour, time.Hour, db, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mlc
+	}
+	user, err := gomagiclink.NewAuthUserRecord("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = newController().StoreUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	algs := []gomagiclink.MACAlgorithm{gomagiclink.MACHMACSHA256, gomagiclink.MACHMACSHA512_256, gomagiclink.MACBLAKE2b256}
+	for _, signAlg := range algs {
+		signer := newController(gomagiclink.WithMACAlgorithm(signAlg))
+		data := []byte("data")
+		signature := signer.SignData("test", data)
+		sessionId, err := signer.GenerateSessionId(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, alg := range algs {
+			for _, legacy := range [][]gomagiclink.MACAlgorithm{nil, {signAlg}} {
+				verifier := newController(gomagiclink.WithMACAlgorithm(alg), gomagiclink.WithLegacyMACAlgorithms(legacy...))
+				want := alg == signAlg || legacy != nil
+				if got := verifier.VerifyData("test", data, signature); got != want {
+					t.Errorf("%v signature verified with %v, legacy %v: %v, want %v", signAlg, alg, legacy, got, want)
+				}
+				if _, err := verifier.VerifySessionId(sessionId); (err == nil) != want {
+					t.Errorf("%v session verified with %v, legacy %v: %v, want accepted %v", signAlg, alg, legacy, err, want)
+				}
+			}
+		}
+	}
+
+	if _, err = gomagiclink.NewAuthMagicLinkController(secretKey, time.Hour, time.Hour, db, gomagiclink.WithLegacyMACAlgorithms(99)); err != gomagiclink.ErrUnknownMACAlgorithm {
+		t.Errorf("unknown legacy algorithm: %v, want ErrUnknownMACAlgorithm", err)
+	}
+}
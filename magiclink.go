@@ -1,19 +1,21 @@
 package gomagiclink
 
 import (
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base32"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink/internal/b32"
+	"github.com/ivoras/gomagiclink/keys"
 )
 
 const sesionIdSplitChar = "_"
@@ -26,17 +28,44 @@ type RecordWithKeyName interface {
 	GetKeyName() string
 }
 
-// When a new storage provider is created, it implements this interface.
-// See the provided storage provided in the `storage` package.
-type UserAuthDatabase interface {
+// UserReader looks up user records in the storage.
+type UserReader interface {
 	UserExistsByEmail(email string) bool
-	StoreUser(user *AuthUserRecord) error
 	GetUserById(id uuid.UUID) (*AuthUserRecord, error)
 	GetUserByEmail(email string) (*AuthUserRecord, error)
+}
+
+// UserWriter modifies user records in the storage. StoreUser() implementations should
+// call AuthUserRecord.Touch() before persisting the record.
+type UserWriter interface {
+	StoreUser(user *AuthUserRecord) error // Creates or updates the user
+}
+
+// UserCounter is implemented by storages which can count users, see GetUserCount().
+type UserCounter interface {
 	GetUserCount() (int, error) // Slow
 	UsersExist() (bool, error)  // Fast
 }
 
+// UserStorage is what the controller needs from a storage provider, so a minimal backend
+// only implements this. The optional capabilities are detected by the controller:
+// UserCreator, UserUpdater, UserDeleter, UserCounter, UserLister, NamespacedStorage and
+// StorageStats. Storages can also keep
+// sessions and challenges, by implementing SessionStore and ChallengeStore, which are
+// passed to WithSessionStore() and WithChallengeStore().
+type UserStorage interface {
+	UserReader
+	UserWriter
+}
+
+// UserAuthDatabase is a storage provider with the basic capabilities, implemented by all
+// the storages provided in the `storage` package.
+type UserAuthDatabase interface {
+	UserReader
+	UserWriter
+	UserCounter
+}
+
 const challengeSignature = "9"
 const sessionIdSignature = "S"
 const saltLength = 8
@@ -44,7 +73,9 @@ const saltLength = 8
 var ErrUserAlreadyExists = errors.New("user already exists")
 var ErrUserNotFound = errors.New("user not found")
 var ErrUserDisabled = errors.New("user disabled")
-var ErrSecretKeyTooShort = errors.New("secret Key too short (min 16 bytes)")
+var ErrStorageUnavailable = errors.New("storage unavailable")
+var ErrUserCountingNotSupported = errors.New("storage doesn't support counting users")
+var ErrSecretKeyTooShort = errors.New("secret key too short")
 var ErrInvalidChallenge = errors.New("invalid challenge")
 var ErrBrokenChallenge = errors.New("broken challenge")
 var ErrExpiredChallenge = errors.New("expired challenge")
@@ -55,212 +86,1021 @@ var ErrExpiredSessionId = errors.New("expired session id")
 // All functionalities needed to implement the Magic Link login system is available
 // through the AuthMagicLinkController.
 type AuthMagicLinkController struct {
-	secretKeyHash        []byte
-	challengeExpDuration time.Duration
-	sessionExpDuration   time.Duration
-	db                   UserAuthDatabase
+	keys                     *keySchedule
+	challengeExpDuration     time.Duration
+	sessionExpDuration       time.Duration
+	db                       UserStorage
+	userCache                *userCache
+	riskEvaluator            RiskEvaluator
+	clockSkew                time.Duration
+	auditLogger              AuditLogger
+	logger                   *slog.Logger
+	audience                 string
+	audienceTag              []byte
+	sessionGrace             time.Duration
+	challengeStore           ChallengeStore
+	maxOutstandingChallenges int
+	sessionTokenKeys         *keys.KeySet
+	secretKeyPolicy          SecretKeyPolicy
+	pendingLoginStore        PendingLoginStore
+	sessionStore             SessionStore
+	hashedEmailChallenges    bool
+	maxSessionsPerUser       int
+	sessionLimitPolicy       SessionLimitPolicy
+	bounceStore              BounceStore
+	macAlgorithm             MACAlgorithm
+	legacyMACAlgorithms      []MACAlgorithm // Accepted besides macAlgorithm
+	proofMaxAge              time.Duration
+	proofReplays             *seenCache
+	reissueMaxAge            time.Duration
+	reissuedChallenges       *seenCache
+	loginCodeLock            sync.Mutex
+	loginCodeAttempts        map[string]*loginCodeAttempts // Wrong login codes per e-mail address
+	onSessionExpired         func(ev SessionExpiredEvent)
+	namespace                string
+	disableLegacyKeys        bool
+	writeBehind              *writeBehind
+	userLocks                [64]sync.Mutex // Serialize the writes of the user records, see userLock()
+	sessionLifetimePolicy    SessionLifetimePolicy
+	disableTokenHeaders      bool
+	resendInterval           time.Duration
+	verifyURLTemplate        *verifyURLTemplate
+	blockedUserChallenges    BlockedUserChallenges
+	batchVerifyWorkers       int
+	emailDomains             *emailDomainRules
+	resends                  *seenCache // E-mail addresses, until they can be re-sent a challenge again
+	usedChallenges           UsedTokenStore
+	claimsProvider           ClaimsProvider
+	encryptedSessions        bool
+	sessionSnapshotFreshness time.Duration
+	refreshTokenStore        RefreshTokenStore
+	refreshTokenLifetime     time.Duration
+	apiTokenStore            APITokenStore
+	revocations              *revocationState
+	totpMaxFailures          int
+	totpLockoutDuration      time.Duration
 }
 
 // NewAuthMagicLinkController configures and creates a new instance of the AuthMagicLinkController.
-// The secretKey needs to be kept safe. To provide your own storage mechanism for the magic
-// link data, implement the UserAuthDatabase interface. There are file system and SQL database
-// implementations provided.
-func NewAuthMagicLinkController(secretKey []byte, challengeExpDuration time.Duration, sessionExpDuration time.Duration, db UserAuthDatabase) (mlc *AuthMagicLinkController, err error) {
-	if len(secretKey) < 16 {
-		return nil, ErrSecretKeyTooShort
-	}
-	keyHash := sha256.Sum256(secretKey)
-	return &AuthMagicLinkController{
-		secretKeyHash:        keyHash[:],
+// The secretKey needs to be kept safe, and at least 16 bytes long (see GenerateSecretKey()
+// and WithSecretKeyPolicy()). To provide your own storage mechanism for the magic
+// link data, implement the UserStorage interface (see UserAuthDatabase for the
+// capabilities the storages usually have). There are file system and SQL database
+// implementations provided. Optional features are enabled by passing ControllerOptions.
+func NewAuthMagicLinkController(secretKey []byte, challengeExpDuration time.Duration, sessionExpDuration time.Duration, db UserStorage, opts ...ControllerOption) (mlc *AuthMagicLinkController, err error) {
+	mlc = &AuthMagicLinkController{
+		keys:                 newKeySchedule(secretKey),
 		challengeExpDuration: challengeExpDuration,
 		sessionExpDuration:   sessionExpDuration,
 		db:                   db,
-	}, nil
+		logger:               slog.New(newRedactingHandler(slog.Default().Handler())).With("subsystem", SubsystemController),
+		secretKeyPolicy:      minimumSecretKeyPolicy,
+		resendInterval:       DefaultResendInterval,
+		resends:              newSeenCache(),
+		totpMaxFailures:      DefaultTOTPMaxFailures,
+		totpLockoutDuration:  DefaultTOTPLockoutDuration,
+	}
+	for _, opt := range opts {
+		opt(mlc)
+	}
+	if err = CheckSecretKey(secretKey, mlc.secretKeyPolicy); err != nil {
+		return nil, err
+	}
+	if !mlc.macAlgorithm.valid() {
+		return nil, ErrUnknownMACAlgorithm
+	}
+	for _, alg := range mlc.legacyMACAlgorithms {
+		if !alg.valid() {
+			return nil, ErrUnknownMACAlgorithm
+		}
+	}
+	if mlc.disableLegacyKeys {
+		mlc.keys.legacy = nil
+	}
+	if err = mlc.setupNamespace(); err != nil {
+		return nil, err
+	}
+	if mlc.verifyURLTemplate != nil {
+		if err = mlc.verifyURLTemplate.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if mlc.emailDomains != nil {
+		if err = mlc.emailDomains.compile(); err != nil {
+			return nil, err
+		}
+	}
+	if mlc.writeBehind != nil {
+		mlc.startWriteBehind()
+	}
+	return mlc, nil
 }
 
-func (mlc *AuthMagicLinkController) makeHMAC(payload []byte) []byte {
-	mac := hmac.New(sha256.New, mlc.secretKeyHash)
-	mac.Write(payload)
-	return mac.Sum(nil)
+func (mlc *AuthMagicLinkController) GetUserByEmail(email string) (*AuthUserRecord, error) {
+	return mlc.loadUserByEmail(email)
 }
 
-func (mlc *AuthMagicLinkController) GetUserByEmail(email string) (*AuthUserRecord, error) {
-	return mlc.db.GetUserByEmail(email)
+func (mlc *AuthMagicLinkController) GetUserById(id uuid.UUID) (*AuthUserRecord, error) {
+	return mlc.getUserById(id)
 }
 
+// StoreUser creates or updates the user record. With WithWriteBehind(), the record is
+// buffered and written later. The TokenEpoch of existing users is never decreased (see
+// UpdateUser()), so with write-behind, the stored record is read if the user has
+// nothing buffered.
 func (mlc *AuthMagicLinkController) StoreUser(user *AuthUserRecord) error {
-	return mlc.db.StoreUser(user)
+	if user.SessionSnapshot {
+		return ErrUserSnapshot
+	}
+	if mlc.writeBehind != nil && !mlc.writeBehind.closed() {
+		if mlc.userCache != nil {
+			defer mlc.userCache.invalidate(user.ID)
+		}
+		lock := mlc.userLock(user.GetID())
+		lock.Lock()
+		defer lock.Unlock()
+		current := mlc.writeBehind.getPending(user.ID)
+		if current == nil {
+			var err error
+			if current, err = mlc.db.GetUserById(user.ID); err != nil && err != ErrUserNotFound {
+				return err
+			}
+		}
+		if current != nil {
+			user.keepTokenEpoch(current)
+		}
+		mlc.writeBehind.buffer(user)
+		return nil
+	}
+	return mlc.storeUserNow(user)
+}
+
+func (mlc *AuthMagicLinkController) storeUserNow(user *AuthUserRecord) error {
+	if mlc.userCache != nil {
+		defer mlc.userCache.invalidate(user.ID)
+	}
+	lock := mlc.userLock(user.GetID())
+	lock.Lock()
+	defer lock.Unlock()
+	err := mlc.updateUserNow(user)
+	if err == ErrUserNotFound {
+		return mlc.createUserNow(user)
+	}
+	return err
+}
+
+// CreateUser stores a new user record, returning ErrUserAlreadyExists if a user with
+// the same ID or e-mail address already exists.
+func (mlc *AuthMagicLinkController) CreateUser(user *AuthUserRecord) error {
+	if user.SessionSnapshot {
+		return ErrUserSnapshot
+	}
+	if err := mlc.flushUser(user.ID); err != nil {
+		return err
+	}
+	return mlc.createUserNow(user)
+}
+
+func (mlc *AuthMagicLinkController) createUserNow(user *AuthUserRecord) error {
+	if mlc.userCache != nil {
+		defer mlc.userCache.invalidate(user.ID)
+	}
+	if err := CreateStoredUser(mlc.db, user); err != nil {
+		return err
+	}
+	mlc.audit(AuditEvent{Type: AuditUserCreated, UserID: user.ID, Email: user.Email})
+	return nil
+}
+
+// UpdateUser updates an existing user record, returning ErrUserNotFound if it doesn't exist.
+//
+// The user's TokenEpoch is kept if the stored one is larger, and copied to the record,
+// so writing a record loaded before InvalidateUserTokens(), e.g. by a request running
+// concurrently with it, doesn't make the invalidated sessions valid again. The stored
+// record is read for this with the user's writes serialized within the controller, but
+// not across app instances sharing the storage, where a write racing with
+// InvalidateUserTokens() within that read can still undo it. The other fields are
+// written as they are, including Enabled and the lock fields.
+func (mlc *AuthMagicLinkController) UpdateUser(user *AuthUserRecord) error {
+	if user.SessionSnapshot {
+		return ErrUserSnapshot
+	}
+	if err := mlc.flushUser(user.ID); err != nil {
+		return err
+	}
+	if mlc.userCache != nil {
+		defer mlc.userCache.invalidate(user.ID)
+	}
+	lock := mlc.userLock(user.GetID())
+	lock.Lock()
+	defer lock.Unlock()
+	return mlc.updateUserNow(user)
+}
+
+// updateUserNow updates the user record in the storage, keeping its TokenEpoch. The
+// caller holds the user's lock.
+func (mlc *AuthMagicLinkController) updateUserNow(user *AuthUserRecord) error {
+	stored, err := mlc.db.GetUserById(user.ID)
+	if err != nil {
+		return err
+	}
+	user.keepTokenEpoch(stored)
+	return UpdateStoredUser(mlc.db, user)
+}
+
+// keepTokenEpoch sets the record's TokenEpoch to the stored record's, if it's larger,
+// see UpdateUser().
+func (aur *AuthUserRecord) keepTokenEpoch(stored *AuthUserRecord) {
+	aur.TokenEpoch = max(aur.TokenEpoch, stored.TokenEpoch)
+}
+
+// userLock returns the mutex serializing the writes of the user's record.
+func (mlc *AuthMagicLinkController) userLock(id uuid.UUID) *sync.Mutex {
+	return &mlc.userLocks[int(id[len(id)-1])%len(mlc.userLocks)]
+}
+
+// modifyUser changes the user's record with fn, which is called on the record as stored,
+// and writes it, while holding the user's lock, so the change is made on the latest
+// state, e.g. for counters. If fn returns an error, the record isn't written, and the
+// error is returned. It returns the written record.
+func (mlc *AuthMagicLinkController) modifyUser(id uuid.UUID, fn func(user *AuthUserRecord) error) (user *AuthUserRecord, err error) {
+	if err = mlc.flushUser(id); err != nil {
+		return
+	}
+	if mlc.userCache != nil {
+		defer mlc.userCache.invalidate(id)
+	}
+	lock := mlc.userLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	if user, err = mlc.db.GetUserById(id); err != nil {
+		return nil, err
+	}
+	if err = fn(user); err != nil {
+		return nil, err
+	}
+	if err = UpdateStoredUser(mlc.db, user); err != nil {
+		return nil, err
+	}
+	if mlc.writeBehind != nil {
+		// The record buffered since the flush gets the new epoch
+		mlc.writeBehind.keepTokenEpoch(user)
+	}
+	return user, nil
+}
+
+// DeleteUser deletes the user record, and the user's sessions if a SessionStore is
+// configured. The storage needs to be a UserDeleter, or ErrUserDeletionNotSupported is
+// returned.
+func (mlc *AuthMagicLinkController) DeleteUser(id uuid.UUID) error {
+	if err := mlc.flushUser(id); err != nil {
+		return err
+	}
+	if mlc.userCache != nil {
+		defer mlc.userCache.invalidate(id)
+	}
+	if err := DeleteStoredUser(mlc.db, id); err != nil {
+		return err
+	}
+	return mlc.RevokeUserSessions(id)
+}
+
+// getUserById fetches the user record from the cache if it's enabled, or from the storage.
+func (mlc *AuthMagicLinkController) getUserById(id uuid.UUID) (*AuthUserRecord, error) {
+	if mlc.userCache != nil {
+		return mlc.userCache.get(id, mlc.loadUserById)
+	}
+	return mlc.loadUserById(id)
+}
+
+// loadUserById fetches the user record from the write-behind buffer if it's there, or
+// from the storage, bypassing the cache.
+func (mlc *AuthMagicLinkController) loadUserById(id uuid.UUID) (*AuthUserRecord, error) {
+	if mlc.writeBehind != nil {
+		if user := mlc.writeBehind.get(id); user != nil {
+			return user, nil
+		}
+	}
+	return mlc.db.GetUserById(id)
+}
+
+// loadUserByEmail is like loadUserById(), by the e-mail address.
+func (mlc *AuthMagicLinkController) loadUserByEmail(email string) (*AuthUserRecord, error) {
+	if mlc.writeBehind != nil {
+		if user := mlc.writeBehind.getByEmail(email); user != nil {
+			return user, nil
+		}
+	}
+	return mlc.db.GetUserByEmail(email)
 }
 
 func (mlc *AuthMagicLinkController) UserExistsByEmail(email string) bool {
+	if mlc.writeBehind != nil && mlc.writeBehind.getByEmail(email) != nil {
+		return true
+	}
 	return mlc.db.UserExistsByEmail(email)
 }
 
+// GetUserCount returns the number of users. Storages which aren't a UserCounter
+// need to be a UserLister, and all the users are listed; otherwise it returns
+// ErrUserCountingNotSupported.
 func (mlc *AuthMagicLinkController) GetUserCount() (int, error) {
-	return mlc.db.GetUserCount()
+	if err := mlc.FlushWrites(); err != nil {
+		return 0, err
+	}
+	return mlc.countUsers()
 }
 
+// UsersExist returns true if there are any users, e.g. to make the first one an
+// admin. Like GetUserCount(), it needs a UserCounter or a UserLister.
 func (mlc *AuthMagicLinkController) UsersExist() (bool, error) {
-	return mlc.db.UsersExist()
+	if mlc.writeBehind != nil && mlc.writeBehind.hasPending() {
+		return true, nil
+	}
+	if uc, ok := mlc.db.(UserCounter); ok {
+		return uc.UsersExist()
+	}
+	if ul, ok := mlc.db.(UserLister); ok {
+		page, err := ul.ListUsers(UserFilter{Limit: 1})
+		return len(page.Users) > 0, err
+	}
+	return false, ErrUserCountingNotSupported
+}
+
+// countUsers counts the users in the storage, see GetUserCount().
+func (mlc *AuthMagicLinkController) countUsers() (int, error) {
+	if uc, ok := mlc.db.(UserCounter); ok {
+		return uc.GetUserCount()
+	}
+	if ul, ok := mlc.db.(UserLister); ok {
+		page, err := ul.ListUsers(UserFilter{})
+		return len(page.Users), err
+	}
+	return 0, ErrUserCountingNotSupported
+}
+
+// isExpired checks the Unix timestamp expTime against the current time, allowing for the
+// configured clock skew between servers.
+func (mlc *AuthMagicLinkController) isExpired(expTime int) bool {
+	return int64(expTime) < time.Now().Add(-mlc.clockSkew).Unix()
 }
 
 // GenerateChallenge creates a challenge string to be used for constructing the magic link.
-// This challenge string needs to be verified by VerifyChallenge()
+// This challenge string needs to be verified by VerifyChallenge(). E-mail addresses which
+// don't pass ValidateEmail() are rejected with ErrInvalidEmail, and empty ones with
+// ErrEmptyEmail.
 func (mlc *AuthMagicLinkController) GenerateChallenge(email string) (challenge string, err error) {
-	// Challenge is in the format:
-	// SALT-EMAIL-EXPTIME-HMAC(SALT || EMAIL || EXPTIME, secredKeyHash)
+	return mlc.GenerateChallengeWithRisk(email, RiskInfo{})
+}
+
+// GenerateChallengeWithRisk is like GenerateChallenge(), but passes information about
+// the client to the RiskEvaluator, if one is configured.
+func (mlc *AuthMagicLinkController) GenerateChallengeWithRisk(email string, info RiskInfo) (challenge string, err error) {
+	challenge, _, err = mlc.generateChallenge(email, info, ChallengeMetadata{}, nil)
+	return
+}
+
+// GenerateChallengeWithMetadata is like GenerateChallenge(), but records the delivery
+// metadata in the audit log and the ChallengeStore. The metadata isn't embedded in the
+// challenge; pass it on to the MagicLinkSender in MagicLinkMessage.Metadata.
+func (mlc *AuthMagicLinkController) GenerateChallengeWithMetadata(email string, meta ChallengeMetadata) (challenge string, err error) {
+	challenge, _, err = mlc.generateChallenge(email, RiskInfo{}, meta, nil)
+	return
+}
+
+// GenerateChallengeWithReceipt is like GenerateChallengeWithMetadata(), but also returns
+// a receipt describing the challenge, which the app can keep to later correlate events
+// (such as a bounced e-mail) with the login attempt.
+func (mlc *AuthMagicLinkController) GenerateChallengeWithReceipt(email string, meta ChallengeMetadata) (challenge string, receipt *ChallengeReceipt, err error) {
+	return mlc.generateChallenge(email, RiskInfo{}, meta, nil)
+}
+
+// generateChallenge creates a challenge, bound to the proof key thumbprint if it's given.
+func (mlc *AuthMagicLinkController) generateChallenge(email string, info RiskInfo, meta ChallengeMetadata, proofKey []byte) (challenge string, receipt *ChallengeReceipt, err error) {
 	email = NormalizeEmail(email)
-	salt := make([]byte, saltLength)
-	_, err = rand.Read(salt)
+	if err = ValidateEmail(email); err != nil {
+		return
+	}
+	if err = mlc.CheckEmailDomain(email); err != nil {
+		return
+	}
+	if err = mlc.checkChallengeEmail(email, info); err != nil {
+		return
+	}
+	challenge, expTime, err := mlc.signChallenge(email, proofKey)
+	if err != nil {
+		return
+	}
+	receipt, err = newChallengeReceipt(email, challenge, time.Unix(expTime, 0))
+	if err != nil {
+		return "", nil, err
+	}
+	err = mlc.recordChallenge(challenge, receipt, meta)
+	if err != nil {
+		return "", nil, err
+	}
+	details := meta.auditDetails()
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["receipt_id"] = receipt.ID.String()
+	details["fingerprint"] = receipt.Fingerprint
+	mlc.audit(AuditEvent{Type: AuditChallengeIssued, Email: email, Details: details})
+	return challenge, receipt, nil
+}
+
+// checkChallengeEmail refuses to issue a challenge to the normalized e-mail address if it's
+// undeliverable, if it belongs to a blocked user (see WithBlockedUserChallenges()), or if
+// the RiskEvaluator rejects it.
+func (mlc *AuthMagicLinkController) checkChallengeEmail(email string, info RiskInfo) error {
+	suppressed, err := mlc.IsEmailSuppressed(email)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return ErrEmailUndeliverable
+	}
+	if err = mlc.checkBlockedUser(email); err != nil {
+		return err
+	}
+	if mlc.riskEvaluator == nil {
+		return nil
+	}
+	user, err := mlc.loadUserByEmail(email)
+	if err != nil && err != ErrUserNotFound {
+		return err
+	}
+	return mlc.evaluateRisk(RiskContext{RiskInfo: info, Stage: RiskStageGenerateChallenge, Email: email, User: user})
+}
+
+// signChallenge creates the challenge for the normalized e-mail address, bound to the
+// proof key thumbprint if it's given, and returns it with its expiration time.
+func (mlc *AuthMagicLinkController) signChallenge(email string, proofKey []byte) (challenge string, expTime int64, err error) {
+	// Challenge is in the format:
+	// SALT-EMAIL-EXPTIME-HMAC(SALT || EMAIL || EXPTIME, challengeKey)
+	// or with WithHashedEmailChallenges():
+	// SALT-EMAIL_HASH-EXPTIME-HMAC("H" || SALT || EMAIL || EXPTIME, challengeKey)
+	// Challenges bound to a proof key are prefixed with "P", and have the key's thumbprint
+	// before the HMAC, which also covers it:
+	// SALT-EMAIL-EXPTIME-THUMBPRINT-HMAC("P" || ... || THUMBPRINT, challengeKey)
+	salt, err := mlc.newSalt()
 	if err != nil {
 		return
 	}
-	expTime := time.Now().Add(mlc.challengeExpDuration).Unix()
-	hmac := mlc.makeHMAC(slices.Concat(salt, []byte{0}, []byte(email), []byte{0}, []byte(strconv.Itoa(int(expTime)))))
-	challenge = fmt.Sprintf("%s%s-%s-%d-%s", challengeSignature, encodeToString(salt), encodeToString([]byte(email)), expTime, encodeToString(hmac))
-	return challenge, nil
+	expTime = time.Now().Add(mlc.challengeExpDuration).Unix()
+	signature, emailPart := challengeSignature, []byte(email)
+	if mlc.hashedEmailChallenges {
+		signature, emailPart = hashedChallengeSignature, mlc.challengeEmailHash(mlc.macAlgorithm, mlc.keys.challenge, email)
+	}
+	payload := challengeHMACPayload(signature, salt, email, expTime)
+	if proofKey != nil {
+		payload = boundChallengeHMACPayload(payload, proofKey)
+	}
+	hmac := mlc.makeTokenHMAC(mlc.keys.challenge, payload)
+	buf := make([]byte, 0, len(signature)+b32.EncodedLen(len(salt))+b32.EncodedLen(len(emailPart))+b32.EncodedLen(len(proofKey))+b32.EncodedLen(len(hmac))+26)
+	if proofKey != nil {
+		buf = append(buf, boundChallengeSignature...)
+	}
+	buf = append(buf, signature...)
+	buf = b32.AppendEncode(buf, salt)
+	buf = append(buf, '-')
+	buf = b32.AppendEncode(buf, emailPart)
+	buf = append(buf, '-')
+	buf = strconv.AppendInt(buf, expTime, 10)
+	buf = append(buf, '-')
+	if proofKey != nil {
+		buf = b32.AppendEncode(buf, proofKey)
+		buf = append(buf, '-')
+	}
+	buf = b32.AppendEncode(buf, hmac)
+	return mlc.sealToken(string(buf)), expTime, nil
 }
 
 // VerifyChallenge verifies the challenge string generated by GenerateChallenge(),
 // and returns the AuthUserRecord corresponding to the user for which the challenge
 // was created (identifying them by their email address).
 func (mlc *AuthMagicLinkController) VerifyChallenge(challenge string) (user *AuthUserRecord, err error) {
-	if !strings.HasPrefix(challenge, challengeSignature) {
-		return nil, ErrInvalidChallenge
+	return mlc.VerifyChallengeWithRisk(challenge, RiskInfo{})
+}
+
+// VerifyChallengeWithRisk is like VerifyChallenge(), but passes information about
+// the client to the RiskEvaluator, if one is configured.
+func (mlc *AuthMagicLinkController) VerifyChallengeWithRisk(challenge string, info RiskInfo) (user *AuthUserRecord, err error) {
+	res, err := mlc.VerifyChallengeDetailed(challenge, info)
+	if err != nil {
+		return nil, err
+	}
+	return res.User, nil
+}
+
+// challengeHMACPayload returns the signed part of a challenge. Challenges with hashed
+// e-mail addresses are signed with their signature prefix, so one kind can't be
+// passed off as the other.
+func challengeHMACPayload(signature string, salt []byte, email string, expTime int64) []byte {
+	var prefix []byte
+	if signature != challengeSignature {
+		prefix = []byte(signature)
+	}
+	return slices.Concat(prefix, salt, []byte{0}, []byte(email), []byte{0}, []byte(strconv.FormatInt(expTime, 10)))
+}
+
+// boundChallengeHMACPayload returns the signed part of a challenge bound to a proof key.
+func boundChallengeHMACPayload(payload []byte, proofKey []byte) []byte {
+	return slices.Concat([]byte(boundChallengeSignature), payload, []byte{0}, proofKey)
+}
+
+// parsedChallenge is the information embedded in a challenge.
+type parsedChallenge struct {
+	Email    string
+	ExpTime  int
+	ProofKey []byte // Thumbprint of the proof key, for challenges bound to one
+}
+
+// parseChallenge verifies the signature of the challenge, and returns the information
+// embedded in it. Expired challenges are rejected with ErrExpiredChallenge, unless
+// allowExpired is set. The email argument is needed only for challenges with hashed
+// e-mail addresses when there's no ChallengeStore.
+func (mlc *AuthMagicLinkController) parseChallenge(challenge string, givenEmail string, allowExpired bool) (pc parsedChallenge, err error) {
+	var signature string
+	body, err := mlc.openToken(challenge)
+	if err != nil {
+		return pc, ErrInvalidChallenge
 	}
-	challenge = challenge[len(challengeSignature):]
-	parts := strings.Split(challenge, "-")
-	if len(parts) != 4 {
-		return nil, ErrInvalidChallenge
+	nParts := 4
+	if strings.HasPrefix(body, boundChallengeSignature) {
+		body, nParts = body[len(boundChallengeSignature):], 5
+	}
+	switch {
+	case strings.HasPrefix(body, challengeSignature):
+		signature = challengeSignature
+	case strings.HasPrefix(body, hashedChallengeSignature):
+		signature = hashedChallengeSignature
+	default:
+		return pc, ErrInvalidChallenge
+	}
+	parts := strings.Split(body[len(signature):], "-")
+	if len(parts) != nParts {
+		return pc, ErrInvalidChallenge
 	}
 
 	salt, err := decodeFromString(parts[0])
 	if err != nil {
-		return nil, ErrInvalidChallenge
+		return pc, ErrInvalidChallenge
+	}
+	if err = mlc.checkAudience(salt); err != nil {
+		return pc, err
 	}
-	email, err := decodeFromString(parts[1])
+	emailPart, err := decodeFromString(parts[1])
 	if err != nil {
-		return nil, ErrInvalidChallenge
+		return pc, ErrInvalidChallenge
 	}
 	expTime, err := strconv.Atoi(parts[2])
 	if err != nil {
-		return nil, ErrInvalidChallenge
+		return pc, ErrInvalidChallenge
 	}
-	if expTime < int(time.Now().Unix()) {
-		return nil, ErrExpiredChallenge
+	if !allowExpired && mlc.isExpired(expTime) {
+		return pc, ErrExpiredChallenge
+	}
+	var proofKey []byte
+	if nParts == 5 {
+		proofKey, err = decodeFromString(parts[3])
+		if err != nil || len(proofKey) != proofKeyThumbprintLength {
+			return pc, ErrInvalidChallenge
+		}
 	}
-	hmac1, err := decodeFromString(parts[3])
+	hmac1, err := decodeFromString(parts[nParts-1])
 	if err != nil {
-		return nil, ErrInvalidChallenge
+		return pc, ErrInvalidChallenge
 	}
-	hmac2 := mlc.makeHMAC(slices.Concat(salt, []byte{0}, []byte(email), []byte{0}, []byte(strconv.Itoa(int(expTime)))))
-	if !hmac.Equal(hmac1, hmac2) {
-		return nil, ErrBrokenChallenge
+	email := string(emailPart)
+	if signature == hashedChallengeSignature {
+		alg, ok := tokenMACAlgorithm(hmac1)
+		if !ok {
+			return pc, ErrBrokenChallenge
+		}
+		email, err = mlc.resolveChallengeEmail(challenge, alg, emailPart, givenEmail)
+		if err != nil {
+			return pc, err
+		}
+	} else if givenEmail != "" && NormalizeEmail(givenEmail) != email {
+		return pc, ErrBrokenChallenge
 	}
-	// We've verified the challenge, so assume the user is real.
-	// Now either create a new AuthUserRecord or load an existing one.
-	user, err = mlc.db.GetUserByEmail(string(email))
+	payload := challengeHMACPayload(signature, salt, email, int64(expTime))
+	if proofKey != nil {
+		payload = boundChallengeHMACPayload(payload, proofKey)
+	}
+	if !mlc.verifyTokenHMAC(mlc.keys.challenge, payload, hmac1) {
+		return pc, ErrBrokenChallenge
+	}
+	return parsedChallenge{Email: email, ExpTime: expTime, ProofKey: proofKey}, nil
+}
+
+// verifyChallenge verifies the challenge. The email argument is needed only for
+// challenges with hashed e-mail addresses when there's no ChallengeStore.
+func (mlc *AuthMagicLinkController) verifyChallenge(challenge string, givenEmail string, info RiskInfo) (user *AuthUserRecord, err error) {
+	res, err := mlc.verifyChallengeDetailed(challenge, givenEmail, info)
 	if err != nil {
-		if err == ErrUserNotFound {
-			user, err = NewAuthUserRecord(string(email))
-		}
+		return nil, err
 	}
+	return res.User, nil
+}
 
-	if user != nil {
-		if !user.Enabled {
-			return nil, ErrUserDisabled
+// verifyChallengeDetailed is verifyChallenge(), returning the VerificationResult.
+func (mlc *AuthMagicLinkController) verifyChallengeDetailed(challenge string, givenEmail string, info RiskInfo) (res *VerificationResult, err error) {
+	pc, err := mlc.parseChallenge(challenge, givenEmail, false)
+	if err != nil {
+		return nil, err
+	}
+	email, proofKey := pc.Email, pc.ProofKey
+	if err = mlc.CheckEmailDomain(email); err != nil {
+		return nil, err
+	}
+	issuedAt := time.Unix(int64(pc.ExpTime), 0).Add(-mlc.challengeExpDuration)
+	user, isNew, err := mlc.completeChallenge(challenge, email, pc.ExpTime, issuedAt, info)
+	if err != nil {
+		return nil, err
+	}
+	if proofKey != nil {
+		user.ProofKeyThumbprint = base64.RawURLEncoding.EncodeToString(proofKey)
+	}
+	return mlc.challengeResult(challenge, pc, user, isNew), nil
+}
+
+// completeChallenge makes the verified challenge for the normalized e-mail address
+// single-use, and loads or creates the user's record, refusing blocked users and those
+// the RiskEvaluator rejects.
+func (mlc *AuthMagicLinkController) completeChallenge(challenge string, email string, expTime int, issuedAt time.Time, info RiskInfo) (user *AuthUserRecord, isNew bool, err error) {
+	if err = mlc.consumeChallenge(challenge); err != nil {
+		return nil, false, err
+	}
+	if err = mlc.markChallengeUsed(challenge, expTime); err != nil {
+		return nil, false, err
+	}
+	// We've verified the challenge, so assume the user is real.
+	// Now either create a new AuthUserRecord or load an existing one.
+	user, err = mlc.loadUserByEmail(email)
+	if err == ErrUserNotFound {
+		if err = mlc.evaluateRisk(RiskContext{RiskInfo: info, Stage: RiskStageVerifyChallenge, Email: email}); err != nil {
+			return nil, false, err
 		}
-		user.RecentLoginTime = time.Now()
+		user, err = NewAuthUserRecord(email)
+		isNew = true
+	} else if err == nil {
+		err = mlc.evaluateRisk(RiskContext{RiskInfo: info, Stage: RiskStageVerifyChallenge, Email: email, User: user})
 	}
-	return
+	if err != nil {
+		return nil, false, err
+	}
+	if !user.Enabled {
+		return nil, false, ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, false, ErrUserLocked
+	}
+	user.RecentLoginTime = time.Now()
+	if user.EmailVerifiedAt.IsZero() {
+		user.EmailVerifiedAt = user.RecentLoginTime
+	}
+	user.TOTPPending = user.HasTOTP()
+	mlc.applySessionLifetimePolicy(user, issuedAt)
+	return user, isNew, nil
 }
 
 // GenerateSessionId generates a session id suitable for using as a cookie
-// in a web app.
+// in a web app. For users with the TOTPPending field set, it generates a pending
+// 2FA session instead (see VerifyPendingTOTPSession()). For users with the
+// ProofKeyThumbprint field set, it generates a signed session ID bound to the
+// key, which can only be verified with VerifySessionIdWithProof().
 func (mlc *AuthMagicLinkController) GenerateSessionId(user *AuthUserRecord) (sessionId string, err error) {
+	if user.TOTPPending {
+		return mlc.generatePendingTOTPSession(user)
+	}
+	var proofKey []byte
+	if user.ProofKeyThumbprint != "" {
+		if proofKey, err = proofKeyFromThumbprint(user.ProofKeyThumbprint); err != nil {
+			return
+		}
+	} else if mlc.sessionStore != nil {
+		return mlc.generateStoredSessionId(user)
+	} else if mlc.encryptedSessions {
+		return mlc.generateEncryptedSessionId(user)
+	}
 	// Session ID is in the format:
-	// SALT-USER_ID-EXPTIME-HMAC(SALT || USER_ID || EXPTIME, secretKeyHash)
-	salt := make([]byte, saltLength)
-	_, err = rand.Read(salt)
+	// SALT-USER_ID-EXPTIME-HMAC(SALT || USER_ID || EXPTIME, sessionKey)
+	// or for sessions bound to a proof key:
+	// SALT-USER_ID-EXPTIME-THUMBPRINT-HMAC("B" || SALT || USER_ID || EXPTIME || THUMBPRINT, sessionKey)
+	// or for sessions with claims from the ClaimsProvider:
+	// SALT-USER_ID-EXPTIME-CLAIMS-HMAC("C" || SALT || USER_ID || EXPTIME || CLAIMS, sessionKey)
+	// where EXPTIME is followed by "~EPOCH" if the user's TokenEpoch isn't 0
+	salt, err := mlc.newSalt()
 	if err != nil {
 		return
 	}
 	userId := user.ID.String()
 	expTime := 0
-	if mlc.sessionExpDuration > 0 {
-		expTime = int(time.Now().Add(mlc.sessionExpDuration).Unix())
+	if d := mlc.sessionDuration(user); d > 0 {
+		expTime = int(time.Now().Add(d).Unix())
 	}
-	expTimeStr := strconv.Itoa(expTime)
+	expTimeStr := sessionExpTimePart(expTime, user.TokenEpoch)
 
 	userIDBytes, err := user.ID.MarshalBinary()
 	if err != nil {
 		return
 	}
 
-	hmac := mlc.makeHMAC(slices.Concat(salt, []byte{0}, userIDBytes, []byte{0}, []byte(expTimeStr)))
+	payload := slices.Concat(salt, []byte{0}, userIDBytes, []byte{0}, []byte(expTimeStr))
+	if proofKey != nil {
+		payload = slices.Concat([]byte(boundSessionIdSignature), payload, []byte{0}, proofKey)
+		hmac := mlc.makeTokenHMAC(mlc.keys.session, payload)
+		return mlc.sealToken(strings.Join([]string{
+			boundSessionIdSignature + encodeToString(salt),
+			userId,
+			expTimeStr,
+			encodeToString(proofKey),
+			encodeToString(hmac),
+		}, sesionIdSplitChar)), nil
+	}
+	claims, err := mlc.sessionClaimsJSON(user)
+	if err != nil {
+		return
+	}
+	if claims != nil {
+		payload = slices.Concat([]byte(claimsSessionIdSignature), payload, []byte{0}, claims)
+		hmac := mlc.makeTokenHMAC(mlc.keys.session, payload)
+		return mlc.sealToken(strings.Join([]string{
+			claimsSessionIdSignature + encodeToString(salt),
+			userId,
+			expTimeStr,
+			encodeToString(claims),
+			encodeToString(hmac),
+		}, sesionIdSplitChar)), nil
+	}
+	hmac := mlc.makeTokenHMAC(mlc.keys.session, payload)
 
-	return strings.Join([]string{
+	return mlc.sealToken(strings.Join([]string{
 		sessionIdSignature + encodeToString(salt),
 		userId,
 		expTimeStr,
 		encodeToString(hmac),
-	}, sesionIdSplitChar), nil
+	}, sesionIdSplitChar)), nil
+}
+
+// ReuseOrGenerateSessionId returns existingSessionId (e.g. from the cookie the browser
+// sent along with the magic link) if it's a live session of the same user, so logging
+// in again on a device which is already logged in doesn't create a second session.
+// Otherwise, including for impersonation sessions and stale sessions within the grace
+// window, sessions bound to another proof key, sessions whose claims (see
+// WithClaimsProvider()) have changed, and encrypted sessions whose snapshot is no longer
+// fresh (see WithEncryptedSessions()), it generates a new session ID.
+// reused reports which one happened.
+func (mlc *AuthMagicLinkController) ReuseOrGenerateSessionId(user *AuthUserRecord, existingSessionId string) (sessionId string, reused bool, err error) {
+	if existingSessionId != "" {
+		claims, err := mlc.parseSessionId(existingSessionId)
+		if err == nil && claims.UserID == user.ID && claims.ImpersonatorID == uuid.Nil && !claims.Stale && claims.epochValid(user) &&
+			base64.RawURLEncoding.EncodeToString(claims.ProofKey) == user.ProofKeyThumbprint {
+			current, err := mlc.sessionClaimsJSON(user)
+			if err == nil && bytes.Equal(current, claims.Claims) &&
+				(claims.Snapshot == nil || mlc.snapshotFresh(claims.Snapshot) && claims.Snapshot.matches(user, current)) {
+				return existingSessionId, true, nil
+			}
+		}
+	}
+	sessionId, err = mlc.GenerateSessionId(user)
+	return sessionId, false, err
 }
 
 // VerifySessionId verifies the session ID generated by GenerateSessionId() and if it's valid,
-// returns the AuthUserRecord of the associated user.
+// returns the AuthUserRecord of the associated user. For sessions generated by
+// GenerateImpersonationSession(), the ImpersonatedBy field of the record is set.
+// If a grace window is set with WithSessionGrace(), recently expired sessions are
+// accepted with the StaleSession field set, and the app should issue a new session ID.
+// Sessions bound to a proof key are rejected with ErrProofRequired; verify them with
+// VerifySessionIdWithProof().
 func (mlc *AuthMagicLinkController) VerifySessionId(sessionId string) (user *AuthUserRecord, err error) {
-	if !strings.HasPrefix(sessionId, sessionIdSignature) {
-		slog.Error("Error finding sessionId prefix")
+	claims, err := mlc.parseSessionId(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ProofKey != nil {
+		return nil, ErrProofRequired
+	}
+	return mlc.sessionUser(claims)
+}
+
+// VerifySessionIdLight verifies the signature and the expiration time of the session ID
+// generated by GenerateSessionId(), and returns the ID of its user and its expiration
+// time (zero if it doesn't expire), without loading the user record, for hot paths which
+// only need the user ID. Because the record isn't loaded, disabling or locking the user
+// doesn't invalidate their sessions here; use VerifySessionId() where that matters.
+// Sessions within the grace window (see WithSessionGrace()) are accepted, with an
+// expiration time in the past. Server-side sessions (see WithSessionStore()) are still
+// looked up in the SessionStore, and sessions bound to a proof key are rejected with
+// ErrProofRequired. For impersonation sessions, the impersonated user's ID is returned.
+func (mlc *AuthMagicLinkController) VerifySessionIdLight(sessionId string) (userId uuid.UUID, expires time.Time, err error) {
+	claims, err := mlc.parseSessionId(sessionId)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+	if claims.ProofKey != nil {
+		return uuid.Nil, time.Time{}, ErrProofRequired
+	}
+	if claims.ExpTime != 0 {
+		expires = time.Unix(int64(claims.ExpTime), 0)
+	}
+	return claims.UserID, expires, nil
+}
+
+// sessionUser loads the user of a verified session, or takes it from the session's
+// snapshot while it's fresh.
+func (mlc *AuthMagicLinkController) sessionUser(claims sessionClaims) (user *AuthUserRecord, err error) {
+	if user = mlc.snapshotUser(claims); user != nil {
+		return mlc.checkSessionUser(claims, user)
+	}
+	// Now we're sure the session Id is validated, so the userId should be valid
+	user, err = mlc.getUserById(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return mlc.checkSessionUser(claims, user)
+}
+
+// snapshotUser returns the user from the snapshot of an encrypted session, or nil if the
+// session has no snapshot, or it's no longer fresh, so the user needs to be loaded.
+func (mlc *AuthMagicLinkController) snapshotUser(claims sessionClaims) *AuthUserRecord {
+	if claims.Snapshot == nil || !mlc.snapshotFresh(claims.Snapshot) {
+		return nil
+	}
+	return claims.Snapshot.user()
+}
+
+// checkSessionUser checks that the loaded user of the session can use it, and sets the
+// session's fields on the record.
+func (mlc *AuthMagicLinkController) checkSessionUser(claims sessionClaims, user *AuthUserRecord) (*AuthUserRecord, error) {
+	if !user.Enabled {
+		return nil, ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, ErrUserLocked
+	}
+	if !claims.epochValid(user) {
 		return nil, ErrInvalidSessionId
 	}
-	sessionId = sessionId[len(sessionIdSignature):]
+	if claims.ImpersonatorID != uuid.Nil {
+		if err := mlc.checkImpersonator(claims.ImpersonatorID, claims.ImpersonatorEpoch, user); err != nil {
+			return nil, err
+		}
+		user.ImpersonatedBy = claims.ImpersonatorID
+		mlc.audit(AuditEvent{Type: AuditImpersonationUsed, UserID: user.ID, ActorID: claims.ImpersonatorID, Email: user.Email})
+	}
+	user.StaleSession = claims.Stale
+	user.SessionClaims = claims.Claims
+	if claims.ProofKey != nil {
+		user.ProofKeyThumbprint = base64.RawURLEncoding.EncodeToString(claims.ProofKey)
+	}
+	user.RecentLoginTime = time.Now()
+	return user, nil
+}
+
+// sessionClaims is the information embedded in a session ID.
+type sessionClaims struct {
+	UserID            uuid.UUID
+	ExpTime           int              // Unix timestamp, 0 if the session doesn't expire
+	Epoch             int              // The user's TokenEpoch when the session was issued
+	ImpersonatorID    uuid.UUID        // Set for impersonation sessions
+	ImpersonatorEpoch int              // The admin's TokenEpoch when the impersonation session was issued
+	Stale             bool             // Expired, but within the grace window
+	ProofKey          []byte           // Thumbprint of the proof key, for sessions bound to one
+	IssuedAt          time.Time        // Known only for server-side and encrypted sessions
+	Stored            bool             // Server-side session
+	Claims            []byte           // JSON-encoded claims from the ClaimsProvider
+	Snapshot          *sessionSnapshot // User snapshot of an encrypted session
+}
+
+// parseSessionId verifies the signature and the expiration time of the session ID,
+// and returns the claims embedded in it.
+func (mlc *AuthMagicLinkController) parseSessionId(sessionId string) (claims sessionClaims, err error) {
+	fullSessionId := sessionId
+	if sessionId, err = mlc.openToken(sessionId); err != nil {
+		return claims, ErrInvalidSessionId
+	}
+	nParts := 4
+	signature := sessionIdSignature
+	if strings.HasPrefix(sessionId, impersonationSessionIdSignature) {
+		sessionId = sessionId[len(impersonationSessionIdSignature):]
+		nParts, signature = 5, impersonationSessionIdSignature
+	} else if strings.HasPrefix(sessionId, boundSessionIdSignature) {
+		sessionId = sessionId[len(boundSessionIdSignature):]
+		nParts, signature = 5, boundSessionIdSignature
+	} else if strings.HasPrefix(sessionId, claimsSessionIdSignature) {
+		sessionId = sessionId[len(claimsSessionIdSignature):]
+		nParts, signature = 5, claimsSessionIdSignature
+	} else if strings.HasPrefix(sessionId, sessionIdSignature) {
+		sessionId = sessionId[len(sessionIdSignature):]
+	} else if strings.HasPrefix(sessionId, storedSessionIdSignature) {
+		return mlc.parseStoredSessionId(sessionId)
+	} else if strings.HasPrefix(sessionId, encryptedSessionIdSignature) {
+		return mlc.parseEncryptedSessionId(fullSessionId, sessionId)
+	} else if strings.HasPrefix(sessionId, totpPendingSessionIdSignature) {
+		return claims, ErrTOTPRequired
+	} else {
+		mlc.logger.Error("Error finding sessionId prefix")
+		return claims, ErrInvalidSessionId
+	}
 	parts := strings.Split(sessionId, sesionIdSplitChar)
-	if len(parts) != 4 {
-		slog.Error("Error in splitting sessionId", "parts", parts, "sessionId", sessionId)
-		return nil, ErrInvalidSessionId
+	if len(parts) != nParts {
+		mlc.logger.Error("Error in splitting sessionId", "session_fingerprint", tokenFingerprint(sessionId))
+		return claims, ErrInvalidSessionId
 	}
 
 	salt, err := decodeFromString(parts[0])
 	if err != nil {
-		slog.Error("Error decoding part 0", "error", err)
-		return nil, ErrInvalidSessionId
+		mlc.logger.Error("Error decoding part 0", "error", err)
+		return claims, ErrInvalidSessionId
+	}
+	if err = mlc.checkAudience(salt); err != nil {
+		return claims, err
 	}
-	userId, err := uuid.Parse(parts[1])
+	userId, err := parseTokenUUID(parts[1])
 	if err != nil {
-		slog.Error("Error parsing UUID", "error", err)
-		return nil, ErrInvalidSessionId
+		mlc.logger.Error("Error parsing UUID", "error", err)
+		return claims, ErrInvalidSessionId
 	}
-	expTime, err := strconv.Atoi(parts[2])
+	expTime, epoch, err := parseSessionExpTimePart(parts[2])
 	if err != nil {
-		slog.Error("Error decoding expTime", "error", err)
-		return nil, ErrInvalidSessionId
+		mlc.logger.Error("Error decoding expTime", "error", err)
+		return claims, ErrInvalidSessionId
 	}
-	if expTime < int(time.Now().Unix()) {
-		slog.Error("Session ID expired")
-		return nil, ErrExpiredSessionId
+	stale, expired := false, false
+	if expTime != 0 && mlc.isExpired(expTime) {
+		// Impersonation sessions are never extended
+		if signature != impersonationSessionIdSignature && mlc.sessionGrace > 0 && !mlc.isExpired(expTime+int(mlc.sessionGrace.Seconds())) {
+			stale = true
+		} else {
+			// Reported after the HMAC is verified, so forged session IDs aren't
+			expired = true
+		}
 	}
-	hmac1, err := decodeFromString(parts[3])
+	hmac1, err := decodeFromString(parts[nParts-1])
 	if err != nil {
-		slog.Error("Error decoding part 3", "error", err)
-		return nil, ErrInvalidSessionId
+		mlc.logger.Error("Error decoding HMAC part", "error", err)
+		return claims, ErrInvalidSessionId
 	}
 	userIdBinary, err := userId.MarshalBinary()
 	if err != nil {
-		slog.Error("Error marshaling userID to binary", "error", err)
-		return nil, ErrInvalidSessionId
+		mlc.logger.Error("Error marshaling userID to binary", "error", err)
+		return claims, ErrInvalidSessionId
 	}
-	hmac2 := mlc.makeHMAC(slices.Concat(salt, []byte{0}, userIdBinary, []byte{0}, []byte(parts[2])))
-	if !hmac.Equal(hmac1, hmac2) {
-		return nil, ErrBrokenSessionId
+	payload := slices.Concat(salt, []byte{0}, userIdBinary, []byte{0}, []byte(parts[2]))
+	var impersonatorId uuid.UUID
+	var impersonatorEpoch int
+	var proofKey, claimsJSON []byte
+	switch signature {
+	case impersonationSessionIdSignature:
+		impersonatorId, impersonatorEpoch, err = parseImpersonatorPart(parts[3])
+		if err != nil {
+			mlc.logger.Error("Error parsing impersonator", "error", err)
+			return claims, ErrInvalidSessionId
+		}
+		payload = slices.Concat([]byte(impersonationSessionIdSignature), payload, []byte{0}, impersonatorPayload(impersonatorId, impersonatorEpoch))
+	case boundSessionIdSignature:
+		proofKey, err = decodeFromString(parts[3])
+		if err != nil || len(proofKey) != proofKeyThumbprintLength {
+			mlc.logger.Error("Error decoding proof key thumbprint", "error", err)
+			return claims, ErrInvalidSessionId
+		}
+		payload = slices.Concat([]byte(boundSessionIdSignature), payload, []byte{0}, proofKey)
+	case claimsSessionIdSignature:
+		claimsJSON, err = decodeFromString(parts[3])
+		if err != nil || len(claimsJSON) == 0 {
+			mlc.logger.Error("Error decoding session claims", "error", err)
+			return claims, ErrInvalidSessionId
+		}
+		payload = slices.Concat([]byte(claimsSessionIdSignature), payload, []byte{0}, claimsJSON)
 	}
-	// Now we're sure the session Id is validated, so the userId should be valid
-	user, err = mlc.db.GetUserById(userId)
-	if !user.Enabled {
-		return nil, ErrUserDisabled
+	if !mlc.verifyTokenHMAC(mlc.keys.session, payload, hmac1) {
+		return claims, ErrBrokenSessionId
 	}
-	user.RecentLoginTime = time.Now()
-	return
+	// Impersonation sessions issued before their validity was limited
+	if signature == impersonationSessionIdSignature && int64(expTime) > time.Now().Add(MaxImpersonationTTL+mlc.clockSkew).Unix() {
+		return claims, ErrInvalidSessionId
+	}
+	if expired {
+		mlc.logger.Error("Session ID expired")
+		if signature != impersonationSessionIdSignature {
+			ev := SessionExpiredEvent{SessionID: storedSessionHash(fullSessionId), UserID: userId, ExpiredAt: time.Unix(int64(expTime), 0), DetectedBy: SessionExpiryDetectedOnVerify}
+			if mlc.sessionExpDuration > 0 {
+				ev.CreatedAt = ev.ExpiredAt.Add(-mlc.sessionExpDuration)
+			}
+			mlc.sessionExpired(ev)
+		}
+		return claims, ErrExpiredSessionId
+	}
+	if mlc.revocations != nil {
+		if err = mlc.checkRevocation(fullSessionId, userId, expTime); err != nil {
+			return claims, err
+		}
+	}
+	return sessionClaims{UserID: userId, ExpTime: expTime, Epoch: epoch, ImpersonatorID: impersonatorId, ImpersonatorEpoch: impersonatorEpoch, Stale: stale, ProofKey: proofKey, Claims: claimsJSON}, nil
 }
 
 // AuthUser represents user data
@@ -271,12 +1111,71 @@ type AuthUserRecord struct {
 	AccessLevel     int               `json:"access_level"`
 	FirstLoginTime  time.Time         `json:"first_login_time"`
 	RecentLoginTime time.Time         `json:"recent_login_time"`
-	CustomData      map[string]string `json:"custom_data"` // Apps can attach custom data to the user record
+	EmailVerifiedAt time.Time         `json:"email_verified_at"` // Set on the first successful VerifyChallenge()
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`            // Set by the storage on each StoreUser()
+	CustomData      map[string]string `json:"custom_data"`           // Apps can attach custom data to the user record
+	Memberships     []OrgMembership   `json:"memberships,omitempty"` // Organizations the user belongs to
+	LockedAt        time.Time         `json:"locked_at"`             // Set by LockUser()
+	LockedUntil     time.Time         `json:"locked_until"`          // Zero if the lock doesn't expire
+	LockReason      string            `json:"lock_reason,omitempty"`
+	TOTPSecret      []byte            `json:"totp_secret,omitempty"` // Encrypted; set by ConfirmTOTP()
+	TOTPEnabledAt   time.Time         `json:"totp_enabled_at"`       // Set by ConfirmTOTP()
+	TOTPLastStep    int64             `json:"totp_last_step,omitempty"`
+
+	TOTPPendingSecret []byte `json:"totp_pending_secret,omitempty"` // Encrypted; set by EnrollTOTP(), moved to TOTPSecret by ConfirmTOTP()
+	TOTPFailures      int    `json:"totp_failures,omitempty"`       // Consecutive wrong codes given to VerifyTOTP() and ConfirmTOTP()
+
+	AntiPhishingPhrase string `json:"anti_phishing_phrase,omitempty"` // Chosen by the user, included in the magic link messages; set by SetAntiPhishingPhrase()
+	TokenEpoch         int    `json:"token_epoch,omitempty"`          // Embedded in the sessions, which are invalid once it changes; incremented by InvalidateUserTokens()
+
+	ImpersonatedBy uuid.UUID `json:"-"` // Set by VerifySessionId() for impersonation sessions; not stored
+	StaleSession   bool      `json:"-"` // Set by VerifySessionId() for expired sessions within the grace window; not stored
+	TOTPPending    bool      `json:"-"` // Set by VerifyChallenge() for users with TOTP enabled, until VerifyTOTP(); not stored
+	// Set by VerifyChallenge() with a session lifetime policy (see WithSessionLifetimePolicy()), to
+	// shorten the sessions generated for the login; not stored
+	SessionLifetime time.Duration `json:"-"`
+	// Set by VerifyChallenge() for challenges bound to a proof key (see GenerateChallengeWithProofKey()),
+	// and by VerifySessionIdWithProof(); not stored
+	ProofKeyThumbprint string `json:"-"`
+	// Set by VerifySessionId() to the JSON-encoded claims embedded in the session ID (see
+	// WithClaimsProvider()); not stored
+	SessionClaims json.RawMessage `json:"-"`
+	// Set by VerifySessionId() for records taken from the snapshot in an encrypted session
+	// (see WithEncryptedSessions()), which only have the ID, Email, AccessLevel and
+	// Memberships; such records can't be stored (ErrUserSnapshot). Not stored
+	SessionSnapshot bool `json:"-"`
+	// Set by VerifyAPIToken() to the record of the API token which authenticated the user;
+	// not stored
+	APIToken *APITokenRecord `json:"-"`
+}
+
+// OrgMembership links a user to an organization. See the `orgs` package.
+type OrgMembership struct {
+	OrgID    uuid.UUID `json:"org_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// GetMembership returns the user's membership in the organization, or nil if they
+// aren't a member.
+func (aur *AuthUserRecord) GetMembership(orgID uuid.UUID) *OrgMembership {
+	for i := range aur.Memberships {
+		if aur.Memberships[i].OrgID == orgID {
+			return &aur.Memberships[i]
+		}
+	}
+	return nil
 }
 
-// NewAuthUserRecords constructs a new AuthUserRecord. This function isn't normally
-// directly called by the users of this package.
+// NewAuthUserRecords constructs a new AuthUserRecord, with the normalized e-mail address,
+// which must pass ValidateEmail(). This function isn't normally directly called by the
+// users of this package.
 func NewAuthUserRecord(email string) (aur *AuthUserRecord, err error) {
+	email = NormalizeEmail(email)
+	if err = ValidateEmail(email); err != nil {
+		return
+	}
 	newID, err := uuid.NewV7()
 	if err != nil {
 		return
@@ -284,15 +1183,35 @@ func NewAuthUserRecord(email string) (aur *AuthUserRecord, err error) {
 	now := time.Now()
 	aur = &AuthUserRecord{
 		ID:              newID,
-		Email:           NormalizeEmail(email),
+		Email:           email,
 		Enabled:         true,
 		FirstLoginTime:  now,
 		RecentLoginTime: now,
+		CreatedAt:       now,
+		UpdatedAt:       now,
 		CustomData:      nil,
 	}
 	return aur, nil
 }
 
+// IsEmailVerified returns true if the user has verified their e-mail address by
+// completing a magic link challenge.
+func (aur *AuthUserRecord) IsEmailVerified() bool {
+	return !aur.EmailVerifiedAt.IsZero()
+}
+
+// Touch updates the UpdatedAt timestamp, and sets CreatedAt for records which were
+// stored before it existed. Storage implementations call it in StoreUser().
+func (aur *AuthUserRecord) Touch() {
+	aur.UpdatedAt = time.Now()
+	if aur.CreatedAt.IsZero() {
+		aur.CreatedAt = aur.FirstLoginTime
+		if aur.CreatedAt.IsZero() {
+			aur.CreatedAt = aur.UpdatedAt
+		}
+	}
+}
+
 // Returns the user ID.
 func (aur *AuthUserRecord) GetID() uuid.UUID {
 	if aur.ID == uuid.Nil {
@@ -317,12 +1236,28 @@ func (aur *AuthUserRecord) GetKeyName() string {
 	return fmt.Sprintf("_%s_%s", aur.ID.String(), aur.Email)
 }
 
-// Binary-string encoding
+// Binary-string encoding, shared by all tokens
 func encodeToString(b []byte) string {
-	return strings.TrimRight(base32.StdEncoding.EncodeToString(b), "=")
+	return b32.EncodeToString(b)
 }
 
 func decodeFromString(s string) ([]byte, error) {
-	s = s + strings.Repeat("=", 8-(len(s)%8))
-	return base32.StdEncoding.DecodeString(s)
+	return b32.DecodeString(s)
+}
+
+var errNonCanonicalUUID = errors.New("UUID not in the canonical form")
+
+// parseTokenUUID parses a UUID in a token. Only the form in which tokens are generated
+// is accepted (lower-case, with hyphens), as the token's HMAC covers the UUID's bytes,
+// not its text, so a copy of the token with the UUID in upper case would otherwise be
+// a different valid token.
+func parseTokenUUID(s string) (uuid.UUID, error) {
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if id.String() != s {
+		return uuid.Nil, errNonCanonicalUUID
+	}
+	return id, nil
 }
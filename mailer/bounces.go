@@ -0,0 +1,418 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+const maxNotificationSize = 1 << 20
+
+var ErrInvalidNotificationSignature = errors.New("invalid notification signature")
+
+// snsCertHost matches the hosts from which Amazon SNS signing certificates are loaded.
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// SESOptions configures the SESNotificationHandler.
+type SESOptions struct {
+	// TopicARNs are the SNS topics the handler accepts notifications from. Required.
+	TopicARNs []string
+	// ConfirmSubscriptions makes the handler confirm SNS subscriptions to the topics.
+	ConfirmSubscriptions bool
+	// Client is used for fetching SNS signing certificates and confirming subscriptions.
+	// Default has a 10s timeout.
+	Client *http.Client
+	// Logger, if set, receives rejected notifications and errors.
+	Logger *slog.Logger
+}
+
+// snsMessage is an Amazon SNS HTTP(S) message.
+type snsMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+// sesNotification is an SES bounce or complaint notification (or event), carried in
+// the SNS message.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageId string `json:"messageId"`
+	} `json:"mail"`
+	Bounce struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// SESNotificationHandler returns a http.Handler receiving Amazon SES bounce and complaint
+// notifications through an SNS topic subscription (HTTPS endpoint). The SNS message
+// signatures are verified, and the bounces are recorded with the controller's RecordBounce().
+func SESNotificationHandler(mlc *gomagiclink.AuthMagicLinkController, opts SESOptions) http.Handler {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	verifier := &snsVerifier{client: opts.Client, certs: map[string]crypto.PublicKey{}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
+		if err != nil {
+			http.Error(w, "Error reading the body", http.StatusBadRequest)
+			return
+		}
+		var msg snsMessage
+		if err = json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, "Invalid SNS message", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(opts.TopicARNs, msg.TopicArn) {
+			logWarn(opts.Logger, "SNS message from an unknown topic", "topic", msg.TopicArn)
+			http.Error(w, "Unknown topic", http.StatusForbidden)
+			return
+		}
+		if err = verifier.verify(&msg); err != nil {
+			logWarn(opts.Logger, "SNS message with an invalid signature", "topic", msg.TopicArn, "error", err)
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+
+		switch msg.Type {
+		case "SubscriptionConfirmation":
+			if !opts.ConfirmSubscriptions {
+				logWarn(opts.Logger, "Ignoring SNS subscription confirmation", "topic", msg.TopicArn)
+				break
+			}
+			if err = confirmSNSSubscription(opts.Client, msg.SubscribeURL); err != nil {
+				logError(opts.Logger, "Error confirming SNS subscription", "topic", msg.TopicArn, "error", err)
+				http.Error(w, "Error confirming the subscription", http.StatusBadGateway)
+				return
+			}
+		case "Notification":
+			var n sesNotification
+			if err = json.Unmarshal([]byte(msg.Message), &n); err != nil {
+				http.Error(w, "Invalid SES notification", http.StatusBadRequest)
+				return
+			}
+			for _, rec := range n.bounceRecords() {
+				if err = mlc.RecordBounce(rec); err != nil {
+					logError(opts.Logger, "Error recording bounce", "error", err)
+					http.Error(w, "Error recording the bounce", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// bounceRecords converts the notification to BounceRecords; other notification types
+// (such as deliveries) have none.
+func (n *sesNotification) bounceRecords() (recs []gomagiclink.BounceRecord) {
+	notificationType := n.NotificationType
+	if notificationType == "" {
+		notificationType = n.EventType
+	}
+	switch notificationType {
+	case "Bounce":
+		bounceType := gomagiclink.BounceSoft
+		if n.Bounce.BounceType == "Permanent" {
+			bounceType = gomagiclink.BounceHard
+		}
+		for _, r := range n.Bounce.BouncedRecipients {
+			reason := r.DiagnosticCode
+			if reason == "" {
+				reason = n.Bounce.BounceType + "/" + n.Bounce.BounceSubType
+			}
+			recs = append(recs, gomagiclink.BounceRecord{Email: r.EmailAddress, Type: bounceType, Provider: "ses", Reason: reason, MessageID: n.Mail.MessageId})
+		}
+	case "Complaint":
+		for _, r := range n.Complaint.ComplainedRecipients {
+			recs = append(recs, gomagiclink.BounceRecord{Email: r.EmailAddress, Type: gomagiclink.BounceComplaint, Provider: "ses", Reason: n.Complaint.ComplaintFeedbackType, MessageID: n.Mail.MessageId})
+		}
+	}
+	return recs
+}
+
+// snsVerifier verifies SNS message signatures, caching the signing certificates.
+type snsVerifier struct {
+	client *http.Client
+	lock   sync.Mutex
+	certs  map[string]crypto.PublicKey
+}
+
+// signedString returns the string SNS signs for the message type.
+func (msg *snsMessage) signedString() string {
+	var fields []string
+	switch msg.Type {
+	case "Notification":
+		fields = []string{"Message", msg.Message, "MessageId", msg.MessageId}
+		if msg.Subject != "" {
+			fields = append(fields, "Subject", msg.Subject)
+		}
+		fields = append(fields, "Timestamp", msg.Timestamp, "TopicArn", msg.TopicArn, "Type", msg.Type)
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = []string{"Message", msg.Message, "MessageId", msg.MessageId, "SubscribeURL", msg.SubscribeURL,
+			"Timestamp", msg.Timestamp, "Token", msg.Token, "TopicArn", msg.TopicArn, "Type", msg.Type}
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+func (sv *snsVerifier) verify(msg *snsMessage) error {
+	var hash crypto.Hash
+	switch msg.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return ErrInvalidNotificationSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return ErrInvalidNotificationSignature
+	}
+	key, err := sv.certKey(msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return ErrInvalidNotificationSignature
+	}
+	signed := []byte(msg.signedString())
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum(signed)
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	}
+	if rsa.VerifyPKCS1v15(rsaKey, hash, digest, sig) != nil {
+		return ErrInvalidNotificationSignature
+	}
+	return nil
+}
+
+// certKey fetches the signing certificate, only from the SNS hosts, and returns its public key.
+func (sv *snsVerifier) certKey(certURL string) (crypto.PublicKey, error) {
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Hostname()) || u.Port() != "" {
+		return nil, ErrInvalidNotificationSignature
+	}
+	sv.lock.Lock()
+	key, ok := sv.certs[certURL]
+	sv.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+	resp, err := sv.client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrInvalidNotificationSignature
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidNotificationSignature
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	sv.lock.Lock()
+	sv.certs[certURL] = cert.PublicKey
+	sv.lock.Unlock()
+	return cert.PublicKey, nil
+}
+
+func confirmSNSSubscription(client *http.Client, subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Hostname()) {
+		return ErrInvalidNotificationSignature
+	}
+	resp, err := client.Get(subscribeURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("subscription confirmation failed: " + resp.Status)
+	}
+	return nil
+}
+
+// SendGridOptions configures the SendGridEventHandler.
+type SendGridOptions struct {
+	// VerificationKey is the public key shown in the SendGrid Event Webhook settings
+	// (base64-encoded), for verifying the signed events. Required.
+	VerificationKey string
+	// MaxAge is the maximum age of the signature timestamp, default 10 minutes.
+	MaxAge time.Duration
+	// Logger, if set, receives rejected requests and errors.
+	Logger *slog.Logger
+}
+
+// Headers of SendGrid's signed event webhook requests
+const (
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+type sendGridEvent struct {
+	Email     string `json:"email"`
+	Event     string `json:"event"`
+	Type      string `json:"type"` // For bounces: "bounce" or "blocked"
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+	MessageID string `json:"sg_message_id"`
+}
+
+// SendGridEventHandler returns a http.Handler receiving SendGrid Event Webhook requests.
+// The request signatures are verified, and bounce, dropped and spam report events are
+// recorded with the controller's RecordBounce(); other events are ignored.
+func SendGridEventHandler(mlc *gomagiclink.AuthMagicLinkController, opts SendGridOptions) (http.Handler, error) {
+	der, err := base64.StdEncoding.DecodeString(opts.VerificationKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("SendGrid verification key isn't an ECDSA key")
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 10 * time.Minute
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
+		if err != nil {
+			http.Error(w, "Error reading the body", http.StatusBadRequest)
+			return
+		}
+		if err = verifySendGridSignature(key, r.Header.Get(SendGridTimestampHeader), r.Header.Get(SendGridSignatureHeader), body, opts.MaxAge); err != nil {
+			logWarn(opts.Logger, "SendGrid event with an invalid signature", "remote_addr", r.RemoteAddr)
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		var events []sendGridEvent
+		if err = json.Unmarshal(body, &events); err != nil {
+			http.Error(w, "Invalid events", http.StatusBadRequest)
+			return
+		}
+		for _, ev := range events {
+			rec := gomagiclink.BounceRecord{Email: ev.Email, Provider: "sendgrid", Reason: ev.Reason, MessageID: ev.MessageID}
+			if ev.Timestamp != 0 {
+				rec.Time = time.Unix(ev.Timestamp, 0)
+			}
+			switch {
+			case ev.Event == "bounce" && ev.Type == "blocked":
+				rec.Type = gomagiclink.BounceSoft
+			case ev.Event == "bounce" || ev.Event == "dropped":
+				rec.Type = gomagiclink.BounceHard
+			case ev.Event == "spamreport":
+				rec.Type = gomagiclink.BounceComplaint
+			default:
+				continue
+			}
+			if err = mlc.RecordBounce(rec); err != nil {
+				logError(opts.Logger, "Error recording bounce", "error", err)
+				http.Error(w, "Error recording the bounce", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), nil
+}
+
+// verifySendGridSignature checks the ECDSA signature of timestamp+body.
+func verifySendGridSignature(key *ecdsa.PublicKey, timestamp string, signature string, body []byte, maxAge time.Duration) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || timestamp == "" {
+		return ErrInvalidNotificationSignature
+	}
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		var unix int64
+		if err = json.Unmarshal([]byte(timestamp), &unix); err != nil {
+			return ErrInvalidNotificationSignature
+		}
+		ts = time.Unix(unix, 0)
+	}
+	if age := time.Since(ts); age > maxAge || age < -maxAge {
+		return ErrInvalidNotificationSignature
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(key, digest[:], sig) {
+		return ErrInvalidNotificationSignature
+	}
+	return nil
+}
+
+func logWarn(logger *slog.Logger, msg string, args ...any) {
+	if logger != nil {
+		logger.Warn(msg, args...)
+	}
+}
+
+func logError(logger *slog.Logger, msg string, args ...any) {
+	if logger != nil {
+		logger.Error(msg, args...)
+	}
+}
@@ -0,0 +1,128 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/internal/qr"
+)
+
+// ConsoleSender is a MagicLinkSender for development, which prints the magic links to
+// the console (or a logger) instead of sending them, optionally with a QR code to open
+// them on a phone. Don't use it in production.
+type ConsoleSender struct {
+	Writer io.Writer    // Default os.Stdout
+	Logger *slog.Logger // If set, the messages are logged instead of printed, without the QR code
+	Color  bool         // Use ANSI colors
+	QR     bool         // Print a QR code with the link
+}
+
+// NewConsoleSender creates a ConsoleSender printing to the writer, with colors if it's
+// a terminal and the NO_COLOR environment variable isn't set.
+func NewConsoleSender(w io.Writer) *ConsoleSender {
+	return &ConsoleSender{Writer: w, Color: isTerminal(w) && os.Getenv("NO_COLOR") == ""}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiDim   = "\x1b[2m"
+	ansiCyan  = "\x1b[36m"
+	ansiQR    = "\x1b[30;47m" // Black on white
+)
+
+func (cs *ConsoleSender) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	if cs.Logger != nil {
+		attrs := []any{"email", msg.Email, "link", msg.Link}
+		if !msg.ExpiresAt.IsZero() {
+			attrs = append(attrs, "expires_at", msg.ExpiresAt)
+		}
+		if msg.Code != "" {
+			attrs = append(attrs, "code", msg.Code)
+		}
+		cs.Logger.InfoContext(ctx, "Magic link", attrs...)
+		return nil
+	}
+
+	style := func(s string, codes string) string {
+		if !cs.Color {
+			return s
+		}
+		return codes + s + ansiReset
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n%s %s\n", style("Magic link for", ansiDim), style(msg.Email, ansiBold))
+	if msg.AntiPhishingPhrase != "" {
+		fmt.Fprintf(&sb, "%s %s\n", style("Anti-phishing phrase:", ansiDim), msg.AntiPhishingPhrase)
+	}
+	fmt.Fprintf(&sb, "\n  %s\n\n", style(msg.Link, ansiBold+ansiCyan))
+	if msg.Code != "" {
+		fmt.Fprintf(&sb, "%s %s\n", style("Login code:", ansiDim), style(msg.Code, ansiBold))
+	}
+	if !msg.ExpiresAt.IsZero() {
+		fmt.Fprintf(&sb, "%s %s (in %s)\n", style("Expires at", ansiDim), msg.ExpiresAt.Format(time.TimeOnly),
+			time.Until(msg.ExpiresAt).Round(time.Second))
+	}
+	if cs.QR {
+		code, err := qr.Encode([]byte(msg.Link), qr.LevelL)
+		if err != nil {
+			return err
+		}
+		sb.WriteByte('\n')
+		writeQR(&sb, code, cs.Color)
+	}
+
+	w := cs.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeQR draws the QR code with half blocks, two rows of modules per line. With colors,
+// it's drawn black on white; without them, it's inverted for the usual dark terminal
+// background, which most scanners handle.
+func writeQR(sb *strings.Builder, code *qr.Code, color bool) {
+	const quietZone = 4
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		if color {
+			sb.WriteString(ansiQR)
+		}
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			top, bottom := code.Dark(x, y), code.Dark(x, y+1)
+			if !color {
+				top, bottom = !top, !bottom
+			}
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteByte(' ')
+			}
+		}
+		if color {
+			sb.WriteString(ansiReset)
+		}
+		sb.WriteByte('\n')
+	}
+}
@@ -0,0 +1,108 @@
+// Package mailer contains implementations of gomagiclink.MagicLinkSender.
+package mailer
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// DevMailbox is a MagicLinkSender for development, which doesn't send anything,
+// but keeps the most recent messages in memory and shows them on a HTML page, so
+// developers can click the magic links without configuring SMTP. It implements
+// http.Handler to serve that page. Don't use it in production.
+type DevMailbox struct {
+	maxMessages int
+	lock        sync.Mutex
+	messages    []DevMessage
+}
+
+// DevMessage is a message captured by the DevMailbox.
+type DevMessage struct {
+	gomagiclink.MagicLinkMessage
+	SentAt time.Time
+}
+
+// DefaultDevMailboxMessages is the number of messages a DevMailbox keeps if the given
+// maximum isn't positive.
+const DefaultDevMailboxMessages = 100
+
+// NewDevMailbox creates a DevMailbox keeping up to maxMessages messages, or
+// DefaultDevMailboxMessages if maxMessages isn't positive.
+func NewDevMailbox(maxMessages int) *DevMailbox {
+	if maxMessages <= 0 {
+		maxMessages = DefaultDevMailboxMessages
+	}
+	return &DevMailbox{maxMessages: maxMessages}
+}
+
+func (dm *DevMailbox) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	dm.messages = append(dm.messages, DevMessage{MagicLinkMessage: *msg, SentAt: time.Now()})
+	if len(dm.messages) > dm.maxMessages {
+		dm.messages = dm.messages[len(dm.messages)-dm.maxMessages:]
+	}
+	return nil
+}
+
+// Messages returns the captured messages, newest first.
+func (dm *DevMailbox) Messages() []DevMessage {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	messages := slices.Clone(dm.messages)
+	slices.Reverse(messages)
+	return messages
+}
+
+// Clear removes all the captured messages.
+func (dm *DevMailbox) Clear() {
+	dm.lock.Lock()
+	dm.messages = nil
+	dm.lock.Unlock()
+}
+
+var devMailboxTemplate = template.Must(template.New("devmailbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Dev mailbox</title>
+<meta http-equiv="refresh" content="5">
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.4em 0.8em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Dev mailbox</h1>
+<form method="post"><button type="submit">Clear</button></form>
+{{if .}}
+<table>
+<tr><th>Sent</th><th>To</th><th>Expires</th><th>Magic link</th></tr>
+{{range .}}
+<tr><td>{{.SentAt.Format "15:04:05"}}</td><td>{{.Email}}</td><td>{{.ExpiresAt.Format "15:04:05"}}</td><td><a href="{{.Link}}">{{.Link}}</a></td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No messages yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// ServeHTTP shows the captured messages. A POST request clears them.
+func (dm *DevMailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		dm.Clear()
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	devMailboxTemplate.Execute(w, dm.Messages())
+}
@@ -0,0 +1,332 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidDKIMKey = errors.New("invalid DKIM key: expecting a PEM-encoded RSA (at least 1024 bits) or Ed25519 private key")
+var ErrInvalidDKIMSigner = errors.New("invalid DKIM signer: domain, selector or canonicalization")
+var ErrMalformedMessage = errors.New("malformed e-mail message")
+
+// DefaultDKIMHeaders are the header fields signed by a DKIMSigner, if they're present.
+// The From field is signed twice, so another one can't be added to the message without
+// breaking the signature.
+var DefaultDKIMHeaders = []string{"From", "From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIMSigner signs e-mail messages with DKIM (RFC 6376, and RFC 8463 for Ed25519), which
+// receiving servers check (along with SPF and DMARC) to tell legitimate mail from spam.
+// Set it as SMTPSender.DKIM when sending directly over SMTP; e-mail services usually sign
+// the messages themselves. The public key is published in DNS as a TXT record at
+// <Selector>._domainkey.<Domain>, with the value returned by DNSRecord().
+type DKIMSigner struct {
+	Domain   string        // Signing domain (d=), normally the domain of the From address or its parent
+	Selector string        // Selector (s=) of the key, e.g. "mail2024"
+	Key      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey, e.g. from LoadDKIMKey()
+	// Canonicalization of the header and the body: "relaxed/relaxed" (the default, which
+	// survives the whitespace changes made by some relays), "relaxed/simple",
+	// "simple/relaxed" or "simple/simple"
+	Canonicalization string
+	Headers          []string      // Header fields to sign, default DefaultDKIMHeaders
+	Expiration       time.Duration // If set, signatures expire (x=) after this long
+}
+
+// LoadDKIMKey reads the DKIM private key from a PEM file, see ParseDKIMKey().
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDKIMKey(data)
+}
+
+// ParseDKIMKey parses a PEM-encoded RSA private key (PKCS #1, as made by
+// "openssl genrsa", or PKCS #8) or Ed25519 private key (PKCS #8, as made by
+// "openssl genpkey -algorithm ed25519").
+func ParseDKIMKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, ErrInvalidDKIMKey
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, ErrInvalidDKIMKey
+	}
+	if err != nil {
+		return nil, ErrInvalidDKIMKey
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 1024 {
+			return nil, ErrInvalidDKIMKey
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, ErrInvalidDKIMKey
+}
+
+// algorithm returns the a= tag value and the key type (k=) for the key.
+func (ds *DKIMSigner) algorithm() (alg string, keyType string, err error) {
+	switch ds.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", "rsa", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", "ed25519", nil
+	}
+	return "", "", ErrInvalidDKIMKey
+}
+
+// canonicalization returns the header and body canonicalization algorithms.
+func (ds *DKIMSigner) canonicalization() (header string, body string, err error) {
+	c := ds.Canonicalization
+	if c == "" {
+		c = "relaxed/relaxed"
+	}
+	header, body, _ = strings.Cut(c, "/")
+	if body == "" {
+		body = "simple"
+	}
+	for _, alg := range []string{header, body} {
+		if alg != "relaxed" && alg != "simple" {
+			return "", "", ErrInvalidDKIMSigner
+		}
+	}
+	return header, body, nil
+}
+
+// DNSRecord returns the value of the TXT record publishing the public key.
+func (ds *DKIMSigner) DNSRecord() (string, error) {
+	_, keyType, err := ds.algorithm()
+	if err != nil {
+		return "", err
+	}
+	var pub []byte
+	switch key := ds.Key.Public().(type) {
+	case *rsa.PublicKey:
+		if pub, err = x509.MarshalPKIXPublicKey(key); err != nil {
+			return "", err
+		}
+	case ed25519.PublicKey:
+		pub = key
+	}
+	return "v=DKIM1; k=" + keyType + "; p=" + base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Sign returns the message with a DKIM-Signature header field added. Line endings are
+// converted to CRLF, as they are when the message is sent.
+func (ds *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	if ds.Domain == "" || ds.Selector == "" || strings.ContainsAny(ds.Domain+ds.Selector, "; \t\r\n") {
+		return nil, ErrInvalidDKIMSigner
+	}
+	if ds.Key == nil {
+		return nil, ErrInvalidDKIMKey
+	}
+	alg, _, err := ds.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	headerCanon, bodyCanon, err := ds.canonicalization()
+	if err != nil {
+		return nil, err
+	}
+	message = toCRLF(message)
+	end := bytes.Index(message, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, ErrMalformedMessage
+	}
+	fields, err := splitHeaderFields(string(message[:end+2]))
+	if err != nil {
+		return nil, err
+	}
+	bodyHash := sha256.Sum256(canonicalBody(message[end+4:], bodyCanon))
+
+	// The signed fields are taken from the bottom up, and the names which aren't present
+	// (anymore) are signed as empty, so such fields can't be added later
+	names := ds.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	used := make([]bool, len(fields))
+	h := sha256.New()
+	signedNames := make([]string, 0, len(names))
+	for _, name := range names {
+		signedNames = append(signedNames, strings.ToLower(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				h.Write([]byte(canonicalHeader(fields[i], headerCanon) + "\r\n"))
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	var sig strings.Builder
+	sig.WriteString("DKIM-Signature: v=1; a=" + alg + "; c=" + headerCanon + "/" + bodyCanon + ";\r\n")
+	sig.WriteString("\td=" + ds.Domain + "; s=" + ds.Selector + "; t=" + strconv.FormatInt(now.Unix(), 10) + ";")
+	if ds.Expiration > 0 {
+		sig.WriteString(" x=" + strconv.FormatInt(now.Add(ds.Expiration).Unix(), 10) + ";")
+	}
+	sig.WriteString("\r\n\th=" + strings.Join(signedNames, ":") + ";\r\n")
+	sig.WriteString("\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n")
+	sig.WriteString("\tb=")
+	// The signature covers its own header field, with an empty b= tag and without the CRLF
+	h.Write([]byte(canonicalHeader(sig.String(), headerCanon)))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	if alg == "ed25519-sha256" {
+		signature, err = ds.Key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		signature, err = ds.Key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := base64.StdEncoding.EncodeToString(signature)
+	for len(b) > 72 {
+		sig.WriteString(b[:72] + "\r\n\t ")
+		b = b[72:]
+	}
+	sig.WriteString(b + "\r\n")
+
+	signed := make([]byte, 0, sig.Len()+len(message))
+	signed = append(signed, sig.String()...)
+	return append(signed, message...), nil
+}
+
+// toCRLF converts bare LF and CR line endings to CRLF.
+func toCRLF(message []byte) []byte {
+	if !bytes.ContainsAny(message, "\r\n") {
+		return message
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(message) + 64)
+	for i := 0; i < len(message); i++ {
+		switch c := message[i]; {
+		case c == '\r' && i+1 < len(message) && message[i+1] == '\n':
+			buf.WriteString("\r\n")
+			i++
+		case c == '\r' || c == '\n':
+			buf.WriteString("\r\n")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.Bytes()
+}
+
+// splitHeaderFields splits the header (ending with CRLF) into fields, each including its
+// continuation lines, without the final CRLF.
+func splitHeaderFields(header string) (fields []string, err error) {
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) == 0 {
+				return nil, ErrMalformedMessage
+			}
+			fields[len(fields)-1] += line
+			continue
+		}
+		if !strings.Contains(line, ":") {
+			return nil, ErrMalformedMessage
+		}
+		if len(fields) > 0 {
+			fields[len(fields)-1] = strings.TrimSuffix(fields[len(fields)-1], "\r\n")
+		}
+		fields = append(fields, line)
+	}
+	if len(fields) > 0 {
+		fields[len(fields)-1] = strings.TrimSuffix(fields[len(fields)-1], "\r\n")
+	}
+	return fields, nil
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+// canonicalHeader canonicalizes a header field, without the final CRLF (RFC 6376
+// section 3.4.1 and 3.4.2).
+func canonicalHeader(field string, alg string) string {
+	if alg == "simple" {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.TrimSpace(collapseWSP(value))
+}
+
+// canonicalBody canonicalizes the body (RFC 6376 section 3.4.3 and 3.4.4).
+func canonicalBody(body []byte, alg string) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(body) + 2)
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r\n")
+		if alg == "relaxed" {
+			line = strings.TrimRight(collapseWSP(line), " ")
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	// Empty lines at the end are ignored
+	out := buf.Bytes()
+	for bytes.HasSuffix(out, []byte("\r\n\r\n")) {
+		out = out[:len(out)-2]
+	}
+	if len(out) == 2 && alg == "relaxed" {
+		return nil
+	}
+	if len(out) == 0 && alg == "simple" {
+		return []byte("\r\n")
+	}
+	return out
+}
+
+// collapseWSP replaces each sequence of spaces and tabs with a single space.
+func collapseWSP(s string) string {
+	if !strings.ContainsAny(s, "\t") && !strings.Contains(s, "  ") {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !inWSP {
+				sb.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// EMLFileSender is a MagicLinkSender for development and testing, which writes the
+// messages as .eml files to a directory instead of sending them. The files contain the
+// same messages SMTPSender sends, so they can be opened in an e-mail client to check
+// how they look, or parsed by tests. Don't use it in production.
+type EMLFileSender struct {
+	Dir     string // Created if it doesn't exist
+	From    string // Sender's address, e.g. "Example <login@example.com>"
+	Subject string // Default "Your login link"
+}
+
+// SendMagicLink writes the message to a file named by the time and the challenge's
+// receipt ID (or a random ID), readable only by the owner, as it contains the magic link.
+func (es *EMLFileSender) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	body, err := composeMessage(es.From, es.Subject, msg)
+	if err != nil {
+		return err
+	}
+	id := msg.ReceiptID.String()
+	if msg.ReceiptID == uuid.Nil {
+		random := make([]byte, 8)
+		if _, err = rand.Read(random); err != nil {
+			return err
+		}
+		id = hex.EncodeToString(random)
+	}
+	if err = os.MkdirAll(es.Dir, 0700); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102-150405.000") + "-" + id + ".eml"
+	return os.WriteFile(filepath.Join(es.Dir, name), body, 0600)
+}
@@ -0,0 +1,198 @@
+package mailer
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrNoProviders = errors.New("no providers configured")
+var ErrInvalidProvider = errors.New("provider needs a name and a sender")
+
+// FailoverProvider is one of the senders of a FailoverSender.
+type FailoverProvider struct {
+	Name     string // E.g. "sendgrid", recorded in the audit log
+	Sender   gomagiclink.MagicLinkSender
+	Priority int           // Providers with lower priorities are tried first
+	Timeout  time.Duration // Timeout of each attempt, default 10s
+}
+
+// FailoverOptions configures a FailoverSender.
+type FailoverOptions struct {
+	// FailureThreshold is the number of consecutive failures after which a provider is
+	// considered unhealthy and skipped, default 3.
+	FailureThreshold int
+	// Cooldown is how long an unhealthy provider is skipped, default one minute. After
+	// it, the provider gets another chance, and is healthy again if it succeeds.
+	Cooldown time.Duration
+	// AuditLogger, if set, receives a gomagiclink.AuditMessageDelivered event naming the
+	// provider which delivered each message, and the ones which failed before it.
+	AuditLogger gomagiclink.AuditLogger
+	Logger      *slog.Logger // Receives the failures of the providers
+}
+
+// ProviderHealth is the health of a FailoverSender's provider, see FailoverSender.Health().
+type ProviderHealth struct {
+	Name                string
+	Healthy             bool
+	ConsecutiveFailures int
+	LastError           string
+	UnhealthyUntil      time.Time // Zero for healthy providers
+}
+
+type failoverProvider struct {
+	FailoverProvider
+	failures       int
+	lastError      error
+	unhealthyUntil time.Time
+}
+
+// FailoverSender is a MagicLinkSender which sends through the first of several providers
+// which succeeds, e.g. SendGrid with Amazon SES as a backup. Providers which keep failing
+// are skipped for a while, so users don't wait for their timeouts. An attempt which timed
+// out may still have been delivered, so the user can receive the magic link twice.
+type FailoverSender struct {
+	opts      FailoverOptions
+	lock      sync.Mutex
+	providers []*failoverProvider // In the order of priority
+}
+
+// NewFailoverSender creates a FailoverSender with the providers.
+func NewFailoverSender(providers []FailoverProvider, opts FailoverOptions) (fs *FailoverSender, err error) {
+	if len(providers) == 0 {
+		return nil, ErrNoProviders
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 3
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = time.Minute
+	}
+	fs = &FailoverSender{opts: opts}
+	for _, p := range providers {
+		if p.Name == "" || p.Sender == nil {
+			return nil, ErrInvalidProvider
+		}
+		if p.Timeout <= 0 {
+			p.Timeout = 10 * time.Second
+		}
+		fs.providers = append(fs.providers, &failoverProvider{FailoverProvider: p})
+	}
+	slices.SortStableFunc(fs.providers, func(a, b *failoverProvider) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+	return fs, nil
+}
+
+// order returns the providers to try: the healthy ones first, in the order of priority,
+// followed by the unhealthy ones, so the message is still sent if they've recovered.
+func (fs *FailoverSender) order() (healthy []*failoverProvider, unhealthy []*failoverProvider) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	now := time.Now()
+	for _, p := range fs.providers {
+		if p.unhealthyUntil.After(now) {
+			unhealthy = append(unhealthy, p)
+		} else {
+			healthy = append(healthy, p)
+		}
+	}
+	return
+}
+
+// record updates the provider's health after an attempt.
+func (fs *FailoverSender) record(p *failoverProvider, err error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err == nil {
+		p.failures, p.lastError, p.unhealthyUntil = 0, nil, time.Time{}
+		return
+	}
+	p.failures++
+	p.lastError = err
+	if p.failures >= fs.opts.FailureThreshold {
+		p.unhealthyUntil = time.Now().Add(fs.opts.Cooldown)
+	}
+}
+
+// SendMagicLink sends the message through the providers in turn, until one succeeds.
+// If all of them fail, it returns their errors joined.
+func (fs *FailoverSender) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	healthy, unhealthy := fs.order()
+	var errs []error
+	var failed []string
+	for _, p := range slices.Concat(healthy, unhealthy) {
+		if ctx.Err() != nil {
+			break
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+		err := p.Sender.SendMagicLink(attemptCtx, msg)
+		cancel()
+		fs.record(p, err)
+		if err == nil {
+			fs.audit(msg, p.Name, failed)
+			return nil
+		}
+		if fs.opts.Logger != nil {
+			fs.opts.Logger.Warn("Magic link provider failed", "provider", p.Name, "error", err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+		failed = append(failed, p.Name)
+	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+func (fs *FailoverSender) audit(msg *gomagiclink.MagicLinkMessage, provider string, failed []string) {
+	if fs.opts.AuditLogger == nil {
+		return
+	}
+	details := map[string]string{"provider": provider, "attempts": strconv.Itoa(len(failed) + 1)}
+	if len(failed) > 0 {
+		details["failed_providers"] = strings.Join(failed, ",")
+	}
+	if msg.ReceiptID != uuid.Nil {
+		details["receipt_id"] = msg.ReceiptID.String()
+	}
+	fs.opts.AuditLogger.LogAuditEvent(gomagiclink.AuditEvent{
+		Time:    time.Now(),
+		Type:    gomagiclink.AuditMessageDelivered,
+		Email:   msg.Email,
+		Details: details,
+	})
+}
+
+// Health returns the health of the providers, in the order of priority, e.g. for a
+// status page.
+func (fs *FailoverSender) Health() []ProviderHealth {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	now := time.Now()
+	health := make([]ProviderHealth, len(fs.providers))
+	for i, p := range fs.providers {
+		health[i] = ProviderHealth{
+			Name:                p.Name,
+			Healthy:             !p.unhealthyUntil.After(now),
+			ConsecutiveFailures: p.failures,
+		}
+		if p.lastError != nil {
+			health[i].LastError = p.lastError.Error()
+		}
+		if !health[i].Healthy {
+			health[i].UnhealthyUntil = p.unhealthyUntil
+		}
+	}
+	return health
+}
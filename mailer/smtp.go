@@ -0,0 +1,123 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrInvalidAddress = errors.New("invalid e-mail address")
+
+// SMTPSender is a MagicLinkSender which sends plain text e-mail messages through an
+// SMTP server, using STARTTLS if the server supports it. It connects for each message,
+// so it's meant for low-volume use, like the standalone auth server; high-volume apps
+// should use a proper e-mail library or service.
+type SMTPSender struct {
+	Host     string
+	Port     int // Default 587
+	Username string
+	Password string
+	From     string      // Sender's address, e.g. "Example <login@example.com>"
+	Subject  string      // Default "Your login link"
+	DKIM     *DKIMSigner // If set, messages are signed with DKIM
+}
+
+// NewSMTPSenderFromPolicy creates an SMTPSender with the mailer settings of a
+// gomagiclink.Policy, and the password, which isn't part of the policy.
+func NewSMTPSenderFromPolicy(p gomagiclink.PolicyMailer, password string) *SMTPSender {
+	return &SMTPSender{
+		Host:     p.Host,
+		Port:     p.Port,
+		Username: p.Username,
+		Password: password,
+		From:     p.From,
+		Subject:  p.Subject,
+	}
+}
+
+// SendMagicLink sends the message. Authentication is used if Username is set, and
+// (as enforced by net/smtp) only over TLS or to localhost.
+func (ss *SMTPSender) SendMagicLink(ctx context.Context, msg *gomagiclink.MagicLinkMessage) error {
+	port := ss.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(ss.Host, strconv.Itoa(port))
+	var auth smtp.Auth
+	if ss.Username != "" {
+		auth = smtp.PlainAuth("", ss.Username, ss.Password, ss.Host)
+	}
+	body, err := composeMessage(ss.From, ss.Subject, msg)
+	if err != nil {
+		return err
+	}
+	if ss.DKIM != nil {
+		if body, err = ss.DKIM.Sign(body); err != nil {
+			return err
+		}
+	}
+	from := ss.From
+	if i := strings.LastIndexByte(from, '<'); i >= 0 {
+		from = strings.TrimSuffix(from[i+1:], ">")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(addr, auth, from, []string{msg.Email}, body)
+	}()
+	select {
+	case err = <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// composeMessage builds the plain text RFC 5322 message with the magic link.
+func composeMessage(from string, subject string, msg *gomagiclink.MagicLinkMessage) ([]byte, error) {
+	if strings.ContainsAny(msg.Email, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, ErrInvalidAddress
+	}
+	if subject == "" {
+		subject = "Your login link"
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if i := strings.LastIndexByte(msg.Email, '@'); i >= 0 {
+		domain = msg.Email[i+1:]
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.Email)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(random), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	if msg.AntiPhishingPhrase != "" {
+		fmt.Fprintf(&buf, "Your anti-phishing phrase: %s\r\n\r\n", msg.AntiPhishingPhrase)
+	}
+	buf.WriteString("Click the link below to log in:\r\n\r\n")
+	buf.WriteString(msg.Link + "\r\n\r\n")
+	if !msg.ExpiresAt.IsZero() {
+		fmt.Fprintf(&buf, "The link expires at %s.\r\n", msg.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	buf.WriteString("If you didn't request it, you can ignore this message.\r\n")
+	return buf.Bytes(), nil
+}
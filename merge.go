@@ -0,0 +1,119 @@
+package gomagiclink
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+var ErrMergeSameUser = errors.New("can't merge a user with itself")
+
+// CustomDataResolver returns the merged value of a CustomData key which is set in both
+// records passed to MergeUsers().
+type CustomDataResolver func(key string, primaryValue string, duplicateValue string) string
+
+// MergeUsers merges the duplicate user into the primary one, e.g. when a user ended up
+// with two accounts because of a mistyped e-mail address which was verified later. The
+// primary record keeps its ID, e-mail address, access level, lock and TOTP settings, and
+// gets:
+//   - the CustomData keys which are only set in the duplicate, and for the keys set in
+//     both, the value returned by the resolver (or the primary's, if it's nil),
+//   - the duplicate's organization memberships it doesn't have,
+//   - the earlier creation and first login times, and the later recent login time.
+//
+// The duplicate's server-side sessions are reassigned to the primary user, and the
+// duplicate is deleted, so its signed session IDs stop working. The merge is recorded
+// in the audit log.
+func (mlc *AuthMagicLinkController) MergeUsers(primaryID uuid.UUID, duplicateID uuid.UUID, resolver CustomDataResolver) (err error) {
+	if primaryID == duplicateID {
+		return ErrMergeSameUser
+	}
+	if _, ok := mlc.db.(UserDeleter); !ok {
+		return ErrUserDeletionNotSupported
+	}
+	primary, err := mlc.loadUserById(primaryID)
+	if err != nil {
+		return
+	}
+	duplicate, err := mlc.loadUserById(duplicateID)
+	if err != nil {
+		return
+	}
+	mergeUserRecords(primary, duplicate, resolver)
+	if err = mlc.UpdateUser(primary); err != nil {
+		return
+	}
+	sessions, err := mlc.reassignSessions(duplicate.ID, primary.ID)
+	if err != nil {
+		return
+	}
+	if err = mlc.flushUser(duplicate.ID); err != nil {
+		return
+	}
+	if mlc.userCache != nil {
+		defer mlc.userCache.invalidate(duplicate.ID)
+	}
+	if err = DeleteStoredUser(mlc.db, duplicate.ID); err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditUsersMerged, UserID: primary.ID, Email: primary.Email, Details: map[string]string{
+		"duplicate_id":    duplicate.ID.String(),
+		"duplicate_email": duplicate.Email,
+		"sessions":        strconv.Itoa(sessions),
+	}})
+	return nil
+}
+
+// mergeUserRecords merges the duplicate into the primary record, see MergeUsers().
+func mergeUserRecords(primary *AuthUserRecord, duplicate *AuthUserRecord, resolver CustomDataResolver) {
+	for key, value := range duplicate.CustomData {
+		if primary.CustomData == nil {
+			primary.CustomData = map[string]string{}
+		}
+		primaryValue, ok := primary.CustomData[key]
+		if !ok {
+			primary.CustomData[key] = value
+		} else if resolver != nil {
+			primary.CustomData[key] = resolver(key, primaryValue, value)
+		}
+	}
+	for _, m := range duplicate.Memberships {
+		if primary.GetMembership(m.OrgID) == nil {
+			primary.Memberships = append(primary.Memberships, m)
+		}
+	}
+	if !duplicate.CreatedAt.IsZero() && (primary.CreatedAt.IsZero() || duplicate.CreatedAt.Before(primary.CreatedAt)) {
+		primary.CreatedAt = duplicate.CreatedAt
+	}
+	if !duplicate.FirstLoginTime.IsZero() && (primary.FirstLoginTime.IsZero() || duplicate.FirstLoginTime.Before(primary.FirstLoginTime)) {
+		primary.FirstLoginTime = duplicate.FirstLoginTime
+	}
+	if duplicate.RecentLoginTime.After(primary.RecentLoginTime) {
+		primary.RecentLoginTime = duplicate.RecentLoginTime
+	}
+}
+
+// reassignSessions moves the user's server-side sessions to another user, returning
+// their number.
+func (mlc *AuthMagicLinkController) reassignSessions(fromID uuid.UUID, toID uuid.UUID) (n int, err error) {
+	if mlc.sessionStore == nil {
+		return 0, nil
+	}
+	recs, err := mlc.sessionStore.GetUserSessions(fromID)
+	if err != nil {
+		return
+	}
+	for _, rec := range recs {
+		if err = mlc.sessionStore.RemoveSession(rec.ID); err != nil && err != ErrSessionNotFound {
+			return
+		}
+		moved := *rec
+		moved.UserID = toID
+		if err = mlc.sessionStore.AddSession(&moved); err != nil {
+			return
+		}
+		n++
+	}
+	return n, nil
+}
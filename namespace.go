@@ -0,0 +1,59 @@
+package gomagiclink
+
+import (
+	"errors"
+	"regexp"
+)
+
+var ErrInvalidNamespace = errors.New("invalid namespace")
+var ErrNamespaceNotSupported = errors.New("storage doesn't support namespaces")
+
+var reNamespace = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// NamespacedStorage is implemented by storages which can keep the records of
+// several apps sharing them apart, see WithNamespace().
+type NamespacedStorage interface {
+	SetNamespace(namespace string) error // Restricts all operations to the namespace's records
+}
+
+// ValidateNamespace checks that the namespace has 1 to 32 letters, digits, underscores
+// and dashes, so it can be safely used in keys of all the storages.
+func ValidateNamespace(namespace string) error {
+	if !reNamespace.MatchString(namespace) {
+		return ErrInvalidNamespace
+	}
+	return nil
+}
+
+// WithNamespace isolates the controller's users and tokens from those of other apps
+// sharing the storage and the secret key. The namespace is passed to the storage, which
+// must implement NamespacedStorage (NewAuthMagicLinkController() returns
+// ErrNamespaceNotSupported otherwise), and mixed into the token HMACs, so the tokens of
+// one app don't verify in another. Setting a namespace invalidates the existing tokens,
+// and the existing records (in the default, empty namespace) aren't visible in it. Each
+// controller needs its own storage instance, as the namespace is set on it.
+func WithNamespace(namespace string) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.namespace = namespace
+	}
+}
+
+// Namespace returns the namespace set by WithNamespace().
+func (mlc *AuthMagicLinkController) Namespace() string {
+	return mlc.namespace
+}
+
+// setupNamespace validates the namespace and passes it to the storage.
+func (mlc *AuthMagicLinkController) setupNamespace() error {
+	if mlc.namespace == "" {
+		return nil
+	}
+	if err := ValidateNamespace(mlc.namespace); err != nil {
+		return err
+	}
+	ns, ok := mlc.db.(NamespacedStorage)
+	if !ok {
+		return ErrNamespaceNotSupported
+	}
+	return ns.SetNamespace(mlc.namespace)
+}
@@ -0,0 +1,301 @@
+package oidcprovider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/adapters"
+)
+
+const authRequestPurpose = "oidc-authorization-request"
+
+var errInvalidAuthRequest = errors.New("invalid or expired authorization request")
+
+// authRequest is a validated authorization request, carried through the login in a
+// signed token (see signRequest()).
+type authRequest struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	State         string `json:"state,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"code_challenge,omitempty"` // S256
+	Expires       int64  `json:"exp"`
+}
+
+// parseAuthRequest validates the authorization request. If the client or the redirect
+// URI are invalid, errMsg is set, and the error must be shown to the user instead of
+// being redirected to the client. Other errors are returned as OAuth error codes in
+// errCode, to be sent to the redirect URI.
+func (p *Provider) parseAuthRequest(r *http.Request) (req *authRequest, errMsg string, errCode string) {
+	q := r.URL.Query()
+	client, ok := p.clients[q.Get("client_id")]
+	if !ok {
+		return nil, "Unknown client.", ""
+	}
+	req = &authRequest{
+		ClientID:      client.ID,
+		RedirectURI:   q.Get("redirect_uri"),
+		Scope:         q.Get("scope"),
+		State:         q.Get("state"),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+		Expires:       time.Now().Add(p.opts.LoginDuration).Unix(),
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return nil, "Invalid redirect URI.", ""
+	}
+	switch {
+	case q.Get("response_type") != "code":
+		return req, "", "unsupported_response_type"
+	case !slices.Contains(strings.Fields(req.Scope), "openid"):
+		return req, "", "invalid_scope"
+	case req.CodeChallenge != "" && q.Get("code_challenge_method") != "S256":
+		return req, "", "invalid_request"
+	case req.CodeChallenge == "" && client.Secret == "":
+		return req, "", "invalid_request" // Public clients must use PKCE
+	}
+	return req, "", ""
+}
+
+// redirectError sends the OAuth error to the client's redirect URI.
+func redirectError(w http.ResponseWriter, r *http.Request, req *authRequest, code string) {
+	q := url.Values{"error": {code}}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	http.Redirect(w, r, addQuery(req.RedirectURI, q), http.StatusFound)
+}
+
+func addQuery(rawURL string, q url.Values) string {
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + q.Encode()
+}
+
+// signRequest serializes the authorization request into a token signed with the
+// controller's secret key, so it doesn't need to be stored during the login.
+func (p *Provider) signRequest(req *authRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sig := p.mlc.SignData(authRequestPurpose, data)
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (p *Provider) verifyRequest(token string) (req *authRequest, err error) {
+	dataPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidAuthRequest
+	}
+	data, err := base64.RawURLEncoding.DecodeString(dataPart)
+	if err != nil {
+		return nil, errInvalidAuthRequest
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil || !p.mlc.VerifyData(authRequestPurpose, data, sig) {
+		return nil, errInvalidAuthRequest
+	}
+	req = &authRequest{}
+	if err = json.Unmarshal(data, req); err != nil || req.Expires < time.Now().Unix() {
+		return nil, errInvalidAuthRequest
+	}
+	if _, ok := p.clients[req.ClientID]; !ok {
+		return nil, errInvalidAuthRequest
+	}
+	return req, nil
+}
+
+// sessionUser returns the user logged in with the AuthHandlers' session cookie, or nil.
+func (p *Provider) sessionUser(r *http.Request) *gomagiclink.AuthUserRecord {
+	cookie, err := r.Cookie(p.handlers.CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	user, err := p.mlc.VerifySessionId(cookie.Value)
+	if err != nil || user.StaleSession {
+		return nil
+	}
+	return user
+}
+
+// serveAuthorize is the authorization endpoint. Users with a session get a code right
+// away (unless the client asks for a new login with prompt=login); the others get the
+// login form.
+func (p *Provider) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, errMsg, errCode := p.parseAuthRequest(r)
+	if errMsg != "" {
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+	if errCode != "" {
+		redirectError(w, r, req, errCode)
+		return
+	}
+	prompt := strings.Fields(r.URL.Query().Get("prompt"))
+	if !slices.Contains(prompt, "login") {
+		if user := p.sessionUser(r); user != nil {
+			p.issueCode(w, r, req, user, time.Time{})
+			return
+		}
+	}
+	if slices.Contains(prompt, "none") {
+		redirectError(w, r, req, "login_required")
+		return
+	}
+	p.renderPage(w, r, req, "", false, http.StatusOK)
+}
+
+// serveLogin handles the login form: it sends the magic link, which leads to the
+// callback with the authorization request.
+func (p *Provider) serveLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+	token := r.FormValue("request")
+	req, err := p.verifyRequest(token)
+	if err != nil {
+		http.Error(w, "This login request has expired. Please go back to the app and try again.", http.StatusBadRequest)
+		return
+	}
+	verifyURL := addQuery(p.opts.Issuer+"/callback", url.Values{"request": {token}})
+	_, err = p.handlers.StartLogin(r.Context(), r.FormValue("email"), adapters.LoginOptions{
+		VerifyURL: verifyURL,
+		Metadata:  gomagiclink.ChallengeMetadata{Campaign: "oidc"},
+	})
+	if err == gomagiclink.ErrChallengeSuppressed {
+		// Blocked user, respond as if the link was sent
+		err = nil
+	}
+	if err != nil {
+		code, status := adapters.ErrorCode(err)
+		if status == http.StatusInternalServerError {
+			p.logError(r, err)
+		}
+		p.renderPage(w, r, req, code, false, status)
+		return
+	}
+	p.renderPage(w, r, req, "", true, http.StatusOK)
+}
+
+// serveCallback is the target of the magic links: it completes the login, which sets
+// the session cookie, and sends the user back to the client with a code.
+func (p *Provider) serveCallback(w http.ResponseWriter, r *http.Request) {
+	req, err := p.verifyRequest(r.URL.Query().Get("request"))
+	if err != nil {
+		http.Error(w, "This login request has expired. Please go back to the app and try again.", http.StatusBadRequest)
+		return
+	}
+	user, _, err := p.handlers.CompleteLogin(w, r)
+	if err != nil {
+		code, status := adapters.ErrorCode(err)
+		if status == http.StatusInternalServerError {
+			p.logError(r, err)
+		}
+		p.renderPage(w, r, req, code, false, status)
+		return
+	}
+	if user.TOTPPending {
+		// The second factor isn't supported by the provider's login flow
+		redirectError(w, r, req, "interaction_required")
+		return
+	}
+	p.issueCode(w, r, req, user, time.Now())
+}
+
+// issueCode redirects the user to the client with a new authorization code.
+func (p *Provider) issueCode(w http.ResponseWriter, r *http.Request, req *authRequest, user *gomagiclink.AuthUserRecord, authTime time.Time) {
+	code, err := p.codes.add(&authCode{
+		request:  *req,
+		userID:   user.ID,
+		authTime: authTime,
+		expires:  time.Now().Add(p.opts.CodeDuration),
+	})
+	if err != nil {
+		p.logError(r, err)
+		redirectError(w, r, req, "server_error")
+		return
+	}
+	q := url.Values{"code": {code}}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, addQuery(req.RedirectURI, q), http.StatusFound)
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.AppName}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:24rem;margin:4rem auto;padding:0 1rem}input,button{font:inherit;padding:.5rem;width:100%;box-sizing:border-box;margin:.25rem 0}.error{color:#b91c1c}</style>
+</head>
+<body>
+<h1>{{.AppName}}</h1>
+{{if .Sent}}<p>We've sent you a login link. Please check your e-mail, and open the link to continue to {{.ClientName}}.</p>
+{{else}}<p>Log in to continue to {{.ClientName}}.</p>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="request" value="{{.Request}}">
+<input type="email" name="email" placeholder="E-mail address" required autofocus>
+<button type="submit">Send login link</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// renderPage renders the login form, the "check your e-mail" page if sent is true, or
+// the login form with the error message for the adapters.ErrorCode* code.
+func (p *Provider) renderPage(w http.ResponseWriter, r *http.Request, req *authRequest, errCode string, sent bool, status int) {
+	token, err := p.signRequest(req)
+	if err != nil {
+		p.logError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	client := p.clients[req.ClientID]
+	data := struct {
+		AppName    string
+		ClientName string
+		Action     string
+		Request    string
+		Error      string
+		Sent       bool
+	}{
+		AppName:    p.opts.AppName,
+		ClientName: client.Name,
+		Action:     p.opts.Issuer + "/authorize",
+		Request:    token,
+		Sent:       sent,
+	}
+	if data.ClientName == "" {
+		data.ClientName = client.ID
+	}
+	if errCode != "" {
+		messages := p.handlers.Messages
+		if messages == nil {
+			messages = adapters.DefaultMessageCatalog
+		}
+		data.Error, _ = messages.Localize(r, errCode)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err = pageTemplate.Execute(w, data); err != nil {
+		p.logError(r, err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package oidcprovider turns the magic link service into a minimal OpenID Connect
+// provider, so other apps can log in "with" it. It implements the authorization code
+// flow (with PKCE) on top of the controller and adapters.AuthHandlers: users who aren't
+// logged in get a magic link, and after they open it, the client gets an authorization
+// code, which it exchanges for an ID token and an access token, signed with the
+// controller's session token keys (see gomagiclink.WithSessionTokenKeys()).
+package oidcprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/adapters"
+	"github.com/ivoras/gomagiclink/keys"
+)
+
+var ErrInvalidIssuer = errors.New("issuer must be an absolute https URL without a query")
+var ErrNoClients = errors.New("no clients configured")
+var ErrInvalidClient = errors.New("client needs an ID and at least one redirect URI")
+var ErrNoSigningKeys = errors.New("no token signing keys: pass Options.Keys or use gomagiclink.WithSessionTokenKeys()")
+
+// Client is an app which logs its users in through the provider (a relying party).
+type Client struct {
+	ID           string
+	Secret       string   // Empty for public clients (e.g. single-page and mobile apps), which must use PKCE
+	RedirectURIs []string // Allowed redirect URIs, compared exactly
+	Name         string   // Shown on the login page
+}
+
+// Options configures the Provider. Zero values are replaced by defaults.
+type Options struct {
+	// Issuer is the provider's URL, e.g. "https://auth.example.com/oidc", which the
+	// Provider is mounted on, and the "iss" claim of the tokens. Plain http is allowed
+	// for localhost only.
+	Issuer  string
+	Clients []Client
+	Keys    *keys.KeySet // Signs the tokens, default the controller's SessionTokenKeys()
+	AppName string       // Shown on the login page, default "Log in"
+
+	CodeDuration  time.Duration // Validity of the authorization codes, default 1 minute
+	TokenDuration time.Duration // Validity of the ID and access tokens, default 1 hour
+	LoginDuration time.Duration // How long the user has to open the magic link, default 1 hour
+	Logger        *slog.Logger  // Receives unexpected errors
+}
+
+// Provider serves the OpenID Connect endpoints, relative to the issuer URL:
+//
+//	/.well-known/openid-configuration  the discovery document
+//	/jwks.json                         the public keys
+//	/authorize                         the authorization endpoint, with the login form
+//	/callback                          the target of the magic links
+//	/token                             the token endpoint
+//	/userinfo                          the UserInfo endpoint
+//
+// It uses the session cookie of the AuthHandlers, so users already logged into the
+// service aren't asked to log in again. Authorization codes are kept in memory, so the
+// provider is meant for a single instance. The tokens are signed with EdDSA (Ed25519),
+// which the clients' OpenID Connect libraries need to support.
+type Provider struct {
+	mlc      *gomagiclink.AuthMagicLinkController
+	handlers *adapters.AuthHandlers
+	opts     Options
+	clients  map[string]*Client
+	basePath string
+	codes    *codeStore
+	mux      *http.ServeMux
+}
+
+// NewProvider creates the Provider. Mount it on the issuer URL's path, e.g.
+// mux.Handle("/oidc/", provider).
+func NewProvider(mlc *gomagiclink.AuthMagicLinkController, handlers *adapters.AuthHandlers, opts Options) (p *Provider, err error) {
+	opts.Issuer = strings.TrimRight(opts.Issuer, "/")
+	u, err := url.Parse(opts.Issuer)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" ||
+		(u.Scheme != "https" && !(u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"))) {
+		return nil, ErrInvalidIssuer
+	}
+	if len(opts.Clients) == 0 {
+		return nil, ErrNoClients
+	}
+	if opts.Keys == nil {
+		opts.Keys = mlc.SessionTokenKeys()
+	}
+	if opts.Keys == nil || opts.Keys.Current() == nil {
+		return nil, ErrNoSigningKeys
+	}
+	if opts.AppName == "" {
+		opts.AppName = "Log in"
+	}
+	if opts.CodeDuration <= 0 {
+		opts.CodeDuration = time.Minute
+	}
+	if opts.TokenDuration <= 0 {
+		opts.TokenDuration = time.Hour
+	}
+	if opts.LoginDuration <= 0 {
+		opts.LoginDuration = time.Hour
+	}
+	p = &Provider{
+		mlc:      mlc,
+		handlers: handlers,
+		opts:     opts,
+		clients:  map[string]*Client{},
+		basePath: u.Path,
+		codes:    newCodeStore(),
+	}
+	for i := range opts.Clients {
+		c := &opts.Clients[i]
+		if c.ID == "" || len(c.RedirectURIs) == 0 {
+			return nil, ErrInvalidClient
+		}
+		p.clients[c.ID] = c
+	}
+
+	// The paths aren't stripped, as the magic links are signed with them
+	base := p.basePath
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("GET "+base+"/.well-known/openid-configuration", p.serveDiscovery)
+	p.mux.Handle("GET "+base+"/jwks.json", adapters.JWKSHandler(opts.Keys))
+	p.mux.HandleFunc("GET "+base+"/authorize", p.serveAuthorize)
+	p.mux.HandleFunc("POST "+base+"/authorize", p.serveLogin)
+	p.mux.HandleFunc("GET "+base+"/callback", p.serveCallback)
+	p.mux.HandleFunc("POST "+base+"/token", p.serveToken)
+	p.mux.HandleFunc("GET "+base+"/userinfo", p.serveUserInfo)
+	p.mux.HandleFunc("POST "+base+"/userinfo", p.serveUserInfo)
+	return p, nil
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// discovery is the OpenID Provider Metadata.
+type discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func (p *Provider) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, discovery{
+		Issuer:                            p.opts.Issuer,
+		AuthorizationEndpoint:             p.opts.Issuer + "/authorize",
+		TokenEndpoint:                     p.opts.Issuer + "/token",
+		UserInfoEndpoint:                  p.opts.Issuer + "/userinfo",
+		JWKSURI:                           p.opts.Issuer + "/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"EdDSA"},
+		ScopesSupported:                   []string{"openid", "email"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified"},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *Provider) logError(r *http.Request, err error) {
+	if p.opts.Logger != nil {
+		p.opts.Logger.Error("Error in OpenID Connect provider", "path", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,275 @@
+package oidcprovider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// authCode is an issued authorization code, waiting to be exchanged for tokens.
+type authCode struct {
+	request  authRequest
+	userID   uuid.UUID
+	authTime time.Time // Zero if the user was already logged in
+	expires  time.Time
+}
+
+// codeStore keeps the authorization codes in memory. Codes can be used once.
+type codeStore struct {
+	lock  sync.Mutex
+	codes map[string]*authCode
+}
+
+func newCodeStore() *codeStore {
+	return &codeStore{codes: map[string]*authCode{}}
+}
+
+func (cs *codeStore) add(ac *authCode) (code string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	code = base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	for c, a := range cs.codes {
+		if now.After(a.expires) {
+			delete(cs.codes, c)
+		}
+	}
+	cs.codes[code] = ac
+	return code, nil
+}
+
+// take removes the code and returns it, or nil if it doesn't exist or has expired.
+func (cs *codeStore) take(code string) *authCode {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	ac, ok := cs.codes[code]
+	if !ok {
+		return nil
+	}
+	delete(cs.codes, code)
+	if time.Now().After(ac.expires) {
+		return nil
+	}
+	return ac
+}
+
+// idTokenClaims are the claims of the ID tokens.
+type idTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"` // User ID
+	Audience      string `json:"aud"` // Client ID
+	Expires       int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// accessTokenClaims are the claims of the access tokens, accepted by the UserInfo endpoint.
+type accessTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	Scope    string `json:"scope"`
+	Email    string `json:"email"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+// authenticateClient checks the client's credentials, from the Authorization header
+// (client_secret_basic) or the form (client_secret_post). Public clients only send their
+// ID.
+func (p *Provider) authenticateClient(r *http.Request) *Client {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// The credentials are form-encoded in the header
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	client, ok := p.clients[id]
+	if !ok {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		return nil
+	}
+	return client
+}
+
+// verifyPKCE checks the code verifier against the S256 code challenge.
+func verifyPKCE(challenge string, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// serveToken is the token endpoint: it exchanges an authorization code for the tokens.
+func (p *Provider) serveToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "malformed request")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	client := p.authenticateClient(r)
+	if client == nil {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	ac := p.codes.take(r.PostFormValue("code"))
+	if ac == nil || ac.request.ClientID != client.ID || ac.request.RedirectURI != r.PostFormValue("redirect_uri") {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+	if !verifyPKCE(ac.request.CodeChallenge, r.PostFormValue("code_verifier")) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "invalid code verifier")
+		return
+	}
+	user, err := p.activeUser(ac.userID)
+	if err != nil {
+		if err == gomagiclink.ErrUserNotFound || err == gomagiclink.ErrUserDisabled || err == gomagiclink.ErrUserLocked {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		} else {
+			p.logError(r, err)
+			writeTokenError(w, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(p.opts.TokenDuration)
+	idClaims := idTokenClaims{
+		Issuer:        p.opts.Issuer,
+		Subject:       user.ID.String(),
+		Audience:      client.ID,
+		Expires:       expires.Unix(),
+		IssuedAt:      now.Unix(),
+		Nonce:         ac.request.Nonce,
+		Email:         user.Email,
+		EmailVerified: true, // The user has opened a link sent to the address
+	}
+	if !ac.authTime.IsZero() {
+		idClaims.AuthTime = ac.authTime.Unix()
+	}
+	idToken, err := p.opts.Keys.Sign(idClaims)
+	if err != nil {
+		p.logError(r, err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	accessToken, err := p.opts.Keys.Sign(accessTokenClaims{
+		Issuer:   p.opts.Issuer,
+		Subject:  user.ID.String(),
+		Audience: client.ID,
+		Expires:  expires.Unix(),
+		IssuedAt: now.Unix(),
+		Scope:    ac.request.Scope,
+		Email:    user.Email,
+	})
+	if err != nil {
+		p.logError(r, err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(p.opts.TokenDuration / time.Second),
+		IDToken:     idToken,
+		Scope:       ac.request.Scope,
+	})
+}
+
+// activeUser loads the user, and checks they can still log in.
+func (p *Provider) activeUser(id uuid.UUID) (*gomagiclink.AuthUserRecord, error) {
+	user, err := p.mlc.GetUserById(id)
+	if err != nil {
+		return nil, err
+	}
+	if !user.Enabled {
+		return nil, gomagiclink.ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, gomagiclink.ErrUserLocked
+	}
+	return user, nil
+}
+
+// serveUserInfo is the UserInfo endpoint, which returns the claims of the access token's
+// user.
+func (p *Provider) serveUserInfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	var claims accessTokenClaims
+	err := p.opts.Keys.Verify(token, &claims)
+	if err != nil || claims.Issuer != p.opts.Issuer || claims.Scope == "" || claims.Expires < time.Now().Unix() {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	user, err := p.activeUser(id)
+	if err != nil {
+		if err == gomagiclink.ErrUserNotFound || err == gomagiclink.ErrUserDisabled || err == gomagiclink.ErrUserLocked {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		} else {
+			p.logError(r, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		}
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sub":            user.ID.String(),
+		"email":          user.Email,
+		"email_verified": true,
+	})
+}
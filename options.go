@@ -0,0 +1,39 @@
+package gomagiclink
+
+import "time"
+
+// ControllerOption configures optional behaviour of the AuthMagicLinkController.
+// Options are passed as the trailing arguments of NewAuthMagicLinkController().
+type ControllerOption func(mlc *AuthMagicLinkController)
+
+// WithUserCache enables an in-memory cache of user records, used by VerifySessionId()
+// to avoid hitting the storage on every request. Concurrent lookups for the same
+// user are deduplicated. Cached records expire after ttl, and are invalidated
+// by StoreUser() and DeleteUser() on the same controller.
+func WithUserCache(ttl time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.userCache = newUserCache(ttl)
+	}
+}
+
+// WithClockSkew sets the tolerance for clock differences between servers in a cluster.
+// Challenges and session IDs are accepted for up to skew after their expiration time,
+// so ones issued by a server whose clock is slightly ahead don't appear expired.
+func WithClockSkew(skew time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		if skew < 0 {
+			skew = -skew
+		}
+		mlc.clockSkew = skew
+	}
+}
+
+// WithSessionGrace enables the session grace mode: session IDs which expired less than
+// grace ago are still accepted by VerifySessionId(), but the returned record has its
+// StaleSession field set, so the app can silently issue a new session ID instead of
+// sending the user to the login page in the middle of their work.
+func WithSessionGrace(grace time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.sessionGrace = grace
+	}
+}
@@ -0,0 +1,271 @@
+// Package orgs adds optional organization (team account) support on top of the
+// gomagiclink controller: organization records, user memberships, and magic link
+// invites into an organization.
+package orgs
+
+import (
+	"crypto/rand"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/internal/b32"
+)
+
+const inviteSignature = "O"
+const invitePurpose = "org-invite"
+const inviteSplitChar = "_"
+const saltLength = 8
+
+var ErrOrgNotFound = errors.New("organization not found")
+var ErrInvalidInvite = errors.New("invalid invite")
+var ErrBrokenInvite = errors.New("broken invite")
+var ErrExpiredInvite = errors.New("expired invite")
+var ErrNotAMember = errors.New("user is not a member of the organization")
+
+// Organization represents a team account which users can belong to.
+type Organization struct {
+	ID         uuid.UUID         `json:"id"`
+	Name       string            `json:"name"`
+	CreatedAt  time.Time         `json:"created_at"`
+	CustomData map[string]string `json:"custom_data"`
+}
+
+// NewOrganization constructs a new Organization record.
+func NewOrganization(name string) (org *Organization, err error) {
+	newID, err := uuid.NewV7()
+	if err != nil {
+		return
+	}
+	return &Organization{
+		ID:        newID,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// OrgDatabase stores organizations and an index of their members. The membership
+// itself (with the role) is stored on the AuthUserRecord.
+type OrgDatabase interface {
+	StoreOrg(org *Organization) error
+	GetOrgById(id uuid.UUID) (*Organization, error)
+	DeleteOrg(id uuid.UUID) error
+	AddMember(orgID uuid.UUID, userID uuid.UUID) error
+	RemoveMember(orgID uuid.UUID, userID uuid.UUID) error
+	GetMemberIds(orgID uuid.UUID) ([]uuid.UUID, error)
+}
+
+// OrgController manages organizations and keeps the memberships on user records
+// and the member index in the OrgDatabase in sync.
+type OrgController struct {
+	mlc               *gomagiclink.AuthMagicLinkController
+	db                OrgDatabase
+	inviteExpDuration time.Duration
+}
+
+// NewOrgController creates an OrgController. Invites expire after inviteExpDuration.
+func NewOrgController(mlc *gomagiclink.AuthMagicLinkController, db OrgDatabase, inviteExpDuration time.Duration) *OrgController {
+	return &OrgController{
+		mlc:               mlc,
+		db:                db,
+		inviteExpDuration: inviteExpDuration,
+	}
+}
+
+func (oc *OrgController) StoreOrg(org *Organization) error {
+	return oc.db.StoreOrg(org)
+}
+
+func (oc *OrgController) GetOrgById(id uuid.UUID) (*Organization, error) {
+	return oc.db.GetOrgById(id)
+}
+
+// DeleteOrg deletes the organization and removes the memberships of all its members.
+func (oc *OrgController) DeleteOrg(id uuid.UUID) error {
+	memberIds, err := oc.db.GetMemberIds(id)
+	if err != nil {
+		return err
+	}
+	for _, userId := range memberIds {
+		err = oc.RemoveMember(id, userId)
+		if err != nil && err != gomagiclink.ErrUserNotFound {
+			return err
+		}
+	}
+	return oc.db.DeleteOrg(id)
+}
+
+// AddMember adds the user to the organization with the given role, or changes the
+// role if they're already a member. The user record is stored.
+func (oc *OrgController) AddMember(org *Organization, user *gomagiclink.AuthUserRecord, role string) error {
+	if m := user.GetMembership(org.ID); m != nil {
+		m.Role = role
+	} else {
+		user.Memberships = append(user.Memberships, gomagiclink.OrgMembership{
+			OrgID:    org.ID,
+			Role:     role,
+			JoinedAt: time.Now(),
+		})
+	}
+	err := oc.mlc.StoreUser(user)
+	if err != nil {
+		return err
+	}
+	return oc.db.AddMember(org.ID, user.ID)
+}
+
+// RemoveMember removes the user from the organization.
+func (oc *OrgController) RemoveMember(orgID uuid.UUID, userID uuid.UUID) error {
+	user, err := oc.mlc.GetUserById(userID)
+	if err != nil {
+		if err == gomagiclink.ErrUserNotFound {
+			// Clean up the index anyway
+			oc.db.RemoveMember(orgID, userID)
+		}
+		return err
+	}
+	user.Memberships = slices.DeleteFunc(user.Memberships, func(m gomagiclink.OrgMembership) bool {
+		return m.OrgID == orgID
+	})
+	err = oc.mlc.StoreUser(user)
+	if err != nil {
+		return err
+	}
+	return oc.db.RemoveMember(orgID, userID)
+}
+
+// GetMembers returns the user records of all the organization's members.
+func (oc *OrgController) GetMembers(orgID uuid.UUID) (users []*gomagiclink.AuthUserRecord, err error) {
+	memberIds, err := oc.db.GetMemberIds(orgID)
+	if err != nil {
+		return nil, err
+	}
+	for _, userId := range memberIds {
+		user, err := oc.mlc.GetUserById(userId)
+		if err != nil {
+			if err == gomagiclink.ErrUserNotFound {
+				continue
+			}
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// GetUserOrgs returns the organizations the user is a member of.
+func (oc *OrgController) GetUserOrgs(user *gomagiclink.AuthUserRecord) (orgs []*Organization, err error) {
+	for _, m := range user.Memberships {
+		org, err := oc.db.GetOrgById(m.OrgID)
+		if err != nil {
+			if err == ErrOrgNotFound {
+				continue
+			}
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, nil
+}
+
+// RequireMembership returns the user's membership in the organization, or ErrNotAMember.
+func (oc *OrgController) RequireMembership(user *gomagiclink.AuthUserRecord, orgID uuid.UUID) (*gomagiclink.OrgMembership, error) {
+	m := user.GetMembership(orgID)
+	if m == nil {
+		return nil, ErrNotAMember
+	}
+	return m, nil
+}
+
+// GenerateInviteChallenge creates a challenge string for a magic link inviting the
+// e-mail address into the organization with the given role. Verifying it with
+// VerifyInviteChallenge() both logs the user in and adds them to the organization.
+// The e-mail address is checked as by GenerateChallenge(), and the invite is recorded
+// in the controller's ChallengeStore, if one is configured.
+func (oc *OrgController) GenerateInviteChallenge(orgID uuid.UUID, email string, role string) (challenge string, err error) {
+	// Invite challenge is in the format:
+	// SALT-ORG_ID-EMAIL-ROLE-EXPTIME-HMAC(SALT || ORG_ID || EMAIL || ROLE || EXPTIME)
+	email = gomagiclink.NormalizeEmail(email)
+	if err = gomagiclink.ValidateEmail(email); err != nil {
+		return
+	}
+	salt := make([]byte, saltLength)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	expTime := time.Now().Add(oc.inviteExpDuration)
+	parts := []string{
+		b32.EncodeToString(salt),
+		orgID.String(),
+		b32.EncodeToString([]byte(email)),
+		b32.EncodeToString([]byte(role)),
+		strconv.FormatInt(expTime.Unix(), 10),
+	}
+	payload := []byte(strings.Join(parts, inviteSplitChar))
+	parts = append(parts, b32.EncodeToString(oc.mlc.SignData(invitePurpose, payload)))
+	challenge = inviteSignature + strings.Join(parts, inviteSplitChar)
+	if err = oc.mlc.IssueSignedChallenge(challenge, email, expTime, gomagiclink.RiskInfo{}); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// VerifyInviteChallenge verifies the invite challenge generated by GenerateInviteChallenge(),
+// loads or creates the invited user's record, adds them to the organization and stores the record.
+// Invites are single-use, and subject to the same checks as VerifyChallenge() (see
+// gomagiclink.AuthMagicLinkController.VerifySignedChallenge()); for users with TOTP,
+// the returned record has TOTPPending set.
+func (oc *OrgController) VerifyInviteChallenge(challenge string) (user *gomagiclink.AuthUserRecord, org *Organization, err error) {
+	if !strings.HasPrefix(challenge, inviteSignature) {
+		return nil, nil, ErrInvalidInvite
+	}
+	parts := strings.Split(challenge[len(inviteSignature):], inviteSplitChar)
+	if len(parts) != 6 {
+		return nil, nil, ErrInvalidInvite
+	}
+	sig, err := b32.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, ErrInvalidInvite
+	}
+	if !oc.mlc.VerifyData(invitePurpose, []byte(strings.Join(parts[:5], inviteSplitChar)), sig) {
+		return nil, nil, ErrBrokenInvite
+	}
+	orgID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return nil, nil, ErrInvalidInvite
+	}
+	email, err := b32.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, ErrInvalidInvite
+	}
+	role, err := b32.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, ErrInvalidInvite
+	}
+	expTime, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil {
+		return nil, nil, ErrInvalidInvite
+	}
+	if expTime < time.Now().Unix() {
+		return nil, nil, ErrExpiredInvite
+	}
+	org, err = oc.db.GetOrgById(orgID)
+	if err != nil {
+		return nil, nil, err
+	}
+	expiresAt := time.Unix(expTime, 0)
+	user, err = oc.mlc.VerifySignedChallenge(challenge, string(email), expiresAt.Add(-oc.inviteExpDuration), expiresAt, gomagiclink.RiskInfo{})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = oc.AddMember(org, user, string(role))
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, org, nil
+}
@@ -0,0 +1,161 @@
+package orgs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// SQLOrgStorage is an OrgDatabase using two tables in a SQL database. The organizations
+// table needs to have these fields:
+//
+//	id		Some type that can store the 16-byte UUID
+//	name	text
+//	data	A type that can accept a long JSON string
+//
+// The members table needs to have these fields:
+//
+//	org_id	Some type that can store the 16-byte UUID
+//	user_id	Some type that can store the 16-byte UUID
+//
+// The tables need to be maintained entirely by the caller, including indexes.
+// A unique index on the organization `id` field, and a unique index on the
+// (org_id, user_id) pair in the members table are highly recommended.
+type SQLOrgStorage struct {
+	db          *sql.DB
+	orgTable    string
+	memberTable string
+	pgsql       bool
+}
+
+// NewSQLiteOrgStorage creates a SQLOrgStorage instance, with SQLite-flavoured SQL.
+func NewSQLiteOrgStorage(db *sql.DB, orgTable string, memberTable string) (st *SQLOrgStorage, err error) {
+	if err = validateTableNames(orgTable, memberTable); err != nil {
+		return nil, err
+	}
+	return &SQLOrgStorage{
+		db:          db,
+		orgTable:    orgTable,
+		memberTable: memberTable,
+	}, nil
+}
+
+// NewPgSQLOrgStorage creates a SQLOrgStorage instance, with PostgreSQL-flavoured SQL.
+func NewPgSQLOrgStorage(db *sql.DB, orgTable string, memberTable string) (st *SQLOrgStorage, err error) {
+	if err = validateTableNames(orgTable, memberTable); err != nil {
+		return nil, err
+	}
+	return &SQLOrgStorage{
+		db:          db,
+		orgTable:    orgTable,
+		memberTable: memberTable,
+		pgsql:       true,
+	}, nil
+}
+
+// query formats the query with the table names, and converts the "?" placeholders
+// to "$1", "$2", etc. for PostgreSQL.
+func (st *SQLOrgStorage) query(q string) string {
+	q = strings.NewReplacer("{orgs}", st.orgTable, "{members}", st.memberTable).Replace(q)
+	if !st.pgsql {
+		return q
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+func (st *SQLOrgStorage) StoreOrg(org *Organization) (err error) {
+	orgJson, err := json.Marshal(org)
+	if err != nil {
+		return
+	}
+	res, err := st.db.Exec(st.query("UPDATE {orgs} SET name=?, data=? WHERE id=?"), org.Name, string(orgJson), org.ID.String())
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return
+	}
+	_, err = st.db.Exec(st.query("INSERT INTO {orgs} (id, name, data) VALUES (?, ?, ?)"), org.ID.String(), org.Name, string(orgJson))
+	return
+}
+
+func (st *SQLOrgStorage) GetOrgById(id uuid.UUID) (org *Organization, err error) {
+	var orgJson string
+	err = st.db.QueryRow(st.query("SELECT data FROM {orgs} WHERE id=?"), id.String()).Scan(&orgJson)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOrgNotFound
+		}
+		return
+	}
+	org = &Organization{}
+	err = json.Unmarshal([]byte(orgJson), org)
+	return
+}
+
+func (st *SQLOrgStorage) DeleteOrg(id uuid.UUID) (err error) {
+	_, err = st.db.Exec(st.query("DELETE FROM {members} WHERE org_id=?"), id.String())
+	if err != nil {
+		return
+	}
+	_, err = st.db.Exec(st.query("DELETE FROM {orgs} WHERE id=?"), id.String())
+	return
+}
+
+func (st *SQLOrgStorage) AddMember(orgID uuid.UUID, userID uuid.UUID) (err error) {
+	var count int
+	err = st.db.QueryRow(st.query("SELECT COUNT(*) FROM {members} WHERE org_id=? AND user_id=?"), orgID.String(), userID.String()).Scan(&count)
+	if err != nil || count > 0 {
+		return
+	}
+	_, err = st.db.Exec(st.query("INSERT INTO {members} (org_id, user_id) VALUES (?, ?)"), orgID.String(), userID.String())
+	return
+}
+
+func (st *SQLOrgStorage) RemoveMember(orgID uuid.UUID, userID uuid.UUID) (err error) {
+	_, err = st.db.Exec(st.query("DELETE FROM {members} WHERE org_id=? AND user_id=?"), orgID.String(), userID.String())
+	return
+}
+
+func (st *SQLOrgStorage) GetMemberIds(orgID uuid.UUID) (ids []uuid.UUID, err error) {
+	rows, err := st.db.Query(st.query("SELECT user_id FROM {members} WHERE org_id=?"), orgID.String())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var idStr string
+		err = rows.Scan(&idStr)
+		if err != nil {
+			return nil, err
+		}
+		id, err := uuid.Parse(idStr)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func validateTableNames(orgTable string, memberTable string) error {
+	if err := gomagiclink.ValidateSQLIdentifier(orgTable); err != nil {
+		return err
+	}
+	return gomagiclink.ValidateSQLIdentifier(memberTable)
+}
@@ -0,0 +1,237 @@
+package gomagiclink
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrPendingLoginNotFound = errors.New("pending login not found")
+var ErrNoPendingLoginStore = errors.New("no pending login store configured")
+
+// PendingLogin is a login started on one device (e.g. a mobile app), which is completed
+// when the user opens the magic link on another device (e.g. in a desktop mail client).
+type PendingLogin struct {
+	ID          string    `json:"id"`           // Random ID, known only to the device which started the login
+	ChallengeID string    `json:"challenge_id"` // See ChallengeID()
+	Email       string    `json:"email"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	UserID      uuid.UUID `json:"user_id"`    // Set when the login is completed
+	SessionID   string    `json:"session_id"` // Set when the login is completed
+}
+
+// PendingLoginStore keeps the pending logins, between StartPendingLogin() and
+// PollPendingLogin(). Expired logins should not be returned.
+type PendingLoginStore interface {
+	AddPendingLogin(pl *PendingLogin) error
+	GetPendingLogin(id string) (*PendingLogin, error)                     // Returns ErrPendingLoginNotFound if it's not in the store
+	GetPendingLoginByChallenge(challengeID string) (*PendingLogin, error) // Returns ErrPendingLoginNotFound if it's not in the store
+	UpdatePendingLogin(pl *PendingLogin) error
+	RemovePendingLogin(id string) error
+}
+
+// WithPendingLoginStore enables cross-device logins with StartPendingLogin().
+func WithPendingLoginStore(pls PendingLoginStore) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.pendingLoginStore = pls
+	}
+}
+
+// StartPendingLogin starts a login for a device (e.g. a native mobile app) which may not
+// be the one on which the user opens the magic link. It returns a login ID, which the
+// device keeps secret and uses with PollPendingLogin(), and the challenge to send to the
+// user (see BuildMagicLink()). When the magic link is opened, the app's verification
+// handler calls VerifyChallenge() and then CompletePendingLogin().
+func (mlc *AuthMagicLinkController) StartPendingLogin(email string) (loginId string, challenge string, err error) {
+	if mlc.pendingLoginStore == nil {
+		return "", "", ErrNoPendingLoginStore
+	}
+	challenge, err = mlc.GenerateChallenge(email)
+	if err != nil {
+		return
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return "", "", err
+	}
+	loginId = hex.EncodeToString(id)
+	err = mlc.pendingLoginStore.AddPendingLogin(&PendingLogin{
+		ID:          loginId,
+		ChallengeID: ChallengeID(challenge),
+		Email:       NormalizeEmail(email),
+		ExpiresAt:   time.Now().Add(mlc.challengeExpDuration),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return loginId, challenge, nil
+}
+
+// CompletePendingLogin completes the pending login started with the challenge, if there
+// is one, by generating a session ID for the device which started it. It should be
+// called after VerifyChallenge() succeeds, and returns false if the challenge wasn't
+// created by StartPendingLogin().
+func (mlc *AuthMagicLinkController) CompletePendingLogin(challenge string, user *AuthUserRecord) (completed bool, err error) {
+	if mlc.pendingLoginStore == nil {
+		return false, nil
+	}
+	pl, err := mlc.pendingLoginStore.GetPendingLoginByChallenge(ChallengeID(challenge))
+	if err == ErrPendingLoginNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if pl.Email != user.Email || pl.SessionID != "" {
+		return false, nil
+	}
+	pl.SessionID, err = mlc.GenerateSessionId(user)
+	if err != nil {
+		return false, err
+	}
+	pl.UserID = user.ID
+	return true, mlc.pendingLoginStore.UpdatePendingLogin(pl)
+}
+
+// PollPendingLogin returns the session ID for the pending login once it's completed,
+// and an empty string while it's still pending. The session ID is returned only once,
+// after which the pending login is removed.
+func (mlc *AuthMagicLinkController) PollPendingLogin(loginId string) (sessionId string, err error) {
+	if mlc.pendingLoginStore == nil {
+		return "", ErrNoPendingLoginStore
+	}
+	pl, err := mlc.pendingLoginStore.GetPendingLogin(loginId)
+	if err != nil {
+		return "", err
+	}
+	if pl.SessionID == "" {
+		return "", nil
+	}
+	err = mlc.pendingLoginStore.RemovePendingLogin(loginId)
+	if err == ErrPendingLoginNotFound {
+		// Another poll got it first
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	return pl.SessionID, nil
+}
+
+// WaitPendingLogin calls PollPendingLogin() every interval until the login is completed,
+// it expires, or the context is done. It's useful for long-polling HTTP handlers.
+func (mlc *AuthMagicLinkController) WaitPendingLogin(ctx context.Context, loginId string, interval time.Duration) (sessionId string, err error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sessionId, err = mlc.PollPendingLogin(loginId)
+		if err != nil || sessionId != "" {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// BuildMagicLink adds the challenge to baseURL, which can be a regular web URL, a
+// universal link / app link handled by a mobile app (e.g. "https://example.com/app/login"),
+// or a custom scheme URL (e.g. "myapp://login").
+func BuildMagicLink(baseURL string, challenge string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("challenge", challenge)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// MemoryPendingLoginStore is an in-memory PendingLoginStore, suitable for single-instance apps.
+type MemoryPendingLoginStore struct {
+	lock        sync.Mutex
+	logins      map[string]*PendingLogin
+	byChallenge map[string]string
+}
+
+func NewMemoryPendingLoginStore() *MemoryPendingLoginStore {
+	return &MemoryPendingLoginStore{
+		logins:      map[string]*PendingLogin{},
+		byChallenge: map[string]string{},
+	}
+}
+
+// purge removes the expired logins. The lock needs to be held.
+func (ms *MemoryPendingLoginStore) purge() {
+	now := time.Now()
+	for id, pl := range ms.logins {
+		if pl.ExpiresAt.Before(now) {
+			delete(ms.logins, id)
+			delete(ms.byChallenge, pl.ChallengeID)
+		}
+	}
+}
+
+func (ms *MemoryPendingLoginStore) AddPendingLogin(pl *PendingLogin) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.purge()
+	plCopy := *pl
+	ms.logins[pl.ID] = &plCopy
+	ms.byChallenge[pl.ChallengeID] = pl.ID
+	return nil
+}
+
+func (ms *MemoryPendingLoginStore) GetPendingLogin(id string) (*PendingLogin, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.purge()
+	pl, ok := ms.logins[id]
+	if !ok {
+		return nil, ErrPendingLoginNotFound
+	}
+	plCopy := *pl
+	return &plCopy, nil
+}
+
+func (ms *MemoryPendingLoginStore) GetPendingLoginByChallenge(challengeID string) (*PendingLogin, error) {
+	ms.lock.Lock()
+	id, ok := ms.byChallenge[challengeID]
+	ms.lock.Unlock()
+	if !ok {
+		return nil, ErrPendingLoginNotFound
+	}
+	return ms.GetPendingLogin(id)
+}
+
+func (ms *MemoryPendingLoginStore) UpdatePendingLogin(pl *PendingLogin) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.logins[pl.ID]; !ok {
+		return ErrPendingLoginNotFound
+	}
+	plCopy := *pl
+	ms.logins[pl.ID] = &plCopy
+	return nil
+}
+
+func (ms *MemoryPendingLoginStore) RemovePendingLogin(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	pl, ok := ms.logins[id]
+	if !ok {
+		return ErrPendingLoginNotFound
+	}
+	delete(ms.logins, id)
+	delete(ms.byChallenge, pl.ChallengeID)
+	return nil
+}
@@ -0,0 +1,218 @@
+package gomagiclink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"os"
+	"time"
+
+	"github.com/ivoras/gomagiclink/internal/yaml"
+)
+
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// PolicyDuration is a time.Duration which is written as a string like "1h30m" in policy
+// files. Plain numbers are taken as seconds.
+type PolicyDuration time.Duration
+
+func (d *PolicyDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var seconds float64
+		if err = json.Unmarshal(b, &seconds); err != nil {
+			return err
+		}
+		*d = PolicyDuration(seconds * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = PolicyDuration(v)
+	return nil
+}
+
+func (d PolicyDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Anti-enumeration modes of a Policy, deciding what happens when a magic link is
+// requested for a disabled or locked user (see WithBlockedUserChallenges()).
+const (
+	AntiEnumerationSend     = "send"     // The link is sent, and fails when it's opened (the default)
+	AntiEnumerationSuppress = "suppress" // Nothing is sent, but the response looks like it was
+	AntiEnumerationOff      = "off"      // The request fails with ErrUserDisabled or ErrUserLocked
+)
+
+// PolicyRateLimit is a request rate limit in a Policy, with the same meaning as the
+// fields of adapters.RateLimitOptions. Zero values leave the defaults unchanged.
+type PolicyRateLimit struct {
+	Requests int            `json:"requests,omitempty"`
+	Interval PolicyDuration `json:"interval,omitempty"`
+	Burst    int            `json:"burst,omitempty"`
+}
+
+// PolicyMailer are the SMTP settings in a Policy, see mailer.NewSMTPSenderFromPolicy().
+// The password isn't part of the policy, so policy files don't hold secrets.
+type PolicyMailer struct {
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"` // Default 587
+	Username string `json:"username,omitempty"`
+	From     string `json:"from,omitempty"` // Required with Host
+	Subject  string `json:"subject,omitempty"`
+}
+
+// Policy is the authentication policy which operators can manage separately from the
+// code, loaded from a file with LoadPolicyFromFile(). The controller settings are applied
+// with NewController() or ControllerOptions(); the rate limits and the mailer settings
+// are for adapters.RateLimitOptions.ApplyPolicy() and mailer.NewSMTPSenderFromPolicy().
+type Policy struct {
+	ChallengeExpiry PolicyDuration `json:"challenge_expiry"` // Required
+	SessionExpiry   PolicyDuration `json:"session_expiry"`   // Required
+	ClockSkew       PolicyDuration `json:"clock_skew,omitempty"`
+	ResendInterval  PolicyDuration `json:"resend_interval,omitempty"`
+	// MaxOutstandingChallenges needs a ChallengeStore, given with the options of NewController()
+	MaxOutstandingChallenges int `json:"max_outstanding_challenges,omitempty"`
+
+	// Domain patterns as in EmailDomainPolicy
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	DeniedDomains  []string `json:"denied_domains,omitempty"`
+
+	AntiEnumeration string `json:"anti_enumeration,omitempty"` // One of the AntiEnumeration* modes, default AntiEnumerationSend
+
+	RateLimits struct {
+		Login  PolicyRateLimit `json:"login"`
+		Verify PolicyRateLimit `json:"verify"`
+	} `json:"rate_limits"`
+
+	Mailer PolicyMailer `json:"mailer"`
+}
+
+// LoadPolicyFromFile reads the policy from a JSON or YAML file (only a subset of YAML is
+// supported: mappings, sequences, scalars and comments), and validates it. Unknown keys
+// are rejected, so typos don't go unnoticed. Durations are written as strings like "15m".
+// A YAML example:
+//
+//	challenge_expiry: 15m
+//	session_expiry: 24h
+//	allowed_domains: [example.com, "*.example.com"]
+//	anti_enumeration: suppress
+//	rate_limits:
+//	  login:
+//	    requests: 5
+//	    interval: 1m
+//	mailer:
+//	  host: smtp.example.com
+//	  from: Example <login@example.com>
+//
+// Invalid policies are rejected with an error wrapping ErrInvalidPolicy, describing all
+// the problems.
+func LoadPolicyFromFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses and validates a policy, like LoadPolicyFromFile(). Documents starting
+// with "{" are parsed as JSON, and the others as YAML.
+func ParsePolicy(data []byte) (*Policy, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		var err error
+		if data, err = yaml.ToJSON(data); err != nil {
+			return nil, errors.Join(ErrInvalidPolicy, err)
+		}
+	}
+	p := &Policy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, errors.Join(ErrInvalidPolicy, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks the policy, returning an error wrapping ErrInvalidPolicy which
+// describes all the problems.
+func (p *Policy) Validate() error {
+	var errs []error
+	if p.ChallengeExpiry <= 0 || p.SessionExpiry <= 0 {
+		errs = append(errs, errors.New("challenge_expiry and session_expiry must be positive"))
+	}
+	if p.ClockSkew < 0 || p.ResendInterval < 0 || p.MaxOutstandingChallenges < 0 {
+		errs = append(errs, errors.New("clock_skew, resend_interval and max_outstanding_challenges can't be negative"))
+	}
+	if _, err := compileDomainPatterns(p.AllowedDomains); err != nil {
+		errs = append(errs, errors.New("allowed_domains: "+err.Error()))
+	}
+	if _, err := compileDomainPatterns(p.DeniedDomains); err != nil {
+		errs = append(errs, errors.New("denied_domains: "+err.Error()))
+	}
+	switch p.AntiEnumeration {
+	case "", AntiEnumerationSend, AntiEnumerationSuppress, AntiEnumerationOff:
+	default:
+		errs = append(errs, errors.New("anti_enumeration must be \"send\", \"suppress\" or \"off\""))
+	}
+	for _, rl := range []PolicyRateLimit{p.RateLimits.Login, p.RateLimits.Verify} {
+		if rl.Requests < 0 || rl.Interval < 0 || rl.Burst < 0 {
+			errs = append(errs, errors.New("rate_limits can't be negative"))
+			break
+		}
+	}
+	if m := p.Mailer; m.Host != "" {
+		if _, err := mail.ParseAddress(m.From); err != nil {
+			errs = append(errs, errors.New("mailer.from must be a valid address with mailer.host"))
+		}
+		if m.Port < 0 || m.Port > 65535 {
+			errs = append(errs, errors.New("mailer.port is out of range"))
+		}
+	} else if m != (PolicyMailer{}) {
+		errs = append(errs, errors.New("mailer.host is required with the other mailer settings"))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Join(append([]error{ErrInvalidPolicy}, errs...)...)
+}
+
+// ControllerOptions returns the options applying the policy's controller settings, other
+// than the expirations.
+func (p *Policy) ControllerOptions() (opts []ControllerOption) {
+	if p.ClockSkew > 0 {
+		opts = append(opts, WithClockSkew(time.Duration(p.ClockSkew)))
+	}
+	if p.ResendInterval > 0 {
+		opts = append(opts, WithResendInterval(time.Duration(p.ResendInterval)))
+	}
+	if p.MaxOutstandingChallenges > 0 {
+		opts = append(opts, WithMaxOutstandingChallenges(p.MaxOutstandingChallenges))
+	}
+	if len(p.AllowedDomains) > 0 || len(p.DeniedDomains) > 0 {
+		opts = append(opts, WithEmailDomainPolicy(EmailDomainPolicy{Allow: p.AllowedDomains, Deny: p.DeniedDomains}))
+	}
+	switch p.AntiEnumeration {
+	case AntiEnumerationSuppress:
+		opts = append(opts, WithBlockedUserChallenges(BlockedUserChallengesSuppressed))
+	case AntiEnumerationOff:
+		opts = append(opts, WithBlockedUserChallenges(BlockedUserChallengesRefused))
+	}
+	return opts
+}
+
+// NewController creates the controller with the policy's expirations and settings. The
+// options are applied after the policy's, so they can add to it (e.g. WithChallengeStore())
+// but also override it.
+func (p *Policy) NewController(secretKey []byte, db UserStorage, opts ...ControllerOption) (*AuthMagicLinkController, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return NewAuthMagicLinkController(secretKey, time.Duration(p.ChallengeExpiry), time.Duration(p.SessionExpiry), db,
+		append(p.ControllerOptions(), opts...)...)
+}
@@ -0,0 +1,123 @@
+package gomagiclink_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+const testPolicyYAML = `# Login policy
+challenge_expiry: 15m
+session_expiry: 24h
+clock_skew: 30   # seconds
+allowed_domains: [example.com, "*.example.com"]
+denied_domains:
+- spam.example.com
+anti_enumeration: suppress
+rate_limits:
+    login:
+        requests: 5
+        interval: 1m
+    verify:
+        burst: 3
+mailer:
+  host: smtp.example.com
+  from: 'Example <login@example.com>'
+`
+
+const testPolicyJSON = `{
+	"challenge_expiry": "15m", "session_expiry": "24h", "clock_skew": 30,
+	"allowed_domains": ["example.com", "*.example.com"], "denied_domains": ["spam.example.com"],
+	"anti_enumeration": "suppress",
+	"rate_limits": {"login": {"requests": 5, "interval": "1m"}, "verify": {"burst": 3}},
+	"mailer": {"host": "smtp.example.com", "from": "Example <login@example.com>"}
+}`
+
+func TestParsePolicy(t *testing.T) {
+	want := &gomagiclink.Policy{
+		ChallengeExpiry: gomagiclink.PolicyDuration(15 * time.Minute),
+		SessionExpiry:   gomagiclink.PolicyDuration(24 * time.Hour),
+		ClockSkew:       gomagiclink.PolicyDuration(30 * time.Second),
+		AllowedDomains:  []string{"example.com", "*.example.com"},
+		DeniedDomains:   []string{"spam.example.com"},
+		AntiEnumeration: gomagiclink.AntiEnumerationSuppress,
+		Mailer:          gomagiclink.PolicyMailer{Host: "smtp.example.com", From: "Example <login@example.com>"},
+	}
+	want.RateLimits.Login = gomagiclink.PolicyRateLimit{Requests: 5, Interval: gomagiclink.PolicyDuration(time.Minute)}
+	want.RateLimits.Verify = gomagiclink.PolicyRateLimit{Burst: 3}
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(testPolicyYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, load := range map[string]func() (*gomagiclink.Policy, error){
+		"YAML":      func() (*gomagiclink.Policy, error) { return gomagiclink.ParsePolicy([]byte(testPolicyYAML)) },
+		"JSON":      func() (*gomagiclink.Policy, error) { return gomagiclink.ParsePolicy([]byte(testPolicyJSON)) },
+		"YAML file": func() (*gomagiclink.Policy, error) { return gomagiclink.LoadPolicyFromFile(path) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, err := load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, want) {
+				t.Errorf("policy = %+v, want %+v", p, want)
+			}
+			if opts := p.ControllerOptions(); len(opts) != 3 {
+				t.Errorf("%d controller options, want 3", len(opts))
+			}
+		})
+	}
+
+	if _, err := gomagiclink.LoadPolicyFromFile(filepath.Join(t.TempDir(), "missing.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadPolicyFromFile() of a missing file: %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	const required = "challenge_expiry: 15m\nsession_expiry: 24h\n"
+	for _, tc := range []struct {
+		name string
+		in   string
+		want []string // In the error message
+	}{
+		{"empty", "", []string{"must be positive"}},
+		{"missing expiry", "challenge_expiry: 15m", []string{"must be positive"}},
+		{"invalid duration", "challenge_expiry: 15 minutes\nsession_expiry: 24h", []string{`unknown unit " minutes"`}},
+		{"unknown key", required + "challenge_expiration: 15m", []string{`unknown field "challenge_expiration"`}},
+		{"unknown nested key", required + "rate_limits:\n  login:\n    request: 5", []string{`unknown field "request"`}},
+		{"wrong type", required + "allowed_domains: example.com", []string{"cannot unmarshal"}},
+		{"malformed JSON", `{"challenge_expiry": "15m",}`, []string{"invalid character"}},
+		{"tab indentation", required + "rate_limits:\n\tlogin: {}", []string{"line 4: tabs"}},
+		{"indented key", required + "  clock_skew: 1s", []string{"line 3: unexpected indentation"}},
+		{"inconsistent indentation", required + "rate_limits:\n    login:\n      requests: 5\n  verify:\n      burst: 3", []string{"line 6: unexpected indentation"}},
+		{"nested key at the top level", required + "rate_limits:\nlogin:\n  requests: 5", []string{`unknown field "login"`}},
+		{"duplicate key", required + "challenge_expiry: 10m", []string{`line 3: duplicate key "challenge_expiry"`}},
+		{"flow mapping", required + "rate_limits: {login: {requests: 5}}", []string{"unsupported YAML syntax"}},
+		{"all the problems", "challenge_expiry: -1m\nsession_expiry: 0s\nclock_skew: -1s\nallowed_domains: ['']\nanti_enumeration: hide\nrate_limits:\n  verify:\n    burst: -1\nmailer:\n  host: smtp.example.com\n  from: nobody\n  port: 70000", []string{
+			"must be positive", "can't be negative", "allowed_domains", "anti_enumeration", "rate_limits can't be negative", "mailer.from", "mailer.port",
+		}},
+		{"mailer without a host", required + "mailer:\n  from: login@example.com", []string{"mailer.host is required"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := gomagiclink.ParsePolicy([]byte(tc.in))
+			if err == nil {
+				t.Fatalf("ParsePolicy(%q) = %+v, want an error", tc.in, p)
+			}
+			if !errors.Is(err, gomagiclink.ErrInvalidPolicy) {
+				t.Errorf("ParsePolicy(%q): %v, want ErrInvalidPolicy", tc.in, err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("ParsePolicy(%q): %v, want %q in the error", tc.in, err, want)
+				}
+			}
+		})
+	}
+}
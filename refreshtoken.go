@@ -0,0 +1,319 @@
+package gomagiclink
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const refreshTokenSignature = "F"
+
+var ErrRefreshTokensDisabled = errors.New("refresh tokens not enabled")
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// RefreshTokenRecord is a refresh token, as kept in a RefreshTokenStore.
+type RefreshTokenRecord struct {
+	ID                 string    `json:"id"` // SHA-256 hash of the refresh token, so a leaked store doesn't leak tokens
+	UserID             uuid.UUID `json:"user_id"`
+	CreatedAt          time.Time `json:"created_at"` // When the user logged in; kept when the token is rotated
+	ExpiresAt          time.Time `json:"expires_at"`
+	FamilyID           string    `json:"family_id,omitempty"`            // Shared by the tokens rotated from the same login
+	ProofKeyThumbprint string    `json:"proof_key_thumbprint,omitempty"` // Of the proof key the sessions are bound to, if any
+	RotatedAt          time.Time `json:"rotated_at"`                     // Set on the records kept for exchanged tokens, to detect their reuse
+}
+
+// RefreshTokenStore keeps the refresh tokens, see WithRefreshTokens(). RemoveRefreshToken()
+// must report ErrRefreshTokenNotFound if the token isn't there, so a token exchanged
+// concurrently by two requests is only accepted once. Stores which can remove the tokens
+// of a family by themselves can also implement RefreshTokenFamilyStore.
+type RefreshTokenStore interface {
+	AddRefreshToken(rec *RefreshTokenRecord) error
+	GetRefreshToken(id string) (*RefreshTokenRecord, error) // Returns ErrRefreshTokenNotFound if it's not in the store
+	RemoveRefreshToken(id string) error
+	RemoveUserRefreshTokens(userID uuid.UUID) error
+}
+
+// RefreshTokenFamilyStore is implemented by the RefreshTokenStores which can remove the
+// tokens of a family (see RefreshTokenRecord.FamilyID), which is done when the reuse of
+// an exchanged token is detected. With the other stores, all the user's refresh tokens
+// are removed instead.
+type RefreshTokenFamilyStore interface {
+	RemoveRefreshTokenFamily(familyID string) error
+}
+
+// DefaultRefreshTokenLifetime is the lifetime of refresh tokens if WithRefreshTokens()
+// isn't given one.
+const DefaultRefreshTokenLifetime = 30 * 24 * time.Hour
+
+// WithRefreshTokens enables the "remember me" two-token model: keep the session expiry
+// (set in NewAuthMagicLinkController()) short, and give users a long-lived refresh token
+// with GenerateRefreshToken(), kept in the RefreshTokenStore, which ExchangeRefreshToken()
+// trades for a new session ID when the session expires. Refresh tokens are valid for
+// lifetime (default DefaultRefreshTokenLifetime), but not longer than a session lifetime
+// policy allows (see WithSessionLifetimePolicy()), and can be revoked with
+// RevokeRefreshToken() and RevokeUserSessions().
+func WithRefreshTokens(store RefreshTokenStore, lifetime time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		if lifetime <= 0 {
+			lifetime = DefaultRefreshTokenLifetime
+		}
+		mlc.refreshTokenStore = store
+		mlc.refreshTokenLifetime = lifetime
+	}
+}
+
+// RefreshTokenLifetime returns the lifetime of refresh tokens set by WithRefreshTokens(),
+// or 0 if they aren't enabled.
+func (mlc *AuthMagicLinkController) RefreshTokenLifetime() time.Duration {
+	if mlc.refreshTokenStore == nil {
+		return 0
+	}
+	return mlc.refreshTokenLifetime
+}
+
+// GenerateRefreshToken creates a refresh token for the user, e.g. after VerifyChallenge()
+// if the user has asked to be remembered. Refresh tokens aren't generated for users who
+// still need to enter a TOTP code (ErrTOTPRequired), nor for impersonation sessions
+// (ErrImpersonationNotAllowed). If the user's sessions are bound to a proof key (see
+// GenerateChallengeWithProofKey()), so are the sessions the refresh token is exchanged
+// for.
+func (mlc *AuthMagicLinkController) GenerateRefreshToken(user *AuthUserRecord) (refreshToken string, err error) {
+	if mlc.refreshTokenStore == nil {
+		return "", ErrRefreshTokensDisabled
+	}
+	if user.TOTPPending {
+		return "", ErrTOTPRequired
+	}
+	if user.ImpersonatedBy != uuid.Nil {
+		return "", ErrImpersonationNotAllowed
+	}
+	lifetime := mlc.refreshTokenLifetime
+	if user.SessionLifetime > 0 && user.SessionLifetime < lifetime {
+		lifetime = user.SessionLifetime
+	}
+	family := make([]byte, 16)
+	if _, err = rand.Read(family); err != nil {
+		return
+	}
+	now := time.Now()
+	return mlc.addRefreshToken(&RefreshTokenRecord{
+		UserID:             user.ID,
+		CreatedAt:          now,
+		ExpiresAt:          now.Add(lifetime),
+		FamilyID:           encodeToString(family),
+		ProofKeyThumbprint: user.ProofKeyThumbprint,
+	})
+}
+
+// addRefreshToken creates a random refresh token and adds it to the store with the
+// record's fields.
+func (mlc *AuthMagicLinkController) addRefreshToken(rec *RefreshTokenRecord) (refreshToken string, err error) {
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	refreshToken = refreshTokenSignature + encodeToString(random)
+	rec.ID = storedSessionHash(refreshToken)
+	if err = mlc.refreshTokenStore.AddRefreshToken(rec); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// ExchangeRefreshToken verifies the refresh token, and returns the user's record, a new
+// session ID, and a new refresh token replacing the used one, which expires at the same
+// time. Each refresh token can be exchanged only once; keep the new one. Invalid,
+// expired and already used refresh tokens are rejected with ErrInvalidRefreshToken, and
+// those of disabled and locked users with ErrUserDisabled and ErrUserLocked. An already
+// used token means that it was stolen (or the new one was), so all the tokens rotated
+// from the same login are revoked. The new session is bound to the same proof key as
+// the session the refresh token was generated with, if any.
+func (mlc *AuthMagicLinkController) ExchangeRefreshToken(refreshToken string) (user *AuthUserRecord, sessionId string, newRefreshToken string, err error) {
+	if mlc.refreshTokenStore == nil {
+		return nil, "", "", ErrRefreshTokensDisabled
+	}
+	if len(refreshToken) == 0 || refreshToken[:1] != refreshTokenSignature {
+		return nil, "", "", ErrInvalidRefreshToken
+	}
+	id := storedSessionHash(refreshToken)
+	rec, err := mlc.refreshTokenStore.GetRefreshToken(id)
+	if err == ErrRefreshTokenNotFound {
+		return nil, "", "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return
+	}
+	if !rec.RotatedAt.IsZero() {
+		if err = mlc.revokeRefreshTokenFamily(rec); err != nil {
+			return nil, "", "", err
+		}
+		return nil, "", "", ErrInvalidRefreshToken
+	}
+	// Removed before anything else, so a concurrent exchange of the same token fails
+	if err = mlc.refreshTokenStore.RemoveRefreshToken(id); err != nil {
+		if err == ErrRefreshTokenNotFound {
+			err = ErrInvalidRefreshToken
+		}
+		return nil, "", "", err
+	}
+	if !rec.ExpiresAt.After(time.Now()) {
+		return nil, "", "", ErrInvalidRefreshToken
+	}
+	// Kept until the family expires, so its reuse is detected
+	rotated := *rec
+	rotated.RotatedAt = time.Now()
+	if err = mlc.refreshTokenStore.AddRefreshToken(&rotated); err != nil {
+		return nil, "", "", err
+	}
+	user, err = mlc.getUserById(rec.UserID)
+	if err == ErrUserNotFound {
+		return nil, "", "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return
+	}
+	if !user.Enabled {
+		return nil, "", "", ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, "", "", ErrUserLocked
+	}
+	if remaining := time.Until(rec.ExpiresAt); mlc.sessionExpDuration <= 0 || remaining < mlc.sessionExpDuration {
+		// Sessions don't outlive the refresh token
+		user.SessionLifetime = remaining
+	}
+	user.ProofKeyThumbprint = rec.ProofKeyThumbprint
+	if sessionId, err = mlc.GenerateSessionId(user); err != nil {
+		return nil, "", "", err
+	}
+	next := &RefreshTokenRecord{
+		UserID:             rec.UserID,
+		CreatedAt:          rec.CreatedAt,
+		ExpiresAt:          rec.ExpiresAt,
+		FamilyID:           rec.FamilyID,
+		ProofKeyThumbprint: rec.ProofKeyThumbprint,
+	}
+	if newRefreshToken, err = mlc.addRefreshToken(next); err != nil {
+		return nil, "", "", err
+	}
+	user.RecentLoginTime = time.Now()
+	mlc.audit(AuditEvent{Type: AuditSessionRefreshed, UserID: user.ID, Email: user.Email})
+	return user, sessionId, newRefreshToken, nil
+}
+
+// revokeRefreshTokenFamily removes the refresh tokens rotated from the same login as the
+// reused one, or all the user's refresh tokens if the store can't remove a family.
+func (mlc *AuthMagicLinkController) revokeRefreshTokenFamily(rec *RefreshTokenRecord) (err error) {
+	fs, ok := mlc.refreshTokenStore.(RefreshTokenFamilyStore)
+	if ok && rec.FamilyID != "" {
+		err = fs.RemoveRefreshTokenFamily(rec.FamilyID)
+	} else {
+		err = mlc.refreshTokenStore.RemoveUserRefreshTokens(rec.UserID)
+	}
+	if err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: rec.UserID, Details: map[string]string{"scope": "refresh_token_family", "reason": "reuse"}})
+	return nil
+}
+
+// RevokeRefreshToken removes the refresh token from the RefreshTokenStore, e.g. on logout.
+func (mlc *AuthMagicLinkController) RevokeRefreshToken(refreshToken string) (err error) {
+	if mlc.refreshTokenStore == nil {
+		return ErrRefreshTokensDisabled
+	}
+	if len(refreshToken) == 0 || refreshToken[:1] != refreshTokenSignature {
+		return ErrInvalidRefreshToken
+	}
+	id := storedSessionHash(refreshToken)
+	rec, err := mlc.refreshTokenStore.GetRefreshToken(id)
+	if err == ErrRefreshTokenNotFound {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return
+	}
+	if !rec.RotatedAt.IsZero() {
+		// Already exchanged for another token
+		return ErrInvalidRefreshToken
+	}
+	if err = mlc.refreshTokenStore.RemoveRefreshToken(id); err != nil && err != ErrRefreshTokenNotFound {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: rec.UserID, Details: map[string]string{"scope": "refresh_token"}})
+	return nil
+}
+
+// MemoryRefreshTokenStore is an in-memory RefreshTokenStore, suitable for single-instance
+// apps. Refresh tokens are lost when the app restarts, so users have to log in again.
+type MemoryRefreshTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]*RefreshTokenRecord
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{tokens: map[string]*RefreshTokenRecord{}}
+}
+
+func (ms *MemoryRefreshTokenStore) AddRefreshToken(rec *RefreshTokenRecord) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if len(ms.tokens) >= 10000 {
+		now := time.Now()
+		for id, rec := range ms.tokens {
+			if rec.ExpiresAt.Before(now) {
+				delete(ms.tokens, id)
+			}
+		}
+	}
+	recCopy := *rec
+	ms.tokens[rec.ID] = &recCopy
+	return nil
+}
+
+func (ms *MemoryRefreshTokenStore) GetRefreshToken(id string) (*RefreshTokenRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rec, ok := ms.tokens[id]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+	recCopy := *rec
+	return &recCopy, nil
+}
+
+func (ms *MemoryRefreshTokenStore) RemoveRefreshToken(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.tokens[id]; !ok {
+		return ErrRefreshTokenNotFound
+	}
+	delete(ms.tokens, id)
+	return nil
+}
+
+func (ms *MemoryRefreshTokenStore) RemoveRefreshTokenFamily(familyID string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, rec := range ms.tokens {
+		if rec.FamilyID == familyID {
+			delete(ms.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryRefreshTokenStore) RemoveUserRefreshTokens(userID uuid.UUID) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, rec := range ms.tokens {
+		if rec.UserID == userID {
+			delete(ms.tokens, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package gomagiclink_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// userOnlyRefreshTokenStore hides the RefreshTokenFamilyStore methods of the store.
+type userOnlyRefreshTokenStore struct {
+	gomagiclink.RefreshTokenStore
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	mlc, _, user := newTestController(t, gomagiclink.WithRefreshTokens(gomagiclink.NewMemoryRefreshTokenStore(), time.Hour))
+	refreshToken, err := mlc.GenerateRefreshToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{refreshToken: true}
+	for i := 0; i < 3; i++ {
+		exchanged, sessionId, next, err := mlc.ExchangeRefreshToken(refreshToken)
+		if err != nil {
+			t.Fatalf("exchange %d: %v", i, err)
+		}
+		if exchanged.ID != user.ID {
+			t.Errorf("exchange %d returned user %v, want %v", i, exchanged.ID, user.ID)
+		}
+		if verified, err := mlc.VerifySessionId(sessionId); err != nil || verified.ID != user.ID {
+			t.Errorf("session from exchange %d: %v", i, err)
+		}
+		if seen[next] {
+			t.Fatalf("exchange %d returned a refresh token issued before", i)
+		}
+		seen[next] = true
+		refreshToken = next
+	}
+
+	if err = mlc.RevokeRefreshToken(refreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = mlc.ExchangeRefreshToken(refreshToken); err != gomagiclink.ErrInvalidRefreshToken {
+		t.Errorf("revoked refresh token = %v, want ErrInvalidRefreshToken", err)
+	}
+	for _, invalid := range []string{"", "F", "Fnot-a-token", "Snot-a-token"} {
+		if _, _, _, err = mlc.ExchangeRefreshToken(invalid); err != gomagiclink.ErrInvalidRefreshToken {
+			t.Errorf("ExchangeRefreshToken(%q) = %v, want ErrInvalidRefreshToken", invalid, err)
+		}
+	}
+}
+
+// TestRefreshTokenReuse checks that exchanging a refresh token again revokes the tokens
+// rotated from the same login, or all the user's tokens with stores which can't remove
+// a family.
+func TestRefreshTokenReuse(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		store        gomagiclink.RefreshTokenStore
+		otherRevoked bool // The tokens of the user's other logins are revoked too
+	}{
+		{"family store", gomagiclink.NewMemoryRefreshTokenStore(), false},
+		{"store without families", userOnlyRefreshTokenStore{gomagiclink.NewMemoryRefreshTokenStore()}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mlc, _, user := newTestController(t, gomagiclink.WithRefreshTokens(tc.store, time.Hour))
+			stolen, err := mlc.GenerateRefreshToken(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := mlc.GenerateRefreshToken(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, second, err := mlc.ExchangeRefreshToken(stolen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, latest, err := mlc.ExchangeRefreshToken(second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The attacker uses the stolen token after the user has rotated it
+			if _, _, _, err = mlc.ExchangeRefreshToken(stolen); err != gomagiclink.ErrInvalidRefreshToken {
+				t.Errorf("reused refresh token = %v, want ErrInvalidRefreshToken", err)
+			}
+			if err = mlc.RevokeRefreshToken(second); err != gomagiclink.ErrInvalidRefreshToken {
+				t.Errorf("RevokeRefreshToken() of an exchanged token = %v, want ErrInvalidRefreshToken", err)
+			}
+			for _, token := range []string{latest, second, stolen} {
+				if _, _, _, err = mlc.ExchangeRefreshToken(token); err != gomagiclink.ErrInvalidRefreshToken {
+					t.Errorf("refresh token of the family after its reuse = %v, want ErrInvalidRefreshToken", err)
+				}
+			}
+			_, _, _, err = mlc.ExchangeRefreshToken(other)
+			if tc.otherRevoked && err != gomagiclink.ErrInvalidRefreshToken {
+				t.Errorf("refresh token of another login = %v, want ErrInvalidRefreshToken", err)
+			}
+			if !tc.otherRevoked && err != nil {
+				t.Errorf("refresh token of another login: %v", err)
+			}
+		})
+	}
+}
+
+// TestRefreshTokenConcurrentExchange exchanges the same refresh token concurrently, and
+// checks that only one of the requests gets a session.
+func TestRefreshTokenConcurrentExchange(t *testing.T) {
+	mlc, _, user := newTestController(t, gomagiclink.WithRefreshTokens(gomagiclink.NewMemoryRefreshTokenStore(), time.Hour))
+	refreshToken, err := mlc.GenerateRefreshToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const requests = 16
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted := 0
+	start := make(chan struct{})
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, _, _, err := mlc.ExchangeRefreshToken(refreshToken)
+			if err != nil && err != gomagiclink.ErrInvalidRefreshToken {
+				t.Errorf("ExchangeRefreshToken(): %v", err)
+			}
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("the refresh token was exchanged %d times, want once", accepted)
+	}
+}
+
+func TestRefreshTokenUser(t *testing.T) {
+	mlc, _, user := newTestController(t, gomagiclink.WithRefreshTokens(gomagiclink.NewMemoryRefreshTokenStore(), time.Millisecond))
+	expired, err := mlc.GenerateRefreshToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, _, err = mlc.ExchangeRefreshToken(expired); err != gomagiclink.ErrInvalidRefreshToken {
+		t.Errorf("expired refresh token = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	mlc, _, user = newTestController(t, gomagiclink.WithRefreshTokens(gomagiclink.NewMemoryRefreshTokenStore(), time.Hour))
+	refreshToken, err := mlc.GenerateRefreshToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Enabled = false
+	if err = mlc.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = mlc.ExchangeRefreshToken(refreshToken); err != gomagiclink.ErrUserDisabled {
+		t.Errorf("refresh token of a disabled user = %v, want ErrUserDisabled", err)
+	}
+
+	pending := *user
+	pending.Enabled, pending.TOTPPending = true, true
+	if _, err = mlc.GenerateRefreshToken(&pending); err != gomagiclink.ErrTOTPRequired {
+		t.Errorf("GenerateRefreshToken() for a pending TOTP login = %v, want ErrTOTPRequired", err)
+	}
+}
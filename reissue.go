@@ -0,0 +1,83 @@
+package gomagiclink
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrChallengeNotExpired = errors.New("challenge not expired")
+
+// WithExpiredChallengeReissue enables ReissueExpiredChallenge() and HandleExpiredChallenge(),
+// for challenges which expired less than maxAge ago. Each expired challenge can be reissued
+// only once (per app instance), so a leaked old link can't be used to flood the user's
+// mailbox; the new link still only goes to the user.
+func WithExpiredChallengeReissue(maxAge time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.reissueMaxAge = maxAge
+		mlc.reissuedChallenges = newSeenCache()
+	}
+}
+
+// ReissueExpiredChallenge verifies the signature of an expired challenge, and generates
+// a new challenge for the same e-mail address (bound to the same proof key, if the
+// expired one was). It returns ErrExpiredChallenge if reissuing isn't enabled with
+// WithExpiredChallengeReissue(), if the challenge expired too long ago, or if it has
+// already been reissued, and ErrChallengeNotExpired for challenges which are still valid.
+func (mlc *AuthMagicLinkController) ReissueExpiredChallenge(challenge string) (newChallenge string, receipt *ChallengeReceipt, err error) {
+	if mlc.reissuedChallenges == nil {
+		return "", nil, ErrExpiredChallenge
+	}
+	pc, err := mlc.parseChallenge(challenge, "", true)
+	if err != nil {
+		return "", nil, err
+	}
+	if !mlc.isExpired(pc.ExpTime) {
+		return "", nil, ErrChallengeNotExpired
+	}
+	expired := time.Unix(int64(pc.ExpTime), 0)
+	if time.Since(expired) > mlc.reissueMaxAge || !mlc.reissuedChallenges.add(ChallengeID(challenge), expired.Add(mlc.reissueMaxAge)) {
+		return "", nil, ErrExpiredChallenge
+	}
+	return mlc.generateChallenge(pc.Email, RiskInfo{}, ChallengeMetadata{Campaign: "reissue"}, pc.ProofKey)
+}
+
+// HandleExpiredChallenge is a helper for the verification endpoint: when VerifyChallenge()
+// returns ErrExpiredChallenge, pass the challenge to it, and it reissues it (see
+// ReissueExpiredChallenge()) and sends the new magic link, built with BuildMagicLink()
+// from verifyURL, or with BuildMagicLinkURL() if it's empty. It returns the e-mail
+// address the link was sent to, so the app can tell the user to check their mailbox
+// instead of showing an error.
+func (mlc *AuthMagicLinkController) HandleExpiredChallenge(ctx context.Context, challenge string, sender MagicLinkSender, verifyURL string) (email string, err error) {
+	newChallenge, receipt, err := mlc.ReissueExpiredChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	var link string
+	if verifyURL != "" {
+		link, err = BuildMagicLink(verifyURL, newChallenge)
+	} else {
+		link, err = mlc.BuildMagicLinkURL(newChallenge, "")
+	}
+	if err != nil {
+		return "", err
+	}
+	phrase, err := mlc.GetAntiPhishingPhrase(receipt.Email)
+	if err != nil {
+		return "", err
+	}
+	err = sender.SendMagicLink(ctx, &MagicLinkMessage{
+		Email:     receipt.Email,
+		Link:      link,
+		Challenge: newChallenge,
+		ExpiresAt: receipt.ExpiresAt,
+		Metadata:  ChallengeMetadata{Campaign: "reissue"},
+		ReceiptID: receipt.ID,
+
+		AntiPhishingPhrase: phrase,
+	})
+	if err != nil {
+		return "", err
+	}
+	return receipt.Email, nil
+}
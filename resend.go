@@ -0,0 +1,76 @@
+package gomagiclink
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrResendTooSoon = errors.New("resend requested too soon")
+
+// DefaultResendInterval is the minimum interval between sending a challenge and
+// re-sending it with ResendChallenge(), unless another is set with WithResendInterval().
+const DefaultResendInterval = time.Minute
+
+// WithResendInterval sets the minimum interval between sending a challenge to an
+// e-mail address and re-sending it with ResendChallenge(), and between the resends.
+func WithResendInterval(interval time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.resendInterval = interval
+	}
+}
+
+// ResendChallenge returns the most recent unexpired challenge for the e-mail address
+// from the ChallengeStore, so it can be sent again, e.g. for a "Didn't get the e-mail?
+// Resend" button, instead of minting a new one, which would add to the outstanding
+// challenges (and invalidate the older ones, see WithMaxOutstandingChallenges()). It
+// returns ErrResendTooSoon if the challenge was sent or re-sent less than the resend
+// interval ago (see WithResendInterval(); resends are tracked per app instance), and
+// ErrChallengeNotFound if there's no unexpired challenge, in which case the app can
+// generate a new one. Blocked users are handled as in GenerateChallenge() (see
+// WithBlockedUserChallenges()). It requires a ChallengeStore.
+func (mlc *AuthMagicLinkController) ResendChallenge(email string) (rec *ChallengeRecord, err error) {
+	if mlc.challengeStore == nil {
+		return nil, ErrNoChallengeStore
+	}
+	email = NormalizeEmail(email)
+	if err = mlc.checkBlockedUser(email); err != nil {
+		return nil, err
+	}
+	recs, err := mlc.challengeStore.GetChallengesByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := len(recs) - 1; i >= 0; i-- {
+		if recs[i].ExpiresAt.After(now) {
+			rec = recs[i]
+			break
+		}
+	}
+	if rec == nil {
+		return nil, ErrChallengeNotFound
+	}
+	if now.Sub(rec.IssuedAt) < mlc.resendInterval || !mlc.resends.add(email, now.Add(mlc.resendInterval)) {
+		return nil, ErrResendTooSoon
+	}
+	details := rec.Metadata.auditDetails()
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["receipt_id"] = rec.ReceiptID.String()
+	details["fingerprint"] = rec.ID
+	details["resent"] = "true"
+	mlc.audit(AuditEvent{Type: AuditChallengeIssued, Email: email, Details: details})
+	return rec, nil
+}
+
+// Receipt returns the receipt of the challenge, as returned when it was generated.
+func (rec *ChallengeRecord) Receipt() *ChallengeReceipt {
+	return &ChallengeReceipt{
+		ID:          rec.ReceiptID,
+		Email:       rec.Email,
+		IssuedAt:    rec.IssuedAt,
+		ExpiresAt:   rec.ExpiresAt,
+		Fingerprint: rec.ID,
+	}
+}
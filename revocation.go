@@ -0,0 +1,412 @@
+package gomagiclink
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrRevocationListStale = errors.New("revocation list is stale")
+var ErrNonExpiringSession = errors.New("sessions without an expiration time can't be revoked")
+
+// RevocationEntry revokes either one signed session (SessionID is set), or all the
+// signed sessions of a user which existed at RevokedAt (SessionID is empty), see
+// WithReplicatedRevocation().
+type RevocationEntry struct {
+	SessionID string    `json:"session_id,omitempty"` // SHA-256 hash of the session ID
+	UserID    uuid.UUID `json:"user_id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	// When the entry can be forgotten, as all the sessions it revokes have expired
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// key identifies the entry: entries with the same key are merged.
+func (e *RevocationEntry) key() string {
+	if e.SessionID != "" {
+		return "s:" + e.SessionID
+	}
+	return "u:" + e.UserID.String()
+}
+
+// merge merges the other entry with the same key into this one, and reports whether
+// this one has changed. Merging takes the latest times, so it's commutative,
+// associative and idempotent, and the replicas converge regardless of the order in
+// which they receive the entries.
+func (e *RevocationEntry) merge(other *RevocationEntry) (changed bool) {
+	if other.RevokedAt.After(e.RevokedAt) {
+		e.RevokedAt, changed = other.RevokedAt, true
+	}
+	if other.ExpiresAt.After(e.ExpiresAt) {
+		e.ExpiresAt, changed = other.ExpiresAt, true
+	}
+	return changed
+}
+
+// ReplicatedRevocationStore keeps the revocation list of a region, replicated
+// asynchronously from and to the other regions' lists (see RunRevocationSync()). The
+// list is a grow-only set of RevocationEntry, merged by key with RevocationEntry's
+// semantics (the latest RevokedAt and ExpiresAt win), from which entries are dropped
+// only after they expire; so revocations can't be undone, and the replicas converge.
+type ReplicatedRevocationStore interface {
+	// MergeRevocations adds the entries, local or from another region, merging them
+	// with the existing ones, and ignoring the expired ones.
+	MergeRevocations(entries []RevocationEntry) error
+	// GetRevocations returns the unexpired entries revoking the session (by the hash of
+	// its ID) and the user's sessions, or nil if there aren't any.
+	GetRevocations(sessionID string, userID uuid.UUID) (session *RevocationEntry, user *RevocationEntry, err error)
+	// RevocationChanges returns up to limit entries added or changed after the cursor,
+	// and the cursor to pass to the next call. The cursor is local to the store: other
+	// regions pull the changes with it, starting from 0. Stores which can lose their
+	// entries, or restart their cursors, must treat the cursors they returned before as
+	// 0, so the other regions pull all the entries again instead of missing the new ones.
+	RevocationChanges(after uint64, limit int) (entries []RevocationEntry, cursor uint64, err error)
+}
+
+// RevocationPeer is another region's revocation list, from which RunRevocationSync()
+// pulls the changes, e.g. through an HTTP endpoint (see adapters.RevocationFeedHandler()
+// and adapters.HTTPRevocationPeer).
+type RevocationPeer interface {
+	Name() string
+	PullRevocations(ctx context.Context, after uint64) (entries []RevocationEntry, cursor uint64, err error)
+}
+
+// revocationState is the replication state of the controller's revocation list.
+type revocationState struct {
+	store        ReplicatedRevocationStore
+	maxStaleness time.Duration
+
+	lock    sync.Mutex
+	syncing bool                 // RunRevocationSync() is running
+	synced  map[string]time.Time // Last successful pull from each peer
+	cursors map[string]uint64
+}
+
+// WithReplicatedRevocation enables the multi-region active-active mode, in which every
+// region verifies signed session IDs on its own (by their signature, without a shared
+// session store), and checks them against its revocation list, kept in the
+// ReplicatedRevocationStore. RevokeSession() then also revokes signed session IDs, and
+// RevokeUserSessions() all the user's signed sessions existing at the time, by adding
+// entries to the list, which RunRevocationSync() replicates asynchronously between the
+// regions. So a revocation takes effect at once in the region where it's made, and in
+// the others when they next pull it.
+//
+// The staleness is bounded by maxStaleness: while RunRevocationSync() is running, if a
+// peer region's changes haven't been pulled for longer than that (e.g. during a network
+// partition), signed sessions are rejected with ErrRevocationListStale, instead of
+// possibly accepting revoked ones. With maxStaleness 0, they're accepted with a stale
+// list.
+//
+// Signed session IDs don't record when they were issued, so revoking all of a user's
+// sessions revokes those expiring before the revocation time plus the session
+// expiration (passed to NewAuthMagicLinkController()); a session with a shortened
+// lifetime (see WithSessionLifetimePolicy()) issued right after the revocation can be
+// revoked as well. Sessions which don't expire can't be revoked (ErrNonExpiringSession).
+func WithReplicatedRevocation(store ReplicatedRevocationStore, maxStaleness time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.revocations = &revocationState{
+			store:        store,
+			maxStaleness: maxStaleness,
+			synced:       map[string]time.Time{},
+			cursors:      map[string]uint64{},
+		}
+	}
+}
+
+// revocationGrace is how long after its expiration time a session ID can still be
+// accepted, so its revocation is kept as long.
+func (mlc *AuthMagicLinkController) revocationGrace() time.Duration {
+	return mlc.sessionGrace + mlc.clockSkew
+}
+
+// revokeSignedSession adds the signed session to the revocation list.
+func (mlc *AuthMagicLinkController) revokeSignedSession(sessionId string) error {
+	claims, err := mlc.parseSessionId(sessionId)
+	if err != nil {
+		return err
+	}
+	if claims.ExpTime == 0 {
+		return ErrNonExpiringSession
+	}
+	entry := RevocationEntry{
+		SessionID: storedSessionHash(sessionId),
+		UserID:    claims.UserID,
+		RevokedAt: time.Now(),
+		ExpiresAt: time.Unix(int64(claims.ExpTime), 0).Add(mlc.revocationGrace()),
+	}
+	if err = mlc.revocations.store.MergeRevocations([]RevocationEntry{entry}); err != nil {
+		return err
+	}
+	mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: claims.UserID, Details: map[string]string{"scope": "replicated"}})
+	return nil
+}
+
+// revokeSignedUserSessions adds the user's signed sessions to the revocation list.
+func (mlc *AuthMagicLinkController) revokeSignedUserSessions(userId uuid.UUID) error {
+	if mlc.sessionExpDuration <= 0 {
+		return ErrNonExpiringSession
+	}
+	now := time.Now()
+	return mlc.revocations.store.MergeRevocations([]RevocationEntry{{
+		UserID:    userId,
+		RevokedAt: now,
+		ExpiresAt: now.Add(mlc.sessionExpDuration + mlc.revocationGrace()),
+	}})
+}
+
+// checkRevocation checks the verified signed session against the revocation list.
+func (mlc *AuthMagicLinkController) checkRevocation(sessionId string, userId uuid.UUID, expTime int) error {
+	rs := mlc.revocations
+	if rs.maxStaleness > 0 {
+		if stale := rs.staleness(); stale > rs.maxStaleness {
+			mlc.logger.Error("Revocation list is stale", "staleness", stale)
+			return ErrRevocationListStale
+		}
+	}
+	session, user, err := rs.store.GetRevocations(storedSessionHash(sessionId), userId)
+	if err != nil {
+		return err
+	}
+	if session != nil {
+		return ErrInvalidSessionId
+	}
+	if user != nil && (expTime == 0 || !time.Unix(int64(expTime), 0).After(user.RevokedAt.Add(mlc.sessionExpDuration))) {
+		return ErrInvalidSessionId
+	}
+	return nil
+}
+
+// staleness returns how long ago the changes of the peer pulled longest ago were
+// pulled, or 0 if RunRevocationSync() isn't running.
+func (rs *revocationState) staleness() time.Duration {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if !rs.syncing {
+		return 0
+	}
+	var oldest time.Time
+	for _, t := range rs.synced {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// RevocationStaleness returns how long ago the revocation list was last brought up to
+// date with all the peer regions, or 0 if it isn't being replicated, e.g. for health
+// checks.
+func (mlc *AuthMagicLinkController) RevocationStaleness() time.Duration {
+	if mlc.revocations == nil {
+		return 0
+	}
+	return mlc.revocations.staleness()
+}
+
+// SyncRevocations pulls the changes of the peer's revocation list into the local one.
+func (mlc *AuthMagicLinkController) SyncRevocations(ctx context.Context, peer RevocationPeer) error {
+	rs := mlc.revocations
+	if rs == nil {
+		return nil
+	}
+	rs.lock.Lock()
+	cursor := rs.cursors[peer.Name()]
+	rs.lock.Unlock()
+	for {
+		entries, next, err := peer.PullRevocations(ctx, cursor)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			if err = rs.store.MergeRevocations(entries); err != nil {
+				return err
+			}
+		}
+		rs.lock.Lock()
+		rs.cursors[peer.Name()] = next
+		rs.lock.Unlock()
+		if len(entries) == 0 || next == cursor {
+			break
+		}
+		cursor = next
+	}
+	rs.lock.Lock()
+	rs.synced[peer.Name()] = time.Now()
+	rs.lock.Unlock()
+	return nil
+}
+
+// RunRevocationSync pulls the changes of the peer regions' revocation lists every
+// interval, until the context is done, and tracks the staleness of the local list (see
+// WithReplicatedRevocation()). The staleness counts from when it's started, until each
+// peer has been pulled once. Errors are logged. Run it in its own goroutine.
+func (mlc *AuthMagicLinkController) RunRevocationSync(ctx context.Context, interval time.Duration, peers ...RevocationPeer) {
+	rs := mlc.revocations
+	if rs == nil {
+		return
+	}
+	rs.lock.Lock()
+	now := time.Now()
+	for _, peer := range peers {
+		if _, ok := rs.synced[peer.Name()]; !ok {
+			rs.synced[peer.Name()] = now
+		}
+	}
+	rs.syncing = true
+	rs.lock.Unlock()
+	defer func() {
+		rs.lock.Lock()
+		rs.syncing = false
+		rs.lock.Unlock()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range peers {
+			if err := mlc.SyncRevocations(ctx, peer); err != nil && ctx.Err() == nil {
+				mlc.logger.Error("Error pulling revocations", "peer", peer.Name(), "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MemoryRevocationStore is an in-memory ReplicatedRevocationStore. The list is rebuilt
+// from the peers after a restart, as long as they still have the entries. Its cursors
+// include a random instance ID, so the peers pull all the entries again after a restart.
+type MemoryRevocationStore struct {
+	lock     sync.Mutex
+	entries  map[string]*memoryRevocation
+	seq      uint64
+	instance uint64 // In the high bits of the cursors, above the sequence number
+}
+
+// memoryRevocationSeqBits is the number of bits of the sequence number in the cursors of
+// MemoryRevocationStore.
+const memoryRevocationSeqBits = 40
+
+type memoryRevocation struct {
+	RevocationEntry
+	seq uint64 // When the entry was last changed
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	var instance uint64
+	for instance == 0 {
+		// Never 0, so the peers' initial cursor is unknown too
+		id := uuid.New()
+		instance = binary.BigEndian.Uint64(id[:8]) >> memoryRevocationSeqBits
+	}
+	return &MemoryRevocationStore{entries: map[string]*memoryRevocation{}, instance: instance}
+}
+
+func (ms *MemoryRevocationStore) MergeRevocations(entries []RevocationEntry) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	for i := range entries {
+		e := &entries[i]
+		if !e.ExpiresAt.After(now) {
+			continue
+		}
+		key := e.key()
+		if existing, ok := ms.entries[key]; ok {
+			if existing.merge(e) {
+				ms.seq++
+				existing.seq = ms.seq
+			}
+			continue
+		}
+		ms.seq++
+		ms.entries[key] = &memoryRevocation{RevocationEntry: *e, seq: ms.seq}
+	}
+	if len(ms.entries) >= 10000 && ms.seq%1000 == 0 {
+		for key, e := range ms.entries {
+			if !e.ExpiresAt.After(now) {
+				delete(ms.entries, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryRevocationStore) GetRevocations(sessionID string, userID uuid.UUID) (session *RevocationEntry, user *RevocationEntry, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	if e, ok := ms.entries["s:"+sessionID]; ok && e.ExpiresAt.After(now) {
+		entryCopy := e.RevocationEntry
+		session = &entryCopy
+	}
+	if e, ok := ms.entries["u:"+userID.String()]; ok && e.ExpiresAt.After(now) {
+		entryCopy := e.RevocationEntry
+		user = &entryCopy
+	}
+	return session, user, nil
+}
+
+func (ms *MemoryRevocationStore) RevocationChanges(after uint64, limit int) (entries []RevocationEntry, cursor uint64, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if after>>memoryRevocationSeqBits != ms.instance {
+		// A cursor of another instance, e.g. before a restart
+		after = 0
+	} else {
+		after &= 1<<memoryRevocationSeqBits - 1
+	}
+	var changed []*memoryRevocation
+	now := time.Now()
+	for _, e := range ms.entries {
+		if e.seq > after && e.ExpiresAt.After(now) {
+			changed = append(changed, e)
+		}
+	}
+	slices.SortFunc(changed, func(a, b *memoryRevocation) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	if limit > 0 && len(changed) > limit {
+		changed = changed[:limit]
+	}
+	cursor = after
+	for _, e := range changed {
+		entries = append(entries, e.RevocationEntry)
+		cursor = e.seq
+	}
+	if len(changed) == 0 && ms.seq > after {
+		// Only expired entries changed since
+		cursor = ms.seq
+	}
+	return entries, ms.instance<<memoryRevocationSeqBits | cursor, nil
+}
+
+// LocalRevocationPeer is a RevocationPeer reading another ReplicatedRevocationStore
+// directly, e.g. a read replica of another region's database.
+type LocalRevocationPeer struct {
+	PeerName string
+	Store    ReplicatedRevocationStore
+	Limit    int // Entries per pull, default 1000
+}
+
+func (lp *LocalRevocationPeer) Name() string {
+	return lp.PeerName
+}
+
+func (lp *LocalRevocationPeer) PullRevocations(ctx context.Context, after uint64) (entries []RevocationEntry, cursor uint64, err error) {
+	limit := lp.Limit
+	if limit <= 0 {
+		limit = 1000
+	}
+	return lp.Store.RevocationChanges(after, limit)
+}
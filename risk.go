@@ -0,0 +1,206 @@
+package gomagiclink
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRiskDenied = errors.New("login denied by risk evaluation")
+var ErrRiskChallengeRequired = errors.New("additional verification required by risk evaluation")
+
+// RiskDecision is the result of a RiskEvaluator.
+type RiskDecision int
+
+const (
+	RiskAllow     RiskDecision = iota // Proceed normally
+	RiskChallenge                     // The app should require additional verification (e.g. a CAPTCHA)
+	RiskDeny                          // Refuse the login attempt
+)
+
+// RiskStage says at which point of the login flow the risk is evaluated.
+type RiskStage int
+
+const (
+	RiskStageGenerateChallenge RiskStage = iota
+	RiskStageVerifyChallenge
+)
+
+// RiskInfo describes the client making the login attempt. All fields are optional.
+type RiskInfo struct {
+	IP     string // Client IP address
+	Device string // Device identifier, e.g. the User-Agent or a device cookie
+}
+
+// auditDetails returns the details recorded in the login audit events, so the logins
+// can be told apart by where they came from (see GetUserActivity()).
+func (info RiskInfo) auditDetails() map[string]string {
+	if info.IP == "" {
+		return nil
+	}
+	return map[string]string{"ip": info.IP}
+}
+
+// RiskContext is passed to the RiskEvaluator.
+type RiskContext struct {
+	RiskInfo
+	Stage RiskStage
+	Email string          // Normalized e-mail address
+	User  *AuthUserRecord // Existing user record, or nil for a new user
+}
+
+// RiskEvaluator is a pluggable policy consulted by the controller when generating
+// and verifying challenges. Set it with the WithRiskEvaluator() option.
+type RiskEvaluator interface {
+	EvaluateRisk(rc RiskContext) (RiskDecision, error)
+}
+
+// WithRiskEvaluator installs a RiskEvaluator into the controller.
+func WithRiskEvaluator(re RiskEvaluator) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.riskEvaluator = re
+	}
+}
+
+// evaluateRisk calls the RiskEvaluator, if configured, and converts its decision to an error.
+func (mlc *AuthMagicLinkController) evaluateRisk(rc RiskContext) error {
+	if mlc.riskEvaluator == nil {
+		return nil
+	}
+	decision, err := mlc.riskEvaluator.EvaluateRisk(rc)
+	if err != nil {
+		return err
+	}
+	switch decision {
+	case RiskAllow:
+		return nil
+	case RiskChallenge:
+		return ErrRiskChallengeRequired
+	default:
+		return ErrRiskDenied
+	}
+}
+
+// HeuristicRiskEvaluator is a simple RiskEvaluator meant as a starting point.
+// It remembers which IP addresses were used to log in to each e-mail address
+// within the Window. If more than MaxIPs distinct addresses were used, logins to
+// new accounts (younger than NewAccountAge) are denied, and logins to older accounts
+// require additional verification. Addresses not seen within the Window are forgotten,
+// and at most MaxEmails e-mail addresses are remembered, forgetting the least recently
+// seen ones first, so unauthenticated clients can't exhaust the memory.
+type HeuristicRiskEvaluator struct {
+	MaxIPs        int
+	NewAccountAge time.Duration
+	Window        time.Duration
+	MaxEmails     int // Default DefaultRiskMaxEmails
+
+	lock      sync.Mutex
+	ips       map[string]map[string]time.Time // email -> IP -> last seen
+	lastSweep time.Time
+}
+
+// DefaultRiskMaxEmails is the default HeuristicRiskEvaluator.MaxEmails.
+const DefaultRiskMaxEmails = 100000
+
+// NewHeuristicRiskEvaluator creates a HeuristicRiskEvaluator with the given limits.
+func NewHeuristicRiskEvaluator(maxIPs int, newAccountAge time.Duration, window time.Duration) *HeuristicRiskEvaluator {
+	return &HeuristicRiskEvaluator{
+		MaxIPs:        maxIPs,
+		NewAccountAge: newAccountAge,
+		Window:        window,
+		MaxEmails:     DefaultRiskMaxEmails,
+		ips:           map[string]map[string]time.Time{},
+		lastSweep:     time.Now(),
+	}
+}
+
+func (hre *HeuristicRiskEvaluator) EvaluateRisk(rc RiskContext) (RiskDecision, error) {
+	if rc.IP == "" {
+		return RiskAllow, nil
+	}
+	now := time.Now()
+
+	hre.lock.Lock()
+	if now.Sub(hre.lastSweep) >= hre.Window {
+		hre.sweep(now)
+	}
+	seen, ok := hre.ips[rc.Email]
+	if !ok {
+		maxEmails := hre.MaxEmails
+		if maxEmails <= 0 {
+			maxEmails = DefaultRiskMaxEmails
+		}
+		if len(hre.ips) >= maxEmails {
+			hre.sweep(now)
+			if len(hre.ips) >= maxEmails {
+				hre.evictOldest()
+			}
+		}
+		seen = map[string]time.Time{}
+		hre.ips[rc.Email] = seen
+	}
+	seen[rc.IP] = now
+	pruneIPs(seen, now, hre.Window)
+	// More addresses don't change the decision
+	for len(seen) > hre.MaxIPs+1 {
+		delete(seen, oldestIP(seen))
+	}
+	nIPs := len(seen)
+	hre.lock.Unlock()
+
+	if nIPs <= hre.MaxIPs {
+		return RiskAllow, nil
+	}
+	if rc.User == nil || now.Sub(rc.User.CreatedAt) < hre.NewAccountAge {
+		return RiskDeny, nil
+	}
+	return RiskChallenge, nil
+}
+
+// sweep forgets the IP addresses not seen within the Window, and the e-mail addresses
+// left without any. Called with the lock held.
+func (hre *HeuristicRiskEvaluator) sweep(now time.Time) {
+	for email, seen := range hre.ips {
+		pruneIPs(seen, now, hre.Window)
+		if len(seen) == 0 {
+			delete(hre.ips, email)
+		}
+	}
+	hre.lastSweep = now
+}
+
+// evictOldest forgets the least recently seen e-mail address. Called with the lock held.
+func (hre *HeuristicRiskEvaluator) evictOldest() {
+	var oldestEmail string
+	var oldest time.Time
+	for email, seen := range hre.ips {
+		var lastSeen time.Time
+		for _, t := range seen {
+			if t.After(lastSeen) {
+				lastSeen = t
+			}
+		}
+		if oldestEmail == "" || lastSeen.Before(oldest) {
+			oldestEmail, oldest = email, lastSeen
+		}
+	}
+	delete(hre.ips, oldestEmail)
+}
+
+func pruneIPs(seen map[string]time.Time, now time.Time, window time.Duration) {
+	for ip, t := range seen {
+		if now.Sub(t) > window {
+			delete(seen, ip)
+		}
+	}
+}
+
+func oldestIP(seen map[string]time.Time) (oldest string) {
+	var oldestTime time.Time
+	for ip, t := range seen {
+		if oldest == "" || t.Before(oldestTime) {
+			oldest, oldestTime = ip, t
+		}
+	}
+	return
+}
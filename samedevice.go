@@ -0,0 +1,30 @@
+package gomagiclink
+
+import "errors"
+
+const sameDevicePurpose = "same-device"
+
+var ErrDeviceMismatch = errors.New("magic link opened in a different browser than the one it was requested in")
+
+// SameDeviceToken returns the token which ties the challenge described by the receipt to
+// the browser requesting it, e.g. in a HttpOnly cookie set by the login handler. When the
+// magic link is opened, VerifySameDeviceToken() checks that the browser has it, so a link
+// requested by an attacker for the victim's address (or the attacker's own, to log the
+// victim into the attacker's account) doesn't work when the victim is tricked into
+// opening it. The token is derived from the challenge, so nothing needs to be stored.
+func (mlc *AuthMagicLinkController) SameDeviceToken(receipt *ChallengeReceipt) string {
+	return encodeToString(mlc.SignData(sameDevicePurpose, []byte(receipt.Fingerprint)))
+}
+
+// VerifySameDeviceToken checks the token from SameDeviceToken() against the challenge,
+// returning ErrDeviceMismatch if it's missing or was made for another challenge.
+func (mlc *AuthMagicLinkController) VerifySameDeviceToken(challenge string, token string) error {
+	if token == "" {
+		return ErrDeviceMismatch
+	}
+	sig, err := decodeFromString(token)
+	if err != nil || !mlc.VerifyData(sameDevicePurpose, []byte(ChallengeID(challenge)), sig) {
+		return ErrDeviceMismatch
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package gomagiclink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"math"
+)
+
+var ErrSecretKeyWeak = errors.New("secret key has too little entropy")
+var ErrSecretKeyPlaceholder = errors.New("secret key looks like a placeholder")
+
+// SecretKeyPolicy sets the requirements for the secret key passed to
+// NewAuthMagicLinkController(). Set it with the WithSecretKeyPolicy() option; without
+// it, the key only needs to be at least 16 bytes long.
+type SecretKeyPolicy struct {
+	MinLength          int     // Minimum length in bytes
+	MinEntropyBits     float64 // Minimum estimated entropy (see EstimateEntropyBits()), 0 to disable
+	RejectPlaceholders bool    // Reject keys containing well-known placeholders, like "changeme"
+}
+
+// minimumSecretKeyPolicy is used unless another policy is set with WithSecretKeyPolicy().
+var minimumSecretKeyPolicy = SecretKeyPolicy{MinLength: 16}
+
+// RecommendedSecretKeyPolicy also rejects the keys with little entropy and placeholders.
+// It's not applied to the controller's key unless it's set with
+// WithSecretKeyPolicy(RecommendedSecretKeyPolicy), as it rejects some of the keys which
+// were accepted before.
+var RecommendedSecretKeyPolicy = SecretKeyPolicy{
+	MinLength:          16,
+	MinEntropyBits:     48,
+	RejectPlaceholders: true,
+}
+
+// Lowercase strings which mark a key as copied from an example or a config template.
+var secretKeyPlaceholders = [][]byte{
+	[]byte("lorem ipsum"),
+	[]byte("changeme"),
+	[]byte("change me"),
+	[]byte("change_me"),
+	[]byte("change-me"),
+	[]byte("placeholder"),
+	[]byte("secretkey"),
+	[]byte("secret key"),
+	[]byte("secret_key"),
+	[]byte("supersecret"),
+	[]byte("your-secret"),
+	[]byte("yoursecret"),
+	[]byte("example"),
+	[]byte("password"),
+	[]byte("xxxxxxxx"),
+	[]byte("00000000"),
+	[]byte("12345678"),
+}
+
+// WithSecretKeyPolicy sets the policy for checking the secret key, e.g.
+// RecommendedSecretKeyPolicy.
+func WithSecretKeyPolicy(policy SecretKeyPolicy) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.secretKeyPolicy = policy
+	}
+}
+
+// CheckSecretKey checks the key against the policy, returning ErrSecretKeyTooShort,
+// ErrSecretKeyPlaceholder or ErrSecretKeyWeak if it fails.
+func CheckSecretKey(key []byte, policy SecretKeyPolicy) error {
+	if len(key) < policy.MinLength {
+		return ErrSecretKeyTooShort
+	}
+	if policy.RejectPlaceholders {
+		lower := bytes.ToLower(key)
+		for _, p := range secretKeyPlaceholders {
+			if bytes.Contains(lower, p) {
+				return ErrSecretKeyPlaceholder
+			}
+		}
+	}
+	if policy.MinEntropyBits > 0 && EstimateEntropyBits(key) < policy.MinEntropyBits {
+		return ErrSecretKeyWeak
+	}
+	return nil
+}
+
+// EstimateEntropyBits estimates the entropy of the key from the distribution of its
+// bytes (the Shannon entropy per byte, times the length). It's an upper bound for
+// human-chosen keys, and about 62 bits for 16 random bytes.
+func EstimateEntropyBits(key []byte) float64 {
+	if len(key) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range key {
+		counts[b]++
+	}
+	h := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(key))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h * float64(len(key))
+}
+
+// GenerateSecretKey generates a random 32-byte secret key, and returns it along with
+// its base64 representation, for storing in configuration files.
+func GenerateSecretKey() (key []byte, keyBase64 string, err error) {
+	key = make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	return key, base64.StdEncoding.EncodeToString(key), nil
+}
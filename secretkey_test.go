@@ -0,0 +1,88 @@
+package gomagiclink_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+func TestEstimateEntropyBits(t *testing.T) {
+	tests := []struct {
+		key  string
+		want float64
+	}{
+		{"", 0},
+		{"a", 0},
+		{"aaaaaaaaaaaaaaaa", 0},
+		{"ab", 2},
+		{"abab", 4},
+		{"aaaaaaaabbbbbbbb", 16},
+		{"abcd", 8},
+		{"0123456789abcdef", 64},
+		{"aab", 3 * (-(2.0/3)*math.Log2(2.0/3) - (1.0/3)*math.Log2(1.0/3))},
+	}
+	for _, tt := range tests {
+		if got := gomagiclink.EstimateEntropyBits([]byte(tt.key)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("EstimateEntropyBits(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	// All the byte values, in any order
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(255 - i)
+	}
+	if got := gomagiclink.EstimateEntropyBits(all); math.Abs(got-2048) > 1e-9 {
+		t.Errorf("EstimateEntropyBits() of all the byte values = %v, want 2048", got)
+	}
+	// Repeating the key doesn't add entropy per byte
+	key := []byte("0123456789abcdef")
+	if got, want := gomagiclink.EstimateEntropyBits(bytes.Repeat(key, 3)), 3*gomagiclink.EstimateEntropyBits(key); math.Abs(got-want) > 1e-9 {
+		t.Errorf("EstimateEntropyBits() of a repeated key = %v, want %v", got, want)
+	}
+}
+
+func TestCheckSecretKey(t *testing.T) {
+	generated, _, err := gomagiclink.GenerateSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key         string
+		minimum     error // Without a policy set
+		recommended error // With RecommendedSecretKeyPolicy
+	}{
+		{string(generated), nil, nil},
+		{"k3Q9zR7vX1mB5nW8", nil, nil},
+		{"k3Q9zR7vX1mB5nW", gomagiclink.ErrSecretKeyTooShort, gomagiclink.ErrSecretKeyTooShort},
+		{"", gomagiclink.ErrSecretKeyTooShort, gomagiclink.ErrSecretKeyTooShort},
+		{"aaaaaaaaaaaaaaaa", nil, gomagiclink.ErrSecretKeyWeak},
+		{"abababababababababab", nil, gomagiclink.ErrSecretKeyWeak},
+		{"my-ChangeMe-key-7f3a9c", nil, gomagiclink.ErrSecretKeyPlaceholder},
+		{"Lorem ipsum dolor sit amet", nil, gomagiclink.ErrSecretKeyPlaceholder},
+		{"0123456789abcdef", nil, gomagiclink.ErrSecretKeyPlaceholder},
+	}
+	newController := func(key string, opts ...gomagiclink.ControllerOption) error {
+		st := &minimalStorage{users: map[uuid.UUID]gomagiclink.AuthUserRecord{}}
+		mlc, err := gomagiclink.NewAuthMagicLinkController([]byte(key), time.Hour, time.Hour, st, opts...)
+		if err == nil {
+			mlc.Close()
+		}
+		return err
+	}
+	for _, tt := range tests {
+		if err := newController(tt.key); err != tt.minimum {
+			t.Errorf("NewAuthMagicLinkController(%q) = %v, want %v", tt.key, err, tt.minimum)
+		}
+		if err := newController(tt.key, gomagiclink.WithSecretKeyPolicy(gomagiclink.RecommendedSecretKeyPolicy)); err != tt.recommended {
+			t.Errorf("NewAuthMagicLinkController(%q) with RecommendedSecretKeyPolicy = %v, want %v", tt.key, err, tt.recommended)
+		}
+		if err := gomagiclink.CheckSecretKey([]byte(tt.key), gomagiclink.RecommendedSecretKeyPolicy); err != tt.recommended {
+			t.Errorf("CheckSecretKey(%q, RecommendedSecretKeyPolicy) = %v, want %v", tt.key, err, tt.recommended)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package gomagiclink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Self-test steps, see SelfTest().
+const (
+	SelfTestChallenge = "challenge"
+	SelfTestSession   = "session"
+	SelfTestStorage   = "storage"
+)
+
+// selfTestProbeDomain is the domain of the probe users' e-mail addresses. The ".invalid"
+// TLD is reserved, so mail can never be delivered to it.
+const selfTestProbeDomain = "gomagiclink-selftest.invalid"
+
+const selfTestProbeEmail = "probe@" + selfTestProbeDomain
+
+var ErrSelfTestMismatch = errors.New("self-test round trip returned different data")
+
+// ReplicatedStorage is implemented by storages which read from replicas (e.g.
+// storage.PgSQLStorage with SetReadReplicas()), so the reads which need the latest
+// writes, like those of SelfTest(), can go to the primary.
+type ReplicatedStorage interface {
+	PrimaryReader() UserReader // Reads from the primary
+}
+
+// SelfTestStep is the outcome of a step of SelfTest().
+type SelfTestStep struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Err      error         `json:"-"`
+}
+
+// SelfTestReport is the outcome of SelfTest(), with the steps in the order they ran.
+type SelfTestReport struct {
+	Steps    []SelfTestStep `json:"steps"`
+	Duration time.Duration  `json:"duration"`
+}
+
+// OK returns true if all the steps succeeded.
+func (r *SelfTestReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the error of the first failed step, or nil.
+func (r *SelfTestReport) Err() error {
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			return fmt.Errorf("self-test step %s: %w", step.Name, step.Err)
+		}
+	}
+	return nil
+}
+
+// SelfTest exercises the controller with a synthetic login of a probe user, and reports
+// how long each step took, e.g. to check the configuration and warm up the storage's
+// connections at startup, or for health checks. The steps are:
+//
+//   - SelfTestChallenge: generating and verifying a challenge
+//   - SelfTestSession: generating and verifying a session ID
+//   - SelfTestStorage: writing a probe user record, reading it by ID and e-mail address,
+//     and deleting it, directly in the storage (from the primary, see ReplicatedStorage)
+//
+// The probe users have e-mail addresses in a reserved domain which can't receive mail.
+// No message is sent, and nothing is recorded in the audit log or the ChallengeStore,
+// but a server-side session (see WithSessionStore()) is added and removed again. The
+// probe record is disabled, and deleted after it's read, so it's not left in the user
+// listings and counts. In storages which can't delete users (see UserDeleter), it's
+// written with a fixed ID and e-mail address instead, and stays. When the context is done, the running step is abandoned
+// (e.g. a storage call which hangs, which keeps running in the background) and reported
+// with the context's error, and the remaining steps don't run. The returned error is the
+// first failed step's (the same as the report's Err()), or the context's.
+func (mlc *AuthMagicLinkController) SelfTest(ctx context.Context) (report *SelfTestReport, err error) {
+	probe, err := NewAuthUserRecord(selfTestProbeEmail)
+	if err != nil {
+		return
+	}
+	// The same ID on all the app instances, kept apart by namespace
+	probe.ID = uuid.NewSHA1(uuid.NameSpaceURL, []byte("mailto:"+selfTestProbeEmail+"#"+mlc.namespace))
+	report = &SelfTestReport{}
+	start := time.Now()
+	steps := []struct {
+		name string
+		run  func(*AuthUserRecord) error
+	}{
+		{SelfTestChallenge, mlc.selfTestChallenge},
+		{SelfTestSession, mlc.selfTestSession},
+		{SelfTestStorage, mlc.selfTestStorage},
+	}
+	for _, step := range steps {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		stepStart := time.Now()
+		done := make(chan error, 1)
+		go func(run func(*AuthUserRecord) error, probe *AuthUserRecord) {
+			done <- run(probe)
+		}(step.run, probe.clone())
+		var stepErr error
+		select {
+		case stepErr = <-done:
+		case <-ctx.Done():
+			stepErr = ctx.Err()
+			err = stepErr
+		}
+		result := SelfTestStep{Name: step.name, Duration: time.Since(stepStart), Err: stepErr}
+		if stepErr != nil {
+			result.Error = stepErr.Error()
+		}
+		report.Steps = append(report.Steps, result)
+		if err != nil {
+			break
+		}
+	}
+	report.Duration = time.Since(start)
+	if err != nil {
+		return report, err
+	}
+	return report, report.Err()
+}
+
+// selfTestChallenge signs and verifies a challenge, bypassing the ChallengeStore and the
+// audit log.
+func (mlc *AuthMagicLinkController) selfTestChallenge(probe *AuthUserRecord) error {
+	challenge, _, err := mlc.signChallenge(probe.Email, nil)
+	if err != nil {
+		return err
+	}
+	pc, err := mlc.parseChallenge(challenge, probe.Email, false)
+	if err != nil {
+		return err
+	}
+	if pc.Email != probe.Email {
+		return ErrSelfTestMismatch
+	}
+	return nil
+}
+
+// selfTestSession generates and verifies a session ID for the probe user, which isn't
+// stored, so the session's user is checked against the probe record.
+func (mlc *AuthMagicLinkController) selfTestSession(probe *AuthUserRecord) error {
+	sessionId, err := mlc.GenerateSessionId(probe)
+	if err != nil {
+		return err
+	}
+	claims, err := mlc.parseSessionId(sessionId)
+	if claims.Stored {
+		if removeErr := mlc.sessionStore.RemoveSession(storedSessionHash(sessionId)); err == nil {
+			err = removeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if claims.UserID != probe.ID {
+		return ErrSelfTestMismatch
+	}
+	user := *probe
+	_, err = mlc.checkSessionUser(claims, &user)
+	return err
+}
+
+// selfTestStorage writes a probe user record, disabled, reads it back from the primary,
+// and deletes it, bypassing the user cache and the write-behind buffer, so the storage
+// itself is tested. Each run writes a probe of its own, so the concurrent self-tests of
+// other instances don't delete it while it's read. If the storage can't delete users,
+// the probe with the fixed ID is written and kept.
+func (mlc *AuthMagicLinkController) selfTestStorage(probe *AuthUserRecord) (err error) {
+	probe.Enabled = false
+	// Deleting the probe with the fixed ID, kept by the earlier versions, also finds
+	// out if the storage can delete users
+	switch err = DeleteStoredUser(mlc.db, probe.ID); err {
+	case ErrUserDeletionNotSupported:
+		if err = mlc.db.StoreUser(probe); err == ErrUserAlreadyExists {
+			// Created concurrently by another instance
+			err = UpdateStoredUser(mlc.db, probe)
+		}
+	case nil, ErrUserNotFound:
+		probe.ID = uuid.New()
+		probe.Email = "probe-" + probe.ID.String() + "@" + selfTestProbeDomain
+		if err = mlc.db.StoreUser(probe); err == nil {
+			defer func() {
+				if deleteErr := DeleteStoredUser(mlc.db, probe.ID); err == nil {
+					err = deleteErr
+				}
+			}()
+		}
+	}
+	if err != nil {
+		return
+	}
+	var reader UserReader = mlc.db
+	if rs, ok := mlc.db.(ReplicatedStorage); ok {
+		reader = rs.PrimaryReader()
+	}
+	user, err := reader.GetUserById(probe.ID)
+	if err != nil {
+		return
+	}
+	if user.Email != probe.Email {
+		return ErrSelfTestMismatch
+	}
+	user, err = reader.GetUserByEmail(probe.Email)
+	if err != nil {
+		return
+	}
+	if user.ID != probe.ID {
+		return ErrSelfTestMismatch
+	}
+	return nil
+}
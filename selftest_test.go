@@ -0,0 +1,43 @@
+package gomagiclink_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// TestSelfTestStorage checks that the self-test's probe user isn't left in the storage,
+// or is written only once in storages which can't delete users.
+func TestSelfTestStorage(t *testing.T) {
+	mlc, db, _ := newTestController(t)
+	for i := 0; i < 2; i++ {
+		if _, err := mlc.SelfTest(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := db.GetUserCount(); err != nil || n != 1 {
+			t.Errorf("user count after SelfTest() = %d, %v, want 1", n, err)
+		}
+	}
+
+	st := &minimalStorage{users: map[uuid.UUID]gomagiclink.AuthUserRecord{}}
+	mlc, err := gomagiclink.NewAuthMagicLinkController(newTestSecretKey(t), time.Hour, time.Hour, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = mlc.SelfTest(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if len(st.users) != 1 {
+			t.Fatalf("%d users after SelfTest() in a storage which can't delete them, want the probe", len(st.users))
+		}
+		for _, probe := range st.users {
+			if probe.Enabled {
+				t.Error("the probe user is enabled")
+			}
+		}
+	}
+}
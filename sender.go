@@ -0,0 +1,56 @@
+package gomagiclink
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MagicLinkMessage is a magic link to be delivered to a user.
+type MagicLinkMessage struct {
+	Email     string    // Recipient's e-mail address
+	Link      string    // The complete magic link URL
+	Challenge string    // The challenge embedded in the link
+	ExpiresAt time.Time // When the challenge expires
+	Metadata  ChallengeMetadata
+	ReceiptID uuid.UUID // ChallengeReceipt.ID, if the challenge was created with GenerateChallengeWithReceipt()
+	Code      string    // Login code, if the challenge was created with GenerateChallengeWithCode()
+	// The user's anti-phishing phrase, to be shown prominently in the message, so the user can
+	// tell it's genuine (see GetAntiPhishingPhrase())
+	AntiPhishingPhrase string
+}
+
+// ChallengeMetadata describes how a magic link should be delivered, e.g. for selecting
+// the message template. It's passed to GenerateChallengeWithMetadata() and recorded in
+// the audit log (and the ChallengeStore, if one is configured), but it's not embedded
+// in the challenge itself.
+type ChallengeMetadata struct {
+	Locale   string `json:"locale,omitempty"`   // E.g. "en-GB"
+	Channel  string `json:"channel,omitempty"`  // Preferred delivery channel, e.g. "email" or "sms"
+	Campaign string `json:"campaign,omitempty"` // Tag for tracking, e.g. "welcome" or "reactivation"
+}
+
+// auditDetails returns the non-empty fields, for AuditEvent.Details.
+func (cm ChallengeMetadata) auditDetails() map[string]string {
+	details := map[string]string{}
+	if cm.Locale != "" {
+		details["locale"] = cm.Locale
+	}
+	if cm.Channel != "" {
+		details["channel"] = cm.Channel
+	}
+	if cm.Campaign != "" {
+		details["campaign"] = cm.Campaign
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return details
+}
+
+// MagicLinkSender delivers magic links to users, usually by e-mail. Implementations
+// are provided in the `mailer` package.
+type MagicLinkSender interface {
+	SendMagicLink(ctx context.Context, msg *MagicLinkMessage) error
+}
@@ -0,0 +1,109 @@
+package gomagiclink
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How an expired session was detected, see SessionExpiredEvent.DetectedBy.
+const (
+	SessionExpiryDetectedOnVerify  = "verify"
+	SessionExpiryDetectedByJanitor = "janitor"
+)
+
+// SessionExpiredEvent describes a session which has expired, for analytics (e.g. the
+// distribution of session durations) and re-engagement (e.g. "we missed you" e-mails).
+type SessionExpiredEvent struct {
+	SessionID  string // Fingerprint of the session ID, the same as SessionRecord.ID for server-side sessions
+	UserID     uuid.UUID
+	CreatedAt  time.Time // For signed session IDs, derived from the expiration time and the session duration
+	ExpiredAt  time.Time
+	DetectedAt time.Time
+	DetectedBy string // SessionExpiryDetectedOnVerify or SessionExpiryDetectedByJanitor
+}
+
+// Duration returns how long the session was valid.
+func (ev SessionExpiredEvent) Duration() time.Duration {
+	if ev.CreatedAt.IsZero() {
+		return 0
+	}
+	return ev.ExpiredAt.Sub(ev.CreatedAt)
+}
+
+// ExpiredSessionPurger is implemented by SessionStores which can remove the expired
+// sessions in bulk, for PurgeExpiredSessions().
+type ExpiredSessionPurger interface {
+	PurgeExpiredSessions(now time.Time) ([]*SessionRecord, error) // Removes and returns the sessions expired before now
+}
+
+// WithOnSessionExpired sets the function which is called when an expired session is
+// detected: lazily, when an expired session ID is verified, or by PurgeExpiredSessions()
+// for server-side sessions which are never presented again. Server-side expired sessions
+// are removed from the SessionStore when they're detected, so they're reported once, but
+// a signed session ID is reported each time it's presented after it expired (the
+// SessionID fingerprint can be used to deduplicate the events). Impersonation sessions
+// aren't reported. The function is called synchronously, so it should be fast.
+func WithOnSessionExpired(fn func(ev SessionExpiredEvent)) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.onSessionExpired = fn
+	}
+}
+
+// sessionExpired reports the expired session to the OnSessionExpired function.
+func (mlc *AuthMagicLinkController) sessionExpired(ev SessionExpiredEvent) {
+	if mlc.onSessionExpired == nil {
+		return
+	}
+	ev.DetectedAt = time.Now()
+	mlc.onSessionExpired(ev)
+}
+
+// storedSessionExpired removes the expired server-side session from the SessionStore,
+// and reports it.
+func (mlc *AuthMagicLinkController) storedSessionExpired(rec *SessionRecord) {
+	err := mlc.sessionStore.RemoveSession(rec.ID)
+	if err != nil && err != ErrSessionNotFound {
+		mlc.logger.Error("Error removing expired session", "error", err)
+		return
+	}
+	if err == nil {
+		mlc.sessionExpired(SessionExpiredEvent{SessionID: rec.ID, UserID: rec.UserID, CreatedAt: rec.CreatedAt, ExpiredAt: rec.ExpiresAt, DetectedBy: SessionExpiryDetectedOnVerify})
+	}
+}
+
+// PurgeExpiredSessions removes the expired sessions from the SessionStore, if it
+// implements ExpiredSessionPurger, reporting each to the OnSessionExpired function
+// (see WithOnSessionExpired()). It returns the number of removed sessions.
+func (mlc *AuthMagicLinkController) PurgeExpiredSessions() (n int, err error) {
+	purger, ok := mlc.sessionStore.(ExpiredSessionPurger)
+	if !ok {
+		return 0, nil
+	}
+	recs, err := purger.PurgeExpiredSessions(time.Now().Add(-mlc.clockSkew))
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range recs {
+		mlc.sessionExpired(SessionExpiredEvent{SessionID: rec.ID, UserID: rec.UserID, CreatedAt: rec.CreatedAt, ExpiredAt: rec.ExpiresAt, DetectedBy: SessionExpiryDetectedByJanitor})
+	}
+	return len(recs), nil
+}
+
+// RunSessionJanitor calls PurgeExpiredSessions() every interval, until the context is
+// done. Errors are logged. Run it in its own goroutine.
+func (mlc *AuthMagicLinkController) RunSessionJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := mlc.PurgeExpiredSessions(); err != nil {
+			mlc.logger.Error("Error purging expired sessions", "error", err)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package gomagiclink
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const storedSessionIdSignature = "R"
+
+var ErrSessionNotFound = errors.New("session not found")
+var ErrTooManySessions = errors.New("too many sessions")
+
+// SessionLimitPolicy decides what happens when a user reaches the limit set by
+// WithMaxSessionsPerUser().
+type SessionLimitPolicy int
+
+const (
+	SessionLimitEvictOldest SessionLimitPolicy = iota // Revoke the oldest sessions to make room for the new one
+	SessionLimitRefuse                                // Refuse the new session with ErrTooManySessions
+)
+
+// SessionRecord is a server-side session, as kept in a SessionStore.
+type SessionRecord struct {
+	ID        string    `json:"id"` // SHA-256 hash of the session ID, so a leaked store doesn't leak sessions
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"` // Zero if the session doesn't expire
+}
+
+// SessionStore keeps server-side sessions, used instead of signed self-contained session
+// IDs when it's configured with WithSessionStore(). GetSession() can return expired
+// sessions, which are then removed by the controller.
+type SessionStore interface {
+	AddSession(rec *SessionRecord) error
+	GetSession(id string) (*SessionRecord, error)               // Returns ErrSessionNotFound if it's not in the store
+	GetUserSessions(userID uuid.UUID) ([]*SessionRecord, error) // Unexpired sessions
+	RemoveSession(id string) error
+	RemoveUserSessions(userID uuid.UUID) error
+}
+
+// LimitedSessionStore is implemented by SessionStores which can enforce the limit set by
+// WithMaxSessionsPerUser() atomically, so concurrent logins of a user can't exceed it.
+// With other stores, the sessions are counted before the new one is added, which
+// concurrent logins can race past.
+type LimitedSessionStore interface {
+	// AddSessionWithLimit adds the session unless its user would then have more than max
+	// unexpired sessions. With evict set, the user's oldest sessions are removed to make
+	// room, and returned; otherwise it returns ErrTooManySessions.
+	AddSessionWithLimit(rec *SessionRecord, max int, evict bool) (evicted []*SessionRecord, err error)
+}
+
+// WithSessionStore makes GenerateSessionId() create opaque random session IDs, kept
+// in the SessionStore, which can be revoked instantly with RevokeSession() or
+// RevokeUserSessions(). Session IDs generated before the option was enabled are
+// still accepted until they expire. Impersonation sessions and sessions bound to a
+// proof key (see WithProofOfPossession()) are always signed.
+func WithSessionStore(ss SessionStore) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.sessionStore = ss
+	}
+}
+
+// WithMaxSessionsPerUser limits the number of concurrent sessions a user can have, so a
+// leaked mailbox can't be used to open unlimited parallel sessions. When a new session
+// would exceed the limit, the policy decides whether the oldest sessions are revoked or
+// the new session is refused. It requires a SessionStore; signed session IDs can't be counted.
+// The limit is only enforced atomically by LimitedSessionStores, such as MemorySessionStore.
+func WithMaxSessionsPerUser(n int, policy SessionLimitPolicy) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.maxSessionsPerUser = n
+		mlc.sessionLimitPolicy = policy
+	}
+}
+
+// storedSessionHash returns the ID of the session in the SessionStore.
+func storedSessionHash(sessionId string) string {
+	h := sha256.Sum256([]byte(CanonicalToken(sessionId)))
+	return hex.EncodeToString(h[:])
+}
+
+// generateStoredSessionId creates a random session ID and adds it to the SessionStore.
+func (mlc *AuthMagicLinkController) generateStoredSessionId(user *AuthUserRecord) (sessionId string, err error) {
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	sessionId = storedSessionIdSignature + encodeToString(random)
+	now := time.Now()
+	rec := &SessionRecord{
+		ID:        storedSessionHash(sessionId),
+		UserID:    user.ID,
+		CreatedAt: now,
+	}
+	if d := mlc.sessionDuration(user); d > 0 {
+		rec.ExpiresAt = now.Add(d)
+	}
+	if err = mlc.addSessionWithLimit(user, rec); err != nil {
+		return "", err
+	}
+	return sessionId, nil
+}
+
+// addSessionWithLimit adds the new session of the user to the SessionStore, according to
+// the configured limit and policy, atomically if the store is a LimitedSessionStore.
+func (mlc *AuthMagicLinkController) addSessionWithLimit(user *AuthUserRecord, rec *SessionRecord) error {
+	if mlc.maxSessionsPerUser <= 0 {
+		return mlc.sessionStore.AddSession(rec)
+	}
+	if ls, ok := mlc.sessionStore.(LimitedSessionStore); ok {
+		evicted, err := ls.AddSessionWithLimit(rec, mlc.maxSessionsPerUser, mlc.sessionLimitPolicy == SessionLimitEvictOldest)
+		if err != nil {
+			return err
+		}
+		mlc.auditSessionLimit(user, len(evicted))
+		return nil
+	}
+	if err := mlc.enforceSessionLimit(user); err != nil {
+		return err
+	}
+	return mlc.sessionStore.AddSession(rec)
+}
+
+// auditSessionLimit records the revocation of the user's sessions evicted by the limit.
+func (mlc *AuthMagicLinkController) auditSessionLimit(user *AuthUserRecord, n int) {
+	if n > 0 {
+		mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: user.ID, Email: user.Email, Details: map[string]string{"reason": "session_limit", "count": strconv.Itoa(n)}})
+	}
+}
+
+// enforceSessionLimit makes room for a new session of the user, according to the
+// configured limit and policy, for SessionStores which aren't LimitedSessionStores.
+func (mlc *AuthMagicLinkController) enforceSessionLimit(user *AuthUserRecord) error {
+	recs, err := mlc.sessionStore.GetUserSessions(user.ID)
+	if err != nil {
+		return err
+	}
+	excess := len(recs) - mlc.maxSessionsPerUser + 1
+	if excess <= 0 {
+		return nil
+	}
+	if mlc.sessionLimitPolicy == SessionLimitRefuse {
+		return ErrTooManySessions
+	}
+	slices.SortFunc(recs, func(a, b *SessionRecord) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	for _, rec := range recs[:excess] {
+		err = mlc.sessionStore.RemoveSession(rec.ID)
+		if err != nil && err != ErrSessionNotFound {
+			return err
+		}
+	}
+	mlc.auditSessionLimit(user, excess)
+	return nil
+}
+
+// parseStoredSessionId looks up the session in the SessionStore.
+func (mlc *AuthMagicLinkController) parseStoredSessionId(sessionId string) (claims sessionClaims, err error) {
+	if mlc.sessionStore == nil {
+		return claims, ErrInvalidSessionId
+	}
+	rec, err := mlc.sessionStore.GetSession(storedSessionHash(sessionId))
+	if err == ErrSessionNotFound {
+		return claims, ErrInvalidSessionId
+	}
+	if err != nil {
+		return claims, err
+	}
+	if !rec.ExpiresAt.IsZero() && mlc.isExpired(int(rec.ExpiresAt.Unix())) {
+		mlc.storedSessionExpired(rec)
+		return claims, ErrExpiredSessionId
+	}
+	claims = sessionClaims{UserID: rec.UserID, IssuedAt: rec.CreatedAt, Stored: true}
+	if !rec.ExpiresAt.IsZero() {
+		claims.ExpTime = int(rec.ExpiresAt.Unix())
+	}
+	return claims, nil
+}
+
+// RevokeSession removes the session from the SessionStore, so it can't be used anymore.
+// Signed session IDs can only be revoked with WithReplicatedRevocation(), and otherwise
+// return ErrInvalidSessionId.
+func (mlc *AuthMagicLinkController) RevokeSession(sessionId string) (err error) {
+	if len(sessionId) > 0 && sessionId[:1] != storedSessionIdSignature && mlc.revocations != nil {
+		return mlc.revokeSignedSession(sessionId)
+	}
+	if mlc.sessionStore == nil || len(sessionId) == 0 || sessionId[:1] != storedSessionIdSignature {
+		return ErrInvalidSessionId
+	}
+	id := storedSessionHash(sessionId)
+	rec, err := mlc.sessionStore.GetSession(id)
+	if err == ErrSessionNotFound {
+		return ErrInvalidSessionId
+	}
+	if err != nil {
+		return
+	}
+	if err = mlc.sessionStore.RemoveSession(id); err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: rec.UserID})
+	return nil
+}
+
+// RevokeUserSessions removes all the user's sessions from the SessionStore, and their
+// refresh tokens from the RefreshTokenStore (see WithRefreshTokens()), e.g. to log them
+// out everywhere. With WithReplicatedRevocation(), it also revokes their signed sessions.
+func (mlc *AuthMagicLinkController) RevokeUserSessions(userId uuid.UUID) (err error) {
+	if mlc.sessionStore == nil && mlc.refreshTokenStore == nil && mlc.revocations == nil {
+		return nil
+	}
+	if mlc.revocations != nil {
+		if err = mlc.revokeSignedUserSessions(userId); err != nil {
+			return
+		}
+	}
+	if mlc.sessionStore != nil {
+		if err = mlc.sessionStore.RemoveUserSessions(userId); err != nil {
+			return
+		}
+	}
+	if mlc.refreshTokenStore != nil {
+		if err = mlc.refreshTokenStore.RemoveUserRefreshTokens(userId); err != nil {
+			return
+		}
+	}
+	mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: userId, Details: map[string]string{"scope": "all"}})
+	return nil
+}
+
+// GetUserSessions returns the user's server-side sessions, or nil if there's no SessionStore.
+func (mlc *AuthMagicLinkController) GetUserSessions(userId uuid.UUID) ([]*SessionRecord, error) {
+	if mlc.sessionStore == nil {
+		return nil, nil
+	}
+	return mlc.sessionStore.GetUserSessions(userId)
+}
+
+// MemorySessionStore is an in-memory SessionStore, suitable for single-instance apps.
+// Expired sessions are kept until they're presented again, or purged with
+// PurgeExpiredSessions(), so run RunSessionJanitor() with it.
+type MemorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*SessionRecord
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]*SessionRecord{}}
+}
+
+func (ms *MemorySessionStore) AddSession(rec *SessionRecord) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	recCopy := *rec
+	ms.sessions[rec.ID] = &recCopy
+	return nil
+}
+
+// AddSessionWithLimit implements LimitedSessionStore.
+func (ms *MemorySessionStore) AddSessionWithLimit(rec *SessionRecord, max int, evict bool) (evicted []*SessionRecord, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	var recs []*SessionRecord
+	for _, other := range ms.sessions {
+		if other.UserID == rec.UserID && (other.ExpiresAt.IsZero() || !other.ExpiresAt.Before(now)) {
+			recs = append(recs, other)
+		}
+	}
+	if excess := len(recs) - max + 1; excess > 0 {
+		if !evict {
+			return nil, ErrTooManySessions
+		}
+		slices.SortFunc(recs, func(a, b *SessionRecord) int {
+			return a.CreatedAt.Compare(b.CreatedAt)
+		})
+		for _, old := range recs[:excess] {
+			delete(ms.sessions, old.ID)
+			evicted = append(evicted, old)
+		}
+	}
+	recCopy := *rec
+	ms.sessions[rec.ID] = &recCopy
+	return evicted, nil
+}
+
+func (ms *MemorySessionStore) GetSession(id string) (*SessionRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rec, ok := ms.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	recCopy := *rec
+	return &recCopy, nil
+}
+
+func (ms *MemorySessionStore) GetUserSessions(userID uuid.UUID) (recs []*SessionRecord, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	for _, rec := range ms.sessions {
+		if !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(now) {
+			continue
+		}
+		if rec.UserID == userID {
+			recCopy := *rec
+			recs = append(recs, &recCopy)
+		}
+	}
+	return recs, nil
+}
+
+func (ms *MemorySessionStore) RemoveSession(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.sessions[id]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(ms.sessions, id)
+	return nil
+}
+
+func (ms *MemorySessionStore) RemoveUserSessions(userID uuid.UUID) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, rec := range ms.sessions {
+		if rec.UserID == userID {
+			delete(ms.sessions, id)
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredSessions removes and returns the sessions which expired before now.
+func (ms *MemorySessionStore) PurgeExpiredSessions(now time.Time) (recs []*SessionRecord, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, rec := range ms.sessions {
+		if !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(now) {
+			delete(ms.sessions, id)
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
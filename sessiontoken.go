@@ -0,0 +1,88 @@
+package gomagiclink
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink/keys"
+)
+
+var ErrNoSessionTokenKeys = errors.New("no session token keys configured")
+
+// WithSessionTokenKeys enables public-key session tokens, signed with the current key
+// from the KeySet. Publish the public keys with adapters.JWKSHandler(), so resource
+// servers can verify the tokens locally, with keys.ParseJWKS() and
+// KeySet.VerifySessionToken().
+func WithSessionTokenKeys(ks *keys.KeySet) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.sessionTokenKeys = ks
+	}
+}
+
+// SessionTokenKeys returns the KeySet set by WithSessionTokenKeys(), or nil.
+func (mlc *AuthMagicLinkController) SessionTokenKeys() *keys.KeySet {
+	return mlc.sessionTokenKeys
+}
+
+// GenerateSessionToken is like GenerateSessionId(), but creates a JWT signed with
+// Ed25519 (see WithSessionTokenKeys()), which can be verified without the secret key.
+// Its claims are keys.SessionClaims. It returns ErrTOTPRequired for users with the
+// TOTPPending field set.
+func (mlc *AuthMagicLinkController) GenerateSessionToken(user *AuthUserRecord) (token string, err error) {
+	if mlc.sessionTokenKeys == nil {
+		return "", ErrNoSessionTokenKeys
+	}
+	if user.TOTPPending {
+		return "", ErrTOTPRequired
+	}
+	now := time.Now()
+	claims := keys.SessionClaims{
+		Subject:  user.ID.String(),
+		Email:    user.Email,
+		Audience: mlc.audience,
+		IssuedAt: now.Unix(),
+	}
+	if d := mlc.sessionDuration(user); d > 0 {
+		claims.Expires = now.Add(d).Unix()
+	}
+	return mlc.sessionTokenKeys.Sign(claims)
+}
+
+// VerifySessionToken verifies the token generated by GenerateSessionToken(), and returns
+// the user's record, like VerifySessionId().
+func (mlc *AuthMagicLinkController) VerifySessionToken(token string) (user *AuthUserRecord, err error) {
+	if mlc.sessionTokenKeys == nil {
+		return nil, ErrNoSessionTokenKeys
+	}
+	var claims keys.SessionClaims
+	err = mlc.sessionTokenKeys.Verify(token, &claims)
+	if err == keys.ErrBrokenToken {
+		return nil, ErrBrokenSessionId
+	}
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	if claims.Expires != 0 && mlc.isExpired(int(claims.Expires)) {
+		return nil, ErrExpiredSessionId
+	}
+	if claims.Audience != mlc.audience {
+		return nil, ErrWrongAudience
+	}
+	userId, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	user, err = mlc.getUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if !user.Enabled {
+		return nil, ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, ErrUserLocked
+	}
+	user.RecentLoginTime = time.Now()
+	return
+}
@@ -0,0 +1,56 @@
+package gomagiclink
+
+import (
+	"time"
+)
+
+// UsedTokenStore remembers the one-time tokens which have been used. Implement it on a
+// shared store (the `storage` package has a Redis implementation) so all the app
+// instances agree on which tokens have been used.
+type UsedTokenStore interface {
+	// MarkUsed atomically records the token ID as used until the given time, returning
+	// false if it already was.
+	MarkUsed(id string, until time.Time) (first bool, err error)
+}
+
+// WithSingleUseChallenges makes each challenge verifiable only once, by marking it as used
+// in the UsedTokenStore when it's verified; the second verification fails with
+// ErrUsedChallenge. Unlike WithChallengeStore(), it doesn't need the challenges to be
+// recorded when they're generated, so it works with challenges generated by any instance,
+// and the store only keeps the used challenges' IDs (see ChallengeID()) until they expire.
+func WithSingleUseChallenges(store UsedTokenStore) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.usedChallenges = store
+	}
+}
+
+// markChallengeUsed marks the challenge as used in the UsedTokenStore, if one is
+// configured, returning ErrUsedChallenge if it already was.
+func (mlc *AuthMagicLinkController) markChallengeUsed(challenge string, expTime int) error {
+	if mlc.usedChallenges == nil {
+		return nil
+	}
+	// Remember it for as long as it could pass verification
+	until := time.Unix(int64(expTime), 0).Add(mlc.clockSkew + time.Second)
+	first, err := mlc.usedChallenges.MarkUsed(ChallengeID(challenge), until)
+	if err != nil {
+		return err
+	}
+	if !first {
+		return ErrUsedChallenge
+	}
+	return nil
+}
+
+// MemoryUsedTokenStore is an in-memory UsedTokenStore, suitable for single-instance apps.
+type MemoryUsedTokenStore struct {
+	seen *seenCache
+}
+
+func NewMemoryUsedTokenStore() *MemoryUsedTokenStore {
+	return &MemoryUsedTokenStore{seen: newSeenCache()}
+}
+
+func (s *MemoryUsedTokenStore) MarkUsed(id string, until time.Time) (first bool, err error) {
+	return s.seen.add(id, until), nil
+}
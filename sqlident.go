@@ -0,0 +1,28 @@
+package gomagiclink
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidSQLIdentifier = errors.New("invalid SQL identifier")
+
+var reSQLIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// ValidateSQLIdentifier checks that the name (e.g. a table name), optionally qualified
+// with a schema name ("schema.table"), consists only of letters, digits and underscores,
+// and doesn't start with a digit. The SQL storages interpolate table names into queries,
+// so they reject names which don't pass this check with ErrInvalidSQLIdentifier.
+func ValidateSQLIdentifier(name string) error {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return ErrInvalidSQLIdentifier
+	}
+	for _, part := range parts {
+		if !reSQLIdentifier.MatchString(part) {
+			return ErrInvalidSQLIdentifier
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package gomagiclink
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const statelessSessionIdSignature = "E"
+
+var ErrStatelessMode = errors.New("operation not supported in stateless mode")
+
+// StatelessController implements magic link logins without a UserAuthDatabase, for
+// apps (e.g. serverless functions) which keep their user data elsewhere, or don't have
+// any. Users are identified only by their e-mail address: VerifyChallenge() returns it,
+// and session IDs are self-contained, carrying the e-mail address instead of a user ID.
+// Such session IDs can't be revoked or checked against a disabled or locked user, so
+// keep the session expiry short.
+//
+// Session IDs created by a StatelessController are not accepted by an
+// AuthMagicLinkController, and vice versa.
+type StatelessController struct {
+	mlc *AuthMagicLinkController
+}
+
+// NewStatelessController creates a StatelessController. The options are the same as
+// for NewAuthMagicLinkController(), but those which need stored user records (such as
+// WithUserCache()) have no effect.
+func NewStatelessController(secretKey []byte, challengeExpDuration time.Duration, sessionExpDuration time.Duration, opts ...ControllerOption) (sc *StatelessController, err error) {
+	mlc, err := NewAuthMagicLinkController(secretKey, challengeExpDuration, sessionExpDuration, statelessDatabase{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	mlc.userCache = nil
+	return &StatelessController{mlc: mlc}, nil
+}
+
+// GenerateChallenge creates a challenge string to be used for constructing the magic link.
+func (sc *StatelessController) GenerateChallenge(email string) (challenge string, err error) {
+	return sc.mlc.GenerateChallenge(email)
+}
+
+// VerifyChallenge verifies the challenge and returns the (normalized) e-mail address
+// for which it was created.
+func (sc *StatelessController) VerifyChallenge(challenge string) (email string, err error) {
+	user, err := sc.mlc.VerifyChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	return user.Email, nil
+}
+
+// GenerateSessionId generates a self-contained session ID for the e-mail address.
+func (sc *StatelessController) GenerateSessionId(email string) (sessionId string, err error) {
+	// Stateless session ID is in the format:
+	// SALT-EMAIL-EXPTIME-HMAC("E" || SALT || EMAIL || EXPTIME, sessionKey)
+	email = NormalizeEmail(email)
+	if err = ValidateEmail(email); err != nil {
+		return
+	}
+	salt, err := sc.mlc.newSalt()
+	if err != nil {
+		return
+	}
+	expTime := 0
+	if sc.mlc.sessionExpDuration > 0 {
+		expTime = int(time.Now().Add(sc.mlc.sessionExpDuration).Unix())
+	}
+	expTimeStr := strconv.Itoa(expTime)
+
+	hmac := sc.mlc.makeTokenHMAC(sc.mlc.keys.session, slices.Concat([]byte(statelessSessionIdSignature), salt, []byte{0}, []byte(email), []byte{0}, []byte(expTimeStr)))
+
+	return sc.mlc.sealToken(strings.Join([]string{
+		statelessSessionIdSignature + encodeToString(salt),
+		encodeToString([]byte(email)),
+		expTimeStr,
+		encodeToString(hmac),
+	}, sesionIdSplitChar)), nil
+}
+
+// VerifySessionId verifies the session ID generated by GenerateSessionId(), and
+// returns the e-mail address it was generated for.
+func (sc *StatelessController) VerifySessionId(sessionId string) (email string, err error) {
+	if sessionId, err = sc.mlc.openToken(sessionId); err != nil {
+		return "", ErrInvalidSessionId
+	}
+	if !strings.HasPrefix(sessionId, statelessSessionIdSignature) {
+		return "", ErrInvalidSessionId
+	}
+	parts := strings.Split(sessionId[len(statelessSessionIdSignature):], sesionIdSplitChar)
+	if len(parts) != 4 {
+		return "", ErrInvalidSessionId
+	}
+	salt, err := decodeFromString(parts[0])
+	if err != nil {
+		return "", ErrInvalidSessionId
+	}
+	if err = sc.mlc.checkAudience(salt); err != nil {
+		return "", err
+	}
+	emailBytes, err := decodeFromString(parts[1])
+	if err != nil {
+		return "", ErrInvalidSessionId
+	}
+	expTime, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", ErrInvalidSessionId
+	}
+	if expTime != 0 && sc.mlc.isExpired(expTime) {
+		return "", ErrExpiredSessionId
+	}
+	hmac1, err := decodeFromString(parts[3])
+	if err != nil {
+		return "", ErrInvalidSessionId
+	}
+	if !sc.mlc.verifyTokenHMAC(sc.mlc.keys.session, slices.Concat([]byte(statelessSessionIdSignature), salt, []byte{0}, emailBytes, []byte{0}, []byte(parts[2])), hmac1) {
+		return "", ErrBrokenSessionId
+	}
+	return string(emailBytes), nil
+}
+
+// statelessDatabase is the UserStorage used in stateless mode. It never finds
+// any users, and refuses to store them.
+type statelessDatabase struct{}
+
+func (statelessDatabase) UserExistsByEmail(email string) bool { return false }
+
+func (statelessDatabase) StoreUser(user *AuthUserRecord) error { return ErrStatelessMode }
+
+func (statelessDatabase) CreateUser(user *AuthUserRecord) error { return ErrStatelessMode }
+
+func (statelessDatabase) UpdateUser(user *AuthUserRecord) error { return ErrStatelessMode }
+
+func (statelessDatabase) GetUserById(id uuid.UUID) (*AuthUserRecord, error) {
+	return nil, ErrUserNotFound
+}
+
+func (statelessDatabase) GetUserByEmail(email string) (*AuthUserRecord, error) {
+	return nil, ErrUserNotFound
+}
+
+func (statelessDatabase) DeleteUser(id uuid.UUID) error { return ErrStatelessMode }
+
+func (statelessDatabase) GetUserCount() (int, error) { return 0, nil }
+
+func (statelessDatabase) UsersExist() (bool, error) { return false, nil }
@@ -0,0 +1,31 @@
+package gomagiclink
+
+import (
+	"database/sql"
+	"time"
+)
+
+// StorageStatistics describes the health of a storage backend.
+type StorageStatistics struct {
+	UserCount     int          `json:"user_count"`
+	LastError     string       `json:"last_error,omitempty"` // The most recent unexpected storage error
+	LastErrorTime time.Time    `json:"last_error_time,omitempty"`
+	DB            *sql.DBStats `json:"db,omitempty"` // Connection pool statistics, for SQL storages
+}
+
+// StorageStats is implemented by storages which can report their health. All the
+// storages in the `storage` package implement it.
+type StorageStats interface {
+	GetStats() StorageStatistics
+}
+
+// GetStorageStats returns the storage statistics, so dashboards can show storage health
+// without backend-specific code. For storages which don't implement StorageStats,
+// only the user count is reported (see GetUserCount()).
+func (mlc *AuthMagicLinkController) GetStorageStats() (stats StorageStatistics, err error) {
+	if ss, ok := mlc.db.(StorageStats); ok {
+		return ss.GetStats(), nil
+	}
+	stats.UserCount, err = mlc.countUsers()
+	return
+}
@@ -0,0 +1,548 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+const azureTableAPIVersion = "2019-02-02"
+
+var ErrInvalidAzureTableName = errors.New("invalid Azure table name")
+var ErrConcurrentModification = errors.New("record was modified concurrently")
+
+var errAzureNotFound = errors.New("entity not found")
+var errAzureConflict = errors.New("entity already exists")
+
+var reAzureTableName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{2,62}$`)
+
+// AzureTableStorage stores the users in an Azure Table Storage table (or a CosmosDB
+// account with the Table API), using its REST API directly. Each user is stored as two
+// entities in the same table:
+//
+//	PartitionKey "u-" + first 2 hex digits of SHA256(email), RowKey SHA256(email): the user record
+//	PartitionKey "i-" + last byte of the ID in hex, RowKey ID: the index from the ID to the e-mail address
+//
+// Hashing the e-mail address spreads the users evenly over 256 partitions. The table
+// needs to be created by the caller. With a namespace (see SetNamespace()), the
+// PartitionKeys are prefixed with it and a dot.
+//
+// Updates use ETags for optimistic concurrency: if a user entity is changed by someone
+// else between reading and writing it, UpdateUser() returns ErrConcurrentModification,
+// and the caller can retry. Azure Tables have no transactions across partitions, so
+// a failure in the middle of creating a user or changing their e-mail address can leave
+// an orphaned entity behind, which is ignored by lookups.
+type AzureTableStorage struct {
+	endpoint  string
+	account   string
+	key       []byte
+	tableName string
+	client    *http.Client
+	errs      errorTracker
+	codec     recordCodec
+
+	partitionPrefix string // The namespace and a dot, see SetNamespace()
+}
+
+type azureUserEntity struct {
+	PartitionKey string
+	RowKey       string
+	ID           string
+	Email        string
+	Data         string
+	ETag         string `json:"odata.etag,omitempty"` // Only in query results
+}
+
+type azureIndexEntity struct {
+	PartitionKey string
+	RowKey       string
+	Email        string
+}
+
+// NewAzureTableStorage creates an AzureTableStorage for the table in the storage account,
+// authenticating with the account's base64-encoded access key.
+func NewAzureTableStorage(account string, accountKey string, tableName string) (st *AzureTableStorage, err error) {
+	return NewAzureTableStorageWithEndpoint(fmt.Sprintf("https://%s.table.core.windows.net", account), account, accountKey, tableName)
+}
+
+// NewAzureTableStorageWithEndpoint is like NewAzureTableStorage(), but with an explicit
+// endpoint URL, e.g. "https://account.table.cosmos.azure.com" for CosmosDB, or
+// "http://127.0.0.1:10002/devstoreaccount1" for the Azurite emulator.
+func NewAzureTableStorageWithEndpoint(endpoint string, account string, accountKey string, tableName string) (st *AzureTableStorage, err error) {
+	if !reAzureTableName.MatchString(tableName) {
+		return nil, ErrInvalidAzureTableName
+	}
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AzureTableStorage{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		account:   account,
+		key:       key,
+		tableName: tableName,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		codec:     recordCodec{text: true}, // The entities' properties are strings
+	}, nil
+}
+
+func (st *AzureTableStorage) userKeys(email string) (pk string, rk string) {
+	h := sha256.Sum256([]byte(email))
+	rk = hex.EncodeToString(h[:])
+	return st.partitionPrefix + "u-" + rk[:2], rk
+}
+
+func (st *AzureTableStorage) indexKeys(id uuid.UUID) (pk string, rk string) {
+	return st.partitionPrefix + "i-" + hex.EncodeToString(id[15:]), id.String()
+}
+
+// StoreUser creates the user record if it doesn't exist, or updates it. It returns
+// ErrUserAlreadyExists if the user's e-mail address belongs to another user.
+func (st *AzureTableStorage) StoreUser(user *gomagiclink.AuthUserRecord) (err error) {
+	err = st.UpdateUser(user)
+	if err == gomagiclink.ErrUserNotFound {
+		return st.CreateUser(user)
+	}
+	return
+}
+
+// CreateUser stores a new user record. It returns ErrUserAlreadyExists if a user
+// with the same ID or e-mail address exists.
+func (st *AzureTableStorage) CreateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	userJson, err := st.codec.marshal(user)
+	if err != nil {
+		return
+	}
+	ipk, irk := st.indexKeys(user.GetID())
+	err = st.insertEntity(&azureIndexEntity{PartitionKey: ipk, RowKey: irk, Email: user.Email})
+	if err == errAzureConflict {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	if err != nil {
+		return
+	}
+	upk, urk := st.userKeys(user.Email)
+	err = st.insertEntity(&azureUserEntity{PartitionKey: upk, RowKey: urk, ID: user.ID.String(), Email: user.Email, Data: string(userJson)})
+	if err != nil {
+		st.deleteEntity(ipk, irk, "*")
+		if err == errAzureConflict {
+			return gomagiclink.ErrUserAlreadyExists
+		}
+	}
+	return
+}
+
+// UpdateUser updates an existing user record. It returns ErrUserNotFound if the
+// user doesn't exist, ErrUserAlreadyExists if the user's (changed) e-mail address
+// belongs to another user, and ErrConcurrentModification if the stored record was
+// changed while it was being updated.
+func (st *AzureTableStorage) UpdateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	userJson, err := st.codec.marshal(user)
+	if err != nil {
+		return
+	}
+	ipk, irk := st.indexKeys(user.ID)
+	var idx azureIndexEntity
+	idxETag, err := st.getEntity(ipk, irk, &idx)
+	if err == errAzureNotFound {
+		return gomagiclink.ErrUserNotFound
+	}
+	if err != nil {
+		return
+	}
+	upk, urk := st.userKeys(user.Email)
+	entity := &azureUserEntity{PartitionKey: upk, RowKey: urk, ID: user.ID.String(), Email: user.Email, Data: string(userJson)}
+
+	if idx.Email == user.Email {
+		var old azureUserEntity
+		etag, err := st.getEntity(upk, urk, &old)
+		if err == errAzureNotFound {
+			return gomagiclink.ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if old.ID != user.ID.String() {
+			return gomagiclink.ErrUserAlreadyExists
+		}
+		err = st.replaceEntity(upk, urk, entity, etag)
+		if err == errAzureNotFound {
+			return ErrConcurrentModification
+		}
+		return err
+	}
+
+	// The e-mail address has changed, so the user entity moves to a new key.
+	err = st.insertEntity(entity)
+	if err == errAzureConflict {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	if err != nil {
+		return
+	}
+	oldEmail := idx.Email
+	idx.Email = user.Email
+	err = st.replaceEntity(ipk, irk, &idx, idxETag)
+	if err != nil {
+		st.deleteEntity(upk, urk, "*")
+		if err == errAzureNotFound {
+			return ErrConcurrentModification
+		}
+		return
+	}
+	opk, ork := st.userKeys(oldEmail)
+	err = st.deleteEntity(opk, ork, "*")
+	if err == errAzureNotFound {
+		err = nil
+	}
+	return
+}
+
+func (st *AzureTableStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	defer st.errs.track(&err)
+	ipk, irk := st.indexKeys(id)
+	var idx azureIndexEntity
+	_, err = st.getEntity(ipk, irk, &idx)
+	if err == errAzureNotFound {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	if err != nil {
+		return
+	}
+	return st.getUserByEmail(idx.Email, id.String())
+}
+
+func (st *AzureTableStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
+	defer st.errs.track(&err)
+	return st.getUserByEmail(gomagiclink.NormalizeEmail(email), "")
+}
+
+// getUserByEmail loads the user entity, checking that it belongs to the user ID, if given.
+func (st *AzureTableStorage) getUserByEmail(email string, id string) (user *gomagiclink.AuthUserRecord, err error) {
+	upk, urk := st.userKeys(email)
+	var entity azureUserEntity
+	_, err = st.getEntity(upk, urk, &entity)
+	if err == errAzureNotFound || (err == nil && id != "" && entity.ID != id) {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	if err != nil {
+		return
+	}
+	return st.codec.unmarshal([]byte(entity.Data))
+}
+
+func (st *AzureTableStorage) DeleteUser(id uuid.UUID) (err error) {
+	defer st.errs.track(&err)
+	ipk, irk := st.indexKeys(id)
+	var idx azureIndexEntity
+	_, err = st.getEntity(ipk, irk, &idx)
+	if err == errAzureNotFound {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	upk, urk := st.userKeys(idx.Email)
+	err = st.deleteEntity(upk, urk, "*")
+	if err != nil && err != errAzureNotFound {
+		return
+	}
+	err = st.deleteEntity(ipk, irk, "*")
+	if err == errAzureNotFound {
+		err = nil
+	}
+	return
+}
+
+func (st *AzureTableStorage) UserExistsByEmail(email string) (exists bool) {
+	upk, urk := st.userKeys(gomagiclink.NormalizeEmail(email))
+	var entity azureUserEntity
+	_, err := st.getEntity(upk, urk, &entity)
+	if err != nil {
+		if err != errAzureNotFound {
+			st.errs.track(&err)
+		}
+		return false
+	}
+	return true
+}
+
+// userFilter selects the user entities, those with PartitionKeys starting with "u-"
+// (after the namespace prefix).
+func (st *AzureTableStorage) userFilter() string {
+	return fmt.Sprintf("PartitionKey ge '%[1]su-' and PartitionKey lt '%[1]su.'", st.partitionPrefix)
+}
+
+func (st *AzureTableStorage) GetUserCount() (n int, err error) {
+	defer st.errs.track(&err)
+	err = st.queryEntities(st.userFilter(), "RowKey", func(entity *azureUserEntity) bool {
+		n++
+		return true
+	})
+	return
+}
+
+func (st *AzureTableStorage) UsersExist() (exist bool, err error) {
+	defer st.errs.track(&err)
+	err = st.queryEntities(st.userFilter(), "RowKey", func(entity *azureUserEntity) bool {
+		exist = true
+		return false
+	})
+	return
+}
+
+// GetStats returns the user count and the most recent storage error.
+func (st *AzureTableStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	stats.UserCount, _ = st.GetUserCount()
+	st.errs.fill(&stats)
+	return
+}
+
+// SetRecordEncryptor enables encryption of the stored user records. Records which were
+// stored unencrypted can still be read, and are encrypted when they're next stored, or
+// by ReencryptRecords(). Note that the e-mail address is also stored in plain text in
+// its own property, for lookups.
+func (st *AzureTableStorage) SetRecordEncryptor(encryptor *gomagiclink.RecordEncryptor) {
+	st.codec.encryptor = encryptor
+}
+
+// SetRecordCodec sets the serialization of the stored user records (JSONRecordCodec by
+// default). Records in the other provided formats can still be read.
+func (st *AzureTableStorage) SetRecordCodec(codec RecordCodec) {
+	st.codec.format = codec
+}
+
+// ReencryptRecords rewrites all the user records which aren't encrypted with the
+// current key of the RecordEncryptor, e.g. after a key rotation. It returns the
+// number of rewritten records.
+func (st *AzureTableStorage) ReencryptRecords() (n int, err error) {
+	defer st.errs.track(&err)
+	if st.codec.encryptor == nil {
+		return 0, gomagiclink.ErrNoRecordEncryptor
+	}
+	var stale []azureUserEntity
+	err = st.queryEntities(st.userFilter(), "", func(entity *azureUserEntity) bool {
+		if st.codec.needsReencryption([]byte(entity.Data)) {
+			stale = append(stale, *entity)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+	for _, entity := range stale {
+		user, err := st.codec.unmarshal([]byte(entity.Data))
+		if err != nil {
+			return n, err
+		}
+		newJson, err := st.codec.marshal(user)
+		if err != nil {
+			return n, err
+		}
+		etag := entity.ETag
+		entity.ETag = ""
+		entity.Data = string(newJson)
+		err = st.replaceEntity(entity.PartitionKey, entity.RowKey, &entity, etag)
+		if err == ErrConcurrentModification || err == errAzureNotFound {
+			// Changed since it was read, so it's been re-encrypted by the writer
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return
+}
+
+// SetNamespace restricts the storage to the entities of the namespace, so several apps
+// can share the table (see gomagiclink.WithNamespace(), which calls it).
+func (st *AzureTableStorage) SetNamespace(namespace string) error {
+	if err := gomagiclink.ValidateNamespace(namespace); err != nil {
+		return err
+	}
+	st.partitionPrefix = namespace + "."
+	return nil
+}
+
+// SetLogger sets the logger to which storage errors are logged. By default they're not logged.
+func (st *AzureTableStorage) SetLogger(logger *slog.Logger) {
+	st.errs.logger = logger
+}
+
+func (st *AzureTableStorage) entityPath(pk string, rk string) string {
+	return fmt.Sprintf("%s(PartitionKey='%s',RowKey='%s')", st.tableName, pk, rk)
+}
+
+func (st *AzureTableStorage) getEntity(pk string, rk string, entity any) (etag string, err error) {
+	resp, err := st.do(http.MethodGet, st.entityPath(pk, rk), "", nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errAzureNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", azureResponseError(resp)
+	}
+	return resp.Header.Get("ETag"), json.NewDecoder(resp.Body).Decode(entity)
+}
+
+func (st *AzureTableStorage) insertEntity(entity any) (err error) {
+	resp, err := st.do(http.MethodPost, st.tableName, "", entity, map[string]string{"Prefer": "return-no-content"})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return errAzureConflict
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusCreated {
+		return azureResponseError(resp)
+	}
+	return nil
+}
+
+func (st *AzureTableStorage) replaceEntity(pk string, rk string, entity any, etag string) (err error) {
+	resp, err := st.do(http.MethodPut, st.entityPath(pk, rk), "", entity, map[string]string{"If-Match": etag})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrConcurrentModification
+	case http.StatusNotFound:
+		return errAzureNotFound
+	}
+	return azureResponseError(resp)
+}
+
+func (st *AzureTableStorage) deleteEntity(pk string, rk string, etag string) (err error) {
+	resp, err := st.do(http.MethodDelete, st.entityPath(pk, rk), "", nil, map[string]string{"If-Match": etag})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return errAzureNotFound
+	}
+	return azureResponseError(resp)
+}
+
+// queryEntities calls fn for each user entity matching the filter, following the
+// continuation tokens, until fn returns false.
+func (st *AzureTableStorage) queryEntities(filter string, selectProps string, fn func(entity *azureUserEntity) bool) error {
+	params := []string{"$filter=" + azureQueryEscape(filter)}
+	if selectProps != "" {
+		params = append(params, "$select="+azureQueryEscape(selectProps))
+	}
+	var nextPK, nextRK string
+	for {
+		query := params
+		if nextPK != "" {
+			query = append(query, "NextPartitionKey="+azureQueryEscape(nextPK))
+			if nextRK != "" {
+				query = append(query, "NextRowKey="+azureQueryEscape(nextRK))
+			}
+		}
+		resp, err := st.do(http.MethodGet, st.tableName+"()", strings.Join(query, "&"), nil, map[string]string{"Accept": "application/json;odata=minimalmetadata"})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = azureResponseError(resp)
+			resp.Body.Close()
+			return err
+		}
+		var result struct {
+			Value []azureUserEntity `json:"value"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for i := range result.Value {
+			if !fn(&result.Value[i]) {
+				return nil
+			}
+		}
+		nextPK = resp.Header.Get("x-ms-continuation-NextPartitionKey")
+		nextRK = resp.Header.Get("x-ms-continuation-NextRowKey")
+		if nextPK == "" {
+			return nil
+		}
+	}
+}
+
+// do sends a request to the Table service, authenticated with the SharedKeyLite scheme.
+func (st *AzureTableStorage) do(method string, path string, rawQuery string, body any, headers map[string]string) (*http.Response, error) {
+	u, err := url.Parse(st.endpoint + "/" + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+	var bodyReader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		bodyReader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("x-ms-date", date)
+	req.Header.Set("x-ms-version", azureTableAPIVersion)
+	req.Header.Set("Accept", "application/json;odata=nometadata")
+	req.Header.Set("DataServiceVersion", "3.0;NetFx")
+	req.Header.Set("MaxDataServiceVersion", "3.0;NetFx")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write([]byte(date + "\n/" + st.account + u.EscapedPath()))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKeyLite %s:%s", st.account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	return st.client.Do(req)
+}
+
+func azureQueryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func azureResponseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("azure table storage: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/internal/msgpack"
+)
+
+var ErrUnknownRecordFormat = errors.New("unknown stored record format")
+
+// RecordCodec serializes the stored user records. The records of binary codecs are
+// stored as the codec's name, a NUL byte and the data: the SQL storages keep them in a
+// binary column (see MigrateRecordColumns()), and the storages which can only hold text
+// base64-encode the data, after a colon instead of the NUL byte. The format of each
+// record is detected when it's read: records written in any of the provided formats can
+// be read regardless of the storage's codec, so the codec can be changed without
+// migrating the existing records, which are converted when they're next stored.
+type RecordCodec interface {
+	Name() string // Prefix of the stored records; empty for JSON, which is detected by itself
+	Marshal(user *gomagiclink.AuthUserRecord) ([]byte, error)
+	Unmarshal(data []byte, user *gomagiclink.AuthUserRecord) error
+}
+
+// The provided codecs. JSON is the default; MessagePack and Protocol Buffers records are
+// smaller and faster to unmarshal, but can't be queried by the database, so user
+// listings with filters are done by scanning the records.
+var (
+	JSONRecordCodec     RecordCodec = jsonRecordCodec{}
+	MsgpackRecordCodec  RecordCodec = msgpackRecordCodec{}
+	ProtobufRecordCodec RecordCodec = protobufRecordCodec{}
+)
+
+var recordCodecs = []RecordCodec{MsgpackRecordCodec, ProtobufRecordCodec}
+
+type jsonRecordCodec struct{}
+
+func (jsonRecordCodec) Name() string {
+	return ""
+}
+
+func (jsonRecordCodec) Marshal(user *gomagiclink.AuthUserRecord) ([]byte, error) {
+	return json.Marshal(user)
+}
+
+func (jsonRecordCodec) Unmarshal(data []byte, user *gomagiclink.AuthUserRecord) error {
+	return json.Unmarshal(data, user)
+}
+
+type msgpackRecordCodec struct{}
+
+func (msgpackRecordCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackRecordCodec) Marshal(user *gomagiclink.AuthUserRecord) ([]byte, error) {
+	return msgpack.Marshal(user)
+}
+
+func (msgpackRecordCodec) Unmarshal(data []byte, user *gomagiclink.AuthUserRecord) error {
+	return msgpack.Unmarshal(data, user)
+}
+
+// recordCodec converts user records to and from the form in which they're stored,
+// optionally encrypting them.
+type recordCodec struct {
+	format    RecordCodec // nil for JSON
+	encryptor *gomagiclink.RecordEncryptor
+	text      bool // Binary records are base64-encoded, for storages which only hold text
+}
+
+func (rc *recordCodec) marshal(user *gomagiclink.AuthUserRecord) (data []byte, err error) {
+	if rc.format == nil || rc.format.Name() == "" {
+		data, err = json.Marshal(user)
+	} else {
+		data, err = rc.format.Marshal(user)
+		if rc.text && rc.encryptor == nil {
+			// Encrypted records are JSON, with the encrypted data already base64-encoded
+			data = append([]byte(rc.format.Name()+":"), base64.RawStdEncoding.EncodeToString(data)...)
+		} else {
+			data = append([]byte(rc.format.Name()+"\x00"), data...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rc.encryptor != nil {
+		return rc.encryptor.Encrypt(data)
+	}
+	return data, nil
+}
+
+func (rc *recordCodec) unmarshal(data []byte) (user *gomagiclink.AuthUserRecord, err error) {
+	if rc.encryptor != nil {
+		data, err = rc.encryptor.Decrypt(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	user = &gomagiclink.AuthUserRecord{}
+	if err = rc.decode(data, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// decode detects the format of the record and unmarshals it.
+func (rc *recordCodec) decode(data []byte, user *gomagiclink.AuthUserRecord) error {
+	if len(data) > 0 && data[0] == '{' {
+		return json.Unmarshal(data, user)
+	}
+	i := bytes.IndexAny(data, ":\x00")
+	if i < 0 {
+		return ErrUnknownRecordFormat
+	}
+	name, encoded := data[:i], data[i+1:]
+	codecs := recordCodecs
+	if rc.format != nil {
+		codecs = append([]RecordCodec{rc.format}, codecs...)
+	}
+	for _, codec := range codecs {
+		if codec.Name() != string(name) {
+			continue
+		}
+		if data[i] == 0 {
+			return codec.Unmarshal(encoded, user)
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			return err
+		}
+		return codec.Unmarshal(raw, user)
+	}
+	return ErrUnknownRecordFormat
+}
+
+// queryable returns true if the stored records are plain JSON, which can be queried
+// by the database.
+func (rc *recordCodec) queryable() bool {
+	return rc.encryptor == nil && (rc.format == nil || rc.format.Name() == "")
+}
+
+// needsReencryption returns true if the stored record should be rewritten to be
+// encrypted with the current key.
+func (rc *recordCodec) needsReencryption(data []byte) bool {
+	return rc.encryptor != nil && rc.encryptor.NeedsReencryption(data)
+}
+
+// isBinaryRecord returns true if the stored record isn't JSON (plain or encrypted), and
+// can only be stored in a binary column.
+func isBinaryRecord(data []byte) bool {
+	return len(data) > 0 && data[0] != '{'
+}
+
+// isTextBinaryRecord returns true if the stored record is a binary record in the
+// base64-encoded form, which the SQL storages don't use anymore.
+func isTextBinaryRecord(data []byte) bool {
+	i := bytes.IndexAny(data, ":\x00")
+	return isBinaryRecord(data) && i >= 0 && data[i] == ':'
+}
@@ -1,30 +1,50 @@
 package storage
 
 import (
-	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/ivoras/gomagiclink"
 )
 
-// Stores data in a flat directory with files named like $<userid>$<email>.json
+// Stores data in a flat directory with files named like _<userid>_<email>.json
 type FileSystemStorage struct {
 	Directory      string
 	ID2Filename    map[uuid.UUID]string
 	Email2Filename map[string]string
+
+	errs  errorTracker
+	codec recordCodec
+
+	lock           sync.RWMutex // Protects the indexes above and lastScan
+	rescanInterval time.Duration
+	lastScan       time.Time
 }
 
-// Files are named like $USER_ID$EMAIL.json
-var reUserEmailFilename = regexp.MustCompilePOSIX("_(.+?)_(.+)\\.json")
+// Files are named like _USER_ID_EMAIL.json. The user ID is a UUID, and is matched
+// explicitly because e-mail addresses can contain underscores.
+var reUserEmailFilename = regexp.MustCompile(`^_([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})_(.+)\.json$`)
 
 func NewFileSystemStorage(dir string) (result *FileSystemStorage, err error) {
 	if dir[len(dir)-1] == '/' {
 		dir = dir[0 : len(dir)-1]
 	}
+	result = &FileSystemStorage{}
+	if err = result.open(dir); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// open creates the directory if it doesn't exist, and reads the existing files. Called
+// with the lock held, except by NewFileSystemStorage().
+func (fss *FileSystemStorage) open(dir string) (err error) {
 	_, err = os.Stat(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -37,84 +57,349 @@ func NewFileSystemStorage(dir string) (result *FileSystemStorage, err error) {
 			return
 		}
 	}
-	result = &FileSystemStorage{
-		Directory:      dir,
-		ID2Filename:    map[uuid.UUID]string{},
-		Email2Filename: map[string]string{},
-	}
+	id2Filename := map[uuid.UUID]string{}
+	email2Filename := map[string]string{}
 	// Read existing files
 	files, err := filepath.Glob(fmt.Sprintf("%s/_*.json", dir))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	for f := range files {
-		m := reUserEmailFilename.FindStringSubmatch(files[f])
+		m := reUserEmailFilename.FindStringSubmatch(filepath.Base(files[f]))
 		if m == nil {
-			return nil, fmt.Errorf("cannot parse filename: %s", files[f])
+			return fmt.Errorf("cannot parse filename: %s", files[f])
 		}
 		id, err := uuid.Parse(m[1])
 		if err != nil {
-			return nil, err
+			return err
 		}
-		result.ID2Filename[id] = files[f]
-		result.Email2Filename[m[2]] = files[f]
+		id2Filename[id] = files[f]
+		email2Filename[gomagiclink.NormalizeEmail(m[2])] = files[f]
 	}
+	fss.Directory = dir
+	fss.ID2Filename = id2Filename
+	fss.Email2Filename = email2Filename
+	fss.lastScan = time.Now()
+	return nil
+}
 
-	return
+// Rebuild rescans the directory and replaces the in-memory indexes of the user records,
+// e.g. after files were copied into the directory or removed from it by something other
+// than this FileSystemStorage.
+func (fss *FileSystemStorage) Rebuild() (err error) {
+	defer fss.errs.track(&err)
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	return fss.open(fss.Directory)
+}
+
+// SetRescanOnMiss makes the lookups which don't find a user in the in-memory indexes,
+// or find a file which no longer exists, rescan the directory (see Rebuild()) and try
+// again, so users whose files were added or removed externally are found without a
+// restart. To keep lookups of nonexistent users cheap, the directory is rescanned at
+// most once per the interval. Zero, the default, disables rescanning.
+func (fss *FileSystemStorage) SetRescanOnMiss(interval time.Duration) {
+	fss.lock.Lock()
+	fss.rescanInterval = interval
+	fss.lock.Unlock()
+}
+
+// rescan rebuilds the indexes if SetRescanOnMiss() enabled it and the interval has
+// passed since the last scan. It returns true if the indexes were rebuilt (possibly by
+// a concurrent lookup).
+func (fss *FileSystemStorage) rescan() bool {
+	fss.lock.RLock()
+	due := fss.rescanInterval > 0 && time.Since(fss.lastScan) >= fss.rescanInterval
+	fss.lock.RUnlock()
+	if !due {
+		return false
+	}
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	// Another lookup may have rescanned in the meantime
+	if time.Since(fss.lastScan) < fss.rescanInterval {
+		return true
+	}
+	err := fss.open(fss.Directory)
+	fss.errs.track(&err)
+	return err == nil
+}
+
+// lookup calls the lookup in the indexes with the read lock held.
+func (fss *FileSystemStorage) lookup(lookup func() (string, bool)) (string, bool) {
+	fss.lock.RLock()
+	defer fss.lock.RUnlock()
+	return lookup()
+}
+
+// findFile returns the file name found by the lookup in the indexes, rescanning the
+// directory on a miss if enabled.
+func (fss *FileSystemStorage) findFile(lookup func() (string, bool)) (string, bool) {
+	fileName, ok := fss.lookup(lookup)
+	if !ok && fss.rescan() {
+		fileName, ok = fss.lookup(lookup)
+	}
+	return fileName, ok
+}
+
+// getUser reads the user record from the file found by the lookup. If the file was
+// removed externally, the directory is rescanned if enabled, in case it was renamed.
+func (fss *FileSystemStorage) getUser(lookup func() (string, bool)) (*gomagiclink.AuthUserRecord, error) {
+	fileName, ok := fss.findFile(lookup)
+	if !ok {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	user, err := fss.getUserFromFileName(fileName)
+	if os.IsNotExist(err) {
+		if !fss.rescan() {
+			return nil, gomagiclink.ErrUserNotFound
+		}
+		if fileName, ok = fss.lookup(lookup); !ok {
+			return nil, gomagiclink.ErrUserNotFound
+		}
+		return fss.getUserFromFileName(fileName)
+	}
+	return user, err
 }
 
+// SetNamespace moves the storage into the namespace's subdirectory of the directory,
+// creating it if needed, so several apps can share the directory (see
+// gomagiclink.WithNamespace(), which calls it). The users in the directory itself
+// aren't visible in the namespace.
+func (fss *FileSystemStorage) SetNamespace(namespace string) error {
+	if err := gomagiclink.ValidateNamespace(namespace); err != nil {
+		return err
+	}
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	return fss.open(filepath.Join(fss.Directory, namespace))
+}
+
+// StoreUser creates the user record if it doesn't exist, or updates it. It returns
+// ErrUserAlreadyExists if the user's e-mail address belongs to another user.
 func (fss *FileSystemStorage) StoreUser(user *gomagiclink.AuthUserRecord) (err error) {
+	err = fss.UpdateUser(user)
+	if err == gomagiclink.ErrUserNotFound {
+		return fss.CreateUser(user)
+	}
+	return
+}
+
+// CreateUser stores a new user record. It returns ErrUserAlreadyExists if a user
+// with the same ID or e-mail address exists.
+func (fss *FileSystemStorage) CreateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	lookup := func() (string, bool) {
+		if fileName, ok := fss.ID2Filename[user.GetID()]; ok {
+			return fileName, ok
+		}
+		fileName, ok := fss.Email2Filename[gomagiclink.NormalizeEmail(user.Email)]
+		return fileName, ok
+	}
+	if _, ok := fss.findFile(lookup); ok {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	// Checked again, as the user may have been created in the meantime
+	if _, ok := lookup(); ok {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	return fss.writeUser(user)
+}
+
+// UpdateUser updates an existing user record. It returns ErrUserNotFound if the
+// user doesn't exist, and ErrUserAlreadyExists if the user's (changed) e-mail address
+// belongs to another user.
+func (fss *FileSystemStorage) UpdateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer fss.errs.track(&err)
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	oldFileName, ok := fss.ID2Filename[user.ID]
+	if fileName, exists := fss.Email2Filename[gomagiclink.NormalizeEmail(user.Email)]; exists && fileName != oldFileName {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	if !ok {
+		return gomagiclink.ErrUserNotFound
+	}
+	for email, fileName := range fss.Email2Filename {
+		if fileName == oldFileName {
+			delete(fss.Email2Filename, email)
+		}
+	}
+	err = fss.writeUser(user)
+	if err != nil {
+		return
+	}
+	// The e-mail address is a part of the file name, so it changes with the address
+	if fss.ID2Filename[user.ID] != oldFileName {
+		err = os.Remove(oldFileName)
+	}
+	return
+}
+
+// writeUser writes the user record and indexes it. Called with the lock held.
+func (fss *FileSystemStorage) writeUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer fss.errs.track(&err)
+	user.Touch()
 	fileName := fmt.Sprintf("%s/%s.json", fss.Directory, user.GetKeyName())
-	f, err := os.Create(fileName)
+	data, err := fss.codec.marshal(user)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	err = json.NewEncoder(f).Encode(user)
-	fss.Email2Filename[user.Email] = fileName
+	if !isBinaryRecord(data) {
+		// Binary records are read back as they are
+		data = append(data, '\n')
+	}
+	err = os.WriteFile(fileName, data, 0644)
+	if err != nil {
+		return err
+	}
+	fss.Email2Filename[gomagiclink.NormalizeEmail(user.Email)] = fileName
 	fss.ID2Filename[user.ID] = fileName
 	return
 }
 
 func (fss *FileSystemStorage) getUserFromFileName(fileName string) (user *gomagiclink.AuthUserRecord, err error) {
-	f, err := os.Open(fmt.Sprintf("%s/%s", fss.Directory, fileName))
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	user = &gomagiclink.AuthUserRecord{}
-	err = json.NewDecoder(f).Decode(user)
+	defer fss.errs.track(&err)
+	data, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+	return fss.codec.unmarshal(data)
 }
 
 func (fss *FileSystemStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
-	fileName, ok := fss.ID2Filename[id]
-	if !ok {
-		return nil, gomagiclink.ErrUserNotFound
-	}
-	return fss.getUserFromFileName(fileName)
+	return fss.getUser(func() (string, bool) {
+		fileName, ok := fss.ID2Filename[id]
+		return fileName, ok
+	})
 }
 
 func (fss *FileSystemStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
-	fileName, ok := fss.Email2Filename[gomagiclink.NormalizeEmail(email)]
+	email = gomagiclink.NormalizeEmail(email)
+	return fss.getUser(func() (string, bool) {
+		fileName, ok := fss.Email2Filename[email]
+		return fileName, ok
+	})
+}
+
+func (fss *FileSystemStorage) DeleteUser(id uuid.UUID) (err error) {
+	defer fss.errs.track(&err)
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	fileName, ok := fss.ID2Filename[id]
 	if !ok {
-		return nil, gomagiclink.ErrUserNotFound
+		return gomagiclink.ErrUserNotFound
 	}
-	return fss.getUserFromFileName(fileName)
+	err = os.Remove(fileName)
+	if err != nil {
+		return
+	}
+	delete(fss.ID2Filename, id)
+	for email, fn := range fss.Email2Filename {
+		if fn == fileName {
+			delete(fss.Email2Filename, email)
+		}
+	}
+	return
 }
 
 func (fss *FileSystemStorage) UserExistsByEmail(email string) (exists bool) {
-	_, exists = fss.Email2Filename[gomagiclink.NormalizeEmail(email)]
+	email = gomagiclink.NormalizeEmail(email)
+	_, exists = fss.findFile(func() (string, bool) {
+		fileName, ok := fss.Email2Filename[email]
+		return fileName, ok
+	})
 	return
 }
 
 func (fss *FileSystemStorage) GetUserCount() (int, error) {
+	fss.lock.RLock()
+	defer fss.lock.RUnlock()
 	return len(fss.Email2Filename), nil
 }
 
 func (fss *FileSystemStorage) UsersExist() (bool, error) {
+	fss.lock.RLock()
+	defer fss.lock.RUnlock()
 	return len(fss.Email2Filename) > 0, nil
 }
+
+// GetStats returns the user count and the most recent storage error.
+func (fss *FileSystemStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	stats.UserCount, _ = fss.GetUserCount()
+	fss.errs.fill(&stats)
+	return
+}
+
+// SetRecordEncryptor enables encryption of the stored user records. Records which were
+// stored unencrypted can still be read, and are encrypted when they're next stored, or
+// by ReencryptRecords(). Note that the e-mail address is also a part of the file name.
+func (fss *FileSystemStorage) SetRecordEncryptor(encryptor *gomagiclink.RecordEncryptor) {
+	fss.codec.encryptor = encryptor
+}
+
+// SetRecordCodec sets the serialization of the stored user records (JSONRecordCodec by
+// default). Records in the other provided formats can still be read.
+func (fss *FileSystemStorage) SetRecordCodec(codec RecordCodec) {
+	fss.codec.format = codec
+}
+
+// ReencryptRecords rewrites all the user records which aren't encrypted with the
+// current key of the RecordEncryptor, e.g. after a key rotation. It returns the
+// number of rewritten records.
+func (fss *FileSystemStorage) ReencryptRecords() (n int, err error) {
+	defer fss.errs.track(&err)
+	if fss.codec.encryptor == nil {
+		return 0, gomagiclink.ErrNoRecordEncryptor
+	}
+	for _, fileName := range fss.fileNames() {
+		rewritten, err := fss.reencryptFile(fileName)
+		if err != nil {
+			return n, err
+		}
+		if rewritten {
+			n++
+		}
+	}
+	return
+}
+
+// reencryptFile rewrites the user record in the file if it isn't encrypted with the
+// current key, holding the lock so it isn't changed concurrently.
+func (fss *FileSystemStorage) reencryptFile(fileName string) (rewritten bool, err error) {
+	fss.lock.Lock()
+	defer fss.lock.Unlock()
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		// Renamed or deleted in the meantime
+		return false, nil
+	}
+	if err != nil || !fss.codec.needsReencryption(data) {
+		return false, err
+	}
+	user, err := fss.codec.unmarshal(data)
+	if err != nil {
+		return false, err
+	}
+	if data, err = fss.codec.marshal(user); err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+// fileNames returns the names of all the users' files.
+func (fss *FileSystemStorage) fileNames() []string {
+	fss.lock.RLock()
+	defer fss.lock.RUnlock()
+	fileNames := make([]string, 0, len(fss.ID2Filename))
+	for _, fileName := range fss.ID2Filename {
+		fileNames = append(fileNames, fileName)
+	}
+	return fileNames
+}
+
+// SetLogger sets the logger to which storage errors are logged. By default they're not logged.
+func (fss *FileSystemStorage) SetLogger(logger *slog.Logger) {
+	fss.errs.logger = logger
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// sqlNamespace restricts the queries of the SQL storages to the records of a namespace
+// (see gomagiclink.WithNamespace()), which are marked in the `namespace` column. Without
+// a namespace, the queries are unchanged, so the column is only needed with one.
+type sqlNamespace struct {
+	name  string
+	pgsql bool
+}
+
+func (ns sqlNamespace) placeholder(n int) string {
+	if ns.pgsql {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// where adds the namespace condition to the query, which must end with its WHERE
+// clause, if it has one. The namespace is added to the arguments.
+func (ns sqlNamespace) where(q string, args ...any) (string, []any) {
+	if ns.name == "" {
+		return q, args
+	}
+	cond := "namespace=" + ns.placeholder(len(args)+1)
+	if i := strings.Index(q, " WHERE "); i >= 0 {
+		q = q[:i] + " WHERE (" + q[i+len(" WHERE "):] + ") AND " + cond
+	} else {
+		q += " WHERE " + cond
+	}
+	return q, append(args, ns.name)
+}
+
+func setSQLNamespace(ns *sqlNamespace, namespace string) error {
+	if err := gomagiclink.ValidateNamespace(namespace); err != nil {
+		return err
+	}
+	ns.name = namespace
+	return nil
+}
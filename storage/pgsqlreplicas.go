@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// ReplicaOptions configures the read replica routing of PgSQLStorage.
+type ReplicaOptions struct {
+	// Replicas are the read replica handles, used in turn.
+	Replicas []*sql.DB
+	// Resolver, if set, picks the handle for each read instead of Replicas, e.g. to skip
+	// lagging replicas. If it returns nil, the primary is used.
+	Resolver func() *sql.DB
+	// StaleReadWindow is how long after a user is written through this storage its
+	// reads go to the primary, so freshly created or changed users are read back despite
+	// the replication lag. Default 5s; negative disables it.
+	StaleReadWindow time.Duration
+	// PrimaryOnMiss retries reads which don't find the user on a replica on the primary,
+	// for users written by other app instances, at the cost of an extra query for
+	// users which don't exist.
+	PrimaryOnMiss bool
+}
+
+// replicaRouter picks the database handles for reads, and remembers the recently
+// written users.
+type replicaRouter struct {
+	opts   ReplicaOptions
+	next   atomic.Uint32
+	lock   sync.Mutex
+	recent map[string]time.Time // User IDs and e-mail addresses, with the time until which they're read from the primary
+}
+
+// SetReadReplicas routes the reads (GetUserById(), GetUserByEmail(), UserExistsByEmail(),
+// GetUserCount(), UsersExist() and ListUsers()) to read replicas, while writes and
+// transactions go to the primary passed to NewPgSQLStorage(). Call it before using the
+// storage.
+func (st *PgSQLStorage) SetReadReplicas(opts ReplicaOptions) {
+	if opts.StaleReadWindow == 0 {
+		opts.StaleReadWindow = 5 * time.Second
+	}
+	if len(opts.Replicas) == 0 && opts.Resolver == nil {
+		st.replicas = nil
+		return
+	}
+	st.replicas = &replicaRouter{opts: opts, recent: map[string]time.Time{}}
+}
+
+// PrimaryReader returns a UserReader which reads the users from the primary, even with
+// read replicas, see gomagiclink.ReplicatedStorage.
+func (st *PgSQLStorage) PrimaryReader() gomagiclink.UserReader {
+	return pgsqlPrimaryReader{st}
+}
+
+// pgsqlPrimaryReader reads the users of PgSQLStorage from the primary.
+type pgsqlPrimaryReader struct {
+	st *PgSQLStorage
+}
+
+func (pr pgsqlPrimaryReader) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	defer pr.st.errs.track(&err)
+	return pr.st.getUser(pr.st.db, "id", id.String())
+}
+
+func (pr pgsqlPrimaryReader) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
+	defer pr.st.errs.track(&err)
+	return pr.st.getUser(pr.st.db, "email", gomagiclink.NormalizeEmail(email))
+}
+
+func (pr pgsqlPrimaryReader) UserExistsByEmail(email string) bool {
+	_, err := pr.GetUserByEmail(email)
+	return err == nil
+}
+
+// readDB returns the handle for reading the user with the given keys (the ID and/or
+// e-mail address), and whether it's a replica.
+func (st *PgSQLStorage) readDB(keys ...string) (db *sql.DB, replica bool) {
+	rr := st.replicas
+	if rr == nil || rr.isRecent(keys) {
+		return st.db, false
+	}
+	if rr.opts.Resolver != nil {
+		db = rr.opts.Resolver()
+	} else {
+		db = rr.opts.Replicas[int(rr.next.Add(1))%len(rr.opts.Replicas)]
+	}
+	if db == nil {
+		return st.db, false
+	}
+	return db, db != st.db
+}
+
+// wrote records that the user was written, so it's read from the primary for a while.
+func (st *PgSQLStorage) wrote(keys ...string) {
+	if rr := st.replicas; rr != nil && rr.opts.StaleReadWindow > 0 {
+		rr.add(keys, time.Now().Add(rr.opts.StaleReadWindow))
+	}
+}
+
+// retryOnPrimary returns true if a read from a replica which returned err should be
+// retried on the primary.
+func (st *PgSQLStorage) retryOnPrimary(replica bool, err error) bool {
+	return replica && err == gomagiclink.ErrUserNotFound && st.replicas.opts.PrimaryOnMiss
+}
+
+func (rr *replicaRouter) add(keys []string, until time.Time) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	if len(rr.recent) >= 1000 {
+		now := time.Now()
+		for key, t := range rr.recent {
+			if t.Before(now) {
+				delete(rr.recent, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		rr.recent[key] = until
+	}
+}
+
+func (rr *replicaRouter) isRecent(keys []string) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if t, ok := rr.recent[key]; ok && now.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func replicaIDKey(id uuid.UUID) string {
+	return "id:" + id.String()
+}
+
+func replicaEmailKey(email string) string {
+	return "email:" + gomagiclink.NormalizeEmail(email)
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// ShardedPgSQLStorage spreads the users across several PostgreSQL tables (shards),
+// each with the same layout as the table used by PgSQLStorage. The shard of a user
+// is chosen by hashing the user ID (FNV-1a modulo the number of shards), so lookups
+// by ID go to a single table, while lookups by e-mail address query all the shards.
+// It's transparent to callers, and implements the same interfaces as PgSQLStorage.
+//
+// The tables can be in different schemas (e.g. "shard0.users"), or even different
+// databases. E-mail uniqueness across the shards is checked before inserting, but
+// can't be guaranteed by indexes, as they're per-table.
+type ShardedPgSQLStorage struct {
+	shards []*PgSQLStorage
+}
+
+var ErrNoShards = errors.New("no shards configured")
+
+// NewShardedPgSQLStorage creates a ShardedPgSQLStorage with one shard per table name.
+// The order of the table names matters, as it determines the shard index.
+func NewShardedPgSQLStorage(db *sql.DB, tableNames []string) (st *ShardedPgSQLStorage, err error) {
+	dbs := make([]*sql.DB, len(tableNames))
+	for i := range dbs {
+		dbs[i] = db
+	}
+	return NewShardedPgSQLStorageMultiDB(dbs, tableNames)
+}
+
+// NewShardedPgSQLStorageMultiDB is like NewShardedPgSQLStorage(), but each shard
+// table can be in its own database.
+func NewShardedPgSQLStorageMultiDB(dbs []*sql.DB, tableNames []string) (st *ShardedPgSQLStorage, err error) {
+	if len(tableNames) == 0 || len(dbs) != len(tableNames) {
+		return nil, ErrNoShards
+	}
+	st = &ShardedPgSQLStorage{}
+	for i := range tableNames {
+		shard, err := NewPgSQLStorage(dbs[i], tableNames[i])
+		if err != nil {
+			return nil, err
+		}
+		st.shards = append(st.shards, shard)
+	}
+	return st, nil
+}
+
+// ShardTableNames returns the names of the shard tables: prefix_0, prefix_1, etc.
+func ShardTableNames(prefix string, n int) (names []string) {
+	for i := 0; i < n; i++ {
+		names = append(names, fmt.Sprintf("%s_%d", prefix, i))
+	}
+	return
+}
+
+func shardIndex(id uuid.UUID, n int) int {
+	h := fnv.New32a()
+	h.Write(id[:])
+	return int(h.Sum32() % uint32(n))
+}
+
+func (st *ShardedPgSQLStorage) shardFor(id uuid.UUID) *PgSQLStorage {
+	return st.shards[shardIndex(id, len(st.shards))]
+}
+
+// StoreUser creates the user record if it doesn't exist, or updates it. It returns
+// ErrUserAlreadyExists if the user's e-mail address belongs to another user.
+func (st *ShardedPgSQLStorage) StoreUser(user *gomagiclink.AuthUserRecord) (err error) {
+	err = st.UpdateUser(user)
+	if err == gomagiclink.ErrUserNotFound {
+		return st.CreateUser(user)
+	}
+	return
+}
+
+// CreateUser stores a new user record. It returns ErrUserAlreadyExists if a user
+// with the same ID or e-mail address exists.
+func (st *ShardedPgSQLStorage) CreateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	shard := st.shardFor(user.GetID())
+	if err = st.checkEmailElsewhere(shard, user.Email); err != nil {
+		return
+	}
+	return shard.CreateUser(user)
+}
+
+// UpdateUser updates an existing user record. It returns ErrUserNotFound if the
+// user doesn't exist, and ErrUserAlreadyExists if the user's (changed) e-mail address
+// belongs to another user.
+func (st *ShardedPgSQLStorage) UpdateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	shard := st.shardFor(user.ID)
+	if err = st.checkEmailElsewhere(shard, user.Email); err != nil {
+		return
+	}
+	return shard.UpdateUser(user)
+}
+
+// checkEmailElsewhere returns ErrUserAlreadyExists if the e-mail address belongs to a
+// user in a shard other than the given one. Errors from the other shards are returned,
+// so a failing shard can't let a duplicate through.
+func (st *ShardedPgSQLStorage) checkEmailElsewhere(shard *PgSQLStorage, email string) error {
+	for _, other := range st.shards {
+		if other == shard {
+			continue
+		}
+		exists, err := other.emailExists(email)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return gomagiclink.ErrUserAlreadyExists
+		}
+	}
+	return nil
+}
+
+// emailExists checks if a user with the e-mail address exists in the table, on the
+// primary database.
+func (st *PgSQLStorage) emailExists(email string) (exists bool, err error) {
+	defer st.errs.track(&err)
+	var count int
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=$1", st.tableName), gomagiclink.NormalizeEmail(email))
+	err = st.db.QueryRow(q, args...).Scan(&count)
+	return count > 0, err
+}
+
+func (st *ShardedPgSQLStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	return st.shardFor(id).GetUserById(id)
+}
+
+func (st *ShardedPgSQLStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
+	for _, shard := range st.shards {
+		user, err = shard.GetUserByEmail(email)
+		if err != gomagiclink.ErrUserNotFound {
+			return
+		}
+	}
+	return nil, gomagiclink.ErrUserNotFound
+}
+
+func (st *ShardedPgSQLStorage) DeleteUser(id uuid.UUID) (err error) {
+	return st.shardFor(id).DeleteUser(id)
+}
+
+func (st *ShardedPgSQLStorage) UserExistsByEmail(email string) (exists bool) {
+	for _, shard := range st.shards {
+		if shard.UserExistsByEmail(email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *ShardedPgSQLStorage) GetUserCount() (n int, err error) {
+	for _, shard := range st.shards {
+		count, err := shard.GetUserCount()
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return
+}
+
+func (st *ShardedPgSQLStorage) UsersExist() (exist bool, err error) {
+	for _, shard := range st.shards {
+		exist, err = shard.UsersExist()
+		if err != nil || exist {
+			return
+		}
+	}
+	return false, nil
+}
+
+// GetStats returns the statistics summed over all the shards. The connection pool
+// statistics are those of the first shard's database.
+func (st *ShardedPgSQLStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	for i, shard := range st.shards {
+		shardStats := shard.GetStats()
+		stats.UserCount += shardStats.UserCount
+		if shardStats.LastErrorTime.After(stats.LastErrorTime) {
+			stats.LastError = shardStats.LastError
+			stats.LastErrorTime = shardStats.LastErrorTime
+		}
+		if i == 0 {
+			stats.DB = shardStats.DB
+		}
+	}
+	return
+}
+
+// SetRecordEncryptor enables encryption of the stored user records in all the shards.
+func (st *ShardedPgSQLStorage) SetRecordEncryptor(encryptor *gomagiclink.RecordEncryptor) {
+	for _, shard := range st.shards {
+		shard.SetRecordEncryptor(encryptor)
+	}
+}
+
+// SetRecordCodec sets the serialization of the stored user records in all the shards.
+func (st *ShardedPgSQLStorage) SetRecordCodec(codec RecordCodec) {
+	for _, shard := range st.shards {
+		shard.SetRecordCodec(codec)
+	}
+}
+
+// ReencryptRecords re-encrypts the user records in all the shards.
+func (st *ShardedPgSQLStorage) ReencryptRecords() (n int, err error) {
+	for _, shard := range st.shards {
+		count, err := shard.ReencryptRecords()
+		n += count
+		if err != nil {
+			return n, err
+		}
+	}
+	return
+}
+
+// MigrateRecordColumns adds the column for the records of binary codecs to the tables
+// of all the shards (see PgSQLStorage.MigrateRecordColumns()).
+func (st *ShardedPgSQLStorage) MigrateRecordColumns() (n int, err error) {
+	for _, shard := range st.shards {
+		count, err := shard.MigrateRecordColumns()
+		n += count
+		if err != nil {
+			return n, err
+		}
+	}
+	return
+}
+
+// SetNamespace restricts all the shards to the records in the namespace (see
+// PgSQLStorage.SetNamespace()).
+func (st *ShardedPgSQLStorage) SetNamespace(namespace string) error {
+	for _, shard := range st.shards {
+		if err := shard.SetNamespace(namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLogger sets the logger to which storage errors are logged in all the shards.
+func (st *ShardedPgSQLStorage) SetLogger(logger *slog.Logger) {
+	for _, shard := range st.shards {
+		shard.SetLogger(logger)
+	}
+}
+
+// Reshard moves the user records into the shard layout of the target storage, e.g.
+// one with more shards. Records are copied as they're stored (without decrypting them).
+// A record is deleted from its old table only if that table is also one of the target's
+// tables; otherwise the old tables are left intact, so they can be dropped after the
+// application is switched to the new layout. It returns the number of moved records.
+// The application should not write to the storage while resharding.
+func (st *ShardedPgSQLStorage) Reshard(target *ShardedPgSQLStorage) (n int, err error) {
+	targetTables := []string{}
+	for _, shard := range target.shards {
+		targetTables = append(targetTables, shard.tableName)
+	}
+	for _, shard := range st.shards {
+		moved, err := shard.reshardTo(target, slices.Contains(targetTables, shard.tableName))
+		n += moved
+		if err != nil {
+			return n, err
+		}
+	}
+	return
+}
+
+// reshardPageSize is the number of records read at a time by Reshard().
+const reshardPageSize = 100
+
+// reshardTo copies the records from the table to their shards in the target, deleting
+// them from this table if deleteMoved is set. The records are read a page at a time,
+// ordered by their IDs.
+func (st *PgSQLStorage) reshardTo(target *ShardedPgSQLStorage, deleteMoved bool) (n int, err error) {
+	defer st.errs.track(&err)
+	after := ""
+	for {
+		records, err := st.reshardPage(after)
+		if err != nil {
+			return n, err
+		}
+		if len(records) == 0 {
+			return n, nil
+		}
+		for _, r := range records {
+			moved, err := st.reshardRecord(target, r, deleteMoved)
+			if err != nil {
+				return n, err
+			}
+			if moved {
+				n++
+			}
+		}
+		after = records[len(records)-1].id
+	}
+}
+
+// rawRecord is a user record as stored, copied by Reshard().
+type rawRecord struct {
+	id, email string
+	record    sqlRecord
+}
+
+// reshardPage reads the page of records with IDs after the given one.
+func (st *PgSQLStorage) reshardPage(after string) (records []rawRecord, err error) {
+	q, args := st.ns.where(fmt.Sprintf("SELECT id, email, %s FROM %s WHERE id>$1", st.records.columns(), st.tableName), after)
+	rows, err := st.db.Query(q+fmt.Sprintf(" ORDER BY id LIMIT %d", reshardPageSize), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r rawRecord
+		if err = rows.Scan(append([]any{&r.id, &r.email}, st.records.dest(&r.record)...)...); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// reshardRecord copies the record to its shard in the target, if it's not already there.
+func (st *PgSQLStorage) reshardRecord(target *ShardedPgSQLStorage, r rawRecord, deleteMoved bool) (moved bool, err error) {
+	id, err := uuid.Parse(r.id)
+	if err != nil {
+		return
+	}
+	dest := target.shardFor(id)
+	if dest.db == st.db && dest.tableName == st.tableName {
+		return false, nil
+	}
+	var count int
+	q, args := dest.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id=$1", dest.tableName), r.id)
+	if err = dest.db.QueryRow(q, args...).Scan(&count); err != nil {
+		return
+	}
+	if count == 0 {
+		if q, args, err = dest.records.insert(dest.ns, dest.tableName, r.id, r.email, r.record.bytes()); err != nil {
+			return
+		}
+		if _, err = dest.db.Exec(q, args...); err != nil {
+			return
+		}
+	}
+	if deleteMoved {
+		q, args := st.ns.where(fmt.Sprintf("DELETE FROM %s WHERE id=$1", st.tableName), r.id)
+		if _, err = st.db.Exec(q, args...); err != nil {
+			return
+		}
+	}
+	return true, nil
+}
@@ -2,8 +2,8 @@ package storage
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	"log/slog"
 
 	"github.com/google/uuid"
 	"github.com/ivoras/gomagiclink"
@@ -12,6 +12,11 @@ import (
 type PgSQLStorage struct {
 	db        *sql.DB
 	tableName string
+	errs      errorTracker
+	codec     recordCodec
+	replicas  *replicaRouter
+	ns        sqlNamespace
+	records   sqlRecords
 }
 
 // NewPgSQLStorage creates a PgSQLStorage instance, with PostgreSQL-flavoured SQL.
@@ -22,48 +27,143 @@ type PgSQLStorage struct {
 //	email	text
 //	data	A type that can accept a long JSON string, either as text, or as a dedicated type (PostgreSQL has a native JSONB field)
 //
+// With a binary RecordCodec (see SetRecordCodec()), the table also needs a `data_bin`
+// BYTEA field, which MigrateRecordColumns() adds.
+//
 // This table needs to be maintained entirely by the caller, including indexes.
 // A unique index on the `id` field, and another unique index on the `email` field are highly recommended.
+// With a namespace (see SetNamespace()), the table also needs a `namespace` text field, and
+// the unique index should be on (`namespace`, `email`) instead.
+// CreateUser() checks for existing users in a transaction, but with PostgreSQL's default isolation
+// level, only the unique indexes reliably prevent duplicates created by concurrent logins.
 func NewPgSQLStorage(db *sql.DB, tableName string) (st *PgSQLStorage, err error) {
+	if err = gomagiclink.ValidateSQLIdentifier(tableName); err != nil {
+		return nil, err
+	}
 	return &PgSQLStorage{
 		db:        db,
 		tableName: tableName,
+		ns:        sqlNamespace{pgsql: true},
 	}, nil
 }
 
+// StoreUser creates the user record if it doesn't exist, or updates it. It returns
+// ErrUserAlreadyExists if the user's e-mail address belongs to another user.
 func (st *PgSQLStorage) StoreUser(user *gomagiclink.AuthUserRecord) (err error) {
-	userJson, err := json.Marshal(user)
+	err = st.UpdateUser(user)
+	if err == gomagiclink.ErrUserNotFound {
+		return st.CreateUser(user)
+	}
+	return
+}
+
+// CreateUser stores a new user record. It returns ErrUserAlreadyExists if a user
+// with the same ID or e-mail address exists.
+func (st *PgSQLStorage) CreateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	userJson, err := st.codec.marshal(user)
 	if err != nil {
 		return
 	}
-	// It's a race condition, but UPSERT isn't standardised across common databases
-	if !st.UserExistsByEmail(user.Email) {
-		_, err = st.db.Exec(fmt.Sprintf("INSERT INTO %s (id, email, data) VALUES ($1, $2, $3)", st.tableName), user.ID.String(), user.Email, string(userJson))
-	} else {
-		_, err = st.db.Exec(fmt.Sprintf("UPDATE %s SET data=$1 WHERE id=$2", st.tableName), string(userJson), user.ID.String())
+	tx, err := st.db.Begin()
+	if err != nil {
+		return
 	}
+	defer tx.Rollback()
 
-	return
+	var count int
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id=$1 OR email=$2", st.tableName), user.ID.String(), user.Email)
+	err = tx.QueryRow(q, args...).Scan(&count)
+	if err != nil {
+		return
+	}
+	if count > 0 {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	q, args, err = st.records.insert(st.ns, st.tableName, user.ID.String(), user.Email, userJson)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(q, args...)
+	if err != nil {
+		return
+	}
+	st.wrote(replicaIDKey(user.ID), replicaEmailKey(user.Email))
+	return tx.Commit()
 }
 
-func (st *PgSQLStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
-	var userJson string
-	err = st.db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE id=$1", st.tableName), id.String()).Scan(&userJson)
+// UpdateUser updates an existing user record. It returns ErrUserNotFound if the
+// user doesn't exist, and ErrUserAlreadyExists if the user's (changed) e-mail address
+// belongs to another user.
+func (st *PgSQLStorage) UpdateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	userJson, err := st.codec.marshal(user)
+	if err != nil {
+		return
+	}
+	tx, err := st.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=$1 AND id<>$2", st.tableName), user.Email, user.ID.String())
+	err = tx.QueryRow(q, args...).Scan(&count)
+	if err != nil {
+		return
+	}
+	if count > 0 {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	values, err := st.records.values(userJson)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, gomagiclink.ErrUserNotFound
-		}
 		return
 	}
+	q, args = st.ns.where(fmt.Sprintf("UPDATE %s SET email=$1, %s WHERE id=$%d", st.tableName, st.records.set(st.ns, 2), len(values)+2), append(append([]any{user.Email}, values...), user.ID.String())...)
+	res, err := tx.Exec(q, args...)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return gomagiclink.ErrUserNotFound
+	}
+	st.wrote(replicaIDKey(user.ID), replicaEmailKey(user.Email))
+	return tx.Commit()
+}
 
-	user = &gomagiclink.AuthUserRecord{}
-	err = json.Unmarshal([]byte(userJson), user)
+func (st *PgSQLStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	defer st.errs.track(&err)
+	db, replica := st.readDB(replicaIDKey(id))
+	user, err = st.getUser(db, "id", id.String())
+	if st.retryOnPrimary(replica, err) {
+		user, err = st.getUser(st.db, "id", id.String())
+	}
 	return
 }
 
 func (st *PgSQLStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
-	var userJson string
-	err = st.db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE email=$1", st.tableName), gomagiclink.NormalizeEmail(email)).Scan(&userJson)
+	defer st.errs.track(&err)
+	email = gomagiclink.NormalizeEmail(email)
+	db, replica := st.readDB(replicaEmailKey(email))
+	user, err = st.getUser(db, "email", email)
+	if st.retryOnPrimary(replica, err) {
+		user, err = st.getUser(st.db, "email", email)
+	}
+	return
+}
+
+// getUser reads the user record with the column (id or email) equal to the value.
+func (st *PgSQLStorage) getUser(db *sql.DB, column string, value string) (user *gomagiclink.AuthUserRecord, err error) {
+	var r sqlRecord
+	q, args := st.ns.where(fmt.Sprintf("SELECT %s FROM %s WHERE %s=$1", st.records.columns(), st.tableName, column), value)
+	err = db.QueryRow(q, args...).Scan(st.records.dest(&r)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, gomagiclink.ErrUserNotFound
@@ -71,26 +171,111 @@ func (st *PgSQLStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUser
 		return
 	}
 
-	user = &gomagiclink.AuthUserRecord{}
-	err = json.Unmarshal([]byte(userJson), user)
+	return st.codec.unmarshal(r.bytes())
+}
+
+func (st *PgSQLStorage) DeleteUser(id uuid.UUID) (err error) {
+	defer st.errs.track(&err)
+	q, args := st.ns.where(fmt.Sprintf("DELETE FROM %s WHERE id=$1", st.tableName), id.String())
+	_, err = st.db.Exec(q, args...)
+	st.wrote(replicaIDKey(id))
 	return
 }
 
 func (st *PgSQLStorage) UserExistsByEmail(email string) (exists bool) {
+	email = gomagiclink.NormalizeEmail(email)
+	db, replica := st.readDB(replicaEmailKey(email))
 	var count int
-	err := st.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=$1", st.tableName), gomagiclink.NormalizeEmail(email)).Scan(&count)
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=$1", st.tableName), email)
+	err := db.QueryRow(q, args...).Scan(&count)
+	if err == nil && count == 0 && st.retryOnPrimary(replica, gomagiclink.ErrUserNotFound) {
+		err = st.db.QueryRow(q, args...).Scan(&count)
+	}
 	if err != nil {
+		st.errs.track(&err)
 		return false
 	}
 	return count > 0
 }
 
 func (st *PgSQLStorage) GetUserCount() (n int, err error) {
-	err = st.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", st.tableName)).Scan(&n)
+	defer st.errs.track(&err)
+	db, _ := st.readDB()
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s", st.tableName))
+	err = db.QueryRow(q, args...).Scan(&n)
 	return
 }
 
 func (st *PgSQLStorage) UsersExist() (exist bool, err error) {
-	err = st.db.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT * FROM %s)", st.tableName)).Scan(&exist)
+	defer st.errs.track(&err)
+	db, _ := st.readDB()
+	q, args := st.ns.where(fmt.Sprintf("SELECT * FROM %s", st.tableName))
+	err = db.QueryRow("SELECT EXISTS ("+q+")", args...).Scan(&exist)
+	return
+}
+
+func (st *PgSQLStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	stats.UserCount, _ = st.GetUserCount()
+	dbStats := st.db.Stats()
+	stats.DB = &dbStats
+	st.errs.fill(&stats)
 	return
 }
+
+// SetRecordEncryptor enables encryption of the stored user records. Records which were
+// stored unencrypted can still be read, and are encrypted when they're next stored, or
+// by ReencryptRecords(). Note that the e-mail address is also stored in plain text in
+// its own column, for lookups.
+func (st *PgSQLStorage) SetRecordEncryptor(encryptor *gomagiclink.RecordEncryptor) {
+	st.codec.encryptor = encryptor
+}
+
+// SetRecordCodec sets the serialization of the stored user records (JSONRecordCodec by
+// default). Records in the other provided formats can still be read. The records of
+// binary codecs are stored in the `data_bin` column, which must exist; see
+// MigrateRecordColumns().
+func (st *PgSQLStorage) SetRecordCodec(codec RecordCodec) {
+	st.codec.format = codec
+	if codec != nil && codec.Name() != "" {
+		st.records.binary = true
+	}
+}
+
+// MigrateRecordColumns adds the `data_bin` BYTEA column for the records of binary codecs,
+// if the table doesn't have it, and moves the binary records which older versions stored
+// base64-encoded in the `data` column to it, or converts them to JSON with the JSON
+// codec. It returns the number of moved records. Call it before the first use of a
+// binary codec, and to read such records after switching back to JSON.
+func (st *PgSQLStorage) MigrateRecordColumns() (n int, err error) {
+	defer st.errs.track(&err)
+	if err = addBinaryColumn(st.db, st.tableName, true); err != nil {
+		return
+	}
+	st.records.binary = true
+	sr := &sqlRewriter{db: st.db, ns: st.ns, records: st.records, tableName: st.tableName, codec: &st.codec, needsRewrite: isTextBinaryRecord, write: func(fn func() error) error { return fn() }, logger: st.errs.logger}
+	return sr.run()
+}
+
+// ReencryptRecords rewrites all the user records which aren't encrypted with the
+// current key of the RecordEncryptor, e.g. after a key rotation. It returns the
+// number of rewritten records. The records are read a page at a time, and those changed
+// concurrently aren't overwritten, but read again.
+func (st *PgSQLStorage) ReencryptRecords() (n int, err error) {
+	defer st.errs.track(&err)
+	if st.codec.encryptor == nil {
+		return 0, gomagiclink.ErrNoRecordEncryptor
+	}
+	sr := &sqlRewriter{db: st.db, ns: st.ns, records: st.records, tableName: st.tableName, codec: &st.codec, needsRewrite: st.codec.needsReencryption, write: func(fn func() error) error { return fn() }, logger: st.errs.logger}
+	return sr.run()
+}
+
+// SetNamespace restricts the storage to the records with the namespace in the `namespace`
+// column, so several apps can share the table (see gomagiclink.WithNamespace(), which calls it).
+func (st *PgSQLStorage) SetNamespace(namespace string) error {
+	return setSQLNamespace(&st.ns, namespace)
+}
+
+// SetLogger sets the logger to which storage errors are logged. By default they're not logged.
+func (st *PgSQLStorage) SetLogger(logger *slog.Logger) {
+	st.errs.logger = logger
+}
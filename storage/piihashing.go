@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// PIIEmailCustomDataKey is the CustomData key under which PIIHashingStorage keeps the
+// plaintext e-mail address in the stored records.
+const PIIEmailCustomDataKey = "gomagiclink:email"
+
+// PIIHashingStorage wraps a UserAuthDatabase, so it stores only the HMAC of the users'
+// e-mail addresses where it indexes them (e.g. the SQL storages' email column, or the
+// file names of FileSystemStorage), and a leaked database dump or directory listing
+// doesn't expose a list of the users' addresses. The plaintext address is kept in the
+// record body, under PIIEmailCustomDataKey in CustomData, and restored when the record
+// is read, so the wrapper is transparent to the controller. It protects the addresses
+// only if the inner storage encrypts the record bodies, so set a RecordEncryptor on it
+// with SetRecordEncryptor().
+//
+// The HMAC key can't be changed without rehashing all the records, so it should be a
+// dedicated secret, not the controller's secret key. Records stored before the wrapper
+// was added aren't found by their e-mail address until they're stored again through it.
+// The storage can't filter the users by the e-mail domain, so such user listings read
+// all the records.
+type PIIHashingStorage struct {
+	inner gomagiclink.UserAuthDatabase
+	key   []byte
+}
+
+// NewPIIHashingStorage wraps the inner storage, hashing the e-mail addresses with the key.
+func NewPIIHashingStorage(inner gomagiclink.UserAuthDatabase, key []byte) (*PIIHashingStorage, error) {
+	if err := gomagiclink.CheckSecretKey(key, gomagiclink.RecommendedSecretKeyPolicy); err != nil {
+		return nil, err
+	}
+	return &PIIHashingStorage{inner: inner, key: key}, nil
+}
+
+// HashEmail returns the HMAC of the normalized e-mail address, as stored in the inner
+// storage instead of the address.
+func (st *PIIHashingStorage) HashEmail(email string) string {
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write([]byte(gomagiclink.NormalizeEmail(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashed returns a copy of the record to store, with the hashed e-mail address.
+func (st *PIIHashingStorage) hashed(user *gomagiclink.AuthUserRecord) *gomagiclink.AuthUserRecord {
+	rec := *user
+	rec.CustomData = maps.Clone(user.CustomData)
+	if rec.CustomData == nil {
+		rec.CustomData = map[string]string{}
+	}
+	rec.CustomData[PIIEmailCustomDataKey] = user.Email
+	rec.Email = st.HashEmail(user.Email)
+	return &rec
+}
+
+// restored returns the record read from the inner storage, with the plaintext e-mail address.
+func (st *PIIHashingStorage) restored(user *gomagiclink.AuthUserRecord) *gomagiclink.AuthUserRecord {
+	if email, ok := user.CustomData[PIIEmailCustomDataKey]; ok {
+		user.Email = email
+		delete(user.CustomData, PIIEmailCustomDataKey)
+		if len(user.CustomData) == 0 {
+			user.CustomData = nil
+		}
+	}
+	return user
+}
+
+// write stores the hashed copy of the record, and updates the original with the
+// timestamps set by the inner storage.
+func (st *PIIHashingStorage) write(user *gomagiclink.AuthUserRecord, op func(*gomagiclink.AuthUserRecord) error) error {
+	rec := st.hashed(user)
+	err := op(rec)
+	user.CreatedAt = rec.CreatedAt
+	user.UpdatedAt = rec.UpdatedAt
+	return err
+}
+
+func (st *PIIHashingStorage) StoreUser(user *gomagiclink.AuthUserRecord) error {
+	return st.write(user, st.inner.StoreUser)
+}
+
+// CreateUser creates the user with the inner storage, see gomagiclink.CreateStoredUser().
+func (st *PIIHashingStorage) CreateUser(user *gomagiclink.AuthUserRecord) error {
+	return st.write(user, func(rec *gomagiclink.AuthUserRecord) error {
+		return gomagiclink.CreateStoredUser(st.inner, rec)
+	})
+}
+
+// UpdateUser updates the user with the inner storage, see gomagiclink.UpdateStoredUser().
+func (st *PIIHashingStorage) UpdateUser(user *gomagiclink.AuthUserRecord) error {
+	return st.write(user, func(rec *gomagiclink.AuthUserRecord) error {
+		return gomagiclink.UpdateStoredUser(st.inner, rec)
+	})
+}
+
+func (st *PIIHashingStorage) GetUserById(id uuid.UUID) (*gomagiclink.AuthUserRecord, error) {
+	user, err := st.inner.GetUserById(id)
+	if err != nil {
+		return nil, err
+	}
+	return st.restored(user), nil
+}
+
+func (st *PIIHashingStorage) GetUserByEmail(email string) (*gomagiclink.AuthUserRecord, error) {
+	user, err := st.inner.GetUserByEmail(st.HashEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	return st.restored(user), nil
+}
+
+// DeleteUser deletes the user with the inner storage, if it's a gomagiclink.UserDeleter.
+func (st *PIIHashingStorage) DeleteUser(id uuid.UUID) error {
+	return gomagiclink.DeleteStoredUser(st.inner, id)
+}
+
+func (st *PIIHashingStorage) UserExistsByEmail(email string) bool {
+	return st.inner.UserExistsByEmail(st.HashEmail(email))
+}
+
+func (st *PIIHashingStorage) GetUserCount() (int, error) {
+	return st.inner.GetUserCount()
+}
+
+func (st *PIIHashingStorage) UsersExist() (bool, error) {
+	return st.inner.UsersExist()
+}
+
+// ListUsers lists the users with the inner storage, if it's a gomagiclink.UserLister.
+// Filters by the e-mail domain are applied in memory, to all the users.
+func (st *PIIHashingStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	lister, ok := st.inner.(gomagiclink.UserLister)
+	if !ok {
+		return page, gomagiclink.ErrUserListingNotSupported
+	}
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	if filter.EmailDomain == "" {
+		if page, err = lister.ListUsers(filter); err != nil {
+			return
+		}
+		for _, user := range page.Users {
+			st.restored(user)
+		}
+		return page, nil
+	}
+	all := filter
+	all.EmailDomain, all.Offset, all.Limit = "", 0, 0
+	if page, err = lister.ListUsers(all); err != nil {
+		return
+	}
+	for _, user := range page.Users {
+		st.restored(user)
+	}
+	return gomagiclink.FilterUsers(page.Users, filter), nil
+}
+
+// GetStats returns the inner storage's statistics, if it provides them.
+func (st *PIIHashingStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	if ss, ok := st.inner.(gomagiclink.StorageStats); ok {
+		stats = ss.GetStats()
+	}
+	return
+}
+
+// SetNamespace passes the namespace to the inner storage, if it's a
+// gomagiclink.NamespacedStorage.
+func (st *PIIHashingStorage) SetNamespace(namespace string) error {
+	ns, ok := st.inner.(gomagiclink.NamespacedStorage)
+	if !ok {
+		return gomagiclink.ErrNamespaceNotSupported
+	}
+	return ns.SetNamespace(namespace)
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+var errBrokenProtobuf = errors.New("broken protobuf record")
+
+// Protocol buffers wire types
+const (
+	pbVarint = 0
+	pbI64    = 1
+	pbBytes  = 2
+	pbI32    = 5
+)
+
+// The user records are encoded as this message, so they can be read by other tools:
+//
+//	message AuthUserRecord {
+//	  bytes id = 1;
+//	  bool enabled = 2;
+//	  string email = 3;
+//	  int64 access_level = 4;
+//	  google.protobuf.Timestamp first_login_time = 5;
+//	  google.protobuf.Timestamp recent_login_time = 6;
+//	  google.protobuf.Timestamp email_verified_at = 7;
+//	  google.protobuf.Timestamp created_at = 8;
+//	  google.protobuf.Timestamp updated_at = 9;
+//	  map<string, string> custom_data = 10;
+//	  repeated OrgMembership memberships = 11;
+//	  google.protobuf.Timestamp locked_at = 12;
+//	  google.protobuf.Timestamp locked_until = 13;
+//	  string lock_reason = 14;
+//	  bytes totp_secret = 15;
+//	  google.protobuf.Timestamp totp_enabled_at = 16;
+//	  int64 totp_last_step = 17;
+//	  string anti_phishing_phrase = 18;
+//	  int64 token_epoch = 19;
+//	  bytes totp_pending_secret = 20;
+//	  int64 totp_failures = 21;
+//	}
+//
+//	message OrgMembership {
+//	  bytes org_id = 1;
+//	  string role = 2;
+//	  google.protobuf.Timestamp joined_at = 3;
+//	}
+//
+// Zero times are omitted.
+type protobufRecordCodec struct{}
+
+func (protobufRecordCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufRecordCodec) Marshal(user *gomagiclink.AuthUserRecord) ([]byte, error) {
+	var b pbBuffer
+	b.bytes(1, user.ID[:])
+	if user.Enabled {
+		b.varint(2, 1)
+	}
+	b.string(3, user.Email)
+	b.varint(4, uint64(user.AccessLevel))
+	b.time(5, user.FirstLoginTime)
+	b.time(6, user.RecentLoginTime)
+	b.time(7, user.EmailVerifiedAt)
+	b.time(8, user.CreatedAt)
+	b.time(9, user.UpdatedAt)
+	for k, v := range user.CustomData {
+		var entry pbBuffer
+		entry.string(1, k)
+		entry.string(2, v)
+		b.bytes(10, entry.buf)
+	}
+	for _, m := range user.Memberships {
+		var msg pbBuffer
+		msg.bytes(1, m.OrgID[:])
+		msg.string(2, m.Role)
+		msg.time(3, m.JoinedAt)
+		b.bytes(11, msg.buf)
+	}
+	b.time(12, user.LockedAt)
+	b.time(13, user.LockedUntil)
+	b.string(14, user.LockReason)
+	b.bytes(15, user.TOTPSecret)
+	b.time(16, user.TOTPEnabledAt)
+	b.varint(17, uint64(user.TOTPLastStep))
+	b.string(18, user.AntiPhishingPhrase)
+	b.varint(19, uint64(user.TokenEpoch))
+	b.bytes(20, user.TOTPPendingSecret)
+	b.varint(21, uint64(user.TOTPFailures))
+	return b.buf, nil
+}
+
+func (protobufRecordCodec) Unmarshal(data []byte, user *gomagiclink.AuthUserRecord) error {
+	return pbFields(data, func(num int, v uint64, b []byte) (err error) {
+		switch num {
+		case 1:
+			user.ID, err = uuid.FromBytes(b)
+		case 2:
+			user.Enabled = v != 0
+		case 3:
+			user.Email = string(b)
+		case 4:
+			user.AccessLevel = int(int64(v))
+		case 5:
+			user.FirstLoginTime, err = pbTime(b)
+		case 6:
+			user.RecentLoginTime, err = pbTime(b)
+		case 7:
+			user.EmailVerifiedAt, err = pbTime(b)
+		case 8:
+			user.CreatedAt, err = pbTime(b)
+		case 9:
+			user.UpdatedAt, err = pbTime(b)
+		case 10:
+			var key, value string
+			err = pbFields(b, func(num int, _ uint64, b []byte) error {
+				if num == 1 {
+					key = string(b)
+				} else if num == 2 {
+					value = string(b)
+				}
+				return nil
+			})
+			if user.CustomData == nil {
+				user.CustomData = map[string]string{}
+			}
+			user.CustomData[key] = value
+		case 11:
+			var m gomagiclink.OrgMembership
+			err = pbFields(b, func(num int, _ uint64, b []byte) (err error) {
+				switch num {
+				case 1:
+					m.OrgID, err = uuid.FromBytes(b)
+				case 2:
+					m.Role = string(b)
+				case 3:
+					m.JoinedAt, err = pbTime(b)
+				}
+				return
+			})
+			user.Memberships = append(user.Memberships, m)
+		case 12:
+			user.LockedAt, err = pbTime(b)
+		case 13:
+			user.LockedUntil, err = pbTime(b)
+		case 14:
+			user.LockReason = string(b)
+		case 15:
+			user.TOTPSecret = append([]byte{}, b...)
+		case 16:
+			user.TOTPEnabledAt, err = pbTime(b)
+		case 17:
+			user.TOTPLastStep = int64(v)
+		case 18:
+			user.AntiPhishingPhrase = string(b)
+		case 19:
+			user.TokenEpoch = int(int64(v))
+		case 20:
+			user.TOTPPendingSecret = append([]byte{}, b...)
+		case 21:
+			user.TOTPFailures = int(int64(v))
+		}
+		return
+	})
+}
+
+// pbBuffer builds a protobuf message. Fields with zero values are omitted, as in proto3.
+type pbBuffer struct {
+	buf []byte
+}
+
+func (b *pbBuffer) tag(num int, wireType int) {
+	b.buf = binary.AppendUvarint(b.buf, uint64(num)<<3|uint64(wireType))
+}
+
+func (b *pbBuffer) varint(num int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(num, pbVarint)
+	b.buf = binary.AppendUvarint(b.buf, v)
+}
+
+func (b *pbBuffer) bytes(num int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	b.tag(num, pbBytes)
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(v)))
+	b.buf = append(b.buf, v...)
+}
+
+func (b *pbBuffer) string(num int, v string) {
+	b.bytes(num, []byte(v))
+}
+
+// time writes a google.protobuf.Timestamp message.
+func (b *pbBuffer) time(num int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var ts pbBuffer
+	ts.varint(1, uint64(t.Unix()))
+	ts.varint(2, uint64(t.Nanosecond()))
+	b.tag(num, pbBytes)
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(ts.buf)))
+	b.buf = append(b.buf, ts.buf...)
+}
+
+// pbFields calls fn for each field of the message, with the value of varint fields
+// or the contents of length-delimited ones. Fixed-size fields are skipped.
+func pbFields(data []byte, fn func(num int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errBrokenProtobuf
+		}
+		data = data[n:]
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case pbVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errBrokenProtobuf
+			}
+			data = data[n:]
+		case pbBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errBrokenProtobuf
+			}
+			b, data = data[n:n+int(length)], data[n+int(length):]
+		case pbI64, pbI32:
+			size := 8
+			if key&7 == pbI32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errBrokenProtobuf
+			}
+			data = data[size:]
+			continue
+		default:
+			return errBrokenProtobuf
+		}
+		if err := fn(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbTime decodes a google.protobuf.Timestamp message.
+func pbTime(data []byte) (t time.Time, err error) {
+	var seconds, nanos uint64
+	err = pbFields(data, func(num int, v uint64, _ []byte) error {
+		if num == 1 {
+			seconds = v
+		} else if num == 2 {
+			nanos = v
+		}
+		return nil
+	})
+	return time.Unix(int64(seconds), int64(nanos)).UTC(), err
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrUnexpectedRedisReply = errors.New("unexpected reply from Redis")
+
+// RedisClient runs Lua scripts on a Redis server (or cluster). It's the only operation the
+// Redis stores need, so any client library can be used without this package depending on
+// it. With github.com/redis/go-redis:
+//
+//	type goRedis struct{ *redis.Client }
+//
+//	func (c goRedis) Eval(ctx context.Context, script string, keys []string, args ...any) (any, error) {
+//		return c.Client.Eval(ctx, script, keys, args...).Result()
+//	}
+//
+// The scripts only return integers and strings, and arrays of them.
+type RedisClient interface {
+	Eval(ctx context.Context, script string, keys []string, args ...any) (any, error)
+}
+
+// redisTokenBucketScript takes a token from the bucket in the hash KEYS[1], refilled at
+// ARGV[1] tokens per second up to ARGV[2] tokens. It uses the server's clock, so the
+// instances' clocks don't need to agree, and expires the bucket when it would be full.
+// It returns {1, "0"} if a token was taken, or {0, seconds until the next token}.
+const redisTokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1])
+local last = tonumber(b[2])
+if tokens == nil or last == nil then
+	tokens = burst
+	last = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+if tokens < 1 then
+	return {0, tostring((1 - tokens) / rate)}
+end
+tokens = tokens - 1
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {1, '0'}
+`
+
+// RedisRateLimitStore is an adapters.RateLimitStore keeping the token buckets in Redis,
+// so the limits are enforced across all the app instances. Each bucket is a hash, updated
+// atomically by a Lua script, and expires when it would be full again.
+type RedisRateLimitStore struct {
+	client  RedisClient
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedisRateLimitStore creates a RedisRateLimitStore. The bucket keys are prefixed with
+// prefix (e.g. "myapp:"), and each Redis call times out after timeout (default one second).
+func NewRedisRateLimitStore(client RedisClient, prefix string, timeout time.Duration) *RedisRateLimitStore {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &RedisRateLimitStore{client: client, prefix: prefix, timeout: timeout}
+}
+
+func (s *RedisRateLimitStore) Take(key string, rate float64, burst int) (ok bool, retryAfter time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	reply, err := s.client.Eval(ctx, redisTokenBucketScript, []string{s.prefix + key},
+		strconv.FormatFloat(rate, 'g', -1, 64), strconv.Itoa(burst))
+	if err != nil {
+		return
+	}
+	values, isArray := reply.([]any)
+	if !isArray || len(values) != 2 {
+		return false, 0, ErrUnexpectedRedisReply
+	}
+	taken, err := redisInt(values[0])
+	if err != nil {
+		return
+	}
+	wait, err := redisString(values[1])
+	if err != nil {
+		return
+	}
+	seconds, err := strconv.ParseFloat(wait, 64)
+	if err != nil {
+		return false, 0, ErrUnexpectedRedisReply
+	}
+	return taken == 1, time.Duration(seconds * float64(time.Second)), nil
+}
+
+// redisMarkUsedScript sets KEYS[1] if it doesn't exist, expiring in ARGV[1] milliseconds,
+// and returns 1 if it was set. (SET returns nil if the key exists, which some clients
+// report as an error.)
+const redisMarkUsedScript = `
+if redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[1]) then
+	return 1
+end
+return 0
+`
+
+// RedisUsedTokenStore is a gomagiclink.UsedTokenStore keeping the used tokens in Redis,
+// so a magic link can be used only once across all the app instances (see
+// gomagiclink.WithSingleUseChallenges()). Each used token is a key set with SET NX, which
+// acts as a lock that's never released, and expires when the token would have expired.
+type RedisUsedTokenStore struct {
+	client  RedisClient
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedisUsedTokenStore creates a RedisUsedTokenStore. The keys are prefixed with prefix
+// (e.g. "myapp:used:"), and each Redis call times out after timeout (default one second).
+func NewRedisUsedTokenStore(client RedisClient, prefix string, timeout time.Duration) *RedisUsedTokenStore {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &RedisUsedTokenStore{client: client, prefix: prefix, timeout: timeout}
+}
+
+func (s *RedisUsedTokenStore) MarkUsed(id string, until time.Time) (first bool, err error) {
+	ttl := time.Until(until).Milliseconds()
+	if ttl < 1000 {
+		ttl = 1000
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	reply, err := s.client.Eval(ctx, redisMarkUsedScript, []string{s.prefix + id}, strconv.FormatInt(ttl, 10))
+	if err != nil {
+		return
+	}
+	set, err := redisInt(reply)
+	return set == 1, err
+}
+
+func redisInt(v any) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("%w: %T instead of an integer", ErrUnexpectedRedisReply, v)
+}
+
+func redisString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("%w: %T instead of a string", ErrUnexpectedRedisReply, v)
+}
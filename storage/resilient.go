@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// ResiliencePolicy configures the ResilientStorage. Zero values are replaced by defaults.
+type ResiliencePolicy struct {
+	MaxAttempts      int                  // Attempts per operation, default 3
+	Backoff          time.Duration        // Delay before the first retry, doubled for each following one, default 50ms
+	FailureThreshold int                  // Consecutive failed operations which open the circuit, default 5
+	OpenDuration     time.Duration        // How long the circuit stays open before a trial operation, default 10s
+	IsTransient      func(err error) bool // Which errors are retried and counted as failures; default is all but the expected results
+}
+
+// ResilientStorage wraps a UserAuthDatabase, retrying operations which fail with
+// transient errors (e.g. during a database failover), and stopping calls to it
+// altogether (a circuit breaker) after too many consecutive failures. When the storage
+// is unavailable, operations return gomagiclink.ErrStorageUnavailable, so HTTP handlers
+// can respond with 503 instead of 500. The last underlying error is reported by GetStats().
+//
+// Note that a retried CreateUser() may return ErrUserAlreadyExists if the first attempt
+// succeeded, but its response was lost.
+type ResilientStorage struct {
+	inner  gomagiclink.UserAuthDatabase
+	policy ResiliencePolicy
+	errs   errorTracker
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // A trial operation is running in the half-open state
+}
+
+// NewResilientStorage wraps the inner storage.
+func NewResilientStorage(inner gomagiclink.UserAuthDatabase, policy ResiliencePolicy) *ResilientStorage {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = 50 * time.Millisecond
+	}
+	if policy.FailureThreshold <= 0 {
+		policy.FailureThreshold = 5
+	}
+	if policy.OpenDuration <= 0 {
+		policy.OpenDuration = 10 * time.Second
+	}
+	if policy.IsTransient == nil {
+		policy.IsTransient = isTransientStorageError
+	}
+	return &ResilientStorage{inner: inner, policy: policy}
+}
+
+func isTransientStorageError(err error) bool {
+	switch err {
+	case gomagiclink.ErrUserNotFound, gomagiclink.ErrUserAlreadyExists, ErrConcurrentModification,
+		gomagiclink.ErrBrokenEncryptedRecord, gomagiclink.ErrUnknownEncryptionKey, gomagiclink.ErrInvalidEncryptionKey,
+		gomagiclink.ErrInvalidUserFilter, gomagiclink.ErrUserListingNotSupported, gomagiclink.ErrUserDeletionNotSupported:
+		return false
+	}
+	return true
+}
+
+// allow returns false if the circuit is open. After OpenDuration, a single trial
+// operation is allowed through (the half-open state).
+func (st *ResilientStorage) allow() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(st.openUntil) || st.trial {
+		return false
+	}
+	st.trial = true
+	return true
+}
+
+func (st *ResilientStorage) record(failed bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.trial = false
+	if !failed {
+		st.failures = 0
+		st.openUntil = time.Time{}
+		return
+	}
+	st.failures++
+	if st.failures >= st.policy.FailureThreshold || !st.openUntil.IsZero() {
+		st.openUntil = time.Now().Add(st.policy.OpenDuration)
+	}
+}
+
+// do runs the operation with retries, returning ErrStorageUnavailable if the circuit
+// is open or all the attempts failed with transient errors.
+func (st *ResilientStorage) do(op func() error) error {
+	if !st.allow() {
+		return gomagiclink.ErrStorageUnavailable
+	}
+	backoff := st.policy.Backoff
+	var err error
+	for attempt := 1; attempt <= st.policy.MaxAttempts; attempt++ {
+		err = op()
+		if err == nil || !st.policy.IsTransient(err) {
+			st.record(false)
+			return err
+		}
+		st.errs.track(&err)
+		if attempt < st.policy.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	st.record(true)
+	return gomagiclink.ErrStorageUnavailable
+}
+
+// IsOpen returns true if the circuit breaker is open, i.e. the storage is considered unavailable.
+func (st *ResilientStorage) IsOpen() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return !st.openUntil.IsZero()
+}
+
+func (st *ResilientStorage) StoreUser(user *gomagiclink.AuthUserRecord) error {
+	return st.do(func() error { return st.inner.StoreUser(user) })
+}
+
+// CreateUser creates the user with the inner storage, see gomagiclink.CreateStoredUser().
+func (st *ResilientStorage) CreateUser(user *gomagiclink.AuthUserRecord) error {
+	return st.do(func() error { return gomagiclink.CreateStoredUser(st.inner, user) })
+}
+
+// UpdateUser updates the user with the inner storage, see gomagiclink.UpdateStoredUser().
+func (st *ResilientStorage) UpdateUser(user *gomagiclink.AuthUserRecord) error {
+	return st.do(func() error { return gomagiclink.UpdateStoredUser(st.inner, user) })
+}
+
+func (st *ResilientStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	err = st.do(func() (err error) {
+		user, err = st.inner.GetUserById(id)
+		return
+	})
+	return
+}
+
+func (st *ResilientStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
+	err = st.do(func() (err error) {
+		user, err = st.inner.GetUserByEmail(email)
+		return
+	})
+	return
+}
+
+// DeleteUser deletes the user with the inner storage, if it's a gomagiclink.UserDeleter.
+func (st *ResilientStorage) DeleteUser(id uuid.UUID) error {
+	return st.do(func() error { return gomagiclink.DeleteStoredUser(st.inner, id) })
+}
+
+// UserExistsByEmail can't report errors, so it isn't retried, and returns false
+// while the circuit is open.
+func (st *ResilientStorage) UserExistsByEmail(email string) bool {
+	if st.IsOpen() {
+		return false
+	}
+	return st.inner.UserExistsByEmail(email)
+}
+
+func (st *ResilientStorage) GetUserCount() (n int, err error) {
+	err = st.do(func() (err error) {
+		n, err = st.inner.GetUserCount()
+		return
+	})
+	return
+}
+
+func (st *ResilientStorage) UsersExist() (exist bool, err error) {
+	err = st.do(func() (err error) {
+		exist, err = st.inner.UsersExist()
+		return
+	})
+	return
+}
+
+// GetStats returns the inner storage's statistics, if it provides them, with the most
+// recent error seen by the ResilientStorage if it's newer.
+func (st *ResilientStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	if ss, ok := st.inner.(gomagiclink.StorageStats); ok {
+		stats = ss.GetStats()
+	}
+	var own gomagiclink.StorageStatistics
+	st.errs.fill(&own)
+	if own.LastErrorTime.After(stats.LastErrorTime) {
+		stats.LastError = own.LastError
+		stats.LastErrorTime = own.LastErrorTime
+	}
+	return
+}
+
+// SetNamespace passes the namespace to the inner storage, if it's a
+// gomagiclink.NamespacedStorage.
+func (st *ResilientStorage) SetNamespace(namespace string) error {
+	ns, ok := st.inner.(gomagiclink.NamespacedStorage)
+	if !ok {
+		return gomagiclink.ErrNamespaceNotSupported
+	}
+	return ns.SetNamespace(namespace)
+}
+
+// SetLogger sets the logger to which the retried errors are logged. By default they're not logged.
+func (st *ResilientStorage) SetLogger(logger *slog.Logger) {
+	st.errs.logger = logger
+}
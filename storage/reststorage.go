@@ -0,0 +1,483 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrInvalidRESTOptions = errors.New("invalid REST storage options")
+
+var errRESTNotFound = errors.New("key not found")
+
+// RESTOptions configures a RESTStorage. The paths are appended to BaseURL, with
+// "{key}", "{prefix}" and "{cursor}" replaced by the escaped values.
+type RESTOptions struct {
+	BaseURL string // E.g. "https://kv.example.com/v1/magiclink"
+	// ValuePath is where the values are read (GET), written (PUT) and deleted (DELETE),
+	// default "/values/{key}". Reads of missing keys must return 404 Not Found.
+	ValuePath string
+	// ExistsPath, if set, is requested with HEAD to check if a key exists (any 2xx status
+	// means it does, 404 that it doesn't). By default the value is read.
+	ExistsPath string
+	// ListPath returns the keys with a prefix, default "/keys?prefix={prefix}&cursor={cursor}".
+	// The response is a JSON object, either {"keys": ["key", ...], "cursor": "..."} or in
+	// the Cloudflare API format, {"result": [{"name": "key"}, ...], "result_info": {"cursor": "..."}}.
+	// Listing is done until the cursor is empty.
+	ListPath string
+	Header   http.Header  // Added to all requests, e.g. Authorization
+	Client   *http.Client // Default a client with a 30s timeout
+}
+
+// RESTStorage stores the users in a key-value store with a HTTP API, such as Cloudflare
+// Workers KV, or a custom internal service, so they can be used without writing a Go
+// adapter. Each user is stored under two keys:
+//
+//	"user:" + ID: the user record
+//	"email:" + e-mail address: the user's ID
+//
+// With a namespace (see SetNamespace()), the keys are prefixed with it and a colon.
+// Key-value stores usually have neither transactions nor conditional writes, so
+// concurrent changes of the same user (or creation of users with the same e-mail
+// address) can overwrite each other, and a failure in the middle of a change can leave
+// an orphaned e-mail key behind, which is ignored by lookups. For the same reason, the
+// user count is obtained by listing the keys, which is slow.
+type RESTStorage struct {
+	opts   RESTOptions
+	errs   errorTracker
+	codec  recordCodec
+	prefix string // The namespace and a colon, see SetNamespace()
+}
+
+// NewRESTStorage creates a RESTStorage with the options.
+func NewRESTStorage(opts RESTOptions) (st *RESTStorage, err error) {
+	opts.BaseURL = strings.TrimRight(opts.BaseURL, "/")
+	if u, err := url.Parse(opts.BaseURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, ErrInvalidRESTOptions
+	}
+	if opts.ValuePath == "" {
+		opts.ValuePath = "/values/{key}"
+	}
+	if opts.ListPath == "" {
+		opts.ListPath = "/keys?prefix={prefix}&cursor={cursor}"
+	}
+	if !strings.Contains(opts.ValuePath, "{key}") || (opts.ExistsPath != "" && !strings.Contains(opts.ExistsPath, "{key}")) ||
+		!strings.Contains(opts.ListPath, "{prefix}") {
+		return nil, ErrInvalidRESTOptions
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &RESTStorage{opts: opts}, nil
+}
+
+// NewCloudflareKVStorage creates a RESTStorage for a Cloudflare Workers KV namespace,
+// using the Cloudflare API with an API token which can edit it.
+func NewCloudflareKVStorage(accountID string, namespaceID string, apiToken string) (st *RESTStorage, err error) {
+	return NewRESTStorage(RESTOptions{
+		BaseURL: fmt.Sprintf("https://api.cloudflare.com/client/v4/accounts/%s/storage/kv/namespaces/%s", url.PathEscape(accountID), url.PathEscape(namespaceID)),
+		Header:  http.Header{"Authorization": {"Bearer " + apiToken}},
+	})
+}
+
+func (st *RESTStorage) userKey(id uuid.UUID) string {
+	return st.prefix + "user:" + id.String()
+}
+
+func (st *RESTStorage) emailKey(email string) string {
+	return st.prefix + "email:" + email
+}
+
+// StoreUser creates the user record if it doesn't exist, or updates it. It returns
+// ErrUserAlreadyExists if the user's e-mail address belongs to another user.
+func (st *RESTStorage) StoreUser(user *gomagiclink.AuthUserRecord) (err error) {
+	err = st.UpdateUser(user)
+	if err == gomagiclink.ErrUserNotFound {
+		return st.CreateUser(user)
+	}
+	return
+}
+
+// CreateUser stores a new user record. It returns ErrUserAlreadyExists if a user
+// with the same ID or e-mail address exists.
+func (st *RESTStorage) CreateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	data, err := st.codec.marshal(user)
+	if err != nil {
+		return
+	}
+	exists, err := st.exists(st.userKey(user.GetID()))
+	if err != nil {
+		return
+	}
+	if exists {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	if _, err = st.getUserByEmail(user.Email); err == nil {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	if err != gomagiclink.ErrUserNotFound {
+		return
+	}
+	if err = st.put(st.userKey(user.ID), data); err != nil {
+		return
+	}
+	return st.put(st.emailKey(user.Email), []byte(user.ID.String()))
+}
+
+// UpdateUser updates an existing user record. It returns ErrUserNotFound if the
+// user doesn't exist, and ErrUserAlreadyExists if the user's (changed) e-mail address
+// belongs to another user.
+func (st *RESTStorage) UpdateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	old, err := st.getUserById(user.ID)
+	if err != nil {
+		return
+	}
+	user.Touch()
+	data, err := st.codec.marshal(user)
+	if err != nil {
+		return
+	}
+	if old.Email == user.Email {
+		return st.put(st.userKey(user.ID), data)
+	}
+
+	// The e-mail address has changed, so the index moves to a new key.
+	other, err := st.getUserByEmail(user.Email)
+	if err == nil && other.ID != user.ID {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	if err != nil && err != gomagiclink.ErrUserNotFound {
+		return
+	}
+	if err = st.put(st.emailKey(user.Email), []byte(user.ID.String())); err != nil {
+		return
+	}
+	if err = st.put(st.userKey(user.ID), data); err != nil {
+		return
+	}
+	err = st.delete(st.emailKey(old.Email))
+	if err == errRESTNotFound {
+		err = nil
+	}
+	return
+}
+
+func (st *RESTStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	defer st.errs.track(&err)
+	return st.getUserById(id)
+}
+
+func (st *RESTStorage) getUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
+	data, err := st.get(st.userKey(id))
+	if err == errRESTNotFound {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	if err != nil {
+		return
+	}
+	return st.codec.unmarshal(data)
+}
+
+func (st *RESTStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
+	defer st.errs.track(&err)
+	return st.getUserByEmail(gomagiclink.NormalizeEmail(email))
+}
+
+// getUserByEmail loads the user through the e-mail key, checking that the record still
+// has the e-mail address.
+func (st *RESTStorage) getUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
+	idData, err := st.get(st.emailKey(email))
+	if err == errRESTNotFound {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	if err != nil {
+		return
+	}
+	id, err := uuid.ParseBytes(bytes.TrimSpace(idData))
+	if err != nil {
+		return
+	}
+	user, err = st.getUserById(id)
+	if err == nil && user.Email != email {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	return
+}
+
+func (st *RESTStorage) DeleteUser(id uuid.UUID) (err error) {
+	defer st.errs.track(&err)
+	user, err := st.getUserById(id)
+	if err == gomagiclink.ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	if err = st.delete(st.userKey(id)); err != nil && err != errRESTNotFound {
+		return
+	}
+	err = st.delete(st.emailKey(user.Email))
+	if err == errRESTNotFound {
+		err = nil
+	}
+	return
+}
+
+func (st *RESTStorage) UserExistsByEmail(email string) bool {
+	_, err := st.getUserByEmail(gomagiclink.NormalizeEmail(email))
+	if err != nil {
+		if err != gomagiclink.ErrUserNotFound {
+			st.errs.track(&err)
+		}
+		return false
+	}
+	return true
+}
+
+func (st *RESTStorage) GetUserCount() (n int, err error) {
+	defer st.errs.track(&err)
+	err = st.listKeys(st.prefix+"user:", func(key string) bool {
+		n++
+		return true
+	})
+	return
+}
+
+func (st *RESTStorage) UsersExist() (exist bool, err error) {
+	defer st.errs.track(&err)
+	err = st.listKeys(st.prefix+"user:", func(key string) bool {
+		exist = true
+		return false
+	})
+	return
+}
+
+// GetStats returns the user count and the most recent storage error.
+func (st *RESTStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	stats.UserCount, _ = st.GetUserCount()
+	st.errs.fill(&stats)
+	return
+}
+
+// SetRecordEncryptor enables encryption of the stored user records. Records which were
+// stored unencrypted can still be read, and are encrypted when they're next stored, or
+// by ReencryptRecords(). Note that the e-mail addresses are also stored in plain text
+// in the keys, for lookups.
+func (st *RESTStorage) SetRecordEncryptor(encryptor *gomagiclink.RecordEncryptor) {
+	st.codec.encryptor = encryptor
+}
+
+// SetRecordCodec sets the serialization of the stored user records (JSONRecordCodec by
+// default). Records in the other provided formats can still be read.
+func (st *RESTStorage) SetRecordCodec(codec RecordCodec) {
+	st.codec.format = codec
+}
+
+// ReencryptRecords rewrites all the user records which aren't encrypted with the
+// current key of the RecordEncryptor, e.g. after a key rotation. It returns the
+// number of rewritten records.
+func (st *RESTStorage) ReencryptRecords() (n int, err error) {
+	defer st.errs.track(&err)
+	if st.codec.encryptor == nil {
+		return 0, gomagiclink.ErrNoRecordEncryptor
+	}
+	var keys []string
+	err = st.listKeys(st.prefix+"user:", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		data, err := st.get(key)
+		if err == errRESTNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !st.codec.needsReencryption(data) {
+			continue
+		}
+		user, err := st.codec.unmarshal(data)
+		if err != nil {
+			return n, err
+		}
+		if data, err = st.codec.marshal(user); err != nil {
+			return n, err
+		}
+		if err = st.put(key, data); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return
+}
+
+// SetNamespace restricts the storage to the keys of the namespace, so several apps
+// can share the store (see gomagiclink.WithNamespace(), which calls it).
+func (st *RESTStorage) SetNamespace(namespace string) error {
+	if err := gomagiclink.ValidateNamespace(namespace); err != nil {
+		return err
+	}
+	st.prefix = namespace + ":"
+	return nil
+}
+
+// SetLogger sets the logger to which storage errors are logged. By default they're not logged.
+func (st *RESTStorage) SetLogger(logger *slog.Logger) {
+	st.errs.logger = logger
+}
+
+func (st *RESTStorage) keyURL(path string, key string) string {
+	return st.opts.BaseURL + strings.ReplaceAll(path, "{key}", url.PathEscape(key))
+}
+
+func (st *RESTStorage) get(key string) (data []byte, err error) {
+	resp, err := st.do(http.MethodGet, st.keyURL(st.opts.ValuePath, key), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRESTNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, restResponseError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (st *RESTStorage) exists(key string) (exists bool, err error) {
+	if st.opts.ExistsPath == "" {
+		_, err = st.get(key)
+		if err == errRESTNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	resp, err := st.do(http.MethodHead, st.keyURL(st.opts.ExistsPath, key), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	}
+	return false, restResponseError(resp)
+}
+
+func (st *RESTStorage) put(key string, data []byte) (err error) {
+	resp, err := st.do(http.MethodPut, st.keyURL(st.opts.ValuePath, key), data)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return restResponseError(resp)
+	}
+	return nil
+}
+
+func (st *RESTStorage) delete(key string) (err error) {
+	resp, err := st.do(http.MethodDelete, st.keyURL(st.opts.ValuePath, key), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errRESTNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return restResponseError(resp)
+	}
+	return nil
+}
+
+// listKeys calls fn for each key with the prefix, following the cursors, until fn
+// returns false.
+func (st *RESTStorage) listKeys(prefix string, fn func(key string) bool) error {
+	var cursor string
+	for {
+		u := st.opts.BaseURL + strings.NewReplacer("{prefix}", url.QueryEscape(prefix), "{cursor}", url.QueryEscape(cursor)).Replace(st.opts.ListPath)
+		resp, err := st.do(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = restResponseError(resp)
+			resp.Body.Close()
+			return err
+		}
+		var result struct {
+			Keys   []string `json:"keys"`
+			Cursor string   `json:"cursor"`
+			Result []struct {
+				Name string `json:"name"`
+			} `json:"result"`
+			ResultInfo struct {
+				Cursor string `json:"cursor"`
+			} `json:"result_info"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, r := range result.Result {
+			result.Keys = append(result.Keys, r.Name)
+		}
+		for _, key := range result.Keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if !fn(key) {
+				return nil
+			}
+		}
+		cursor = result.Cursor + result.ResultInfo.Cursor
+		if cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (st *RESTStorage) do(method string, u string, body []byte) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range st.opts.Header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return st.opts.Client.Do(req)
+}
+
+func restResponseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("rest storage: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
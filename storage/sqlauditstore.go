@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// SQLAuditStore is a gomagiclink.AuditStore keeping the audit events in a SQL table
+// with these fields:
+//
+//	event_time	A 64-bit integer, Unix time in microseconds
+//	type		text
+//	user_id		text, empty if there's no user
+//	actor_id	text, empty if there's no actor
+//	email		text
+//	details		text, JSON object
+//
+// The table needs to be maintained entirely by the caller, including indexes.
+// Indexes on `event_time` and `user_id` are recommended for queries.
+type SQLAuditStore struct {
+	db        *sql.DB
+	tableName string
+	pgsql     bool
+	errs      errorTracker
+}
+
+// NewSQLiteAuditStore creates a SQLAuditStore with SQLite-flavoured SQL.
+func NewSQLiteAuditStore(db *sql.DB, tableName string) (st *SQLAuditStore, err error) {
+	if err = gomagiclink.ValidateSQLIdentifier(tableName); err != nil {
+		return nil, err
+	}
+	return &SQLAuditStore{db: db, tableName: tableName}, nil
+}
+
+// NewPgSQLAuditStore creates a SQLAuditStore with PostgreSQL-flavoured SQL.
+func NewPgSQLAuditStore(db *sql.DB, tableName string) (st *SQLAuditStore, err error) {
+	if err = gomagiclink.ValidateSQLIdentifier(tableName); err != nil {
+		return nil, err
+	}
+	return &SQLAuditStore{db: db, tableName: tableName, pgsql: true}, nil
+}
+
+// query converts the "?" placeholders to "$1", "$2", etc. for PostgreSQL.
+func (st *SQLAuditStore) query(q string) string {
+	if !st.pgsql {
+		return q
+	}
+	return pgPlaceholders(q)
+}
+
+// pgPlaceholders converts the "?" placeholders to "$1", "$2", etc.
+func pgPlaceholders(q string) string {
+	var sb strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// LogAuditEvent stores the event. Errors can't be returned to the controller, so
+// they're logged (see SetLogger()) and reported by GetStats().
+func (st *SQLAuditStore) LogAuditEvent(ev gomagiclink.AuditEvent) {
+	var err error
+	defer st.errs.track(&err)
+	details := []byte("{}")
+	if len(ev.Details) > 0 {
+		details, err = json.Marshal(ev.Details)
+		if err != nil {
+			return
+		}
+	}
+	_, err = st.db.Exec(st.query(fmt.Sprintf("INSERT INTO %s (event_time, type, user_id, actor_id, email, details) VALUES (?, ?, ?, ?, ?, ?)", st.tableName)),
+		ev.Time.UnixMicro(), ev.Type, auditUUID(ev.UserID), auditUUID(ev.ActorID), ev.Email, string(details))
+}
+
+func (st *SQLAuditStore) GetAuditEvents(filter gomagiclink.AuditFilter) (events []gomagiclink.AuditEvent, err error) {
+	defer st.errs.track(&err)
+	var where []string
+	var args []any
+	if !filter.Since.IsZero() {
+		where = append(where, "event_time >= ?")
+		args = append(args, filter.Since.UnixMicro())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "event_time < ?")
+		args = append(args, filter.Until.UnixMicro())
+	}
+	if filter.UserID != uuid.Nil {
+		where = append(where, "(user_id = ? OR actor_id = ?)")
+		args = append(args, filter.UserID.String(), filter.UserID.String())
+	}
+	if len(filter.Types) > 0 {
+		where = append(where, "type IN (?"+strings.Repeat(", ?", len(filter.Types)-1)+")")
+		for _, t := range filter.Types {
+			args = append(args, t)
+		}
+	}
+	q := fmt.Sprintf("SELECT event_time, type, user_id, actor_id, email, details FROM %s", st.tableName)
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY event_time"
+	if filter.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, filter.Limit)
+	} else if filter.Offset > 0 && !st.pgsql {
+		q += " LIMIT -1" // SQLite needs a LIMIT with OFFSET
+	}
+	if filter.Offset > 0 {
+		q += " OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+
+	rows, err := st.db.Query(st.query(q), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev gomagiclink.AuditEvent
+		var eventTime int64
+		var userId, actorId, details string
+		err = rows.Scan(&eventTime, &ev.Type, &userId, &actorId, &ev.Email, &details)
+		if err != nil {
+			return
+		}
+		ev.Time = time.UnixMicro(eventTime)
+		if userId != "" {
+			if ev.UserID, err = uuid.Parse(userId); err != nil {
+				return
+			}
+		}
+		if actorId != "" {
+			if ev.ActorID, err = uuid.Parse(actorId); err != nil {
+				return
+			}
+		}
+		if err = json.Unmarshal([]byte(details), &ev.Details); err != nil {
+			return
+		}
+		if len(ev.Details) == 0 {
+			ev.Details = nil
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// GetStats returns the most recent error and the database connection pool statistics.
+// UserCount is always 0.
+func (st *SQLAuditStore) GetStats() (stats gomagiclink.StorageStatistics) {
+	dbStats := st.db.Stats()
+	stats.DB = &dbStats
+	st.errs.fill(&stats)
+	return
+}
+
+// SetLogger sets the logger to which storage errors are logged. By default they're not logged.
+func (st *SQLAuditStore) SetLogger(logger *slog.Logger) {
+	st.errs.logger = logger
+}
+
+func auditUUID(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return ""
+	}
+	return id.String()
+}
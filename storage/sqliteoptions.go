@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+var ErrStorageClosed = errors.New("storage closed")
+
+// DefaultSQLiteBusyTimeout is how long SQLite waits for a lock held by another connection
+// (or process) before failing with SQLITE_BUSY.
+const DefaultSQLiteBusyTimeout = 5 * time.Second
+
+// SQLiteOptions configures NewSQLiteStorageWithOptions().
+type SQLiteOptions struct {
+	Path         string        // Database file, opened if DB is nil
+	DriverName   string        // Driver to open Path with, "sqlite3" (github.com/mattn/go-sqlite3, the default) or "sqlite" (modernc.org/sqlite); the app needs to import it
+	DB           *sql.DB       // Already opened database, used instead of Path; it isn't closed by Close()
+	TableName    string        // Default "magiclink"
+	BusyTimeout  time.Duration // Default DefaultSQLiteBusyTimeout
+	DisableWAL   bool          // Keep the rollback journal instead of switching to WAL mode
+	CreateSchema bool          // Create the table (with the `namespace` and `data_bin` columns, see SetNamespace() and SetRecordCodec()) and its indexes if they don't exist
+}
+
+// sqliteWrite is a write operation queued for the writer goroutine.
+type sqliteWrite struct {
+	fn   func() error
+	done chan error
+}
+
+// NewSQLiteStorageWithOptions is an opinionated way to set up a SQLiteStorage for apps
+// with concurrent logins. It opens the database (unless one is given), enables WAL mode,
+// so reads don't block on writes, sets the busy timeout and enables foreign keys, and
+// optionally creates the schema. Writes are serialized through a single goroutine, so
+// concurrent logins don't fail with SQLITE_BUSY; call Close() to stop it.
+//
+// The busy timeout and foreign keys are per-connection settings. When the database is
+// opened by Path, they're set in the DSN for each connection; for a given DB, they're
+// set with PRAGMAs, which only reach all connections if the pool has a single one, so
+// prefer setting them in the DSN.
+func NewSQLiteStorageWithOptions(opts SQLiteOptions) (st *SQLiteStorage, err error) {
+	if opts.TableName == "" {
+		opts.TableName = "magiclink"
+	}
+	if opts.BusyTimeout == 0 {
+		opts.BusyTimeout = DefaultSQLiteBusyTimeout
+	}
+	if err = gomagiclink.ValidateSQLIdentifier(opts.TableName); err != nil {
+		return nil, err
+	}
+	db, ownDB := opts.DB, false
+	if db == nil {
+		if db, err = openSQLite(opts); err != nil {
+			return nil, err
+		}
+		ownDB = true
+	}
+	st, err = NewSQLiteStorage(db, opts.TableName)
+	if err == nil {
+		err = st.setup(opts, ownDB)
+	}
+	if err != nil {
+		if ownDB {
+			db.Close()
+		}
+		return nil, err
+	}
+	st.ownDB = ownDB
+	st.writes = make(chan sqliteWrite)
+	st.writerDone = make(chan struct{})
+	go st.writer()
+	return st, nil
+}
+
+// openSQLite opens the database file with the per-connection settings in the DSN,
+// in the format of the driver.
+func openSQLite(opts SQLiteOptions) (*sql.DB, error) {
+	driver := opts.DriverName
+	if driver == "" {
+		driver = "sqlite3"
+	}
+	query := url.Values{}
+	busyTimeout := fmt.Sprint(opts.BusyTimeout.Milliseconds())
+	switch driver {
+	case "sqlite3":
+		query.Set("_busy_timeout", busyTimeout)
+		query.Set("_foreign_keys", "on")
+		// Take the write lock at the start of transactions, instead of failing to upgrade
+		// a read lock later
+		query.Set("_txlock", "immediate")
+	case "sqlite":
+		query["_pragma"] = []string{"busy_timeout(" + busyTimeout + ")", "foreign_keys(1)"}
+		query.Set("_txlock", "immediate")
+	}
+	dsn := opts.Path
+	if len(query) > 0 {
+		if !strings.HasPrefix(dsn, "file:") {
+			dsn = "file:" + dsn
+		}
+		dsn += "?" + query.Encode()
+	}
+	return sql.Open(driver, dsn)
+}
+
+// setup sets the journal mode (which is persistent in the database file) and, for
+// databases not opened by us, the per-connection settings, and creates the schema.
+func (st *SQLiteStorage) setup(opts SQLiteOptions, ownDB bool) (err error) {
+	if !opts.DisableWAL {
+		var mode string
+		if err = st.db.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+			return
+		}
+		// In-memory databases can't use WAL, and stay in the "memory" mode
+		if mode != "wal" && mode != "memory" {
+			return fmt.Errorf("can't enable WAL mode, journal mode is %q", mode)
+		}
+	}
+	if !ownDB {
+		if _, err = st.db.Exec(fmt.Sprintf("PRAGMA busy_timeout=%d", opts.BusyTimeout.Milliseconds())); err != nil {
+			return
+		}
+		if _, err = st.db.Exec("PRAGMA foreign_keys=ON"); err != nil {
+			return
+		}
+	}
+	if opts.CreateSchema {
+		_, err = st.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT NOT NULL PRIMARY KEY, email TEXT NOT NULL, data TEXT NOT NULL, namespace TEXT NOT NULL DEFAULT '', data_bin BLOB)", st.tableName))
+		if err != nil {
+			return
+		}
+		// Tables created before binary records were supported get the column
+		if err = addBinaryColumn(st.db, st.tableName, false); err != nil {
+			return
+		}
+		st.records.binary = true
+		// Tables created before namespaces were supported keep their index on the e-mail address
+		_, err = st.db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_email ON %[1]s (namespace, email)", st.tableName))
+	}
+	return
+}
+
+// writer runs the queued write operations one at a time.
+func (st *SQLiteStorage) writer() {
+	defer close(st.writerDone)
+	for w := range st.writes {
+		w.done <- w.fn()
+	}
+}
+
+// write runs the write operation on the writer goroutine, if there is one.
+func (st *SQLiteStorage) write(fn func() error) error {
+	if st.writes == nil {
+		return fn()
+	}
+	st.writeLock.RLock()
+	defer st.writeLock.RUnlock()
+	if st.closed {
+		return ErrStorageClosed
+	}
+	w := sqliteWrite{fn: fn, done: make(chan error, 1)}
+	st.writes <- w
+	return <-w.done
+}
+
+// Close stops the writer goroutine of a SQLiteStorage created with
+// NewSQLiteStorageWithOptions(), after the queued writes are done, and closes the
+// database if it was opened by the storage. Later writes fail with ErrStorageClosed.
+func (st *SQLiteStorage) Close() error {
+	if st.writes == nil {
+		return nil
+	}
+	st.writeLock.Lock()
+	if st.closed {
+		st.writeLock.Unlock()
+		return nil
+	}
+	st.closed = true
+	close(st.writes)
+	st.writeLock.Unlock()
+	<-st.writerDone
+	if st.ownDB {
+		return st.db.Close()
+	}
+	return nil
+}
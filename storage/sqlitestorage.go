@@ -2,8 +2,9 @@ package storage
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	"log/slog"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/ivoras/gomagiclink"
@@ -12,6 +13,17 @@ import (
 type SQLiteStorage struct {
 	db        *sql.DB
 	tableName string
+	errs      errorTracker
+	codec     recordCodec
+	ns        sqlNamespace
+	records   sqlRecords
+
+	// Set by NewSQLiteStorageWithOptions()
+	writes     chan sqliteWrite
+	writerDone chan struct{}
+	writeLock  sync.RWMutex
+	closed     bool
+	ownDB      bool
 }
 
 // NewSQLiteStorage creates a SQLiteStorage instance.
@@ -22,33 +34,125 @@ type SQLiteStorage struct {
 //	email	text
 //	data	A type that can accept a long JSON string, either as text, or as a dedicated type
 //
+// With a binary RecordCodec (see SetRecordCodec()), the table also needs a `data_bin`
+// BLOB field, which MigrateRecordColumns() adds.
+//
 // This table needs to be maintained entirely by the caller, including indexes.
 // A unique index on the `id` field, and another unique index on the `email` field are highly recommended.
+// With a namespace (see SetNamespace()), the table also needs a `namespace` text field, and
+// the unique index should be on (`namespace`, `email`) instead.
 func NewSQLiteStorage(db *sql.DB, tableName string) (st *SQLiteStorage, err error) {
+	if err = gomagiclink.ValidateSQLIdentifier(tableName); err != nil {
+		return nil, err
+	}
 	return &SQLiteStorage{
 		db:        db,
 		tableName: tableName,
 	}, nil
 }
 
+// StoreUser creates the user record if it doesn't exist, or updates it. It returns
+// ErrUserAlreadyExists if the user's e-mail address belongs to another user.
 func (st *SQLiteStorage) StoreUser(user *gomagiclink.AuthUserRecord) (err error) {
-	userJson, err := json.Marshal(user)
+	err = st.UpdateUser(user)
+	if err == gomagiclink.ErrUserNotFound {
+		return st.CreateUser(user)
+	}
+	return
+}
+
+// CreateUser stores a new user record. It returns ErrUserAlreadyExists if a user
+// with the same ID or e-mail address exists.
+func (st *SQLiteStorage) CreateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	userJson, err := st.codec.marshal(user)
 	if err != nil {
 		return
 	}
-	// It's a race condition, but UPSERT isn't standardised across common databases
-	if !st.UserExistsByEmail(user.Email) {
-		_, err = st.db.Exec(fmt.Sprintf("INSERT INTO %s (id, email, data) VALUES (?, ?, ?)", st.tableName), user.ID.String(), user.Email, string(userJson))
-	} else {
-		_, err = st.db.Exec(fmt.Sprintf("UPDATE %s SET data=? WHERE id=?", st.tableName), string(userJson), user.ID.String())
+	return st.write(func() error { return st.createUser(user, userJson) })
+}
+
+func (st *SQLiteStorage) createUser(user *gomagiclink.AuthUserRecord, userJson []byte) (err error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return
 	}
+	defer tx.Rollback()
 
-	return
+	var count int
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id=? OR email=?", st.tableName), user.ID.String(), user.Email)
+	err = tx.QueryRow(q, args...).Scan(&count)
+	if err != nil {
+		return
+	}
+	if count > 0 {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	q, args, err = st.records.insert(st.ns, st.tableName, user.ID.String(), user.Email, userJson)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(q, args...)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// UpdateUser updates an existing user record. It returns ErrUserNotFound if the
+// user doesn't exist, and ErrUserAlreadyExists if the user's (changed) e-mail address
+// belongs to another user.
+func (st *SQLiteStorage) UpdateUser(user *gomagiclink.AuthUserRecord) (err error) {
+	defer st.errs.track(&err)
+	user.Touch()
+	userJson, err := st.codec.marshal(user)
+	if err != nil {
+		return
+	}
+	return st.write(func() error { return st.updateUser(user, userJson) })
+}
+
+func (st *SQLiteStorage) updateUser(user *gomagiclink.AuthUserRecord, userJson []byte) (err error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=? AND id<>?", st.tableName), user.Email, user.ID.String())
+	err = tx.QueryRow(q, args...).Scan(&count)
+	if err != nil {
+		return
+	}
+	if count > 0 {
+		return gomagiclink.ErrUserAlreadyExists
+	}
+	values, err := st.records.values(userJson)
+	if err != nil {
+		return
+	}
+	q, args = st.ns.where(fmt.Sprintf("UPDATE %s SET email=?, %s WHERE id=?", st.tableName, st.records.set(st.ns, 2)), append(append([]any{user.Email}, values...), user.ID.String())...)
+	res, err := tx.Exec(q, args...)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return gomagiclink.ErrUserNotFound
+	}
+	return tx.Commit()
 }
 
 func (st *SQLiteStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRecord, err error) {
-	var userJson string
-	err = st.db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE id=?", st.tableName), id.String()).Scan(&userJson)
+	defer st.errs.track(&err)
+	var r sqlRecord
+	q, args := st.ns.where(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", st.records.columns(), st.tableName), id.String())
+	err = st.db.QueryRow(q, args...).Scan(st.records.dest(&r)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, gomagiclink.ErrUserNotFound
@@ -56,14 +160,14 @@ func (st *SQLiteStorage) GetUserById(id uuid.UUID) (user *gomagiclink.AuthUserRe
 		return
 	}
 
-	user = &gomagiclink.AuthUserRecord{}
-	err = json.Unmarshal([]byte(userJson), user)
-	return
+	return st.codec.unmarshal(r.bytes())
 }
 
 func (st *SQLiteStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUserRecord, err error) {
-	var userJson string
-	err = st.db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE email=?", st.tableName), gomagiclink.NormalizeEmail(email)).Scan(&userJson)
+	defer st.errs.track(&err)
+	var r sqlRecord
+	q, args := st.ns.where(fmt.Sprintf("SELECT %s FROM %s WHERE email=?", st.records.columns(), st.tableName), gomagiclink.NormalizeEmail(email))
+	err = st.db.QueryRow(q, args...).Scan(st.records.dest(&r)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, gomagiclink.ErrUserNotFound
@@ -71,26 +175,108 @@ func (st *SQLiteStorage) GetUserByEmail(email string) (user *gomagiclink.AuthUse
 		return
 	}
 
-	user = &gomagiclink.AuthUserRecord{}
-	err = json.Unmarshal([]byte(userJson), user)
-	return
+	return st.codec.unmarshal(r.bytes())
+}
+
+func (st *SQLiteStorage) DeleteUser(id uuid.UUID) (err error) {
+	defer st.errs.track(&err)
+	return st.write(func() error {
+		q, args := st.ns.where(fmt.Sprintf("DELETE FROM %s WHERE id=?", st.tableName), id.String())
+		_, err := st.db.Exec(q, args...)
+		return err
+	})
 }
 
 func (st *SQLiteStorage) UserExistsByEmail(email string) (exists bool) {
 	var count int
-	err := st.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=?", st.tableName), gomagiclink.NormalizeEmail(email)).Scan(&count)
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE email=?", st.tableName), gomagiclink.NormalizeEmail(email))
+	err := st.db.QueryRow(q, args...).Scan(&count)
 	if err != nil {
+		st.errs.track(&err)
 		return false
 	}
 	return count > 0
 }
 
 func (st *SQLiteStorage) GetUserCount() (n int, err error) {
-	err = st.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", st.tableName)).Scan(&n)
+	defer st.errs.track(&err)
+	q, args := st.ns.where(fmt.Sprintf("SELECT COUNT(*) FROM %s", st.tableName))
+	err = st.db.QueryRow(q, args...).Scan(&n)
 	return
 }
 
 func (st *SQLiteStorage) UsersExist() (exist bool, err error) {
-	err = st.db.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT * FROM %s)", st.tableName)).Scan(&exist)
+	defer st.errs.track(&err)
+	q, args := st.ns.where(fmt.Sprintf("SELECT * FROM %s", st.tableName))
+	err = st.db.QueryRow("SELECT EXISTS ("+q+")", args...).Scan(&exist)
+	return
+}
+
+// GetStats returns the user count, the most recent storage error and the
+// database connection pool statistics.
+func (st *SQLiteStorage) GetStats() (stats gomagiclink.StorageStatistics) {
+	stats.UserCount, _ = st.GetUserCount()
+	dbStats := st.db.Stats()
+	stats.DB = &dbStats
+	st.errs.fill(&stats)
 	return
 }
+
+// SetRecordEncryptor enables encryption of the stored user records. Records which were
+// stored unencrypted can still be read, and are encrypted when they're next stored, or
+// by ReencryptRecords(). Note that the e-mail address is also stored in plain text in
+// its own column, for lookups.
+func (st *SQLiteStorage) SetRecordEncryptor(encryptor *gomagiclink.RecordEncryptor) {
+	st.codec.encryptor = encryptor
+}
+
+// SetRecordCodec sets the serialization of the stored user records (JSONRecordCodec by
+// default). Records in the other provided formats can still be read. The records of
+// binary codecs are stored in the `data_bin` column, which must exist; see
+// MigrateRecordColumns().
+func (st *SQLiteStorage) SetRecordCodec(codec RecordCodec) {
+	st.codec.format = codec
+	if codec != nil && codec.Name() != "" {
+		st.records.binary = true
+	}
+}
+
+// MigrateRecordColumns adds the `data_bin` BLOB column for the records of binary codecs,
+// if the table doesn't have it, and moves the binary records which older versions stored
+// base64-encoded in the `data` column to it, or converts them to JSON with the JSON
+// codec. It returns the number of moved records. Call it before the first use of a
+// binary codec, and to read such records after switching back to JSON.
+// NewSQLiteStorageWithOptions() adds the column when it creates the schema.
+func (st *SQLiteStorage) MigrateRecordColumns() (n int, err error) {
+	defer st.errs.track(&err)
+	if err = st.write(func() error { return addBinaryColumn(st.db, st.tableName, false) }); err != nil {
+		return
+	}
+	st.records.binary = true
+	sr := &sqlRewriter{db: st.db, ns: st.ns, records: st.records, tableName: st.tableName, codec: &st.codec, needsRewrite: isTextBinaryRecord, write: st.write, logger: st.errs.logger}
+	return sr.run()
+}
+
+// ReencryptRecords rewrites all the user records which aren't encrypted with the
+// current key of the RecordEncryptor, e.g. after a key rotation. It returns the
+// number of rewritten records. The records are read a page at a time, and those changed
+// concurrently aren't overwritten, but read again.
+func (st *SQLiteStorage) ReencryptRecords() (n int, err error) {
+	defer st.errs.track(&err)
+	if st.codec.encryptor == nil {
+		return 0, gomagiclink.ErrNoRecordEncryptor
+	}
+	sr := &sqlRewriter{db: st.db, ns: st.ns, records: st.records, tableName: st.tableName, codec: &st.codec, needsRewrite: st.codec.needsReencryption, write: st.write, logger: st.errs.logger}
+	return sr.run()
+}
+
+// SetNamespace restricts the storage to the records with the namespace in the `namespace`
+// column, so several apps can share the table (see gomagiclink.WithNamespace(), which calls it).
+func (st *SQLiteStorage) SetNamespace(namespace string) error {
+	return setSQLNamespace(&st.ns, namespace)
+}
+
+// SetLogger sets the logger to which storage errors are logged. By default they're not logged.
+func (st *SQLiteStorage) SetLogger(logger *slog.Logger) {
+	st.errs.logger = logger
+}
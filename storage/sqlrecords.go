@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrBinaryColumnRequired = errors.New("binary records need the data_bin column, see MigrateRecordColumns()")
+
+// sqlBinaryNull is stored in the `data` column of binary records, so the column keeps
+// valid JSON, and its NOT NULL constraint.
+const sqlBinaryNull = "null"
+
+// sqlRecords maps the user records to the columns of the SQL storages. JSON records,
+// including the encrypted ones, are stored in the `data` column, and binary records (of
+// the MessagePack and Protocol Buffers codecs) in the `data_bin` column (BYTEA in
+// PostgreSQL, BLOB in SQLite). The `data_bin` column is only used with binary set, so
+// the tables of the storages with JSON records don't need it.
+type sqlRecords struct {
+	binary bool
+}
+
+// sqlRecord is a user record as read from the SQL storages.
+type sqlRecord struct {
+	data sql.NullString
+	bin  []byte
+}
+
+// bytes returns the stored record, from the column which holds it.
+func (r *sqlRecord) bytes() []byte {
+	if r.bin != nil {
+		return r.bin
+	}
+	return []byte(r.data.String)
+}
+
+// columns returns the record columns, for SELECT queries.
+func (sr sqlRecords) columns() string {
+	if sr.binary {
+		return "data, data_bin"
+	}
+	return "data"
+}
+
+// dest returns the scan destinations of the columns.
+func (sr sqlRecords) dest(r *sqlRecord) []any {
+	if sr.binary {
+		return []any{&r.data, &r.bin}
+	}
+	return []any{&r.data}
+}
+
+// values returns the column values of the stored record.
+func (sr sqlRecords) values(data []byte) ([]any, error) {
+	if !isBinaryRecord(data) {
+		if sr.binary {
+			return []any{string(data), nil}, nil
+		}
+		return []any{string(data)}, nil
+	}
+	if !sr.binary {
+		return nil, ErrBinaryColumnRequired
+	}
+	return []any{sqlBinaryNull, data}, nil
+}
+
+// stored returns the column values of the record as it was read.
+func (sr sqlRecords) stored(r *sqlRecord) []any {
+	if sr.binary {
+		return []any{r.data, r.bin}
+	}
+	return []any{r.data}
+}
+
+// set returns the assignments of the record columns for UPDATE queries, with the
+// placeholders numbered from n.
+func (sr sqlRecords) set(ns sqlNamespace, n int) string {
+	if sr.binary {
+		return fmt.Sprintf("data=%s, data_bin=%s", ns.placeholder(n), ns.placeholder(n+1))
+	}
+	return "data=" + ns.placeholder(n)
+}
+
+// same returns the conditions matching the record columns to their values, with the
+// placeholders numbered from n, e.g. to update a record only if it wasn't changed.
+func (sr sqlRecords) same(ns sqlNamespace, n int) string {
+	if !sr.binary {
+		return "data=" + ns.placeholder(n)
+	}
+	// Comparisons with NULL are never true, unlike IS in SQLite and IS NOT DISTINCT FROM
+	// in PostgreSQL
+	is := " IS "
+	if ns.pgsql {
+		is = " IS NOT DISTINCT FROM "
+	}
+	return fmt.Sprintf("data=%s AND data_bin%s%s", ns.placeholder(n), is, ns.placeholder(n+1))
+}
+
+// insert returns the query inserting a user record into the table.
+func (sr sqlRecords) insert(ns sqlNamespace, tableName string, id string, email string, data []byte) (string, []any, error) {
+	values, err := sr.values(data)
+	if err != nil {
+		return "", nil, err
+	}
+	columns := []string{"id", "email", sr.columns()}
+	args := append([]any{id, email}, values...)
+	if ns.name != "" {
+		columns = append(columns, "namespace")
+		args = append(args, ns.name)
+	}
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = ns.placeholder(i + 1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", tableName, strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args, nil
+}
+
+// addBinaryColumn adds the `data_bin` column to the table, if it doesn't have it.
+func addBinaryColumn(db *sql.DB, tableName string, pgsql bool) (err error) {
+	if pgsql {
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS data_bin BYTEA", tableName))
+		return
+	}
+	// SQLite doesn't support IF NOT EXISTS with ADD COLUMN
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", tableName))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return
+		}
+		if name == "data_bin" {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN data_bin BLOB", tableName))
+	return
+}
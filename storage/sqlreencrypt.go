@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// reencryptPageSize is the number of records read at a time by ReencryptRecords().
+const reencryptPageSize = 100
+
+// reencryptAttempts is how many times a record modified concurrently with
+// ReencryptRecords() is read again and rewritten, before it's skipped.
+const reencryptAttempts = 3
+
+// sqlRewriter rewrites the user records of the SQL storages which need it, e.g. those
+// which aren't encrypted with the current key. The records are read a page at a time,
+// ordered by their IDs, and each is updated only if it wasn't changed since it was read,
+// so concurrent writes aren't overwritten.
+type sqlRewriter struct {
+	db           *sql.DB
+	ns           sqlNamespace
+	records      sqlRecords
+	tableName    string
+	codec        *recordCodec
+	needsRewrite func(data []byte) bool
+	write        func(fn func() error) error // Runs the updates, e.g. on the SQLite writer goroutine
+	logger       *slog.Logger
+}
+
+func (sr *sqlRewriter) run() (n int, err error) {
+	after := ""
+	skipped := 0
+	for {
+		q, args := sr.ns.where(fmt.Sprintf("SELECT id, %s FROM %s WHERE id>%s", sr.records.columns(), sr.tableName, sr.ns.placeholder(1)), after)
+		rows, err := sr.db.Query(q+fmt.Sprintf(" ORDER BY id LIMIT %d", reencryptPageSize), args...)
+		if err != nil {
+			return n, err
+		}
+		var ids []string
+		var records []*sqlRecord
+		for rows.Next() {
+			var id string
+			r := &sqlRecord{}
+			if err = rows.Scan(append([]any{&id}, sr.records.dest(r)...)...); err != nil {
+				rows.Close()
+				return n, err
+			}
+			ids, records = append(ids, id), append(records, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return n, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for i, id := range ids {
+			if !sr.needsRewrite(records[i].bytes()) {
+				continue
+			}
+			rewritten, err := sr.rewrite(id, records[i])
+			if err == ErrConcurrentModification {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+			if rewritten {
+				n++
+			}
+		}
+		after = ids[len(ids)-1]
+	}
+	if skipped > 0 && sr.logger != nil {
+		sr.logger.Warn("Records modified concurrently weren't rewritten", "count", skipped)
+	}
+	return n, nil
+}
+
+// rewrite rewrites the record, if it's still the same as read. If it was changed, it's
+// read again, and rewritten if it still needs it.
+func (sr *sqlRewriter) rewrite(id string, r *sqlRecord) (rewritten bool, err error) {
+	for attempt := 0; attempt < reencryptAttempts; attempt++ {
+		user, err := sr.codec.unmarshal(r.bytes())
+		if err != nil {
+			return false, err
+		}
+		newData, err := sr.codec.marshal(user)
+		if err != nil {
+			return false, err
+		}
+		newValues, err := sr.records.values(newData)
+		if err != nil {
+			return false, err
+		}
+		next := len(newValues) + 1
+		q := fmt.Sprintf("UPDATE %s SET %s WHERE id=%s AND %s", sr.tableName, sr.records.set(sr.ns, 1), sr.ns.placeholder(next), sr.records.same(sr.ns, next+1))
+		args := append(append(newValues, id), sr.records.stored(r)...)
+		var updated int64
+		err = sr.write(func() error {
+			res, err := sr.db.Exec(q, args...)
+			if err != nil {
+				return err
+			}
+			updated, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		if updated > 0 {
+			return true, nil
+		}
+		r = &sqlRecord{}
+		err = sr.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=%s", sr.records.columns(), sr.tableName, sr.ns.placeholder(1)), id).Scan(sr.records.dest(r)...)
+		if err == sql.ErrNoRows {
+			// Deleted in the meantime
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !sr.needsRewrite(r.bytes()) {
+			// Rewritten in the meantime
+			return false, nil
+		}
+	}
+	return false, ErrConcurrentModification
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// errorTracker remembers the most recent unexpected error returned by a storage,
+// for reporting in gomagiclink.StorageStatistics, and logs it if a logger is set.
+type errorTracker struct {
+	logger        *slog.Logger
+	lock          sync.Mutex
+	lastError     error
+	lastErrorTime time.Time
+}
+
+// track records *err if it's an error other than the expected "not found",
+// "already exists" and concurrent modification results. It's meant to be deferred
+// with the address of a named error result.
+func (et *errorTracker) track(err *error) {
+	if *err == nil || *err == gomagiclink.ErrUserNotFound || *err == gomagiclink.ErrUserAlreadyExists || *err == ErrConcurrentModification {
+		return
+	}
+	if et.logger != nil {
+		et.logger.Error("Storage error", "error", *err)
+	}
+	et.lock.Lock()
+	et.lastError = *err
+	et.lastErrorTime = time.Now()
+	et.lock.Unlock()
+}
+
+func (et *errorTracker) fill(stats *gomagiclink.StorageStatistics) {
+	et.lock.Lock()
+	defer et.lock.Unlock()
+	if et.lastError != nil {
+		stats.LastError = et.lastError.Error()
+		stats.LastErrorTime = et.lastErrorTime
+	}
+}
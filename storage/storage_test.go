@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testStorage is implemented by all the storages in the package.
+type testStorage interface {
+	gomagiclink.UserAuthDatabase
+	gomagiclink.UserCreator
+	gomagiclink.UserUpdater
+	gomagiclink.UserDeleter
+}
+
+// testBackends are the storages which run without external services.
+var testBackends = []struct {
+	name string
+	open func(t *testing.T) testStorage
+}{
+	{"filesystem", func(t *testing.T) testStorage {
+		st, err := NewFileSystemStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}},
+	{"sqlite", openTestSQLite},
+	{"sqlite-options", func(t *testing.T) testStorage {
+		st, err := NewSQLiteStorageWithOptions(SQLiteOptions{Path: filepath.Join(t.TempDir(), "users.db"), CreateSchema: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.Close() })
+		return st
+	}},
+	{"sqlite-msgpack", func(t *testing.T) testStorage {
+		st, err := NewSQLiteStorageWithOptions(SQLiteOptions{Path: filepath.Join(t.TempDir(), "users.db"), CreateSchema: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.Close() })
+		st.SetRecordCodec(MsgpackRecordCodec)
+		return st
+	}},
+	{"sqlite-protobuf", func(t *testing.T) testStorage {
+		st := openTestSQLite(t).(*SQLiteStorage)
+		if _, err := st.MigrateRecordColumns(); err != nil {
+			t.Fatal(err)
+		}
+		st.SetRecordCodec(ProtobufRecordCodec)
+		return st
+	}},
+	{"filesystem-msgpack", func(t *testing.T) testStorage {
+		st, err := NewFileSystemStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.SetRecordCodec(MsgpackRecordCodec)
+		return st
+	}},
+	{"rest", func(t *testing.T) testStorage {
+		srv := httptest.NewServer(newTestKVServer())
+		t.Cleanup(srv.Close)
+		st, err := NewRESTStorage(RESTOptions{BaseURL: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}},
+	{"pii-hashing", func(t *testing.T) testStorage {
+		st, err := NewPIIHashingStorage(openTestSQLite(t), []byte("k9Qz7Wm2Lr8Xv4Tn1Bp6Hs3Jd5Fy0Ca"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}},
+	{"resilient", func(t *testing.T) testStorage {
+		st, err := NewFileSystemStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewResilientStorage(st, ResiliencePolicy{})
+	}},
+}
+
+func openTestSQLite(t *testing.T) testStorage {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec("CREATE TABLE users (id TEXT NOT NULL PRIMARY KEY, email TEXT NOT NULL UNIQUE, data TEXT NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewSQLiteStorage(db, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// newTestKVServer returns a minimal key-value HTTP API, as expected by RESTStorage with
+// the default paths.
+func newTestKVServer() http.Handler {
+	var lock sync.Mutex
+	values := map[string][]byte{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/values/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/values/")
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := values[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(value)
+		case http.MethodPut:
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			values[key] = value
+		case http.MethodDelete:
+			if _, ok := values[key]; !ok {
+				http.NotFound(w, r)
+				return
+			}
+			delete(values, key)
+		}
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		lock.Lock()
+		keys := []string{}
+		for key := range values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	return mux
+}
+
+func TestStorageRoundTrip(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			st := backend.open(t)
+			if exist, err := st.UsersExist(); err != nil || exist {
+				t.Fatalf("UsersExist() on an empty storage = %v, %v", exist, err)
+			}
+
+			user, err := gomagiclink.NewAuthUserRecord("Round.Trip@Example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.AccessLevel = 3
+			user.CustomData = map[string]string{"name": "Round Trip"}
+			if err = st.CreateUser(user); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+
+			byId, err := st.GetUserById(user.ID)
+			if err != nil {
+				t.Fatalf("GetUserById: %v", err)
+			}
+			checkTestUser(t, byId, user)
+			byEmail, err := st.GetUserByEmail("ROUND.TRIP@example.com")
+			if err != nil {
+				t.Fatalf("GetUserByEmail: %v", err)
+			}
+			checkTestUser(t, byEmail, user)
+			if !st.UserExistsByEmail("round.trip@example.com") {
+				t.Error("UserExistsByEmail() = false for a stored user")
+			}
+			if st.UserExistsByEmail("nobody@example.com") {
+				t.Error("UserExistsByEmail() = true for a missing user")
+			}
+
+			dup, err := gomagiclink.NewAuthUserRecord("round.trip@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = st.CreateUser(dup); err != gomagiclink.ErrUserAlreadyExists {
+				t.Errorf("CreateUser with a taken e-mail address = %v, want ErrUserAlreadyExists", err)
+			}
+
+			user.AccessLevel = 5
+			user.CustomData["name"] = "Renamed"
+			if err = st.UpdateUser(user); err != nil {
+				t.Fatalf("UpdateUser: %v", err)
+			}
+			byId, err = st.GetUserById(user.ID)
+			if err != nil {
+				t.Fatalf("GetUserById after UpdateUser: %v", err)
+			}
+			checkTestUser(t, byId, user)
+
+			missing, err := gomagiclink.NewAuthUserRecord("missing@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = st.UpdateUser(missing); err != gomagiclink.ErrUserNotFound {
+				t.Errorf("UpdateUser of a missing user = %v, want ErrUserNotFound", err)
+			}
+			if err = st.StoreUser(missing); err != nil {
+				t.Fatalf("StoreUser of a new user: %v", err)
+			}
+			if n, err := st.GetUserCount(); err != nil || n != 2 {
+				t.Errorf("GetUserCount() = %d, %v, want 2", n, err)
+			}
+
+			if err = st.DeleteUser(user.ID); err != nil {
+				t.Fatalf("DeleteUser: %v", err)
+			}
+			if _, err = st.GetUserById(user.ID); err != gomagiclink.ErrUserNotFound {
+				t.Errorf("GetUserById after DeleteUser = %v, want ErrUserNotFound", err)
+			}
+			if _, err = st.GetUserByEmail(user.Email); err != gomagiclink.ErrUserNotFound {
+				t.Errorf("GetUserByEmail after DeleteUser = %v, want ErrUserNotFound", err)
+			}
+			if _, err = st.GetUserById(uuid.New()); err != gomagiclink.ErrUserNotFound {
+				t.Errorf("GetUserById of an unknown ID = %v, want ErrUserNotFound", err)
+			}
+			if n, err := st.GetUserCount(); err != nil || n != 1 {
+				t.Errorf("GetUserCount() after DeleteUser = %d, %v, want 1", n, err)
+			}
+		})
+	}
+}
+
+func TestMigrateRecordColumns(t *testing.T) {
+	st := openTestSQLite(t).(*SQLiteStorage)
+	user, err := gomagiclink.NewAuthUserRecord("legacy@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.CustomData = map[string]string{"name": "Legacy"}
+	// Older versions stored binary records base64-encoded in the data column
+	legacy := recordCodec{format: MsgpackRecordCodec, text: true}
+	data, err := legacy.marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.db.Exec("INSERT INTO users (id, email, data) VALUES (?, ?, ?)", user.ID.String(), user.Email, string(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	st.SetRecordCodec(ProtobufRecordCodec)
+	if n, err := st.MigrateRecordColumns(); err != nil || n != 1 {
+		t.Fatalf("MigrateRecordColumns() = %d, %v, want 1", n, err)
+	}
+	var stored string
+	var bin []byte
+	if err = st.db.QueryRow("SELECT data, data_bin FROM users WHERE id=?", user.ID.String()).Scan(&stored, &bin); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "null" || !strings.HasPrefix(string(bin), "protobuf\x00") {
+		t.Errorf("migrated record = %q, %q, want null and a protobuf record", stored, bin)
+	}
+	migrated, err := st.GetUserById(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserById after MigrateRecordColumns: %v", err)
+	}
+	checkTestUser(t, migrated, user)
+	if n, err := st.MigrateRecordColumns(); err != nil || n != 0 {
+		t.Errorf("MigrateRecordColumns() again = %d, %v, want 0", n, err)
+	}
+
+	// Switching back to JSON converts the binary records as they're stored
+	st.SetRecordCodec(JSONRecordCodec)
+	if err = st.UpdateUser(migrated); err != nil {
+		t.Fatal(err)
+	}
+	if err = st.db.QueryRow("SELECT data, data_bin FROM users WHERE id=?", user.ID.String()).Scan(&stored, &bin); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "{") || bin != nil {
+		t.Errorf("record stored with JSON = %q, %q, want JSON only", stored, bin)
+	}
+}
+
+func checkTestUser(t *testing.T, got *gomagiclink.AuthUserRecord, want *gomagiclink.AuthUserRecord) {
+	t.Helper()
+	if got.ID != want.ID {
+		t.Errorf("ID = %v, want %v", got.ID, want.ID)
+	}
+	if got.Email != want.Email {
+		t.Errorf("Email = %q, want %q", got.Email, want.Email)
+	}
+	if got.Enabled != want.Enabled || got.AccessLevel != want.AccessLevel {
+		t.Errorf("Enabled, AccessLevel = %v, %d, want %v, %d", got.Enabled, got.AccessLevel, want.Enabled, want.AccessLevel)
+	}
+	if !maps.Equal(got.CustomData, want.CustomData) {
+		t.Errorf("CustomData = %v, want %v", got.CustomData, want.CustomData)
+	}
+	if !got.FirstLoginTime.Equal(want.FirstLoginTime) {
+		t.Errorf("FirstLoginTime = %v, want %v", got.FirstLoginTime, want.FirstLoginTime)
+	}
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// sqlUserLister runs user filters on the SQL storages, where the user records are JSON
+// in the `data` column.
+type sqlUserLister struct {
+	db        *sql.DB
+	tableName string
+	pgsql     bool
+	codec     *recordCodec
+	records   sqlRecords
+	namespace string
+}
+
+func (sl *sqlUserLister) listUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	if !sl.codec.queryable() {
+		// The records can't be queried in the database, so only the e-mail domain is
+		// filtered there.
+		return sl.scanUsers(filter)
+	}
+	where, args := sl.where(filter)
+	if sl.namespace != "" {
+		where = append(where, "namespace = ?")
+		args = append(args, sl.namespace)
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s", sl.records.columns(), sl.tableName)
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id"
+	if filter.Limit > 0 {
+		// One more, to know if there's a next page
+		q += " LIMIT ?"
+		args = append(args, filter.Limit+1)
+	} else if filter.Offset > 0 && !sl.pgsql {
+		q += " LIMIT -1" // SQLite needs a LIMIT with OFFSET
+	}
+	if filter.Offset > 0 {
+		q += " OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+	users, err := sl.queryUsers(q, args)
+	if err != nil {
+		return
+	}
+	page.NextOffset = -1
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+		page.NextOffset = filter.Offset + filter.Limit
+	}
+	page.Users = users
+	return page, nil
+}
+
+// where returns the SQL conditions for the filter, using the database's JSON functions.
+func (sl *sqlUserLister) where(filter gomagiclink.UserFilter) (where []string, args []any) {
+	field := func(name string) string {
+		if sl.pgsql {
+			return "(data::jsonb->>'" + name + "')"
+		}
+		return "json_extract(data, '$." + name + "')"
+	}
+	if filter.Enabled != nil {
+		if sl.pgsql {
+			where = append(where, field("enabled")+"::boolean = ?")
+		} else {
+			where = append(where, field("enabled")+" = ?")
+		}
+		args = append(args, *filter.Enabled)
+	}
+	for _, bound := range []struct {
+		t  time.Time
+		op string
+	}{{filter.CreatedSince, ">="}, {filter.CreatedUntil, "<"}} {
+		if bound.t.IsZero() {
+			continue
+		}
+		if sl.pgsql {
+			where = append(where, field("created_at")+"::timestamptz "+bound.op+" ?")
+			args = append(args, bound.t)
+		} else {
+			// Timestamps with different time zones and precisions can't be compared as strings
+			where = append(where, "julianday("+field("created_at")+") "+bound.op+" julianday(?)")
+			args = append(args, bound.t.UTC().Format(time.RFC3339Nano))
+		}
+	}
+	if filter.EmailDomain != "" {
+		if sl.pgsql {
+			where = append(where, "split_part(email, '@', 2) = ?")
+		} else {
+			where = append(where, "substr(email, instr(email, '@') + 1) = ?")
+		}
+		args = append(args, filter.EmailDomain)
+	}
+	for _, bound := range []struct {
+		level *int
+		op    string
+	}{{filter.MinAccessLevel, ">="}, {filter.MaxAccessLevel, "<="}} {
+		if bound.level == nil {
+			continue
+		}
+		if sl.pgsql {
+			where = append(where, field("access_level")+"::int "+bound.op+" ?")
+		} else {
+			where = append(where, field("access_level")+" "+bound.op+" ?")
+		}
+		args = append(args, *bound.level)
+	}
+	for key, value := range filter.CustomData {
+		if sl.pgsql {
+			where = append(where, "data::jsonb->'custom_data'->>? = ?")
+			args = append(args, key, value)
+		} else {
+			// The keys are validated not to contain quotes
+			where = append(where, "json_extract(data, ?) = ?")
+			args = append(args, `$.custom_data."`+key+`"`, value)
+		}
+	}
+	return
+}
+
+// scanUsers reads all the records in the e-mail domain (or all of them), and filters
+// them in memory.
+func (sl *sqlUserLister) scanUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	q := fmt.Sprintf("SELECT %s FROM %s", sl.records.columns(), sl.tableName)
+	where, args := sl.where(gomagiclink.UserFilter{EmailDomain: filter.EmailDomain})
+	if sl.namespace != "" {
+		where = append(where, "namespace = ?")
+		args = append(args, sl.namespace)
+	}
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	users, err := sl.queryUsers(q, args)
+	if err != nil {
+		return
+	}
+	return gomagiclink.FilterUsers(users, filter), nil
+}
+
+func (sl *sqlUserLister) queryUsers(q string, args []any) (users []*gomagiclink.AuthUserRecord, err error) {
+	if sl.pgsql {
+		q = pgPlaceholders(q)
+	}
+	rows, err := sl.db.Query(q, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r sqlRecord
+		if err = rows.Scan(sl.records.dest(&r)...); err != nil {
+			return
+		}
+		user, err := sl.codec.unmarshal(r.bytes())
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// ListUsers returns the users matching the filter, ordered by ID. The filter runs in
+// the database using the JSON functions, unless the records are encrypted or not stored
+// as JSON (see SetRecordCodec()), in which case they're all read and filtered in memory.
+func (st *SQLiteStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	defer st.errs.track(&err)
+	sl := sqlUserLister{db: st.db, tableName: st.tableName, codec: &st.codec, records: st.records, namespace: st.ns.name}
+	return sl.listUsers(filter)
+}
+
+// ListUsers returns the users matching the filter, ordered by ID. The filter runs in
+// the database using the JSONB operators, unless the records are encrypted or not stored
+// as JSON (see SetRecordCodec()), in which case they're all read and filtered in memory.
+func (st *PgSQLStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	defer st.errs.track(&err)
+	db, _ := st.readDB()
+	sl := sqlUserLister{db: db, tableName: st.tableName, pgsql: true, codec: &st.codec, records: st.records, namespace: st.ns.name}
+	return sl.listUsers(filter)
+}
+
+// ListUsers queries all the shards for the first Offset+Limit matching users, and
+// merges the results.
+func (st *ShardedPgSQLStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	shardFilter := filter.Page(0, 0)
+	if filter.Limit > 0 {
+		shardFilter.Limit = filter.Offset + filter.Limit
+	}
+	var users []*gomagiclink.AuthUserRecord
+	more := false
+	for _, shard := range st.shards {
+		shardPage, err := shard.ListUsers(shardFilter)
+		if err != nil {
+			return page, err
+		}
+		users = append(users, shardPage.Users...)
+		more = more || shardPage.NextOffset >= 0
+	}
+	page = gomagiclink.FilterUsers(users, filter)
+	if more && page.NextOffset < 0 && len(page.Users) == filter.Limit {
+		page.NextOffset = filter.Offset + filter.Limit
+	}
+	return page, nil
+}
+
+// ListUsers reads all the user records and filters them in memory. With
+// SetRescanOnMiss(), the directory is rescanned first, if the interval has passed.
+func (fss *FileSystemStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	fss.rescan()
+	var users []*gomagiclink.AuthUserRecord
+	for _, fileName := range fss.fileNames() {
+		user, err := fss.getUserFromFileName(fileName)
+		if os.IsNotExist(err) {
+			// Deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return page, err
+		}
+		users = append(users, user)
+	}
+	return gomagiclink.FilterUsers(users, filter), nil
+}
+
+// ListUsers reads all the user entities and filters them in memory.
+func (st *AzureTableStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	defer st.errs.track(&err)
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	var users []*gomagiclink.AuthUserRecord
+	var decodeErr error
+	err = st.queryEntities(st.userFilter(), "", func(entity *azureUserEntity) bool {
+		var user *gomagiclink.AuthUserRecord
+		if user, decodeErr = st.codec.unmarshal([]byte(entity.Data)); decodeErr != nil {
+			return false
+		}
+		users = append(users, user)
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return
+	}
+	return gomagiclink.FilterUsers(users, filter), nil
+}
+
+// ListUsers lists the users from the inner storage, if it's a gomagiclink.UserLister.
+func (st *ResilientStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	ul, ok := st.inner.(gomagiclink.UserLister)
+	if !ok {
+		return gomagiclink.UserPage{NextOffset: -1}, gomagiclink.ErrUserListingNotSupported
+	}
+	err = st.do(func() (err error) {
+		page, err = ul.ListUsers(filter)
+		return
+	})
+	return
+}
+
+// ListUsers reads all the user records and filters them in memory.
+func (st *RESTStorage) ListUsers(filter gomagiclink.UserFilter) (page gomagiclink.UserPage, err error) {
+	defer st.errs.track(&err)
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	prefix := st.prefix + "user:"
+	var users []*gomagiclink.AuthUserRecord
+	var readErr error
+	err = st.listKeys(prefix, func(key string) bool {
+		id, err := uuid.Parse(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			return true // Not a user record
+		}
+		user, err := st.getUserById(id)
+		if err == gomagiclink.ErrUserNotFound {
+			return true // Deleted while listing
+		}
+		if err != nil {
+			readErr = err
+			return false
+		}
+		users = append(users, user)
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return
+	}
+	return gomagiclink.FilterUsers(users, filter), nil
+}
@@ -0,0 +1,79 @@
+package gomagiclink
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// sessionEpochSeparator separates the user's TokenEpoch from the expiration time in
+// signed session IDs. It's omitted for epoch 0, so session IDs issued before there was
+// an epoch stay valid.
+const sessionEpochSeparator = "~"
+
+// sessionExpTimePart formats the expiration time part of a signed session ID.
+func sessionExpTimePart(expTime int, epoch int) string {
+	if epoch == 0 {
+		return strconv.Itoa(expTime)
+	}
+	return strconv.Itoa(expTime) + sessionEpochSeparator + strconv.Itoa(epoch)
+}
+
+// parseSessionExpTimePart parses the expiration time part of a signed session ID.
+func parseSessionExpTimePart(s string) (expTime int, epoch int, err error) {
+	expTimeStr, epochStr, found := strings.Cut(s, sessionEpochSeparator)
+	if expTime, err = strconv.Atoi(expTimeStr); err != nil {
+		return
+	}
+	if found {
+		if epoch, err = strconv.Atoi(epochStr); err == nil && epoch <= 0 {
+			err = ErrInvalidSessionId
+		}
+	}
+	return
+}
+
+// InvalidateUserTokens increments the user's TokenEpoch, which is embedded in their
+// sessions, e.g. to log them out everywhere when their account may be compromised. The
+// sessions issued before are rejected with ErrInvalidSessionId when they're verified,
+// without a revocation list. It also removes the user's server-side sessions, refresh
+// tokens and API tokens, which don't embed the epoch. It's recorded in the audit log.
+// The epoch is incremented on the stored record, and writes of the user's records loaded
+// before don't decrement it (see UpdateUser()).
+//
+// Checking the epoch needs the user record, so like disabling the user, it doesn't
+// affect VerifySessionIdLight() and VerifySessionIdClaims(), and encrypted sessions
+// while their snapshot is fresh (see WithEncryptedSessions()).
+func (mlc *AuthMagicLinkController) InvalidateUserTokens(id uuid.UUID) (err error) {
+	user, err := mlc.modifyUser(id, func(user *AuthUserRecord) error {
+		user.TokenEpoch++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if mlc.sessionStore != nil {
+		if err = mlc.sessionStore.RemoveUserSessions(id); err != nil {
+			return
+		}
+	}
+	if mlc.refreshTokenStore != nil {
+		if err = mlc.refreshTokenStore.RemoveUserRefreshTokens(id); err != nil {
+			return
+		}
+	}
+	if mlc.apiTokenStore != nil {
+		if err = mlc.apiTokenStore.RemoveUserAPITokens(id); err != nil {
+			return
+		}
+	}
+	mlc.audit(AuditEvent{Type: AuditSessionRevoked, UserID: user.ID, Email: user.Email, Details: map[string]string{"scope": "epoch", "epoch": strconv.Itoa(user.TokenEpoch)}})
+	return nil
+}
+
+// epochValid returns true if the session was issued in the user's current TokenEpoch.
+// Server-side sessions don't embed it, as InvalidateUserTokens() removes them.
+func (claims *sessionClaims) epochValid(user *AuthUserRecord) bool {
+	return claims.Stored || claims.Epoch == user.TokenEpoch
+}
@@ -0,0 +1,227 @@
+package gomagiclink_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+// testControllerOptions are the controller configurations which write the user records
+// differently.
+var testControllerOptions = []struct {
+	name string
+	opts []gomagiclink.ControllerOption
+}{
+	{"plain", nil},
+	{"user cache", []gomagiclink.ControllerOption{gomagiclink.WithUserCache(time.Minute)}},
+	{"write-behind", []gomagiclink.ControllerOption{gomagiclink.WithWriteBehind(time.Millisecond)}},
+}
+
+// newTestController returns a controller with a file system storage, and a stored user.
+func newTestController(t *testing.T, opts ...gomagiclink.ControllerOption) (*gomagiclink.AuthMagicLinkController, *storage.FileSystemStorage, *gomagiclink.AuthUserRecord) {
+	t.Helper()
+	db, err := storage.NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mlc, err := gomagiclink.NewAuthMagicLinkController(newTestSecretKey(t), time.Hour, time.Hour, db, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mlc.Close() })
+	user, err := gomagiclink.NewAuthUserRecord("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return mlc, db, user
+}
+
+// TestStaleWritesKeepTokenEpoch writes user records loaded before the user's tokens were
+// invalidated, concurrently with it, and checks that the epoch isn't decreased.
+func TestStaleWritesKeepTokenEpoch(t *testing.T) {
+	for _, tc := range testControllerOptions {
+		t.Run(tc.name, func(t *testing.T) {
+			mlc, db, user := newTestController(t, tc.opts...)
+			sessionId, err := mlc.GenerateSessionId(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale, err := mlc.GetUserById(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const writers, writes = 8, 50
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					<-start
+					for i := 0; i < writes; i++ {
+						rec := *stale
+						rec.CustomData = map[string]string{"writer": strconv.Itoa(w), "write": strconv.Itoa(i)}
+						store := mlc.StoreUser
+						if i%2 == 1 {
+							store = mlc.UpdateUser
+						}
+						if err := store(&rec); err != nil {
+							t.Errorf("writing a stale record: %v", err)
+							return
+						}
+					}
+				}(w)
+			}
+			close(start)
+			if err = mlc.InvalidateUserTokens(user.ID); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+			// One more, surely after the invalidation
+			rec := *stale
+			rec.CustomData = map[string]string{"writer": "last"}
+			if err = mlc.StoreUser(&rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.TokenEpoch != 1 {
+				t.Errorf("stale record's TokenEpoch after StoreUser = %d, want the stored 1", rec.TokenEpoch)
+			}
+			if err = mlc.FlushWrites(); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := db.GetUserById(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.TokenEpoch != 1 {
+				t.Errorf("TokenEpoch = %d, want 1", stored.TokenEpoch)
+			}
+			if stored.CustomData["writer"] != "last" {
+				t.Errorf("CustomData = %v, want the last write's", stored.CustomData)
+			}
+			if _, err = mlc.VerifySessionId(sessionId); err != gomagiclink.ErrInvalidSessionId {
+				t.Errorf("session issued before InvalidateUserTokens() = %v, want ErrInvalidSessionId", err)
+			}
+		})
+	}
+}
+
+// TestStoreUserSecurityFields checks that the Enabled and lock fields are written as
+// they're set on the record.
+func TestStoreUserSecurityFields(t *testing.T) {
+	for _, tc := range testControllerOptions {
+		t.Run(tc.name, func(t *testing.T) {
+			mlc, db, user := newTestController(t, tc.opts...)
+			sessionId, err := mlc.GenerateSessionId(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(enabled bool, locked bool) {
+				t.Helper()
+				if err := mlc.FlushWrites(); err != nil {
+					t.Fatal(err)
+				}
+				stored, err := db.GetUserById(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Enabled != enabled || stored.IsLocked() != locked {
+					t.Errorf("stored user: enabled %v, locked %v, want %v, %v", stored.Enabled, stored.IsLocked(), enabled, locked)
+				}
+			}
+
+			// Disabling
+			rec, err := mlc.GetUserById(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec.Enabled = false
+			if err = mlc.StoreUser(rec); err != nil {
+				t.Fatal(err)
+			}
+			check(false, false)
+			if _, err = mlc.VerifySessionId(sessionId); err != gomagiclink.ErrUserDisabled {
+				t.Errorf("session of a user disabled with StoreUser() = %v, want ErrUserDisabled", err)
+			}
+			rec.Enabled = true
+			if err = mlc.UpdateUser(rec); err != nil {
+				t.Fatal(err)
+			}
+			check(true, false)
+
+			// Unlocking
+			if err = mlc.LockUser(user.ID, "test", time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			check(true, true)
+			if rec, err = mlc.GetUserById(user.ID); err != nil {
+				t.Fatal(err)
+			}
+			rec.LockedAt, rec.LockedUntil, rec.LockReason = time.Time{}, time.Time{}, ""
+			if err = mlc.StoreUser(rec); err != nil {
+				t.Fatal(err)
+			}
+			check(true, false)
+			if _, err = mlc.VerifySessionId(sessionId); err != nil {
+				t.Errorf("session of a user unlocked with StoreUser(): %v", err)
+			}
+		})
+	}
+}
+
+// TestInvalidateImpersonatorTokens checks that InvalidateUserTokens() on an admin ends
+// the impersonation sessions they issued.
+func TestInvalidateImpersonatorTokens(t *testing.T) {
+	for _, tc := range testControllerOptions {
+		t.Run(tc.name, func(t *testing.T) {
+			mlc, _, user := newTestController(t, tc.opts...)
+			admin, err := gomagiclink.NewAuthUserRecord("admin@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			admin.AccessLevel = 10
+			if err = mlc.CreateUser(admin); err != nil {
+				t.Fatal(err)
+			}
+			// The first one is issued with the admin's epoch 0, and the second with 1
+			for i := 0; i < 2; i++ {
+				if admin, err = mlc.GetUserById(admin.ID); err != nil {
+					t.Fatal(err)
+				}
+				sessionId, err := mlc.GenerateImpersonationSession(admin, user, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				impersonated, err := mlc.VerifySessionId(sessionId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if impersonated.ID != user.ID || impersonated.ImpersonatedBy != admin.ID {
+					t.Fatalf("impersonation session of user %v by %v, want %v by %v", impersonated.ID, impersonated.ImpersonatedBy, user.ID, admin.ID)
+				}
+				if err = mlc.InvalidateUserTokens(admin.ID); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = mlc.VerifySessionId(sessionId); err != gomagiclink.ErrInvalidSessionId {
+					t.Errorf("impersonation session after InvalidateUserTokens() on the admin = %v, want ErrInvalidSessionId", err)
+				}
+				si, err := mlc.IntrospectSession(sessionId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if si.Active {
+					t.Error("impersonation session introspected as active after InvalidateUserTokens() on the admin")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package gomagiclink
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Tokens (challenges and signed session IDs) start with a header describing how they
+// were made, so the format, the keys and the MAC algorithm can change without breaking
+// the tokens already issued:
+//
+//	v1.KEY_ID.ALG.BODY
+//
+// where KEY_ID identifies the secret key (see TokenKeyID()), ALG is the MACAlgorithm
+// number, and BODY is the token in the format it had before headers, starting with its
+// kind ("9" for challenges, "S" for session IDs, etc.).
+//
+// All the tokens are made only of characters which are unreserved in URLs (RFC 3986):
+// letters, digits, ".", "-" and "_", so they're never escaped or broken by e-mail clients
+// and can be put in any part of a URL as they are. See CanonicalToken() for the tokens
+// which were mangled on the way.
+const tokenHeaderPrefix = "v"
+const tokenHeaderSplitChar = "."
+const tokenFormatVersion = 1
+
+var ErrInvalidTokenHeader = errors.New("invalid token header")
+var ErrUnsupportedTokenVersion = errors.New("unsupported token format version")
+var ErrUnknownTokenKey = errors.New("token made with an unknown key")
+
+// TokenHeader is the parsed header of a token, see ParseTokenHeader().
+type TokenHeader struct {
+	Version   int // 0 for tokens without a header, made before headers were introduced
+	KeyID     string
+	Algorithm MACAlgorithm
+}
+
+// ParseTokenHeader parses the header of a challenge or a session ID, without verifying
+// the token, e.g. to find out which key made it. It returns the token's body, which
+// is the whole token for tokens without a header.
+func ParseTokenHeader(token string) (header TokenHeader, body string, err error) {
+	if !strings.HasPrefix(token, tokenHeaderPrefix) {
+		// Headerless tokens start with their kind, an upper-case letter or "9"
+		return header, token, nil
+	}
+	parts := strings.SplitN(token[len(tokenHeaderPrefix):], tokenHeaderSplitChar, 4)
+	if len(parts) != 4 || parts[1] == "" || parts[3] == "" {
+		return header, "", ErrInvalidTokenHeader
+	}
+	if header.Version, err = strconv.Atoi(parts[0]); err != nil || header.Version < 1 {
+		return header, "", ErrInvalidTokenHeader
+	}
+	alg, err := strconv.ParseUint(parts[2], 10, 8)
+	if err != nil {
+		return header, "", ErrInvalidTokenHeader
+	}
+	header.KeyID, header.Algorithm = parts[1], MACAlgorithm(alg)
+	return header, parts[3], nil
+}
+
+// CanonicalToken returns the token with the characters which can't be part of it removed:
+// whitespace, line breaks (including quoted-printable soft line breaks, "=" at the end of
+// a line) and "=" padding, which some e-mail clients and older encoders add to links. The
+// controller verifies tokens in their canonical form, and uses it to identify them (e.g.
+// in ChallengeID()), so a mangled copy of a token is the same token, and can't be used
+// to replay it. Canonical tokens are returned unchanged.
+func CanonicalToken(token string) string {
+	if !strings.ContainsAny(token, "= \t\r\n") {
+		return token
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '=', ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, token)
+}
+
+// WithoutTokenHeaders makes the controller generate tokens without the header, as
+// before headers were introduced. Use it during a rolling upgrade, until all the
+// instances verifying the tokens understand headers. Tokens with headers are still
+// verified.
+func WithoutTokenHeaders() ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.disableTokenHeaders = true
+	}
+}
+
+// TokenKeyID returns the ID of the secret key in the token headers. It's derived from
+// the secret key, and doesn't reveal anything about it.
+func (mlc *AuthMagicLinkController) TokenKeyID() string {
+	return mlc.keys.id
+}
+
+// sealToken prefixes the token body with the header.
+func (mlc *AuthMagicLinkController) sealToken(body string) string {
+	if mlc.disableTokenHeaders {
+		return body
+	}
+	return tokenHeaderPrefix + strconv.Itoa(tokenFormatVersion) + tokenHeaderSplitChar +
+		mlc.keys.id + tokenHeaderSplitChar +
+		strconv.Itoa(int(mlc.macAlgorithm)) + tokenHeaderSplitChar + body
+}
+
+// openToken checks the token's header, and returns its canonical body. Tokens without
+// a header are passed through. The body's MAC must have been made with the algorithm named in
+// the header; it's verified by the caller.
+func (mlc *AuthMagicLinkController) openToken(token string) (body string, err error) {
+	header, body, err := ParseTokenHeader(CanonicalToken(token))
+	if err != nil || header.Version == 0 {
+		return body, err
+	}
+	if header.Version != tokenFormatVersion {
+		mlc.logger.Warn("Token with an unsupported format version", "version", header.Version)
+		return "", ErrUnsupportedTokenVersion
+	}
+	if header.KeyID != mlc.keys.id {
+		// Most likely made with a previous secret key
+		mlc.logger.Warn("Token made with an unknown key", "key_id", header.KeyID)
+		return "", ErrUnknownTokenKey
+	}
+	// The MAC is the last part of all the token bodies
+	mac, err := decodeFromString(body[strings.LastIndexAny(body, "-"+sesionIdSplitChar)+1:])
+	if err != nil {
+		return "", ErrInvalidTokenHeader
+	}
+	if alg, ok := tokenMACAlgorithm(mac); !ok || alg != header.Algorithm {
+		return "", ErrInvalidTokenHeader
+	}
+	return body, nil
+}
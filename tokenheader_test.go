@@ -0,0 +1,233 @@
+package gomagiclink_test
+
+import (
+	"crypto/rand"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+	"github.com/ivoras/gomagiclink/storage"
+)
+
+// testToken is a token of one kind, with the function verifying it.
+type testToken struct {
+	name      string
+	token     string
+	verify    func(token string) error
+	singleUse bool // Verifying the token consumes it
+}
+
+type testClaimsProvider struct{}
+
+func (testClaimsProvider) SessionClaims(user *gomagiclink.AuthUserRecord) (any, error) {
+	return map[string]string{"plan": "pro"}, nil
+}
+
+func newTestSecretKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newTestProofJWK returns a new EC P-256 public key in the JWK format, and its thumbprint.
+func newTestProofJWK(t *testing.T) (jwk []byte, thumbprint string) {
+	t.Helper()
+	jwk = newTestProofKey(t).jwk
+	thumbprint, err := gomagiclink.ProofKeyThumbprint(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwk, thumbprint
+}
+
+// issueTestTokens issues a token of every kind.
+func issueTestTokens(t *testing.T) []testToken {
+	t.Helper()
+	db, err := storage.NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey := newTestSecretKey(t)
+	newController := func(opts ...gomagiclink.ControllerOption) *gomagiclink.AuthMagicLinkController {
+		mlc, err := gomagiclink.NewAuthMagicLinkController(secretKey, time.Hour, time.Hour, db, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mlc
+	}
+	usedTokens := gomagiclink.NewMemoryUsedTokenStore()
+	mlc := newController(
+		gomagiclink.WithSingleUseChallenges(usedTokens),
+		gomagiclink.WithProofOfPossession(0),
+		gomagiclink.WithAPITokens(gomagiclink.NewMemoryAPITokenStore()),
+		gomagiclink.WithRefreshTokens(gomagiclink.NewMemoryRefreshTokenStore(), time.Hour),
+	)
+	hashed := newController(gomagiclink.WithSingleUseChallenges(usedTokens), gomagiclink.WithHashedEmailChallenges())
+	stored := newController(gomagiclink.WithSessionStore(gomagiclink.NewMemorySessionStore()))
+	encrypted := newController(gomagiclink.WithEncryptedSessions(time.Minute))
+	claims := newController(gomagiclink.WithClaimsProvider(testClaimsProvider{}))
+	legacy := newController(gomagiclink.WithSingleUseChallenges(usedTokens), gomagiclink.WithoutTokenHeaders())
+	stateless, err := gomagiclink.NewStatelessController(secretKey, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := gomagiclink.NewAuthUserRecord("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := gomagiclink.NewAuthUserRecord("admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.AccessLevel = 10
+	for _, u := range []*gomagiclink.AuthUserRecord{user, admin} {
+		if err = mlc.StoreUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := *user
+	pending.TOTPPending = true
+	jwk, thumbprint := newTestProofJWK(t)
+	bound := *user
+	bound.ProofKeyThumbprint = thumbprint
+
+	must := func(token string, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	userOnly := func(_ *gomagiclink.AuthUserRecord, err error) error { return err }
+	emailOnly := func(_ string, err error) error { return err }
+	verifySession := func(mlc *gomagiclink.AuthMagicLinkController) func(string) error {
+		return func(token string) error { return userOnly(mlc.VerifySessionId(token)) }
+	}
+	verifyChallenge := func(mlc *gomagiclink.AuthMagicLinkController) func(string) error {
+		return func(token string) error { return userOnly(mlc.VerifyChallenge(token)) }
+	}
+
+	boundChallenge, _, err := mlc.GenerateChallengeWithProofKey(user.Email, jwk, gomagiclink.ChallengeMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiToken, _, err := mlc.GenerateAPIToken(user, "test", []string{"read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []testToken{
+		{"challenge", must(mlc.GenerateChallenge(user.Email)), verifyChallenge(mlc), true},
+		{"hashed challenge", must(hashed.GenerateChallenge(user.Email)), func(token string) error {
+			return userOnly(hashed.VerifyChallengeForEmail(token, user.Email, gomagiclink.RiskInfo{}))
+		}, true},
+		{"bound challenge", boundChallenge, verifyChallenge(mlc), true},
+		{"session", must(mlc.GenerateSessionId(user)), verifySession(mlc), false},
+		{"stored session", must(stored.GenerateSessionId(user)), verifySession(stored), false},
+		{"encrypted session", must(encrypted.GenerateSessionId(user)), verifySession(encrypted), false},
+		{"claims session", must(claims.GenerateSessionId(user)), verifySession(claims), false},
+		{"impersonation session", must(mlc.GenerateImpersonationSession(admin, user, time.Minute)), verifySession(mlc), false},
+		{"pending TOTP session", must(mlc.GenerateSessionId(&pending)), func(token string) error {
+			return userOnly(mlc.VerifyPendingTOTPSession(token))
+		}, false},
+		{"bound session", must(mlc.GenerateSessionId(&bound)), func(token string) error {
+			// Verified without a proof, so the token itself is valid if only the proof is missing
+			if err := userOnly(mlc.VerifySessionId(token)); err != gomagiclink.ErrProofRequired {
+				return err
+			}
+			return nil
+		}, false},
+		{"refresh token", must(mlc.GenerateRefreshToken(user)), func(token string) error {
+			_, _, _, err := mlc.ExchangeRefreshToken(token)
+			return err
+		}, true},
+		{"API token", apiToken, func(token string) error { return userOnly(mlc.VerifyAPIToken(token)) }, false},
+		{"stateless challenge", must(stateless.GenerateChallenge(user.Email)), func(token string) error {
+			return emailOnly(stateless.VerifyChallenge(token))
+		}, false},
+		{"stateless session", must(stateless.GenerateSessionId(user.Email)), func(token string) error {
+			return emailOnly(stateless.VerifySessionId(token))
+		}, false},
+		{"headerless challenge", must(legacy.GenerateChallenge(user.Email)), verifyChallenge(legacy), true},
+		{"headerless session", must(legacy.GenerateSessionId(user)), verifySession(legacy), false},
+	}
+}
+
+func TestCanonicalToken(t *testing.T) {
+	for _, tt := range issueTestTokens(t) {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if got := gomagiclink.CanonicalToken(token); got != token {
+				t.Fatalf("CanonicalToken(%q) = %q, want it unchanged", token, got)
+			}
+			if escaped := url.QueryEscape(token); escaped != token {
+				t.Errorf("QueryEscape(%q) = %q, want it unchanged", token, escaped)
+			}
+			if escaped := url.PathEscape(token); escaped != token {
+				t.Errorf("PathEscape(%q) = %q, want it unchanged", token, escaped)
+			}
+			if unescaped, err := url.QueryUnescape(url.QueryEscape(token)); err != nil || unescaped != token {
+				t.Errorf("QueryUnescape(QueryEscape(%q)) = %q, %v", token, unescaped, err)
+			}
+
+			// Changing the case makes a different token, which is rejected
+			header := ""
+			if h, body, err := gomagiclink.ParseTokenHeader(token); err == nil && h.Version > 0 {
+				header = strings.TrimSuffix(token, body)
+			}
+			upperBody := header + strings.ToUpper(strings.TrimPrefix(token, header))
+			for _, mangled := range []string{strings.ToLower(token), strings.ToUpper(token), upperBody} {
+				if mangled == token {
+					continue
+				}
+				if got := gomagiclink.CanonicalToken(mangled); got == token {
+					t.Errorf("CanonicalToken(%q) = the original token", mangled)
+				}
+				if err := tt.verify(mangled); err == nil {
+					t.Errorf("token with the case changed, %q, was accepted", mangled)
+				}
+			}
+
+			half := len(token) / 2
+			mangledCopies := []string{
+				token[:half] + "=\r\n" + token[half:], // Quoted-printable soft line break
+				token[:half] + "\r\n" + token[half:],
+				token[:half] + "\n  " + token[half:],
+				" \t" + token + "\n",
+				token + "==",
+				url.QueryEscape(" " + token[:half] + "\n" + token[half:] + "="),
+			}
+			for i, mangled := range mangledCopies {
+				if i == len(mangledCopies)-1 {
+					unescaped, err := url.QueryUnescape(mangled)
+					if err != nil {
+						t.Fatalf("QueryUnescape(%q): %v", mangled, err)
+					}
+					mangled = unescaped
+				}
+				if got := gomagiclink.CanonicalToken(mangled); got != token {
+					t.Errorf("CanonicalToken(%q) = %q, want %q", mangled, got, token)
+				}
+			}
+
+			// A mangled copy is verified as the token, and it's the same token, so it
+			// can't be used to replay single-use tokens
+			if err := tt.verify(mangledCopies[0]); err != nil {
+				t.Fatalf("verifying a mangled copy of the token: %v", err)
+			}
+			err := tt.verify(token)
+			if tt.singleUse && err == nil {
+				t.Error("the token was accepted again after its mangled copy")
+			}
+			if !tt.singleUse && err != nil {
+				t.Errorf("verifying the token: %v", err)
+			}
+		})
+	}
+}
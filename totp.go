@@ -0,0 +1,367 @@
+package gomagiclink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivoras/gomagiclink/internal/b32"
+)
+
+const totpPendingSessionIdSignature = "T"
+const totpPendingSessionPurpose = "totp-pending-session"
+const totpSecretLength = 20
+const totpPeriod = 30
+const totpDigits = 6
+
+// TOTPPendingSessionDuration is how long a pending 2FA session (see VerifyChallenge())
+// is valid for, i.e. how long the user has to enter the TOTP code.
+const TOTPPendingSessionDuration = 10 * time.Minute
+
+// Defaults for WithTOTPLockout().
+const (
+	DefaultTOTPMaxFailures     = 5
+	DefaultTOTPLockoutDuration = 15 * time.Minute
+)
+
+// totpLockReason is the LockReason of users locked by WithTOTPLockout().
+const totpLockReason = "too many wrong TOTP codes"
+
+var ErrTOTPRequired = errors.New("TOTP code required")
+var ErrTOTPNotEnrolled = errors.New("TOTP not enrolled")
+var ErrInvalidTOTPCode = errors.New("invalid TOTP code")
+
+// Audit event types for TOTP
+const (
+	AuditTOTPEnabled  = "totp.enabled"
+	AuditTOTPDisabled = "totp.disabled"
+	AuditTOTPFailed   = "totp.failed"
+)
+
+// WithTOTPLockout locks the user (see LockUser()) for the duration after maxFailures
+// consecutive wrong codes given to VerifyTOTP() or ConfirmTOTP(), so the 6-digit codes
+// can't be guessed by brute force. By default, the user is locked for
+// DefaultTOTPLockoutDuration after DefaultTOTPMaxFailures wrong codes. A maxFailures of
+// 0 disables the lockout.
+func WithTOTPLockout(maxFailures int, duration time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		mlc.totpMaxFailures = maxFailures
+		mlc.totpLockoutDuration = duration
+	}
+}
+
+// HasTOTP returns true if the user has a confirmed TOTP authenticator enrollment.
+func (aur *AuthUserRecord) HasTOTP() bool {
+	return !aur.TOTPEnabledAt.IsZero()
+}
+
+// totpKey returns the key for encrypting TOTP secrets on the user records.
+func (mlc *AuthMagicLinkController) totpKey() []byte {
+	return mlc.keys.totp
+}
+
+// openTOTPSecret decrypts the user's TOTP secret (the pending one if pending is set).
+// Secrets encrypted with the legacy key are re-encrypted with the current one on the
+// record, to be stored by the caller.
+func (mlc *AuthMagicLinkController) openTOTPSecret(user *AuthUserRecord, pending bool) (secret []byte, err error) {
+	sealed := &user.TOTPSecret
+	if pending {
+		sealed = &user.TOTPPendingSecret
+	}
+	secret, err = openAESGCM(mlc.totpKey(), *sealed, user.ID[:])
+	if err == nil || mlc.keys.legacy == nil {
+		return
+	}
+	secret, legacyErr := openAESGCM(mlc.keys.legacyKey("totp-secret-encryption"), *sealed, user.ID[:])
+	if legacyErr != nil {
+		return nil, err
+	}
+	if *sealed, err = sealAESGCM(mlc.totpKey(), secret, user.ID[:]); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EnrollTOTP starts the enrollment of a TOTP authenticator app (a second factor) for
+// the user. It generates a new secret, stores it encrypted on the user record as the
+// pending secret, and returns it in base32 and as an otpauth:// URL (usually shown as a
+// QR code), with the issuer being the name of the app. The enrollment takes effect when
+// it's confirmed with ConfirmTOTP(); until then, an existing enrollment stays in effect,
+// so starting a new one doesn't turn off the second factor.
+func (mlc *AuthMagicLinkController) EnrollTOTP(user *AuthUserRecord, issuer string) (secret string, otpauthURL string, err error) {
+	rawSecret := make([]byte, totpSecretLength)
+	if _, err = rand.Read(rawSecret); err != nil {
+		return
+	}
+	encrypted, err := sealAESGCM(mlc.totpKey(), rawSecret, user.ID[:])
+	if err != nil {
+		return
+	}
+	user.TOTPPendingSecret = encrypted
+	if err = mlc.StoreUser(user); err != nil {
+		return
+	}
+	secret = b32.EncodeToString(rawSecret)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(issuer + ":" + user.Email)
+	return secret, "otpauth://totp/" + label + "?" + q.Encode(), nil
+}
+
+// ConfirmTOTP completes the enrollment started by EnrollTOTP() by checking a code from
+// the authenticator app, replacing the previous enrollment, if any. From then on,
+// VerifyChallenge() marks the user's logins as pending until VerifyTOTP() is called.
+// Wrong codes are counted as in VerifyTOTP().
+func (mlc *AuthMagicLinkController) ConfirmTOTP(user *AuthUserRecord, code string) (err error) {
+	if user.IsLocked() {
+		return ErrUserLocked
+	}
+	if err = mlc.useTOTPCode(user, code, true); err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditTOTPEnabled, UserID: user.ID, Email: user.Email})
+	return nil
+}
+
+// DisableTOTP removes the user's TOTP enrollment.
+func (mlc *AuthMagicLinkController) DisableTOTP(user *AuthUserRecord) (err error) {
+	user.TOTPSecret = nil
+	user.TOTPPendingSecret = nil
+	user.TOTPEnabledAt = time.Time{}
+	user.TOTPLastStep = 0
+	user.TOTPFailures = 0
+	user.TOTPPending = false
+	if err = mlc.StoreUser(user); err != nil {
+		return
+	}
+	mlc.audit(AuditEvent{Type: AuditTOTPDisabled, UserID: user.ID, Email: user.Email})
+	return nil
+}
+
+// VerifyTOTP checks the code from the user's authenticator app. On success, the
+// TOTPPending field of the record is cleared, so GenerateSessionId() issues a full
+// session. Each code can be used only once, even by concurrent requests. Wrong codes are
+// counted on the record, and too many of them lock the user (see WithTOTPLockout()).
+func (mlc *AuthMagicLinkController) VerifyTOTP(user *AuthUserRecord, code string) (err error) {
+	if !user.HasTOTP() {
+		return ErrTOTPNotEnrolled
+	}
+	if user.IsLocked() {
+		return ErrUserLocked
+	}
+	if err = mlc.useTOTPCode(user, code, false); err != nil {
+		return
+	}
+	user.TOTPPending = false
+	return nil
+}
+
+// useTOTPCode checks the code with checkTOTP() and records its use, or the wrong code,
+// on the user's record. Both are done on the stored record, while holding the user's
+// lock, so a code can't be used by concurrent requests more than once, and concurrent
+// wrong codes are all counted. With pending set, the pending enrollment is confirmed.
+func (mlc *AuthMagicLinkController) useTOTPCode(user *AuthUserRecord, code string, pending bool) error {
+	var codeErr error
+	locked := false
+	stored, err := mlc.modifyUser(user.ID, func(stored *AuthUserRecord) error {
+		if stored.IsLocked() {
+			return ErrUserLocked
+		}
+		step, err := mlc.checkTOTP(stored, code, pending)
+		if err == ErrInvalidTOTPCode {
+			codeErr = err
+			stored.TOTPFailures++
+			if mlc.totpMaxFailures > 0 && stored.TOTPFailures >= mlc.totpMaxFailures {
+				locked = true
+				stored.TOTPFailures = 0
+				stored.LockedAt = time.Now()
+				stored.LockedUntil = stored.LockedAt.Add(mlc.totpLockoutDuration)
+				stored.LockReason = totpLockReason
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pending {
+			stored.TOTPSecret = stored.TOTPPendingSecret
+			stored.TOTPPendingSecret = nil
+			stored.TOTPEnabledAt = time.Now()
+		}
+		stored.TOTPLastStep = step
+		stored.TOTPFailures = 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret, user.TOTPPendingSecret, user.TOTPEnabledAt = stored.TOTPSecret, stored.TOTPPendingSecret, stored.TOTPEnabledAt
+	user.TOTPLastStep, user.TOTPFailures = stored.TOTPLastStep, stored.TOTPFailures
+	user.LockedAt, user.LockedUntil, user.LockReason = stored.LockedAt, stored.LockedUntil, stored.LockReason
+	if codeErr == nil {
+		return nil
+	}
+	mlc.audit(AuditEvent{Type: AuditTOTPFailed, UserID: user.ID, Email: user.Email})
+	if locked {
+		mlc.audit(AuditEvent{Type: AuditUserLocked, UserID: user.ID, Email: user.Email, Details: map[string]string{
+			"reason": totpLockReason,
+			"until":  user.LockedUntil.UTC().Format(time.RFC3339),
+		}})
+	}
+	return codeErr
+}
+
+// checkTOTP checks the code against the current time step and the ones next to it
+// (allowing for clock drift), and returns the matching step. With pending set, it's
+// checked against the pending secret of an enrollment. Steps up to the last used one
+// of the confirmed secret are rejected, so codes can't be replayed.
+func (mlc *AuthMagicLinkController) checkTOTP(user *AuthUserRecord, code string, pending bool) (step int64, err error) {
+	sealed, lastStep := user.TOTPSecret, user.TOTPLastStep
+	if pending {
+		sealed, lastStep = user.TOTPPendingSecret, 0
+	}
+	if len(sealed) == 0 {
+		return 0, ErrTOTPNotEnrolled
+	}
+	secret, err := mlc.openTOTPSecret(user, pending)
+	if err != nil {
+		return 0, err
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, ErrInvalidTOTPCode
+	}
+	now := time.Now().Unix() / totpPeriod
+	for _, step = range []int64{now - 1, now, now + 1} {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidTOTPCode
+}
+
+// totpCode computes the RFC 6238 code for the time step.
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, uint64(step))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// generatePendingTOTPSession creates a short-lived session ID which can only be used
+// with VerifyPendingTOTPSession().
+func (mlc *AuthMagicLinkController) generatePendingTOTPSession(user *AuthUserRecord) (sessionId string, err error) {
+	// Pending TOTP session ID is in the format:
+	// SALT-USER_ID-EXPTIME-HMAC(purpose || SALT || USER_ID || EXPTIME, signingKey)
+	// or for logins bound to a proof key, which the full session is bound to as well:
+	// SALT-USER_ID-EXPTIME-THUMBPRINT-HMAC(purpose || SALT || USER_ID || EXPTIME || THUMBPRINT, signingKey)
+	// EXPTIME includes the user's TokenEpoch, as in session IDs.
+	var proofKey []byte
+	if user.ProofKeyThumbprint != "" {
+		if proofKey, err = proofKeyFromThumbprint(user.ProofKeyThumbprint); err != nil {
+			return
+		}
+	}
+	salt, err := mlc.newSalt()
+	if err != nil {
+		return
+	}
+	expTimeStr := sessionExpTimePart(int(time.Now().Add(TOTPPendingSessionDuration).Unix()), user.TokenEpoch)
+	parts := []string{totpPendingSessionIdSignature + encodeToString(salt), user.ID.String(), expTimeStr}
+	payload := slices.Concat(salt, []byte{0}, user.ID[:], []byte{0}, []byte(expTimeStr))
+	if proofKey != nil {
+		parts = append(parts, encodeToString(proofKey))
+		payload = slices.Concat(payload, []byte{0}, proofKey)
+	}
+	hmac := mlc.SignData(totpPendingSessionPurpose, payload)
+	return mlc.sealToken(strings.Join(append(parts, encodeToString(hmac)), sesionIdSplitChar)), nil
+}
+
+// VerifyPendingTOTPSession verifies a pending 2FA session ID, which GenerateSessionId()
+// returns for users with the TOTPPending field set, and returns the user record with
+// TOTPPending set. Pass it to VerifyTOTP() with the code the user entered, and then
+// generate a full session with GenerateSessionId(). VerifySessionId() rejects pending
+// 2FA sessions with ErrTOTPRequired.
+func (mlc *AuthMagicLinkController) VerifyPendingTOTPSession(sessionId string) (user *AuthUserRecord, err error) {
+	if sessionId, err = mlc.openToken(sessionId); err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	if !strings.HasPrefix(sessionId, totpPendingSessionIdSignature) {
+		return nil, ErrInvalidSessionId
+	}
+	parts := strings.Split(sessionId[len(totpPendingSessionIdSignature):], sesionIdSplitChar)
+	if len(parts) != 4 && len(parts) != 5 {
+		return nil, ErrInvalidSessionId
+	}
+	salt, err := decodeFromString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	if err = mlc.checkAudience(salt); err != nil {
+		return nil, err
+	}
+	userId, err := parseTokenUUID(parts[1])
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	expTime, epoch, err := parseSessionExpTimePart(parts[2])
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	if mlc.isExpired(expTime) {
+		return nil, ErrExpiredSessionId
+	}
+	payload := slices.Concat(salt, []byte{0}, userId[:], []byte{0}, []byte(parts[2]))
+	var proofKey []byte
+	if len(parts) == 5 {
+		proofKey, err = decodeFromString(parts[3])
+		if err != nil || len(proofKey) != proofKeyThumbprintLength {
+			return nil, ErrInvalidSessionId
+		}
+		payload = slices.Concat(payload, []byte{0}, proofKey)
+	}
+	hmac1, err := decodeFromString(parts[len(parts)-1])
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+	if !mlc.VerifyData(totpPendingSessionPurpose, payload, hmac1) {
+		return nil, ErrBrokenSessionId
+	}
+	user, err = mlc.getUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if !user.Enabled {
+		return nil, ErrUserDisabled
+	}
+	if user.IsLocked() {
+		return nil, ErrUserLocked
+	}
+	if epoch != user.TokenEpoch {
+		return nil, ErrInvalidSessionId
+	}
+	user.TOTPPending = user.HasTOTP()
+	if proofKey != nil {
+		user.ProofKeyThumbprint = base64.RawURLEncoding.EncodeToString(proofKey)
+	}
+	return user, nil
+}
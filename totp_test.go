@@ -0,0 +1,189 @@
+package gomagiclink_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivoras/gomagiclink"
+)
+
+// testTOTPCode computes the code of the base32 secret returned by EnrollTOTP(), as an
+// authenticator app would, for the time step offset from the current one.
+func testTOTPCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, uint64(time.Now().Unix()/30+offset))
+	sum := mac.Sum(nil)
+	offs := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offs:])&0x7fffffff)%1000000)
+}
+
+// newTestTOTPUser returns a controller with a user enrolled in TOTP, and the secret.
+func newTestTOTPUser(t *testing.T, opts ...gomagiclink.ControllerOption) (*gomagiclink.AuthMagicLinkController, *gomagiclink.AuthUserRecord, string) {
+	t.Helper()
+	mlc, _, user := newTestController(t, opts...)
+	secret, _, err := mlc.EnrollTOTP(user, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.ConfirmTOTP(user, testTOTPCode(t, secret, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if !user.HasTOTP() {
+		t.Fatal("HasTOTP() = false after ConfirmTOTP()")
+	}
+	return mlc, user, secret
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	for _, tc := range testControllerOptions {
+		t.Run(tc.name, func(t *testing.T) {
+			// Replayed codes are counted as wrong codes, so the lockout is disabled
+			opts := append([]gomagiclink.ControllerOption{gomagiclink.WithTOTPLockout(0, 0)}, tc.opts...)
+			mlc, user, secret := newTestTOTPUser(t, opts...)
+			// The code used to confirm the enrollment
+			if err := mlc.VerifyTOTP(user, testTOTPCode(t, secret, 0)); err != gomagiclink.ErrInvalidTOTPCode {
+				t.Errorf("VerifyTOTP() with the code used by ConfirmTOTP() = %v, want ErrInvalidTOTPCode", err)
+			}
+
+			// The next code, by concurrent requests with their own copies of the record
+			code := testTOTPCode(t, secret, 1)
+			const requests = 8
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			accepted := 0
+			start := make(chan struct{})
+			for i := 0; i < requests; i++ {
+				rec, err := mlc.GetUserById(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					err := mlc.VerifyTOTP(rec, code)
+					mu.Lock()
+					defer mu.Unlock()
+					switch err {
+					case nil:
+						accepted++
+					case gomagiclink.ErrInvalidTOTPCode:
+					default:
+						t.Errorf("VerifyTOTP(): %v", err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			if accepted != 1 {
+				t.Errorf("the code was accepted %d times, want once", accepted)
+			}
+			if err := mlc.VerifyTOTP(user, code); err != gomagiclink.ErrInvalidTOTPCode {
+				t.Errorf("VerifyTOTP() with a used code = %v, want ErrInvalidTOTPCode", err)
+			}
+		})
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	const maxFailures = 3
+	wrongCode := func(t *testing.T, secret string) string {
+		t.Helper()
+		for i := 0; ; i++ {
+			code := fmt.Sprintf("%06d", i)
+			if code != testTOTPCode(t, secret, -1) && code != testTOTPCode(t, secret, 0) && code != testTOTPCode(t, secret, 1) {
+				return code
+			}
+		}
+	}
+	checkLocked := func(t *testing.T, mlc *gomagiclink.AuthMagicLinkController, user *gomagiclink.AuthUserRecord) {
+		t.Helper()
+		stored, err := mlc.GetUserById(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.IsLocked() || !user.IsLocked() {
+			t.Errorf("locked: stored %v, record %v, want locked", stored.IsLocked(), user.IsLocked())
+		}
+	}
+
+	t.Run("VerifyTOTP", func(t *testing.T) {
+		mlc, user, secret := newTestTOTPUser(t, gomagiclink.WithTOTPLockout(maxFailures, time.Hour))
+		for i := 0; i < maxFailures; i++ {
+			if err := mlc.VerifyTOTP(user, wrongCode(t, secret)); err != gomagiclink.ErrInvalidTOTPCode {
+				t.Fatalf("VerifyTOTP() with a wrong code = %v, want ErrInvalidTOTPCode", err)
+			}
+		}
+		checkLocked(t, mlc, user)
+		if err := mlc.VerifyTOTP(user, testTOTPCode(t, secret, 1)); err != gomagiclink.ErrUserLocked {
+			t.Errorf("VerifyTOTP() of a locked user = %v, want ErrUserLocked", err)
+		}
+	})
+
+	t.Run("ConfirmTOTP", func(t *testing.T) {
+		mlc, _, user := newTestController(t, gomagiclink.WithTOTPLockout(maxFailures, time.Hour))
+		secret, _, err := mlc.EnrollTOTP(user, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < maxFailures; i++ {
+			if err = mlc.ConfirmTOTP(user, wrongCode(t, secret)); err != gomagiclink.ErrInvalidTOTPCode {
+				t.Fatalf("ConfirmTOTP() with a wrong code = %v, want ErrInvalidTOTPCode", err)
+			}
+		}
+		checkLocked(t, mlc, user)
+		if err = mlc.ConfirmTOTP(user, testTOTPCode(t, secret, 0)); err != gomagiclink.ErrUserLocked {
+			t.Errorf("ConfirmTOTP() of a locked user = %v, want ErrUserLocked", err)
+		}
+		if user.HasTOTP() {
+			t.Error("HasTOTP() = true after a failed ConfirmTOTP()")
+		}
+	})
+
+	t.Run("reset on success", func(t *testing.T) {
+		mlc, user, secret := newTestTOTPUser(t, gomagiclink.WithTOTPLockout(maxFailures, time.Hour))
+		for i := 0; i < maxFailures-1; i++ {
+			if err := mlc.VerifyTOTP(user, wrongCode(t, secret)); err != gomagiclink.ErrInvalidTOTPCode {
+				t.Fatalf("VerifyTOTP() with a wrong code = %v, want ErrInvalidTOTPCode", err)
+			}
+		}
+		if err := mlc.VerifyTOTP(user, testTOTPCode(t, secret, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := mlc.VerifyTOTP(user, wrongCode(t, secret)); err != gomagiclink.ErrInvalidTOTPCode {
+			t.Fatalf("VerifyTOTP() with a wrong code = %v, want ErrInvalidTOTPCode", err)
+		}
+		if user.IsLocked() || user.TOTPFailures != 1 {
+			t.Errorf("after a success and a wrong code: locked %v, failures %d, want unlocked, 1", user.IsLocked(), user.TOTPFailures)
+		}
+	})
+}
+
+func TestPendingTOTPSessionInvalidated(t *testing.T) {
+	mlc, user, _ := newTestTOTPUser(t)
+	user.TOTPPending = true
+	sessionId, err := mlc.GenerateSessionId(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mlc.VerifyPendingTOTPSession(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.InvalidateUserTokens(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mlc.VerifyPendingTOTPSession(sessionId); err != gomagiclink.ErrInvalidSessionId {
+		t.Errorf("pending session issued before InvalidateUserTokens() = %v, want ErrInvalidSessionId", err)
+	}
+}
@@ -0,0 +1,24 @@
+package gomagiclink
+
+import "testing"
+
+// TestTOTPCode checks totpCode() against the SHA1 test vectors of RFC 6238, Appendix B,
+// truncated to 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if code := totpCode(secret, tc.time/totpPeriod); code != tc.code {
+			t.Errorf("totpCode() at %d = %s, want %s", tc.time, code, tc.code)
+		}
+	}
+}
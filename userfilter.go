@@ -0,0 +1,176 @@
+package gomagiclink
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrUserListingNotSupported = errors.New("storage doesn't support listing users")
+var ErrInvalidUserFilter = errors.New("invalid user filter")
+
+// UserFilter selects users in ListUsersByFilter(). Zero-valued fields don't filter.
+// It can be built with the Where*() methods, e.g.:
+//
+//	filter := gomagiclink.UserFilter{}.WhereEnabled(true).WhereEmailDomain("example.com").Page(0, 50)
+type UserFilter struct {
+	Enabled        *bool             // Only enabled or disabled users
+	CreatedSince   time.Time         // Users created at or after this time
+	CreatedUntil   time.Time         // Users created before this time
+	EmailDomain    string            // Users with e-mail addresses in this domain (not including subdomains)
+	MinAccessLevel *int              // Users with at least this AccessLevel
+	MaxAccessLevel *int              // Users with at most this AccessLevel
+	CustomData     map[string]string // Users with these CustomData values; SQL storages query them with JSON functions
+	Offset         int               // Number of matching users to skip, for pagination
+	Limit          int               // Maximum number of users to return, 0 for no limit
+}
+
+// WhereEnabled selects only enabled or only disabled users.
+func (uf UserFilter) WhereEnabled(enabled bool) UserFilter {
+	uf.Enabled = &enabled
+	return uf
+}
+
+// WhereCreatedBetween selects users created in the [since, until) range. Either can be zero.
+func (uf UserFilter) WhereCreatedBetween(since time.Time, until time.Time) UserFilter {
+	uf.CreatedSince = since
+	uf.CreatedUntil = until
+	return uf
+}
+
+// WhereEmailDomain selects users with e-mail addresses in the domain.
+func (uf UserFilter) WhereEmailDomain(domain string) UserFilter {
+	uf.EmailDomain = strings.ToLower(strings.TrimPrefix(domain, "@"))
+	return uf
+}
+
+// WhereAccessLevelAtLeast selects users with AccessLevel >= level.
+func (uf UserFilter) WhereAccessLevelAtLeast(level int) UserFilter {
+	uf.MinAccessLevel = &level
+	return uf
+}
+
+// WhereAccessLevelAtMost selects users with AccessLevel <= level.
+func (uf UserFilter) WhereAccessLevelAtMost(level int) UserFilter {
+	uf.MaxAccessLevel = &level
+	return uf
+}
+
+// WhereCustomData selects users whose CustomData has the value under the key. Calling it
+// for several keys selects users matching all of them.
+func (uf UserFilter) WhereCustomData(key string, value string) UserFilter {
+	uf.CustomData = maps.Clone(uf.CustomData)
+	if uf.CustomData == nil {
+		uf.CustomData = map[string]string{}
+	}
+	uf.CustomData[key] = value
+	return uf
+}
+
+// Page sets the pagination.
+func (uf UserFilter) Page(offset int, limit int) UserFilter {
+	uf.Offset = offset
+	uf.Limit = limit
+	return uf
+}
+
+// Validate returns ErrInvalidUserFilter for filters which can't be safely run by all
+// the storages, e.g. with negative pagination or quotes in CustomData keys.
+func (uf *UserFilter) Validate() error {
+	if uf.Offset < 0 || uf.Limit < 0 {
+		return ErrInvalidUserFilter
+	}
+	for key := range uf.CustomData {
+		if key == "" || strings.ContainsAny(key, "\"\\") {
+			return ErrInvalidUserFilter
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the user passes the filter (ignoring Offset and Limit).
+func (uf *UserFilter) Matches(user *AuthUserRecord) bool {
+	if uf.Enabled != nil && user.Enabled != *uf.Enabled {
+		return false
+	}
+	if !uf.CreatedSince.IsZero() && user.CreatedAt.Before(uf.CreatedSince) {
+		return false
+	}
+	if !uf.CreatedUntil.IsZero() && !user.CreatedAt.Before(uf.CreatedUntil) {
+		return false
+	}
+	if uf.EmailDomain != "" {
+		_, domain, _ := strings.Cut(user.Email, "@")
+		if domain != uf.EmailDomain {
+			return false
+		}
+	}
+	if uf.MinAccessLevel != nil && user.AccessLevel < *uf.MinAccessLevel {
+		return false
+	}
+	if uf.MaxAccessLevel != nil && user.AccessLevel > *uf.MaxAccessLevel {
+		return false
+	}
+	for key, value := range uf.CustomData {
+		if v, ok := user.CustomData[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// UserPage is a page of users returned by ListUsersByFilter().
+type UserPage struct {
+	Users      []*AuthUserRecord
+	NextOffset int // Offset of the next page, or -1 if this is the last one
+}
+
+// UserLister is implemented by storages which can list users. All the storages in
+// the `storage` package implement it.
+type UserLister interface {
+	// ListUsers returns the users matching the filter, ordered by ID (which is the
+	// creation order for IDs generated by NewAuthUserRecord()).
+	ListUsers(filter UserFilter) (UserPage, error)
+}
+
+// ListUsersByFilter returns a page of the users matching the filter, ordered by ID,
+// so admin tools can list users without backend-specific queries.
+func (mlc *AuthMagicLinkController) ListUsersByFilter(filter UserFilter) (page UserPage, err error) {
+	if err = filter.Validate(); err != nil {
+		return
+	}
+	ul, ok := mlc.db.(UserLister)
+	if !ok {
+		return UserPage{NextOffset: -1}, ErrUserListingNotSupported
+	}
+	return ul.ListUsers(filter)
+}
+
+// FilterUsers applies the filter to the users in memory, sorting them by ID and
+// returning the requested page. It's meant for storages which can't run the filter
+// natively.
+func FilterUsers(users []*AuthUserRecord, filter UserFilter) UserPage {
+	var matching []*AuthUserRecord
+	for _, user := range users {
+		if filter.Matches(user) {
+			matching = append(matching, user)
+		}
+	}
+	slices.SortFunc(matching, func(a, b *AuthUserRecord) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	page := UserPage{NextOffset: -1}
+	if filter.Offset >= len(matching) {
+		return page
+	}
+	matching = matching[filter.Offset:]
+	if filter.Limit > 0 && len(matching) > filter.Limit {
+		matching = matching[:filter.Limit]
+		page.NextOffset = filter.Offset + filter.Limit
+	}
+	page.Users = matching
+	return page
+}
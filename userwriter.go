@@ -0,0 +1,70 @@
+package gomagiclink
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// UserCreator is implemented by storages which can create user records, enforcing the
+// uniqueness of the IDs and e-mail addresses. All the storages in the `storage` package
+// implement it.
+type UserCreator interface {
+	CreateUser(user *AuthUserRecord) error // Returns ErrUserAlreadyExists if the ID or e-mail exists
+}
+
+// UserUpdater is implemented by storages which can update existing user records only.
+// All the storages in the `storage` package implement it.
+type UserUpdater interface {
+	UpdateUser(user *AuthUserRecord) error // Returns ErrUserNotFound if the user doesn't exist
+}
+
+// UserDeleter is implemented by storages which can delete user records. All the storages
+// in the `storage` package implement it.
+type UserDeleter interface {
+	DeleteUser(id uuid.UUID) error
+}
+
+var ErrUserDeletionNotSupported = errors.New("storage doesn't support deleting users")
+
+// CreateStoredUser creates the user record in the storage, returning ErrUserAlreadyExists
+// if a user with the same ID or e-mail address exists. Storages which aren't a
+// UserCreator are checked for existing users before StoreUser(), which isn't atomic, so
+// a user created concurrently, e.g. by another app instance, can be overwritten.
+func CreateStoredUser(db UserStorage, user *AuthUserRecord) error {
+	if uc, ok := db.(UserCreator); ok {
+		return uc.CreateUser(user)
+	}
+	if _, err := db.GetUserById(user.ID); err == nil {
+		return ErrUserAlreadyExists
+	} else if err != ErrUserNotFound {
+		return err
+	}
+	if db.UserExistsByEmail(user.Email) {
+		return ErrUserAlreadyExists
+	}
+	return db.StoreUser(user)
+}
+
+// UpdateStoredUser updates the existing user record in the storage, returning
+// ErrUserNotFound if it doesn't exist. Storages which aren't a UserUpdater are checked
+// for the record before StoreUser(), which isn't atomic, so a user deleted concurrently
+// can be created again.
+func UpdateStoredUser(db UserStorage, user *AuthUserRecord) error {
+	if uu, ok := db.(UserUpdater); ok {
+		return uu.UpdateUser(user)
+	}
+	if _, err := db.GetUserById(user.ID); err != nil {
+		return err
+	}
+	return db.StoreUser(user)
+}
+
+// DeleteStoredUser deletes the user record from the storage, if it's a UserDeleter, or
+// returns ErrUserDeletionNotSupported.
+func DeleteStoredUser(db UserStorage, id uuid.UUID) error {
+	if ud, ok := db.(UserDeleter); ok {
+		return ud.DeleteUser(id)
+	}
+	return ErrUserDeletionNotSupported
+}
@@ -0,0 +1,118 @@
+package gomagiclink_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// minimalStorage implements only gomagiclink.UserStorage.
+type minimalStorage struct {
+	lock  sync.Mutex
+	users map[uuid.UUID]gomagiclink.AuthUserRecord
+}
+
+func (st *minimalStorage) UserExistsByEmail(email string) bool {
+	_, err := st.GetUserByEmail(email)
+	return err == nil
+}
+
+func (st *minimalStorage) GetUserById(id uuid.UUID) (*gomagiclink.AuthUserRecord, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	user, ok := st.users[id]
+	if !ok {
+		return nil, gomagiclink.ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (st *minimalStorage) GetUserByEmail(email string) (*gomagiclink.AuthUserRecord, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for _, user := range st.users {
+		if strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+	return nil, gomagiclink.ErrUserNotFound
+}
+
+func (st *minimalStorage) StoreUser(user *gomagiclink.AuthUserRecord) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	user.Touch()
+	st.users[user.ID] = *user
+	return nil
+}
+
+func TestMinimalStorage(t *testing.T) {
+	mlc, err := gomagiclink.NewAuthMagicLinkController(newTestSecretKey(t), time.Hour, time.Hour, &minimalStorage{users: map[uuid.UUID]gomagiclink.AuthUserRecord{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := gomagiclink.NewAuthUserRecord("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.UpdateUser(user); err != gomagiclink.ErrUserNotFound {
+		t.Errorf("UpdateUser() of a new user = %v, want ErrUserNotFound", err)
+	}
+	if err = mlc.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.CreateUser(user); err != gomagiclink.ErrUserAlreadyExists {
+		t.Errorf("CreateUser() of an existing user = %v, want ErrUserAlreadyExists", err)
+	}
+	dup, err := gomagiclink.NewAuthUserRecord("USER@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.CreateUser(dup); err != gomagiclink.ErrUserAlreadyExists {
+		t.Errorf("CreateUser() with an existing e-mail address = %v, want ErrUserAlreadyExists", err)
+	}
+	user.AccessLevel = 5
+	if err = mlc.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err = mlc.InvalidateUserTokens(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := mlc.GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessLevel != 5 || stored.TokenEpoch != 1 {
+		t.Errorf("stored user: access level %d, epoch %d, want 5, 1", stored.AccessLevel, stored.TokenEpoch)
+	}
+	if err = mlc.DeleteUser(user.ID); err != gomagiclink.ErrUserDeletionNotSupported {
+		t.Errorf("DeleteUser() = %v, want ErrUserDeletionNotSupported", err)
+	}
+	if err = mlc.MergeUsers(user.ID, dup.ID, nil); err != gomagiclink.ErrUserDeletionNotSupported {
+		t.Errorf("MergeUsers() = %v, want ErrUserDeletionNotSupported", err)
+	}
+}
+
+func TestUserCacheCopies(t *testing.T) {
+	mlc, _, user := newTestController(t, gomagiclink.WithUserCache(time.Minute))
+	if _, _, err := mlc.EnrollTOTP(user, "test"); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := mlc.GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(cached.TOTPPendingSecret)
+	cached.TOTPPendingSecret[0] ^= 0xff
+	again, err := mlc.GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again.TOTPPendingSecret) != want {
+		t.Error("changing the TOTPPendingSecret of a record changed the cached one")
+	}
+}
@@ -1,9 +1,40 @@
 package gomagiclink
 
 import (
+	"errors"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// MaxEmailLength is the longest e-mail address accepted, as limited by RFC 5321.
+const MaxEmailLength = 254
+
+var ErrInvalidEmail = errors.New("invalid e-mail address")
+var ErrEmptyEmail = errors.New("empty e-mail address")
+
 func NormalizeEmail(email string) string {
 	return strings.ToLower(strings.TrimSpace(email))
 }
+
+// ValidateEmail checks that the normalized e-mail address can be safely embedded in
+// tokens: it must be valid UTF-8 (NormalizeEmail() replaces invalid bytes with U+FFFD,
+// which is rejected as well), at most MaxEmailLength bytes long, and free of control
+// characters (including NUL, which separates the fields of the signed payloads), line
+// separators and invisible formatting characters. Empty addresses (including those which
+// were only whitespace before normalization) are rejected with ErrEmptyEmail. It doesn't
+// check the address' syntax beyond that.
+func ValidateEmail(email string) error {
+	if strings.TrimSpace(email) == "" {
+		return ErrEmptyEmail
+	}
+	if len(email) > MaxEmailLength || !utf8.ValidString(email) {
+		return ErrInvalidEmail
+	}
+	for _, r := range email {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.In(r, unicode.Cf, unicode.Zl, unicode.Zp) {
+			return ErrInvalidEmail
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package gomagiclink
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of verified tokens, see TokenClaims.Kind.
+const (
+	TokenKindChallenge = "challenge"
+	TokenKindSession   = "session"
+)
+
+// TokenClaims are the claims embedded in a verified challenge or session ID.
+type TokenClaims struct {
+	Kind           string      // TokenKindChallenge or TokenKindSession
+	Header         TokenHeader // Version 0 for tokens without a header, and server-side sessions
+	Email          string      // For challenges
+	UserID         uuid.UUID   // For sessions
+	ExpTime        int64       // Unix timestamp, 0 if the token doesn't expire
+	ImpersonatorID uuid.UUID   // Set for impersonation sessions
+	Stale          bool        // Expired session within the grace window, see WithSessionGrace()
+	Stored         bool        // Server-side session, see WithSessionStore()
+	// Base64url thumbprint of the proof key, for tokens bound to one (see WithProofOfPossession())
+	ProofKeyThumbprint string
+	AppClaims          json.RawMessage // For sessions, the claims from the ClaimsProvider (see WithClaimsProvider())
+}
+
+// VerificationResult describes a successful verification in detail, see
+// VerifyChallengeDetailed() and VerifySessionIdDetailed().
+type VerificationResult struct {
+	User      *AuthUserRecord
+	IsNewUser bool      // The record was created by verifying the challenge, and hasn't been stored yet
+	IssuedAt  time.Time // Estimated from the expiration time and the duration, except for server-side sessions; zero if unknown
+	ExpiresAt time.Time // Zero if the token doesn't expire
+	Claims    TokenClaims
+}
+
+// ExpiresIn returns how long the token is valid for, 0 if it has expired (e.g. a
+// stale session), or -1 if it doesn't expire.
+func (vr *VerificationResult) ExpiresIn() time.Duration {
+	if vr.ExpiresAt.IsZero() {
+		return -1
+	}
+	return max(time.Until(vr.ExpiresAt), 0)
+}
+
+// VerifyChallengeDetailed is like VerifyChallengeWithRisk(), but returns the details
+// of the verification along with the user record, e.g. whether the user is new, so
+// the app can show a welcome page.
+func (mlc *AuthMagicLinkController) VerifyChallengeDetailed(challenge string, info RiskInfo) (res *VerificationResult, err error) {
+	res, err = mlc.verifyChallengeDetailed(challenge, "", info)
+	if err != nil {
+		mlc.audit(AuditEvent{Type: AuditLoginFailed, Details: map[string]string{"reason": err.Error()}})
+		return nil, err
+	}
+	mlc.audit(AuditEvent{Type: AuditLoginSucceeded, UserID: res.User.ID, Email: res.User.Email, Details: info.auditDetails()})
+	return res, nil
+}
+
+// challengeResult describes the verified challenge.
+func (mlc *AuthMagicLinkController) challengeResult(challenge string, pc parsedChallenge, user *AuthUserRecord, isNew bool) *VerificationResult {
+	header, _, _ := ParseTokenHeader(challenge)
+	res := &VerificationResult{
+		User:      user,
+		IsNewUser: isNew,
+		ExpiresAt: time.Unix(int64(pc.ExpTime), 0),
+		Claims: TokenClaims{
+			Kind:    TokenKindChallenge,
+			Header:  header,
+			Email:   pc.Email,
+			ExpTime: int64(pc.ExpTime),
+		},
+	}
+	res.IssuedAt = res.ExpiresAt.Add(-mlc.challengeExpDuration)
+	if pc.ProofKey != nil {
+		res.Claims.ProofKeyThumbprint = base64.RawURLEncoding.EncodeToString(pc.ProofKey)
+	}
+	return res
+}
+
+// VerifySessionIdDetailed is like VerifySessionId(), but returns the details of the
+// verification along with the user record, e.g. when the session expires, so the app
+// can refresh it ahead of time.
+func (mlc *AuthMagicLinkController) VerifySessionIdDetailed(sessionId string) (res *VerificationResult, err error) {
+	claims, err := mlc.parseSessionId(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ProofKey != nil {
+		return nil, ErrProofRequired
+	}
+	user, err := mlc.sessionUser(claims)
+	if err != nil {
+		return nil, err
+	}
+	res = &VerificationResult{
+		User:     user,
+		IssuedAt: claims.IssuedAt,
+		Claims: TokenClaims{
+			Kind:           TokenKindSession,
+			UserID:         claims.UserID,
+			ExpTime:        int64(claims.ExpTime),
+			ImpersonatorID: claims.ImpersonatorID,
+			Stale:          claims.Stale,
+			Stored:         claims.Stored,
+			AppClaims:      claims.Claims,
+		},
+	}
+	if !claims.Stored {
+		res.Claims.Header, _, _ = ParseTokenHeader(sessionId)
+	}
+	if claims.ExpTime != 0 {
+		res.ExpiresAt = time.Unix(int64(claims.ExpTime), 0)
+		if res.IssuedAt.IsZero() && claims.ImpersonatorID == uuid.Nil && mlc.sessionExpDuration > 0 {
+			res.IssuedAt = res.ExpiresAt.Add(-mlc.sessionExpDuration)
+		}
+	}
+	return res, nil
+}
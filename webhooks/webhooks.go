@@ -0,0 +1,268 @@
+// Package webhooks delivers gomagiclink audit events to HTTP endpoints as signed JSON payloads.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivoras/gomagiclink"
+)
+
+// Headers set on webhook requests.
+const (
+	SignatureHeader = "X-Magiclink-Signature" // "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">"
+	EventHeader     = "X-Magiclink-Event"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+var ErrDispatcherClosed = errors.New("webhook dispatcher closed")
+
+// Endpoint is a customer-provided URL receiving webhooks.
+type Endpoint struct {
+	URL    string
+	Secret []byte   // Key for the signature header
+	Events []string // Event types to deliver, e.g. gomagiclink.AuditLoginSucceeded; empty for all
+}
+
+// Payload is the JSON body of a webhook request.
+type Payload struct {
+	ID    string                 `json:"id"` // Unique per event, for deduplicating retried deliveries
+	Type  string                 `json:"type"`
+	Time  time.Time              `json:"time"`
+	Event gomagiclink.AuditEvent `json:"event"`
+}
+
+// Options configures the Dispatcher. Zero values are replaced by defaults.
+type Options struct {
+	MaxAttempts int           // Delivery attempts per event and endpoint, default 5
+	Backoff     time.Duration // Delay before the first retry, doubled for each following one, default 1s
+	QueueSize   int           // Events waiting for delivery, default 1000; further events are dropped
+	Workers     int           // Concurrent deliveries, default 4
+	Client      *http.Client  // Default has a 10s timeout
+	Logger      *slog.Logger  // Receives delivery failures; default doesn't log
+}
+
+type delivery struct {
+	endpoint *Endpoint
+	body     []byte
+	payload  *Payload
+}
+
+// Dispatcher is a gomagiclink.AuditLogger which POSTs the events to the endpoints
+// in the background, with retries and exponential backoff. Install it with
+// gomagiclink.WithAuditLogger(), combined with other AuditLoggers using
+// gomagiclink.MultiAuditLogger if needed. Call Shutdown() before the process exits,
+// to deliver the queued events.
+type Dispatcher struct {
+	endpoints []Endpoint
+	opts      Options
+	queue     chan delivery
+	wg        sync.WaitGroup
+	lock      sync.RWMutex
+	closed    bool
+	stop      chan struct{}
+}
+
+// NewDispatcher creates a Dispatcher and starts its workers.
+func NewDispatcher(endpoints []Endpoint, opts Options) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	d := &Dispatcher{
+		endpoints: endpoints,
+		opts:      opts,
+		queue:     make(chan delivery, opts.QueueSize),
+		stop:      make(chan struct{}),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// LogAuditEvent queues the event for delivery to the endpoints subscribed to its type.
+func (d *Dispatcher) LogAuditEvent(ev gomagiclink.AuditEvent) {
+	payload := &Payload{ID: uuid.NewString(), Type: ev.Type, Time: ev.Time, Event: ev}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.logError("Error encoding webhook payload", payload, nil, err)
+		return
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return
+	}
+	for i := range d.endpoints {
+		ep := &d.endpoints[i]
+		if len(ep.Events) > 0 && !slices.Contains(ep.Events, ev.Type) {
+			continue
+		}
+		select {
+		case d.queue <- delivery{endpoint: ep, body: body, payload: payload}:
+		default:
+			d.logError("Webhook queue full, dropping event", payload, ep, nil)
+		}
+	}
+}
+
+// Shutdown stops accepting events and waits for the queued ones to be delivered, or
+// until the context is done, in which case pending retries are abandoned.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return ErrDispatcherClosed
+	}
+	d.closed = true
+	close(d.queue)
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(d.stop)
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for dl := range d.queue {
+		d.deliver(dl)
+	}
+}
+
+// deliver sends the payload, retrying on network errors, 429 and 5xx responses.
+func (d *Dispatcher) deliver(dl delivery) {
+	backoff := d.opts.Backoff
+	var err error
+	for attempt := 1; attempt <= d.opts.MaxAttempts; attempt++ {
+		var retry bool
+		retry, err = d.send(dl)
+		if err == nil || !retry {
+			break
+		}
+		if attempt == d.opts.MaxAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-d.stop:
+			d.logError("Webhook delivery abandoned", dl.payload, dl.endpoint, err)
+			return
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		d.logError("Webhook delivery failed", dl.payload, dl.endpoint, err)
+	}
+}
+
+func (d *Dispatcher) send(dl delivery) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, dl.endpoint.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, dl.payload.Type)
+	req.Header.Set(SignatureHeader, Sign(dl.endpoint.Secret, time.Now(), dl.body))
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook endpoint returned %s", resp.Status)
+}
+
+func (d *Dispatcher) logError(msg string, payload *Payload, ep *Endpoint, err error) {
+	if d.opts.Logger == nil {
+		return
+	}
+	attrs := []any{"event_id", payload.ID, "type", payload.Type}
+	if ep != nil {
+		attrs = append(attrs, "url", ep.URL)
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	d.opts.Logger.Error(msg, attrs...)
+}
+
+func signature(secret []byte, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Sign returns the value of the signature header for the body, sent at time t.
+func Sign(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(signature(secret, ts, body))
+}
+
+// VerifySignature checks the signature header of a received webhook, rejecting
+// signatures older than tolerance (to prevent replays), unless it's 0.
+func VerifySignature(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var sig []byte
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig, _ = hex.DecodeString(v)
+		}
+	}
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == nil {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(t, 0)) > tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal(sig, signature(secret, ts, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package gomagiclink
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const loginCodePurpose = "login-code"
+
+// LoginCodeDigits is the length of the login codes generated by GenerateChallengeWithCode().
+const LoginCodeDigits = 6
+
+// MaxLoginCodeAttempts is the number of wrong login codes accepted for an e-mail address,
+// after which all its outstanding challenges (and their codes) are invalidated.
+const MaxLoginCodeAttempts = 5
+
+var ErrNoChallengeStore = errors.New("no challenge store configured")
+var ErrInvalidLoginCode = errors.New("invalid login code")
+var ErrInvalidWebOTPHost = errors.New("invalid WebOTP host")
+
+// GenerateChallengeWithCode is like GenerateChallengeWithReceipt(), but also returns a
+// numeric login code, which the user can type (or have autofilled, see WebOTPMessage())
+// instead of opening the magic link, e.g. when they read the message on another device.
+// The code is verified with VerifyLoginCode(). It requires a ChallengeStore.
+func (mlc *AuthMagicLinkController) GenerateChallengeWithCode(email string, meta ChallengeMetadata) (challenge string, code string, receipt *ChallengeReceipt, err error) {
+	if mlc.challengeStore == nil {
+		return "", "", nil, ErrNoChallengeStore
+	}
+	challenge, receipt, err = mlc.generateChallenge(email, RiskInfo{}, meta, nil)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return challenge, mlc.loginCode(mlc.keys.challenge, challenge), receipt, nil
+}
+
+// loginCode derives the login code from the challenge with the key, so it doesn't need
+// to be stored.
+func (mlc *AuthMagicLinkController) loginCode(key []byte, challenge string) string {
+	sum := mlc.macWith(MACHMACSHA256, key, signPayload(loginCodePurpose, []byte(challenge)))
+	return fmt.Sprintf("%0*d", LoginCodeDigits, binary.BigEndian.Uint64(sum)%1000000)
+}
+
+// loginCodeMatches checks the code against the one derived from the challenge, and the
+// one derived with the legacy key, unless it's disabled.
+func (mlc *AuthMagicLinkController) loginCodeMatches(challenge string, code string) bool {
+	if subtle.ConstantTimeCompare([]byte(mlc.loginCode(mlc.keys.challenge, challenge)), []byte(code)) == 1 {
+		return true
+	}
+	return mlc.keys.legacy != nil && subtle.ConstantTimeCompare([]byte(mlc.loginCode(mlc.keys.legacy, challenge)), []byte(code)) == 1
+}
+
+// VerifyLoginCode verifies a login code from GenerateChallengeWithCode(), for the e-mail
+// address the user entered. It's like VerifyChallengeWithRisk() for the challenge the
+// code belongs to, which is then used up. As the codes are short, each wrong code counts
+// against the address, and after MaxLoginCodeAttempts of them all the outstanding
+// challenges for the address are invalidated, and the user needs to request a new one.
+func (mlc *AuthMagicLinkController) VerifyLoginCode(email string, code string, info RiskInfo) (user *AuthUserRecord, err error) {
+	user, err = mlc.verifyLoginCode(NormalizeEmail(email), strings.TrimSpace(code), info)
+	if err != nil {
+		mlc.audit(AuditEvent{Type: AuditLoginFailed, Email: NormalizeEmail(email), Details: map[string]string{"reason": err.Error()}})
+		return nil, err
+	}
+	mlc.audit(AuditEvent{Type: AuditLoginSucceeded, UserID: user.ID, Email: user.Email, Details: info.auditDetails()})
+	return user, nil
+}
+
+func (mlc *AuthMagicLinkController) verifyLoginCode(email string, code string, info RiskInfo) (user *AuthUserRecord, err error) {
+	if mlc.challengeStore == nil {
+		return nil, ErrNoChallengeStore
+	}
+	recs, err := mlc.challengeStore.GetChallengesByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		if mlc.loginCodeMatches(rec.Challenge, code) {
+			mlc.resetLoginCodeAttempts(email)
+			return mlc.verifyChallenge(rec.Challenge, email, info)
+		}
+	}
+	if mlc.countLoginCodeAttempt(email) {
+		for _, rec := range recs {
+			if err = mlc.challengeStore.RemoveChallenge(rec.ID); err != nil && err != ErrChallengeNotFound {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrInvalidLoginCode
+}
+
+// maxLoginCodeAttemptEntries is the number of e-mail addresses for which the wrong login
+// codes are counted at a time.
+const maxLoginCodeAttemptEntries = 10000
+
+// loginCodeAttempts is the count of wrong login codes for an e-mail address.
+type loginCodeAttempts struct {
+	count int
+	until time.Time // When the count is forgotten
+}
+
+// countLoginCodeAttempt records a wrong login code for the e-mail address, and returns
+// true (and starts counting anew) when the limit is reached. The count is kept until
+// the challenges outstanding at the time expire. As the addresses come from the
+// requests, the counts are limited to maxLoginCodeAttemptEntries addresses; when there
+// are too many, the limit is considered reached for new ones.
+func (mlc *AuthMagicLinkController) countLoginCodeAttempt(email string) bool {
+	mlc.loginCodeLock.Lock()
+	defer mlc.loginCodeLock.Unlock()
+	if mlc.loginCodeAttempts == nil {
+		mlc.loginCodeAttempts = map[string]*loginCodeAttempts{}
+	}
+	now := time.Now()
+	a := mlc.loginCodeAttempts[email]
+	if a != nil && a.until.Before(now) {
+		a = nil
+	}
+	if a == nil {
+		if len(mlc.loginCodeAttempts) >= maxLoginCodeAttemptEntries {
+			for key, a := range mlc.loginCodeAttempts {
+				if a.until.Before(now) {
+					delete(mlc.loginCodeAttempts, key)
+				}
+			}
+			if len(mlc.loginCodeAttempts) >= maxLoginCodeAttemptEntries {
+				return true
+			}
+		}
+		a = &loginCodeAttempts{}
+		mlc.loginCodeAttempts[email] = a
+	}
+	a.count++
+	a.until = now.Add(mlc.challengeExpDuration)
+	if a.count < MaxLoginCodeAttempts {
+		return false
+	}
+	delete(mlc.loginCodeAttempts, email)
+	return true
+}
+
+func (mlc *AuthMagicLinkController) resetLoginCodeAttempts(email string) {
+	mlc.loginCodeLock.Lock()
+	defer mlc.loginCodeLock.Unlock()
+	delete(mlc.loginCodeAttempts, email)
+}
+
+// WebOTPMessage formats an SMS with a login code so that browsers supporting the WebOTP
+// API (and the "one-time-code" autocomplete of the code input field) can fill the code
+// in automatically: the text is followed by the origin-bound last line, "@host #code".
+// The host is the host name of the site with the code input field, without the scheme
+// and port, e.g. "example.com".
+func WebOTPMessage(text string, host string, code string) (string, error) {
+	if host == "" || strings.ContainsAny(host, " \t\r\n@#/:") {
+		return "", ErrInvalidWebOTPHost
+	}
+	text = strings.TrimRight(text, " \t\r\n")
+	if text != "" {
+		text += "\n\n"
+	}
+	return text + "@" + host + " #" + code, nil
+}
@@ -0,0 +1,58 @@
+package gomagiclink
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCountLoginCodeAttempt(t *testing.T) {
+	mlc := &AuthMagicLinkController{challengeExpDuration: time.Minute}
+	for i := 1; i < MaxLoginCodeAttempts; i++ {
+		if mlc.countLoginCodeAttempt("user@example.com") {
+			t.Fatalf("limit reached after %d wrong codes", i)
+		}
+	}
+	if !mlc.countLoginCodeAttempt("user@example.com") {
+		t.Fatalf("limit not reached after %d wrong codes", MaxLoginCodeAttempts)
+	}
+	if _, ok := mlc.loginCodeAttempts["user@example.com"]; ok {
+		t.Error("the count is kept after the limit is reached")
+	}
+
+	// Counts older than the challenges are forgotten
+	for i := 1; i < MaxLoginCodeAttempts; i++ {
+		mlc.countLoginCodeAttempt("user@example.com")
+	}
+	mlc.loginCodeAttempts["user@example.com"].until = time.Now().Add(-time.Second)
+	if mlc.countLoginCodeAttempt("user@example.com") {
+		t.Error("limit reached with an expired count")
+	}
+	if n := mlc.loginCodeAttempts["user@example.com"].count; n != 1 {
+		t.Errorf("count after expiry = %d, want 1", n)
+	}
+
+	// The number of addresses is limited, and expired ones are pruned
+	for i := len(mlc.loginCodeAttempts); i < maxLoginCodeAttemptEntries; i++ {
+		mlc.countLoginCodeAttempt("user" + strconv.Itoa(i) + "@example.com")
+	}
+	if !mlc.countLoginCodeAttempt("new@example.com") {
+		t.Error("limit not reached for a new address with too many counted")
+	}
+	if !mlc.countLoginCodeAttempt("new@example.com") {
+		t.Error("limit not reached for a new address with too many counted, again")
+	}
+	if mlc.countLoginCodeAttempt("user@example.com") {
+		t.Error("limit reached for a counted address with too many counted")
+	}
+	mlc.loginCodeAttempts["user1@example.com"].until = time.Now().Add(-time.Second)
+	if mlc.countLoginCodeAttempt("new@example.com") {
+		t.Error("limit reached for a new address after an expired one")
+	}
+	if _, ok := mlc.loginCodeAttempts["user1@example.com"]; ok {
+		t.Error("expired count not pruned")
+	}
+	if len(mlc.loginCodeAttempts) > maxLoginCodeAttemptEntries {
+		t.Errorf("%d addresses counted, want at most %d", len(mlc.loginCodeAttempts), maxLoginCodeAttemptEntries)
+	}
+}
@@ -0,0 +1,218 @@
+package gomagiclink
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// writeBehind buffers the records passed to StoreUser(), see WithWriteBehind().
+type writeBehind struct {
+	interval  time.Duration
+	lock      sync.Mutex
+	pending   map[uuid.UUID]*AuthUserRecord // Records waiting for the next flush, the latest one per user
+	flushing  map[uuid.UUID]*AuthUserRecord // Records being written by the running flush
+	flushLock sync.Mutex                    // Serializes the flushes
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// WithWriteBehind makes StoreUser() buffer the records in memory and write them to the
+// storage in the background every interval, instead of on every call. Repeated writes of
+// the same user between the flushes are coalesced into one, so it's meant for apps which
+// store the user record often, e.g. on every page view. The records are written through
+// UpdateUser() and CreateUser() as with synchronous StoreUser() calls.
+//
+// The controller reads its own buffered records, so it sees the latest state, but other
+// instances sharing the storage (and the user listing functions) don't see them until
+// they're flushed. A failed write is logged and retried on the next flush, unless it's
+// been superseded by a newer one. The other functions changing the user records
+// (CreateUser(), UpdateUser(), DeleteUser()...) write the user's buffered record first,
+// and are synchronous. Call Close() on shutdown to flush the buffer.
+func WithWriteBehind(interval time.Duration) ControllerOption {
+	return func(mlc *AuthMagicLinkController) {
+		if interval <= 0 {
+			mlc.writeBehind = nil
+			return
+		}
+		mlc.writeBehind = &writeBehind{
+			interval: interval,
+			pending:  map[uuid.UUID]*AuthUserRecord{},
+			flushing: map[uuid.UUID]*AuthUserRecord{},
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// startWriteBehind runs the background flushes.
+func (mlc *AuthMagicLinkController) startWriteBehind() {
+	wb := mlc.writeBehind
+	go func() {
+		defer close(wb.done)
+		ticker := time.NewTicker(wb.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mlc.FlushWrites()
+			case <-wb.stop:
+				return
+			}
+		}
+	}()
+}
+
+// buffer adds a copy of the record to the buffer, replacing the user's previous one.
+func (wb *writeBehind) buffer(user *AuthUserRecord) {
+	user.GetID()
+	user.Touch()
+	wb.lock.Lock()
+	wb.pending[user.ID] = user.clone()
+	wb.lock.Unlock()
+}
+
+// keepTokenEpoch sets the TokenEpoch of the user's buffered record to the stored
+// record's, if it's larger, see AuthMagicLinkController.modifyUser(). A record being
+// flushed gets it when it's written.
+func (wb *writeBehind) keepTokenEpoch(stored *AuthUserRecord) {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	if user, ok := wb.pending[stored.ID]; ok {
+		user = user.clone()
+		user.keepTokenEpoch(stored)
+		wb.pending[stored.ID] = user
+	}
+}
+
+// getPending returns a copy of the user's record waiting for the next flush, or nil.
+// Unlike the record being flushed, it has the user's current TokenEpoch.
+func (wb *writeBehind) getPending(id uuid.UUID) *AuthUserRecord {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	if user, ok := wb.pending[id]; ok {
+		return user.clone()
+	}
+	return nil
+}
+
+// get returns a copy of the user's buffered record, or nil.
+func (wb *writeBehind) get(id uuid.UUID) *AuthUserRecord {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	if user, ok := wb.pending[id]; ok {
+		return user.clone()
+	}
+	if user, ok := wb.flushing[id]; ok {
+		return user.clone()
+	}
+	return nil
+}
+
+// getByEmail returns a copy of the buffered record with the e-mail address, or nil.
+func (wb *writeBehind) getByEmail(email string) *AuthUserRecord {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	for _, m := range []map[uuid.UUID]*AuthUserRecord{wb.pending, wb.flushing} {
+		for _, user := range m {
+			if user.Email == email {
+				return user.clone()
+			}
+		}
+	}
+	return nil
+}
+
+// FlushWrites writes the records buffered by StoreUser() to the storage, see
+// WithWriteBehind(). The records which failed to be written stay in the buffer, and the
+// first error is returned. It does nothing if write-behind isn't enabled.
+func (mlc *AuthMagicLinkController) FlushWrites() error {
+	wb := mlc.writeBehind
+	if wb == nil {
+		return nil
+	}
+	wb.flushLock.Lock()
+	defer wb.flushLock.Unlock()
+	wb.lock.Lock()
+	wb.flushing, wb.pending = wb.pending, map[uuid.UUID]*AuthUserRecord{}
+	batch := wb.flushing
+	wb.lock.Unlock()
+
+	var firstErr error
+	for id, user := range batch {
+		if err := mlc.writeBuffered(id, user); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flushUser synchronously writes the user's buffered record, if there is one.
+func (mlc *AuthMagicLinkController) flushUser(id uuid.UUID) error {
+	wb := mlc.writeBehind
+	if wb == nil {
+		return nil
+	}
+	wb.flushLock.Lock()
+	defer wb.flushLock.Unlock()
+	wb.lock.Lock()
+	user, ok := wb.pending[id]
+	if ok {
+		delete(wb.pending, id)
+		wb.flushing[id] = user
+	}
+	wb.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return mlc.writeBuffered(id, user)
+}
+
+// writeBuffered writes a record from the flushing set to the storage. If it fails, the
+// record is put back into the buffer, unless there's a newer one.
+func (mlc *AuthMagicLinkController) writeBuffered(id uuid.UUID, user *AuthUserRecord) error {
+	wb := mlc.writeBehind
+	err := mlc.storeUserNow(user.clone())
+	wb.lock.Lock()
+	if _, superseded := wb.pending[id]; err != nil && !superseded {
+		wb.pending[id] = user
+	}
+	delete(wb.flushing, id)
+	wb.lock.Unlock()
+	if err != nil {
+		mlc.logger.Error("Can't write buffered user record", "user_id", id, "error", err)
+	}
+	return err
+}
+
+// Close stops the background flushes started by WithWriteBehind(), and writes the
+// buffered records, returning the first error. Call it on shutdown, after the HTTP
+// server has stopped. StoreUser() is synchronous after Close().
+func (mlc *AuthMagicLinkController) Close() error {
+	wb := mlc.writeBehind
+	if wb == nil {
+		return nil
+	}
+	wb.closeOnce.Do(func() {
+		close(wb.stop)
+		<-wb.done
+	})
+	return mlc.FlushWrites()
+}
+
+func (wb *writeBehind) closed() bool {
+	select {
+	case <-wb.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (wb *writeBehind) hasPending() bool {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	return len(wb.pending) > 0 || len(wb.flushing) > 0
+}